@@ -0,0 +1,507 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	adminLogLevelURL = "/loglevel"
+	adminCaptureURL  = "/capture"
+
+	// defaultCaptureDuration is how long a capture runs for if no duration is given
+	defaultCaptureDuration = time.Duration(5) * time.Minute
+	// maxCaptureDuration is the longest a capture can run for
+	maxCaptureDuration = time.Duration(1) * time.Hour
+	// maxCaptureBodySize is the amount of the request and response body captured
+	maxCaptureBodySize = 64 * 1024
+)
+
+//
+// logLevelRequest is the body of a log level change
+//
+type logLevelRequest struct {
+	// Level is the log level to switch to
+	Level string `json:"level"`
+	// Duration is how long before reverting to the previous level, zero is permanent
+	Duration string `json:"duration,omitempty"`
+}
+
+//
+// captureRule is a time-boxed capture of the requests for a path or subject
+//
+type captureRule struct {
+	// Path is the path prefix to capture
+	Path string `json:"path,omitempty"`
+	// Subject is the id or email of the user to capture
+	Subject string `json:"subject,omitempty"`
+	// Duration is how long the capture runs for
+	Duration string `json:"duration,omitempty"`
+	// Expires is the time the capture stops
+	Expires time.Time `json:"expires"`
+}
+
+//
+// requestCapture holds the active capture rules
+//
+type requestCapture struct {
+	sync.RWMutex
+	// the active rules
+	rules []*captureRule
+}
+
+//
+// captureWriter records the response body as it's written to the client
+//
+type captureWriter struct {
+	gin.ResponseWriter
+	// the captured body
+	body bytes.Buffer
+}
+
+// logLevelReset is used to revert a time-boxed change to the log level
+var logLevelReset struct {
+	sync.Mutex
+	timer *time.Timer
+}
+
+//
+// newRequestCapture creates a empty capture
+//
+func newRequestCapture() *requestCapture {
+	return &requestCapture{}
+}
+
+//
+// add places a rule into the capture
+//
+func (r *requestCapture) add(rule *captureRule) {
+	r.Lock()
+	defer r.Unlock()
+	r.rules = append(r.active(time.Now()), rule)
+}
+
+//
+// clear removes all the rules
+//
+func (r *requestCapture) clear() {
+	r.Lock()
+	defer r.Unlock()
+	r.rules = nil
+}
+
+//
+// list returns the active rules
+//
+func (r *requestCapture) list() []*captureRule {
+	r.RLock()
+	defer r.RUnlock()
+	return r.active(time.Now())
+}
+
+//
+// active filters out the expired rules, the lock must be held
+//
+func (r *requestCapture) active(now time.Time) []*captureRule {
+	list := make([]*captureRule, 0)
+	for _, x := range r.rules {
+		if x.Expires.After(now) {
+			list = append(list, x)
+		}
+	}
+
+	return list
+}
+
+//
+// isEnabled checks if any capture is active
+//
+func (r *requestCapture) isEnabled() bool {
+	return len(r.list()) > 0
+}
+
+//
+// matches checks if the request for the path and subject should be captured
+//
+func (r *requestCapture) matches(path string, user *userContext) bool {
+	for _, x := range r.list() {
+		if x.Path != "" && !strings.HasPrefix(path, x.Path) {
+			continue
+		}
+		if x.Subject != "" && (user == nil || (x.Subject != user.id && x.Subject != user.email)) {
+			continue
+		}
+		return true
+	}
+
+	return false
+}
+
+//
+// Write records the response body up to the capture limit
+//
+func (r *captureWriter) Write(content []byte) (int, error) {
+	if remaining := maxCaptureBodySize - r.body.Len(); remaining > 0 {
+		if len(content) < remaining {
+			remaining = len(content)
+		}
+		r.body.Write(content[:remaining])
+	}
+
+	return r.ResponseWriter.Write(content)
+}
+
+//
+// WriteString records the response body up to the capture limit
+//
+func (r *captureWriter) WriteString(content string) (int, error) {
+	return r.Write([]byte(content))
+}
+
+//
+// captureMiddleware logs the full request and response for any requests matching an active capture
+//
+func (r *oauthProxy) captureMiddleware() gin.HandlerFunc {
+	return func(cx *gin.Context) {
+		if !r.capture.isEnabled() {
+			cx.Next()
+			return
+		}
+
+		// step: take a copy of the head of the request body, leaving the body intact for the upstream
+		var requestBody []byte
+		if cx.Request.Body != nil {
+			head, err := ioutil.ReadAll(io.LimitReader(cx.Request.Body, maxCaptureBodySize))
+			if err == nil {
+				requestBody = head
+				cx.Request.Body = &readCloser{Reader: io.MultiReader(bytes.NewReader(head), cx.Request.Body), Closer: cx.Request.Body}
+			}
+		}
+		path := cx.Request.URL.Path
+		requestHeaders := redactHeaders(cx.Request.Header)
+
+		writer := &captureWriter{ResponseWriter: cx.Writer}
+		cx.Writer = writer
+
+		cx.Next()
+
+		var user *userContext
+		if uc, found := cx.Get(userContextName); found {
+			user = uc.(*userContext)
+		}
+		if !r.capture.matches(path, user) {
+			return
+		}
+
+		// step: the login form, the callback and the tokens of the auth endpoints are never captured
+		requestContent := redactedValue
+		responseContent := redactedValue
+		if !strings.HasPrefix(path, oauthURL) {
+			requestContent = redactCaptureBody(cx.Request.Header.Get("Content-Type"), requestBody)
+			responseContent = redactCaptureBody(writer.Header().Get("Content-Type"), writer.body.Bytes())
+		}
+		fields := log.Fields{
+			"capture":          true,
+			"client_ip":        cx.ClientIP(),
+			"method":           cx.Request.Method,
+			"path":             path,
+			"query":            redactQueryParams(cx.Request.URL.Query(), defaultRedactedQueryParams),
+			"request_headers":  requestHeaders,
+			"request_body":     requestContent,
+			"status":           writer.Status(),
+			"response_headers": redactHeaders(writer.Header()),
+			"response_body":    responseContent,
+		}
+		if user != nil {
+			fields["subject"] = user.id
+			fields["email"] = user.email
+		}
+
+		log.WithFields(fields).Infof("captured request: %s %s", cx.Request.Method, path)
+	}
+}
+
+//
+// redactCaptureBody redacts the credentials within the form and json bodies; a body which can't be parsed, i.e. one
+// truncated by the capture limit, is redacted in full
+//
+func redactCaptureBody(contentType string, content []byte) string {
+	if len(content) <= 0 {
+		return ""
+	}
+	media, _, _ := mime.ParseMediaType(contentType)
+	switch {
+	case media == "application/x-www-form-urlencoded":
+		values, err := url.ParseQuery(string(content))
+		if err != nil {
+			return redactedValue
+		}
+		for k := range values {
+			if isCaptureCredential(k) {
+				for i := range values[k] {
+					values[k][i] = redactedValue
+				}
+			}
+		}
+		return values.Encode()
+	case media == "application/json" || strings.HasSuffix(media, "+json"):
+		var decoded interface{}
+		if err := json.Unmarshal(content, &decoded); err != nil {
+			return redactedValue
+		}
+		encoded, err := json.Marshal(redactCaptureValue(decoded))
+		if err != nil {
+			return redactedValue
+		}
+		return string(encoded)
+	}
+
+	return string(content)
+}
+
+//
+// redactCaptureValue redacts the values of the credential fields within the decoded json
+//
+func redactCaptureValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for k, x := range v {
+			if isCaptureCredential(k) {
+				v[k] = redactedValue
+				continue
+			}
+			v[k] = redactCaptureValue(x)
+		}
+	case []interface{}:
+		for i, x := range v {
+			v[i] = redactCaptureValue(x)
+		}
+	}
+
+	return value
+}
+
+//
+// isCaptureCredential checks if the field of a captured body holds a credential
+//
+func isCaptureCredential(name string) bool {
+	name = strings.ToLower(name)
+	for _, x := range []string{"password", "secret", "token", "assertion", "credential"} {
+		if strings.Contains(name, x) {
+			return true
+		}
+	}
+
+	return containedIn(name, defaultRedactedQueryParams)
+}
+
+//
+// createAdminEndpoints creates the router for the admin api
+//
+func (r *oauthProxy) createAdminEndpoints() {
+	engine := gin.New()
+	engine.Use(gin.Recovery(), r.adminAuthMiddleware())
+	engine.GET(adminLogLevelURL, r.adminGetLogLevelHandler)
+	engine.PUT(adminLogLevelURL, r.adminSetLogLevelHandler)
+	engine.GET(adminCaptureURL, r.adminListCaptureHandler)
+	engine.POST(adminCaptureURL, r.adminAddCaptureHandler)
+	engine.DELETE(adminCaptureURL, r.adminClearCaptureHandler)
+	engine.GET(versionURL, r.versionHandler)
+
+	r.adminRouter = engine
+}
+
+//
+// adminAuthMiddleware checks the admin token, refusing every request should there be no token
+//
+func (r *oauthProxy) adminAuthMiddleware() gin.HandlerFunc {
+	expected := []byte("Bearer " + r.config.AdminToken)
+
+	return func(cx *gin.Context) {
+		if r.config.AdminToken == "" || subtle.ConstantTimeCompare([]byte(cx.Request.Header.Get(authorizationHeader)), expected) != 1 {
+			log.WithFields(log.Fields{
+				"client_ip": cx.ClientIP(),
+				"path":      cx.Request.URL.Path,
+			}).Warnf("unauthorized request to the admin api")
+
+			cx.AbortWithStatus(http.StatusUnauthorized)
+		}
+	}
+}
+
+//
+// adminGetLogLevelHandler returns the current log level
+//
+func (r *oauthProxy) adminGetLogLevelHandler(cx *gin.Context) {
+	cx.JSON(http.StatusOK, logLevelRequest{Level: log.GetLevel().String()})
+}
+
+//
+// adminSetLogLevelHandler changes the log level, optionally reverting after a duration
+//
+func (r *oauthProxy) adminSetLogLevelHandler(cx *gin.Context) {
+	request := logLevelRequest{}
+	if err := cx.BindJSON(&request); err != nil {
+		return
+	}
+	level, err := log.ParseLevel(request.Level)
+	if err != nil {
+		cx.String(http.StatusBadRequest, "%s\n", err)
+		return
+	}
+	var duration time.Duration
+	if request.Duration != "" {
+		if duration, err = time.ParseDuration(request.Duration); err != nil || duration <= 0 {
+			cx.String(http.StatusBadRequest, "invalid duration: %s\n", request.Duration)
+			return
+		}
+	}
+
+	previous := log.GetLevel()
+	log.WithFields(log.Fields{
+		"client_ip": cx.ClientIP(),
+		"previous":  previous.String(),
+		"level":     level.String(),
+		"duration":  request.Duration,
+	}).Warnf("changing the log level to: %s", level)
+
+	logLevelReset.Lock()
+	defer logLevelReset.Unlock()
+	if logLevelReset.timer != nil {
+		logLevelReset.timer.Stop()
+		logLevelReset.timer = nil
+	}
+	log.SetLevel(level)
+	if duration > 0 {
+		logLevelReset.timer = time.AfterFunc(duration, func() {
+			log.SetLevel(previous)
+			log.Warnf("reverted the log level to: %s", previous)
+		})
+	}
+
+	cx.JSON(http.StatusOK, logLevelRequest{Level: level.String(), Duration: request.Duration})
+}
+
+//
+// adminListCaptureHandler lists the active captures
+//
+func (r *oauthProxy) adminListCaptureHandler(cx *gin.Context) {
+	cx.JSON(http.StatusOK, r.capture.list())
+}
+
+//
+// adminAddCaptureHandler adds a time-boxed capture for a path or subject
+//
+func (r *oauthProxy) adminAddCaptureHandler(cx *gin.Context) {
+	rule := &captureRule{}
+	if err := cx.BindJSON(rule); err != nil {
+		return
+	}
+	if rule.Path == "" && rule.Subject == "" {
+		cx.String(http.StatusBadRequest, "the capture requires a path or subject\n")
+		return
+	}
+	duration := defaultCaptureDuration
+	if rule.Duration != "" {
+		var err error
+		if duration, err = time.ParseDuration(rule.Duration); err != nil || duration <= 0 {
+			cx.String(http.StatusBadRequest, "invalid duration: %s\n", rule.Duration)
+			return
+		}
+	}
+	if duration > maxCaptureDuration {
+		cx.String(http.StatusBadRequest, "the capture duration can not exceed %s\n", maxCaptureDuration)
+		return
+	}
+	rule.Duration = duration.String()
+	rule.Expires = time.Now().Add(duration)
+	r.capture.add(rule)
+
+	log.WithFields(log.Fields{
+		"client_ip": cx.ClientIP(),
+		"path":      rule.Path,
+		"subject":   rule.Subject,
+		"expires":   rule.Expires.Format(time.RFC3339),
+	}).Warnf("enabled the request capture for %s", rule.Duration)
+
+	cx.JSON(http.StatusCreated, rule)
+}
+
+//
+// adminClearCaptureHandler removes all the captures
+//
+func (r *oauthProxy) adminClearCaptureHandler(cx *gin.Context) {
+	r.capture.clear()
+	log.WithFields(log.Fields{
+		"client_ip": cx.ClientIP(),
+	}).Warnf("cleared all the request captures")
+
+	cx.AbortWithStatus(http.StatusNoContent)
+}
+
+//
+// runAdmin starts the admin api listener
+//
+func (r *oauthProxy) runAdmin() error {
+	listener, err := net.Listen("tcp", r.config.ListenAdmin)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		log.Infof("keycloak proxy admin api starting on %s", r.config.ListenAdmin)
+		if err := http.Serve(listener, r.adminRouter); err != nil {
+			log.WithFields(log.Fields{
+				"error": err.Error(),
+			}).Fatalf("failed to start the admin api")
+		}
+	}()
+
+	return nil
+}
+
+//
+// redactHeaders returns a copy of the headers with any credentials redacted
+//
+func redactHeaders(headers http.Header) map[string]string {
+	list := make(map[string]string, len(headers))
+	for k, v := range headers {
+		list[k] = redactHeader(k, strings.Join(v, ","))
+	}
+
+	return list
+}
+
+// readCloser joins a reader with the closer of the original body
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
@@ -0,0 +1,163 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequestCaptureMatches(t *testing.T) {
+	capture := newRequestCapture()
+	assert.False(t, capture.isEnabled())
+
+	capture.add(&captureRule{Path: "/api", Expires: time.Now().Add(time.Minute)})
+	capture.add(&captureRule{Subject: "gambol99@gmail.com", Expires: time.Now().Add(time.Minute)})
+	capture.add(&captureRule{Path: "/expired", Expires: time.Now().Add(-time.Minute)})
+	assert.True(t, capture.isEnabled())
+	assert.Len(t, capture.list(), 2)
+
+	user := &userContext{id: "1e11e539", email: "gambol99@gmail.com"}
+	assert.True(t, capture.matches("/api/users", nil))
+	assert.True(t, capture.matches("/admin", user))
+	assert.False(t, capture.matches("/admin", nil))
+	assert.False(t, capture.matches("/expired", nil))
+
+	capture.clear()
+	assert.False(t, capture.isEnabled())
+}
+
+func TestAdminAPI(t *testing.T) {
+	config := newFakeKeycloakConfig()
+	config.ListenAdmin = "127.0.0.1:0"
+	config.AdminToken = "secret"
+	p, _, _ := newTestProxyService(config)
+	service := httptest.NewServer(p.adminRouter)
+	defer service.Close()
+
+	level := log.GetLevel()
+	defer log.SetLevel(level)
+
+	cases := []struct {
+		Method   string
+		URI      string
+		Body     string
+		NoToken  bool
+		HTTPCode int
+	}{
+		{Method: "GET", URI: adminLogLevelURL, NoToken: true, HTTPCode: http.StatusUnauthorized},
+		{Method: "GET", URI: adminLogLevelURL, HTTPCode: http.StatusOK},
+		{Method: "PUT", URI: adminLogLevelURL, Body: `{"level": "verbose"}`, HTTPCode: http.StatusBadRequest},
+		{Method: "PUT", URI: adminLogLevelURL, Body: `{"level": "debug", "duration": "50ms"}`, HTTPCode: http.StatusOK},
+		{Method: "POST", URI: adminCaptureURL, Body: `{}`, HTTPCode: http.StatusBadRequest},
+		{Method: "POST", URI: adminCaptureURL, Body: `{"path": "/api", "duration": "2h"}`, HTTPCode: http.StatusBadRequest},
+		{Method: "POST", URI: adminCaptureURL, Body: `{"path": "/api"}`, HTTPCode: http.StatusCreated},
+		{Method: "DELETE", URI: adminCaptureURL, HTTPCode: http.StatusNoContent},
+	}
+	for i, c := range cases {
+		request, _ := http.NewRequest(c.Method, service.URL+c.URI, strings.NewReader(c.Body))
+		request.Header.Set("Content-Type", "application/json")
+		if !c.NoToken {
+			request.Header.Set(authorizationHeader, "Bearer "+config.AdminToken)
+		}
+		resp, err := http.DefaultClient.Do(request)
+		if !assert.NoError(t, err, "case %d, unable to make the request", i) {
+			continue
+		}
+		assert.Equal(t, c.HTTPCode, resp.StatusCode, "case %d, expected: %d, got: %d", i, c.HTTPCode, resp.StatusCode)
+	}
+
+	// step: the capture should have been cleared and the log level reverted
+	assert.False(t, p.capture.isEnabled())
+	assert.Equal(t, log.DebugLevel, log.GetLevel())
+	time.Sleep(time.Duration(100) * time.Millisecond)
+	assert.Equal(t, level, log.GetLevel())
+
+	request, _ := http.NewRequest("GET", service.URL+adminLogLevelURL, nil)
+	request.Header.Set(authorizationHeader, "Bearer "+config.AdminToken)
+	resp, err := http.DefaultClient.Do(request)
+	if assert.NoError(t, err) {
+		response := logLevelRequest{}
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&response))
+		assert.Equal(t, level.String(), response.Level)
+	}
+}
+
+func TestAdminAPIWithoutToken(t *testing.T) {
+	config := newFakeKeycloakConfig()
+	config.ListenAdmin = "127.0.0.1:0"
+	assert.Error(t, config.isValid())
+
+	// step: should the validation be bypassed, the requests are still refused
+	p, _, _ := newTestProxyService(config)
+	service := httptest.NewServer(p.adminRouter)
+	defer service.Close()
+	for _, header := range []string{"", "Bearer ", "Bearer"} {
+		request, _ := http.NewRequest("GET", service.URL+adminLogLevelURL, nil)
+		if header != "" {
+			request.Header.Set(authorizationHeader, header)
+		}
+		resp, err := http.DefaultClient.Do(request)
+		if assert.NoError(t, err) {
+			assert.Equal(t, http.StatusUnauthorized, resp.StatusCode, "header: '%s'", header)
+		}
+	}
+}
+
+func TestRedactCaptureBody(t *testing.T) {
+	cases := []struct {
+		ContentType string
+		Body        string
+		Expected    string
+	}{
+		{ContentType: "text/plain", Body: "hello", Expected: "hello"},
+		{ContentType: "application/json"},
+		{
+			ContentType: "application/x-www-form-urlencoded",
+			Body:        "username=jane&password=secret&client_secret=abc",
+			Expected:    "client_secret=REDACTED&password=REDACTED&username=jane",
+		},
+		{
+			ContentType: "application/json; charset=utf-8",
+			Body:        `{"access_token":"a","user":{"name":"jane","credentials":["x"]},"items":[{"refresh_token":"b"}]}`,
+			Expected:    `{"access_token":"REDACTED","items":[{"refresh_token":"REDACTED"}],"user":{"credentials":"REDACTED","name":"jane"}}`,
+		},
+		{ContentType: "application/scim+json", Body: `{"password":"x"}`, Expected: `{"password":"REDACTED"}`},
+		// a truncated body can't be parsed, so is redacted in full
+		{ContentType: "application/json", Body: `{"password":"sec`, Expected: "REDACTED"},
+	}
+	for i, c := range cases {
+		assert.Equal(t, c.Expected, redactCaptureBody(c.ContentType, []byte(c.Body)), "case %d", i)
+	}
+}
+
+func TestCaptureWriter(t *testing.T) {
+	cx := newFakeGinContext("GET", "/")
+	writer := &captureWriter{ResponseWriter: cx.Writer}
+
+	content := strings.Repeat("a", maxCaptureBodySize+10)
+	n, err := writer.WriteString(content)
+	assert.NoError(t, err)
+	assert.Equal(t, len(content), n)
+	assert.Equal(t, maxCaptureBodySize, writer.body.Len())
+}
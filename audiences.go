@@ -0,0 +1,114 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"strings"
+
+	"github.com/coreos/go-oidc/jose"
+)
+
+//
+// getClaimsAudiences returns the audiences of the token, the aud claim being a string or a array
+//
+func getClaimsAudiences(claims jose.Claims) ([]string, error) {
+	if audience, found, err := claims.StringClaim(claimAudience); err == nil && found {
+		return []string{audience}, nil
+	}
+	if audiences, found, err := claims.StringsClaim(claimAudience); err == nil && found && len(audiences) > 0 {
+		return audiences, nil
+	}
+
+	return nil, ErrNoTokenAudience
+}
+
+//
+// getAllowedAudiences returns the audiences the tokens are accepted for, the client id and the allowed audiences
+//
+func (r *Config) getAllowedAudiences() []string {
+	return r.getClientAudiences(r.ClientID)
+}
+
+//
+// getClientAudiences returns the audiences the tokens issued to the client are accepted for, i.e. of a additional
+// provider, the client id and the allowed audiences
+//
+func (r *Config) getClientAudiences(clientID string) []string {
+	var list []string
+	if clientID != "" {
+		list = append(list, clientID)
+	}
+
+	return append(list, r.AllowedAudiences...)
+}
+
+//
+// isAllowedAudience checks the audience of the user, or the authorized party when permitted, is one of the allowed
+// audiences; with no client id or allowed audiences any audience is accepted
+//
+func (r *Config) isAllowedAudience(user *userContext) bool {
+	return r.isClientAudience(user, r.ClientID)
+}
+
+//
+// isClientAudience checks the audience of the user is one of the audiences of the client
+//
+func (r *Config) isClientAudience(user *userContext, clientID string) bool {
+	audiences := r.getClientAudiences(clientID)
+	if len(audiences) <= 0 {
+		return true
+	}
+	for _, x := range audiences {
+		if user.isAudience(x) {
+			return true
+		}
+	}
+	if r.EnableAuthorizedPartyAudience {
+		if party, found, _ := user.claims.StringClaim(claimAuthorizedParty); found && containedIn(party, audiences) {
+			return true
+		}
+	}
+
+	return false
+}
+
+//
+// isAudienceError checks the verification of the token failed on the audience alone; the provider client checks
+// the audience against the client id last, after the signature, expiration and issuer, so the token is otherwise valid
+//
+func isAudienceError(err error) bool {
+	return strings.Contains(err.Error(), "'aud' claim and 'client_id' do not match") ||
+		strings.Contains(err.Error(), "cannot find 'client_id' in 'aud' claim")
+}
+
+//
+// acceptAudience clears the verification error of a token issued for one of the allowed audiences rather than the
+// client id
+//
+func (r *Config) acceptAudience(token jose.JWT, err error) error {
+	if err == nil || !isAudienceError(err) {
+		return err
+	}
+	if len(r.AllowedAudiences) <= 0 && !r.EnableAuthorizedPartyAudience {
+		return err
+	}
+	user, e := extractIdentity(token)
+	if e != nil || !r.isAllowedAudience(user) {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,113 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/coreos/go-oidc/jose"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetClaimsAudiences(t *testing.T) {
+	audiences, err := getClaimsAudiences(jose.Claims{"aud": "test"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"test"}, audiences)
+	audiences, err = getClaimsAudiences(jose.Claims{"aud": []interface{}{"orders", "billing"}})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"orders", "billing"}, audiences)
+	_, err = getClaimsAudiences(jose.Claims{"aud": []interface{}{}})
+	assert.Equal(t, ErrNoTokenAudience, err)
+	_, err = getClaimsAudiences(jose.Claims{})
+	assert.Equal(t, ErrNoTokenAudience, err)
+}
+
+func TestIsAllowedAudience(t *testing.T) {
+	cs := []struct {
+		Config  *Config
+		Claims  jose.Claims
+		Allowed bool
+	}{
+		{Config: &Config{}, Claims: jose.Claims{"aud": "anything"}, Allowed: true},
+		{Config: &Config{ClientID: "test"}, Claims: jose.Claims{"aud": "test"}, Allowed: true},
+		{Config: &Config{ClientID: "test"}, Claims: jose.Claims{"aud": "orders"}},
+		{Config: &Config{ClientID: "test"}, Claims: jose.Claims{"aud": []interface{}{"orders", "test"}}, Allowed: true},
+		{Config: &Config{ClientID: "test", AllowedAudiences: []string{"orders"}}, Claims: jose.Claims{"aud": "orders"}, Allowed: true},
+		{Config: &Config{AllowedAudiences: []string{"orders"}}, Claims: jose.Claims{"aud": []interface{}{"billing", "orders"}}, Allowed: true},
+		{Config: &Config{ClientID: "test", AllowedAudiences: []string{"orders"}}, Claims: jose.Claims{"aud": "billing"}},
+		{Config: &Config{ClientID: "test"}, Claims: jose.Claims{"aud": "account", "azp": "test"}},
+		{
+			Config:  &Config{ClientID: "test", EnableAuthorizedPartyAudience: true},
+			Claims:  jose.Claims{"aud": "account", "azp": "test"},
+			Allowed: true,
+		},
+		{
+			Config: &Config{ClientID: "test", EnableAuthorizedPartyAudience: true},
+			Claims: jose.Claims{"aud": "account", "azp": "other"},
+		},
+	}
+	for i, c := range cs {
+		c.Claims["sub"] = "1234"
+		user, err := extractClaimsIdentity(c.Claims)
+		if !assert.NoError(t, err, "case %d", i) {
+			continue
+		}
+		assert.Equal(t, c.Allowed, c.Config.isAllowedAudience(user), "case %d", i)
+	}
+}
+
+func TestAllowedAudiences(t *testing.T) {
+	config := newFakeKeycloakConfig()
+	config.AllowedAudiences = []string{"orders"}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	defer upstream.Close()
+	config.Upstream = upstream.URL
+	p, auth, u := newTestProxyService(config)
+	if !assert.NoError(t, p.createUpstreamProxy(p.endpoint)) {
+		t.FailNow()
+	}
+
+	cs := []struct {
+		Audience interface{}
+		HTTPCode int
+	}{
+		{Audience: fakeClientID, HTTPCode: http.StatusOK},
+		{Audience: "orders", HTTPCode: http.StatusOK},
+		{Audience: []string{"billing", "orders"}, HTTPCode: http.StatusOK},
+		{Audience: "billing", HTTPCode: http.StatusForbidden},
+	}
+	for i, c := range cs {
+		claims := jose.Claims{}
+		for k, v := range auth.claims {
+			claims[k] = v
+		}
+		claims["aud"] = c.Audience
+		token, err := jose.NewSignedJWT(claims, auth.signer)
+		if !assert.NoError(t, err, "case %d", i) {
+			continue
+		}
+		req, _ := http.NewRequest("GET", u+fakeAuthAllURL, nil)
+		req.Header.Set(authorizationHeader, "Bearer "+token.Encode())
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if !assert.NoError(t, err, "case %d", i) {
+			continue
+		}
+		resp.Body.Close()
+		assert.Equal(t, c.HTTPCode, resp.StatusCode, "case %d", i)
+	}
+}
@@ -0,0 +1,103 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// authLatencyBuckets are the buckets of the auth layer latencies, from 10us to ~160ms
+var authLatencyBuckets = prometheus.ExponentialBuckets(0.00001, 4, 8)
+
+//
+// authMetrics are the metrics of where the time goes inside the auth layer; all the methods are safe on a nil
+// receiver, so the callers needn't check the metrics are enabled
+//
+type authMetrics struct {
+	// the lookups of the identities held by the token cache, partitioned by the result
+	identityLookups *prometheus.CounterVec
+	// the time taken to extract the identity of the request, partitioned by the source
+	extraction *prometheus.HistogramVec
+	// the time taken to evaluate the admission checks, partitioned by the check and claim
+	evaluation *prometheus.HistogramVec
+}
+
+//
+// newAuthMetrics creates and registers the auth layer metrics
+//
+func newAuthMetrics() *authMetrics {
+	return &authMetrics{
+		identityLookups: prometheus.MustRegisterOrGet(prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "proxy_identity_cache_lookups_total",
+				Help: "The lookups of the identities held by the token cache, partitioned by the result",
+			},
+			[]string{"result"},
+		)).(*prometheus.CounterVec),
+		extraction: prometheus.MustRegisterOrGet(prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "proxy_identity_extraction_duration_seconds",
+				Help:    "The time taken to extract the identity of the request, partitioned by the source",
+				Buckets: authLatencyBuckets,
+			},
+			[]string{"source"},
+		)).(*prometheus.HistogramVec),
+		evaluation: prometheus.MustRegisterOrGet(prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "proxy_admission_evaluation_duration_seconds",
+				Help:    "The time taken to evaluate the admission checks, partitioned by the check and claim",
+				Buckets: authLatencyBuckets,
+			},
+			[]string{"check", "claim"},
+		)).(*prometheus.HistogramVec),
+	}
+}
+
+//
+// recordIdentityLookup records a lookup of the identity cache
+//
+func (r *authMetrics) recordIdentityLookup(hit bool) {
+	if r == nil {
+		return
+	}
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	r.identityLookups.WithLabelValues(result).Inc()
+}
+
+//
+// observeExtraction records the time taken to extract the identity from the source, i.e. cache or token
+//
+func (r *authMetrics) observeExtraction(source string, took time.Duration) {
+	if r == nil {
+		return
+	}
+	r.extraction.WithLabelValues(source).Observe(took.Seconds())
+}
+
+//
+// observeEvaluation records the time taken by a admission check, the claim being empty for the other checks
+//
+func (r *authMetrics) observeEvaluation(check, claim string, took time.Duration) {
+	if r == nil {
+		return
+	}
+	r.evaluation.WithLabelValues(check, claim).Observe(took.Seconds())
+}
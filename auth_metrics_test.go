@@ -0,0 +1,65 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/coreos/go-oidc/jose"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuthMetrics(t *testing.T) {
+	config := newFakeKeycloakConfig()
+	config.EnableMetrics = true
+	config.TokenCacheSize = 10
+	config.TokenCacheTTL = time.Minute
+	config.MatchClaims = map[string]string{"email": "^gambol99@"}
+	p, auth, _ := newTestProxyService(config)
+	token, err := jose.NewSignedJWT(auth.claims, auth.signer)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	for i := 0; i < 2; i++ {
+		request := httptest.NewRequest("GET", fakeAuthAllURL+"/resource", nil)
+		request.AddCookie(&http.Cookie{Name: config.CookieAccessName, Value: token.Encode()})
+		p.router.ServeHTTP(httptest.NewRecorder(), request)
+	}
+
+	recorder := httptest.NewRecorder()
+	p.router.ServeHTTP(recorder, httptest.NewRequest("GET", oauthURL+metricsURL, nil))
+	metrics := recorder.Body.String()
+	for _, x := range []string{
+		`proxy_identity_cache_lookups_total{result="hit"}`,
+		`proxy_identity_cache_lookups_total{result="miss"}`,
+		`proxy_identity_extraction_duration_seconds_count{source="cache"}`,
+		`proxy_identity_extraction_duration_seconds_count{source="token"}`,
+		`proxy_admission_evaluation_duration_seconds_count{check="audience",claim=""}`,
+		`proxy_admission_evaluation_duration_seconds_count{check="claim",claim="email"}`,
+	} {
+		assert.Contains(t, metrics, x)
+	}
+}
+
+func TestAuthMetricsDisabled(t *testing.T) {
+	var metrics *authMetrics
+	metrics.recordIdentityLookup(true)
+	metrics.observeExtraction("token", time.Millisecond)
+	metrics.observeEvaluation("roles", "", time.Millisecond)
+}
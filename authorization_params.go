@@ -0,0 +1,170 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// loginHintParam is the query parameter the login hint is taken from
+	loginHintParam = "login_hint"
+	// loginHintMaxLength is the longest login hint passed through, longer hints are ignored
+	loginHintMaxLength = 256
+	// idpHintParam is the parameter selecting the identity provider keycloak brokers the login to
+	idpHintParam = "kc_idp_hint"
+	// promptParam is the parameter asking the provider to prompt the user, or not
+	promptParam = "prompt"
+	// uiLocalesParam is the parameter of the preferred locales of the login page
+	uiLocalesParam = "ui_locales"
+	// maxAgeParam is the parameter of the time, in seconds, since the user last authenticated
+	maxAgeParam = "max_age"
+)
+
+// authorizationPassthroughParams are the parameters of the login which can be passed through to the provider
+var authorizationPassthroughParams = []string{idpHintParam, promptParam, loginHintParam, uiLocalesParam, maxAgeParam}
+
+// promptValues are the values of the prompt parameter (openid connect core 3.1.2.1)
+var promptValues = []string{"none", "login", "consent", "select_account"}
+
+//
+// isValidAuthorizationClaims checks the claims request parameter (openid connect core 5.5) is a json object
+//
+func isValidAuthorizationClaims(claims string) error {
+	var request map[string]interface{}
+	if err := json.Unmarshal([]byte(claims), &request); err != nil {
+		return fmt.Errorf("the authorization claims must be a json object, error: %s", err)
+	}
+	if request == nil {
+		return fmt.Errorf("the authorization claims must be a json object")
+	}
+
+	return nil
+}
+
+//
+// isValidAuthorizationParam checks the value of a parameter passed through to the provider
+//
+func isValidAuthorizationParam(name, value string) bool {
+	if value == "" || len(value) > loginHintMaxLength {
+		return false
+	}
+	switch name {
+	case promptParam:
+		for _, x := range strings.Split(value, " ") {
+			if !containedIn(x, promptValues) {
+				return false
+			}
+		}
+	case maxAgeParam:
+		if _, err := strconv.ParseUint(value, 10, 32); err != nil {
+			return false
+		}
+	}
+
+	return true
+}
+
+//
+// getRequestAuthorizationParams returns the parameters of the request passed through to the provider, the invalid
+// values being ignored
+//
+func (r *oauthProxy) getRequestAuthorizationParams(cx *gin.Context) url.Values {
+	params := url.Values{}
+	for _, name := range r.config.AuthorizationParamsPassthrough {
+		if value := cx.Query(name); isValidAuthorizationParam(name, value) {
+			params.Set(name, value)
+		}
+	}
+
+	return params
+}
+
+//
+// getRequestLoginHint returns the login hint of the request, from the query parameter else the header when configured
+//
+func (r *oauthProxy) getRequestLoginHint(cx *gin.Context) string {
+	if !r.config.EnableLoginHintPropagation {
+		return ""
+	}
+	hint := cx.Query(loginHintParam)
+	if hint == "" && r.config.LoginHintHeader != "" {
+		hint = cx.Request.Header.Get(r.config.LoginHintHeader)
+	}
+	if len(hint) > loginHintMaxLength {
+		return ""
+	}
+
+	return hint
+}
+
+//
+// getAuthorizationParams returns the additional parameters of the authorization request, i.e. the claims requested,
+// the locales of the login page, the hint of the user logging in, the identity provider, prompt and maximum age of
+// the authentication and the acr a resource requires; the parameters of the request take precedence
+//
+func (r *oauthProxy) getAuthorizationParams(cx *gin.Context) url.Values {
+	params := url.Values{}
+	if r.config.AuthorizationClaims != "" {
+		params.Set("claims", r.config.AuthorizationClaims)
+	}
+	if r.config.UILocales != "" {
+		params.Set(uiLocalesParam, r.config.UILocales)
+	}
+	if hint := r.getRequestLoginHint(cx); hint != "" {
+		params.Set(loginHintParam, hint)
+	} else if r.config.LoginHint != "" {
+		params.Set(loginHintParam, r.config.LoginHint)
+	}
+	if r.config.IDPHint != "" {
+		params.Set(idpHintParam, r.config.IDPHint)
+	}
+	if r.config.Prompt != "" {
+		params.Set(promptParam, r.config.Prompt)
+	}
+	if r.config.AuthenticationMaxAge > 0 {
+		params.Set(maxAgeParam, strconv.FormatInt(int64(r.config.AuthenticationMaxAge/time.Second), 10))
+	}
+	for name, values := range r.getRequestAuthorizationParams(cx) {
+		params[name] = values
+	}
+	if acr := cx.Query(acrValuesParam); r.isKnownACR(acr) {
+		params.Set(acrValuesParam, strings.Join(getStepUpACRValues(acr, r.config.ACRLevels), " "))
+		if r.config.AuthorizationClaims == "" {
+			params.Set("claims", getStepUpClaims(acr, r.config.ACRLevels))
+		}
+	}
+
+	return params
+}
+
+//
+// addAuthorizationParams appends the parameters to the authorization url
+//
+func addAuthorizationParams(authURL string, params url.Values) string {
+	if len(params) <= 0 {
+		return authURL
+	}
+
+	return authURL + "&" + params.Encode()
+}
@@ -0,0 +1,186 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsValidAuthorizationClaims(t *testing.T) {
+	assert.NoError(t, isValidAuthorizationClaims(`{"id_token":{"acr":null}}`))
+	assert.NoError(t, isValidAuthorizationClaims(`{}`))
+	assert.Error(t, isValidAuthorizationClaims(`null`))
+	assert.Error(t, isValidAuthorizationClaims(`["acr"]`))
+	assert.Error(t, isValidAuthorizationClaims(`{"id_token":`))
+}
+
+func TestAuthorizationParams(t *testing.T) {
+	cs := []struct {
+		Claims   string
+		Locales  string
+		Hint     string
+		Expected map[string]string
+	}{
+		{
+			Expected: map[string]string{"claims": "", "ui_locales": "", "login_hint": ""},
+		},
+		{
+			Claims:   `{"id_token":{"acr":{"essential":true}}}`,
+			Expected: map[string]string{"claims": `{"id_token":{"acr":{"essential":true}}}`, "ui_locales": "", "login_hint": ""},
+		},
+		{
+			Locales:  "en-GB fr",
+			Hint:     "jane@example.com",
+			Expected: map[string]string{"claims": "", "ui_locales": "en-GB fr", "login_hint": "jane@example.com"},
+		},
+	}
+	for i, c := range cs {
+		config := newFakeKeycloakConfig()
+		config.AuthorizationClaims = c.Claims
+		config.UILocales = c.Locales
+		config.LoginHint = c.Hint
+		_, _, u := newTestProxyService(config)
+
+		req, _ := http.NewRequest("GET", u+oauthURL+authorizationURL, nil)
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if !assert.NoError(t, err, "case %d, unable to call the authorization handler", i) {
+			continue
+		}
+		location, err := url.Parse(resp.Header.Get("Location"))
+		if !assert.NoError(t, err, "case %d", i) {
+			continue
+		}
+		assert.NotEmpty(t, location.Query().Get("client_id"), "case %d, missing the client id", i)
+		for k, v := range c.Expected {
+			assert.Equal(t, v, location.Query().Get(k), "case %d, parameter: %s", i, k)
+		}
+	}
+}
+
+func TestLoginHintPropagation(t *testing.T) {
+	config := newFakeKeycloakConfig()
+	config.EnableLoginHintPropagation = true
+	config.LoginHintHeader = "X-Login-Hint"
+	config.LoginHint = "default@example.com"
+	_, _, u := newTestProxyService(config)
+
+	cs := []struct {
+		URL      string
+		Header   string
+		Expected string
+	}{
+		{URL: "/admin", Expected: "default@example.com"},
+		{URL: "/admin?login_hint=jane@example.com", Expected: "jane@example.com"},
+		{URL: "/admin", Header: "joe@example.com", Expected: "joe@example.com"},
+		{URL: "/admin?login_hint=jane@example.com", Header: "joe@example.com", Expected: "jane@example.com"},
+		{URL: "/admin?login_hint=" + strings.Repeat("a", loginHintMaxLength+1), Expected: "default@example.com"},
+	}
+	for i, c := range cs {
+		// step: the hint is carried through the redirect to the authorization handler
+		req, _ := http.NewRequest("GET", u+c.URL, nil)
+		if c.Header != "" {
+			req.Header.Set("X-Login-Hint", c.Header)
+		}
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if !assert.NoError(t, err, "case %d, unable to make the request", i) {
+			continue
+		}
+		assert.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode, "case %d", i)
+
+		// step: and on to the provider
+		req, _ = http.NewRequest("GET", u+resp.Header.Get("Location"), nil)
+		resp, err = http.DefaultTransport.RoundTrip(req)
+		if !assert.NoError(t, err, "case %d, unable to call the authorization handler", i) {
+			continue
+		}
+		location, _ := url.Parse(resp.Header.Get("Location"))
+		assert.Equal(t, c.Expected, location.Query().Get("login_hint"), "case %d", i)
+	}
+}
+
+func TestIsValidAuthorizationParam(t *testing.T) {
+	cs := []struct {
+		Name  string
+		Value string
+		Ok    bool
+	}{
+		{Name: idpHintParam, Value: "corporate-adfs", Ok: true},
+		{Name: idpHintParam},
+		{Name: idpHintParam, Value: strings.Repeat("a", loginHintMaxLength+1)},
+		{Name: promptParam, Value: "none", Ok: true},
+		{Name: promptParam, Value: "login consent", Ok: true},
+		{Name: promptParam, Value: "always"},
+		{Name: maxAgeParam, Value: "3600", Ok: true},
+		{Name: maxAgeParam, Value: "-1"},
+		{Name: maxAgeParam, Value: "1h"},
+		{Name: uiLocalesParam, Value: "en-GB fr", Ok: true},
+	}
+	for i, c := range cs {
+		assert.Equal(t, c.Ok, isValidAuthorizationParam(c.Name, c.Value), "case %d", i)
+	}
+}
+
+func TestAuthorizationParamsPassthrough(t *testing.T) {
+	config := newFakeKeycloakConfig()
+	config.IDPHint = "corporate-adfs"
+	config.Prompt = "login"
+	config.AuthenticationMaxAge = time.Duration(12) * time.Hour
+	config.AuthorizationParamsPassthrough = []string{idpHintParam, maxAgeParam}
+	_, _, u := newTestProxyService(config)
+
+	cs := []struct {
+		URL      string
+		Expected url.Values
+	}{
+		{
+			URL:      "/admin",
+			Expected: url.Values{idpHintParam: {"corporate-adfs"}, promptParam: {"login"}, maxAgeParam: {"43200"}},
+		},
+		{
+			URL:      "/admin?kc_idp_hint=partner-oidc&max_age=60&prompt=none",
+			Expected: url.Values{idpHintParam: {"partner-oidc"}, promptParam: {"login"}, maxAgeParam: {"60"}},
+		},
+		{
+			URL:      "/admin?max_age=forever",
+			Expected: url.Values{idpHintParam: {"corporate-adfs"}, promptParam: {"login"}, maxAgeParam: {"43200"}},
+		},
+	}
+	for i, c := range cs {
+		// step: the parameters are carried through the redirect to the authorization handler
+		req, _ := http.NewRequest("GET", u+c.URL, nil)
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if !assert.NoError(t, err, "case %d, unable to make the request", i) {
+			continue
+		}
+		assert.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode, "case %d", i)
+
+		req, _ = http.NewRequest("GET", u+resp.Header.Get("Location"), nil)
+		resp, err = http.DefaultTransport.RoundTrip(req)
+		if !assert.NoError(t, err, "case %d, unable to call the authorization handler", i) {
+			continue
+		}
+		location, _ := url.Parse(resp.Header.Get("Location"))
+		for k, v := range c.Expected {
+			assert.Equal(t, v, location.Query()[k], "case %d, parameter: %s", i, k)
+		}
+	}
+}
@@ -0,0 +1,253 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/coreos/go-oidc/jose"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// backchannelLogoutEvent is the event of the logout tokens (openid connect back-channel logout 1.0)
+	backchannelLogoutEvent = "http://schemas.openid.net/event/backchannel-logout"
+	// backchannelLogoutKeyPrefix is the prefix of the logged out sessions and subjects held in the store
+	backchannelLogoutKeyPrefix = "logout."
+)
+
+//
+// backchannelLogouts holds the sessions, and subjects, the provider has logged out, for the retention, so the
+// cookies of the sessions are refused; the logouts are shared via the store when it can expire the keys
+//
+type backchannelLogouts struct {
+	sync.Mutex
+	// the logouts in memory, keyed by the session or subject, and the time of the logout
+	logouts map[string]time.Time
+	// the time the logouts are held for
+	retention time.Duration
+	// the shared store, if any
+	store expiringStorage
+}
+
+//
+// newBackchannelLogouts creates the tracking of the logouts
+//
+func newBackchannelLogouts(store expiringStorage, retention time.Duration) *backchannelLogouts {
+	return &backchannelLogouts{
+		logouts:   make(map[string]time.Time),
+		retention: retention,
+		store:     store,
+	}
+}
+
+//
+// add records the logout of the session or subject
+//
+func (r *backchannelLogouts) add(key string, now time.Time) {
+	key = backchannelLogoutKeyPrefix + key
+
+	r.Lock()
+	for k, v := range r.logouts {
+		if !now.Before(v.Add(r.retention)) {
+			delete(r.logouts, k)
+		}
+	}
+	r.logouts[key] = now
+	r.Unlock()
+
+	if r.store != nil {
+		if err := r.store.SetWithExpiration(key, strconv.FormatInt(now.Unix(), 10), r.retention); err != nil {
+			log.WithFields(log.Fields{
+				"error": err.Error(),
+			}).Warnf("unable to add the logout to the store")
+		}
+	}
+}
+
+//
+// get returns the time of the logout of the session or subject, if any
+//
+func (r *backchannelLogouts) get(key string, now time.Time) (time.Time, bool) {
+	key = backchannelLogoutKeyPrefix + key
+
+	r.Lock()
+	at, found := r.logouts[key]
+	r.Unlock()
+	if found && now.Before(at.Add(r.retention)) {
+		return at, true
+	}
+
+	if r.store != nil {
+		value, err := r.store.Get(key)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error": err.Error(),
+			}).Warnf("unable to retrieve the logout from the store")
+		}
+		if unix, err := strconv.ParseInt(value, 10, 64); err == nil {
+			return time.Unix(unix, 0), true
+		}
+	}
+
+	return time.Time{}, false
+}
+
+//
+// isLoggedOut checks the session of the user has been logged out, either the session itself or the tokens of the
+// subject issued before the logout of the subject
+//
+func (r *backchannelLogouts) isLoggedOut(user *userContext, now time.Time) bool {
+	claims, err := user.token.Claims()
+	if err != nil {
+		return false
+	}
+	for _, x := range []string{claimSessionState, claimSessionID} {
+		if sid, found, err := claims.StringClaim(x); err == nil && found && sid != "" {
+			if _, found := r.get("sid."+sid, now); found {
+				return true
+			}
+		}
+	}
+	if at, found := r.get("sub."+user.id, now); found {
+		issued, found, err := claims.TimeClaim("iat")
+		if err != nil || !found || !issued.After(at) {
+			return true
+		}
+	}
+
+	return false
+}
+
+//
+// parseLogoutToken verifies the logout token of the provider, returning the session and subject logged out
+//
+func (r *oauthProxy) parseLogoutToken(raw string) (string, string, error) {
+	token, err := jose.ParseJWT(raw)
+	if err != nil {
+		return "", "", err
+	}
+	if err := r.verifySkewedToken(token); err != nil {
+		return "", "", err
+	}
+	claims, err := token.Claims()
+	if err != nil {
+		return "", "", err
+	}
+	events, ok := claims["events"].(map[string]interface{})
+	if !ok {
+		return "", "", errors.New("the logout token has no events")
+	}
+	if _, found := events[backchannelLogoutEvent]; !found {
+		return "", "", errors.New("the logout token has no back-channel logout event")
+	}
+	if _, found := claims["nonce"]; found {
+		return "", "", errors.New("the logout token must not have a nonce")
+	}
+	sid, _, _ := claims.StringClaim(claimSessionID)
+	sub, _, _ := claims.StringClaim("sub")
+	if sid == "" && sub == "" {
+		return "", "", errors.New("the logout token has no session or subject")
+	}
+
+	return sid, sub, nil
+}
+
+//
+// backchannelLogoutHandler accepts the logout tokens of the provider, logging out the session, or all the sessions
+// of the subject when the token has no session
+//
+func (r *oauthProxy) backchannelLogoutHandler(cx *gin.Context) {
+	cx.Header("Cache-Control", "no-store")
+
+	sid, sub, err := r.parseLogoutToken(cx.PostForm("logout_token"))
+	if err != nil {
+		log.WithFields(log.Fields{
+			"client_ip": cx.ClientIP(),
+			"error":     err.Error(),
+		}).Warnf("refusing the back-channel logout, the logout token is invalid")
+
+		cx.JSON(http.StatusBadRequest, gin.H{"error": "invalid_request", "error_description": "the logout token is invalid"})
+		cx.Abort()
+		return
+	}
+
+	now := time.Now()
+	if sid != "" {
+		r.backchannel.add("sid."+sid, now)
+		if r.config.MaxSessions > 0 && sub != "" {
+			if err := r.removeSessionID(sub, sid); err != nil {
+				log.WithFields(log.Fields{
+					"error": err.Error(),
+				}).Errorf("unable to remove the session from the store")
+			}
+		}
+	} else {
+		r.backchannel.add("sub."+sub, now)
+	}
+
+	log.WithFields(log.Fields{
+		"event":   "session_logout",
+		"subject": sub,
+		"session": sid,
+	}).Infof("the provider has logged out the session of subject: %s", sub)
+
+	cx.AbortWithStatus(http.StatusOK)
+}
+
+//
+// backchannelLogoutMiddleware refuses the sessions logged out by the provider, removing their refresh tokens
+//
+func (r *oauthProxy) backchannelLogoutMiddleware() gin.HandlerFunc {
+	return func(cx *gin.Context) {
+		if r.backchannel == nil {
+			return
+		}
+		if _, found := cx.Get(cxEnforce); !found {
+			return
+		}
+		uc, found := cx.Get(userContextName)
+		if !found {
+			return
+		}
+		user := uc.(*userContext)
+		// step: bearer tokens are not sessions
+		if user.isBearer() {
+			return
+		}
+		if !r.backchannel.isLoggedOut(user, time.Now()) {
+			return
+		}
+
+		log.WithFields(log.Fields{
+			"event":     "session_logged_out",
+			"subject":   user.id,
+			"email":     user.email,
+			"client_ip": cx.ClientIP(),
+		}).Warnf("the session for user: %s has been logged out by the provider, redirecting for authorization", user.email)
+
+		if r.useStore() {
+			r.DeleteRefreshToken(user.token)
+		}
+		r.clearAllCookies(cx)
+		r.redirectToAuthorization(cx)
+	}
+}
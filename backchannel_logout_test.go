@@ -0,0 +1,127 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coreos/go-oidc/jose"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackchannelLogouts(t *testing.T) {
+	now := time.Now()
+	logouts := newBackchannelLogouts(nil, time.Hour)
+	session, other := newFakeSessionUser(t, "1"), newFakeSessionUser(t, "2")
+	assert.False(t, logouts.isLoggedOut(session, now))
+
+	logouts.add("sid.1", now)
+	assert.True(t, logouts.isLoggedOut(session, now))
+	assert.False(t, logouts.isLoggedOut(other, now))
+	assert.False(t, logouts.isLoggedOut(session, now.Add(time.Hour)))
+
+	// step: the logout of the subject covers the tokens issued before it
+	issued := newFakeSessionUser(t, "3")
+	issued.token = *newFakeJWTToken(t, jose.Claims{"sub": issued.id, "iat": now.Add(time.Minute).Unix()})
+	logouts.add("sub."+other.id, now)
+	assert.True(t, logouts.isLoggedOut(other, now))
+	assert.False(t, logouts.isLoggedOut(issued, now))
+}
+
+func TestBackchannelLogoutsSharedStore(t *testing.T) {
+	now := time.Now()
+	store := &fakeExpiringStore{values: make(map[string]string)}
+	first, second := newBackchannelLogouts(store, time.Hour), newBackchannelLogouts(store, time.Hour)
+	first.add("sid.1", now)
+	assert.True(t, second.isLoggedOut(newFakeSessionUser(t, "1"), now))
+	assert.Len(t, store.values, 1)
+}
+
+func TestBackchannelLogoutHandler(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	defer upstream.Close()
+
+	config := newFakeKeycloakConfig()
+	config.Upstream = upstream.URL
+	config.EnableBackchannelLogout = true
+	config.BackchannelLogoutTTL = time.Hour
+	p, auth, u := newTestProxyService(config)
+	if !assert.NoError(t, p.createUpstreamProxy(p.endpoint)) {
+		t.FailNow()
+	}
+	session, err := jose.NewSignedJWT(auth.claims, auth.signer)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	request := func() int {
+		req, _ := http.NewRequest("GET", u+fakeAuthAllURL, nil)
+		req.AddCookie(&http.Cookie{Name: config.CookieAccessName, Value: session.Encode()})
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	logout := func(claims jose.Claims) int {
+		token, err := jose.NewSignedJWT(claims, auth.signer)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		resp, err := http.Post(u+oauthURL+backchannelURL, "application/x-www-form-urlencoded",
+			strings.NewReader(url.Values{"logout_token": {token.Encode()}}.Encode()))
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	claims := jose.Claims{
+		"iss":    auth.claims["iss"],
+		"aud":    auth.claims["aud"],
+		"sub":    auth.claims["sub"],
+		"iat":    time.Now().Unix(),
+		"exp":    time.Now().Add(time.Minute).Unix(),
+		"jti":    "bd8d4c6c-f6d1-4b84-9d6e-4f0e5a4b1f3b",
+		"events": map[string]interface{}{backchannelLogoutEvent: map[string]interface{}{}},
+	}
+	assert.Equal(t, http.StatusOK, request())
+
+	// step: the invalid logout tokens are refused
+	invalid := jose.Claims{}
+	for k, v := range claims {
+		invalid[k] = v
+	}
+	delete(invalid, "events")
+	assert.Equal(t, http.StatusBadRequest, logout(invalid))
+	invalid["events"], invalid["aud"] = claims["events"], "another"
+	assert.Equal(t, http.StatusBadRequest, logout(invalid))
+	assert.Equal(t, http.StatusOK, request())
+
+	// step: the logout of another session leaves the session alone
+	claims["sid"] = "another"
+	assert.Equal(t, http.StatusOK, logout(claims))
+	assert.Equal(t, http.StatusOK, request())
+
+	claims["sid"] = auth.claims["session_state"]
+	assert.Equal(t, http.StatusOK, logout(claims))
+	assert.Equal(t, http.StatusTemporaryRedirect, request())
+}
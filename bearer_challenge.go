@@ -0,0 +1,81 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// authBearer is the authorization scheme of the bearer tokens
+	authBearer = "Bearer"
+	// bearerErrorInvalidToken is the error of a token which is expired, revoked, malformed or invalid (rfc 6750)
+	bearerErrorInvalidToken = "invalid_token"
+	// bearerErrorExpired is the description of a expired access token
+	bearerErrorExpired = "the access token has expired"
+	// bearerErrorInvalid is the description of a access token which failed the validation
+	bearerErrorInvalid = "the access token is invalid"
+)
+
+//
+// getBearerErrorDescription returns the description of why the access token was refused, keeping the details of
+// the validation from the client
+//
+func getBearerErrorDescription(err error) string {
+	switch err {
+	case ErrAccessTokenExpired:
+		return bearerErrorExpired
+	case errTokenInactive:
+		return errTokenInactive.Error()
+	default:
+		return bearerErrorInvalid
+	}
+}
+
+//
+// setBearerError records the reason the access token presented was refused, for the bearer challenge
+//
+func setBearerError(cx *gin.Context, description string) {
+	cx.Set(cxBearerError, description)
+}
+
+//
+// setBearerChallenge adds the bearer challenge (rfc 6750) to the unauthorized response, with the invalid_token
+// error when a access token was presented and refused; a request without any token gets the bare challenge
+//
+func (r *oauthProxy) setBearerChallenge(cx *gin.Context) {
+	if !r.config.EnableBearerChallenge {
+		return
+	}
+	var params []string
+	if r.config.BearerRealm != "" {
+		params = append(params, `realm="`+r.config.BearerRealm+`"`)
+	}
+	if v, found := cx.Get(cxBearerError); found {
+		params = append(params, `error="`+bearerErrorInvalidToken+`"`)
+		if description, ok := v.(string); ok && r.config.BearerErrorDescription {
+			params = append(params, `error_description="`+description+`"`)
+		}
+	}
+	challenge := authBearer
+	if len(params) > 0 {
+		challenge += " " + strings.Join(params, ", ")
+	}
+
+	cx.Writer.Header().Add(headerWWWAuthenticate, challenge)
+}
@@ -0,0 +1,86 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/coreos/go-oidc/jose"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBearerChallenge(t *testing.T) {
+	config := newFakeKeycloakConfig()
+	config.NoRedirects = true
+	config.EnableBearerChallenge = true
+	config.BearerRealm = "api"
+	p, auth, _ := newTestProxyService(config)
+
+	claims := jose.Claims{}
+	for k, v := range auth.claims {
+		claims[k] = v
+	}
+	claims["exp"] = float64(time.Now().Add(-time.Hour).Unix())
+	expired, err := jose.NewSignedJWT(claims, auth.signer)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	tests := []struct {
+		Token       string
+		Description bool
+		Challenge   string
+	}{
+		{
+			Challenge: `Bearer realm="api"`,
+		},
+		{
+			Token:     expired.Encode(),
+			Challenge: `Bearer realm="api", error="invalid_token"`,
+		},
+		{
+			Token:       expired.Encode(),
+			Description: true,
+			Challenge:   `Bearer realm="api", error="invalid_token", error_description="the access token has expired"`,
+		},
+		{
+			Token:       "not.a.token",
+			Description: true,
+			Challenge:   `Bearer realm="api", error="invalid_token", error_description="the access token is invalid"`,
+		},
+	}
+	for i, c := range tests {
+		p.config.BearerErrorDescription = c.Description
+		req := httptest.NewRequest(http.MethodGet, fakeAuthAllURL, nil)
+		if c.Token != "" {
+			req.Header.Set(authorizationHeader, "Bearer "+c.Token)
+		}
+		resp := httptest.NewRecorder()
+		p.router.ServeHTTP(resp, req)
+		assert.Equal(t, http.StatusUnauthorized, resp.Code, "case %d, expected a unauthorized", i)
+		assert.Equal(t, c.Challenge, resp.Header().Get(headerWWWAuthenticate), "case %d, unexpected challenge", i)
+	}
+
+	// step: the challenge is off by default
+	p.config.EnableBearerChallenge = false
+	resp := httptest.NewRecorder()
+	p.router.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, fakeAuthAllURL, nil))
+	assert.Equal(t, http.StatusUnauthorized, resp.Code)
+	assert.Empty(t, resp.Header().Get(headerWWWAuthenticate))
+}
@@ -0,0 +1,113 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gin-gonic/gin"
+)
+
+//
+// useSessionBinding checks if the sessions are bound to the client
+//
+func (r *oauthProxy) useSessionBinding() bool {
+	return r.config.BindSessionIP || r.config.BindSessionUserAgent
+}
+
+//
+// getSessionBinding returns the binding for the subject and client, i.e. subject|network|user agent hash
+//
+func (r *oauthProxy) getSessionBinding(cx *gin.Context, subject string) string {
+	network := ""
+	if r.config.BindSessionIP {
+		network = getClientNetwork(getRemoteAddress(cx.Request), r.config.BindSessionIPv4Prefix, r.config.BindSessionIPv6Prefix)
+	}
+	agent := ""
+	if r.config.BindSessionUserAgent {
+		agent = hashSHA256([]byte(cx.Request.Header.Get("User-Agent")))
+	}
+
+	return strings.Join([]string{subject, network, agent}, "|")
+}
+
+//
+// dropSessionBindingCookie drops the encrypted binding for the subject into the response
+//
+func (r *oauthProxy) dropSessionBindingCookie(cx *gin.Context, subject string, duration time.Duration) error {
+	encrypted, err := encodeText(r.getSessionBinding(cx, subject), r.config.EncryptionKey)
+	if err != nil {
+		return err
+	}
+	r.dropCookie(cx, r.config.CookieBindingName, encrypted, duration)
+
+	return nil
+}
+
+//
+// verifySessionBinding checks the binding cookie matches the user and the client making the request
+//
+func (r *oauthProxy) verifySessionBinding(cx *gin.Context, user *userContext) error {
+	cookie, err := cx.Request.Cookie(r.config.CookieBindingName)
+	if err != nil {
+		return ErrSessionBindingMismatch
+	}
+	binding, err := decodeText(cookie.Value, r.config.EncryptionKey)
+	if err != nil {
+		return ErrSessionBindingMismatch
+	}
+	if binding != r.getSessionBinding(cx, user.id) {
+		log.WithFields(log.Fields{
+			"event":      "session_binding_mismatch",
+			"email":      user.email,
+			"client_ip":  getRemoteAddress(cx.Request),
+			"user_agent": cx.Request.Header.Get("User-Agent"),
+		}).Warnf("the session for user: %s is being used by a different client", user.email)
+
+		return ErrSessionBindingMismatch
+	}
+
+	return nil
+}
+
+//
+// getClientNetwork returns the network of the client address masked to the prefix, permitting the address to change
+// within a nat pool
+//
+func getClientNetwork(address string, ipv4Prefix, ipv6Prefix int) string {
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		address = host
+	}
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return address
+	}
+	if v4 := ip.To4(); v4 != nil {
+		if ipv4Prefix <= 0 || ipv4Prefix > 32 {
+			ipv4Prefix = 32
+		}
+		return fmt.Sprintf("%s/%d", v4.Mask(net.CIDRMask(ipv4Prefix, 32)), ipv4Prefix)
+	}
+	if ipv6Prefix <= 0 || ipv6Prefix > 128 {
+		ipv6Prefix = 128
+	}
+
+	return fmt.Sprintf("%s/%d", ip.Mask(net.CIDRMask(ipv6Prefix, 128)), ipv6Prefix)
+}
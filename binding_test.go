@@ -0,0 +1,147 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/cookiejar"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetClientNetwork(t *testing.T) {
+	cases := []struct {
+		Address  string
+		IPv4     int
+		IPv6     int
+		Expected string
+	}{
+		{Address: "10.10.10.1", IPv4: 32, Expected: "10.10.10.1/32"},
+		{Address: "10.10.10.1:4433", IPv4: 24, Expected: "10.10.10.0/24"},
+		{Address: "10.10.10.1", Expected: "10.10.10.1/32"},
+		{Address: "2001:db8::1", IPv6: 64, Expected: "2001:db8::/64"},
+		{Address: "2001:db8::1", Expected: "2001:db8::1/128"},
+		{Address: "not_an_address", Expected: "not_an_address"},
+	}
+	for i, c := range cases {
+		network := getClientNetwork(c.Address, c.IPv4, c.IPv6)
+		assert.Equal(t, c.Expected, network, "case %d, expected: %s, got: %s", i, c.Expected, network)
+	}
+}
+
+func TestGetRemoteAddress(t *testing.T) {
+	cases := []struct {
+		RemoteAddr string
+		Forwarded  string
+		Expected   string
+	}{
+		{RemoteAddr: "10.10.10.1:4433", Expected: "10.10.10.1"},
+		{RemoteAddr: "10.10.10.1:4433", Forwarded: "192.168.1.1", Expected: "10.10.10.1"},
+		{RemoteAddr: "[2001:db8::1]:4433", Expected: "2001:db8::1"},
+		{RemoteAddr: "10.10.10.1", Expected: "10.10.10.1"},
+	}
+	for i, c := range cases {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.RemoteAddr = c.RemoteAddr
+		if c.Forwarded != "" {
+			req.Header.Set("X-Forwarded-For", c.Forwarded)
+			req.Header.Set("X-Real-Ip", c.Forwarded)
+		}
+		assert.Equal(t, c.Expected, getRemoteAddress(req), "case %d", i)
+	}
+}
+
+func TestSessionBindingForwardedAddress(t *testing.T) {
+	config := newFakeKeycloakConfig()
+	config.BindSessionIP = true
+	config.CookieBindingName = "kc-binding"
+	config.EncryptionKey = "AgXa7xRcoClDEU0ZDSH4X0XhL5Qy2Z2j"
+	p, _, u := newTestProxyService(config)
+	p.upstream = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	jar, _ := cookiejar.New(nil)
+	client := &http.Client{Jar: jar}
+
+	// step: the session is bound to the peer address, not the address the client claims to be forwarded for
+	request, _ := http.NewRequest("GET", u+fakeAuthAllURL, nil)
+	request.Header.Set("X-Forwarded-For", "10.0.0.1")
+	resp, err := client.Do(request)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return errors.New("no redirects")
+	}
+	for i, forwarded := range []string{"", "10.0.0.2"} {
+		request, _ = http.NewRequest("GET", u+fakeAuthAllURL, nil)
+		if forwarded != "" {
+			request.Header.Set("X-Forwarded-For", forwarded)
+		}
+		resp, _ = client.Do(request)
+		if assert.NotNil(t, resp, "case %d, no response", i) {
+			assert.Equal(t, http.StatusOK, resp.StatusCode, "case %d", i)
+		}
+	}
+}
+
+func TestSessionBindingUserAgent(t *testing.T) {
+	config := newFakeKeycloakConfig()
+	config.BindSessionUserAgent = true
+	config.CookieBindingName = "kc-binding"
+	config.EncryptionKey = "AgXa7xRcoClDEU0ZDSH4X0XhL5Qy2Z2j"
+	p, _, u := newTestProxyService(config)
+	p.upstream = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	jar, _ := cookiejar.New(nil)
+	client := &http.Client{Jar: jar}
+
+	// step: login and get redirected back to the resource
+	request, _ := http.NewRequest("GET", u+fakeAuthAllURL, nil)
+	request.Header.Set("User-Agent", "browser/1.0")
+	resp, err := client.Do(request)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// step: the same session from a different user agent should be rejected
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return errors.New("no redirects")
+	}
+	for i, c := range []struct {
+		UserAgent string
+		HTTPCode  int
+	}{
+		{UserAgent: "browser/1.0", HTTPCode: http.StatusOK},
+		{UserAgent: "curl/7.47.0", HTTPCode: http.StatusTemporaryRedirect},
+	} {
+		request, _ = http.NewRequest("GET", u+fakeAuthAllURL, nil)
+		request.Header.Set("User-Agent", c.UserAgent)
+		resp, _ = client.Do(request)
+		if !assert.NotNil(t, resp, "case %d, no response", i) {
+			continue
+		}
+		assert.Equal(t, c.HTTPCode, resp.StatusCode, "case %d, expected: %d, got: %d", i, c.HTTPCode, resp.StatusCode)
+	}
+}
@@ -0,0 +1,182 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gin-gonic/gin"
+)
+
+//
+// getJSONPath extracts the value at the dotted path, e.g. order.owner or items.0.id, from the decoded json
+//
+func getJSONPath(document interface{}, path string) (interface{}, bool) {
+	value := document
+	for _, x := range strings.Split(path, ".") {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			item, found := v[x]
+			if !found {
+				return nil, false
+			}
+			value = item
+		case []interface{}:
+			index, err := strconv.Atoi(x)
+			if err != nil || index < 0 || index >= len(v) {
+				return nil, false
+			}
+			value = v[index]
+		default:
+			return nil, false
+		}
+	}
+
+	return value, true
+}
+
+//
+// getScalarString returns the string form of a scalar json or claim value, the objects, arrays and nulls have none
+//
+func getScalarString(value interface{}) (string, bool) {
+	switch v := value.(type) {
+	case string:
+		return v, true
+	case json.Number:
+		return v.String(), true
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	case bool:
+		return strconv.FormatBool(v), true
+	}
+
+	return "", false
+}
+
+//
+// isJSONContentType checks the content type of the request is json, i.e. application/json or a +json suffix
+//
+func isJSONContentType(contentType string) bool {
+	media, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	return media == "application/json" || strings.HasSuffix(media, "+json")
+}
+
+//
+// bodyInspectionMiddleware requires the fields of the json request body to match the claims of the token, as per
+// the body claims of the resource, so a user can't act on another's behalf by changing the body, i.e. a idor
+//
+func (r *oauthProxy) bodyInspectionMiddleware() gin.HandlerFunc {
+	return func(cx *gin.Context) {
+		ur, found := cx.Get(cxEnforce)
+		if !found {
+			return
+		}
+		resource := ur.(*Resource)
+		if len(resource.BodyClaims) <= 0 {
+			return
+		}
+		uc, found := cx.Get(userContextName)
+		if !found || cx.Request.ContentLength == 0 || cx.Request.Body == nil {
+			return
+		}
+		user := uc.(*userContext)
+
+		if !isJSONContentType(cx.Request.Header.Get("Content-Type")) {
+			log.WithFields(log.Fields{
+				"resource":     resource.URL,
+				"content_type": cx.Request.Header.Get("Content-Type"),
+			}).Warnf("rejecting the request, the body of the resource is inspected and must be json")
+
+			cx.AbortWithStatus(http.StatusUnsupportedMediaType)
+			return
+		}
+		if cx.Request.ContentLength > r.config.MaxBodyInspectionSize {
+			log.WithFields(log.Fields{
+				"resource": resource.URL,
+				"size":     cx.Request.ContentLength,
+				"limit":    r.config.MaxBodyInspectionSize,
+			}).Warnf("rejecting the request, body exceeds the size permitted for inspection")
+
+			cx.AbortWithStatus(http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		// step: read the body, the content length can be unknown i.e. chunked, so never read past the limit
+		content, err := ioutil.ReadAll(io.LimitReader(cx.Request.Body, r.config.MaxBodyInspectionSize+1))
+		if err != nil {
+			log.WithFields(log.Fields{
+				"resource": resource.URL,
+				"error":    err.Error(),
+			}).Warnf("unable to read the request body for inspection")
+
+			cx.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+		if int64(len(content)) > r.config.MaxBodyInspectionSize {
+			cx.AbortWithStatus(http.StatusRequestEntityTooLarge)
+			return
+		}
+		cx.Request.Body.Close()
+		cx.Request.Body = ioutil.NopCloser(bytes.NewReader(content))
+		cx.Request.ContentLength = int64(len(content))
+
+		var document interface{}
+		decoder := json.NewDecoder(bytes.NewReader(content))
+		decoder.UseNumber()
+		if err := decoder.Decode(&document); err != nil {
+			log.WithFields(log.Fields{
+				"resource": resource.URL,
+				"error":    err.Error(),
+			}).Warnf("rejecting the request, unable to decode the json body")
+
+			cx.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+
+		// step: the fields must be present and match the claims
+		for path, claim := range resource.BodyClaims {
+			value, found := getJSONPath(document, path)
+			field, scalar := getScalarString(value)
+			issued, claimed := getScalarString(user.claims[claim])
+			if found && scalar && claimed && field == issued {
+				continue
+			}
+			log.WithFields(log.Fields{
+				"event":    "body_claim_mismatch",
+				"access":   "denied",
+				"username": user.name,
+				"resource": resource.URL,
+				"field":    path,
+				"claim":    claim,
+			}).Warnf("the request body does not match the claims of the token")
+
+			r.resourceForbidden(cx, resource)
+			return
+		}
+	}
+}
@@ -0,0 +1,106 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/coreos/go-oidc/jose"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetJSONPath(t *testing.T) {
+	var document interface{}
+	decoder := json.NewDecoder(strings.NewReader(`{"userId":"abc","order":{"owner":42,"items":[{"id":"x"}]}}`))
+	decoder.UseNumber()
+	assert.NoError(t, decoder.Decode(&document))
+
+	cases := []struct {
+		Path     string
+		Expected string
+		Found    bool
+	}{
+		{Path: "userId", Expected: "abc", Found: true},
+		{Path: "order.owner", Expected: "42", Found: true},
+		{Path: "order.items.0.id", Expected: "x", Found: true},
+		{Path: "order.items.1.id"},
+		{Path: "order.items.x"},
+		{Path: "order.missing"},
+		{Path: "userId.nested"},
+	}
+	for i, c := range cases {
+		value, found := getJSONPath(document, c.Path)
+		assert.Equal(t, c.Found, found, "case %d, unexpected result", i)
+		if found {
+			v, _ := getScalarString(value)
+			assert.Equal(t, c.Expected, v, "case %d, unexpected value", i)
+		}
+	}
+}
+
+func TestBodyInspectionHandler(t *testing.T) {
+	proxy, _, _ := newTestProxyService(nil)
+	proxy.config.MaxBodyInspectionSize = 64
+	handler := proxy.bodyInspectionMiddleware()
+	resource := &Resource{
+		URL:        "/orders",
+		BodyClaims: map[string]string{"userId": "sub", "account.id": "account"},
+	}
+	user := &userContext{
+		name:   "test",
+		claims: jose.Claims{"sub": "abc", "account": float64(42)},
+	}
+
+	cases := []struct {
+		ContentType string
+		Body        string
+		HTTPCode    int
+	}{
+		{HTTPCode: http.StatusOK},
+		{ContentType: "application/json", Body: `{"userId":"abc","account":{"id":42}}`, HTTPCode: http.StatusOK},
+		{ContentType: "application/merge-patch+json", Body: `{"userId":"abc","account":{"id":42}}`, HTTPCode: http.StatusOK},
+		{ContentType: "application/json", Body: `{"userId":"xyz","account":{"id":42}}`, HTTPCode: http.StatusForbidden},
+		{ContentType: "application/json", Body: `{"userId":"abc","account":{"id":"43"}}`, HTTPCode: http.StatusForbidden},
+		{ContentType: "application/json", Body: `{"userId":"abc"}`, HTTPCode: http.StatusForbidden},
+		{ContentType: "application/json", Body: `{"userId":{"id":"abc"},"account":{"id":42}}`, HTTPCode: http.StatusForbidden},
+		{ContentType: "application/json", Body: `{"userId":`, HTTPCode: http.StatusBadRequest},
+		{ContentType: "text/plain", Body: `{"userId":"abc","account":{"id":42}}`, HTTPCode: http.StatusUnsupportedMediaType},
+		{ContentType: "application/json", Body: `{"userId":"abc","account":{"id":42},"padding":"` + strings.Repeat("x", 64) + `"}`, HTTPCode: http.StatusRequestEntityTooLarge},
+	}
+
+	for i, c := range cases {
+		context := newFakeGinContext("POST", "/orders")
+		context.Set(cxEnforce, resource)
+		context.Set(userContextName, user)
+		if c.Body != "" {
+			context.Request.Header.Set("Content-Type", c.ContentType)
+			context.Request.Body = ioutil.NopCloser(strings.NewReader(c.Body))
+			context.Request.ContentLength = int64(len(c.Body))
+		}
+		handler(context)
+		assert.Equal(t, c.HTTPCode, context.Writer.Status(), "case %d, expected: %d, got: %d", i, c.HTTPCode, context.Writer.Status())
+		// step: the admitted body is passed on unchanged
+		if c.Body != "" && c.HTTPCode == http.StatusOK {
+			content, err := ioutil.ReadAll(context.Request.Body)
+			assert.NoError(t, err)
+			assert.Equal(t, c.Body, string(content), "case %d, the body has changed", i)
+		}
+	}
+}
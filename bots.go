@@ -0,0 +1,313 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	botReasonUserAgent = "user_agent"
+	botReasonHeaders   = "missing_headers"
+	botReasonNotFound  = "not_found_rate"
+	botReasonBlocked   = "blocked"
+)
+
+var (
+	// defaultBotUserAgents is a list of user agents used by common vulnerability scanners
+	defaultBotUserAgents = []string{
+		"(?i)sqlmap",
+		"(?i)nikto",
+		"(?i)nmap",
+		"(?i)masscan",
+		"(?i)zgrab",
+		"(?i)nuclei",
+		"(?i)dirbuster",
+		"(?i)gobuster",
+		"(?i)wpscan",
+		"(?i)acunetix",
+		"(?i)netsparker",
+	}
+)
+
+//
+// botDetector tracks the clients flagged as scanners
+//
+type botDetector struct {
+	sync.Mutex
+	// the configuration
+	config BotDetection
+	// the compiled user agent filters
+	userAgents []*regexp.Regexp
+	// the networks permitted to bypass the checks
+	allowed []*net.IPNet
+	// the state of the clients
+	clients map[string]*botClient
+}
+
+//
+// botClient is the tracked state of a client address
+//
+type botClient struct {
+	// the number of not found responses in the window
+	notFound int
+	// the start of the current window
+	windowStart time.Time
+	// blockedUntil is the time the client is blocked until
+	blockedUntil time.Time
+}
+
+//
+// isValid validates the bot detection configuration
+//
+func (r *BotDetection) isValid() error {
+	for _, x := range r.UserAgents {
+		if _, err := regexp.Compile(x); err != nil {
+			return fmt.Errorf("the bot user agent filter: %s is not a valid regex", x)
+		}
+	}
+	for _, x := range r.Allowlist {
+		if _, err := parseNetwork(x); err != nil {
+			return fmt.Errorf("the bot allowlist entry: %s is invalid, %s", x, err)
+		}
+	}
+	if r.MaxNotFound < 0 {
+		return fmt.Errorf("the bot max not found must be a positive value")
+	}
+
+	return nil
+}
+
+//
+// newBotDetector creates a detector from the configuration
+//
+func newBotDetector(config BotDetection) (*botDetector, error) {
+	if config.NotFoundWindow <= 0 {
+		config.NotFoundWindow = time.Duration(1) * time.Minute
+	}
+	if config.BlockDuration <= 0 {
+		config.BlockDuration = time.Duration(10) * time.Minute
+	}
+	if len(config.UserAgents) <= 0 {
+		config.UserAgents = defaultBotUserAgents
+	}
+
+	detector := &botDetector{
+		config:  config,
+		clients: make(map[string]*botClient, 0),
+	}
+	for _, x := range config.UserAgents {
+		filter, err := regexp.Compile(x)
+		if err != nil {
+			return nil, err
+		}
+		detector.userAgents = append(detector.userAgents, filter)
+	}
+	for _, x := range config.Allowlist {
+		network, err := parseNetwork(x)
+		if err != nil {
+			return nil, err
+		}
+		detector.allowed = append(detector.allowed, network)
+	}
+
+	return detector, nil
+}
+
+//
+// isAllowed checks if the client address is on the allowlist
+//
+func (r *botDetector) isAllowed(address string) bool {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return false
+	}
+	for _, x := range r.allowed {
+		if x.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+//
+// inspect checks the request against the heuristics, returning the reason if the client is flagged
+//
+func (r *botDetector) inspect(address string, req *http.Request) string {
+	r.Lock()
+	defer r.Unlock()
+
+	if client, found := r.clients[address]; found && time.Now().Before(client.blockedUntil) {
+		return botReasonBlocked
+	}
+
+	agent := req.Header.Get("User-Agent")
+	for _, x := range r.userAgents {
+		if x.MatchString(agent) {
+			r.blockClient(address)
+			return botReasonUserAgent
+		}
+	}
+	for _, x := range r.config.RequireHeaders {
+		if req.Header.Get(x) == "" {
+			return botReasonHeaders
+		}
+	}
+
+	return ""
+}
+
+//
+// recordNotFound records a not found response for the client, returning true if the client is now blocked
+//
+func (r *botDetector) recordNotFound(address string) bool {
+	if r.config.MaxNotFound <= 0 {
+		return false
+	}
+	r.Lock()
+	defer r.Unlock()
+
+	now := time.Now()
+	client, found := r.clients[address]
+	if !found || now.Sub(client.windowStart) > r.config.NotFoundWindow {
+		r.pruneClients(now)
+		client = &botClient{windowStart: now}
+		r.clients[address] = client
+	}
+	client.notFound++
+	if client.notFound > r.config.MaxNotFound {
+		client.blockedUntil = now.Add(r.config.BlockDuration)
+		return true
+	}
+
+	return false
+}
+
+//
+// blockClient marks the client as blocked, the lock must be held
+//
+func (r *botDetector) blockClient(address string) {
+	now := time.Now()
+	client, found := r.clients[address]
+	if !found {
+		client = &botClient{windowStart: now}
+		r.clients[address] = client
+	}
+	client.blockedUntil = now.Add(r.config.BlockDuration)
+}
+
+//
+// pruneClients removes any clients whose window and block have both expired, the lock must be held
+//
+func (r *botDetector) pruneClients(now time.Time) {
+	for address, client := range r.clients {
+		if now.Sub(client.windowStart) > r.config.NotFoundWindow && now.After(client.blockedUntil) {
+			delete(r.clients, address)
+		}
+	}
+}
+
+//
+// botDetectionMiddleware flags obvious scanners and serves a challenge before they reach the upstream
+//
+func (r *oauthProxy) botDetectionMiddleware() gin.HandlerFunc {
+	detector, err := newBotDetector(r.config.BotDetection)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err.Error()}).Fatalf("failed to create the bot detector")
+	}
+
+	detections := prometheus.MustRegisterOrGet(prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "proxy_bot_detections_total",
+			Help: "The requests flagged by the bot detection, partitioned by reason",
+		},
+		[]string{"reason"},
+	)).(*prometheus.CounterVec)
+
+	return func(cx *gin.Context) {
+		// step: the forwarded headers are set by the client, so the allowlist and blocks are by the peer address
+		address := getRemoteAddress(cx.Request)
+		if detector.isAllowed(address) {
+			cx.Next()
+			return
+		}
+
+		if reason := detector.inspect(address, cx.Request); reason != "" {
+			detections.WithLabelValues(reason).Inc()
+			log.WithFields(log.Fields{
+				"client_ip":  address,
+				"reason":     reason,
+				"user_agent": cx.Request.Header.Get("User-Agent"),
+				"path":       cx.Request.URL.Path,
+			}).Warnf("request flagged by the bot detection")
+
+			r.botChallenge(cx, detector.config.BlockDuration)
+			return
+		}
+
+		cx.Next()
+
+		if cx.Writer.Status() == http.StatusNotFound && detector.recordNotFound(address) {
+			detections.WithLabelValues(botReasonNotFound).Inc()
+			log.WithFields(log.Fields{
+				"client_ip": address,
+				"blocked":   detector.config.BlockDuration.String(),
+			}).Warnf("client exceeded the not found rate, blocking the client")
+		}
+	}
+}
+
+//
+// botChallenge serves the challenge page, or a too many requests if no page is configured
+//
+func (r *oauthProxy) botChallenge(cx *gin.Context, retry time.Duration) {
+	cx.Header("Retry-After", fmt.Sprintf("%d", int(retry.Seconds())))
+	if r.config.BotDetection.ChallengePage != "" {
+		cx.HTML(http.StatusTooManyRequests, path.Base(r.config.BotDetection.ChallengePage), r.config.TagData)
+		cx.Abort()
+		return
+	}
+
+	cx.AbortWithStatus(http.StatusTooManyRequests)
+}
+
+//
+// parseNetwork parses a cidr or a single address into a network
+//
+func parseNetwork(v string) (*net.IPNet, error) {
+	if !strings.Contains(v, "/") {
+		if ip := net.ParseIP(v); ip != nil && ip.To4() != nil {
+			v = v + "/32"
+		} else {
+			v = v + "/128"
+		}
+	}
+	_, network, err := net.ParseCIDR(v)
+
+	return network, err
+}
@@ -0,0 +1,115 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBotDetectionIsValid(t *testing.T) {
+	assert.NoError(t, (&BotDetection{}).isValid())
+	assert.NoError(t, (&BotDetection{Allowlist: []string{"10.0.0.0/8", "127.0.0.1", "::1"}}).isValid())
+	assert.Error(t, (&BotDetection{Allowlist: []string{"not_an_address"}}).isValid())
+	assert.Error(t, (&BotDetection{UserAgents: []string{"(bad"}}).isValid())
+	assert.Error(t, (&BotDetection{MaxNotFound: -1}).isValid())
+}
+
+func TestBotDetectorInspect(t *testing.T) {
+	detector, err := newBotDetector(BotDetection{
+		RequireHeaders: []string{"Accept"},
+		Allowlist:      []string{"10.0.0.0/8"},
+	})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	request := &http.Request{Header: http.Header{}}
+	request.Header.Set("User-Agent", "Mozilla/5.0")
+	request.Header.Set("Accept", "*/*")
+	assert.Empty(t, detector.inspect("127.0.0.1", request))
+
+	request.Header.Del("Accept")
+	assert.Equal(t, botReasonHeaders, detector.inspect("127.0.0.1", request))
+
+	request.Header.Set("Accept", "*/*")
+	request.Header.Set("User-Agent", "sqlmap/1.0-dev")
+	assert.Equal(t, botReasonUserAgent, detector.inspect("127.0.0.2", request))
+
+	// step: the client should now be blocked, regardless of the user agent
+	request.Header.Set("User-Agent", "Mozilla/5.0")
+	assert.Equal(t, botReasonBlocked, detector.inspect("127.0.0.2", request))
+
+	assert.True(t, detector.isAllowed("10.1.1.1"))
+	assert.False(t, detector.isAllowed("127.0.0.1"))
+}
+
+func TestBotDetectorNotFound(t *testing.T) {
+	detector, _ := newBotDetector(BotDetection{MaxNotFound: 2})
+	request := &http.Request{Header: http.Header{}}
+
+	assert.False(t, detector.recordNotFound("127.0.0.1"))
+	assert.False(t, detector.recordNotFound("127.0.0.1"))
+	assert.Empty(t, detector.inspect("127.0.0.1", request))
+	assert.True(t, detector.recordNotFound("127.0.0.1"))
+	assert.Equal(t, botReasonBlocked, detector.inspect("127.0.0.1", request))
+	assert.Empty(t, detector.inspect("127.0.0.3", request))
+}
+
+func TestBotDetectionHandler(t *testing.T) {
+	config := newFakeKeycloakConfig()
+	config.EnableBotDetection = true
+	_, _, u := newTestProxyService(config)
+
+	request, _ := http.NewRequest("GET", u+"/not_secure", nil)
+	request.Header.Set("User-Agent", "Nikto/2.1.6")
+	resp, err := http.DefaultClient.Do(request)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.NotEmpty(t, resp.Header.Get("Retry-After"))
+}
+
+func TestBotDetectionForwardedAddress(t *testing.T) {
+	config := newFakeKeycloakConfig()
+	config.EnableBotDetection = true
+	config.BotDetection.Allowlist = []string{"10.0.0.1"}
+	_, _, u := newTestProxyService(config)
+
+	request, _ := http.NewRequest("GET", u+"/not_secure", nil)
+	request.Header.Set("User-Agent", "Nikto/2.1.6")
+	request.Header.Set("X-Forwarded-For", "10.0.0.1")
+	request.Header.Set("X-Real-Ip", "10.0.0.1")
+	resp, err := http.DefaultClient.Do(request)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+}
+
+func TestParseNetwork(t *testing.T) {
+	network, err := parseNetwork("127.0.0.1")
+	assert.NoError(t, err)
+	assert.Equal(t, "127.0.0.1/32", network.String())
+	network, err = parseNetwork("10.0.0.0/8")
+	assert.NoError(t, err)
+	assert.Equal(t, "10.0.0.0/8", network.String())
+	_, err = parseNetwork("bad")
+	assert.Error(t, err)
+}
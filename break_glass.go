@@ -0,0 +1,316 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/urfave/cli"
+)
+
+const (
+	// headerBreakGlass is the header carrying the break glass token
+	headerBreakGlass = "X-Break-Glass-Token"
+	// breakGlassTokenPrefix is the version prefix of the break glass tokens
+	breakGlassTokenPrefix = "bg1"
+	// breakGlassMinKeyLength is the minimum length of the break glass key
+	breakGlassMinKeyLength = 32
+)
+
+//
+// breakGlassClaims are the claims of a break glass token
+//
+type breakGlassClaims struct {
+	// ID is a unique identifier for the token
+	ID string `json:"jti"`
+	// Subject is who the token was issued to and why
+	Subject string `json:"sub"`
+	// IssuedAt is when the token was issued
+	IssuedAt int64 `json:"iat"`
+	// Expires is when the token expires
+	Expires int64 `json:"exp"`
+}
+
+//
+// breakGlass verifies the break glass tokens and limits the rate they're used
+//
+type breakGlass struct {
+	sync.Mutex
+	// the key the tokens are signed with
+	key []byte
+	// the maximum lifetime of a token
+	maxDuration time.Duration
+	// the permitted requests per minute
+	rate int
+	// the requests remaining in the current minute
+	remaining int
+	// the start of the current minute
+	window time.Time
+}
+
+//
+// newBreakGlass creates the break glass verifier
+//
+func newBreakGlass(key string, maxDuration time.Duration, rate int) *breakGlass {
+	return &breakGlass{key: []byte(key), maxDuration: maxDuration, rate: rate}
+}
+
+//
+// issueBreakGlassToken creates a signed break glass token for the subject
+//
+func issueBreakGlassToken(key, subject string, duration time.Duration, now time.Time) (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(&breakGlassClaims{
+		ID:       hex.EncodeToString(id),
+		Subject:  subject,
+		IssuedAt: now.Unix(),
+		Expires:  now.Add(duration).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+
+	return fmt.Sprintf("%s.%s.%s", breakGlassTokenPrefix, encoded, getBreakGlassSignature([]byte(key), encoded)), nil
+}
+
+//
+// getBreakGlassSignature returns the hmac of the encoded claims
+//
+func getBreakGlassSignature(key []byte, payload string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(breakGlassTokenPrefix + "." + payload))
+
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+//
+// verify checks the signature and lifetime of the token, returning the claims
+//
+func (r *breakGlass) verify(token string, now time.Time) (*breakGlassClaims, error) {
+	items := strings.Split(token, ".")
+	if len(items) != 3 || items[0] != breakGlassTokenPrefix {
+		return nil, errors.New("the break glass token is malformed")
+	}
+	if !hmac.Equal([]byte(items[2]), []byte(getBreakGlassSignature(r.key, items[1]))) {
+		return nil, errors.New("the break glass token signature is invalid")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(items[1])
+	if err != nil {
+		return nil, errors.New("the break glass token is malformed")
+	}
+	claims := &breakGlassClaims{}
+	if err := json.Unmarshal(payload, claims); err != nil {
+		return nil, errors.New("the break glass token is malformed")
+	}
+	if claims.Subject == "" || claims.ID == "" {
+		return nil, errors.New("the break glass token has no subject or identifier")
+	}
+	if time.Duration(claims.Expires-claims.IssuedAt)*time.Second > r.maxDuration {
+		return claims, fmt.Errorf("the break glass token lifetime exceeds the maximum of %s", r.maxDuration)
+	}
+	if now.Unix() < claims.IssuedAt-60 {
+		return claims, errors.New("the break glass token was issued in the future")
+	}
+	if now.Unix() >= claims.Expires {
+		return claims, errors.New("the break glass token has expired")
+	}
+
+	return claims, nil
+}
+
+//
+// allow checks the request is within the rate limit, which is shared by all the tokens
+//
+func (r *breakGlass) allow(now time.Time) bool {
+	r.Lock()
+	defer r.Unlock()
+
+	if now.Sub(r.window) >= time.Minute {
+		r.window = now
+		r.remaining = r.rate
+	}
+	if r.remaining <= 0 {
+		return false
+	}
+	r.remaining--
+
+	return true
+}
+
+//
+// admit checks the token permits the request to the resource, only read requests to the resources which opt in
+// are permitted
+//
+func (r *breakGlass) admit(token string, req *http.Request, resource *Resource, now time.Time) (*breakGlassClaims, error) {
+	claims, err := r.verify(token, now)
+	if err != nil {
+		return claims, err
+	}
+	if !resource.BreakGlass {
+		return claims, fmt.Errorf("the resource: %s does not permit break glass access", resource.URL)
+	}
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return claims, fmt.Errorf("break glass access is read only, the method: %s is not permitted", req.Method)
+	}
+	if !r.allow(now) {
+		return claims, errors.New("the break glass rate limit has been reached")
+	}
+
+	return claims, nil
+}
+
+//
+// breakGlassMiddleware permits a request with a valid break glass token through without the identity provider,
+// every use, permitted or not, is audited
+//
+func (r *oauthProxy) breakGlassMiddleware() gin.HandlerFunc {
+	if r.config.BreakGlassKey == "" {
+		return func(cx *gin.Context) {
+			cx.Request.Header.Del(headerBreakGlass)
+		}
+	}
+	verifier := newBreakGlass(r.config.BreakGlassKey, r.config.BreakGlassMaxDuration, r.config.BreakGlassRateLimit)
+
+	attempts := prometheus.MustRegisterOrGet(prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "proxy_break_glass_requests_total",
+			Help: "The requests carrying a break glass token, partitioned by the result",
+		},
+		[]string{"result"},
+	)).(*prometheus.CounterVec)
+
+	return func(cx *gin.Context) {
+		token := cx.Request.Header.Get(headerBreakGlass)
+		if token == "" {
+			return
+		}
+		cx.Request.Header.Del(headerBreakGlass)
+
+		resource, found := cx.Get(cxEnforce)
+		if !found {
+			return
+		}
+
+		claims, err := verifier.admit(token, cx.Request, resource.(*Resource), time.Now())
+		fields := getBreakGlassAuditFields(cx.Request, resource.(*Resource))
+		if claims != nil {
+			fields["subject"] = claims.Subject
+			fields["token_id"] = claims.ID
+			fields["expires"] = time.Unix(claims.Expires, 0).Format(time.RFC3339)
+		}
+		if err != nil {
+			fields["error"] = err.Error()
+			log.WithFields(fields).Errorf("rejected a break glass request")
+			attempts.WithLabelValues("rejected").Inc()
+
+			r.accessForbidden(cx)
+			return
+		}
+		log.WithFields(fields).Warnf("permitted a break glass request, bypassing the identity provider")
+		attempts.WithLabelValues("permitted").Inc()
+
+		// step: skip the authentication
+		delete(cx.Keys, cxEnforce)
+		cx.Set(cxBreakGlass, claims)
+	}
+}
+
+//
+// getBreakGlassAuditFields returns the fields of the audit record, the client address being the peer address as the
+// forwarded headers can be forged by the client; the forwarded chain is recorded separately, for what it's worth
+//
+func getBreakGlassAuditFields(req *http.Request, resource *Resource) log.Fields {
+	fields := log.Fields{
+		"audit":     "break-glass",
+		"client_ip": getRemoteAddress(req),
+		"method":    req.Method,
+		"uri":       req.URL.Path,
+		"resource":  resource.getName(),
+	}
+	if forwarded := req.Header.Get("X-Forwarded-For"); forwarded != "" {
+		fields["forwarded_for"] = forwarded
+	}
+
+	return fields
+}
+
+//
+// newBreakGlassCommand creates the command to issue the break glass tokens
+//
+func newBreakGlassCommand(config *Config) cli.Command {
+	return cli.Command{
+		Name:  "break-glass",
+		Usage: "helpers for the emergency access to the resources when the identity provider is unavailable",
+		Subcommands: []cli.Command{
+			{
+				Name:      "issue",
+				Usage:     "issues a break glass token, signed with the --break-glass-key",
+				UsageText: "keycloak-proxy break-glass issue --break-glass-key KEY --subject WHO_AND_WHY [--duration 1h]",
+				Flags: append(getOptions(),
+					cli.StringFlag{
+						Name:  "subject",
+						Usage: "who the token is issued to and why, e.g. the operator and incident, recorded in the audit log",
+					},
+					cli.DurationFlag{
+						Name:  "duration",
+						Usage: "the lifetime of the token, limited by the --break-glass-max-duration",
+						Value: time.Hour,
+					},
+				),
+				Action: func(cx *cli.Context) error {
+					if err := parseConfig(cx, config); err != nil {
+						return printError(err.Error())
+					}
+					if len(config.BreakGlassKey) < breakGlassMinKeyLength {
+						return printError("a break glass key of at least %d characters is required, use --break-glass-key or the configuration file", breakGlassMinKeyLength)
+					}
+					if strings.TrimSpace(cx.String("subject")) == "" {
+						return printError("no subject given, use --subject to record who the token is for and why")
+					}
+					duration := cx.Duration("duration")
+					if duration <= 0 || duration > config.BreakGlassMaxDuration {
+						return printError("the duration must be positive and no more than the maximum of %s", config.BreakGlassMaxDuration)
+					}
+					token, err := issueBreakGlassToken(config.BreakGlassKey, cx.String("subject"), duration, time.Now())
+					if err != nil {
+						return printError("unable to issue the token, error: %s", err)
+					}
+					fmt.Fprintln(cx.App.Writer, token)
+
+					return nil
+				},
+			},
+		},
+	}
+}
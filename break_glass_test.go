@@ -0,0 +1,137 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const fakeBreakGlassKey = "c8fe3cd5a0b1d4d2e4a7f0b9c6e1d3a5"
+
+func TestBreakGlassVerify(t *testing.T) {
+	now := time.Now()
+	verifier := newBreakGlass(fakeBreakGlassKey, 4*time.Hour, 10)
+	valid, _ := issueBreakGlassToken(fakeBreakGlassKey, "jsmith incident-42", time.Hour, now)
+	other, _ := issueBreakGlassToken("another-key-of-at-least-32-chars!", "jsmith", time.Hour, now)
+	long, _ := issueBreakGlassToken(fakeBreakGlassKey, "jsmith", 24*time.Hour, now)
+	future, _ := issueBreakGlassToken(fakeBreakGlassKey, "jsmith", time.Hour, now.Add(time.Hour))
+	items := strings.Split(valid, ".")
+
+	cases := []struct {
+		Token string
+		Now   time.Time
+		Ok    bool
+	}{
+		{Token: valid, Now: now, Ok: true},
+		{Token: valid, Now: now.Add(59 * time.Minute), Ok: true},
+		{Token: valid, Now: now.Add(time.Hour)},
+		{Token: other, Now: now},
+		{Token: long, Now: now},
+		{Token: future, Now: now},
+		{Token: items[0] + "." + items[1] + ".c2lnbmF0dXJl", Now: now},
+		{Token: "bg2." + items[1] + "." + items[2], Now: now},
+		{Token: "not_a_token", Now: now},
+	}
+	for i, c := range cases {
+		claims, err := verifier.verify(c.Token, c.Now)
+		if !c.Ok {
+			assert.Error(t, err, "case %d should have failed", i)
+			continue
+		}
+		if assert.NoError(t, err, "case %d should not have failed", i) {
+			assert.Equal(t, "jsmith incident-42", claims.Subject, "case %d, unexpected subject", i)
+		}
+	}
+}
+
+func TestBreakGlassRateLimit(t *testing.T) {
+	now := time.Now()
+	verifier := newBreakGlass(fakeBreakGlassKey, time.Hour, 2)
+	assert.True(t, verifier.allow(now))
+	assert.True(t, verifier.allow(now.Add(time.Second)))
+	assert.False(t, verifier.allow(now.Add(2*time.Second)))
+	assert.True(t, verifier.allow(now.Add(time.Minute)))
+}
+
+func TestGetBreakGlassAuditFields(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/status", nil)
+	req.RemoteAddr = "10.10.10.1:4433"
+	req.Header.Set("X-Forwarded-For", "192.168.1.1")
+	req.Header.Set("X-Real-Ip", "192.168.1.1")
+	fields := getBreakGlassAuditFields(req, &Resource{URL: "/status", Methods: []string{"GET"}})
+	assert.Equal(t, "10.10.10.1", fields["client_ip"])
+	assert.Equal(t, "192.168.1.1", fields["forwarded_for"])
+	assert.Equal(t, "/status", fields["uri"])
+
+	req.Header.Del("X-Forwarded-For")
+	assert.NotContains(t, getBreakGlassAuditFields(req, &Resource{URL: "/status"}), "forwarded_for")
+}
+
+func TestBreakGlassMiddleware(t *testing.T) {
+	config := newFakeKeycloakConfig()
+	config.BreakGlassKey = fakeBreakGlassKey
+	config.BreakGlassMaxDuration = time.Hour
+	config.BreakGlassRateLimit = 2
+	config.Resources = append([]*Resource{
+		{
+			URL:        "/status",
+			Methods:    []string{"ANY"},
+			BreakGlass: true,
+		},
+	}, config.Resources...)
+	_, _, u := newTestProxyService(config)
+	token, err := issueBreakGlassToken(fakeBreakGlassKey, "jsmith incident-42", time.Hour, time.Now())
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	cases := []struct {
+		Method   string
+		URI      string
+		Token    string
+		HTTPCode int
+	}{
+		{URI: "/status", HTTPCode: http.StatusTemporaryRedirect},
+		// note: the fake upstream doesn't write a response
+		{URI: "/status", Token: token, HTTPCode: http.StatusNotFound},
+		{URI: "/status", Token: "bg1.e30.invalid", HTTPCode: http.StatusForbidden},
+		{Method: "POST", URI: "/status", Token: token, HTTPCode: http.StatusForbidden},
+		{URI: fakeAdminRoleURL, Token: token, HTTPCode: http.StatusForbidden},
+		{URI: "/status/detail", Token: token, HTTPCode: http.StatusNotFound},
+		// the rate limit has been reached
+		{URI: "/status", Token: token, HTTPCode: http.StatusForbidden},
+	}
+	for i, c := range cases {
+		if c.Method == "" {
+			c.Method = "GET"
+		}
+		request, _ := http.NewRequest(c.Method, u+c.URI, nil)
+		if c.Token != "" {
+			request.Header.Set(headerBreakGlass, c.Token)
+		}
+		resp, err := http.DefaultTransport.RoundTrip(request)
+		if !assert.NoError(t, err, "case %d, unable to make the request", i) {
+			continue
+		}
+		resp.Body.Close()
+		assert.Equal(t, c.HTTPCode, resp.StatusCode, "case %d, expected: %d, got: %d", i, c.HTTPCode, resp.StatusCode)
+	}
+}
@@ -0,0 +1,129 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	headerCacheControl = "Cache-Control"
+	headerVary         = "Vary"
+)
+
+// authenticatedVary are the request headers an authenticated response varies by
+var authenticatedVary = []string{"Cookie", "Authorization"}
+
+//
+// cacheControlWriter marks the response as private before the headers are written
+//
+type cacheControlWriter struct {
+	gin.ResponseWriter
+	// the cache control for the authenticated responses
+	cacheControl string
+	// the headers have been updated
+	done bool
+}
+
+//
+// cacheHeadersMiddleware prevents the shared caches in front of the proxy from storing the authenticated responses,
+// the upstream cache control is replaced unless already private or no-store
+//
+func (r *oauthProxy) cacheHeadersMiddleware() gin.HandlerFunc {
+	return func(cx *gin.Context) {
+		if !r.config.EnableCacheHeaders {
+			return
+		}
+		if _, found := cx.Get(userContextName); found {
+			cx.Writer = &cacheControlWriter{ResponseWriter: cx.Writer, cacheControl: r.config.CacheControl}
+		}
+	}
+}
+
+//
+// setHeaders updates the cache control and vary headers of the response, once
+//
+func (r *cacheControlWriter) setHeaders() {
+	if r.done {
+		return
+	}
+	r.done = true
+
+	header := r.ResponseWriter.Header()
+	if value := strings.ToLower(header.Get(headerCacheControl)); !strings.Contains(value, "private") && !strings.Contains(value, "no-store") {
+		header.Set(headerCacheControl, r.cacheControl)
+	}
+	header[headerVary] = mergeVary(header[headerVary], authenticatedVary)
+}
+
+//
+// WriteHeader updates the headers before writing the status
+//
+func (r *cacheControlWriter) WriteHeader(code int) {
+	r.setHeaders()
+	r.ResponseWriter.WriteHeader(code)
+}
+
+//
+// WriteHeaderNow updates the headers before they are written
+//
+func (r *cacheControlWriter) WriteHeaderNow() {
+	r.setHeaders()
+	r.ResponseWriter.WriteHeaderNow()
+}
+
+//
+// Write updates the headers before the body is written
+//
+func (r *cacheControlWriter) Write(content []byte) (int, error) {
+	r.setHeaders()
+	return r.ResponseWriter.Write(content)
+}
+
+//
+// WriteString updates the headers before the body is written
+//
+func (r *cacheControlWriter) WriteString(content string) (int, error) {
+	r.setHeaders()
+	return r.ResponseWriter.WriteString(content)
+}
+
+//
+// mergeVary adds the headers to the vary values, ignoring any already present
+//
+func mergeVary(values, headers []string) []string {
+	var existing []string
+	for _, x := range values {
+		for _, name := range strings.Split(x, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				existing = append(existing, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	if containedIn("*", existing) {
+		return []string{"*"}
+	}
+	for _, x := range headers {
+		if !containedIn(x, existing) {
+			existing = append(existing, x)
+		}
+	}
+
+	return []string{strings.Join(existing, ", ")}
+}
@@ -0,0 +1,96 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCacheHeadersMiddleware(t *testing.T) {
+	config := newFakeKeycloakConfig()
+	config.EnableCacheHeaders = true
+	config.CacheControl = "private, max-age=60"
+	p, _, _ := newTestProxyService(config)
+
+	cases := []struct {
+		Identity     *userContext
+		Disabled     bool
+		CacheControl string
+		Vary         string
+		Expected     http.Header
+	}{
+		{
+			CacheControl: "public, max-age=3600",
+			Expected:     http.Header{"Cache-Control": []string{"public, max-age=3600"}, "Vary": []string{""}},
+		},
+		{
+			Identity: &userContext{id: "test"},
+			Expected: http.Header{"Cache-Control": []string{"private, max-age=60"}, "Vary": []string{"Cookie, Authorization"}},
+		},
+		{
+			Identity:     &userContext{id: "test"},
+			CacheControl: "public, max-age=3600",
+			Vary:         "Accept-Encoding",
+			Expected: http.Header{
+				"Cache-Control": []string{"private, max-age=60"},
+				"Vary":          []string{"Accept-Encoding, Cookie, Authorization"},
+			},
+		},
+		{
+			Identity:     &userContext{id: "test"},
+			CacheControl: "no-store",
+			Vary:         "cookie, Origin",
+			Expected:     http.Header{"Cache-Control": []string{"no-store"}, "Vary": []string{"Cookie, Origin, Authorization"}},
+		},
+		{
+			Identity:     &userContext{id: "test"},
+			CacheControl: "Private",
+			Vary:         "*",
+			Expected:     http.Header{"Cache-Control": []string{"Private"}, "Vary": []string{"*"}},
+		},
+		{
+			Identity:     &userContext{id: "test"},
+			Disabled:     true,
+			CacheControl: "public",
+			Expected:     http.Header{"Cache-Control": []string{"public"}, "Vary": []string{""}},
+		},
+	}
+	for i, c := range cases {
+		p.config.EnableCacheHeaders = !c.Disabled
+		cx := newFakeGinContext("GET", fakeAuthAllURL)
+		if c.Identity != nil {
+			cx.Set(userContextName, c.Identity)
+		}
+		p.cacheHeadersMiddleware()(cx)
+		// step: emulate the upstream response
+		if c.CacheControl != "" {
+			cx.Writer.Header().Set("Cache-Control", c.CacheControl)
+		}
+		if c.Vary != "" {
+			cx.Writer.Header().Set("Vary", c.Vary)
+		}
+		cx.Writer.WriteHeader(http.StatusOK)
+		cx.Writer.Write([]byte("content"))
+
+		for k := range c.Expected {
+			assert.Equal(t, c.Expected.Get(k), cx.Writer.Header().Get(k), "case %d, header: %s, expected: %s, got: %s",
+				i, k, c.Expected.Get(k), cx.Writer.Header().Get(k))
+		}
+	}
+}
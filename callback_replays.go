@@ -0,0 +1,121 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"container/heap"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// callbackReplayKeyPrefix is the prefix of the used codes and states held in the store
+	callbackReplayKeyPrefix = "callback."
+)
+
+//
+// claimingStorage is a store which can atomically add an expiring key, only if it's not already present
+//
+type claimingStorage interface {
+	expiringStorage
+	// SetIfNotExists adds the key to the store, removed after the duration, returning false if already present
+	SetIfNotExists(string, string, time.Duration) (bool, error)
+}
+
+//
+// callbackReplayEntry is a used value and when it expires
+//
+type callbackReplayEntry struct {
+	// the hash of the value
+	key string
+	// when the use expires
+	expires time.Time
+}
+
+//
+// callbackReplayQueue is the used values ordered by their expiry
+//
+type callbackReplayQueue []callbackReplayEntry
+
+func (q callbackReplayQueue) Len() int            { return len(q) }
+func (q callbackReplayQueue) Less(i, j int) bool  { return q[i].expires.Before(q[j].expires) }
+func (q callbackReplayQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *callbackReplayQueue) Push(x interface{}) { *q = append(*q, x.(callbackReplayEntry)) }
+
+func (q *callbackReplayQueue) Pop() interface{} {
+	old := *q
+	entry := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return entry
+}
+
+//
+// callbackReplays tracks the authorization codes and states used on the callback, for their validity window, so an
+// intercepted code or state can't be replayed; the used values are claimed in the store when it can do so atomically
+//
+type callbackReplays struct {
+	sync.Mutex
+	// the used values in memory, keyed by the hash, and when they expire
+	used map[string]time.Time
+	// the used values in memory, ordered by their expiry
+	expiry callbackReplayQueue
+	// the shared store, if any
+	store claimingStorage
+}
+
+//
+// newCallbackReplays creates the callback replay tracking
+//
+func newCallbackReplays(store claimingStorage) *callbackReplays {
+	return &callbackReplays{used: make(map[string]time.Time), store: store}
+}
+
+//
+// isReplay records the use of the value, checking if it has already been used within the window; an error claiming
+// the value in the store is returned, as the value may have been used on another instance
+//
+func (r *callbackReplays) isReplay(kind, value string, window time.Duration, now time.Time) (bool, error) {
+	hash := sha256.Sum256([]byte(value))
+	key := callbackReplayKeyPrefix + kind + "." + hex.EncodeToString(hash[:])
+	expires := now.Add(window)
+
+	r.Lock()
+	for r.expiry.Len() > 0 && !now.Before(r.expiry[0].expires) {
+		delete(r.used, heap.Pop(&r.expiry).(callbackReplayEntry).key)
+	}
+	if _, found := r.used[key]; found {
+		r.Unlock()
+		return true, nil
+	}
+	r.used[key] = expires
+	heap.Push(&r.expiry, callbackReplayEntry{key: key, expires: expires})
+	r.Unlock()
+
+	// step: claim the value in the store, so it can't be used on another instance
+	if r.store != nil {
+		claimed, err := r.store.SetIfNotExists(key, strconv.FormatInt(expires.Unix(), 10), window)
+		if err != nil {
+			return false, err
+		}
+
+		return !claimed, nil
+	}
+
+	return false, nil
+}
@@ -0,0 +1,122 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func isReplay(t *testing.T, replays *callbackReplays, kind, value string, window time.Duration, now time.Time) bool {
+	found, err := replays.isReplay(kind, value, window, now)
+	assert.NoError(t, err)
+	return found
+}
+
+func TestCallbackReplays(t *testing.T) {
+	now := time.Now()
+	replays := newCallbackReplays(nil)
+	assert.False(t, isReplay(t, replays, "code", "abc", time.Minute, now))
+	assert.True(t, isReplay(t, replays, "code", "abc", time.Minute, now.Add(30*time.Second)))
+	assert.False(t, isReplay(t, replays, "state", "abc", time.Minute, now))
+	assert.False(t, isReplay(t, replays, "code", "abc", time.Minute, now.Add(time.Minute)))
+	assert.Len(t, replays.used, 1)
+}
+
+func TestCallbackReplaysSharedStore(t *testing.T) {
+	now := time.Now()
+	store := &fakeExpiringStore{values: make(map[string]string)}
+	first, second := newCallbackReplays(store), newCallbackReplays(store)
+	assert.False(t, isReplay(t, first, "code", "abc", time.Minute, now))
+	assert.True(t, isReplay(t, second, "code", "abc", time.Minute, now))
+	assert.Len(t, store.values, 1)
+	// step: the store expires the key after the window
+	store.values = make(map[string]string)
+	assert.False(t, isReplay(t, second, "code", "abc", time.Minute, now.Add(2*time.Minute)))
+	assert.Len(t, store.values, 1)
+}
+
+func TestCallbackReplaysStoreFailure(t *testing.T) {
+	store := &fakeExpiringStore{values: make(map[string]string), err: errors.New("the store is unavailable")}
+	replays := newCallbackReplays(store)
+	found, err := replays.isReplay("code", "abc", time.Minute, time.Now())
+	assert.Error(t, err)
+	assert.False(t, found)
+}
+
+func TestCallbackReplaysExpiry(t *testing.T) {
+	now := time.Now()
+	replays := newCallbackReplays(nil)
+	for i, value := range []string{"a", "b", "c"} {
+		assert.False(t, isReplay(t, replays, "code", value, time.Duration(3-i)*time.Minute, now))
+	}
+	assert.False(t, isReplay(t, replays, "code", "d", time.Hour, now.Add(90*time.Second)))
+	assert.Len(t, replays.used, 3)
+	assert.Len(t, replays.expiry, 3)
+	assert.True(t, isReplay(t, replays, "code", "a", time.Minute, now.Add(90*time.Second)))
+	assert.False(t, isReplay(t, replays, "code", "c", time.Minute, now.Add(90*time.Second)))
+}
+
+func getFakeCallbackURL(t *testing.T, u string) string {
+	req, _ := http.NewRequest("GET", u+"/oauth/authorize?state=L2FkbWlu", nil)
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	req, _ = http.NewRequest("GET", resp.Header.Get("Location"), nil)
+	resp, err = http.DefaultTransport.RoundTrip(req)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	return resp.Header.Get("Location")
+}
+
+func TestCallbackReplayRefused(t *testing.T) {
+	config := newFakeKeycloakConfig()
+	config.EnableCallbackReplayProtection = true
+	config.CallbackReplayWindow = time.Minute
+	_, _, u := newTestProxyService(config)
+
+	callbackURL := getFakeCallbackURL(t, u)
+	for i, expected := range []int{http.StatusTemporaryRedirect, http.StatusForbidden} {
+		req, _ := http.NewRequest("GET", callbackURL, nil)
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if assert.NoError(t, err, "case %d, unable to call the callback", i) {
+			resp.Body.Close()
+			assert.Equal(t, expected, resp.StatusCode, "case %d, unexpected status", i)
+		}
+	}
+}
+
+func TestCallbackReplayStoreFailure(t *testing.T) {
+	config := newFakeKeycloakConfig()
+	config.EnableCallbackReplayProtection = true
+	config.CallbackReplayWindow = time.Minute
+	p, _, u := newTestProxyService(config)
+	p.replays = newCallbackReplays(&fakeExpiringStore{values: make(map[string]string), err: errors.New("the store is unavailable")})
+
+	req, _ := http.NewRequest("GET", getFakeCallbackURL(t, u), nil)
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+	}
+}
@@ -0,0 +1,186 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+//
+// certificateStore selects the certificate presented to the client by the server name (sni)
+//
+type certificateStore struct {
+	sync.RWMutex
+	// the certificate used when no server name matches
+	defaultCertificate *tls.Certificate
+	// the certificates by lowercase server name, wildcards are held as *.domain
+	names map[string]*tls.Certificate
+	// all the loaded certificates
+	certificates []*tls.Certificate
+	// the ocsp responses stapled to the certificates
+	staples map[*tls.Certificate][]byte
+}
+
+//
+// newCertificateStore loads the certificate pairs, the tls-cert pair (or the first of the pairs) is the default
+//
+func newCertificateStore(config *Config) (*certificateStore, error) {
+	store := &certificateStore{
+		names:   make(map[string]*tls.Certificate, 0),
+		staples: make(map[*tls.Certificate][]byte, 0),
+	}
+
+	pairs := config.TLSCertificates
+	if config.TLSCertificate != "" {
+		pairs = append([]TLSCertificatePair{{
+			Certificate: config.TLSCertificate,
+			PrivateKey:  config.TLSPrivateKey,
+		}}, pairs...)
+	}
+	if len(pairs) == 0 {
+		return nil, errors.New("no tls certificates have been configured")
+	}
+
+	for i, x := range pairs {
+		certificate, err := tls.LoadX509KeyPair(x.Certificate, x.PrivateKey)
+		if err != nil {
+			return nil, err
+		}
+		if certificate.Leaf, err = x509.ParseCertificate(certificate.Certificate[0]); err != nil {
+			return nil, err
+		}
+		if i == 0 {
+			store.defaultCertificate = &certificate
+		}
+		store.certificates = append(store.certificates, &certificate)
+
+		// step: use the names in the certificate unless the hostnames have been given
+		hostnames := x.Hostnames
+		if len(hostnames) == 0 {
+			hostnames = certificate.Leaf.DNSNames
+			if len(hostnames) == 0 && certificate.Leaf.Subject.CommonName != "" {
+				hostnames = []string{certificate.Leaf.Subject.CommonName}
+			}
+		}
+		for _, name := range hostnames {
+			name = strings.ToLower(name)
+			// the first pair to claim a name wins, keeping the default stable
+			if _, found := store.names[name]; !found {
+				store.names[name] = &certificate
+			}
+		}
+		log.Infof("loaded the tls certificate: %s for hostnames: %s", x.Certificate, strings.Join(hostnames, ","))
+	}
+
+	return store, nil
+}
+
+//
+// getCertificate returns the certificate for the server name of the client, falling back to a wildcard and then
+// the default certificate
+//
+func (r *certificateStore) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	certificate, found := r.names[name]
+	if !found {
+		if i := strings.Index(name, "."); i > 0 {
+			certificate, found = r.names["*"+name[i:]]
+		}
+	}
+	if !found {
+		certificate = r.defaultCertificate
+	}
+
+	// step: the certificates are shared by the handshakes, so the staple is added to a copy
+	r.RLock()
+	staple, found := r.staples[certificate]
+	r.RUnlock()
+	if found {
+		stapled := *certificate
+		stapled.OCSPStaple = staple
+		return &stapled, nil
+	}
+
+	return certificate, nil
+}
+
+//
+// startStapling starts a routine per certificate to fetch and refresh the ocsp response stapled to the handshakes
+//
+func (r *certificateStore) startStapling() {
+	client := &http.Client{Timeout: ocspTimeout}
+	for _, x := range r.certificates {
+		if len(x.Leaf.OCSPServer) == 0 {
+			log.Warnf("the tls certificate: %s has no ocsp responder, unable to staple", x.Leaf.Subject)
+			continue
+		}
+		if len(x.Certificate) < 2 {
+			log.Warnf("the tls certificate: %s does not include the issuer, unable to staple", x.Leaf.Subject)
+			continue
+		}
+		issuer, err := x509.ParseCertificate(x.Certificate[1])
+		if err != nil {
+			log.WithFields(log.Fields{"error": err.Error()}).Warnf("unable to parse the issuer of the tls certificate: %s", x.Leaf.Subject)
+			continue
+		}
+		go r.refreshStaple(client, x, issuer)
+	}
+}
+
+//
+// refreshStaple fetches the ocsp response for the certificate, refreshing it halfway to the next update
+//
+func (r *certificateStore) refreshStaple(client *http.Client, certificate *tls.Certificate, issuer *x509.Certificate) {
+	for {
+		next := ocspStapleRetry
+		staple, status, err := queryOCSP(client, certificate.Leaf.OCSPServer[0], certificate.Leaf, issuer)
+		switch {
+		case err != nil:
+			log.WithFields(log.Fields{
+				"certificate": certificate.Leaf.Subject.String(),
+				"error":       err.Error(),
+			}).Warnf("unable to refresh the ocsp staple")
+		case status.revoked:
+			log.WithFields(log.Fields{
+				"certificate": certificate.Leaf.Subject.String(),
+			}).Errorf("the ocsp responder reports the tls certificate has been revoked")
+			r.Lock()
+			delete(r.staples, certificate)
+			r.Unlock()
+		default:
+			r.Lock()
+			r.staples[certificate] = staple
+			r.Unlock()
+			if refresh := status.expires.Sub(time.Now()) / 2; refresh > next {
+				next = refresh
+			}
+			log.WithFields(log.Fields{
+				"certificate": certificate.Leaf.Subject.String(),
+				"refresh":     next.String(),
+			}).Debugf("refreshed the ocsp staple")
+		}
+
+		<-time.After(next)
+	}
+}
@@ -0,0 +1,196 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newFakeCertificatePair(t *testing.T, dir, commonName string, names ...string) TLSCertificatePair {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	certificate, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	encoded, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	pair := TLSCertificatePair{
+		Certificate: filepath.Join(dir, commonName+".pem"),
+		PrivateKey:  filepath.Join(dir, commonName+"-key.pem"),
+	}
+	if err := ioutil.WriteFile(pair.Certificate, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificate}), 0600); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := ioutil.WriteFile(pair.PrivateKey, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: encoded}), 0600); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	return pair
+}
+
+func TestCertificateStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certificates")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	defaults := newFakeCertificatePair(t, dir, "default")
+	site := newFakeCertificatePair(t, dir, "site", "site.example.com", "*.apps.example.com")
+	internal := newFakeCertificatePair(t, dir, "internal.example.com")
+	custom := newFakeCertificatePair(t, dir, "custom", "ignored.example.com")
+	custom.Hostnames = []string{"Custom.Example.com"}
+
+	config := newFakeKeycloakConfig()
+	config.TLSCertificate = defaults.Certificate
+	config.TLSPrivateKey = defaults.PrivateKey
+	config.TLSCertificates = []TLSCertificatePair{site, internal, custom}
+	store, err := newCertificateStore(config)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	cases := []struct {
+		ServerName string
+		Expected   string
+	}{
+		{ServerName: "", Expected: "default"},
+		{ServerName: "unknown.example.com", Expected: "default"},
+		{ServerName: "site.example.com", Expected: "site"},
+		{ServerName: "SITE.example.com.", Expected: "site"},
+		{ServerName: "web.apps.example.com", Expected: "site"},
+		{ServerName: "a.web.apps.example.com", Expected: "default"},
+		{ServerName: "internal.example.com", Expected: "internal.example.com"},
+		{ServerName: "custom.example.com", Expected: "custom"},
+		{ServerName: "ignored.example.com", Expected: "default"},
+	}
+	for i, c := range cases {
+		certificate, err := store.getCertificate(&tls.ClientHelloInfo{ServerName: c.ServerName})
+		if !assert.NoError(t, err, "case %d should not have failed", i) {
+			continue
+		}
+		name := certificate.Leaf.Subject.CommonName
+		assert.Equal(t, c.Expected, name, "case %d, expected: %s, got: %s", i, c.Expected, name)
+	}
+
+	// step: without a tls-cert the first of the pairs is the default
+	config.TLSCertificate, config.TLSPrivateKey = "", ""
+	store, err = newCertificateStore(config)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	certificate, err := store.getCertificate(&tls.ClientHelloInfo{ServerName: "unknown.example.com"})
+	assert.NoError(t, err)
+	assert.Equal(t, "site", certificate.Leaf.Subject.CommonName)
+
+	config.TLSCertificates = nil
+	_, err = newCertificateStore(config)
+	assert.Error(t, err)
+}
+
+func TestCertificateStoreStapling(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certificates")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := newFakeCA(t)
+	responder := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		content, _ := ioutil.ReadAll(r.Body)
+		request := ocspRequest{}
+		if _, err := asn1.Unmarshal(content, &request); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		certificate := &x509.Certificate{SerialNumber: request.TBSRequest.RequestList[0].Cert.SerialNumber}
+		w.Write(ca.newOCSPResponse(t, certificate, "good"))
+	}))
+	defer responder.Close()
+
+	// step: create a server certificate with the issuer in the chain
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(20),
+		Subject:      pkix.Name{CommonName: "site.example.com"},
+		DNSNames:     []string{"site.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		OCSPServer:   []string{responder.URL},
+	}
+	certificate, err := x509.CreateCertificate(rand.Reader, template, ca.certificate, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	encoded, _ := x509.MarshalECPrivateKey(key)
+	config := newFakeKeycloakConfig()
+	config.TLSCertificate = filepath.Join(dir, "site.pem")
+	config.TLSPrivateKey = filepath.Join(dir, "site-key.pem")
+	chain := append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificate}),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.certificate.Raw})...)
+	ioutil.WriteFile(config.TLSCertificate, chain, 0600)
+	ioutil.WriteFile(config.TLSPrivateKey, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: encoded}), 0600)
+
+	store, err := newCertificateStore(config)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	hello := &tls.ClientHelloInfo{ServerName: "site.example.com"}
+	served, err := store.getCertificate(hello)
+	assert.NoError(t, err)
+	assert.Empty(t, served.OCSPStaple)
+
+	store.startStapling()
+	for i := 0; i < 50; i++ {
+		if served, _ = store.getCertificate(hello); len(served.OCSPStaple) > 0 {
+			break
+		}
+		time.Sleep(time.Duration(20) * time.Millisecond)
+	}
+	assert.NotEmpty(t, served.OCSPStaple)
+	// step: the staple must not be added to the shared certificate
+	assert.Empty(t, store.defaultCertificate.OCSPStaple)
+}
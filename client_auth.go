@@ -0,0 +1,247 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-oidc/jose"
+	"github.com/coreos/go-oidc/oauth2"
+)
+
+const (
+	// clientAuthTLS authenticates the client by the certificate of the connection (rfc 8705)
+	clientAuthTLS = "tls_client_auth"
+	// clientAssertionType is the type of the signed client assertions (rfc 7523)
+	clientAssertionType = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+	// clientAssertionDuration is the time a client assertion is valid for
+	clientAssertionDuration = time.Duration(1) * time.Minute
+	// clientAuthUnusedSecret stands in for the secret the openid client requires, it's removed from the requests
+	clientAuthUnusedSecret = "unused"
+)
+
+// clientAuthMethods are the methods the client can authenticate to the provider by
+var clientAuthMethods = []string{
+	oauth2.AuthMethodClientSecretBasic,
+	oauth2.AuthMethodClientSecretPost,
+	oauth2.AuthMethodPrivateKeyJWT,
+	clientAuthTLS,
+}
+
+//
+// isClientSecretAuth checks the client authenticates to the provider by the client secret
+//
+func (r *Config) isClientSecretAuth() bool {
+	return r.ClientAuthMethod == "" || r.ClientAuthMethod == oauth2.AuthMethodClientSecretBasic ||
+		r.ClientAuthMethod == oauth2.AuthMethodClientSecretPost
+}
+
+//
+// clientAuthTransport rewrites the client authentication of the requests to the provider, as the openid client only
+// supports the client secret; only the requests of the clients of the proxy are rewritten
+//
+type clientAuthTransport struct {
+	// the transport the requests are sent by
+	transport http.RoundTripper
+	// the method the clients authenticate by
+	method string
+	// the clients of the proxy
+	clients []string
+	// the signer of the client assertions
+	signer jose.Signer
+}
+
+//
+// newClientAuthClient creates the client used to reach the provider, authenticating by the configured method; the
+// certificate for tls_client_auth comes from the spiffe workload api when the base client presents it
+//
+func newClientAuthClient(config *Config, base *http.Client) (*http.Client, error) {
+	var transport http.RoundTripper
+	if base != nil && base.Transport != nil {
+		transport = base.Transport
+	} else {
+		tlsConfig := &tls.Config{}
+		if config.ClientAuthMethod == clientAuthTLS {
+			certificate, err := tls.LoadX509KeyPair(config.ClientAuthCertificate, config.ClientAuthPrivateKey)
+			if err != nil {
+				return nil, fmt.Errorf("unable to load the client authentication certificate, error: %s", err)
+			}
+			tlsConfig.Certificates = []tls.Certificate{certificate}
+		}
+		transport = &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: tlsConfig,
+		}
+	}
+
+	var signer jose.Signer
+	if config.ClientAuthMethod == oauth2.AuthMethodPrivateKeyJWT {
+		key, err := loadClientAuthKey(config.ClientAuthPrivateKey)
+		if err != nil {
+			return nil, err
+		}
+		signer = jose.NewSignerRSA(config.ClientAuthKeyID, *key)
+	}
+
+	clients := []string{config.ClientID}
+	if config.TokenExchangeClientID != "" {
+		clients = append(clients, config.TokenExchangeClientID)
+	}
+	for _, x := range config.Providers {
+		clients = append(clients, x.ClientID)
+	}
+
+	return &http.Client{
+		Transport: &clientAuthTransport{
+			transport: transport,
+			method:    config.ClientAuthMethod,
+			clients:   clients,
+			signer:    signer,
+		},
+	}, nil
+}
+
+//
+// loadClientAuthKey reads the rsa private key the client assertions are signed with, pkcs1 or pkcs8 encoded
+//
+func loadClientAuthKey(filename string) (*rsa.PrivateKey, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(content)
+	if block == nil {
+		return nil, fmt.Errorf("the client authentication key: %s is not pem encoded", filename)
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse the client authentication key: %s, error: %s", filename, err)
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("the client authentication key: %s must be a rsa key", filename)
+	}
+
+	return key, nil
+}
+
+//
+// RoundTrip replaces the client secret of the form posts of the clients with the configured authentication
+//
+func (r *clientAuthTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodPost || req.Body == nil ||
+		!strings.HasPrefix(req.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+		return r.transport.RoundTrip(req)
+	}
+	content, err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	form, err := url.ParseQuery(string(content))
+	if err != nil {
+		return nil, err
+	}
+
+	// step: the requests of other clients, or without a client, are left alone
+	client := getTokenRequestClient(req, form)
+	if client == "" || !containedIn(client, r.clients) {
+		req.Body = ioutil.NopCloser(strings.NewReader(string(content)))
+		return r.transport.RoundTrip(req)
+	}
+	secret := form.Get("client_secret")
+	if _, password, found := req.BasicAuth(); found {
+		if unescaped, err := url.QueryUnescape(password); err == nil {
+			secret = unescaped
+		}
+	}
+
+	// step: the request and its headers are copied, as the round tripper mustn't modify the request
+	outreq := new(http.Request)
+	*outreq = *req
+	outreq.Header = make(http.Header, len(req.Header))
+	for name, values := range req.Header {
+		outreq.Header[name] = append([]string(nil), values...)
+	}
+	outreq.Header.Del(authorizationHeader)
+	form.Del("client_secret")
+	form.Set("client_id", client)
+	switch r.method {
+	case oauth2.AuthMethodClientSecretPost:
+		form.Set("client_secret", secret)
+	case oauth2.AuthMethodPrivateKeyJWT:
+		assertion, err := r.getClientAssertion(client, req.URL, time.Now())
+		if err != nil {
+			return nil, err
+		}
+		form.Set("client_assertion_type", clientAssertionType)
+		form.Set("client_assertion", assertion)
+	}
+	encoded := form.Encode()
+	outreq.Body = ioutil.NopCloser(strings.NewReader(encoded))
+	outreq.ContentLength = int64(len(encoded))
+	outreq.GetBody = nil
+
+	return r.transport.RoundTrip(outreq)
+}
+
+//
+// getClientAssertion signs a client assertion for the endpoint, the audience being the endpoint and the realm of
+// keycloak, either of which the provider may expect
+//
+func (r *clientAuthTransport) getClientAssertion(client string, endpoint *url.URL, now time.Time) (string, error) {
+	if r.signer == nil {
+		return "", errors.New("no signer for the client assertions")
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	target := url.URL{Scheme: endpoint.Scheme, Host: endpoint.Host, Path: endpoint.Path}
+	audience := []string{target.String()}
+	if i := strings.Index(target.Path, "/protocol/"); i > 0 {
+		target.Path = target.Path[:i]
+		audience = append(audience, target.String())
+	}
+	token, err := jose.NewSignedJWT(jose.Claims{
+		"iss": client,
+		"sub": client,
+		"aud": audience,
+		"jti": hex.EncodeToString(id),
+		"iat": now.Unix(),
+		"exp": now.Add(clientAssertionDuration).Unix(),
+	}, r.signer)
+	if err != nil {
+		return "", err
+	}
+
+	return token.Encode(), nil
+}
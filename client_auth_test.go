@@ -0,0 +1,156 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/coreos/go-oidc/jose"
+	"github.com/coreos/go-oidc/oauth2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadClientAuthKey(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	pkcs8, _ := x509.MarshalPKCS8PrivateKey(key)
+	cs := []struct {
+		Content []byte
+		Ok      bool
+	}{
+		{Content: pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}), Ok: true},
+		{Content: pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8}), Ok: true},
+		{Content: []byte("not a key")},
+		{Content: pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: []byte("invalid")})},
+	}
+	for i, c := range cs {
+		file, _ := ioutil.TempFile("", "client-key")
+		file.Write(c.Content)
+		file.Close()
+		loaded, err := loadClientAuthKey(file.Name())
+		os.Remove(file.Name())
+		if !c.Ok {
+			assert.Error(t, err, "case %d, expected an error", i)
+			continue
+		}
+		if assert.NoError(t, err, "case %d", i) {
+			assert.Equal(t, key.N, loaded.N, "case %d", i)
+		}
+	}
+}
+
+func TestClientAuthTransport(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	var received *http.Request
+	var form url.Values
+	provider := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req.ParseForm()
+		received, form = req, req.PostForm
+	}))
+	defer provider.Close()
+	endpoint := provider.URL + "/auth/realms/hod/protocol/openid-connect/token"
+
+	cs := []struct {
+		Method   string
+		Basic    bool
+		Form     url.Values
+		Expected url.Values
+		Checked  bool
+	}{
+		{
+			Method:   oauth2.AuthMethodClientSecretPost,
+			Basic:    true,
+			Form:     url.Values{"grant_type": {"refresh_token"}},
+			Expected: url.Values{"grant_type": {"refresh_token"}, "client_id": {"proxy"}, "client_secret": {"secret"}},
+		},
+		{
+			Method:   clientAuthTLS,
+			Basic:    true,
+			Form:     url.Values{"grant_type": {"authorization_code"}, "client_secret": {"secret"}},
+			Expected: url.Values{"grant_type": {"authorization_code"}, "client_id": {"proxy"}},
+		},
+		{
+			Method:  oauth2.AuthMethodPrivateKeyJWT,
+			Basic:   true,
+			Form:    url.Values{"grant_type": {"client_credentials"}},
+			Checked: true,
+		},
+		{
+			Method:  oauth2.AuthMethodPrivateKeyJWT,
+			Form:    url.Values{"grant_type": {"authorization_code"}, "client_id": {"proxy"}, "code_verifier": {"v"}},
+			Checked: true,
+		},
+		{
+			Method:   oauth2.AuthMethodPrivateKeyJWT,
+			Form:     url.Values{"grant_type": {"authorization_code"}, "client_id": {"mobile"}, "client_secret": {"mobile"}},
+			Expected: url.Values{"grant_type": {"authorization_code"}, "client_id": {"mobile"}, "client_secret": {"mobile"}},
+		},
+	}
+	signer := jose.NewSignerRSA("kid", *key)
+	for i, c := range cs {
+		client := &http.Client{
+			Transport: &clientAuthTransport{
+				transport: http.DefaultTransport,
+				method:    c.Method,
+				clients:   []string{"proxy"},
+				signer:    signer,
+			},
+		}
+		req, _ := http.NewRequest(http.MethodPost, endpoint, strings.NewReader(c.Form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if c.Basic {
+			req.SetBasicAuth("proxy", "secret")
+		}
+		resp, err := client.Do(req)
+		if !assert.NoError(t, err, "case %d, unable to make the request", i) {
+			continue
+		}
+		resp.Body.Close()
+		if !c.Checked {
+			assert.Equal(t, c.Expected, form, "case %d", i)
+			continue
+		}
+		assert.Empty(t, received.Header.Get(authorizationHeader), "case %d, the basic authentication remains", i)
+		assert.Empty(t, form.Get("client_secret"), "case %d, the secret remains", i)
+		assert.Equal(t, "proxy", form.Get("client_id"), "case %d", i)
+		assert.Equal(t, clientAssertionType, form.Get("client_assertion_type"), "case %d", i)
+		assertion, err := jose.ParseJWT(form.Get("client_assertion"))
+		if !assert.NoError(t, err, "case %d, invalid assertion", i) {
+			continue
+		}
+		assert.NoError(t, signer.Verify(assertion.Signature, []byte(assertion.Data())), "case %d", i)
+		claims, _ := assertion.Claims()
+		assert.Equal(t, "proxy", claims["iss"], "case %d", i)
+		assert.Equal(t, "proxy", claims["sub"], "case %d", i)
+		assert.Equal(t, []interface{}{endpoint, provider.URL + "/auth/realms/hod"}, claims["aud"], "case %d", i)
+		assert.NotEmpty(t, claims["jti"], "case %d", i)
+	}
+}
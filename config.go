@@ -19,12 +19,16 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net/http"
 	"net/url"
+	"path"
 	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/coreos/go-oidc/oauth2"
 	"github.com/urfave/cli"
 	"gopkg.in/yaml.v2"
 )
@@ -40,9 +44,64 @@ func newDefaultConfig() *Config {
 		UpstreamKeepaliveTimeout: time.Duration(10) * time.Second,
 		CookieAccessName:         "kc-access",
 		CookieRefreshName:        "kc-state",
+		CookieBindingName:        "kc-binding",
+		CookieKerberosName:       "kc-kerberos",
+		CookieSAMLName:           "kc-saml",
+		CookiePKCEName:           "kc-pkce",
+		CookieNonceName:          "kc-nonce",
+		EnableNonce:              true,
+		CookieIDTokenName:        "kc-id",
+		BindSessionIPv4Prefix:    32,
+		BindSessionIPv6Prefix:    128,
 		SecureCookie:             true,
-		SkipUpstreamTLSVerify:    true,
+		EnableCacheHeaders:       true,
+		CacheControl:             "private",
+		SignedURLDuration:        time.Duration(5) * time.Minute,
+		SignedStateDuration:      time.Duration(30) * time.Minute,
+		CallbackReplayWindow:     time.Duration(10) * time.Minute,
+		BackchannelLogoutTTL:     time.Duration(24) * time.Hour,
+		LoginLoopThreshold:       5,
+		LoginLoopWindow:          time.Duration(1) * time.Minute,
+		TokenCacheTTL:            time.Duration(1) * time.Minute,
+		IntrospectionCacheSize:   10000,
+		IntrospectionCacheTTL:    time.Duration(1) * time.Minute,
+		TokenExchangeCacheSize:   10000,
+		UMACacheSize:             10000,
+		UMACacheTTL:              time.Duration(30) * time.Second,
+		EnrichmentClaim:          "preferred_username",
+		EnrichmentTimeout:        time.Duration(5) * time.Second,
+		EnrichmentCacheSize:      10000,
+		EnrichmentCacheTTL:       time.Duration(5) * time.Minute,
+		UnauthenticatedCacheTTL:  time.Duration(5) * time.Second,
+		BreakGlassMaxDuration:    time.Duration(4) * time.Hour,
+		BreakGlassRateLimit:      60,
+		IdPGracePeriod:           time.Duration(1) * time.Hour,
+		EnableJWKSCache:          true,
+		JWKSMinRefreshInterval:   time.Duration(10) * time.Second,
+		JWKSRefreshInterval:      time.Duration(15) * time.Minute,
+		MaxTokenSize:             65536,
+		MaxTokenClaims:           256,
+		MaxTokenDepth:            16,
+		MaxBodyInspectionSize:    1048576,
+		SAMLRolesAttribute:       "Role",
+		SAMLSessionDuration:      time.Duration(1) * time.Hour,
+		CallbackPath:             oauthURL + callbackURL,
+		TLSRevocationFailureMode: revocationFailOpen,
 		CrossOrigin:              CORS{},
+		ForwardingGrantType:      oauth2.GrantTypeUserCreds,
+		HeadMethod:               methodHandlingExact,
+		OptionsMethod:            methodHandlingExact,
+		SecurityFilter: SecurityFilter{
+			BrowserXSSFilter:   true,
+			ContentTypeNosniff: true,
+			FrameDeny:          true,
+		},
+
+		UpstreamIdleTimeout:               time.Duration(90) * time.Second,
+		UpstreamAttemptTimeout:            time.Duration(2) * time.Second,
+		TokenPassthroughRateLimit:         60,
+		UpstreamMaxIdleConnections:        100,
+		UpstreamMaxIdleConnectionsPerHost: http.DefaultMaxIdleConnsPerHost,
 	}
 }
 
@@ -51,6 +110,166 @@ func (r *Config) isValid() error {
 	if r.Listen == "" {
 		return fmt.Errorf("you have not specified the listening interface")
 	}
+	if _, found := diagnosticsSignals[r.DiagnosticsSignal]; r.DiagnosticsSignal != "" && !found {
+		return fmt.Errorf("the diagnostics signal must be SIGUSR1, SIGUSR2 or SIGQUIT")
+	}
+	if r.MethodOverride != "" && r.MethodOverride != methodOverrideReject && r.MethodOverride != methodOverrideNormalize {
+		return fmt.Errorf("the method override must be either %s or %s", methodOverrideReject, methodOverrideNormalize)
+	}
+	for _, x := range []string{r.HeadMethod, r.OptionsMethod} {
+		switch x {
+		case "", methodHandlingExact, methodHandlingEnforce, methodHandlingMatchGet, methodHandlingAllow:
+		default:
+			return fmt.Errorf("the head and options method handling must be either %s, %s, %s or %s",
+				methodHandlingExact, methodHandlingEnforce, methodHandlingMatchGet, methodHandlingAllow)
+		}
+	}
+	if r.MaxUploadRate < 0 || r.MaxDownloadRate < 0 {
+		return fmt.Errorf("the max upload and download rates must be positive")
+	}
+	if r.SecurityFilter.STSSeconds < 0 {
+		return fmt.Errorf("the sts seconds of the security filter must be zero or greater")
+	}
+	if strings.ContainsAny(r.BearerRealm, "\"\\") {
+		return fmt.Errorf("the bearer realm cannot contain quotes or backslashes")
+	}
+	if r.MaxTransferDuration < 0 {
+		return fmt.Errorf("the max transfer duration must be positive")
+	}
+	if r.EnableDeadlinePropagation && r.MaxTransferDuration <= 0 {
+		return fmt.Errorf("the deadline propagation requires a max transfer duration")
+	}
+	if r.MaxBodyInspectionSize < 0 {
+		return fmt.Errorf("the max body inspection size must be positive")
+	}
+	if r.MaxUpgradedConnections < 0 || r.MaxUpgradedConnectionsPerUser < 0 {
+		return fmt.Errorf("the max upgraded connections, in total and per user, must be zero or greater")
+	}
+	if len(r.TokenPassthroughClients) > 0 && r.TokenPassthroughRateLimit <= 0 {
+		return fmt.Errorf("the token passthrough rate limit must be greater than zero")
+	}
+	if r.SkewTolerance < 0 {
+		return fmt.Errorf("the skew tolerance must be zero or greater")
+	}
+	if r.ListenAdmin != "" && r.AdminToken == "" {
+		return fmt.Errorf("the admin api requires an admin token")
+	}
+	if r.EnableIdPGrace && r.IdPGracePeriod <= 0 {
+		return fmt.Errorf("the identity provider grace period must be positive")
+	}
+	if r.EnableJWKSCache {
+		if r.JWKSMinRefreshInterval <= 0 {
+			return fmt.Errorf("the jwks min refresh interval must be greater than zero")
+		}
+		if r.JWKSRefreshInterval < 0 {
+			return fmt.Errorf("the jwks refresh interval must be zero or greater")
+		}
+	}
+	if r.IssuerURL != "" {
+		location, err := url.Parse(r.IssuerURL)
+		if err != nil || (location.Scheme != "http" && location.Scheme != "https") || location.Host == "" {
+			return fmt.Errorf("the issuer url: %s must be a absolute http or https url", r.IssuerURL)
+		}
+	}
+	if r.ExternalDiscoveryURL != "" {
+		r.ExternalDiscoveryURL = strings.TrimSuffix(strings.TrimSuffix(r.ExternalDiscoveryURL, "/.well-known/openid-configuration"), "/")
+		location, err := url.Parse(r.ExternalDiscoveryURL)
+		if err != nil || (location.Scheme != "http" && location.Scheme != "https") || location.Host == "" {
+			return fmt.Errorf("the external discovery url: %s must be a absolute http or https url", r.ExternalDiscoveryURL)
+		}
+	}
+	if hasCookieDomainPlaceholders(r.CookieDomain) && len(r.PermittedCookieDomains) <= 0 {
+		return fmt.Errorf("a templated cookie domain requires the permitted cookie domains")
+	}
+	for _, x := range r.PermittedCookieDomains {
+		if _, err := path.Match(x, ""); err != nil || x == "" {
+			return fmt.Errorf("the permitted cookie domain: '%s' is invalid", x)
+		}
+	}
+	if r.BreakGlassKey != "" {
+		if len(r.BreakGlassKey) < breakGlassMinKeyLength {
+			return fmt.Errorf("the break glass key must be at least %d characters", breakGlassMinKeyLength)
+		}
+		if r.BreakGlassMaxDuration <= 0 {
+			return fmt.Errorf("the break glass max duration must be positive")
+		}
+		if r.BreakGlassRateLimit <= 0 {
+			return fmt.Errorf("the break glass rate limit must be positive")
+		}
+	}
+	if r.SPNEGOKeytab != "" && len(r.EncryptionKey) != 16 && len(r.EncryptionKey) != 32 {
+		return fmt.Errorf("the kerberos negotiation requires a encryption key of 16 or 32 characters for the sessions")
+	}
+	if r.SAMLMetadataURL != "" {
+		if len(r.EncryptionKey) != 16 && len(r.EncryptionKey) != 32 {
+			return fmt.Errorf("the saml service provider requires a encryption key of 16 or 32 characters for the sessions")
+		}
+		if r.SAMLSessionDuration <= 0 {
+			return fmt.Errorf("the saml session duration must be positive")
+		}
+		if r.EnableForwarding {
+			return fmt.Errorf("the saml service provider is not supported in forwarding mode")
+		}
+	}
+	if r.EdgeAuthentication != "" {
+		switch r.EdgeAuthentication {
+		case edgeAWSALB:
+			if r.EdgeALBArn == "" {
+				return fmt.Errorf("the aws alb edge authentication requires the arn of the load balancer")
+			}
+		case edgeCloudflareAccess:
+			if r.EdgeCloudflareTeamDomain == "" || r.EdgeAudience == "" {
+				return fmt.Errorf("the cloudflare access edge authentication requires the team domain and audience")
+			}
+		default:
+			return fmt.Errorf("the edge authentication: %s must be %s or %s", r.EdgeAuthentication, edgeAWSALB, edgeCloudflareAccess)
+		}
+		if r.EdgeKeysURL != "" {
+			if u, err := url.Parse(r.EdgeKeysURL); err != nil || u.Scheme == "" || u.Host == "" {
+				return fmt.Errorf("the edge keys url: %s must be a absolute url", r.EdgeKeysURL)
+			}
+		}
+		if r.SAMLMetadataURL != "" {
+			return fmt.Errorf("the edge authentication can't be used with a saml identity provider")
+		}
+		if r.EnableForwarding {
+			return fmt.Errorf("the edge authentication is not supported in forwarding mode")
+		}
+	}
+	if r.EnableCacheHeaders && r.CacheControl == "" {
+		return fmt.Errorf("the cache control must be set when the cache headers are enabled")
+	}
+	for k, v := range r.LogSampleRates {
+		if v < 0 || v > 1 {
+			return fmt.Errorf("the log sample rate for: %s must be between 0 and 1", k)
+		}
+	}
+	if r.LogMetadataService && !r.LogMetadata {
+		return fmt.Errorf("the log metadata service requires the log metadata to be enabled")
+	}
+	if r.UpstreamIdleTimeout < 0 {
+		return fmt.Errorf("the upstream idle timeout must be positive")
+	}
+	if r.UpstreamAttemptTimeout < 0 {
+		return fmt.Errorf("the upstream attempt timeout must be positive")
+	}
+	if r.UpstreamMaxIdleConnections < 0 || r.UpstreamMaxIdleConnectionsPerHost < 0 {
+		return fmt.Errorf("the upstream max idle connections must be positive")
+	}
+	if r.UpstreamMaxHeaderSize < 0 {
+		return fmt.Errorf("the upstream max header size must be a positive value")
+	}
+	if r.UpstreamMaxHeaders < 0 {
+		return fmt.Errorf("the upstream max headers must be a positive value")
+	}
+	if r.MaxTokenSize < 0 || r.MaxTokenClaims < 0 || r.MaxTokenDepth < 0 {
+		return fmt.Errorf("the max token size, claims and depth must be zero or greater")
+	}
+	for _, x := range r.UpstreamHeaderCasing {
+		if x == "" || strings.ContainsAny(x, " :\r\n") {
+			return fmt.Errorf("the upstream header casing: '%s' is not a valid header name", x)
+		}
+	}
 	if r.TLSCertificate != "" && r.TLSPrivateKey == "" {
 		return fmt.Errorf("you have not provided a private key")
 	}
@@ -63,12 +282,112 @@ func (r *Config) isValid() error {
 	if r.TLSPrivateKey != "" && !fileExists(r.TLSPrivateKey) {
 		return fmt.Errorf("the tls private key %s does not exist", r.TLSPrivateKey)
 	}
+	if r.EnableOCSPStapling && !r.useTLS() {
+		return fmt.Errorf("ocsp stapling requires a tls certificate")
+	}
+	for _, x := range r.TLSCertificates {
+		if x.Certificate == "" || x.PrivateKey == "" {
+			return fmt.Errorf("the tls certificate pairs must have both a certificate and private key")
+		}
+		if !fileExists(x.Certificate) {
+			return fmt.Errorf("the tls certificate %s does not exist", x.Certificate)
+		}
+		if !fileExists(x.PrivateKey) {
+			return fmt.Errorf("the tls private key %s does not exist", x.PrivateKey)
+		}
+	}
 	if r.TLSCaCertificate != "" && !fileExists(r.TLSCaCertificate) {
 		return fmt.Errorf("the tls ca certificate file %s does not exist", r.TLSCaCertificate)
 	}
+	if (r.TLSClientCRL != "" || r.EnableTLSClientOCSP) && r.TLSCaCertificate == "" {
+		return fmt.Errorf("the client certificate revocation checks require a tls ca certificate")
+	}
+	if r.TLSClientCRL != "" && !fileExists(r.TLSClientCRL) {
+		return fmt.Errorf("the tls client crl file %s does not exist", r.TLSClientCRL)
+	}
+	if r.TLSRevocationFailureMode != "" && r.TLSRevocationFailureMode != revocationFailOpen && r.TLSRevocationFailureMode != revocationFailClosed {
+		return fmt.Errorf("the tls revocation failure mode must be either %s or %s", revocationFailOpen, revocationFailClosed)
+	}
+	if r.SpiffeEndpointSocket != "" && strings.Contains(r.SpiffeEndpointSocket, "://") && !strings.HasPrefix(r.SpiffeEndpointSocket, "unix://") {
+		return fmt.Errorf("the spiffe endpoint socket must be a unix socket, i.e. unix:///path/to/agent.sock")
+	}
 	if r.TLSClientCertificate != "" && !fileExists(r.TLSClientCertificate) {
 		return fmt.Errorf("the tls client certificate %s does not exist", r.TLSClientCertificate)
 	}
+	if r.StoreCACertificate != "" && !fileExists(r.StoreCACertificate) {
+		return fmt.Errorf("the store ca certificate %s does not exist", r.StoreCACertificate)
+	}
+	if (r.StoreClientCertificate == "") != (r.StoreClientPrivateKey == "") {
+		return fmt.Errorf("the store client certificate and private key must be set together")
+	}
+	if r.StoreClientCertificate != "" && (!fileExists(r.StoreClientCertificate) || !fileExists(r.StoreClientPrivateKey)) {
+		return fmt.Errorf("the store client certificate %s or private key does not exist", r.StoreClientCertificate)
+	}
+	if r.StorePoolSize < 0 {
+		return fmt.Errorf("the store pool size must be zero or greater")
+	}
+	if r.ClientAuthMethod != "" && !containedIn(r.ClientAuthMethod, clientAuthMethods) {
+		return fmt.Errorf("the client auth method must be one of %s", strings.Join(clientAuthMethods, ", "))
+	}
+	switch r.ClientAuthMethod {
+	case oauth2.AuthMethodPrivateKeyJWT:
+		if r.ClientAuthPrivateKey == "" || !fileExists(r.ClientAuthPrivateKey) {
+			return fmt.Errorf("the private_key_jwt client authentication requires the client auth private key")
+		}
+	case clientAuthTLS:
+		if r.SpiffeEndpointSocket == "" {
+			if r.ClientAuthCertificate == "" || r.ClientAuthPrivateKey == "" {
+				return fmt.Errorf("the tls_client_auth client authentication requires the client auth certificate and private key, or a spiffe endpoint socket")
+			}
+			if !fileExists(r.ClientAuthCertificate) {
+				return fmt.Errorf("the client auth certificate %s does not exist", r.ClientAuthCertificate)
+			}
+			if !fileExists(r.ClientAuthPrivateKey) {
+				return fmt.Errorf("the client auth private key %s does not exist", r.ClientAuthPrivateKey)
+			}
+		}
+	}
+	if r.EnableBotDetection {
+		if err := r.BotDetection.isValid(); err != nil {
+			return err
+		}
+	}
+	if r.EnableDebugHeaders {
+		if len(r.DebugHeadersAllowlist) <= 0 {
+			return fmt.Errorf("the debug headers require a allowlist of the client networks")
+		}
+		for _, x := range r.DebugHeadersAllowlist {
+			if _, err := parseNetwork(x); err != nil {
+				return fmt.Errorf("the debug headers allowlist entry: %s is invalid, error: %s", x, err)
+			}
+		}
+	}
+	if _, err := newCORSPolicy(r.CrossOrigin); err != nil {
+		return err
+	}
+	for _, x := range r.UpstreamTLS {
+		if err := x.isValid(); err != nil {
+			return err
+		}
+	}
+	for _, signer := range r.UpstreamSigning {
+		if err := signer.isValid(); err != nil {
+			return err
+		}
+	}
+	for _, x := range r.RoleMappings {
+		if err := x.isValid(); err != nil {
+			return err
+		}
+	}
+	for _, x := range r.UpstreamAuth {
+		if err := x.isValid(); err != nil {
+			return err
+		}
+		if x.Type == upstreamAuthNTLM && (!r.UpstreamKeepalives || r.UpstreamProxyProtocol) {
+			return fmt.Errorf("the ntlm authentication of the upstream requires upstream-keepalives and no upstream-proxy-protocol, as the handshake authenticates the connection")
+		}
+	}
 
 	if r.EnableForwarding {
 		if r.ClientID == "" {
@@ -77,26 +396,61 @@ func (r *Config) isValid() error {
 		if r.DiscoveryURL == "" {
 			return fmt.Errorf("you have not specified the discovery url")
 		}
-		if r.ForwardingUsername == "" {
-			return fmt.Errorf("no forwarding username")
+		switch r.ForwardingGrantType {
+		case oauth2.GrantTypeUserCreds:
+			if r.ForwardingUsername == "" {
+				return fmt.Errorf("no forwarding username")
+			}
+			if r.ForwardingPassword == "" {
+				return fmt.Errorf("no forwarding password")
+			}
+		case oauth2.GrantTypeClientCreds:
+			if r.ClientSecret == "" && r.isClientSecretAuth() {
+				return fmt.Errorf("the client credentials grant requires the client secret")
+			}
+		default:
+			return fmt.Errorf("the forwarding grant type must be either %s or %s", oauth2.GrantTypeUserCreds, oauth2.GrantTypeClientCreds)
 		}
-		if r.ForwardingPassword == "" {
-			return fmt.Errorf("no forwarding password")
+		if len(r.VirtualHosts) > 0 {
+			return fmt.Errorf("the virtual hosts are not supported in forwarding mode")
 		}
 	} else {
-		if r.Upstream == "" {
+		if r.Upstream == "" && r.ExtAuthzListen == "" {
 			return fmt.Errorf("you have not specified an upstream endpoint to proxy to")
 		}
-		if _, err := url.Parse(r.Upstream); err != nil {
+		if isUpstreamTemplate(r.Upstream) {
+			if _, err := newUpstreamTemplate(r.Upstream, r.UpstreamURLPattern); err != nil {
+				return err
+			}
+			if r.SkipTokenVerification {
+				return fmt.Errorf("the templated upstream url requires the token verification")
+			}
+		} else if _, err := url.Parse(r.Upstream); err != nil {
 			return fmt.Errorf("the upstream endpoint is invalid, %s", err)
 		}
-		// step: if the skip verification is off, we need the below
-		if !r.SkipTokenVerification {
+		// step: if the skip verification is off, we need the below, unless the edge has logged the user in
+		if !r.SkipTokenVerification && r.EdgeAuthentication == "" {
 			if r.ClientID == "" {
 				return fmt.Errorf("you have not specified the client id")
 			}
-			if r.DiscoveryURL == "" {
-				return fmt.Errorf("you have not specified the discovery url")
+			if r.DiscoveryURL == "" && r.SAMLMetadataURL == "" {
+				return fmt.Errorf("you have not specified the discovery url or saml metadata url")
+			}
+			for _, x := range r.TrustedDiscoveryURLs {
+				if x == "" || x == r.DiscoveryURL {
+					return fmt.Errorf("the trusted discovery url: '%s' must be set and differ from the discovery url", x)
+				}
+			}
+			if len(r.Providers) > 0 && r.SAMLMetadataURL != "" {
+				return fmt.Errorf("the additional providers can't be used with a saml identity provider")
+			}
+			for _, x := range r.Providers {
+				if err := x.isValid(); err != nil {
+					return err
+				}
+				if x.DiscoveryURL == r.DiscoveryURL || containedIn(x.DiscoveryURL, r.TrustedDiscoveryURLs) {
+					return fmt.Errorf("the provider: %s must differ from the discovery url and trusted discovery urls", x.getName())
+				}
 			}
 			if strings.HasSuffix(r.RedirectionURL, "/") {
 				r.RedirectionURL = strings.TrimSuffix(r.RedirectionURL, "/")
@@ -110,17 +464,269 @@ func (r *Config) isValid() error {
 			if !r.NoRedirects && r.SecureCookie && !strings.HasPrefix(r.RedirectionURL, "https") {
 				return fmt.Errorf("the cookie is set to secure but your redirection url is non-tls")
 			}
+			if !strings.HasPrefix(r.getCallbackPath(), "/") || strings.ContainsAny(r.getCallbackPath(), ":*?#") {
+				return fmt.Errorf("the callback path: %s must be a absolute path, without any parameters", r.getCallbackPath())
+			}
+			hosts := make(map[string]bool, 0)
+			for i, x := range r.RedirectionURLs {
+				location, err := url.Parse(strings.TrimSuffix(x, "/"))
+				if err != nil || location.Scheme == "" || location.Host == "" {
+					return fmt.Errorf("the redirection url: %s must be a absolute url", x)
+				}
+				if !r.NoRedirects && r.SecureCookie && location.Scheme != "https" {
+					return fmt.Errorf("the cookie is set to secure but the redirection url: %s is non-tls", x)
+				}
+				if hosts[strings.ToLower(location.Host)] {
+					return fmt.Errorf("the redirection urls have a duplicate host: %s", location.Host)
+				}
+				hosts[strings.ToLower(location.Host)] = true
+				r.RedirectionURLs[i] = strings.TrimSuffix(x, "/")
+			}
 			if r.StoreURL != "" {
-				if _, err := url.Parse(r.StoreURL); err != nil {
+				location, err := url.Parse(r.StoreURL)
+				if err != nil {
 					return fmt.Errorf("the store url is invalid, error: %s", err)
 				}
+				if (r.StoreCACertificate != "" || r.StoreClientCertificate != "") && location.Scheme != "rediss" {
+					return fmt.Errorf("the store certificates require a rediss store url")
+				}
+			}
+		}
+		if r.EnableSignedState {
+			if r.EncryptionKey == "" {
+				return fmt.Errorf("the signed state requires an encryption key to sign the state")
+			}
+			if r.SignedStateDuration <= 0 {
+				return fmt.Errorf("the signed state duration must be greater than zero")
+			}
+		}
+		if r.EnablePKCE && r.EncryptionKey == "" {
+			return fmt.Errorf("the pkce requires an encryption key to protect the code verifier")
+		}
+		if r.AuthorizationClaims != "" {
+			if err := isValidAuthorizationClaims(r.AuthorizationClaims); err != nil {
+				return err
+			}
+		}
+		if r.Prompt != "" && !isValidAuthorizationParam(promptParam, r.Prompt) {
+			return fmt.Errorf("the prompt: %s must be none, or any of login, consent and select_account", r.Prompt)
+		}
+		if r.AuthenticationMaxAge < 0 {
+			return fmt.Errorf("the authentication max age must be zero or greater")
+		}
+		for _, x := range r.AuthorizationParamsPassthrough {
+			if !containedIn(x, authorizationPassthroughParams) {
+				return fmt.Errorf("the authorization parameter: %s can't be passed through, must be one of %s", x,
+					strings.Join(authorizationPassthroughParams, ", "))
+			}
+		}
+		if r.EnableLogoutRedirect {
+			if r.SkipTokenVerification || r.SAMLMetadataURL != "" {
+				return fmt.Errorf("the logout redirect requires the token verification and a openid provider")
+			}
+			if r.EndSessionURL != "" {
+				if u, err := url.Parse(r.EndSessionURL); err != nil || u.Scheme == "" || u.Host == "" {
+					return fmt.Errorf("the end session url: %s must be a absolute url", r.EndSessionURL)
+				}
+			}
+			if r.CookieIDTokenName == "" {
+				return fmt.Errorf("the logout redirect requires the identity token cookie name")
+			}
+		}
+		if r.PostLogoutRedirectURI != "" {
+			if !r.EnableLogoutRedirect {
+				return fmt.Errorf("the post logout redirect uri requires the logout redirect")
+			}
+			if u, err := url.Parse(r.PostLogoutRedirectURI); err != nil || u.Scheme == "" || u.Host == "" {
+				return fmt.Errorf("the post logout redirect uri: %s must be a absolute url", r.PostLogoutRedirectURI)
+			}
+		}
+		if r.EnableDeviceAuthorization {
+			if r.SkipTokenVerification || r.SAMLMetadataURL != "" {
+				return fmt.Errorf("the device authorization requires the token verification and a openid provider")
+			}
+			if r.DeviceAuthorizationURL != "" {
+				if u, err := url.Parse(r.DeviceAuthorizationURL); err != nil || u.Scheme == "" || u.Host == "" {
+					return fmt.Errorf("the device authorization url: %s must be a absolute url", r.DeviceAuthorizationURL)
+				}
+			}
+		}
+		if r.EnableCallbackReplayProtection {
+			if r.CallbackReplayWindow <= 0 {
+				return fmt.Errorf("the callback replay window must be greater than zero")
+			}
+			if r.EnableSignedState && r.UnauthenticatedCacheSize > 0 {
+				return fmt.Errorf("the callback replay protection can't be used with the unauthenticated cache, which shares the signed states between the requests")
+			}
+		}
+		if r.EnableBackchannelLogout {
+			if r.SkipTokenVerification || r.SAMLMetadataURL != "" {
+				return fmt.Errorf("the back-channel logout requires the token verification and a openid provider")
+			}
+			if r.BackchannelLogoutTTL <= 0 {
+				return fmt.Errorf("the back-channel logout ttl must be greater than zero")
+			}
+		}
+		if r.EnableFrontchannelLogout && (r.SkipTokenVerification || r.SAMLMetadataURL != "") {
+			return fmt.Errorf("the front-channel logout requires the token verification and a openid provider")
+		}
+		if r.FrontchannelLogoutSessionRequired && !r.EnableFrontchannelLogout {
+			return fmt.Errorf("the front-channel logout session requires the front-channel logout")
+		}
+		if r.TokenCacheSize < 0 {
+			return fmt.Errorf("the token cache size must be zero or greater")
+		}
+		if r.TokenCacheSize > 0 && r.TokenCacheTTL <= 0 {
+			return fmt.Errorf("the token cache ttl must be greater than zero")
+		}
+		if r.EnableTokenCacheStore && (r.TokenCacheSize <= 0 || !isRedisStoreURL(r.StoreURL)) {
+			return fmt.Errorf("the token cache store requires a token cache size and a redis store url")
+		}
+		if r.EnableTokenIntrospection {
+			if r.SkipTokenVerification || r.SAMLMetadataURL != "" {
+				return fmt.Errorf("the token introspection requires the token verification and a openid provider")
+			}
+			if r.IntrospectionURL != "" {
+				if u, err := url.Parse(r.IntrospectionURL); err != nil || u.Scheme == "" || u.Host == "" {
+					return fmt.Errorf("the introspection url: %s must be a absolute url", r.IntrospectionURL)
+				}
+			}
+			if r.IntrospectionCacheSize < 0 {
+				return fmt.Errorf("the introspection cache size must be zero or greater")
+			}
+			if r.IntrospectionCacheSize > 0 && r.IntrospectionCacheTTL <= 0 {
+				return fmt.Errorf("the introspection cache ttl must be greater than zero")
+			}
+		}
+		if r.EnableTokenExchange {
+			if r.SkipTokenVerification || r.SAMLMetadataURL != "" {
+				return fmt.Errorf("the token exchange requires the token verification and a openid provider")
+			}
+			if r.TokenExchangeAudience == "" {
+				return fmt.Errorf("the token exchange requires a audience")
+			}
+			if r.TokenExchangeClientID != "" && r.TokenExchangeClientSecret == "" && r.isClientSecretAuth() {
+				return fmt.Errorf("the token exchange client requires a client secret")
+			}
+			if r.TokenExchangeCacheSize < 0 {
+				return fmt.Errorf("the token exchange cache size must be zero or greater")
+			}
+		}
+		if r.EnableUMA {
+			if r.SkipTokenVerification || r.SAMLMetadataURL != "" {
+				return fmt.Errorf("the uma enforcement requires the token verification and a openid provider")
+			}
+			if r.UMACacheSize < 0 {
+				return fmt.Errorf("the uma cache size must be zero or greater")
+			}
+			if r.UMACacheSize > 0 && r.UMACacheTTL <= 0 {
+				return fmt.Errorf("the uma cache ttl must be greater than zero")
+			}
+		}
+		if r.EnrichmentURL != "" {
+			u, err := url.Parse(r.EnrichmentURL)
+			if err != nil || u.Host == "" {
+				return fmt.Errorf("the enrichment url: %s must be a absolute url", r.EnrichmentURL)
+			}
+			switch u.Scheme {
+			case "ldap", "ldaps":
+				if r.EnrichmentBaseDN == "" {
+					return fmt.Errorf("the ldap enrichment requires the base dn the users are searched under")
+				}
+			case "http", "https":
+			default:
+				return fmt.Errorf("the enrichment url: %s must be a ldap, ldaps, http or https url", r.EnrichmentURL)
+			}
+			if r.EnrichmentClaim == "" {
+				return fmt.Errorf("the enrichment requires the claim the users are looked up by")
+			}
+			if len(r.EnrichmentAttributes) <= 0 {
+				return fmt.Errorf("the enrichment requires the attributes added to the claims")
+			}
+			if r.EnrichmentTimeout <= 0 {
+				return fmt.Errorf("the enrichment timeout must be greater than zero")
+			}
+			if r.EnrichmentCacheSize < 0 {
+				return fmt.Errorf("the enrichment cache size must be zero or greater")
+			}
+			if r.EnrichmentCacheSize > 0 && r.EnrichmentCacheTTL <= 0 {
+				return fmt.Errorf("the enrichment cache ttl must be greater than zero")
+			}
+		}
+		if r.UnauthenticatedCacheSize < 0 {
+			return fmt.Errorf("the unauthenticated cache size must be zero or greater")
+		}
+		if r.UnauthenticatedCacheSize > 0 && r.UnauthenticatedCacheTTL <= 0 {
+			return fmt.Errorf("the unauthenticated cache ttl must be greater than zero")
+		}
+		if r.LoginLoopThreshold < 0 {
+			return fmt.Errorf("the login loop threshold must be zero or greater")
+		}
+		if r.LoginLoopThreshold > 0 && r.LoginLoopWindow <= 0 {
+			return fmt.Errorf("the login loop window must be greater than zero")
+		}
+		if r.BindSessionIP || r.BindSessionUserAgent {
+			if len(r.EncryptionKey) != 16 && len(r.EncryptionKey) != 32 {
+				return fmt.Errorf("the session binding requires an encryption key of 16 or 32 characters")
+			}
+			if r.BindSessionIPv4Prefix < 0 || r.BindSessionIPv4Prefix > 32 {
+				return fmt.Errorf("the session binding ipv4 prefix must be between 0 and 32")
+			}
+			if r.BindSessionIPv6Prefix < 0 || r.BindSessionIPv6Prefix > 128 {
+				return fmt.Errorf("the session binding ipv6 prefix must be between 0 and 128")
+			}
+		}
+		if r.MaxSessions < 0 {
+			return fmt.Errorf("the max sessions must be a positive value")
+		}
+		if r.MaxSessions > 0 && r.StoreURL == "" {
+			return fmt.Errorf("the concurrent session limit requires a store url")
+		}
+		switch r.SessionLimitAction {
+		case "", sessionLimitReject, sessionLimitEvictOldest:
+		default:
+			return fmt.Errorf("the session limit action: %s is invalid, should be %s or %s",
+				r.SessionLimitAction, sessionLimitReject, sessionLimitEvictOldest)
+		}
+		// step: valid the virtual hosts
+		defaults := 0
+		for _, vhost := range r.VirtualHosts {
+			if err := vhost.isValid(); err != nil {
+				return err
 			}
+			if vhost.Default {
+				defaults++
+			}
+		}
+		if defaults > 1 {
+			return fmt.Errorf("only one virtual host can be the default")
 		}
 		// step: valid the resources
-		for _, resource := range r.Resources {
+		for _, resource := range r.getResources() {
 			if err := resource.IsValid(); err != nil {
 				return err
 			}
+			if resource.RequireDPoP && !r.EnableDPoP {
+				return fmt.Errorf("the resource: %s requires dpop, but dpop is not enabled", resource.URL)
+			}
+			if resource.BreakGlass && r.BreakGlassKey == "" {
+				return fmt.Errorf("the resource: %s permits break glass access, but no break glass key has been set", resource.URL)
+			}
+			if resource.SPNEGO && r.SPNEGOKeytab == "" {
+				return fmt.Errorf("the resource: %s negotiates kerberos, but no spnego keytab has been set", resource.URL)
+			}
+			if resource.SignedURLs && r.SignedURLKey == "" {
+				return fmt.Errorf("the resource: %s uses signed urls, but no signed url key has been set", resource.URL)
+			}
+			if resource.SignedURLs && r.SignedURLDuration <= 0 {
+				return fmt.Errorf("the resource: %s uses signed urls, the signed url duration must be positive", resource.URL)
+			}
+			if len(resource.BodyClaims) > 0 && r.MaxBodyInspectionSize <= 0 {
+				return fmt.Errorf("the resource: %s inspects the body claims, the max body inspection size must be positive", resource.URL)
+			}
+			if resource.ACR != "" && len(r.ACRLevels) > 0 && !containedIn(resource.ACR, r.ACRLevels) {
+				return fmt.Errorf("the resource: %s requires the acr: %s, which is not one of the acr levels", resource.URL, resource.ACR)
+			}
 		}
 		// step: validate the claims are validate regex's
 		for k, claim := range r.MatchClaims {
@@ -143,6 +749,51 @@ func (r *Config) hasCustomSignInPage() bool {
 	return false
 }
 
+// useTLS checks if the listener is serving tls
+func (r *Config) useTLS() bool {
+	return r.TLSCertificate != "" || len(r.TLSCertificates) > 0
+}
+
+// getCallbackPath returns the path of the oauth callback handler
+func (r *Config) getCallbackPath() string {
+	if r.CallbackPath == "" {
+		return oauthURL + callbackURL
+	}
+
+	return r.CallbackPath
+}
+
+// getIssuerURL returns the expected issuer of the tokens when it differs from the discovery url, defaulting to the
+// external discovery url
+func (r *Config) getIssuerURL() string {
+	if r.IssuerURL == "" {
+		return r.ExternalDiscoveryURL
+	}
+
+	return r.IssuerURL
+}
+
+// getResources returns the resources, including those of the virtual hosts
+func (r *Config) getResources() []*Resource {
+	resources := r.Resources
+	for _, x := range r.VirtualHosts {
+		resources = append(resources[:len(resources):len(resources)], x.Resources...)
+	}
+
+	return resources
+}
+
+// getSignInPageModel returns the data passed to the sign in page, the custom tags and the redirection url
+func (r *Config) getSignInPageModel(redirect string) map[string]string {
+	model := make(map[string]string, 0)
+	for k, v := range r.TagData {
+		model[k] = v
+	}
+	model["redirect"] = redirect
+
+	return model
+}
+
 // hasForbiddenPage checks if there is a custom forbidden page
 func (r *Config) hasCustomForbiddenPage() bool {
 	if r.ForbiddenPage != "" {
@@ -166,15 +817,54 @@ func readOptions(cx *cli.Context, config *Config) (err error) {
 	if cx.String("client-id") != "" {
 		config.ClientID = cx.String("client-id")
 	}
+	if cx.IsSet("client-auth-method") {
+		config.ClientAuthMethod = cx.String("client-auth-method")
+	}
+	if cx.IsSet("client-auth-private-key") {
+		config.ClientAuthPrivateKey = cx.String("client-auth-private-key")
+	}
+	if cx.IsSet("client-auth-certificate") {
+		config.ClientAuthCertificate = cx.String("client-auth-certificate")
+	}
+	if cx.IsSet("client-auth-key-id") {
+		config.ClientAuthKeyID = cx.String("client-auth-key-id")
+	}
 	if cx.String("discovery-url") != "" {
 		config.DiscoveryURL = cx.String("discovery-url")
 	}
+	if cx.IsSet("allowed-audiences") {
+		config.AllowedAudiences = append(config.AllowedAudiences, cx.StringSlice("allowed-audiences")...)
+	}
+	if cx.IsSet("enable-authorized-party-audience") {
+		config.EnableAuthorizedPartyAudience = cx.Bool("enable-authorized-party-audience")
+	}
+	if cx.IsSet("trusted-discovery-url") {
+		config.TrustedDiscoveryURLs = append(config.TrustedDiscoveryURLs, cx.StringSlice("trusted-discovery-url")...)
+	}
+	if cx.IsSet("issuer-url") {
+		config.IssuerURL = cx.String("issuer-url")
+	}
+	if cx.IsSet("external-discovery-url") {
+		config.ExternalDiscoveryURL = cx.String("external-discovery-url")
+	}
 	if cx.String("upstream-url") != "" {
 		config.Upstream = cx.String("upstream-url")
 	}
+	if cx.IsSet("upstream-url-pattern") {
+		config.UpstreamURLPattern = cx.String("upstream-url-pattern")
+	}
 	if cx.String("revocation-url") != "" {
 		config.RevocationEndpoint = cx.String("revocation-url")
 	}
+	if cx.IsSet("enable-logout-redirect") {
+		config.EnableLogoutRedirect = cx.Bool("enable-logout-redirect")
+	}
+	if cx.IsSet("end-session-url") {
+		config.EndSessionURL = cx.String("end-session-url")
+	}
+	if cx.IsSet("post-logout-redirect-uri") {
+		config.PostLogoutRedirectURI = cx.String("post-logout-redirect-uri")
+	}
 	if cx.IsSet("upstream-keepalives") {
 		config.UpstreamKeepalives = cx.Bool("upstream-keepalives")
 	}
@@ -184,9 +874,75 @@ func readOptions(cx *cli.Context, config *Config) (err error) {
 	if cx.IsSet("upstream-keepalive-timeout") {
 		config.UpstreamKeepaliveTimeout = cx.Duration("upstream-keepalive-timeout")
 	}
+	if cx.IsSet("upstream-attempt-timeout") {
+		config.UpstreamAttemptTimeout = cx.Duration("upstream-attempt-timeout")
+	}
+	if cx.IsSet("upstream-idle-timeout") {
+		config.UpstreamIdleTimeout = cx.Duration("upstream-idle-timeout")
+	}
+	if cx.IsSet("upstream-max-idle-connections") {
+		config.UpstreamMaxIdleConnections = cx.Int("upstream-max-idle-connections")
+	}
+	if cx.IsSet("upstream-max-idle-connections-per-host") {
+		config.UpstreamMaxIdleConnectionsPerHost = cx.Int("upstream-max-idle-connections-per-host")
+	}
+	if cx.IsSet("upstream-max-header-size") {
+		config.UpstreamMaxHeaderSize = cx.Int("upstream-max-header-size")
+	}
+	if cx.IsSet("upstream-max-headers") {
+		config.UpstreamMaxHeaders = cx.Int("upstream-max-headers")
+	}
+	if cx.IsSet("upstream-header-casing") {
+		config.UpstreamHeaderCasing = append(config.UpstreamHeaderCasing, cx.StringSlice("upstream-header-casing")...)
+	}
+	if cx.IsSet("max-upload-rate") {
+		config.MaxUploadRate = cx.Int64("max-upload-rate")
+	}
+	if cx.IsSet("max-download-rate") {
+		config.MaxDownloadRate = cx.Int64("max-download-rate")
+	}
+	if cx.IsSet("max-transfer-duration") {
+		config.MaxTransferDuration = cx.Duration("max-transfer-duration")
+	}
+	if cx.IsSet("enable-deadline-propagation") {
+		config.EnableDeadlinePropagation = cx.Bool("enable-deadline-propagation")
+	}
+	if cx.IsSet("max-body-inspection-size") {
+		config.MaxBodyInspectionSize = cx.Int64("max-body-inspection-size")
+	}
+	if cx.IsSet("max-upgraded-connections") {
+		config.MaxUpgradedConnections = cx.Int("max-upgraded-connections")
+	}
+	if cx.IsSet("max-upgraded-connections-per-user") {
+		config.MaxUpgradedConnectionsPerUser = cx.Int("max-upgraded-connections-per-user")
+	}
+	if cx.IsSet("dedupe-forwarded-headers") {
+		config.DedupeForwardedHeaders = cx.Bool("dedupe-forwarded-headers")
+	}
+	if cx.IsSet("enable-path-normalization") {
+		config.EnablePathNormalization = cx.Bool("enable-path-normalization")
+	}
+	if cx.IsSet("case-insensitive-paths") {
+		config.CaseInsensitivePaths = cx.Bool("case-insensitive-paths")
+	}
+	if cx.IsSet("default-deny") {
+		config.DefaultDeny = cx.Bool("default-deny")
+	}
+	if cx.IsSet("method-override") {
+		config.MethodOverride = cx.String("method-override")
+	}
+	if cx.IsSet("head-method") {
+		config.HeadMethod = cx.String("head-method")
+	}
+	if cx.IsSet("options-method") {
+		config.OptionsMethod = cx.String("options-method")
+	}
 	if cx.IsSet("idle-duration") {
 		config.IdleDuration = cx.Duration("idle-duration")
 	}
+	if cx.IsSet("skew-tolerance") {
+		config.SkewTolerance = cx.Duration("skew-tolerance")
+	}
 	if cx.IsSet("skip-token-verification") {
 		config.SkipTokenVerification = cx.Bool("skip-token-verification")
 	}
@@ -205,45 +961,337 @@ func readOptions(cx *cli.Context, config *Config) (err error) {
 	if cx.IsSet("cookie-refresh-name") {
 		config.CookieRefreshName = cx.String("cookie-refresh-name")
 	}
-	if cx.IsSet("cookie-domain") {
-		config.CookieDomain = cx.String("cookie-domain")
+	if cx.IsSet("cookie-binding-name") {
+		config.CookieBindingName = cx.String("cookie-binding-name")
 	}
-	if cx.IsSet("add-claims") {
-		config.AddClaims = append(config.AddClaims, cx.StringSlice("add-claims")...)
+	if cx.IsSet("cookie-kerberos-name") {
+		config.CookieKerberosName = cx.String("cookie-kerberos-name")
 	}
-	if cx.String("store-url") != "" {
-		config.StoreURL = cx.String("store-url")
+	if cx.IsSet("cookie-saml-name") {
+		config.CookieSAMLName = cx.String("cookie-saml-name")
+	}
+	if cx.IsSet("cookie-pkce-name") {
+		config.CookiePKCEName = cx.String("cookie-pkce-name")
+	}
+	if cx.IsSet("cookie-nonce-name") {
+		config.CookieNonceName = cx.String("cookie-nonce-name")
+	}
+	if cx.IsSet("cookie-id-token-name") {
+		config.CookieIDTokenName = cx.String("cookie-id-token-name")
+	}
+	if cx.IsSet("bind-session-ip") {
+		config.BindSessionIP = cx.Bool("bind-session-ip")
+	}
+	if cx.IsSet("bind-session-ipv4-prefix") {
+		config.BindSessionIPv4Prefix = cx.Int("bind-session-ipv4-prefix")
+	}
+	if cx.IsSet("bind-session-ipv6-prefix") {
+		config.BindSessionIPv6Prefix = cx.Int("bind-session-ipv6-prefix")
+	}
+	if cx.IsSet("bind-session-user-agent") {
+		config.BindSessionUserAgent = cx.Bool("bind-session-user-agent")
+	}
+	if cx.IsSet("cookie-domain") {
+		config.CookieDomain = cx.String("cookie-domain")
+	}
+	if cx.IsSet("permitted-cookie-domains") {
+		config.PermittedCookieDomains = append(config.PermittedCookieDomains, cx.StringSlice("permitted-cookie-domains")...)
+	}
+	if cx.IsSet("add-claims") {
+		config.AddClaims = append(config.AddClaims, cx.StringSlice("add-claims")...)
+	}
+	if cx.String("store-url") != "" {
+		config.StoreURL = cx.String("store-url")
+	}
+	if cx.IsSet("store-ca-certificate") {
+		config.StoreCACertificate = cx.String("store-ca-certificate")
+	}
+	if cx.IsSet("store-client-certificate") {
+		config.StoreClientCertificate = cx.String("store-client-certificate")
+	}
+	if cx.IsSet("store-client-private-key") {
+		config.StoreClientPrivateKey = cx.String("store-client-private-key")
+	}
+	if cx.IsSet("store-pool-size") {
+		config.StorePoolSize = cx.Int("store-pool-size")
 	}
 	if cx.IsSet("no-redirects") {
 		config.NoRedirects = cx.Bool("no-redirects")
 	}
+	if cx.IsSet("enable-bearer-challenge") {
+		config.EnableBearerChallenge = cx.Bool("enable-bearer-challenge")
+	}
+	if cx.IsSet("bearer-realm") {
+		config.BearerRealm = cx.String("bearer-realm")
+	}
+	if cx.IsSet("bearer-error-description") {
+		config.BearerErrorDescription = cx.Bool("bearer-error-description")
+	}
+	if cx.IsSet("max-sessions") {
+		config.MaxSessions = cx.Int("max-sessions")
+	}
+	if cx.IsSet("session-limit-action") {
+		config.SessionLimitAction = cx.String("session-limit-action")
+	}
+	if cx.IsSet("preserve-fragments") {
+		config.PreserveFragments = cx.Bool("preserve-fragments")
+	}
+	if cx.IsSet("enable-signed-state") {
+		config.EnableSignedState = cx.Bool("enable-signed-state")
+	}
+	if cx.IsSet("enable-pkce") {
+		config.EnablePKCE = cx.Bool("enable-pkce")
+	}
+	if cx.IsSet("enable-nonce") {
+		config.EnableNonce = cx.BoolT("enable-nonce")
+	}
+	if cx.IsSet("authorization-claims") {
+		config.AuthorizationClaims = cx.String("authorization-claims")
+	}
+	if cx.IsSet("ui-locales") {
+		config.UILocales = cx.String("ui-locales")
+	}
+	if cx.IsSet("login-hint") {
+		config.LoginHint = cx.String("login-hint")
+	}
+	if cx.IsSet("enable-login-hint-propagation") {
+		config.EnableLoginHintPropagation = cx.Bool("enable-login-hint-propagation")
+	}
+	if cx.IsSet("login-hint-header") {
+		config.LoginHintHeader = cx.String("login-hint-header")
+	}
+	if cx.IsSet("idp-hint") {
+		config.IDPHint = cx.String("idp-hint")
+	}
+	if cx.IsSet("prompt") {
+		config.Prompt = cx.String("prompt")
+	}
+	if cx.IsSet("authentication-max-age") {
+		config.AuthenticationMaxAge = cx.Duration("authentication-max-age")
+	}
+	if cx.IsSet("authorization-params-passthrough") {
+		config.AuthorizationParamsPassthrough = cx.StringSlice("authorization-params-passthrough")
+	}
+	if cx.IsSet("acr-levels") {
+		config.ACRLevels = cx.StringSlice("acr-levels")
+	}
+	if cx.IsSet("enable-device-authorization") {
+		config.EnableDeviceAuthorization = cx.Bool("enable-device-authorization")
+	}
+	if cx.IsSet("device-authorization-url") {
+		config.DeviceAuthorizationURL = cx.String("device-authorization-url")
+	}
+	if cx.IsSet("enable-callback-replay-protection") {
+		config.EnableCallbackReplayProtection = cx.Bool("enable-callback-replay-protection")
+	}
+	if cx.IsSet("callback-replay-window") {
+		config.CallbackReplayWindow = cx.Duration("callback-replay-window")
+	}
+	if cx.IsSet("enable-backchannel-logout") {
+		config.EnableBackchannelLogout = cx.Bool("enable-backchannel-logout")
+	}
+	if cx.IsSet("backchannel-logout-ttl") {
+		config.BackchannelLogoutTTL = cx.Duration("backchannel-logout-ttl")
+	}
+	if cx.IsSet("enable-frontchannel-logout") {
+		config.EnableFrontchannelLogout = cx.Bool("enable-frontchannel-logout")
+	}
+	if cx.IsSet("frontchannel-logout-session-required") {
+		config.FrontchannelLogoutSessionRequired = cx.Bool("frontchannel-logout-session-required")
+	}
+	if cx.IsSet("signed-state-duration") {
+		config.SignedStateDuration = cx.Duration("signed-state-duration")
+	}
+	if cx.IsSet("login-loop-threshold") {
+		config.LoginLoopThreshold = cx.Int("login-loop-threshold")
+	}
+	if cx.IsSet("login-loop-window") {
+		config.LoginLoopWindow = cx.Duration("login-loop-window")
+	}
+	if cx.IsSet("token-cache-size") {
+		config.TokenCacheSize = cx.Int("token-cache-size")
+	}
+	if cx.IsSet("token-cache-ttl") {
+		config.TokenCacheTTL = cx.Duration("token-cache-ttl")
+	}
+	if cx.IsSet("max-token-size") {
+		config.MaxTokenSize = cx.Int("max-token-size")
+	}
+	if cx.IsSet("max-token-claims") {
+		config.MaxTokenClaims = cx.Int("max-token-claims")
+	}
+	if cx.IsSet("max-token-depth") {
+		config.MaxTokenDepth = cx.Int("max-token-depth")
+	}
+	if cx.IsSet("enable-token-cache-store") {
+		config.EnableTokenCacheStore = cx.Bool("enable-token-cache-store")
+	}
+	if cx.IsSet("enable-token-introspection") {
+		config.EnableTokenIntrospection = cx.Bool("enable-token-introspection")
+	}
+	if cx.IsSet("introspection-url") {
+		config.IntrospectionURL = cx.String("introspection-url")
+	}
+	if cx.IsSet("introspection-cache-size") {
+		config.IntrospectionCacheSize = cx.Int("introspection-cache-size")
+	}
+	if cx.IsSet("introspection-cache-ttl") {
+		config.IntrospectionCacheTTL = cx.Duration("introspection-cache-ttl")
+	}
+	if cx.IsSet("enable-token-exchange") {
+		config.EnableTokenExchange = cx.Bool("enable-token-exchange")
+	}
+	if cx.IsSet("token-exchange-audience") {
+		config.TokenExchangeAudience = cx.String("token-exchange-audience")
+	}
+	if cx.IsSet("token-exchange-client-id") {
+		config.TokenExchangeClientID = cx.String("token-exchange-client-id")
+	}
+	if cx.IsSet("token-exchange-client-secret") {
+		config.TokenExchangeClientSecret = cx.String("token-exchange-client-secret")
+	}
+	if cx.IsSet("token-exchange-cache-size") {
+		config.TokenExchangeCacheSize = cx.Int("token-exchange-cache-size")
+	}
+	if cx.IsSet("enable-uma") {
+		config.EnableUMA = cx.Bool("enable-uma")
+	}
+	if cx.IsSet("uma-audience") {
+		config.UMAAudience = cx.String("uma-audience")
+	}
+	if cx.IsSet("uma-cache-size") {
+		config.UMACacheSize = cx.Int("uma-cache-size")
+	}
+	if cx.IsSet("uma-cache-ttl") {
+		config.UMACacheTTL = cx.Duration("uma-cache-ttl")
+	}
+	if cx.IsSet("enrichment-url") {
+		config.EnrichmentURL = cx.String("enrichment-url")
+	}
+	if cx.IsSet("enrichment-claim") {
+		config.EnrichmentClaim = cx.String("enrichment-claim")
+	}
+	if cx.IsSet("enrichment-lookup-attribute") {
+		config.EnrichmentLookupAttribute = cx.String("enrichment-lookup-attribute")
+	}
+	if cx.IsSet("enrichment-attributes") {
+		config.EnrichmentAttributes = cx.StringSlice("enrichment-attributes")
+	}
+	if cx.IsSet("enrichment-base-dn") {
+		config.EnrichmentBaseDN = cx.String("enrichment-base-dn")
+	}
+	if cx.IsSet("enrichment-bind-dn") {
+		config.EnrichmentBindDN = cx.String("enrichment-bind-dn")
+	}
+	if cx.IsSet("enrichment-bind-password") {
+		config.EnrichmentBindPassword = cx.String("enrichment-bind-password")
+	}
+	if cx.IsSet("enrichment-token") {
+		config.EnrichmentToken = cx.String("enrichment-token")
+	}
+	if cx.IsSet("enrichment-timeout") {
+		config.EnrichmentTimeout = cx.Duration("enrichment-timeout")
+	}
+	if cx.IsSet("enrichment-cache-size") {
+		config.EnrichmentCacheSize = cx.Int("enrichment-cache-size")
+	}
+	if cx.IsSet("enrichment-cache-ttl") {
+		config.EnrichmentCacheTTL = cx.Duration("enrichment-cache-ttl")
+	}
+	if cx.IsSet("unauthenticated-cache-size") {
+		config.UnauthenticatedCacheSize = cx.Int("unauthenticated-cache-size")
+	}
+	if cx.IsSet("unauthenticated-cache-ttl") {
+		config.UnauthenticatedCacheTTL = cx.Duration("unauthenticated-cache-ttl")
+	}
+	if cx.IsSet("enable-dpop") {
+		config.EnableDPoP = cx.Bool("enable-dpop")
+	}
+	if cx.IsSet("enable-xhr-login") {
+		config.EnableXHRLogin = cx.Bool("enable-xhr-login")
+	}
 	if cx.String("redirection-url") != "" {
 		config.RedirectionURL = cx.String("redirection-url")
 	}
+	if cx.IsSet("redirection-urls") {
+		config.RedirectionURLs = append(config.RedirectionURLs, cx.StringSlice("redirection-urls")...)
+	}
+	if cx.IsSet("callback-path") {
+		config.CallbackPath = cx.String("callback-path")
+	}
 	if cx.IsSet("tls-cert") {
 		config.TLSCertificate = cx.String("tls-cert")
 	}
 	if cx.IsSet("tls-private-key") {
 		config.TLSPrivateKey = cx.String("tls-private-key")
 	}
+	if cx.IsSet("tls-certificate-pair") {
+		// note: the order is kept, the first pair being the default when no tls-cert is given
+		for _, x := range cx.StringSlice("tls-certificate-pair") {
+			items := strings.Split(x, "=")
+			if len(items) != 2 {
+				return fmt.Errorf("invalid tls certificate pair '%s' should be cert=key", x)
+			}
+			config.TLSCertificates = append(config.TLSCertificates, TLSCertificatePair{Certificate: items[0], PrivateKey: items[1]})
+		}
+	}
+	if cx.IsSet("enable-ocsp-stapling") {
+		config.EnableOCSPStapling = cx.Bool("enable-ocsp-stapling")
+	}
 	if cx.IsSet("tls-ca-certificate") {
 		config.TLSCaCertificate = cx.String("tls-ca-certificate")
 	}
+	if cx.IsSet("tls-client-crl") {
+		config.TLSClientCRL = cx.String("tls-client-crl")
+	}
+	if cx.IsSet("enable-tls-client-ocsp") {
+		config.EnableTLSClientOCSP = cx.Bool("enable-tls-client-ocsp")
+	}
+	if cx.IsSet("tls-revocation-failure-mode") {
+		config.TLSRevocationFailureMode = cx.String("tls-revocation-failure-mode")
+	}
+	if cx.IsSet("spiffe-endpoint-socket") {
+		config.SpiffeEndpointSocket = cx.String("spiffe-endpoint-socket")
+	}
 	if cx.IsSet("tls-client-certificate") {
 		config.TLSClientCertificate = cx.String("tls-client-certificate")
 	}
 	if cx.IsSet("enable-metrics") {
 		config.EnableMetrics = cx.Bool("enable-metrics")
 	}
+	if cx.IsSet("diagnostics-signal") {
+		config.DiagnosticsSignal = cx.String("diagnostics-signal")
+	}
+	if cx.IsSet("enable-config-reload") {
+		config.EnableConfigReload = cx.Bool("enable-config-reload")
+	}
+	if cx.IsSet("enable-bot-detection") {
+		config.EnableBotDetection = cx.Bool("enable-bot-detection")
+	}
+	if cx.IsSet("enable-debug-headers") {
+		config.EnableDebugHeaders = cx.Bool("enable-debug-headers")
+	}
+	if cx.IsSet("debug-headers-allowlist") {
+		config.DebugHeadersAllowlist = append(config.DebugHeadersAllowlist, cx.StringSlice("debug-headers-allowlist")...)
+	}
 	if cx.IsSet("enable-proxy-protocol") {
 		config.EnableProxyProtocol = cx.Bool("enable-proxy-protocol")
 	}
+	if cx.IsSet("upstream-proxy-protocol") {
+		config.UpstreamProxyProtocol = cx.Bool("upstream-proxy-protocol")
+	}
+	if cx.IsSet("enable-grpc-web") {
+		config.EnableGRPCWeb = cx.Bool("enable-grpc-web")
+	}
 	if cx.IsSet("enable-forwarding") {
 		config.EnableForwarding = cx.Bool("enable-forwarding")
 	}
 	if cx.IsSet("enable-refresh-tokens") {
 		config.EnableRefreshTokens = cx.Bool("enable-refresh-tokens")
 	}
+	if cx.IsSet("forwarding-grant-type") {
+		config.ForwardingGrantType = cx.String("forwarding-grant-type")
+	}
 	if cx.IsSet("forwarding-username") {
 		config.ForwardingUsername = cx.String("forwarding-username")
 	}
@@ -262,12 +1310,156 @@ func readOptions(cx *cli.Context, config *Config) (err error) {
 	if cx.IsSet("enable-security-filter") {
 		config.EnableSecurityFilter = true
 	}
+	if cx.IsSet("security-filter-allowed-hosts") {
+		config.SecurityFilter.AllowedHosts = append(config.SecurityFilter.AllowedHosts, cx.StringSlice("security-filter-allowed-hosts")...)
+	}
+	if cx.IsSet("security-filter-ssl-redirect") {
+		config.SecurityFilter.SSLRedirect = cx.Bool("security-filter-ssl-redirect")
+	}
+	if cx.IsSet("security-filter-ssl-host") {
+		config.SecurityFilter.SSLHost = cx.String("security-filter-ssl-host")
+	}
+	if cx.IsSet("security-filter-ssl-proxy-headers") {
+		headers, err := decodeKeyPairs(cx.StringSlice("security-filter-ssl-proxy-headers"))
+		if err != nil {
+			return err
+		}
+		if config.SecurityFilter.SSLProxyHeaders == nil {
+			config.SecurityFilter.SSLProxyHeaders = make(map[string]string)
+		}
+		mergeMaps(config.SecurityFilter.SSLProxyHeaders, headers)
+	}
+	if cx.IsSet("security-filter-sts-seconds") {
+		config.SecurityFilter.STSSeconds = cx.Int64("security-filter-sts-seconds")
+	}
+	if cx.IsSet("security-filter-development") {
+		config.SecurityFilter.Development = cx.Bool("security-filter-development")
+	}
+	if cx.IsSet("enable-cache-headers") {
+		config.EnableCacheHeaders = cx.BoolT("enable-cache-headers")
+	}
+	if cx.IsSet("cache-control") {
+		config.CacheControl = cx.String("cache-control")
+	}
+	if cx.IsSet("signed-url-key") {
+		config.SignedURLKey = cx.String("signed-url-key")
+	}
+	if cx.IsSet("signed-url-duration") {
+		config.SignedURLDuration = cx.Duration("signed-url-duration")
+	}
+	if cx.IsSet("enable-idp-grace") {
+		config.EnableIdPGrace = cx.Bool("enable-idp-grace")
+	}
+	if cx.IsSet("enable-discovery-proxy") {
+		config.EnableDiscoveryProxy = cx.Bool("enable-discovery-proxy")
+	}
+	if cx.IsSet("token-passthrough-clients") {
+		config.TokenPassthroughClients = append(config.TokenPassthroughClients, cx.StringSlice("token-passthrough-clients")...)
+	}
+	if cx.IsSet("token-passthrough-rate-limit") {
+		config.TokenPassthroughRateLimit = cx.Int("token-passthrough-rate-limit")
+	}
+	if cx.IsSet("idp-grace-period") {
+		config.IdPGracePeriod = cx.Duration("idp-grace-period")
+	}
+	if cx.IsSet("enable-jwks-cache") {
+		config.EnableJWKSCache = cx.BoolT("enable-jwks-cache")
+	}
+	if cx.IsSet("jwks-min-refresh-interval") {
+		config.JWKSMinRefreshInterval = cx.Duration("jwks-min-refresh-interval")
+	}
+	if cx.IsSet("jwks-refresh-interval") {
+		config.JWKSRefreshInterval = cx.Duration("jwks-refresh-interval")
+	}
+	if cx.IsSet("break-glass-key") {
+		config.BreakGlassKey = cx.String("break-glass-key")
+	}
+	if cx.IsSet("break-glass-max-duration") {
+		config.BreakGlassMaxDuration = cx.Duration("break-glass-max-duration")
+	}
+	if cx.IsSet("break-glass-rate-limit") {
+		config.BreakGlassRateLimit = cx.Int("break-glass-rate-limit")
+	}
+	if cx.IsSet("spnego-keytab") {
+		config.SPNEGOKeytab = cx.String("spnego-keytab")
+	}
+	if cx.IsSet("spnego-roles") {
+		roles, err := decodeKeyPairs(cx.StringSlice("spnego-roles"))
+		if err != nil {
+			return err
+		}
+		if config.SPNEGORoles == nil {
+			config.SPNEGORoles = make(map[string]string)
+		}
+		mergeMaps(roles, config.SPNEGORoles)
+	}
+	if cx.IsSet("saml-idp-metadata-url") {
+		config.SAMLMetadataURL = cx.String("saml-idp-metadata-url")
+	}
+	if cx.IsSet("saml-roles-attribute") {
+		config.SAMLRolesAttribute = cx.String("saml-roles-attribute")
+	}
+	if cx.IsSet("saml-session-duration") {
+		config.SAMLSessionDuration = cx.Duration("saml-session-duration")
+	}
+	if cx.IsSet("edge-authentication") {
+		config.EdgeAuthentication = cx.String("edge-authentication")
+	}
+	if cx.IsSet("edge-alb-arn") {
+		config.EdgeALBArn = cx.String("edge-alb-arn")
+	}
+	if cx.IsSet("edge-cloudflare-team-domain") {
+		config.EdgeCloudflareTeamDomain = cx.String("edge-cloudflare-team-domain")
+	}
+	if cx.IsSet("edge-audience") {
+		config.EdgeAudience = cx.String("edge-audience")
+	}
+	if cx.IsSet("edge-keys-url") {
+		config.EdgeKeysURL = cx.String("edge-keys-url")
+	}
 	if cx.IsSet("json-logging") {
 		config.LogJSONFormat = cx.Bool("json-logging")
 	}
 	if cx.IsSet("log-requests") {
 		config.LogRequests = cx.Bool("log-requests")
 	}
+	if cx.IsSet("listen-admin") {
+		config.ListenAdmin = cx.String("listen-admin")
+	}
+	if cx.IsSet("admin-token") {
+		config.AdminToken = cx.String("admin-token")
+	}
+	if cx.IsSet("ext-authz-listen") {
+		config.ExtAuthzListen = cx.String("ext-authz-listen")
+	}
+	if cx.IsSet("log-redact-query-params") {
+		config.LogRedactQueryParams = append(config.LogRedactQueryParams, cx.StringSlice("log-redact-query-params")...)
+	}
+	if cx.IsSet("log-request-headers") {
+		config.LogRequestHeaders = append(config.LogRequestHeaders, cx.StringSlice("log-request-headers")...)
+	}
+	if cx.IsSet("log-metadata") {
+		config.LogMetadata = cx.Bool("log-metadata")
+	}
+	if cx.IsSet("log-metadata-service") {
+		config.LogMetadataService = cx.Bool("log-metadata-service")
+	}
+	if cx.IsSet("log-sample-rate") {
+		rates, err := decodeKeyPairs(cx.StringSlice("log-sample-rate"))
+		if err != nil {
+			return err
+		}
+		if config.LogSampleRates == nil {
+			config.LogSampleRates = make(map[string]float64, 0)
+		}
+		for k, v := range rates {
+			rate, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				return fmt.Errorf("the log sample rate for: %s is invalid, %s", k, err)
+			}
+			config.LogSampleRates[k] = rate
+		}
+	}
 	if cx.IsSet("verbose") {
 		config.Verbose = cx.Bool("verbose")
 	}
@@ -325,6 +1517,9 @@ func readOptions(cx *cli.Context, config *Config) (err error) {
 			config.Resources = append(config.Resources, resource)
 		}
 	}
+	if cx.IsSet("openapi-spec") {
+		config.OpenAPISpec = cx.String("openapi-spec")
+	}
 
 	return nil
 }
@@ -351,127 +1546,660 @@ func readConfigFile(filename string, config *Config) error {
 func getOptions() []cli.Flag {
 	defaults := newDefaultConfig()
 
-	return []cli.Flag{
+	return withFlagAliases([]cli.Flag{
+		cli.StringFlag{
+			Name:   "config",
+			Usage:  "the path to the configuration file for the keycloak proxy",
+			EnvVar: "PROXY_CONFIG_FILE",
+		},
+		cli.StringFlag{
+			Name:   "listen",
+			Usage:  "the interface the service should be listening on",
+			Value:  defaults.Listen,
+			EnvVar: "PROXY_LISTEN",
+		},
+		cli.StringFlag{
+			Name:   "client-secret",
+			Usage:  "the client secret used to authenticate to the oauth server (access_type: confidential)",
+			EnvVar: "PROXY_CLIENT_SECRET",
+		},
+		cli.StringFlag{
+			Name:   "client-id",
+			Usage:  "the client id used to authenticate to the oauth service",
+			EnvVar: "PROXY_CLIENT_ID",
+		},
+		cli.StringFlag{
+			Name:  "client-auth-method",
+			Usage: "the method the client authenticates to the provider by, i.e. client_secret_basic, client_secret_post, private_key_jwt or tls_client_auth (default: client_secret_basic)",
+		},
+		cli.StringFlag{
+			Name:  "client-auth-private-key",
+			Usage: "the rsa private key signing the client assertions of private_key_jwt, or the key of the tls_client_auth certificate",
+		},
+		cli.StringFlag{
+			Name:  "client-auth-certificate",
+			Usage: "the client certificate presented to the provider for tls_client_auth, unless the spiffe svid is used",
+		},
+		cli.StringFlag{
+			Name:  "client-auth-key-id",
+			Usage: "the key id (kid) in the header of the client assertions of private_key_jwt",
+		},
+		cli.StringFlag{
+			Name:   "discovery-url",
+			Usage:  "the discovery url to retrieve the openid configuration",
+			EnvVar: "PROXY_DISCOVERY_URL",
+		},
+		cli.StringSliceFlag{
+			Name:  "allowed-audiences",
+			Usage: "a audience, besides the client id, the tokens are accepted for, i.e. issued with a array audience",
+		},
+		cli.BoolFlag{
+			Name:  "enable-authorized-party-audience",
+			Usage: "accept the tokens whose authorized party (azp) is the client id or one of the allowed audiences",
+		},
+		cli.StringSliceFlag{
+			Name:  "trusted-discovery-url",
+			Usage: "the discovery url of an additional provider whose tokens are accepted, i.e. when migrating realms",
+		},
+		cli.StringFlag{
+			Name:  "issuer-url",
+			Usage: "the issuer of the tokens when it differs from the discovery url, i.e. keycloak is reached by a internal url",
+		},
+		cli.StringFlag{
+			Name:  "external-discovery-url",
+			Usage: "the url of the realm as reached by the users, the browser is redirected to it while the proxy uses the discovery url",
+		},
+		cli.StringSliceFlag{
+			Name:  "scope",
+			Usage: "a variable list of scopes requested when authenticating the user",
+		},
+		cli.BoolFlag{
+			Name:  "token-validate-only",
+			Usage: "validate the token and roles only, no required implement oauth",
+		},
+		cli.DurationFlag{
+			Name:  "idle-duration",
+			Usage: "the expiration of the access token cookie, if not used within this time its removed",
+		},
+		cli.DurationFlag{
+			Name:  "skew-tolerance",
+			Usage: "the skew tolerated between the clocks of the provider and the proxy on the expiry and not before of the tokens",
+		},
+		cli.StringFlag{
+			Name:   "redirection-url",
+			Usage:  "redirection url for the oauth callback url (the callback path is added)",
+			EnvVar: "PROXY_REDIRECTION_URL",
+		},
+		cli.StringSliceFlag{
+			Name:  "redirection-urls",
+			Usage: "additional redirection urls, selected by the host of the request, i.e. a client shared by a number of hostnames",
+		},
+		cli.StringFlag{
+			Name:  "callback-path",
+			Usage: "the path of the oauth callback handler, appended to the redirection url",
+			Value: defaults.CallbackPath,
+		},
+		cli.StringFlag{
+			Name:   "revocation-url",
+			Usage:  "the url for the revocation endpoint to revoke refresh token",
+			Value:  "/oauth2/revoke",
+			EnvVar: "PROXY_REVOCATION_URL",
+		},
+		cli.BoolFlag{
+			Name:  "enable-logout-redirect",
+			Usage: "redirect the logout to the end session endpoint of the provider, ending the single sign-on session",
+		},
+		cli.StringFlag{
+			Name:  "end-session-url",
+			Usage: "the url of the end session endpoint of the provider, defaults to the logout endpoint alongside the authorization endpoint",
+		},
+		cli.StringFlag{
+			Name:  "post-logout-redirect-uri",
+			Usage: "the url the provider returns the user to after the logout, unless the logout has a redirect",
+		},
+		cli.StringFlag{
+			Name:   "store-url",
+			Usage:  "url for the storage subsystem, e.g redis://127.0.0.1:6379, file:///etc/tokens.file",
+			EnvVar: "PROXY_STORE_URL",
+		},
+		cli.StringFlag{
+			Name:  "store-ca-certificate",
+			Usage: "the ca certificate redis is verified against on a rediss store url, defaults to the system certificates",
+		},
+		cli.StringFlag{
+			Name:  "store-client-certificate",
+			Usage: "the client certificate presented to redis on a rediss store url",
+		},
+		cli.StringFlag{
+			Name:  "store-client-private-key",
+			Usage: "the private key of the store client certificate",
+		},
+		cli.IntFlag{
+			Name:  "store-pool-size",
+			Usage: "the maximum number of connections to the redis store, defaults to 10",
+		},
+		cli.StringFlag{
+			Name:   "upstream-url",
+			Usage:  "the url for the upstream endpoint you wish to proxy to",
+			Value:  defaults.Upstream,
+			EnvVar: "PROXY_UPSTREAM_URL",
+		},
+		cli.StringFlag{
+			Name:  "upstream-url-pattern",
+			Usage: "the pattern the upstream urls templated from the claims of the users must match, e.g. http://notebook-[a-z0-9-]+\\.svc:8888",
+		},
+		cli.BoolTFlag{
+			Name:  "upstream-keepalives",
+			Usage: "enables or disables the keepalive connections for upstream endpoint",
+		},
+		cli.DurationFlag{
+			Name:  "upstream-timeout",
+			Usage: "is the maximum amount of time a dial will wait for a connect to complete",
+			Value: defaults.UpstreamTimeout,
+		},
+		cli.DurationFlag{
+			Name:  "upstream-keepalive-timeout",
+			Usage: "specifies the keep-alive period for an active network connection",
+			Value: defaults.UpstreamKeepaliveTimeout,
+		},
+		cli.DurationFlag{
+			Name:  "upstream-attempt-timeout",
+			Usage: "the maximum time a connection to one of the addresses of the upstream is attempted for, the addresses are raced, zero disables",
+			Value: defaults.UpstreamAttemptTimeout,
+		},
+		cli.DurationFlag{
+			Name:  "upstream-idle-timeout",
+			Usage: "the duration a idle upstream connection is kept before being reaped, zero keeps them indefinitely",
+			Value: defaults.UpstreamIdleTimeout,
+		},
+		cli.IntFlag{
+			Name:  "upstream-max-idle-connections",
+			Usage: "the maximum number of idle upstream connections kept across all hosts, zero is unlimited",
+			Value: defaults.UpstreamMaxIdleConnections,
+		},
+		cli.IntFlag{
+			Name:  "upstream-max-idle-connections-per-host",
+			Usage: "the maximum number of idle upstream connections kept per host",
+			Value: defaults.UpstreamMaxIdleConnectionsPerHost,
+		},
+		cli.IntFlag{
+			Name:  "upstream-max-header-size",
+			Usage: "the maximum size in bytes of the headers forwarded upstream, zero disables the check",
+		},
+		cli.IntFlag{
+			Name:  "upstream-max-headers",
+			Usage: "the maximum number of headers forwarded upstream, zero disables the check",
+		},
+		cli.StringSliceFlag{
+			Name:  "upstream-header-casing",
+			Usage: "a header name in the casing expected by the upstream, e.g. SOAPAction, rather than the canonical form",
+		},
+		cli.Int64Flag{
+			Name:  "max-upload-rate",
+			Usage: "the maximum rate in bytes per second a request body is read, per request, zero disables",
+		},
+		cli.Int64Flag{
+			Name:  "max-download-rate",
+			Usage: "the maximum rate in bytes per second a response is written, per request, zero disables",
+		},
+		cli.DurationFlag{
+			Name:  "max-transfer-duration",
+			Usage: "the maximum duration of a proxied request before it's aborted, zero disables",
+		},
+		cli.BoolFlag{
+			Name:  "enable-deadline-propagation",
+			Usage: "pass the time remaining of the max transfer duration upstream, via the x-request-deadline and grpc-timeout headers",
+		},
+		cli.Int64Flag{
+			Name:  "max-body-inspection-size",
+			Usage: "the maximum size in bytes of the request bodies inspected for the body claims of the resources",
+			Value: defaults.MaxBodyInspectionSize,
+		},
+		cli.IntFlag{
+			Name:  "max-upgraded-connections",
+			Usage: "the maximum upgraded connections, i.e. websockets, and event streams open in total, zero disables",
+		},
+		cli.IntFlag{
+			Name:  "max-upgraded-connections-per-user",
+			Usage: "the maximum upgraded connections and event streams open per user, or client address if anonymous, zero disables",
+		},
+		cli.BoolFlag{
+			Name:  "dedupe-forwarded-headers",
+			Usage: "collapse duplicate X-Forwarded-* and X-Auth-* headers before proxying upstream",
+		},
+		cli.BoolFlag{
+			Name:  "enable-path-normalization",
+			Usage: "normalize the request path (dot segments, duplicate slashes, encoding) before matching and proxying",
+		},
+		cli.BoolFlag{
+			Name:  "case-insensitive-paths",
+			Usage: "match the request path against the resources irrespective of case",
+		},
+		cli.BoolFlag{
+			Name:  "default-deny",
+			Usage: "require authentication on the paths which match no resource, rather than permitting them",
+		},
+		cli.StringFlag{
+			Name:  "method-override",
+			Usage: "how to handle X-HTTP-Method-Override and _method overrides, either reject or normalize",
+		},
+		cli.StringFlag{
+			Name:  "head-method",
+			Usage: "whether the head requests to the resources are matched as is (exact), always authenticated (enforce), matched as a get (match-get) or always permitted (allow)",
+			Value: defaults.HeadMethod,
+		},
+		cli.StringFlag{
+			Name:  "options-method",
+			Usage: "whether the options requests to the resources are matched as is (exact), always authenticated (enforce), matched as a get (match-get) or always permitted (allow)",
+			Value: defaults.OptionsMethod,
+		},
+		cli.BoolFlag{
+			Name:  "enable-refresh-tokens",
+			Usage: "enables the handling of the refresh tokens",
+		},
+		cli.BoolTFlag{
+			Name:  "secure-cookie",
+			Usage: "enforces the cookie to be secure, default to true",
+		},
+		cli.StringSliceFlag{
+			Name:  "cookie-domain",
+			Usage: "a domain the access cookie is available to, defaults host header",
+		},
+		cli.StringSliceFlag{
+			Name:  "permitted-cookie-domains",
+			Usage: "the domains a templated cookie domain is permitted to expand to, e.g. *.example.com",
+		},
+		cli.StringFlag{
+			Name:  "cookie-access-name",
+			Usage: "the name of the cookie use to hold the access token",
+			Value: defaults.CookieAccessName,
+		},
+		cli.StringFlag{
+			Name:  "cookie-refresh-name",
+			Usage: "the name of the cookie used to hold the encrypted refresh token",
+			Value: defaults.CookieRefreshName,
+		},
+		cli.StringFlag{
+			Name:  "cookie-binding-name",
+			Usage: "the name of the cookie used to hold the encrypted session binding",
+			Value: defaults.CookieBindingName,
+		},
+		cli.StringFlag{
+			Name:  "cookie-kerberos-name",
+			Usage: "the name of the cookie used to hold the encrypted kerberos session",
+			Value: defaults.CookieKerberosName,
+		},
+		cli.StringFlag{
+			Name:  "cookie-saml-name",
+			Usage: "the name of the cookie used to hold the encrypted saml session",
+			Value: defaults.CookieSAMLName,
+		},
+		cli.StringFlag{
+			Name:  "cookie-pkce-name",
+			Usage: "the name of the cookie used to hold the encrypted pkce code verifier through the login",
+			Value: defaults.CookiePKCEName,
+		},
+		cli.StringFlag{
+			Name:  "cookie-nonce-name",
+			Usage: "the name of the cookie used to hold the secret of the nonce through the login",
+			Value: defaults.CookieNonceName,
+		},
+		cli.StringFlag{
+			Name:  "cookie-id-token-name",
+			Usage: "the name of the cookie used to hold the identity token, the hint of the logout redirect",
+			Value: defaults.CookieIDTokenName,
+		},
+		cli.BoolFlag{
+			Name:  "bind-session-ip",
+			Usage: "bind the session to the network of the client address, requires the encryption key",
+		},
+		cli.IntFlag{
+			Name:  "bind-session-ipv4-prefix",
+			Usage: "the prefix length of the ipv4 network the session is bound to, permits nat pools",
+			Value: defaults.BindSessionIPv4Prefix,
+		},
+		cli.IntFlag{
+			Name:  "bind-session-ipv6-prefix",
+			Usage: "the prefix length of the ipv6 network the session is bound to",
+			Value: defaults.BindSessionIPv6Prefix,
+		},
+		cli.BoolFlag{
+			Name:  "bind-session-user-agent",
+			Usage: "bind the session to the user agent of the client, requires the encryption key",
+		},
 		cli.StringFlag{
-			Name:   "config",
-			Usage:  "the path to the configuration file for the keycloak proxy",
-			EnvVar: "PROXY_CONFIG_FILE",
+			Name:  "encryption-key",
+			Usage: "the encryption key used to encrpytion the session state",
+		},
+		cli.BoolFlag{
+			Name:  "no-redirects",
+			Usage: "do not have back redirects when no authentication is present, 401 them",
+		},
+		cli.BoolFlag{
+			Name:  "enable-bearer-challenge",
+			Usage: "add a bearer challenge (rfc 6750) to the 401 responses, with the invalid_token error when a token was refused",
 		},
 		cli.StringFlag{
-			Name:   "listen",
-			Usage:  "the interface the service should be listening on",
-			Value:  defaults.Listen,
-			EnvVar: "PROXY_LISTEN",
+			Name:  "bearer-realm",
+			Usage: "the realm of the bearer challenge",
+		},
+		cli.BoolFlag{
+			Name:  "bearer-error-description",
+			Usage: "include the reason the access token was refused, i.e. expired or invalid, in the bearer challenge",
+		},
+		cli.IntFlag{
+			Name:  "max-sessions",
+			Usage: "the maximum number of concurrent sessions per user, requires a store url, zero is unlimited",
 		},
 		cli.StringFlag{
-			Name:   "client-secret",
-			Usage:  "the client secret used to authenticate to the oauth server (access_type: confidential)",
-			EnvVar: "PROXY_CLIENT_SECRET",
+			Name:  "session-limit-action",
+			Usage: "the action when a user exceeds the session limit, either reject (the new session) or evict-oldest",
+			Value: sessionLimitReject,
+		},
+		cli.BoolFlag{
+			Name:  "preserve-fragments",
+			Usage: "use a javascript shim to preserve the url fragment through the login redirection",
+		},
+		cli.BoolFlag{
+			Name:  "enable-signed-state",
+			Usage: "carry the login state in a signed state parameter, for the clients blocking the temporary cookies",
+		},
+		cli.BoolFlag{
+			Name:  "enable-pkce",
+			Usage: "use a s256 proof key (pkce) on the authorization code exchange, requires the encryption-key",
+		},
+		cli.BoolTFlag{
+			Name:  "enable-nonce",
+			Usage: "bind the identity token of the login to the browser by a nonce, verified on the callback (defaults true)",
 		},
 		cli.StringFlag{
-			Name:   "client-id",
-			Usage:  "the client id used to authenticate to the oauth service",
-			EnvVar: "PROXY_CLIENT_ID",
+			Name:  "authorization-claims",
+			Usage: "the claims request parameter, a json object, added to the authorization request e.g. {\"id_token\":{\"acr\":null}}",
 		},
 		cli.StringFlag{
-			Name:   "discovery-url",
-			Usage:  "the discovery url to retrieve the openid configuration",
-			EnvVar: "PROXY_DISCOVERY_URL",
+			Name:  "ui-locales",
+			Usage: "the preferred locales of the login page, space separated, added to the authorization request",
+		},
+		cli.StringFlag{
+			Name:  "login-hint",
+			Usage: "the hint of the user logging in, i.e. the username or email, added to the authorization request",
+		},
+		cli.BoolFlag{
+			Name:  "enable-login-hint-propagation",
+			Usage: "pass the login_hint query parameter of the unauthenticated requests through to the login page of the provider",
+		},
+		cli.StringFlag{
+			Name:  "login-hint-header",
+			Usage: "a header the login hint is taken from when the request has no login_hint parameter, e.g. X-Login-Hint",
+		},
+		cli.StringFlag{
+			Name:  "idp-hint",
+			Usage: "the identity provider keycloak brokers the login to, added to the authorization request as the kc_idp_hint",
+		},
+		cli.StringFlag{
+			Name:  "prompt",
+			Usage: "the prompt parameter added to the authorization request, either none or any of login, consent and select_account",
+		},
+		cli.DurationFlag{
+			Name:  "authentication-max-age",
+			Usage: "the time since the user last authenticated after which the provider reauthenticates them, zero omits the max_age",
 		},
 		cli.StringSliceFlag{
-			Name:  "scope",
-			Usage: "a variable list of scopes requested when authenticating the user",
+			Name:  "authorization-params-passthrough",
+			Usage: "the query parameters of the login passed through to the authorization request, any of kc_idp_hint, prompt, login_hint, ui_locales and max_age",
+		},
+		cli.StringSliceFlag{
+			Name:  "acr-levels",
+			Usage: "the authentication context classes ordered from the weakest to the strongest, a stronger acr satisfies the acr required by a resource",
 		},
 		cli.BoolFlag{
-			Name:  "token-validate-only",
-			Usage: "validate the token and roles only, no required implement oauth",
+			Name:  "enable-device-authorization",
+			Usage: "accept the device authorization grant for the headless clients, via /oauth/device and /oauth/device/token",
+		},
+		cli.StringFlag{
+			Name:  "device-authorization-url",
+			Usage: "the url of the device authorization endpoint, defaults to the authorization endpoint of the provider suffixed by /device",
 		},
 		cli.DurationFlag{
-			Name:  "idle-duration",
-			Usage: "the expiration of the access token cookie, if not used within this time its removed",
+			Name:  "signed-state-duration",
+			Usage: "the time the user has to complete the login when using the signed state",
+			Value: defaults.SignedStateDuration,
+		},
+		cli.BoolFlag{
+			Name:  "enable-callback-replay-protection",
+			Usage: "reject the authorization codes, and signed states, which have already been used on the callback",
+		},
+		cli.DurationFlag{
+			Name:  "callback-replay-window",
+			Usage: "the time the used authorization codes are tracked for, the signed states are tracked for the signed-state-duration",
+			Value: defaults.CallbackReplayWindow,
+		},
+		cli.BoolFlag{
+			Name:  "enable-backchannel-logout",
+			Usage: "accept the logout tokens of the provider on /oauth/backchannel-logout, refusing the sessions logged out",
+		},
+		cli.DurationFlag{
+			Name:  "backchannel-logout-ttl",
+			Usage: "the time the sessions logged out are held for, should be at least the maximum lifetime of the sessions",
+			Value: defaults.BackchannelLogoutTTL,
+		},
+		cli.BoolFlag{
+			Name:  "enable-frontchannel-logout",
+			Usage: "clear the cookies of the sessions logged out by the provider on /oauth/frontchannel-logout, loaded in a iframe",
+		},
+		cli.BoolFlag{
+			Name:  "frontchannel-logout-session-required",
+			Usage: "only log out the session named by the iss and sid parameters of the front-channel logout",
+		},
+		cli.IntFlag{
+			Name:  "login-loop-threshold",
+			Usage: "the logins without a session permitted from a client within the window before the loop is broken, zero disables",
+			Value: defaults.LoginLoopThreshold,
+		},
+		cli.DurationFlag{
+			Name:  "login-loop-window",
+			Usage: "the window the logins of a client are counted in for the login loop detection",
+			Value: defaults.LoginLoopWindow,
+		},
+		cli.IntFlag{
+			Name:  "token-cache-size",
+			Usage: "the number of successful token validations cached, sparing the verification on every request, zero disables",
+		},
+		cli.DurationFlag{
+			Name:  "token-cache-ttl",
+			Usage: "the maximum time a token validation is cached for, never beyond the expiration of the token",
+			Value: defaults.TokenCacheTTL,
+		},
+		cli.IntFlag{
+			Name:  "max-token-size",
+			Usage: "the maximum size in bytes of the tokens presented by the clients, zero disables the check",
+			Value: defaults.MaxTokenSize,
+		},
+		cli.IntFlag{
+			Name:  "max-token-claims",
+			Usage: "the maximum number of claims of the tokens presented by the clients, zero disables the check",
+			Value: defaults.MaxTokenClaims,
+		},
+		cli.IntFlag{
+			Name:  "max-token-depth",
+			Usage: "the maximum nesting depth of the claims of the tokens presented by the clients, zero disables the check",
+			Value: defaults.MaxTokenDepth,
+		},
+		cli.BoolFlag{
+			Name:  "enable-token-cache-store",
+			Usage: "share the token validations between the instances via the store, requires a redis store-url",
+		},
+		cli.BoolFlag{
+			Name:  "enable-token-introspection",
+			Usage: "validate the opaque bearer tokens with the introspection endpoint of the provider (rfc 7662)",
 		},
 		cli.StringFlag{
-			Name:   "redirection-url",
-			Usage:  fmt.Sprintf("redirection url for the oauth callback url (%s is added)", oauthURL),
-			EnvVar: "PROXY_REDIRECTION_URL",
+			Name:  "introspection-url",
+			Usage: "the url of the introspection endpoint, defaults to the token endpoint of the provider suffixed by /introspect",
+		},
+		cli.IntFlag{
+			Name:  "introspection-cache-size",
+			Usage: "the number of introspection results cached, zero disables",
+			Value: defaults.IntrospectionCacheSize,
+		},
+		cli.DurationFlag{
+			Name:  "introspection-cache-ttl",
+			Usage: "the maximum time a introspection result is cached for, never beyond the expiration of the token",
+			Value: defaults.IntrospectionCacheTTL,
+		},
+		cli.BoolFlag{
+			Name:  "enable-token-exchange",
+			Usage: "exchange the access token for one of the upstream audience (rfc 8693) before proxying, requires the token-exchange-audience",
 		},
 		cli.StringFlag{
-			Name:   "revocation-url",
-			Usage:  "the url for the revocation endpoint to revoke refresh token",
-			Value:  "/oauth2/revoke",
-			EnvVar: "PROXY_REVOCATION_URL",
+			Name:  "token-exchange-audience",
+			Usage: "the audience, i.e. the client id of the upstream, the access tokens are exchanged for",
 		},
 		cli.StringFlag{
-			Name:   "store-url",
-			Usage:  "url for the storage subsystem, e.g redis://127.0.0.1:6379, file:///etc/tokens.file",
-			EnvVar: "PROXY_STORE_URL",
+			Name:  "token-exchange-client-id",
+			Usage: "the client performing the token exchange, defaults to the client id",
 		},
 		cli.StringFlag{
-			Name:   "upstream-url",
-			Usage:  "the url for the upstream endpoint you wish to proxy to",
-			Value:  defaults.Upstream,
-			EnvVar: "PROXY_UPSTREAM_URL",
+			Name:  "token-exchange-client-secret",
+			Usage: "the secret of the client performing the token exchange",
 		},
-		cli.BoolTFlag{
-			Name:  "upstream-keepalives",
-			Usage: "enables or disables the keepalive connections for upstream endpoint",
+		cli.IntFlag{
+			Name:  "token-exchange-cache-size",
+			Usage: "the number of exchanged tokens cached by the subject, never beyond the expiration of either token, zero disables",
+			Value: defaults.TokenExchangeCacheSize,
 		},
-		cli.DurationFlag{
-			Name:  "upstream-timeout",
-			Usage: "is the maximum amount of time a dial will wait for a connect to complete",
-			Value: defaults.UpstreamTimeout,
+		cli.BoolFlag{
+			Name:  "enable-uma",
+			Usage: "authorize the requests by the permissions of the keycloak authorization services (uma), rather than the roles",
+		},
+		cli.StringFlag{
+			Name:  "uma-audience",
+			Usage: "the client holding the resources and policies the permissions are evaluated by, defaults to the client id",
+		},
+		cli.IntFlag{
+			Name:  "uma-cache-size",
+			Usage: "the number of permissions cached by the access token, never beyond its expiration, zero disables",
+			Value: defaults.UMACacheSize,
 		},
 		cli.DurationFlag{
-			Name:  "upstream-keepalive-timeout",
-			Usage: "specifies the keep-alive period for an active network connection",
-			Value: defaults.UpstreamKeepaliveTimeout,
+			Name:  "uma-cache-ttl",
+			Usage: "the maximum time the permissions of a access token are cached for",
+			Value: defaults.UMACacheTTL,
 		},
-		cli.BoolFlag{
-			Name:  "enable-refresh-tokens",
-			Usage: "enables the handling of the refresh tokens",
+		cli.StringFlag{
+			Name:  "enrichment-url",
+			Usage: "the ldap directory (ldap:// or ldaps://) or scim endpoint (http:// or https://) the attributes of the users are looked up in",
 		},
-		cli.BoolTFlag{
-			Name:  "secure-cookie",
-			Usage: "enforces the cookie to be secure, default to true",
+		cli.StringFlag{
+			Name:  "enrichment-claim",
+			Usage: "the claim of the token the users are looked up in the directory by",
+			Value: defaults.EnrichmentClaim,
+		},
+		cli.StringFlag{
+			Name:  "enrichment-lookup-attribute",
+			Usage: "the attribute of the directory matched to the claim, defaults to uid for ldap and userName for scim",
 		},
 		cli.StringSliceFlag{
-			Name:  "cookie-domain",
-			Usage: "a domain the access cookie is available to, defaults host header",
+			Name:  "enrichment-attributes",
+			Usage: "the attributes of the directory added to the claims, as attribute or attribute=claim",
 		},
 		cli.StringFlag{
-			Name:  "cookie-access-name",
-			Usage: "the name of the cookie use to hold the access token",
-			Value: defaults.CookieAccessName,
+			Name:  "enrichment-base-dn",
+			Usage: "the dn the users are searched under in the ldap directory",
 		},
 		cli.StringFlag{
-			Name:  "cookie-refresh-name",
-			Usage: "the name of the cookie used to hold the encrypted refresh token",
-			Value: defaults.CookieRefreshName,
+			Name:  "enrichment-bind-dn",
+			Usage: "the dn the proxy binds to the ldap directory as, anonymous when empty",
 		},
 		cli.StringFlag{
-			Name:  "encryption-key",
-			Usage: "the encryption key used to encrpytion the session state",
+			Name:  "enrichment-bind-password",
+			Usage: "the password of the bind dn",
+		},
+		cli.StringFlag{
+			Name:  "enrichment-token",
+			Usage: "the bearer token of the scim endpoint",
+		},
+		cli.DurationFlag{
+			Name:  "enrichment-timeout",
+			Usage: "the time permitted for the lookup of the attributes of a user",
+			Value: defaults.EnrichmentTimeout,
+		},
+		cli.IntFlag{
+			Name:  "enrichment-cache-size",
+			Usage: "the number of users the attributes are cached for, zero disables",
+			Value: defaults.EnrichmentCacheSize,
+		},
+		cli.DurationFlag{
+			Name:  "enrichment-cache-ttl",
+			Usage: "the time the attributes of a user are cached for",
+			Value: defaults.EnrichmentCacheTTL,
+		},
+		cli.IntFlag{
+			Name:  "unauthenticated-cache-size",
+			Usage: "the number of request uris the authorization state of the unauthenticated requests is cached for, zero disables",
+		},
+		cli.DurationFlag{
+			Name:  "unauthenticated-cache-ttl",
+			Usage: "the time the authorization state of a request uri is cached for",
+			Value: defaults.UnauthenticatedCacheTTL,
 		},
 		cli.BoolFlag{
-			Name:  "no-redirects",
-			Usage: "do not have back redirects when no authentication is present, 401 them",
+			Name:  "enable-dpop",
+			Usage: "validate the dpop proof of possession for access tokens bound to a key",
+		},
+		cli.BoolFlag{
+			Name:  "enable-xhr-login",
+			Usage: "hand back a 401 with a json body holding the login url to xhr requests, rather than a redirect",
 		},
 		cli.StringSliceFlag{
 			Name:  "hostname",
-			Usage: "a list of hostnames the service will respond to, defaults to all",
+			Usage: "a list of hostnames the service will respond to, may include a wildcard e.g. *.example.com, defaults to all",
 		},
 		cli.BoolFlag{
 			Name:  "enable-metrics",
 			Usage: "enable the prometheus metrics collector on /oauth/metrics",
 		},
+		cli.StringFlag{
+			Name:  "diagnostics-signal",
+			Usage: "dump the goroutine stacks, caches, connections and store statistics to the log on the signal, SIGUSR1, SIGUSR2 or SIGQUIT",
+		},
+		cli.BoolFlag{
+			Name:  "enable-config-reload",
+			Usage: "reload the configuration on a SIGHUP rather than exiting, a invalid configuration is refused and the previous served",
+		},
+		cli.BoolFlag{
+			Name:  "enable-bot-detection",
+			Usage: "enable the scanner heuristics, serving a challenge to flagged clients",
+		},
+		cli.BoolFlag{
+			Name:  "enable-debug-headers",
+			Usage: "add the upstream time, matched resource and decision headers to the responses of the allowlisted clients",
+		},
+		cli.StringSliceFlag{
+			Name:  "debug-headers-allowlist",
+			Usage: "a network or address of the clients the debug headers are added for, i.e. 10.0.0.0/8",
+		},
 		cli.BoolFlag{
 			Name:  "enable-proxy-protocol",
-			Usage: "whether to enable proxy protocol",
+			Usage: "whether to enable proxy protocol, v1 and v2 headers are accepted",
+		},
+		cli.BoolFlag{
+			Name:  "upstream-proxy-protocol",
+			Usage: "send a proxy protocol v2 header with the client address to the upstream, disables upstream keepalives",
+		},
+		cli.BoolFlag{
+			Name:  "enable-grpc-web",
+			Usage: "translate the grpc-web requests of the browsers to grpc, the upstream must speak http/2 i.e. h2c or tls",
 		},
 		cli.BoolFlag{
 			Name:  "enable-forwarding",
 			Usage: "enables the forwarding proxy mode, signing outbound request",
 		},
+		cli.StringFlag{
+			Name:  "forwarding-grant-type",
+			Usage: "the grant the access token is requested by, either password or client_credentials",
+			Value: defaults.ForwardingGrantType,
+		},
 		cli.StringFlag{
 			Name:  "forwarding-username",
 			Usage: "the username to use when logging into the openid provider",
@@ -492,17 +2220,43 @@ func getOptions() []cli.Flag {
 			Name:  "tls-private-key",
 			Usage: "the path to the private key for TLS support",
 		},
+		cli.StringSliceFlag{
+			Name:  "tls-certificate-pair",
+			Usage: "keypair of a additional certificate and private key e.g. site.pem=site-key.pem, selected by the server name in the certificate",
+		},
+		cli.BoolFlag{
+			Name:  "enable-ocsp-stapling",
+			Usage: "fetch and staple the ocsp responses for the tls certificates, refreshed in the background",
+		},
 		cli.StringFlag{
 			Name:  "tls-ca-certificate",
 			Usage: "the path to the ca certificate used for mutual TLS",
 		},
+		cli.StringFlag{
+			Name:  "tls-client-crl",
+			Usage: "the path to the pem encoded certificate revocation lists the mutual TLS client certificates are checked against",
+		},
+		cli.BoolFlag{
+			Name:  "enable-tls-client-ocsp",
+			Usage: "check the mutual TLS client certificates with the ocsp responder in the certificate",
+		},
+		cli.StringFlag{
+			Name:  "tls-revocation-failure-mode",
+			Usage: "when the revocation status of a client certificate can't be determined either permit (open) or reject (closed) it",
+			Value: defaults.TLSRevocationFailureMode,
+		},
+		cli.StringFlag{
+			Name:   "spiffe-endpoint-socket",
+			Usage:  "the spiffe workload api socket the client certificate for the upstream and idp is retrieved and rotated from, e.g. unix:///run/spire/sockets/agent.sock",
+			EnvVar: "SPIFFE_ENDPOINT_SOCKET",
+		},
 		cli.StringFlag{
 			Name:  "tls-client-certificate",
 			Usage: "the path to the client certificate, used to outbound connections in reverse and forwarding proxy modes",
 		},
-		cli.BoolTFlag{
+		cli.BoolFlag{
 			Name:  "skip-upstream-tls-verify",
-			Usage: "whether to skip the verification of any upstream TLS (defaults to true)",
+			Usage: "explicitly skip the verification of the upstream TLS, the upstream-tls settings take precedence",
 		},
 		cli.StringSliceFlag{
 			Name:  "match-claims",
@@ -516,6 +2270,10 @@ func getOptions() []cli.Flag {
 			Name:  "resource",
 			Usage: "a list of resources 'uri=/admin|methods=GET|roles=role1,role2'",
 		},
+		cli.StringFlag{
+			Name:  "openapi-spec",
+			Usage: "the path to a openapi spec the resources are generated from, after any resources configured",
+		},
 		cli.StringSliceFlag{
 			Name:  "headers",
 			Usage: "Add custom headers to the upstream request, key=value",
@@ -560,6 +2318,142 @@ func getOptions() []cli.Flag {
 			Name:  "enable-security-filter",
 			Usage: "enables the security filter handler",
 		},
+		cli.StringSliceFlag{
+			Name:  "security-filter-allowed-hosts",
+			Usage: "the host names permitted by the security filter, exactly, any if empty",
+		},
+		cli.BoolFlag{
+			Name:  "security-filter-ssl-redirect",
+			Usage: "redirect the http requests to https in the security filter",
+		},
+		cli.StringFlag{
+			Name:  "security-filter-ssl-host",
+			Usage: "the host the http requests are redirected to, defaults to the same host",
+		},
+		cli.StringSliceFlag{
+			Name:  "security-filter-ssl-proxy-headers",
+			Usage: "the headers indicating the request was https behind a load balancer i.e. X-Forwarded-Proto=https",
+		},
+		cli.Int64Flag{
+			Name:  "security-filter-sts-seconds",
+			Usage: "the max-age of the strict transport security header, zero omits the header",
+		},
+		cli.BoolFlag{
+			Name:  "security-filter-development",
+			Usage: "skip the allowed hosts, ssl redirect and sts header of the security filter, for testing over http",
+		},
+		cli.BoolTFlag{
+			Name:  "enable-cache-headers",
+			Usage: "marks the authenticated responses as private and varying by the cookie and authorization headers (defaults true)",
+		},
+		cli.StringFlag{
+			Name:  "cache-control",
+			Usage: "the cache control applied to the authenticated responses, unless upstream is already private or no-store",
+			Value: defaults.CacheControl,
+		},
+		cli.StringFlag{
+			Name:   "signed-url-key",
+			Usage:  "the key used to sign the urls of the resources permitting signed urls",
+			EnvVar: "PROXY_SIGNED_URL_KEY",
+		},
+		cli.DurationFlag{
+			Name:  "signed-url-duration",
+			Usage: "the maximum duration a signed url is valid for, the expiration being rounded down to a quarter of this",
+			Value: defaults.SignedURLDuration,
+		},
+		cli.BoolFlag{
+			Name:  "enable-discovery-proxy",
+			Usage: "serve the discovery document and keys of the provider on /oauth/.well-known, so the clients only need to reach the proxy",
+		},
+		cli.StringSliceFlag{
+			Name:  "token-passthrough-clients",
+			Usage: "the client ids whose token requests are passed through to the provider on /oauth/provider/token",
+		},
+		cli.IntFlag{
+			Name:  "token-passthrough-rate-limit",
+			Usage: "the maximum number of token requests passed through per client per minute",
+			Value: defaults.TokenPassthroughRateLimit,
+		},
+		cli.BoolFlag{
+			Name:  "enable-idp-grace",
+			Usage: "permit the unexpired tokens verified with the last known keys while the identity provider is unreachable",
+		},
+		cli.DurationFlag{
+			Name:  "idp-grace-period",
+			Usage: "the maximum time since the keys were last retrieved from the identity provider the grace applies",
+			Value: defaults.IdPGracePeriod,
+		},
+		cli.BoolTFlag{
+			Name:  "enable-jwks-cache",
+			Usage: "cache the signing keys of the identity provider, retrieving them again when a token is signed by a unknown key",
+		},
+		cli.DurationFlag{
+			Name:  "jwks-min-refresh-interval",
+			Usage: "the minimum interval between the retrievals of the signing keys on a unknown key id",
+			Value: defaults.JWKSMinRefreshInterval,
+		},
+		cli.DurationFlag{
+			Name:  "jwks-refresh-interval",
+			Usage: "the interval the signing keys are retrieved in the background, disabled if zero",
+			Value: defaults.JWKSRefreshInterval,
+		},
+		cli.StringFlag{
+			Name:   "break-glass-key",
+			Usage:  "the key used to sign the break glass tokens, permitting emergency read only access to the opted in resources",
+			EnvVar: "PROXY_BREAK_GLASS_KEY",
+		},
+		cli.DurationFlag{
+			Name:  "break-glass-max-duration",
+			Usage: "the maximum lifetime of a break glass token",
+			Value: defaults.BreakGlassMaxDuration,
+		},
+		cli.IntFlag{
+			Name:  "break-glass-rate-limit",
+			Usage: "the maximum number of break glass requests per minute, across all the tokens",
+			Value: defaults.BreakGlassRateLimit,
+		},
+		cli.StringFlag{
+			Name:  "spnego-keytab",
+			Usage: "the keytab of the service, enabling the kerberos negotiation on the resources with spnego",
+		},
+		cli.StringSliceFlag{
+			Name:  "spnego-roles",
+			Usage: "keypair values mapping the kerberos principals or realms to roles, e.g. @EXAMPLE.COM=staff, jsmith@EXAMPLE.COM=admin,staff",
+		},
+		cli.StringFlag{
+			Name:  "saml-idp-metadata-url",
+			Usage: "the url or file of the saml metadata of the identity provider, running as a saml service provider in place of openid",
+		},
+		cli.StringFlag{
+			Name:  "saml-roles-attribute",
+			Usage: "the attribute of the saml assertion holding the roles of the user",
+			Value: defaults.SAMLRolesAttribute,
+		},
+		cli.DurationFlag{
+			Name:  "saml-session-duration",
+			Usage: "the duration of the saml session when the assertion has no session expiry",
+			Value: defaults.SAMLSessionDuration,
+		},
+		cli.StringFlag{
+			Name:  "edge-authentication",
+			Usage: "consume the identity asserted by the edge in place of the login, aws-alb (x-amzn-oidc-data) or cloudflare-access (cf-access-jwt-assertion)",
+		},
+		cli.StringFlag{
+			Name:  "edge-alb-arn",
+			Usage: "the arn of the load balancer signing the x-amzn-oidc-data",
+		},
+		cli.StringFlag{
+			Name:  "edge-cloudflare-team-domain",
+			Usage: "the team domain of cloudflare access, i.e. <team>.cloudflareaccess.com, the issuer of the jwt",
+		},
+		cli.StringFlag{
+			Name:  "edge-audience",
+			Usage: "the audience (application aud tag) of the cloudflare access jwt",
+		},
+		cli.StringFlag{
+			Name:  "edge-keys-url",
+			Usage: "override the url of the signing keys of the edge, derived from the region of the arn or the team domain",
+		},
 		cli.BoolFlag{
 			Name:  "skip-token-verification",
 			Usage: "TESTING ONLY; bypass token verification, only expiration and roles enforced",
@@ -572,9 +2466,41 @@ func getOptions() []cli.Flag {
 			Name:  "log-requests",
 			Usage: "switch on logging of all incoming requests (defaults true)",
 		},
+		cli.StringFlag{
+			Name:  "listen-admin",
+			Usage: "the interface for the admin api (log level and request capture), disabled if not set",
+		},
+		cli.StringFlag{
+			Name:  "admin-token",
+			Usage: "a bearer token required to call the admin api, required with the listen-admin",
+		},
+		cli.StringFlag{
+			Name:  "ext-authz-listen",
+			Usage: "the interface of the envoy external authorization (ext_authz) grpc service, disabled if not set",
+		},
+		cli.StringSliceFlag{
+			Name:  "log-redact-query-params",
+			Usage: "query parameters whose values are redacted in the request log, in addition to the tokens and codes",
+		},
+		cli.StringSliceFlag{
+			Name:  "log-request-headers",
+			Usage: "request headers to include in the request log, any credentials are redacted",
+		},
+		cli.StringSliceFlag{
+			Name:  "log-sample-rate",
+			Usage: "keypair of path prefix and the fraction of requests logged e.g. /health=0.01, server errors are always logged",
+		},
+		cli.BoolFlag{
+			Name:  "log-metadata",
+			Usage: "add the hostname, pod, namespace, node and availability zone to the logs and audit events",
+		},
+		cli.BoolFlag{
+			Name:  "log-metadata-service",
+			Usage: "query the ecs and ec2 metadata services for the task and availability zone, requires --log-metadata",
+		},
 		cli.BoolFlag{
 			Name:  "verbose",
 			Usage: "switch on debug / verbose logging",
 		},
-	}
+	})
 }
@@ -0,0 +1,286 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// configReloadDrainPeriod is the time the requests in flight have to complete before a replaced configuration is
+	// stopped and its store closed
+	configReloadDrainPeriod = time.Duration(1) * time.Minute
+	// configRedacted replaces the values of the secrets in the changes of the configuration
+	configRedacted = "[redacted]"
+	// configRedactedPassword replaces the passwords of the urls in the changes of the configuration
+	configRedactedPassword = "xxxxx"
+)
+
+// configRestartOptions are the options bound to the listeners, the changes are only applied on a restart
+var configRestartOptions = []string{
+	"listen", "listen-admin", "admin-token", "ext-authz-listen", "enabled-proxy-protocol", "diagnostics-signal",
+	"enable-config-reload", "tls-cert", "tls-private-key", "tls-certificates", "tls-ca-certificate", "tls-client-crl",
+	"enable-tls-client-ocsp", "tls-revocation-failure-mode", "enable-ocsp-stapling",
+	"log-metadata", "log-metadata-service",
+}
+
+//
+// configChange is the change of a option of the configuration
+//
+type configChange struct {
+	From interface{} `json:"from"`
+	To   interface{} `json:"to"`
+}
+
+//
+// configReloader reloads the configuration on a signal, the reloaded configuration is served by the listeners of the
+// proxy; a configuration which can't be read, is invalid or fails to create is refused, the proxy serving the
+// previous configuration
+//
+type configReloader struct {
+	sync.Mutex
+	// the proxy started with the configuration, whose listeners serve the reloaded configurations
+	proxy *oauthProxy
+	// the proxy of the configuration being served
+	current *oauthProxy
+	// reads the configuration afresh, i.e. the configuration file and the options
+	read func() (*Config, error)
+	// the reloads refused, by the reason
+	failures *prometheus.CounterVec
+}
+
+//
+// newConfigReloader creates the reloading of the configuration of the proxy
+//
+func newConfigReloader(proxy *oauthProxy, read func() (*Config, error)) *configReloader {
+	return &configReloader{
+		proxy:   proxy,
+		current: proxy,
+		read:    read,
+		failures: prometheus.MustRegisterOrGet(prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "config_reload_failures_total",
+				Help: "The reloads of the configuration refused, the proxy serving the previous configuration",
+			},
+			[]string{"reason"},
+		)).(*prometheus.CounterVec),
+	}
+}
+
+//
+// handleSignal reloads the configuration whenever the signal is received
+//
+func (r *configReloader) handleSignal(sig os.Signal) {
+	log.Infof("the configuration will be reloaded on %s", sig)
+
+	signalChannel := make(chan os.Signal, 1)
+	signal.Notify(signalChannel, sig)
+	go func() {
+		for range signalChannel {
+			r.reload()
+		}
+	}()
+}
+
+//
+// reload reads, validates and creates the proxy of the configuration, switching the listeners over to it; on any
+// failure the previous configuration is kept and the changes which would have been made logged
+//
+func (r *configReloader) reload() error {
+	r.Lock()
+	defer r.Unlock()
+
+	config, err := r.read()
+	if err != nil {
+		return r.refuse("read", nil, err)
+	}
+	err = config.isValid()
+	changes := getConfigChanges(r.current.config, config)
+	if err != nil {
+		return r.refuse("invalid", changes, err)
+	}
+	if len(changes) <= 0 {
+		log.Infof("the configuration is unchanged, nothing to reload")
+		return nil
+	}
+
+	next, err := createProxy(config, r.current)
+	if err != nil {
+		return r.refuse("create", changes, err)
+	}
+	previous := r.current
+	r.current = next
+	r.proxy.reloaded.Store(next.router)
+
+	log.WithFields(log.Fields{
+		"changed": getConfigChangeNames(changes),
+		"changes": changes,
+	}).Infof("the configuration has been reloaded")
+
+	var restart []string
+	for _, x := range configRestartOptions {
+		if _, found := changes[x]; found {
+			restart = append(restart, x)
+		}
+	}
+	if len(restart) > 0 {
+		log.WithFields(log.Fields{
+			"options": restart,
+		}).Warnf("the options bound to the listeners are only applied on a restart")
+	}
+
+	// step: stop the replaced configuration once the requests in flight are done, closing the store unless still shared
+	time.AfterFunc(configReloadDrainPeriod, func() {
+		previous.Stop()
+		if previous.store != nil && previous.store != next.store && previous.store != r.proxy.store {
+			previous.CloseStore()
+		}
+	})
+
+	return nil
+}
+
+//
+// refuse records the refusal of the reload, logging the changes which would have been made
+//
+func (r *configReloader) refuse(reason string, changes map[string]configChange, err error) error {
+	r.failures.WithLabelValues(reason).Inc()
+
+	log.WithFields(log.Fields{
+		"reason":  reason,
+		"error":   err.Error(),
+		"changed": getConfigChangeNames(changes),
+		"changes": changes,
+	}).Errorf("the configuration reload has been refused, serving the previous configuration")
+
+	return err
+}
+
+//
+// getConfigChanges returns the options which differ between the configurations, keyed by the option, the values
+// of the secrets and the credentials of the urls being redacted
+//
+func getConfigChanges(previous, next *Config) map[string]configChange {
+	from, to := getConfigOptions(previous), getConfigOptions(next)
+	changes := make(map[string]configChange)
+	for name, value := range to {
+		if !reflect.DeepEqual(from[name], value) {
+			changes[name] = configChange{From: redactConfigOption(name, from[name]), To: redactConfigOption(name, value)}
+		}
+	}
+	for name, value := range from {
+		if _, found := to[name]; !found {
+			changes[name] = configChange{From: redactConfigOption(name, value)}
+		}
+	}
+
+	return changes
+}
+
+//
+// getConfigOptions returns the options of the configuration, keyed by the option
+//
+func getConfigOptions(config *Config) map[string]interface{} {
+	options := make(map[string]interface{})
+	encoded, err := json.Marshal(config)
+	if err != nil {
+		return options
+	}
+	json.Unmarshal(encoded, &options)
+
+	return options
+}
+
+//
+// getConfigChangeNames returns the sorted options changed
+//
+func getConfigChangeNames(changes map[string]configChange) []string {
+	names := make([]string, 0, len(changes))
+	for name := range changes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+//
+// redactConfigOption redacts the values of the secrets, or the passwords of the urls, within the option
+//
+func redactConfigOption(name string, value interface{}) interface{} {
+	if value == nil {
+		return nil
+	}
+	name = strings.ToLower(name)
+	if strings.Contains(name, "secret") || strings.Contains(name, "password") || strings.Contains(name, "authorization") ||
+		strings.HasSuffix(name, "key") || strings.HasSuffix(name, "token") {
+		return configRedacted
+	}
+	switch v := value.(type) {
+	case map[string]interface{}:
+		redacted := make(map[string]interface{}, len(v))
+		for k, x := range v {
+			redacted[k] = redactConfigOption(k, x)
+		}
+		return redacted
+	case []interface{}:
+		redacted := make([]interface{}, len(v))
+		for i, x := range v {
+			redacted[i] = redactConfigOption(name, x)
+		}
+		return redacted
+	case string:
+		if location, err := url.Parse(v); err == nil && location.User != nil {
+			if _, found := location.User.Password(); found {
+				location.User = url.UserPassword(location.User.Username(), configRedactedPassword)
+			}
+			return location.String()
+		}
+	}
+
+	return value
+}
+
+//
+// getRouter returns the router of the reloaded configuration, else the router
+//
+func (r *oauthProxy) getRouter() *gin.Engine {
+	if router, ok := r.reloaded.Load().(*gin.Engine); ok {
+		return router
+	}
+
+	return r.router
+}
+
+//
+// serveRouter serves the request by the router of the current configuration
+//
+func (r *oauthProxy) serveRouter(w http.ResponseWriter, req *http.Request) {
+	r.getRouter().ServeHTTP(w, req)
+}
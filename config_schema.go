@@ -0,0 +1,167 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+const (
+	// configSchemaVersion is the json schema draft the schema is written to
+	configSchemaVersion = "http://json-schema.org/draft-07/schema#"
+	// durationPattern matches the durations accepted in the configuration, e.g. 1h30m
+	durationPattern = `^(0|([0-9]+(\.[0-9]+)?(ns|us|µs|ms|s|m|h))+)$`
+)
+
+//
+// newConfigCommand creates the commands for working with the configuration file
+//
+func newConfigCommand() cli.Command {
+	return cli.Command{
+		Name:  "config",
+		Usage: "helpers for working with the configuration file",
+		Subcommands: []cli.Command{
+			{
+				Name:      "schema",
+				Usage:     "prints a json schema for the configuration file, i.e. to validate the configuration before deployment",
+				UsageText: "keycloak-proxy config schema",
+				Action: func(cx *cli.Context) error {
+					encoder := json.NewEncoder(cx.App.Writer)
+					encoder.SetEscapeHTML(false)
+					encoder.SetIndent("", "  ")
+					if err := encoder.Encode(getConfigSchema()); err != nil {
+						return printError(err.Error())
+					}
+
+					return nil
+				},
+			},
+		},
+	}
+}
+
+//
+// getConfigSchema generates the json schema of the configuration from the config struct, with the defaults and the
+// descriptions of the options of the same name
+//
+func getConfigSchema() map[string]interface{} {
+	descriptions := make(map[string]string)
+	for _, x := range getFlagSpecs(getOptions()) {
+		descriptions[x.Name] = x.Usage
+	}
+	schema := getTypeSchema(reflect.TypeOf(Config{}), reflect.ValueOf(*newDefaultConfig()), descriptions)
+	schema["$schema"] = configSchemaVersion
+	schema["title"] = "keycloak-proxy configuration"
+
+	return schema
+}
+
+//
+// getTypeSchema generates the schema of the type; the defaults are taken from the value when valid and the
+// descriptions of the fields from the map
+//
+func getTypeSchema(t reflect.Type, defaults reflect.Value, descriptions map[string]string) map[string]interface{} {
+	if t == reflect.TypeOf(time.Duration(0)) {
+		return map[string]interface{}{
+			"type":    []string{"string", "integer"},
+			"pattern": durationPattern,
+		}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		if defaults.IsValid() && !defaults.IsNil() {
+			return getTypeSchema(t.Elem(), defaults.Elem(), nil)
+		}
+		return getTypeSchema(t.Elem(), reflect.Value{}, nil)
+	case reflect.Struct:
+		properties := make(map[string]interface{})
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			name := strings.Split(field.Tag.Get("yaml"), ",")[0]
+			if field.PkgPath != "" || name == "" || name == "-" {
+				continue
+			}
+			var value reflect.Value
+			if defaults.IsValid() {
+				value = defaults.Field(i)
+			}
+			property := getTypeSchema(field.Type, value, nil)
+			if description, found := descriptions[name]; found {
+				property["description"] = description
+			}
+			if value.IsValid() && field.Type.Kind() != reflect.Struct {
+				if x := getSchemaDefault(value); x != nil {
+					property["default"] = x
+				}
+			}
+			properties[name] = property
+		}
+
+		return map[string]interface{}{
+			"type":                 "object",
+			"properties":           properties,
+			"additionalProperties": false,
+		}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{
+			"type":  "array",
+			"items": getTypeSchema(t.Elem(), reflect.Value{}, nil),
+		}
+	case reflect.Map:
+		return map[string]interface{}{
+			"type":                 "object",
+			"additionalProperties": getTypeSchema(t.Elem(), reflect.Value{}, nil),
+		}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	}
+
+	return map[string]interface{}{}
+}
+
+//
+// getSchemaDefault returns the default of a field, or nil when the field is unset
+//
+func getSchemaDefault(value reflect.Value) interface{} {
+	switch value.Kind() {
+	case reflect.Ptr, reflect.Slice, reflect.Map:
+		if value.IsNil() || (value.Kind() != reflect.Ptr && value.Len() <= 0) {
+			return nil
+		}
+	default:
+		if value.Interface() == reflect.Zero(value.Type()).Interface() {
+			return nil
+		}
+	}
+	if x, ok := value.Interface().(time.Duration); ok {
+		return x.String()
+	}
+
+	return value.Interface()
+}
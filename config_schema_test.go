@@ -0,0 +1,86 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v2"
+)
+
+func TestConfigSchema(t *testing.T) {
+	output := &bytes.Buffer{}
+	app := newOauthProxyApp()
+	app.Writer = output
+	if !assert.NoError(t, app.Run([]string{"", "config", "schema"})) {
+		t.FailNow()
+	}
+	schema := make(map[string]interface{})
+	if !assert.NoError(t, json.Unmarshal(output.Bytes(), &schema)) {
+		t.FailNow()
+	}
+	assert.Equal(t, configSchemaVersion, schema["$schema"])
+	assert.Equal(t, false, schema["additionalProperties"])
+
+	properties := schema["properties"].(map[string]interface{})
+	listen := properties["listen"].(map[string]interface{})
+	assert.Equal(t, "string", listen["type"])
+	assert.Equal(t, "127.0.0.1:3000", listen["default"])
+	assert.Equal(t, "the interface the service should be listening on", listen["description"])
+
+	timeout := properties["upstream-timeout"].(map[string]interface{})
+	assert.Equal(t, []interface{}{"string", "integer"}, timeout["type"])
+	assert.Equal(t, "10s", timeout["default"])
+
+	resources := properties["resources"].(map[string]interface{})
+	assert.Equal(t, "array", resources["type"])
+	resource := resources["items"].(map[string]interface{})["properties"].(map[string]interface{})
+	assert.Contains(t, resource, "white-listed")
+	assert.Contains(t, resource, "cors")
+
+	headers := properties["headers"].(map[string]interface{})
+	assert.Equal(t, map[string]interface{}{"type": "string"}, headers["additionalProperties"])
+}
+
+func TestConfigSchemaSample(t *testing.T) {
+	content, err := ioutil.ReadFile("config_sample.yml")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	sample := make(map[string]interface{})
+	if !assert.NoError(t, yaml.Unmarshal(content, &sample)) {
+		t.FailNow()
+	}
+	properties := getConfigSchema()["properties"].(map[string]interface{})
+	for k := range sample {
+		assert.Contains(t, properties, k, "the sample option %s is not in the schema", k)
+	}
+}
+
+func TestDurationPattern(t *testing.T) {
+	pattern := regexp.MustCompile(durationPattern)
+	for _, x := range []string{"0", "10s", "1h30m", "1.5h", "250ms"} {
+		assert.True(t, pattern.MatchString(x), "%s should match", x)
+	}
+	for _, x := range []string{"", "10", "ten seconds", "1d"} {
+		assert.False(t, pattern.MatchString(x), "%s should not match", x)
+	}
+}
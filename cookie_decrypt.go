@@ -0,0 +1,150 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/coreos/go-oidc/jose"
+	"github.com/urfave/cli"
+)
+
+//
+// newCookieCommand creates the command to inspect the encrypted cookies
+//
+func newCookieCommand(config *Config) cli.Command {
+	return cli.Command{
+		Name:  "cookie",
+		Usage: "helpers for inspecting the encrypted session cookies",
+		Subcommands: []cli.Command{
+			{
+				Name:      "decrypt",
+				Usage:     "decrypts a refresh token or session binding cookie, or a refresh token from the store",
+				UsageText: "keycloak-proxy cookie decrypt --encryption-key KEY --value VALUE, or the value on stdin",
+				Flags: append(getOptions(),
+					cli.StringFlag{
+						Name:  "value",
+						Usage: "the encrypted cookie value, if not given the value is read from stdin",
+					},
+				),
+				Action: func(cx *cli.Context) error {
+					if err := parseConfig(cx, config); err != nil {
+						return printError(err.Error())
+					}
+					if config.EncryptionKey == "" {
+						return printError("no encryption key given, use --encryption-key or the configuration file")
+					}
+					value := cx.String("value")
+					if value == "" {
+						content, err := ioutil.ReadAll(os.Stdin)
+						if err != nil {
+							return printError("unable to read the value from stdin, error: %s", err)
+						}
+						value = string(content)
+					}
+					if strings.TrimSpace(value) == "" {
+						return printError("no value given, use --value or pass the value on stdin")
+					}
+					fmt.Fprintf(os.Stderr, "[warning] the decrypted value contains credentials for the user, do not share or store it\n")
+
+					return decryptCookie(cx.App.Writer, config.EncryptionKey, strings.TrimSpace(value))
+				},
+			},
+		},
+	}
+}
+
+//
+// decryptCookie decrypts the value and writes the payload, decoding the refresh token or session binding
+//
+func decryptCookie(w io.Writer, key, value string) error {
+	// step: the value may have been copied url encoded
+	if strings.Contains(value, "%") {
+		if unescaped, err := url.QueryUnescape(value); err == nil {
+			value = unescaped
+		}
+	}
+	// step: the cipher is unauthenticated, so a wrong key is only evident from the garbage it produces
+	plaintext, err := decodeText(value, key)
+	if err != nil || !isPrintable(plaintext) {
+		return printError("unable to decrypt the value, the encryption key is wrong or the value is corrupt")
+	}
+
+	// step: is the payload a refresh token?
+	if token, err := jose.ParseJWT(plaintext); err == nil {
+		claims, err := token.Claims()
+		if err != nil {
+			return printError("unable to decode the refresh token claims, error: %s", err)
+		}
+		content, err := json.MarshalIndent(claims, "", "  ")
+		if err != nil {
+			return printError("unable to encode the claims, error: %s", err)
+		}
+		expires := "never"
+		if exp, found, err := claims.TimeClaim("exp"); err == nil && found {
+			expires = exp.Format(time.RFC3339)
+			if exp.Before(time.Now()) {
+				expires += " (expired)"
+			}
+		}
+		fmt.Fprintf(w, "type:    refresh token\n")
+		fmt.Fprintf(w, "expires: %s\n", expires)
+		fmt.Fprintf(w, "token:   %s\n", plaintext)
+		fmt.Fprintf(w, "\nclaims:\n%s\n", content)
+
+		return nil
+	}
+
+	// step: is the payload a session binding, i.e. subject|network|user agent hash
+	if items := strings.Split(plaintext, "|"); len(items) == 3 {
+		fmt.Fprintf(w, "type:            session binding\n")
+		fmt.Fprintf(w, "subject:         %s\n", items[0])
+		fmt.Fprintf(w, "network:         %s\n", items[1])
+		fmt.Fprintf(w, "user agent hash: %s\n", items[2])
+
+		return nil
+	}
+
+	fmt.Fprintf(w, "type:    unknown\n")
+	fmt.Fprintf(w, "payload: %s\n", plaintext)
+
+	return nil
+}
+
+//
+// isPrintable checks the value is valid utf8 without any control characters
+//
+func isPrintable(value string) bool {
+	if !utf8.ValidString(value) {
+		return false
+	}
+	for _, x := range value {
+		if !unicode.IsPrint(x) {
+			return false
+		}
+	}
+
+	return true
+}
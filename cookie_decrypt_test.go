@@ -0,0 +1,64 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"net/url"
+	"testing"
+
+	"github.com/coreos/go-oidc/jose"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecryptCookie(t *testing.T) {
+	key := "AgXa7xRcoClDEU0ZDSH4X0XhL5Qy2Z2j"
+	auth := newFakeOAuthServer()
+	token, err := jose.NewSignedJWT(auth.claims, auth.signer)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	refresh, _ := encodeText(token.Encode(), key)
+	binding, _ := encodeText("1e11e539|10.0.0.1/32|", key)
+	other, _ := encodeText("plain", key)
+
+	cases := []struct {
+		Key    string
+		Value  string
+		Error  bool
+		Report []string
+	}{
+		{Key: key, Value: refresh, Report: []string{"type:    refresh token", "token:   " + token.Encode(), "\"sub\": \"1e11e539-8256-4b3b-bda8-cc0d56cddb48\""}},
+		{Key: key, Value: url.QueryEscape(refresh), Report: []string{"type:    refresh token"}},
+		{Key: key, Value: binding, Report: []string{"type:            session binding", "subject:         1e11e539", "network:         10.0.0.1/32"}},
+		{Key: key, Value: other, Report: []string{"type:    unknown", "payload: plain"}},
+		{Key: "BgXa7xRcoClDEU0ZDSH4X0XhL5Qy2Z2j", Value: refresh, Error: true},
+		{Key: key, Value: "not_base64!", Error: true},
+	}
+	for i, c := range cases {
+		report := &bytes.Buffer{}
+		err := decryptCookie(report, c.Key, c.Value)
+		if c.Error && err == nil {
+			t.Errorf("case %d should have failed", i)
+		}
+		if !c.Error && err != nil {
+			t.Errorf("case %d should not have failed, error: %s", i, err)
+		}
+		for _, x := range c.Report {
+			assert.Contains(t, report.String(), x, "case %d, report: %s", i, report)
+		}
+	}
+}
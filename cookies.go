@@ -17,9 +17,11 @@ package main
 
 import (
 	"net/http"
+	"path"
 	"strings"
 	"time"
 
+	log "github.com/Sirupsen/logrus"
 	"github.com/gin-gonic/gin"
 )
 
@@ -27,14 +29,9 @@ import (
 // dropCookie drops a cookie into the response
 //
 func (r *oauthProxy) dropCookie(cx *gin.Context, name, value string, duration time.Duration) {
-	// step: default to the host header, else the config domain
-	domain := strings.Split(cx.Request.Host, ":")[0]
-	if r.config.CookieDomain != "" {
-		domain = r.config.CookieDomain
-	}
 	cookie := &http.Cookie{
 		Name:   name,
-		Domain: domain,
+		Domain: r.getCookieDomain(cx.Request),
 		Path:   "/",
 		Secure: r.config.SecureCookie,
 		Value:  value,
@@ -46,6 +43,70 @@ func (r *oauthProxy) dropCookie(cx *gin.Context, name, value string, duration ti
 	http.SetCookie(cx.Writer, cookie)
 }
 
+//
+// getCookieDomain returns the domain for the cookies; defaulting to the host header, else the config domain with the
+// placeholders expanded from the host, which must be a permitted domain
+//
+func (r *oauthProxy) getCookieDomain(req *http.Request) string {
+	host := strings.ToLower(strings.Split(req.Host, ":")[0])
+	if r.config.CookieDomain == "" {
+		return host
+	}
+	if !hasCookieDomainPlaceholders(r.config.CookieDomain) {
+		return r.config.CookieDomain
+	}
+
+	domain := expandCookieDomain(r.config.CookieDomain, host)
+	if !isPermittedCookieDomain(domain, host, r.config.PermittedCookieDomains) {
+		log.WithFields(log.Fields{
+			"domain": domain,
+			"host":   host,
+		}).Warnf("the cookie domain is not permitted, defaulting to the host")
+
+		return host
+	}
+
+	return domain
+}
+
+//
+// hasCookieDomainPlaceholders checks if the cookie domain is templated from the host
+//
+func hasCookieDomainPlaceholders(domain string) bool {
+	return strings.Contains(domain, "{")
+}
+
+//
+// expandCookieDomain expands the placeholders in the cookie domain; {host} is the host, {parent} is the host without
+// the first label and {domain} is the last two labels of the host, e.g. for a.b.example.com, b.example.com and
+// example.com
+//
+func expandCookieDomain(domain, host string) string {
+	parent, registrable := host, host
+	if labels := strings.Split(host, "."); len(labels) > 2 {
+		parent = strings.Join(labels[1:], ".")
+		registrable = strings.Join(labels[len(labels)-2:], ".")
+	}
+
+	return strings.NewReplacer("{host}", host, "{parent}", parent, "{domain}", registrable).Replace(domain)
+}
+
+//
+// isPermittedCookieDomain checks the domain covers the host and matches one of the permitted domains, e.g. *.example.com
+//
+func isPermittedCookieDomain(domain, host string, permitted []string) bool {
+	if domain != host && !strings.HasSuffix(host, "."+domain) {
+		return false
+	}
+	for _, x := range permitted {
+		if matched, _ := path.Match(x, domain); matched {
+			return true
+		}
+	}
+
+	return false
+}
+
 //
 // dropAccessTokenCookie drops a access token cookie into the response
 //
@@ -66,6 +127,18 @@ func (r *oauthProxy) dropRefreshTokenCookie(cx *gin.Context, value string, durat
 func (r *oauthProxy) clearAllCookies(cx *gin.Context) {
 	r.clearAccessTokenCookie(cx)
 	r.clearRefreshTokenCookie(cx)
+	if r.useSessionBinding() {
+		r.clearSessionBindingCookie(cx)
+	}
+	if r.kerberos != nil {
+		r.clearKerberosCookie(cx)
+	}
+	if r.saml != nil {
+		r.clearSAMLCookie(cx)
+	}
+	if r.endSession != "" {
+		r.clearIDTokenCookie(cx)
+	}
 }
 
 //
@@ -81,3 +154,10 @@ func (r *oauthProxy) clearRefreshTokenCookie(cx *gin.Context) {
 func (r *oauthProxy) clearAccessTokenCookie(cx *gin.Context) {
 	r.dropCookie(cx, r.config.CookieAccessName, "", time.Duration(-10*time.Hour))
 }
+
+//
+// clearSessionBindingCookie clears the session binding cookie
+//
+func (r *oauthProxy) clearSessionBindingCookie(cx *gin.Context) {
+	r.dropCookie(cx, r.config.CookieBindingName, "", time.Duration(-10*time.Hour))
+}
@@ -16,6 +16,7 @@ limitations under the License.
 package main
 
 import (
+	"net/http"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -54,6 +55,30 @@ func TestDropCookie(t *testing.T) {
 		"we have not set the cookie, headers: %v", context.Writer.Header())
 }
 
+func TestGetCookieDomain(t *testing.T) {
+	cases := []struct {
+		Domain    string
+		Permitted []string
+		Host      string
+		Expected  string
+	}{
+		{Host: "tenant.apps.example.com:443", Expected: "tenant.apps.example.com"},
+		{Domain: "example.com", Host: "tenant.apps.example.com", Expected: "example.com"},
+		{Domain: "{host}", Permitted: []string{"*.apps.example.com"}, Host: "Tenant.apps.example.com", Expected: "tenant.apps.example.com"},
+		{Domain: "{parent}", Permitted: []string{"apps.example.com"}, Host: "tenant.apps.example.com", Expected: "apps.example.com"},
+		{Domain: "{domain}", Permitted: []string{"example.com"}, Host: "tenant.apps.example.com", Expected: "example.com"},
+		{Domain: "{domain}", Permitted: []string{"example.com"}, Host: "tenant.example.co.uk", Expected: "tenant.example.co.uk"},
+		{Domain: "{parent}", Permitted: []string{"*.example.com"}, Host: "example.com", Expected: "example.com"},
+		{Domain: "{host}", Permitted: []string{"*.apps.example.com"}, Host: "evil.com", Expected: "evil.com"},
+		{Domain: "auth.{parent}", Permitted: []string{"*.example.com"}, Host: "tenant.example.com", Expected: "tenant.example.com"},
+	}
+	for i, c := range cases {
+		p := &oauthProxy{config: &Config{CookieDomain: c.Domain, PermittedCookieDomains: c.Permitted}}
+		request, _ := http.NewRequest("GET", "http://"+c.Host+"/", nil)
+		assert.Equal(t, c.Expected, p.getCookieDomain(request), "case %d, unexpected domain", i)
+	}
+}
+
 func TestClearAccessTokenCookie(t *testing.T) {
 	p, _, _ := newTestProxyService(nil)
 	context := newFakeGinContext("GET", "/admin")
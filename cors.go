@@ -0,0 +1,179 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	headerOrigin                     = "Origin"
+	headerAccessControlRequestMethod = "Access-Control-Request-Method"
+)
+
+//
+// corsPolicy is the cors configuration with the origin patterns compiled
+//
+type corsPolicy struct {
+	CORS
+	// any origin is permitted
+	any bool
+	// the permitted origins, exact, wildcard or regex
+	origins []*regexp.Regexp
+}
+
+//
+// newCORSPolicy compiles the origins, a origin starting with ^ is a regex, while a * in a origin matches any
+// hostname labels, e.g. https://*.example.com
+//
+func newCORSPolicy(c CORS) (*corsPolicy, error) {
+	policy := &corsPolicy{CORS: c}
+	for _, x := range c.Origins {
+		var expr string
+		switch {
+		case x == "*":
+			policy.any = true
+			continue
+		case strings.HasPrefix(x, "^"):
+			expr = x
+		default:
+			expr = "^" + strings.Replace(regexp.QuoteMeta(x), `\*`, `[a-zA-Z0-9.-]+`, -1) + "$"
+		}
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cors origin: %s, %s", x, err)
+		}
+		policy.origins = append(policy.origins, re)
+	}
+
+	return policy, nil
+}
+
+//
+// isPermitted checks the origin is permitted by the policy
+//
+func (r *corsPolicy) isPermitted(origin string) bool {
+	if r.any {
+		return true
+	}
+	for _, x := range r.origins {
+		if x.MatchString(origin) {
+			return true
+		}
+	}
+
+	return false
+}
+
+//
+// setHeaders adds the cors headers to the response, the origin is only reflected when permitted
+//
+func (r *corsPolicy) setHeaders(cx *gin.Context) {
+	header := cx.Writer.Header()
+	switch origin := cx.Request.Header.Get(headerOrigin); {
+	case origin == "":
+		if len(r.Origins) > 0 {
+			header.Set("Access-Control-Allow-Origin", strings.Join(r.Origins, ","))
+		}
+	case !r.isPermitted(origin):
+		return
+	case r.any && !r.Credentials:
+		header.Set("Access-Control-Allow-Origin", "*")
+	default:
+		header.Set("Access-Control-Allow-Origin", origin)
+		header.Add("Vary", headerOrigin)
+	}
+	if len(r.Methods) > 0 {
+		header.Set("Access-Control-Allow-Methods", strings.Join(r.Methods, ","))
+	}
+	if len(r.Headers) > 0 {
+		header.Set("Access-Control-Allow-Headers", strings.Join(r.Headers, ","))
+	}
+	if len(r.ExposedHeaders) > 0 {
+		header.Set("Access-Control-Expose-Headers", strings.Join(r.ExposedHeaders, ","))
+	}
+	if r.Credentials {
+		header.Set("Access-Control-Allow-Credentials", "true")
+	}
+	if r.MaxAge > 0 {
+		header.Set("Access-Control-Max-Age", fmt.Sprintf("%d", int(r.MaxAge.Seconds())))
+	}
+}
+
+//
+// isPreflight checks if the request is a cors preflight
+//
+func isPreflight(req *http.Request) bool {
+	return req.Method == http.MethodOptions && req.Header.Get(headerOrigin) != "" &&
+		req.Header.Get(headerAccessControlRequestMethod) != ""
+}
+
+//
+// crossOriginMiddleware adds the cors headers to the proxied resources, the resource cors taking precedence over
+// the global, and answers the preflight requests of permitted origins without requiring a token
+//
+func (r *oauthProxy) crossOriginMiddleware() gin.HandlerFunc {
+	global, err := newCORSPolicy(r.config.CrossOrigin)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err.Error()}).Errorf("unable to compile the cors policy")
+		global = &corsPolicy{}
+	}
+	policies := make(map[*Resource]*corsPolicy, 0)
+	for _, x := range r.config.getResources() {
+		if x.CORS == nil {
+			continue
+		}
+		if policies[x], err = newCORSPolicy(*x.CORS); err != nil {
+			log.WithFields(log.Fields{"error": err.Error()}).Errorf("unable to compile the cors policy for resource: %s", x.URL)
+			policies[x] = &corsPolicy{}
+		}
+	}
+
+	return func(cx *gin.Context) {
+		origin := cx.Request.Header.Get(headerOrigin)
+		if origin == "" {
+			cx.Next()
+			return
+		}
+
+		// step: find the policy for the resource, the oauth handlers use the global
+		policy := global
+		if !strings.HasPrefix(cx.Request.URL.Path, oauthURL) {
+			if resource := r.getRequestResource(cx); resource != nil && resource.CORS != nil {
+				policy = policies[resource]
+			}
+		}
+		if !policy.isPermitted(origin) {
+			cx.Next()
+			return
+		}
+		policy.setHeaders(cx)
+
+		// step: the preflight doesn't carry the credentials, so we answer it here
+		if isPreflight(cx.Request) {
+			cx.AbortWithStatus(http.StatusNoContent)
+			return
+		}
+
+		cx.Next()
+	}
+}
@@ -0,0 +1,170 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCORSPolicyIsPermitted(t *testing.T) {
+	cases := []struct {
+		Origins  []string
+		Origin   string
+		Expected bool
+	}{
+		{Origins: []string{"*"}, Origin: "https://example.com", Expected: true},
+		{Origins: []string{"https://example.com"}, Origin: "https://example.com", Expected: true},
+		{Origins: []string{"https://example.com"}, Origin: "https://example.com.evil.com"},
+		{Origins: []string{"https://example.com"}, Origin: "http://example.com"},
+		{Origins: []string{"https://*.example.com"}, Origin: "https://app.example.com", Expected: true},
+		{Origins: []string{"https://*.example.com"}, Origin: "https://a.b.example.com", Expected: true},
+		{Origins: []string{"https://*.example.com"}, Origin: "https://example.com"},
+		{Origins: []string{"https://*.example.com"}, Origin: "https://evil.com/.example.com"},
+		{Origins: []string{"https://*.example.com"}, Origin: "https://app.example.com:8443"},
+		{Origins: []string{`^https://(app|admin)\.example\.com(:\d+)?$`}, Origin: "https://admin.example.com:8443", Expected: true},
+		{Origins: []string{`^https://(app|admin)\.example\.com(:\d+)?$`}, Origin: "https://other.example.com"},
+		{Origin: "https://example.com"},
+	}
+	for i, c := range cases {
+		policy, err := newCORSPolicy(CORS{Origins: c.Origins})
+		if !assert.NoError(t, err, "case %d, unable to create the policy", i) {
+			continue
+		}
+		assert.Equal(t, c.Expected, policy.isPermitted(c.Origin), "case %d, origin: %s, expected: %t", i, c.Origin, c.Expected)
+	}
+
+	_, err := newCORSPolicy(CORS{Origins: []string{"^https://(.example.com"}})
+	assert.Error(t, err)
+}
+
+func TestCORSPolicyHeaders(t *testing.T) {
+	cases := []struct {
+		CORS     CORS
+		Origin   string
+		Expected map[string]string
+	}{
+		{
+			CORS:     CORS{Origins: []string{"*"}},
+			Origin:   "https://example.com",
+			Expected: map[string]string{"Access-Control-Allow-Origin": "*", "Vary": ""},
+		},
+		{
+			CORS:   CORS{Origins: []string{"*"}, Credentials: true},
+			Origin: "https://example.com",
+			Expected: map[string]string{
+				"Access-Control-Allow-Origin":      "https://example.com",
+				"Access-Control-Allow-Credentials": "true",
+				"Vary":                             "Origin",
+			},
+		},
+		{
+			CORS:     CORS{Origins: []string{"https://*.example.com"}, Methods: []string{"GET", "POST"}},
+			Origin:   "https://app.example.com",
+			Expected: map[string]string{"Access-Control-Allow-Origin": "https://app.example.com", "Access-Control-Allow-Methods": "GET,POST"},
+		},
+		{
+			CORS:     CORS{Origins: []string{"https://*.example.com"}, Methods: []string{"GET"}},
+			Origin:   "https://example.org",
+			Expected: map[string]string{"Access-Control-Allow-Origin": "", "Access-Control-Allow-Methods": ""},
+		},
+	}
+	for i, c := range cases {
+		policy, _ := newCORSPolicy(c.CORS)
+		cx := newFakeGinContext("GET", "/")
+		cx.Request.Header.Set(headerOrigin, c.Origin)
+		policy.setHeaders(cx)
+		for k, v := range c.Expected {
+			value := cx.Writer.Header().Get(k)
+			assert.Equal(t, v, value, "case %d, header: %s, expected: %s, got: %s", i, k, v, value)
+		}
+	}
+}
+
+func TestCrossOriginMiddleware(t *testing.T) {
+	config := newFakeKeycloakConfig()
+	config.CrossOrigin = CORS{Origins: []string{"https://*.example.com"}, Methods: []string{"GET"}}
+	config.Resources = append([]*Resource{
+		{
+			URL:     "/api",
+			Methods: []string{"ANY"},
+			CORS:    &CORS{Origins: []string{"https://partner.example.org"}, Methods: []string{"GET", "DELETE"}},
+		},
+	}, config.Resources...)
+	_, _, u := newTestProxyService(config)
+
+	cases := []struct {
+		Method    string
+		URI       string
+		Origin    string
+		Preflight bool
+		HTTPCode  int
+		Headers   map[string]string
+	}{
+		{
+			Method: "OPTIONS", URI: fakeAuthAllURL, Origin: "https://app.example.com", Preflight: true,
+			HTTPCode: http.StatusNoContent,
+			Headers:  map[string]string{"Access-Control-Allow-Origin": "https://app.example.com", "Access-Control-Allow-Methods": "GET"},
+		},
+		{
+			Method: "OPTIONS", URI: fakeAuthAllURL, Origin: "https://evil.com", Preflight: true,
+			HTTPCode: http.StatusTemporaryRedirect,
+			Headers:  map[string]string{"Access-Control-Allow-Origin": ""},
+		},
+		{
+			// not a preflight, so the token is still required
+			Method: "OPTIONS", URI: fakeAuthAllURL, Origin: "https://app.example.com",
+			HTTPCode: http.StatusTemporaryRedirect,
+		},
+		{
+			Method: "OPTIONS", URI: "/api/users", Origin: "https://partner.example.org", Preflight: true,
+			HTTPCode: http.StatusNoContent,
+			Headers:  map[string]string{"Access-Control-Allow-Origin": "https://partner.example.org", "Access-Control-Allow-Methods": "GET,DELETE"},
+		},
+		{
+			// the resource overrides the global origins
+			Method: "OPTIONS", URI: "/api/users", Origin: "https://app.example.com", Preflight: true,
+			HTTPCode: http.StatusTemporaryRedirect,
+		},
+		{
+			// note: the fake upstream doesn't write a response
+			Method: "GET", URI: fakeTestWhitelistedURL, Origin: "https://app.example.com",
+			HTTPCode: http.StatusNotFound,
+			Headers:  map[string]string{"Access-Control-Allow-Origin": "https://app.example.com", "Vary": "Origin"},
+		},
+	}
+	client := &http.Client{
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+	for i, c := range cases {
+		request, _ := http.NewRequest(c.Method, u+c.URI, nil)
+		request.Header.Set(headerOrigin, c.Origin)
+		if c.Preflight {
+			request.Header.Set(headerAccessControlRequestMethod, "GET")
+		}
+		resp, err := client.Do(request)
+		if !assert.NoError(t, err, "case %d, unable to make the request", i) {
+			continue
+		}
+		resp.Body.Close()
+		assert.Equal(t, c.HTTPCode, resp.StatusCode, "case %d, expected: %d, got: %d", i, c.HTTPCode, resp.StatusCode)
+		for k, v := range c.Headers {
+			assert.Equal(t, v, resp.Header.Get(k), "case %d, header: %s, expected: %s", i, k, v)
+		}
+	}
+}
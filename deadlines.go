@@ -0,0 +1,103 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// headerRequestDeadline is the time the proxy gives up on the request, in utc with milliseconds
+	headerRequestDeadline = "X-Request-Deadline"
+	// headerGRPCTimeout is the remaining time of a grpc request
+	headerGRPCTimeout = "Grpc-Timeout"
+	// requestDeadlineFormat is the format of the deadline header
+	requestDeadlineFormat = "2006-01-02T15:04:05.000Z07:00"
+	// grpcTimeoutMaxValue is the largest value of the grpc timeout, which is at most eight digits
+	grpcTimeoutMaxValue = 99999999
+)
+
+// grpcTimeoutUnits are the units of the grpc timeout, from the most precise
+var grpcTimeoutUnits = []struct {
+	unit time.Duration
+	name string
+}{
+	{time.Nanosecond, "n"},
+	{time.Microsecond, "u"},
+	{time.Millisecond, "m"},
+	{time.Second, "S"},
+	{time.Minute, "M"},
+	{time.Hour, "H"},
+}
+
+//
+// encodeGRPCTimeout encodes the duration as a grpc timeout, in the most precise unit which fits; the value is
+// truncated, so the upstream never waits longer than the proxy
+//
+func encodeGRPCTimeout(timeout time.Duration) string {
+	for _, x := range grpcTimeoutUnits {
+		if value := int64(timeout / x.unit); value <= grpcTimeoutMaxValue {
+			return strconv.FormatInt(value, 10) + x.name
+		}
+	}
+
+	return strconv.Itoa(grpcTimeoutMaxValue) + "H"
+}
+
+//
+// parseGRPCTimeout decodes a grpc timeout
+//
+func parseGRPCTimeout(value string) (time.Duration, bool) {
+	if len(value) < 2 || len(value) > 9 {
+		return 0, false
+	}
+	amount, err := strconv.ParseInt(value[:len(value)-1], 10, 64)
+	if err != nil || amount < 0 {
+		return 0, false
+	}
+	for _, x := range grpcTimeoutUnits {
+		if x.name == value[len(value)-1:] {
+			return time.Duration(amount) * x.unit, true
+		}
+	}
+
+	return 0, false
+}
+
+//
+// setDeadlineHeaders translates the time remaining before the proxy gives up on the request into the deadline
+// headers, so the upstream can stop the work no one is waiting for; a grpc timeout from the client is kept when
+// it's shorter
+//
+func setDeadlineHeaders(req *http.Request, now time.Time) {
+	deadline, found := req.Context().Deadline()
+	if !found || !now.Before(deadline) {
+		req.Header.Del(headerRequestDeadline)
+		return
+	}
+	req.Header.Set(headerRequestDeadline, deadline.UTC().Format(requestDeadlineFormat))
+
+	if strings.HasPrefix(req.Header.Get("Content-Type"), grpcContentType) {
+		remaining := deadline.Sub(now)
+		if timeout, found := parseGRPCTimeout(req.Header.Get(headerGRPCTimeout)); found && timeout < remaining {
+			return
+		}
+		req.Header.Set(headerGRPCTimeout, encodeGRPCTimeout(remaining))
+	}
+}
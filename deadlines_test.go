@@ -0,0 +1,108 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEncodeGRPCTimeout(t *testing.T) {
+	cases := []struct {
+		Timeout  time.Duration
+		Expected string
+	}{
+		{Timeout: 50 * time.Millisecond, Expected: "50000000n"},
+		{Timeout: 30 * time.Second, Expected: "30000000u"},
+		{Timeout: 29*time.Second + 999999999*time.Nanosecond, Expected: "29999999u"},
+		{Timeout: 10 * time.Minute, Expected: "600000m"},
+		{Timeout: 48 * time.Hour, Expected: "172800S"},
+	}
+	for i, c := range cases {
+		assert.Equal(t, c.Expected, encodeGRPCTimeout(c.Timeout), "case %d, unexpected timeout", i)
+		timeout, found := parseGRPCTimeout(c.Expected)
+		assert.True(t, found, "case %d, unable to parse the timeout", i)
+		assert.True(t, timeout <= c.Timeout, "case %d, the timeout must not exceed the duration", i)
+	}
+	for _, x := range []string{"", "1", "10x", "-1S", "123456789S", "abcS"} {
+		_, found := parseGRPCTimeout(x)
+		assert.False(t, found, "the timeout %q should be invalid", x)
+	}
+}
+
+func TestSetDeadlineHeaders(t *testing.T) {
+	now := time.Date(2017, 3, 4, 10, 20, 0, 0, time.UTC)
+	ctx, cancel := context.WithDeadline(context.Background(), now.Add(30*time.Second+450*time.Millisecond))
+	defer cancel()
+
+	// step: the client deadline is replaced
+	req, _ := http.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(headerRequestDeadline, "2099-01-01T00:00:00.000Z")
+	setDeadlineHeaders(req.WithContext(ctx), now)
+	assert.Equal(t, "2017-03-04T10:20:30.450Z", req.Header.Get(headerRequestDeadline))
+	assert.Empty(t, req.Header.Get(headerGRPCTimeout))
+
+	// step: the grpc timeout is set, unless the client asked for less
+	req.Header.Set("Content-Type", "application/grpc-web+proto")
+	setDeadlineHeaders(req.WithContext(ctx), now)
+	assert.Equal(t, "30450000u", req.Header.Get(headerGRPCTimeout))
+	req.Header.Set(headerGRPCTimeout, "5S")
+	setDeadlineHeaders(req.WithContext(ctx), now)
+	assert.Equal(t, "5S", req.Header.Get(headerGRPCTimeout))
+	req.Header.Set(headerGRPCTimeout, "1H")
+	setDeadlineHeaders(req.WithContext(ctx), now)
+	assert.Equal(t, "30450000u", req.Header.Get(headerGRPCTimeout))
+
+	// step: without a deadline the client's is removed
+	req, _ = http.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(headerRequestDeadline, "2099-01-01T00:00:00.000Z")
+	setDeadlineHeaders(req, now)
+	assert.Empty(t, req.Header.Get(headerRequestDeadline))
+}
+
+func TestDeadlinePropagation(t *testing.T) {
+	var deadline string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		deadline = req.Header.Get(headerRequestDeadline)
+	}))
+	defer upstream.Close()
+
+	config := newFakeKeycloakConfig()
+	config.Upstream = upstream.URL
+	config.MaxTransferDuration = time.Minute
+	config.EnableDeadlinePropagation = true
+	p, _, u := newTestProxyService(config)
+	if !assert.NoError(t, p.createUpstreamProxy(p.endpoint)) {
+		t.FailNow()
+	}
+
+	started := time.Now()
+	resp, err := http.Get(u + fakeTestWhitelistedURL)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	expires, err := time.Parse(requestDeadlineFormat, deadline)
+	if assert.NoError(t, err) {
+		assert.WithinDuration(t, started.Add(time.Minute), expires, 5*time.Second)
+	}
+}
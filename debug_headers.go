@@ -0,0 +1,132 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// headerProxyUpstreamTime is the time the upstream took to respond, in milliseconds
+	headerProxyUpstreamTime = "X-Proxy-Upstream-Time"
+	// headerProxyMatchedResource is the name of the resource matched by the request
+	headerProxyMatchedResource = "X-Proxy-Matched-Resource"
+	// headerProxyDecision is the routing decision of the request
+	headerProxyDecision = "X-Proxy-Decision"
+	// cxUpstreamStarted is the tag name for the time the request was passed to the upstream
+	cxUpstreamStarted = "UpstreamStarted"
+)
+
+//
+// debugHeadersWriter adds the debug headers to the response before the headers are written, as the proxy replaces
+// the headers with those of the upstream
+//
+type debugHeadersWriter struct {
+	gin.ResponseWriter
+	// the context of the request
+	cx *gin.Context
+	// the proxy
+	proxy *oauthProxy
+	// the headers have been added
+	done bool
+}
+
+//
+// debugHeadersMiddleware adds the upstream time, matched resource and decision to the responses of the clients on
+// the debug allowlist; the peer address is used, as the forwarded headers can be set by anyone
+//
+func (r *oauthProxy) debugHeadersMiddleware() gin.HandlerFunc {
+	var allowed []*net.IPNet
+	for _, x := range r.config.DebugHeadersAllowlist {
+		network, err := parseNetwork(x)
+		if err != nil {
+			log.WithFields(log.Fields{"error": err.Error()}).Errorf("unable to parse the debug headers allowlist entry: %s", x)
+			continue
+		}
+		allowed = append(allowed, network)
+	}
+
+	return func(cx *gin.Context) {
+		ip := net.ParseIP(getRemoteAddress(cx.Request))
+		if ip == nil {
+			return
+		}
+		for _, x := range allowed {
+			if x.Contains(ip) {
+				cx.Writer = &debugHeadersWriter{ResponseWriter: cx.Writer, cx: cx, proxy: r}
+				return
+			}
+		}
+	}
+}
+
+//
+// setHeaders adds the debug headers to the response, once
+//
+func (r *debugHeadersWriter) setHeaders() {
+	if r.done {
+		return
+	}
+	r.done = true
+
+	header := r.ResponseWriter.Header()
+	resource, decision := r.proxy.getDecision(r.cx)
+	if resource != nil {
+		header.Set(headerProxyMatchedResource, resource.getName())
+	}
+	header.Set(headerProxyDecision, decision)
+	if started, found := r.cx.Get(cxUpstreamStarted); found {
+		elapsed := time.Since(started.(time.Time))
+		header.Set(headerProxyUpstreamTime, fmt.Sprintf("%.3f", float64(elapsed)/float64(time.Millisecond)))
+	}
+}
+
+//
+// WriteHeader adds the headers before writing the status
+//
+func (r *debugHeadersWriter) WriteHeader(code int) {
+	r.setHeaders()
+	r.ResponseWriter.WriteHeader(code)
+}
+
+//
+// WriteHeaderNow adds the headers before they are written
+//
+func (r *debugHeadersWriter) WriteHeaderNow() {
+	r.setHeaders()
+	r.ResponseWriter.WriteHeaderNow()
+}
+
+//
+// Write adds the headers before the body is written
+//
+func (r *debugHeadersWriter) Write(content []byte) (int, error) {
+	r.setHeaders()
+	return r.ResponseWriter.Write(content)
+}
+
+//
+// WriteString adds the headers before the body is written
+//
+func (r *debugHeadersWriter) WriteString(content string) (int, error) {
+	r.setHeaders()
+	return r.ResponseWriter.WriteString(content)
+}
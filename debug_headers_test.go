@@ -0,0 +1,90 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDebugHeaders(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+		w.Header().Set(headerProxyDecision, "spoofed")
+		w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+
+	cs := []struct {
+		Allowlist []string
+		Expected  bool
+	}{
+		{Allowlist: []string{"127.0.0.0/8"}, Expected: true},
+		{Allowlist: []string{"127.0.0.1"}, Expected: true},
+		{Allowlist: []string{"10.0.0.0/8"}},
+	}
+	for i, c := range cs {
+		config := newFakeKeycloakConfig()
+		config.Upstream = upstream.URL
+		config.EnableDebugHeaders = true
+		config.DebugHeadersAllowlist = c.Allowlist
+		config.Resources = []*Resource{{URL: "/public", WhiteListed: true, Methods: []string{"ANY"}}}
+		p, _, u := newTestProxyService(config)
+		if !assert.NoError(t, p.createUpstreamProxy(p.endpoint)) {
+			t.FailNow()
+		}
+
+		resp, err := http.Get(u + "/public/page")
+		if !assert.NoError(t, err, "case %d, unable to make the request", i) {
+			continue
+		}
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode, "case %d", i)
+		if !c.Expected {
+			assert.Empty(t, resp.Header.Get(headerProxyMatchedResource), "case %d", i)
+			assert.Empty(t, resp.Header.Get(headerProxyUpstreamTime), "case %d", i)
+			continue
+		}
+		assert.Equal(t, "/public", resp.Header.Get(headerProxyMatchedResource), "case %d", i)
+		assert.Equal(t, decisionWhiteListed, resp.Header.Get(headerProxyDecision), "case %d", i)
+		elapsed, err := strconv.ParseFloat(resp.Header.Get(headerProxyUpstreamTime), 64)
+		assert.NoError(t, err, "case %d", i)
+		assert.True(t, elapsed >= 20, "case %d, upstream time: %f", i, elapsed)
+	}
+}
+
+func TestDebugHeadersNotUpstream(t *testing.T) {
+	config := newFakeKeycloakConfig()
+	config.NoRedirects = true
+	config.EnableDebugHeaders = true
+	config.DebugHeadersAllowlist = []string{"127.0.0.1"}
+	config.Resources = []*Resource{{URL: "/admin", Methods: []string{"ANY"}}}
+	_, _, u := newTestProxyService(config)
+
+	resp, err := http.Get(u + "/admin/page")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assert.Equal(t, "/admin", resp.Header.Get(headerProxyMatchedResource))
+	assert.Empty(t, resp.Header.Get(headerProxyUpstreamTime))
+}
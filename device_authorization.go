@@ -0,0 +1,206 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// deviceCodeGrantType is the grant type of the device code exchange (rfc 8628)
+	deviceCodeGrantType = "urn:ietf:params:oauth:grant-type:device_code"
+)
+
+//
+// deviceAuthorization performs the device authorization grant (rfc 8628) on behalf of the headless clients, i.e.
+// the cli tools, which can't follow the browser redirects
+//
+type deviceAuthorization struct {
+	// the client used to reach the provider
+	client *http.Client
+	// the device authorization endpoint of the provider
+	endpoint string
+	// the token endpoint of the provider
+	tokenEndpoint string
+	// the credentials of the client
+	clientID, clientSecret string
+	// the scopes requested
+	scopes []string
+}
+
+//
+// newDeviceAuthorization creates the device authorization grant
+//
+func newDeviceAuthorization(client *http.Client, endpoint, tokenEndpoint, clientID, clientSecret string, scopes []string) *deviceAuthorization {
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	return &deviceAuthorization{
+		client:        client,
+		endpoint:      endpoint,
+		tokenEndpoint: tokenEndpoint,
+		clientID:      clientID,
+		clientSecret:  clientSecret,
+		scopes:        scopes,
+	}
+}
+
+//
+// post makes a request to the provider as the client, returning the status and body of the response
+//
+func (r *deviceAuthorization) post(endpoint string, values url.Values) (int, []byte, error) {
+	values.Set("client_id", r.clientID)
+	req, err := http.NewRequest(http.MethodPost, endpoint, strings.NewReader(values.Encode()))
+	if err != nil {
+		return 0, nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if r.clientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(r.clientID), url.QueryEscape(r.clientSecret))
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return resp.StatusCode, body, nil
+}
+
+//
+// start requests a device and user code from the provider
+//
+func (r *deviceAuthorization) start() (int, []byte, error) {
+	return r.post(r.endpoint, url.Values{
+		"scope": {strings.Join(append([]string{"openid"}, r.scopes...), " ")},
+	})
+}
+
+//
+// exchange polls the provider for the tokens of the device code, the provider answers authorization_pending until
+// the user has approved the device
+//
+func (r *deviceAuthorization) exchange(deviceCode string) (int, []byte, error) {
+	return r.post(r.tokenEndpoint, url.Values{
+		"grant_type":  {deviceCodeGrantType},
+		"device_code": {deviceCode},
+	})
+}
+
+//
+// deviceAuthorizationHandler starts the device flow, returning the user code and verification uri for the client
+// to present to the user, along with the device code to poll with
+//
+func (r *oauthProxy) deviceAuthorizationHandler(cx *gin.Context) {
+	status, body, err := r.device.start()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err.Error(),
+		}).Errorf("unable to request the device authorization from the provider")
+
+		tokenPassthroughError(cx, http.StatusBadGateway, "temporarily_unavailable", "the provider is unavailable")
+		return
+	}
+	if status != http.StatusOK {
+		log.WithFields(log.Fields{
+			"status":   status,
+			"response": string(body),
+		}).Errorf("the provider refused the device authorization")
+	}
+	cx.Header("Cache-Control", "no-store")
+	cx.Header("Pragma", "no-cache")
+	cx.Data(status, "application/json", body)
+}
+
+//
+// deviceTokenHandler exchanges the device code for the tokens once the user has approved the device, dropping the
+// access token cookie as the login handler does; the pending and slow down errors are passed back to the client
+//
+func (r *oauthProxy) deviceTokenHandler(cx *gin.Context) {
+	deviceCode := cx.Request.PostFormValue("device_code")
+	if deviceCode == "" {
+		tokenPassthroughError(cx, http.StatusBadRequest, "invalid_request", "the request has no device code")
+		return
+	}
+	status, body, err := r.device.exchange(deviceCode)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err.Error(),
+		}).Errorf("unable to exchange the device code with the provider")
+
+		tokenPassthroughError(cx, http.StatusBadGateway, "temporarily_unavailable", "the provider is unavailable")
+		return
+	}
+	cx.Header("Cache-Control", "no-store")
+	cx.Header("Pragma", "no-cache")
+	if status != http.StatusOK {
+		cx.Data(status, "application/json", body)
+		return
+	}
+
+	var token tokenResponse
+	if err := json.Unmarshal(body, &token); err != nil || token.AccessToken == "" {
+		log.WithFields(log.Fields{
+			"client_ip": cx.ClientIP(),
+		}).Errorf("the token response of the device code exchange is invalid")
+
+		cx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	// step: drop the access token
+	r.dropAccessTokenCookie(cx, token.AccessToken, r.config.IdleDuration)
+
+	// step: are we binding the session to the client?
+	if r.useSessionBinding() {
+		_, identity, err := parseToken(token.AccessToken)
+		if err == nil {
+			err = r.dropSessionBindingCookie(cx, identity.ID, r.config.IdleDuration)
+		}
+		if err != nil {
+			log.WithFields(log.Fields{
+				"client_ip": cx.ClientIP(),
+				"error":     err.Error(),
+			}).Errorf("unable to bind the session to the client")
+
+			cx.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	cx.JSON(http.StatusOK, tokenResponse{
+		IDToken:      token.IDToken,
+		AccessToken:  token.AccessToken,
+		RefreshToken: token.RefreshToken,
+		ExpiresIn:    token.ExpiresIn,
+		Scope:        token.Scope,
+	})
+}
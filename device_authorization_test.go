@@ -0,0 +1,82 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeviceAuthorizationDisabled(t *testing.T) {
+	_, _, u := newTestProxyService(nil)
+	resp, err := http.PostForm(u+oauthURL+deviceURL, url.Values{})
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	}
+}
+
+func TestDeviceAuthorization(t *testing.T) {
+	config := newFakeKeycloakConfig()
+	config.EnableDeviceAuthorization = true
+	_, auth, u := newTestProxyService(config)
+
+	// step: start the flow
+	resp, err := http.PostForm(u+oauthURL+deviceURL, url.Values{})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	var device map[string]interface{}
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&device))
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "QWER-ASDF", device["user_code"])
+	assert.NotEmpty(t, device["verification_uri"])
+	code, _ := device["device_code"].(string)
+	if !assert.NotEmpty(t, code) {
+		t.FailNow()
+	}
+
+	poll := func(values url.Values) (*http.Response, map[string]interface{}) {
+		resp, err := http.PostForm(u+oauthURL+deviceTokenURL, values)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		defer resp.Body.Close()
+		content := make(map[string]interface{})
+		json.NewDecoder(resp.Body).Decode(&content)
+		return resp, content
+	}
+
+	// step: the device code is required
+	resp, _ = poll(url.Values{})
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	// step: pending until the user approves the device
+	resp, content := poll(url.Values{"device_code": {code}})
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Equal(t, "authorization_pending", content["error"])
+
+	auth.approveDevice(code)
+	resp, content = poll(url.Values{"device_code": {code}})
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.NotEmpty(t, content["access_token"])
+	assert.NotNil(t, findCookie(config.CookieAccessName, resp.Cookies()))
+}
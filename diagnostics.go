@@ -0,0 +1,134 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"os/signal"
+	"runtime"
+	"syscall"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// diagnosticsSignals are the signals the diagnostics can be dumped on
+var diagnosticsSignals = map[string]os.Signal{
+	"SIGUSR1": syscall.SIGUSR1,
+	"SIGUSR2": syscall.SIGUSR2,
+	"SIGQUIT": syscall.SIGQUIT,
+}
+
+//
+// statsStorage is a store which can report the statistics of its client
+//
+type statsStorage interface {
+	storage
+	// Stats returns the statistics of the store client
+	Stats() map[string]interface{}
+}
+
+//
+// handleDiagnosticsSignal dumps the diagnostics to the log whenever the signal is received
+//
+func (r *oauthProxy) handleDiagnosticsSignal(sig os.Signal) {
+	log.Infof("the diagnostics will be dumped to the log on %s", sig)
+
+	signalChannel := make(chan os.Signal, 1)
+	signal.Notify(signalChannel, sig)
+	go func() {
+		for range signalChannel {
+			r.dumpDiagnostics()
+		}
+	}()
+}
+
+//
+// dumpDiagnostics logs the state of the proxy and the stacks of the goroutines
+//
+func (r *oauthProxy) dumpDiagnostics() {
+	log.WithFields(r.getDiagnostics()).Warnf("diagnostics dump requested")
+	log.Warnf("diagnostics dump, goroutine stacks:\n%s", getGoroutineStacks())
+}
+
+//
+// getDiagnostics returns the state of the proxy, the sessions, caches, connections and store
+//
+func (r *oauthProxy) getDiagnostics() log.Fields {
+	fields := log.Fields{
+		"goroutines":      runtime.NumGoroutine(),
+		"config_checksum": getConfigChecksum(r.config),
+	}
+	if r.connections != nil {
+		fields["upstream_connections_open"] = r.connections.getOpen()
+		fields["upstream_connections_active"] = r.connections.getActive()
+		fields["upstream_connections_idle"] = r.connections.getIdle()
+	}
+	if r.tokens != nil {
+		r.tokens.Lock()
+		fields["token_cache_entries"] = r.tokens.entries.Len()
+		r.tokens.Unlock()
+	}
+	if r.unauthenticated != nil {
+		r.unauthenticated.Lock()
+		fields["unauthenticated_cache_entries"] = len(r.unauthenticated.entries)
+		r.unauthenticated.Unlock()
+	}
+	if r.loops != nil {
+		r.loops.Lock()
+		fields["login_loop_clients"] = len(r.loops.clients)
+		r.loops.Unlock()
+	}
+	if r.store != nil {
+		if store, ok := r.store.(statsStorage); ok {
+			for k, v := range store.Stats() {
+				fields["store_"+k] = v
+			}
+		}
+	}
+
+	return fields
+}
+
+//
+// getConfigChecksum returns the sha256 of the configuration, so the configuration of the instances can be compared
+// without the secrets being logged
+//
+func getConfigChecksum(config *Config) string {
+	encoded, err := json.Marshal(config)
+	if err != nil {
+		return ""
+	}
+	hash := sha256.Sum256(encoded)
+
+	return hex.EncodeToString(hash[:])
+}
+
+//
+// getGoroutineStacks returns the stacks of all the goroutines
+//
+func getGoroutineStacks() []byte {
+	buffer := make([]byte, 64*1024)
+	for {
+		n := runtime.Stack(buffer, true)
+		if n < len(buffer) {
+			return buffer[:n]
+		}
+		buffer = make([]byte, 2*len(buffer))
+	}
+}
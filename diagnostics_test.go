@@ -0,0 +1,53 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetDiagnostics(t *testing.T) {
+	config := newFakeKeycloakConfig()
+	config.TokenCacheSize = 10
+	config.TokenCacheTTL = time.Minute
+	config.LoginLoopThreshold = 2
+	config.LoginLoopWindow = time.Minute
+	p, _, _ := newTestProxyService(config)
+	p.loops.record("client", time.Now())
+
+	fields := p.getDiagnostics()
+	assert.NotZero(t, fields["goroutines"])
+	assert.Len(t, fields["config_checksum"], 64)
+	assert.Equal(t, 0, fields["token_cache_entries"])
+	assert.Equal(t, 1, fields["login_loop_clients"])
+	assert.Contains(t, fields, "upstream_connections_open")
+	assert.NotContains(t, fields, "unauthenticated_cache_entries")
+
+	// step: the checksum changes with the configuration
+	checksum := getConfigChecksum(config)
+	config.ClientSecret = "another"
+	assert.NotEqual(t, checksum, getConfigChecksum(config))
+}
+
+func TestGetGoroutineStacks(t *testing.T) {
+	stacks := string(getGoroutineStacks())
+	assert.True(t, strings.HasPrefix(stacks, "goroutine "))
+	assert.Contains(t, stacks, "TestGetGoroutineStacks")
+}
@@ -17,13 +17,17 @@ package main
 
 import (
 	"errors"
+	"net/url"
 	"time"
+
+	"github.com/coreos/go-oidc/oidc"
 )
 
 var (
-	release = "v1.2.3"
-	gitsha  = "no gitsha provided"
-	version = release + " (git+sha: " + gitsha + ")"
+	release   = "v1.2.3"
+	gitsha    = "no gitsha provided"
+	buildTime = "no build time provided"
+	version   = release + " (git+sha: " + gitsha + ")"
 )
 
 const (
@@ -33,6 +37,7 @@ const (
 	description = "is a proxy using the keycloak service for auth and authorization"
 
 	headerUpgrade       = "Upgrade"
+	formMethodOverride  = "_method"
 	userContextName     = "identity"
 	authorizationHeader = "Authorization"
 	versionHeader       = "X-Auth-Proxy-Version"
@@ -46,12 +51,23 @@ const (
 	logoutURL        = "/logout"
 	loginURL         = "/login"
 	metricsURL       = "/metrics"
+	versionURL       = "/version"
+	discoveryURL     = "/.well-known/openid-configuration"
+	jwksURL          = "/.well-known/jwks.json"
+	providerTokenURL = "/provider/token"
+	deviceURL        = "/device"
+	deviceTokenURL   = "/device/token"
+	backchannelURL   = "/backchannel-logout"
+	frontchannelURL  = "/frontchannel-logout"
+	samlACSURL       = "/saml/acs"
+	samlMetadataURL  = "/saml/metadata"
 
-	claimPreferredName  = "preferred_username"
-	claimAudience       = "aud"
-	claimResourceAccess = "resource_access"
-	claimRealmAccess    = "realm_access"
-	claimResourceRoles  = "roles"
+	claimPreferredName   = "preferred_username"
+	claimAudience        = "aud"
+	claimAuthorizedParty = "azp"
+	claimResourceAccess  = "resource_access"
+	claimRealmAccess     = "realm_access"
+	claimResourceRoles   = "roles"
 )
 
 var (
@@ -63,14 +79,42 @@ var (
 	ErrInvalidSession = errors.New("invalid session identifier")
 	// ErrAccessTokenExpired indicates the access token has expired
 	ErrAccessTokenExpired = errors.New("the access token has expired")
+	// ErrTokenNotYetValid indicates the token is used before its not before
+	ErrTokenNotYetValid = errors.New("the token is not yet valid")
 	// ErrRefreshTokenExpired indicates the refresh token as expired
 	ErrRefreshTokenExpired = errors.New("the refresh token has expired")
 	// ErrNoTokenAudience indicates their is not audience in the token
 	ErrNoTokenAudience = errors.New("the token does not audience in claims")
+	// ErrSessionLimitReached indicates the user has reached the concurrent session limit
+	ErrSessionLimitReached = errors.New("the concurrent session limit has been reached")
+	// ErrSessionBindingMismatch indicates the session is being used by a different client
+	ErrSessionBindingMismatch = errors.New("the session is not bound to the client")
+	// ErrRequestBodyTooLarge indicates the request body exceeds the size which can be read in
+	ErrRequestBodyTooLarge = errors.New("the request body exceeds the maximum permitted size")
+	// ErrHeadersTooLarge indicates the request headers exceed the permitted size for the upstream
+	ErrHeadersTooLarge = errors.New("the request headers exceed the maximum permitted size")
+	// ErrTooManyHeaders indicates the request headers exceed the permitted number for the upstream
+	ErrTooManyHeaders = errors.New("the request headers exceed the maximum permitted number")
+	// ErrSignedURLExpired indicates the signed url has expired
+	ErrSignedURLExpired = errors.New("the signed url has expired")
+	// ErrSignedURLInvalid indicates the signature of the url is invalid
+	ErrSignedURLInvalid = errors.New("the signature of the url is invalid")
+	// ErrStateExpired indicates the signed state of the login has expired
+	ErrStateExpired = errors.New("the state parameter has expired")
+	// ErrTokenTooLarge indicates the token exceeds the maximum permitted size
+	ErrTokenTooLarge = errors.New("the token exceeds the maximum permitted size")
+	// ErrTokenTooManyClaims indicates the token exceeds the maximum permitted number of claims
+	ErrTokenTooManyClaims = errors.New("the token exceeds the maximum permitted number of claims")
+	// ErrTokenTooDeep indicates the claims of the token exceed the maximum permitted nesting depth
+	ErrTokenTooDeep = errors.New("the token claims exceed the maximum permitted nesting depth")
+	// ErrStateInvalid indicates the signature of the state is invalid
+	ErrStateInvalid = errors.New("the signature of the state parameter is invalid")
 )
 
 // Resource represents a url resource to protect
 type Resource struct {
+	// Name is a optional name for the resource, passed to the upstream
+	Name string `json:"name" yaml:"name"`
 	// URL the url for the resource
 	URL string `json:"url" yaml:"url"`
 	// Methods the method type
@@ -79,11 +123,37 @@ type Resource struct {
 	WhiteListed bool `json:"white-listed" yaml:"white-listed"`
 	// Roles the roles required to access this url
 	Roles []string `json:"roles" yaml:"roles"`
+	// ContentTypes is a list of content types permitted in the request body
+	ContentTypes []string `json:"content-types" yaml:"content-types"`
+	// MaxBodySize is the maximum size in bytes of the request body
+	MaxBodySize int64 `json:"max-body-size" yaml:"max-body-size"`
+	// RequireDPoP requires the access token to be dpop bound, i.e. no plain bearer tokens or sessions
+	RequireDPoP bool `json:"require-dpop" yaml:"require-dpop"`
+	// XHRLogin overrides the global xhr login handling for this resource
+	XHRLogin *bool `json:"xhr-login,omitempty" yaml:"xhr-login,omitempty"`
+	// CORS overrides the global cors for this resource
+	CORS *CORS `json:"cors,omitempty" yaml:"cors,omitempty"`
+	// SignedURLs permits a short lived signed url in place of the token, the admitted requests are redirected to one
+	SignedURLs bool `json:"signed-urls" yaml:"signed-urls"`
+	// BreakGlass permits read only access with a break glass token
+	BreakGlass bool `json:"break-glass" yaml:"break-glass"`
+	// SessionExpiry adds the remaining lifetime of the session to the responses
+	SessionExpiry bool `json:"session-expiry" yaml:"session-expiry"`
+	// SPNEGO negotiates kerberos with the clients, falling back to the login
+	SPNEGO bool `json:"spnego" yaml:"spnego"`
+	// Hidden responds with a 404 rather than a 403 on a denial, so the existence of the resource isn't revealed
+	Hidden bool `json:"hidden" yaml:"hidden"`
+	// BodyClaims requires the fields of the json request body to match the claims of the token, keyed by the dotted path
+	BodyClaims map[string]string `json:"body-claims" yaml:"body-claims"`
+	// NoBuffering flushes the responses to the client as they are received from the upstream
+	NoBuffering bool `json:"no-buffering" yaml:"no-buffering"`
+	// ACR is the authentication context class the token must carry, else the user is stepped up by the provider
+	ACR string `json:"acr" yaml:"acr"`
 }
 
 // CORS access controls
 type CORS struct {
-	// Origins is a list of origins permitted
+	// Origins is a list of origins permitted, either exact, a wildcard e.g. https://*.example.com or a regex starting with ^
 	Origins []string `json:"origins" yaml:"origins"`
 	// Methods is a set of access control methods
 	Methods []string `json:"methods" yaml:"methods"`
@@ -97,45 +167,287 @@ type CORS struct {
 	MaxAge time.Duration `json:"max-age" yaml:"max-age"`
 }
 
+// SecurityFilter are the options of the security filter
+type SecurityFilter struct {
+	// AllowedHosts is a list of the host names permitted, exactly, by the filter; empty permits any
+	AllowedHosts []string `json:"allowed-hosts" yaml:"allowed-hosts"`
+	// SSLRedirect redirects the http requests to https
+	SSLRedirect bool `json:"ssl-redirect" yaml:"ssl-redirect"`
+	// SSLTemporaryRedirect uses a 307 rather than a 301 for the https redirect
+	SSLTemporaryRedirect bool `json:"ssl-temporary-redirect" yaml:"ssl-temporary-redirect"`
+	// SSLHost is the host the http requests are redirected to, defaults to the same host
+	SSLHost string `json:"ssl-host" yaml:"ssl-host"`
+	// SSLProxyHeaders are the headers and values indicating the request was https, i.e. X-Forwarded-Proto: https
+	SSLProxyHeaders map[string]string `json:"ssl-proxy-headers" yaml:"ssl-proxy-headers"`
+	// STSSeconds is the max-age of the Strict-Transport-Security header, zero omits the header
+	STSSeconds int64 `json:"sts-seconds" yaml:"sts-seconds"`
+	// STSIncludeSubdomains adds includeSubdomains to the Strict-Transport-Security header
+	STSIncludeSubdomains bool `json:"sts-include-subdomains" yaml:"sts-include-subdomains"`
+	// STSPreload adds preload to the Strict-Transport-Security header
+	STSPreload bool `json:"sts-preload" yaml:"sts-preload"`
+	// ForceSTSHeader adds the Strict-Transport-Security header to the http requests too
+	ForceSTSHeader bool `json:"force-sts-header" yaml:"force-sts-header"`
+	// FrameDeny adds the X-Frame-Options: DENY header
+	FrameDeny bool `json:"frame-deny" yaml:"frame-deny"`
+	// FrameOptions is a custom value of the X-Frame-Options header, overriding the frame deny
+	FrameOptions string `json:"frame-options" yaml:"frame-options"`
+	// ContentTypeNosniff adds the X-Content-Type-Options: nosniff header
+	ContentTypeNosniff bool `json:"content-type-nosniff" yaml:"content-type-nosniff"`
+	// BrowserXSSFilter adds the X-XSS-Protection: 1; mode=block header
+	BrowserXSSFilter bool `json:"browser-xss-filter" yaml:"browser-xss-filter"`
+	// ContentSecurityPolicy is the value of the Content-Security-Policy header
+	ContentSecurityPolicy string `json:"content-security-policy" yaml:"content-security-policy"`
+	// Development skips the allowed hosts, ssl redirect and sts header, for testing over http
+	Development bool `json:"development" yaml:"development"`
+}
+
+// TLSCertificatePair is a certificate and private key selected by the server name (sni) of the client
+type TLSCertificatePair struct {
+	// Certificate is the location of the certificate
+	Certificate string `json:"cert" yaml:"cert"`
+	// PrivateKey is the location of the private key
+	PrivateKey string `json:"private-key" yaml:"private-key"`
+	// Hostnames is the list of server names the pair is used for, defaults to the names in the certificate
+	Hostnames []string `json:"hostnames" yaml:"hostnames"`
+}
+
+// Provider is a additional openid provider and client, selected by the host or path of the request
+type Provider struct {
+	// Name is a name for the provider in the logs, defaults to the discovery url
+	Name string `json:"name" yaml:"name"`
+	// DiscoveryURL is the url for the keycloak realm
+	DiscoveryURL string `json:"discovery-url" yaml:"discovery-url"`
+	// ClientID is the client id
+	ClientID string `json:"client-id" yaml:"client-id"`
+	// ClientSecret is the secret for the client
+	ClientSecret string `json:"client-secret" yaml:"client-secret"`
+	// Scopes is a list of scopes requested, defaults to the global scopes
+	Scopes []string `json:"scopes" yaml:"scopes"`
+	// RedirectionURL is the redirection url of the client, defaults to the global redirection url
+	RedirectionURL string `json:"redirection-url" yaml:"redirection-url"`
+	// Hostnames is a list of hosts the provider is selected for, the first label may be a wildcard
+	Hostnames []string `json:"hostnames" yaml:"hostnames"`
+	// PathPrefixes is a list of path prefixes the provider is selected for
+	PathPrefixes []string `json:"path-prefixes" yaml:"path-prefixes"`
+	// the client of the provider
+	client *oidc.Client
+	// the configuration of the provider
+	provider oidc.ProviderConfig
+}
+
+// VirtualHost is the upstream and resources for the requests to a set of hosts
+type VirtualHost struct {
+	// Hostnames is a list of hosts, the first label may be a wildcard, e.g. *.apps.example.com
+	Hostnames []string `json:"hostnames" yaml:"hostnames"`
+	// Default marks the virtual host used for the requests matching no other virtual host
+	Default bool `json:"default" yaml:"default"`
+	// Upstream is the upstream endpoint for the virtual host
+	Upstream string `json:"upstream-url" yaml:"upstream-url"`
+	// Resources is a list of protected resources for the virtual host
+	Resources []*Resource `json:"resources" yaml:"resources"`
+	// Headers are the custom headers added to the requests, in addition to the global headers
+	Headers map[string]string `json:"headers" yaml:"headers"`
+	// SignInPage is the sign in page for the virtual host, defaults to the global
+	SignInPage string `json:"sign-in-page" yaml:"sign-in-page"`
+	// ForbiddenPage is the access forbidden page for the virtual host, defaults to the global
+	ForbiddenPage string `json:"forbidden-page" yaml:"forbidden-page"`
+	// the parsed upstream endpoint
+	endpoint *url.URL
+	// the compiled matcher of the resources
+	matcher *resourceMatcher
+}
+
+// UpstreamTLS is the tls verification of the upstreams matching the domains
+type UpstreamTLS struct {
+	// Domains is a list of upstream domains the settings apply to, defaults to all
+	Domains []string `json:"domains" yaml:"domains"`
+	// CACertificate is the ca the upstream certificate must be signed by, defaults to the system roots
+	CACertificate string `json:"ca-certificate" yaml:"ca-certificate"`
+	// ServerName is the name expected in the upstream certificate, defaults to the upstream hostname
+	ServerName string `json:"server-name" yaml:"server-name"`
+	// Pins is a list of base64 sha256 hashes of the subject public key info, one of which the upstream must present
+	Pins []string `json:"pins" yaml:"pins"`
+	// SkipVerify skips the verification of the certificate chain, the pins are still checked
+	SkipVerify bool `json:"skip-verify" yaml:"skip-verify"`
+}
+
+// UpstreamSigning is the configuration for signing requests to the upstream
+type UpstreamSigning struct {
+	// Type is the signing scheme, either aws-sigv4 or hmac
+	Type string `json:"type" yaml:"type"`
+	// Domains is a list of upstream domains to sign, defaults to all
+	Domains []string `json:"domains" yaml:"domains"`
+	// Region is the aws region of the upstream
+	Region string `json:"region" yaml:"region"`
+	// Service is the aws service name, e.g. execute-api, s3
+	Service string `json:"service" yaml:"service"`
+	// AccessKey is the aws access key id
+	AccessKey string `json:"access-key" yaml:"access-key"`
+	// SecretKey is the aws secret key or the hmac shared secret
+	SecretKey string `json:"secret-key" yaml:"secret-key"`
+	// SessionToken is an optional aws session token
+	SessionToken string `json:"session-token" yaml:"session-token"`
+	// UnsignedPayload skips hashing the request body
+	UnsignedPayload bool `json:"unsigned-payload" yaml:"unsigned-payload"`
+	// MaxBodySize is the maximum size in bytes of the request body read in to be signed, defaults to 10MB
+	MaxBodySize int64 `json:"max-body-size" yaml:"max-body-size"`
+	// Header is the header the hmac signature is placed in
+	Header string `json:"header" yaml:"header"`
+	// StripBearer removes the bearer token from the upstream request
+	StripBearer bool `json:"strip-bearer" yaml:"strip-bearer"`
+}
+
+// UpstreamAuth is the credentials the proxy authenticates to the upstream with, for the legacy backends unable to
+// consume the tokens or headers
+type UpstreamAuth struct {
+	// Type is the authentication scheme, either basic or ntlm
+	Type string `json:"type" yaml:"type"`
+	// Domains is a list of upstream domains to authenticate to, defaults to all
+	Domains []string `json:"domains" yaml:"domains"`
+	// Username is the user to authenticate as, for ntlm optionally prefixed by the windows domain i.e. CORP\user
+	Username string `json:"username" yaml:"username"`
+	// Password is the password of the user
+	Password string `json:"password" yaml:"password"`
+}
+
+// RoleMapping gives the users holding a group, or value of a claim, the roles of the resources
+type RoleMapping struct {
+	// Claim is the claim of the token matched, a string or list, defaults to groups
+	Claim string `json:"claim" yaml:"claim"`
+	// Value is the group, or value of the claim, the roles are given for
+	Value string `json:"value" yaml:"value"`
+	// Roles are the roles given to the users
+	Roles []string `json:"roles" yaml:"roles"`
+}
+
+// BotDetection is the configuration for the scanner heuristics
+type BotDetection struct {
+	// UserAgents is a list of regexes for user agents to block, defaults to common scanners
+	UserAgents []string `json:"user-agents" yaml:"user-agents"`
+	// RequireHeaders is a list of headers a request must carry
+	RequireHeaders []string `json:"require-headers" yaml:"require-headers"`
+	// MaxNotFound is the number of not found responses permitted per client in the window
+	MaxNotFound int `json:"max-not-found" yaml:"max-not-found"`
+	// NotFoundWindow is the window the not found responses are counted over
+	NotFoundWindow time.Duration `json:"not-found-window" yaml:"not-found-window"`
+	// BlockDuration is the duration a flagged client is blocked for
+	BlockDuration time.Duration `json:"block-duration" yaml:"block-duration"`
+	// Allowlist is a list of addresses or cidrs which bypass the checks
+	Allowlist []string `json:"allowlist" yaml:"allowlist"`
+	// ChallengePage is a custom template displayed to flagged clients
+	ChallengePage string `json:"challenge-page" yaml:"challenge-page"`
+}
+
 // Config is the configuration for the proxy
 type Config struct {
 	// Listen is the binding interface
 	Listen string `json:"listen" yaml:"listen"`
 	// DiscoveryURL is the url for the keycloak server
 	DiscoveryURL string `json:"discovery-url" yaml:"discovery-url"`
+	// TrustedDiscoveryURLs are the discovery urls of the additional providers whose tokens are accepted
+	TrustedDiscoveryURLs []string `json:"trusted-discovery-urls" yaml:"trusted-discovery-urls"`
+	// Providers are the additional providers and clients, selected by the host or path of the request
+	Providers []*Provider `json:"providers" yaml:"providers"`
+	// IssuerURL is the issuer of the tokens when it differs from the discovery url, i.e. keycloak is reached internally
+	IssuerURL string `json:"issuer-url" yaml:"issuer-url"`
+	// ExternalDiscoveryURL is the url of the realm as reached by the users, the browser is redirected to it
+	ExternalDiscoveryURL string `json:"external-discovery-url" yaml:"external-discovery-url"`
 	// ClientID is the client id
 	ClientID string `json:"client-id" yaml:"client-id"`
 	// ClientSecret is the secret for AS
 	ClientSecret string `json:"client-secret" yaml:"client-secret"`
+	// AllowedAudiences are the audiences, besides the client id, the tokens are accepted for
+	AllowedAudiences []string `json:"allowed-audiences" yaml:"allowed-audiences"`
+	// EnableAuthorizedPartyAudience accepts the tokens whose authorized party (azp) is one of the allowed audiences
+	EnableAuthorizedPartyAudience bool `json:"enable-authorized-party-audience" yaml:"enable-authorized-party-audience"`
+	// ClientAuthMethod is the method the client authenticates to the provider by, defaults to client_secret_basic
+	ClientAuthMethod string `json:"client-auth-method" yaml:"client-auth-method"`
+	// ClientAuthPrivateKey is the private key signing the client assertions, or of the client certificate
+	ClientAuthPrivateKey string `json:"client-auth-private-key" yaml:"client-auth-private-key"`
+	// ClientAuthCertificate is the client certificate presented to the provider for tls_client_auth
+	ClientAuthCertificate string `json:"client-auth-certificate" yaml:"client-auth-certificate"`
+	// ClientAuthKeyID is the key id in the header of the client assertions
+	ClientAuthKeyID string `json:"client-auth-key-id" yaml:"client-auth-key-id"`
 	// RedirectionURL the redirection url
 	RedirectionURL string `json:"redirection-url" yaml:"redirection-url"`
+	// RedirectionURLs are additional redirection urls, selected by the host of the request
+	RedirectionURLs []string `json:"redirection-urls" yaml:"redirection-urls"`
+	// CallbackPath is the path of the oauth callback handler, defaults to /oauth/callback
+	CallbackPath string `json:"callback-path" yaml:"callback-path"`
 	// RevocationEndpoint is the token revocation endpoint to revoke refresh tokens
 	RevocationEndpoint string `json:"revocation-url" yaml:"revocation-url"`
+	// EnableLogoutRedirect redirects the logout to the end session endpoint of the provider, ending the single sign-on session
+	EnableLogoutRedirect bool `json:"enable-logout-redirect" yaml:"enable-logout-redirect"`
+	// EndSessionURL is the end session endpoint of the provider, defaults to the logout endpoint of keycloak
+	EndSessionURL string `json:"end-session-url" yaml:"end-session-url"`
+	// PostLogoutRedirectURI is the url the provider returns the user to after the logout, unless the logout has a redirect
+	PostLogoutRedirectURI string `json:"post-logout-redirect-uri" yaml:"post-logout-redirect-uri"`
 	// Scopes is a list of scope we should request
 	Scopes []string `json:"scopes" yaml:"scopes"`
 	// Upstream is the upstream endpoint i.e whom were proxying to
 	Upstream string `json:"upstream-url" yaml:"upstream-url"`
+	// UpstreamURLPattern is the pattern the upstream urls rendered from the claims of the users must match
+	UpstreamURLPattern string `json:"upstream-url-pattern" yaml:"upstream-url-pattern"`
 	// Resources is a list of protected resources
 	Resources []*Resource `json:"resources" yaml:"resources"`
+	// DefaultDeny requires authentication on the paths which match no resource, rather than permitting them
+	DefaultDeny bool `json:"default-deny" yaml:"default-deny"`
+	// OpenAPISpec is the openapi spec the resources are generated from, after the resources configured
+	OpenAPISpec string `json:"openapi-spec" yaml:"openapi-spec"`
 	// Headers permits adding customs headers across the board
 	Headers map[string]string `json:"headers" yaml:"headers"`
+	// UpstreamSigning is a list of signing configurations for the upstream requests
+	UpstreamSigning []*UpstreamSigning `json:"upstream-signing" yaml:"upstream-signing"`
+	// UpstreamAuth is a list of credentials the proxy authenticates to the upstreams with
+	UpstreamAuth []*UpstreamAuth `json:"upstream-auth" yaml:"upstream-auth"`
+	// RoleMappings gives the roles of the resources to the users by their groups or claims
+	RoleMappings []*RoleMapping `json:"role-mappings" yaml:"role-mappings"`
 
 	// EnableMetrics indicates if the metrics is enabled
 	EnableMetrics bool `json:"enable-metrics" yaml:"enable-metrics"`
+	// DiagnosticsSignal is the signal the diagnostics are dumped to the log on, i.e. SIGUSR1, SIGUSR2 or SIGQUIT
+	DiagnosticsSignal string `json:"diagnostics-signal" yaml:"diagnostics-signal"`
+	// EnableConfigReload reloads the configuration on a SIGHUP rather than exiting, a invalid configuration is refused
+	EnableConfigReload bool `json:"enable-config-reload" yaml:"enable-config-reload"`
 	// EnableURIMetrics indicates we want to keep metrics on uri request times
 	EnableURIMetrics bool `json:"enable-uri-metrics" yaml:"enable-uri-metrics"`
+	// EnableBotDetection enables the scanner heuristics
+	EnableBotDetection bool `json:"enable-bot-detection" yaml:"enable-bot-detection"`
+	// BotDetection is the configuration for the scanner heuristics
+	BotDetection BotDetection `json:"bot-detection" yaml:"bot-detection"`
+	// EnableDebugHeaders adds the upstream time, matched resource and decision to the responses of the allowlist
+	EnableDebugHeaders bool `json:"enable-debug-headers" yaml:"enable-debug-headers"`
+	// DebugHeadersAllowlist are the networks or addresses of the clients the debug headers are added for
+	DebugHeadersAllowlist []string `json:"debug-headers-allowlist" yaml:"debug-headers-allowlist"`
 
 	// CookieDomain is a list of domains the cookie is available to
 	CookieDomain string `json:"cookie-domain" yaml:"cookie-domain"`
+	// PermittedCookieDomains are the domains a templated cookie domain is permitted to expand to
+	PermittedCookieDomains []string `json:"permitted-cookie-domains" yaml:"permitted-cookie-domains"`
 	// CookieAccessName is the name of the access cookie holding the access token
 	CookieAccessName string `json:"cookie-access-name" yaml:"cookie-access-name"`
 	// CookieRefreshName is the name of the refresh cookie
 	CookieRefreshName string `json:"cookie-refresh-name" yaml:"cookie-refresh-name"`
+	// CookieBindingName is the name of the cookie holding the encrypted session binding
+	CookieBindingName string `json:"cookie-binding-name" yaml:"cookie-binding-name"`
+	// CookieKerberosName is the name of the cookie holding the encrypted kerberos session
+	CookieKerberosName string `json:"cookie-kerberos-name" yaml:"cookie-kerberos-name"`
+	// CookieSAMLName is the name of the cookie holding the encrypted saml session
+	CookieSAMLName string `json:"cookie-saml-name" yaml:"cookie-saml-name"`
+	// CookiePKCEName is the name of the cookie holding the encrypted pkce code verifier through the login
+	CookiePKCEName string `json:"cookie-pkce-name" yaml:"cookie-pkce-name"`
+	// CookieNonceName is the name of the cookie holding the secret of the nonce through the login
+	CookieNonceName string `json:"cookie-nonce-name" yaml:"cookie-nonce-name"`
+	// CookieIDTokenName is the name of the cookie holding the identity token, the hint of the logout redirect
+	CookieIDTokenName string `json:"cookie-id-token-name" yaml:"cookie-id-token-name"`
 	// SecureCookie enforces the cookie as secure
 	SecureCookie bool `json:"secure-cookie" yaml:"secure-cookie"`
 
 	// IdleDuration is the max amount of time a session can last without being used
 	IdleDuration time.Duration `json:"idle-duration" yaml:"idle-duration"`
+	// SkewTolerance is the skew tolerated between the clocks of the provider and the proxy on the expiration and not
+	// before of the tokens
+	SkewTolerance time.Duration `json:"skew-tolerance" yaml:"skew-tolerance"`
 	// MatchClaims is a series of checks, the claims in the token must match those here
 	MatchClaims map[string]string `json:"match-claims" yaml:"match-claims"`
 	// AddClaims is a series of claims that should be added to the auth headers
@@ -145,34 +457,269 @@ type Config struct {
 	TLSCertificate string `json:"tls-cert" yaml:"tls-cert"`
 	// TLSPrivateKey is the location of a tls private key
 	TLSPrivateKey string `json:"tls-private-key" yaml:"tls-private-key"`
+	// TLSCertificates are additional certificate pairs selected by the server name of the client
+	TLSCertificates []TLSCertificatePair `json:"tls-certificates" yaml:"tls-certificates"`
+	// EnableOCSPStapling fetches and staples the ocsp responses for the tls certificates
+	EnableOCSPStapling bool `json:"enable-ocsp-stapling" yaml:"enable-ocsp-stapling"`
 	// TLSCaCertificate is the CA certificate which the client cert must be signed
 	TLSCaCertificate string `json:"tls-ca-certificate" yaml:"tls-ca-certificate"`
+	// TLSClientCRL is the path to the certificate revocation lists the client certs are checked against
+	TLSClientCRL string `json:"tls-client-crl" yaml:"tls-client-crl"`
+	// EnableTLSClientOCSP checks the client certs with the ocsp responder in the certificate
+	EnableTLSClientOCSP bool `json:"enable-tls-client-ocsp" yaml:"enable-tls-client-ocsp"`
+	// TLSRevocationFailureMode is either open or closed, i.e. whether to permit a client cert when the revocation status is unknown
+	TLSRevocationFailureMode string `json:"tls-revocation-failure-mode" yaml:"tls-revocation-failure-mode"`
 	// TLSClientCertificate is path to a client certificate to use for outbound connections
 	TLSClientCertificate string `json:"tls-client-certificate" yaml:"tls-client-certificate"`
-	// SkipUpstreamTLSVerify skips the verification of any upstream tls
+	// SpiffeEndpointSocket is the spiffe workload api socket the upstream and idp client certificate is retrieved from
+	SpiffeEndpointSocket string `json:"spiffe-endpoint-socket" yaml:"spiffe-endpoint-socket"`
+	// SkipUpstreamTLSVerify skips the verification of any upstream tls without settings in UpstreamTLS
 	SkipUpstreamTLSVerify bool `json:"skip-upstream-tls-verify" yaml:"skip-upstream-tls-verify"`
+	// UpstreamTLS is a list of tls verification settings per upstream
+	UpstreamTLS []*UpstreamTLS `json:"upstream-tls" yaml:"upstream-tls"`
 
 	// CrossOrigin permits adding headers to the /oauth handlers
 	CrossOrigin CORS `json:"cors" yaml:"cors"`
 
 	// Hostname is a list of hostname's the service should response to
 	Hostnames []string `json:"hostnames" yaml:"hostnames"`
+	// VirtualHosts is a list of hosts with their own upstream and resources
+	VirtualHosts []*VirtualHost `json:"virtual-hosts" yaml:"virtual-hosts"`
 
 	// Store is a url for a store resource, used to hold the refresh tokens
 	StoreURL string `json:"store-url" yaml:"store-url"`
+	// StoreCACertificate is the ca certificate redis is verified against on a rediss store url
+	StoreCACertificate string `json:"store-ca-certificate" yaml:"store-ca-certificate"`
+	// StoreClientCertificate is the client certificate presented to redis on a rediss store url
+	StoreClientCertificate string `json:"store-client-certificate" yaml:"store-client-certificate"`
+	// StoreClientPrivateKey is the private key of the client certificate
+	StoreClientPrivateKey string `json:"store-client-private-key" yaml:"store-client-private-key"`
+	// StorePoolSize is the maximum number of connections to redis
+	StorePoolSize int `json:"store-pool-size" yaml:"store-pool-size"`
+	// BindSessionIP binds the session to the network of the client address
+	BindSessionIP bool `json:"bind-session-ip" yaml:"bind-session-ip"`
+	// BindSessionIPv4Prefix is the prefix length of the ipv4 network the session is bound to
+	BindSessionIPv4Prefix int `json:"bind-session-ipv4-prefix" yaml:"bind-session-ipv4-prefix"`
+	// BindSessionIPv6Prefix is the prefix length of the ipv6 network the session is bound to
+	BindSessionIPv6Prefix int `json:"bind-session-ipv6-prefix" yaml:"bind-session-ipv6-prefix"`
+	// BindSessionUserAgent binds the session to the user agent of the client
+	BindSessionUserAgent bool `json:"bind-session-user-agent" yaml:"bind-session-user-agent"`
+	// MaxSessions is the maximum number of concurrent sessions per user, requires a store
+	MaxSessions int `json:"max-sessions" yaml:"max-sessions"`
+	// SessionLimitAction is the action taken when the limit is reached, reject or evict-oldest
+	SessionLimitAction string `json:"session-limit-action" yaml:"session-limit-action"`
 	// EncryptionKey is the encryption key used to encrypt the refresh token
 	EncryptionKey string `json:"encryption-key" yaml:"encryption-key"`
 
+	// EnableCacheHeaders marks the authenticated responses as private to any shared caches
+	EnableCacheHeaders bool `json:"enable-cache-headers" yaml:"enable-cache-headers"`
+	// CacheControl is the cache control applied to the authenticated responses
+	CacheControl string `json:"cache-control" yaml:"cache-control"`
+
+	// SignedURLKey is the key used to sign the urls of the signed url resources
+	SignedURLKey string `json:"signed-url-key" yaml:"signed-url-key"`
+	// SignedURLDuration is the maximum duration a signed url is valid for, rounded down to a quarter of this
+	SignedURLDuration time.Duration `json:"signed-url-duration" yaml:"signed-url-duration"`
+
+	// BreakGlassKey is the key used to sign the break glass tokens, disabled if empty
+	BreakGlassKey string `json:"break-glass-key" yaml:"break-glass-key"`
+	// BreakGlassMaxDuration is the maximum lifetime of a break glass token
+	BreakGlassMaxDuration time.Duration `json:"break-glass-max-duration" yaml:"break-glass-max-duration"`
+	// BreakGlassRateLimit is the maximum number of break glass requests per minute
+	BreakGlassRateLimit int `json:"break-glass-rate-limit" yaml:"break-glass-rate-limit"`
+
+	// SPNEGOKeytab is the keytab of the service, enabling the kerberos negotiation on the resources opting in
+	SPNEGOKeytab string `json:"spnego-keytab" yaml:"spnego-keytab"`
+	// SPNEGORoles maps the kerberos principals, or realms i.e. @EXAMPLE.COM, to a comma separated list of roles
+	SPNEGORoles map[string]string `json:"spnego-roles" yaml:"spnego-roles"`
+
+	// SAMLMetadataURL is the url or file of the saml metadata of the identity provider, running the proxy as a saml
+	// service provider in place of openid, the client id being the entity id of the service provider
+	SAMLMetadataURL string `json:"saml-idp-metadata-url" yaml:"saml-idp-metadata-url"`
+	// SAMLRolesAttribute is the attribute of the assertion holding the roles of the user
+	SAMLRolesAttribute string `json:"saml-roles-attribute" yaml:"saml-roles-attribute"`
+	// SAMLSessionDuration is the duration of the session when the assertion has no session expiry
+	SAMLSessionDuration time.Duration `json:"saml-session-duration" yaml:"saml-session-duration"`
+	// EdgeAuthentication consumes the identity asserted by the edge, aws-alb or cloudflare-access, in place of the login
+	EdgeAuthentication string `json:"edge-authentication" yaml:"edge-authentication"`
+	// EdgeALBArn is the arn of the load balancer signing the x-amzn-oidc-data
+	EdgeALBArn string `json:"edge-alb-arn" yaml:"edge-alb-arn"`
+	// EdgeCloudflareTeamDomain is the team domain of cloudflare access, i.e. <team>.cloudflareaccess.com
+	EdgeCloudflareTeamDomain string `json:"edge-cloudflare-team-domain" yaml:"edge-cloudflare-team-domain"`
+	// EdgeAudience is the audience (application aud tag) of the cloudflare access jwt
+	EdgeAudience string `json:"edge-audience" yaml:"edge-audience"`
+	// EdgeKeysURL overrides the url of the signing keys of the edge
+	EdgeKeysURL string `json:"edge-keys-url" yaml:"edge-keys-url"`
+
+	// EnableIdPGrace permits the tokens verified with the last known keys while the provider is unreachable
+	EnableIdPGrace bool `json:"enable-idp-grace" yaml:"enable-idp-grace"`
+	// EnableDiscoveryProxy serves the discovery document and keys of the provider under the oauth handlers
+	EnableDiscoveryProxy bool `json:"enable-discovery-proxy" yaml:"enable-discovery-proxy"`
+	// TokenPassthroughClients are the client ids whose token requests are passed through to the provider
+	TokenPassthroughClients []string `json:"token-passthrough-clients" yaml:"token-passthrough-clients"`
+	// TokenPassthroughRateLimit is the maximum number of token requests passed through per client per minute
+	TokenPassthroughRateLimit int `json:"token-passthrough-rate-limit" yaml:"token-passthrough-rate-limit"`
+	// IdPGracePeriod is the maximum time since the keys were last retrieved the grace applies
+	IdPGracePeriod time.Duration `json:"idp-grace-period" yaml:"idp-grace-period"`
+	// EnableJWKSCache caches the signing keys of the provider, retrieving them again on a unknown key id
+	EnableJWKSCache bool `json:"enable-jwks-cache" yaml:"enable-jwks-cache"`
+	// JWKSMinRefreshInterval is the minimum interval between the retrievals of the signing keys on a unknown key id
+	JWKSMinRefreshInterval time.Duration `json:"jwks-min-refresh-interval" yaml:"jwks-min-refresh-interval"`
+	// JWKSRefreshInterval is the interval the signing keys are retrieved in the background, disabled if zero
+	JWKSRefreshInterval time.Duration `json:"jwks-refresh-interval" yaml:"jwks-refresh-interval"`
+
 	// EnableSecurityFilter enabled the security handler
 	EnableSecurityFilter bool `json:"enable-security-filter" yaml:"enable-security-filter"`
+	// SecurityFilter are the options of the security filter
+	SecurityFilter SecurityFilter `json:"security-filter" yaml:"security-filter"`
 	// EnableRefreshTokens indicate's you wish to ignore using refresh tokens and re-auth on expiration of access token
 	EnableRefreshTokens bool `json:"enable-refresh-tokens" yaml:"enable-refresh-tokens"`
+	// ListenAdmin is the interface the admin api should listen on, disabled if empty
+	ListenAdmin string `json:"listen-admin" yaml:"listen-admin"`
+	// AdminToken is a bearer token required to call the admin api
+	AdminToken string `json:"admin-token" yaml:"admin-token"`
+	// ExtAuthzListen is the interface of the envoy external authorization (ext_authz) grpc service, disabled if empty
+	ExtAuthzListen string `json:"ext-authz-listen" yaml:"ext-authz-listen"`
 	// LogRequests indicates if we should log all the requests
 	LogRequests bool `json:"log-requests" yaml:"log-requests"`
 	// LogFormat is the logging format
 	LogJSONFormat bool `json:"log-json-format" yaml:"log-json-format"`
+	// LogRedactQueryParams is a list of query parameters, in addition to the defaults, redacted in the request log
+	LogRedactQueryParams []string `json:"log-redact-query-params" yaml:"log-redact-query-params"`
+	// LogRequestHeaders is a list of request headers to include in the request log, credentials are redacted
+	LogRequestHeaders []string `json:"log-request-headers" yaml:"log-request-headers"`
+	// LogSampleRates is a map of path prefix to the fraction of requests logged, server errors are always logged
+	LogSampleRates map[string]float64 `json:"log-sample-rates" yaml:"log-sample-rates"`
+	// LogMetadata adds the hostname, pod, namespace, node and availability zone to the logs and audit events
+	LogMetadata bool `json:"log-metadata" yaml:"log-metadata"`
+	// LogMetadataService queries the ecs and ec2 metadata services for the task and availability zone
+	LogMetadataService bool `json:"log-metadata-service" yaml:"log-metadata-service"`
 	// NoRedirects informs we should hand back a 401 not a redirect
 	NoRedirects bool `json:"no-redirects" yaml:"no-redirects"`
+	// EnableBearerChallenge adds the bearer challenge (rfc 6750) to the unauthorized responses
+	EnableBearerChallenge bool `json:"enable-bearer-challenge" yaml:"enable-bearer-challenge"`
+	// BearerRealm is the realm of the bearer challenge
+	BearerRealm string `json:"bearer-realm" yaml:"bearer-realm"`
+	// BearerErrorDescription includes the reason the access token was refused in the bearer challenge
+	BearerErrorDescription bool `json:"bearer-error-description" yaml:"bearer-error-description"`
+	// PreserveFragments uses a small script to carry the url fragment through the login
+	PreserveFragments bool `json:"preserve-fragments" yaml:"preserve-fragments"`
+	// EnableSignedState carries the login state in a signed state parameter, without the need for any cookie
+	EnableSignedState bool `json:"enable-signed-state" yaml:"enable-signed-state"`
+	// EnablePKCE requires a proof key (rfc 7636) on the authorization code exchange
+	EnablePKCE bool `json:"enable-pkce" yaml:"enable-pkce"`
+	// EnableNonce binds the identity token of the login to the browser by a nonce, defaults to true
+	EnableNonce bool `json:"enable-nonce" yaml:"enable-nonce"`
+	// AuthorizationClaims is the claims request parameter (json) added to the authorization request
+	AuthorizationClaims string `json:"authorization-claims" yaml:"authorization-claims"`
+	// UILocales are the preferred locales of the login page, space separated
+	UILocales string `json:"ui-locales" yaml:"ui-locales"`
+	// LoginHint is the hint of the user logging in added to the authorization request
+	LoginHint string `json:"login-hint" yaml:"login-hint"`
+	// EnableLoginHintPropagation passes the login_hint of the unauthenticated requests through to the provider
+	EnableLoginHintPropagation bool `json:"enable-login-hint-propagation" yaml:"enable-login-hint-propagation"`
+	// LoginHintHeader is a header the login hint is taken from when the request has no login_hint parameter
+	LoginHintHeader string `json:"login-hint-header" yaml:"login-hint-header"`
+	// IDPHint is the identity provider keycloak brokers the login to, added as the kc_idp_hint
+	IDPHint string `json:"idp-hint" yaml:"idp-hint"`
+	// Prompt asks the provider to prompt the user for the login, consent or account, or not at all
+	Prompt string `json:"prompt" yaml:"prompt"`
+	// AuthenticationMaxAge is the time since the user last authenticated after which the provider reauthenticates
+	AuthenticationMaxAge time.Duration `json:"authentication-max-age" yaml:"authentication-max-age"`
+	// AuthorizationParamsPassthrough are the parameters of the login passed through to the authorization request
+	AuthorizationParamsPassthrough []string `json:"authorization-params-passthrough" yaml:"authorization-params-passthrough"`
+	// ACRLevels are the authentication context classes ordered from the weakest to the strongest
+	ACRLevels []string `json:"acr-levels" yaml:"acr-levels"`
+	// EnableDeviceAuthorization accepts the device authorization grant (rfc 8628) for the headless clients
+	EnableDeviceAuthorization bool `json:"enable-device-authorization" yaml:"enable-device-authorization"`
+	// DeviceAuthorizationURL is the device authorization endpoint, defaults to the authorization endpoint suffixed by /device
+	DeviceAuthorizationURL string `json:"device-authorization-url" yaml:"device-authorization-url"`
+	// EnableCallbackReplayProtection rejects the authorization codes and signed states already used on the callback
+	EnableCallbackReplayProtection bool `json:"enable-callback-replay-protection" yaml:"enable-callback-replay-protection"`
+	// CallbackReplayWindow is the time the used authorization codes are tracked for
+	CallbackReplayWindow time.Duration `json:"callback-replay-window" yaml:"callback-replay-window"`
+	// EnableBackchannelLogout accepts the logout tokens of the provider (openid connect back-channel logout)
+	EnableBackchannelLogout bool `json:"enable-backchannel-logout" yaml:"enable-backchannel-logout"`
+	// BackchannelLogoutTTL is the time the logged out sessions are held for, at least the session lifetime
+	BackchannelLogoutTTL time.Duration `json:"backchannel-logout-ttl" yaml:"backchannel-logout-ttl"`
+	// EnableFrontchannelLogout clears the cookies of the sessions logged out by the provider in a iframe (openid connect front-channel logout)
+	EnableFrontchannelLogout bool `json:"enable-frontchannel-logout" yaml:"enable-frontchannel-logout"`
+	// FrontchannelLogoutSessionRequired only logs out the sessions named by the issuer and session of the request
+	FrontchannelLogoutSessionRequired bool `json:"frontchannel-logout-session-required" yaml:"frontchannel-logout-session-required"`
+	// SignedStateDuration is the time the user has to complete the login with the provider
+	SignedStateDuration time.Duration `json:"signed-state-duration" yaml:"signed-state-duration"`
+	// LoginLoopThreshold is the number of logins without a session permitted within the window, zero disables
+	LoginLoopThreshold int `json:"login-loop-threshold" yaml:"login-loop-threshold"`
+	// LoginLoopWindow is the window the logins of a client are counted in
+	LoginLoopWindow time.Duration `json:"login-loop-window" yaml:"login-loop-window"`
+	// TokenCacheSize is the number of successful token validations cached, zero disables
+	TokenCacheSize int `json:"token-cache-size" yaml:"token-cache-size"`
+	// TokenCacheTTL is the maximum time a token validation is cached for
+	TokenCacheTTL time.Duration `json:"token-cache-ttl" yaml:"token-cache-ttl"`
+	// MaxTokenSize is the maximum size in bytes of the tokens presented by the clients, zero disables
+	MaxTokenSize int `json:"max-token-size" yaml:"max-token-size"`
+	// MaxTokenClaims is the maximum number of claims of the tokens presented by the clients, zero disables
+	MaxTokenClaims int `json:"max-token-claims" yaml:"max-token-claims"`
+	// MaxTokenDepth is the maximum nesting depth of the claims of the tokens presented by the clients, zero disables
+	MaxTokenDepth int `json:"max-token-depth" yaml:"max-token-depth"`
+	// EnableTokenCacheStore shares the token validations between the instances via the store
+	EnableTokenCacheStore bool `json:"enable-token-cache-store" yaml:"enable-token-cache-store"`
+	// EnableTokenIntrospection validates the opaque bearer tokens with the introspection endpoint of the provider
+	EnableTokenIntrospection bool `json:"enable-token-introspection" yaml:"enable-token-introspection"`
+	// IntrospectionURL is the introspection endpoint, defaults to the token endpoint suffixed by /introspect
+	IntrospectionURL string `json:"introspection-url" yaml:"introspection-url"`
+	// IntrospectionCacheSize is the number of introspection results cached, zero disables
+	IntrospectionCacheSize int `json:"introspection-cache-size" yaml:"introspection-cache-size"`
+	// IntrospectionCacheTTL is the maximum time a introspection result is cached for
+	IntrospectionCacheTTL time.Duration `json:"introspection-cache-ttl" yaml:"introspection-cache-ttl"`
+	// EnableTokenExchange exchanges the access token for one of the upstream audience (rfc 8693) before proxying
+	EnableTokenExchange bool `json:"enable-token-exchange" yaml:"enable-token-exchange"`
+	// TokenExchangeAudience is the audience, i.e. the client id of the upstream, the tokens are exchanged for
+	TokenExchangeAudience string `json:"token-exchange-audience" yaml:"token-exchange-audience"`
+	// TokenExchangeClientID is the client performing the exchange, defaults to the client id
+	TokenExchangeClientID string `json:"token-exchange-client-id" yaml:"token-exchange-client-id"`
+	// TokenExchangeClientSecret is the secret of the client performing the exchange
+	TokenExchangeClientSecret string `json:"token-exchange-client-secret" yaml:"token-exchange-client-secret"`
+	// TokenExchangeCacheSize is the number of exchanged tokens cached by the subject, zero disables
+	TokenExchangeCacheSize int `json:"token-exchange-cache-size" yaml:"token-exchange-cache-size"`
+	// EnableUMA authorizes the requests by the permissions of the keycloak authorization services, not the roles
+	EnableUMA bool `json:"enable-uma" yaml:"enable-uma"`
+	// UMAAudience is the client holding the resources and policies, defaults to the client id
+	UMAAudience string `json:"uma-audience" yaml:"uma-audience"`
+	// UMACacheSize is the number of permissions cached by the access token, zero disables
+	UMACacheSize int `json:"uma-cache-size" yaml:"uma-cache-size"`
+	// UMACacheTTL is the maximum time the permissions are cached for
+	UMACacheTTL time.Duration `json:"uma-cache-ttl" yaml:"uma-cache-ttl"`
+	// EnrichmentURL is the ldap directory (ldap or ldaps) or scim endpoint (http or https) the attributes of the users are looked up in
+	EnrichmentURL string `json:"enrichment-url" yaml:"enrichment-url"`
+	// EnrichmentClaim is the claim of the token the users are looked up by
+	EnrichmentClaim string `json:"enrichment-claim" yaml:"enrichment-claim"`
+	// EnrichmentLookupAttribute is the attribute of the directory matched to the claim, defaults to uid or userName
+	EnrichmentLookupAttribute string `json:"enrichment-lookup-attribute" yaml:"enrichment-lookup-attribute"`
+	// EnrichmentAttributes are the attributes added to the claims, as attribute or attribute=claim
+	EnrichmentAttributes []string `json:"enrichment-attributes" yaml:"enrichment-attributes"`
+	// EnrichmentBaseDN is the dn the users are searched under in the ldap directory
+	EnrichmentBaseDN string `json:"enrichment-base-dn" yaml:"enrichment-base-dn"`
+	// EnrichmentBindDN is the dn the proxy binds to the ldap directory as, anonymous when empty
+	EnrichmentBindDN string `json:"enrichment-bind-dn" yaml:"enrichment-bind-dn"`
+	// EnrichmentBindPassword is the password of the bind dn
+	EnrichmentBindPassword string `json:"enrichment-bind-password" yaml:"enrichment-bind-password"`
+	// EnrichmentToken is the bearer token of the scim endpoint
+	EnrichmentToken string `json:"enrichment-token" yaml:"enrichment-token"`
+	// EnrichmentTimeout is the time permitted for a lookup
+	EnrichmentTimeout time.Duration `json:"enrichment-timeout" yaml:"enrichment-timeout"`
+	// EnrichmentCacheSize is the number of users the attributes are cached for, zero disables
+	EnrichmentCacheSize int `json:"enrichment-cache-size" yaml:"enrichment-cache-size"`
+	// EnrichmentCacheTTL is the time the attributes of a user are cached for
+	EnrichmentCacheTTL time.Duration `json:"enrichment-cache-ttl" yaml:"enrichment-cache-ttl"`
+	// UnauthenticatedCacheSize is the number of request uris the authorization state is cached for, zero disables
+	UnauthenticatedCacheSize int `json:"unauthenticated-cache-size" yaml:"unauthenticated-cache-size"`
+	// UnauthenticatedCacheTTL is the time the authorization state of a request uri is cached for
+	UnauthenticatedCacheTTL time.Duration `json:"unauthenticated-cache-ttl" yaml:"unauthenticated-cache-ttl"`
+	// EnableDPoP validates the proof of possession for dpop bound access tokens
+	EnableDPoP bool `json:"enable-dpop" yaml:"enable-dpop"`
+	// EnableXHRLogin hands back a 401 with the login url to xhr requests rather than a redirect
+	EnableXHRLogin bool `json:"enable-xhr-login" yaml:"enable-xhr-login"`
 	// SkipTokenVerification tells the service to skipp verifying the access token - for testing purposes
 	SkipTokenVerification bool `json:"skip-token-verification" yaml:"skip-token-verification"`
 	// UpstreamKeepalives specifies whether we use keepalives on the upstream
@@ -181,10 +728,54 @@ type Config struct {
 	UpstreamTimeout time.Duration `json:"upstream-timeout" yaml:"upstream-timeout"`
 	// UpstreamKeepaliveTimeout
 	UpstreamKeepaliveTimeout time.Duration `json:"upstream-keepalive-timeout" yaml:"upstream-keepalive-timeout"`
+	// UpstreamAttemptTimeout is the maximum time a connection to one of the addresses of the upstream is attempted for
+	UpstreamAttemptTimeout time.Duration `json:"upstream-attempt-timeout" yaml:"upstream-attempt-timeout"`
+	// UpstreamIdleTimeout is the duration a idle upstream connection is kept before being reaped
+	UpstreamIdleTimeout time.Duration `json:"upstream-idle-timeout" yaml:"upstream-idle-timeout"`
+	// UpstreamMaxIdleConnections is the maximum number of idle upstream connections kept across all hosts
+	UpstreamMaxIdleConnections int `json:"upstream-max-idle-connections" yaml:"upstream-max-idle-connections"`
+	// UpstreamMaxIdleConnectionsPerHost is the maximum number of idle upstream connections kept per host
+	UpstreamMaxIdleConnectionsPerHost int `json:"upstream-max-idle-connections-per-host" yaml:"upstream-max-idle-connections-per-host"`
+	// UpstreamMaxHeaderSize is the maximum size in bytes of the headers forwarded to the upstream
+	UpstreamMaxHeaderSize int `json:"upstream-max-header-size" yaml:"upstream-max-header-size"`
+	// UpstreamMaxHeaders is the maximum number of headers forwarded to the upstream
+	UpstreamMaxHeaders int `json:"upstream-max-headers" yaml:"upstream-max-headers"`
+	// UpstreamHeaderCasing is a list of header names in the casing expected by the upstream
+	UpstreamHeaderCasing []string `json:"upstream-header-casing" yaml:"upstream-header-casing"`
+	// MaxUploadRate is the maximum rate in bytes per second a request body is read, zero disables
+	MaxUploadRate int64 `json:"max-upload-rate" yaml:"max-upload-rate"`
+	// MaxDownloadRate is the maximum rate in bytes per second a response is written, zero disables
+	MaxDownloadRate int64 `json:"max-download-rate" yaml:"max-download-rate"`
+	// MaxTransferDuration is the maximum duration of a proxied request, zero disables
+	MaxTransferDuration time.Duration `json:"max-transfer-duration" yaml:"max-transfer-duration"`
+	// EnableDeadlinePropagation passes the time remaining of the max transfer duration to the upstream as headers
+	EnableDeadlinePropagation bool `json:"enable-deadline-propagation" yaml:"enable-deadline-propagation"`
+	// MaxBodyInspectionSize is the maximum size in bytes of the request bodies inspected for the body claims
+	MaxBodyInspectionSize int64 `json:"max-body-inspection-size" yaml:"max-body-inspection-size"`
+	// MaxUpgradedConnections is the maximum upgraded connections and event streams open in total, zero disables
+	MaxUpgradedConnections int `json:"max-upgraded-connections" yaml:"max-upgraded-connections"`
+	// MaxUpgradedConnectionsPerUser is the maximum upgraded connections and event streams open per user, zero disables
+	MaxUpgradedConnectionsPerUser int `json:"max-upgraded-connections-per-user" yaml:"max-upgraded-connections-per-user"`
+	// DedupeForwardedHeaders collapses duplicate forwarding headers before proxying upstream
+	DedupeForwardedHeaders bool `json:"dedupe-forwarded-headers" yaml:"dedupe-forwarded-headers"`
+	// EnablePathNormalization cleans the request path before matching resources and proxying
+	EnablePathNormalization bool `json:"enable-path-normalization" yaml:"enable-path-normalization"`
+	// CaseInsensitivePaths performs the resource matching irrespective of case
+	CaseInsensitivePaths bool `json:"case-insensitive-paths" yaml:"case-insensitive-paths"`
+	// MethodOverride controls the handling of method overrides, either reject or normalize
+	MethodOverride string `json:"method-override" yaml:"method-override"`
+	// HeadMethod controls the protection of the head requests, either exact, enforce, match-get or allow
+	HeadMethod string `json:"head-method" yaml:"head-method"`
+	// OptionsMethod controls the protection of the options requests, either exact, enforce, match-get or allow
+	OptionsMethod string `json:"options-method" yaml:"options-method"`
 	// Verbose switches on debug logging
 	Verbose bool `json:"verbose" yaml:"verbose"`
 	// EnableProxyProtocol controls the proxy protocol
 	EnableProxyProtocol bool `json:"enabled-proxy-protocol" yaml:"enabled-proxy-protocol"`
+	// UpstreamProxyProtocol sends a proxy protocol v2 header with the client address on the upstream connections
+	UpstreamProxyProtocol bool `json:"upstream-proxy-protocol" yaml:"upstream-proxy-protocol"`
+	// EnableGRPCWeb translates the grpc-web requests of the browsers to grpc, over http/2 to the upstream
+	EnableGRPCWeb bool `json:"enable-grpc-web" yaml:"enable-grpc-web"`
 
 	// SignInPage is the relative url for the sign in page
 	SignInPage string `json:"sign-in-page" yaml:"sign-in-page"`
@@ -195,6 +786,8 @@ type Config struct {
 
 	// EnableForwarding enables the forwarding proxy
 	EnableForwarding bool `json:"enable-forwarding" yaml:"enable-forwarding"`
+	// ForwardingGrantType is the grant the access token is requested by, either password or client_credentials
+	ForwardingGrantType string `json:"forwarding-grant-type" yaml:"forwarding-grant-type"`
 	// ForwardingUsername is the username to login to the oauth service
 	ForwardingUsername string `json:"forwarding-username" yaml:"forwarding-username"`
 	// ForwardingPassword is the password to use for the above
@@ -216,6 +809,12 @@ type storage interface {
 	Close() error
 }
 
+// directory is a external directory of the attributes of the users
+type directory interface {
+	// lookup returns the attributes of the user matching the value, none when there's no such user
+	lookup(string) (map[string]interface{}, error)
+}
+
 // tokenResponse
 type tokenResponse struct {
 	TokenType    string `json:"token_type"`
@@ -225,3 +824,17 @@ type tokenResponse struct {
 	ExpiresIn    int    `json:"expires_in"`
 	Scope        string `json:"scope,omitempty"`
 }
+
+// loginRequiredResponse is handed back to xhr requests requiring authentication
+type loginRequiredResponse struct {
+	Error    string `json:"error"`
+	LoginURL string `json:"login_url"`
+}
+
+// buildInfo is the version and build information of the proxy
+type buildInfo struct {
+	Version   string `json:"version"`
+	GitSHA    string `json:"gitsha"`
+	BuildTime string `json:"build_time"`
+	GoVersion string `json:"go_version"`
+}
@@ -0,0 +1,310 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	dpopHeader    = "DPoP"
+	dpopScheme    = "DPoP"
+	dpopProofType = "dpop+jwt"
+
+	claimConfirmation  = "cnf"
+	claimJWKThumbprint = "jkt"
+
+	// dpopProofMaxAge is how long a proof is accepted for after being issued
+	dpopProofMaxAge = time.Duration(60) * time.Second
+	// dpopClockSkew is the tolerance for proofs issued by clients with a fast clock
+	dpopClockSkew = time.Duration(5) * time.Second
+)
+
+//
+// dpopVerifier validates the proof of possession for dpop bound access tokens
+//
+type dpopVerifier struct {
+	sync.Mutex
+	// the identifiers of the proofs already seen
+	seen map[string]time.Time
+}
+
+//
+// dpopProofHeader is the jose header of a dpop proof
+//
+type dpopProofHeader struct {
+	Type      string  `json:"typ"`
+	Algorithm string  `json:"alg"`
+	JWK       dpopJWK `json:"jwk"`
+}
+
+//
+// dpopJWK is the public key embedded in the proof
+//
+type dpopJWK struct {
+	KeyType string `json:"kty"`
+	Curve   string `json:"crv"`
+	X       string `json:"x"`
+	Y       string `json:"y"`
+	Modulus string `json:"n"`
+	Exp     string `json:"e"`
+}
+
+//
+// dpopProofClaims are the claims of a dpop proof
+//
+type dpopProofClaims struct {
+	ID          string `json:"jti"`
+	Method      string `json:"htm"`
+	URL         string `json:"htu"`
+	IssuedAt    int64  `json:"iat"`
+	AccessToken string `json:"ath"`
+}
+
+//
+// newDPoPVerifier creates a new verifier
+//
+func newDPoPVerifier() *dpopVerifier {
+	return &dpopVerifier{seen: make(map[string]time.Time, 0)}
+}
+
+//
+// verifyDPoP checks the proof of possession for the token in the request; tokens bound to a key via the cnf claim
+// must be presented with the dpop scheme and a valid proof, unbound tokens are only rejected when required
+//
+func (r *oauthProxy) verifyDPoP(cx *gin.Context, user *userContext, required bool) error {
+	scheme := strings.SplitN(cx.Request.Header.Get(authorizationHeader), " ", 2)[0]
+	thumbprint := ""
+	if cnf, found := user.claims[claimConfirmation].(map[string]interface{}); found {
+		thumbprint, _ = cnf[claimJWKThumbprint].(string)
+	}
+
+	switch {
+	case thumbprint == "" && !strings.EqualFold(scheme, dpopScheme):
+		if required {
+			return errors.New("the resource requires a dpop bound access token")
+		}
+		return nil
+	case thumbprint == "":
+		return errors.New("the access token is not bound to a key")
+	case !strings.EqualFold(scheme, dpopScheme):
+		return errors.New("the dpop bound access token must use the dpop authorization scheme")
+	}
+
+	proofs := cx.Request.Header[http.CanonicalHeaderKey(dpopHeader)]
+	if len(proofs) != 1 {
+		return errors.New("the request must have a single dpop proof")
+	}
+
+	return r.dpop.verify(proofs[0], user.getAccessToken(), thumbprint, cx.Request.Method, getRequestURL(cx), time.Now())
+}
+
+//
+// verify validates the proof against the request and the thumbprint of the key the token is bound to
+//
+func (r *dpopVerifier) verify(proof, token, thumbprint, method string, location *url.URL, now time.Time) error {
+	parts := strings.Split(proof, ".")
+	if len(parts) != 3 {
+		return errors.New("the dpop proof is malformed")
+	}
+
+	// step: decode the header and the claims
+	var header dpopProofHeader
+	if err := decodeJWTSegment(parts[0], &header); err != nil {
+		return fmt.Errorf("unable to decode the dpop proof header, %s", err)
+	}
+	var claims dpopProofClaims
+	if err := decodeJWTSegment(parts[1], &claims); err != nil {
+		return fmt.Errorf("unable to decode the dpop proof claims, %s", err)
+	}
+	if header.Type != dpopProofType {
+		return fmt.Errorf("the dpop proof type: %s is invalid", header.Type)
+	}
+
+	// step: the proof must be signed by the key the token is bound to
+	jkt, err := header.JWK.thumbprint()
+	if err != nil {
+		return err
+	}
+	if jkt != thumbprint {
+		return errors.New("the dpop proof key does not match the access token binding")
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return errors.New("the dpop proof signature is malformed")
+	}
+	if err := header.JWK.verify(header.Algorithm, []byte(parts[0]+"."+parts[1]), signature); err != nil {
+		return err
+	}
+
+	// step: the proof must be for this request and this token
+	if !strings.EqualFold(claims.Method, method) {
+		return fmt.Errorf("the dpop proof method: %s does not match the request", claims.Method)
+	}
+	htu, err := url.Parse(claims.URL)
+	if err != nil || !strings.EqualFold(htu.Scheme, location.Scheme) || !strings.EqualFold(htu.Host, location.Host) || htu.Path != location.Path {
+		return fmt.Errorf("the dpop proof url: %s does not match the request", claims.URL)
+	}
+	hash := sha256.Sum256([]byte(token))
+	if claims.AccessToken != base64.RawURLEncoding.EncodeToString(hash[:]) {
+		return errors.New("the dpop proof is not for the access token")
+	}
+
+	// step: the proof must be fresh and not replayed
+	issued := time.Unix(claims.IssuedAt, 0)
+	if issued.After(now.Add(dpopClockSkew)) || now.Sub(issued) > dpopProofMaxAge {
+		return errors.New("the dpop proof has expired")
+	}
+	if claims.ID == "" {
+		return errors.New("the dpop proof has no identifier")
+	}
+
+	r.Lock()
+	defer r.Unlock()
+	for k, v := range r.seen {
+		if now.Sub(v) > dpopProofMaxAge+dpopClockSkew {
+			delete(r.seen, k)
+		}
+	}
+	if _, found := r.seen[claims.ID]; found {
+		return errors.New("the dpop proof has already been used")
+	}
+	r.seen[claims.ID] = issued
+
+	return nil
+}
+
+//
+// thumbprint returns the rfc7638 thumbprint of the key, the required members in lexicographic order
+//
+func (r dpopJWK) thumbprint() (string, error) {
+	var canonical string
+	switch r.KeyType {
+	case "EC":
+		canonical = fmt.Sprintf(`{"crv":%q,"kty":"EC","x":%q,"y":%q}`, r.Curve, r.X, r.Y)
+	case "RSA":
+		canonical = fmt.Sprintf(`{"e":%q,"kty":"RSA","n":%q}`, r.Exp, r.Modulus)
+	default:
+		return "", fmt.Errorf("the dpop key type: %s is not supported", r.KeyType)
+	}
+	hash := sha256.Sum256([]byte(canonical))
+
+	return base64.RawURLEncoding.EncodeToString(hash[:]), nil
+}
+
+//
+// verify checks the signature of the content with the key
+//
+func (r dpopJWK) verify(algorithm string, content, signature []byte) error {
+	hash := sha256.Sum256(content)
+
+	switch algorithm {
+	case "ES256":
+		if r.KeyType != "EC" || r.Curve != "P-256" {
+			return errors.New("the dpop proof algorithm does not match the key")
+		}
+		x, err := decodeBigInt(r.X)
+		if err != nil {
+			return err
+		}
+		y, err := decodeBigInt(r.Y)
+		if err != nil {
+			return err
+		}
+		key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
+		if len(signature) != 64 {
+			return errors.New("the dpop proof signature is invalid")
+		}
+		if !ecdsa.Verify(key, hash[:], new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])) {
+			return errors.New("the dpop proof signature is invalid")
+		}
+	case "RS256":
+		if r.KeyType != "RSA" {
+			return errors.New("the dpop proof algorithm does not match the key")
+		}
+		n, err := decodeBigInt(r.Modulus)
+		if err != nil {
+			return err
+		}
+		e, err := decodeBigInt(r.Exp)
+		if err != nil {
+			return err
+		}
+		key := &rsa.PublicKey{N: n, E: int(e.Int64())}
+		if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, hash[:], signature); err != nil {
+			return errors.New("the dpop proof signature is invalid")
+		}
+	default:
+		return fmt.Errorf("the dpop proof algorithm: %s is not supported", algorithm)
+	}
+
+	return nil
+}
+
+//
+// getRequestURL returns the url the client used to make the request, i.e. the htu of the proof
+//
+func getRequestURL(cx *gin.Context) *url.URL {
+	scheme := "http"
+	if cx.Request.TLS != nil {
+		scheme = "https"
+	}
+	if proto := cx.Request.Header.Get("X-Forwarded-Proto"); proto != "" {
+		scheme = proto
+	}
+
+	return &url.URL{Scheme: scheme, Host: cx.Request.Host, Path: cx.Request.URL.Path}
+}
+
+//
+// decodeJWTSegment decodes a base64url segment of a jwt into the value
+//
+func decodeJWTSegment(segment string, v interface{}) error {
+	content, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(segment, "="))
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(content, v)
+}
+
+//
+// decodeBigInt decodes a base64url encoded big endian integer
+//
+func decodeBigInt(v string) (*big.Int, error) {
+	content, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(v, "="))
+	if err != nil {
+		return nil, err
+	}
+
+	return new(big.Int).SetBytes(content), nil
+}
@@ -0,0 +1,372 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/coreos/go-oidc/jose"
+	"github.com/coreos/go-oidc/oidc"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// edgeAWSALB consumes the identity asserted by the authentication of a aws application load balancer
+	edgeAWSALB = "aws-alb"
+	// edgeCloudflareAccess consumes the identity asserted by cloudflare access
+	edgeCloudflareAccess = "cloudflare-access"
+
+	// headerALBIdentity is the header of the claims of the user signed by the load balancer
+	headerALBIdentity = "X-Amzn-Oidc-Data"
+	// headerCloudflareAssertion is the header of the jwt of the user signed by cloudflare access
+	headerCloudflareAssertion = "Cf-Access-Jwt-Assertion"
+
+	// edgeKeysRefreshInterval is the minimum interval between the requests for a unknown signing key
+	edgeKeysRefreshInterval = time.Duration(1) * time.Minute
+)
+
+//
+// edgeHeader is the header of the jwt asserted by the edge
+//
+type edgeHeader struct {
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid"`
+	Signer    string `json:"signer"`
+}
+
+//
+// edgeVerifier verifies the identity the edge in front of the proxy asserts in a header, i.e. the load balancer or
+// access gateway has already logged the user in, so the proxy enforces the resources without a login of its own
+//
+type edgeVerifier struct {
+	sync.RWMutex
+	// the client used to retrieve the signing keys
+	client *http.Client
+	// the edge, aws-alb or cloudflare-access
+	mode string
+	// the header the jwt is asserted in
+	header string
+	// the arn of the load balancer signing the jwt
+	signer string
+	// the issuer and audience of the cloudflare jwt
+	issuer   string
+	audience string
+	// the url of the signing keys, the key id being appended for the load balancer
+	keysURL string
+	// the signing keys keyed by the key id
+	keys map[string]crypto.PublicKey
+	// the last time the keys were requested
+	requested time.Time
+	// the skew tolerated between the clocks of the edge and the proxy
+	skew time.Duration
+}
+
+//
+// newEdgeVerifier creates the verification of the identities asserted by the edge
+//
+func newEdgeVerifier(config *Config, client *http.Client) (*edgeVerifier, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	r := &edgeVerifier{
+		client:   client,
+		mode:     config.EdgeAuthentication,
+		keysURL:  strings.TrimSuffix(config.EdgeKeysURL, "/"),
+		audience: config.EdgeAudience,
+		skew:     config.SkewTolerance,
+		keys:     make(map[string]crypto.PublicKey),
+	}
+	switch config.EdgeAuthentication {
+	case edgeAWSALB:
+		r.header = headerALBIdentity
+		r.signer = config.EdgeALBArn
+		if r.keysURL == "" {
+			// arn:aws:elasticloadbalancing:region:account:loadbalancer/app/name/id
+			items := strings.Split(config.EdgeALBArn, ":")
+			if len(items) < 6 || items[3] == "" {
+				return nil, fmt.Errorf("unable to derive the region from the load balancer arn: %s, set the edge-keys-url", config.EdgeALBArn)
+			}
+			r.keysURL = fmt.Sprintf("https://public-keys.auth.elb.%s.amazonaws.com", items[3])
+		}
+	case edgeCloudflareAccess:
+		domain := strings.TrimSuffix(strings.TrimPrefix(config.EdgeCloudflareTeamDomain, "https://"), "/")
+		r.header = headerCloudflareAssertion
+		r.issuer = "https://" + domain
+		if r.keysURL == "" {
+			r.keysURL = r.issuer + "/cdn-cgi/access/certs"
+		}
+	default:
+		return nil, fmt.Errorf("the edge authentication: %s must be %s or %s", config.EdgeAuthentication, edgeAWSALB, edgeCloudflareAccess)
+	}
+
+	return r, nil
+}
+
+//
+// getIdentity verifies the jwt asserted by the edge, returning the claims of the user
+//
+func (r *edgeVerifier) getIdentity(req *http.Request, now time.Time) (jose.Claims, error) {
+	assertion := req.Header.Get(r.header)
+	if assertion == "" {
+		return nil, ErrSessionNotFound
+	}
+	segments := strings.Split(assertion, ".")
+	if len(segments) != 3 {
+		return nil, errors.New("the edge assertion is not a jwt")
+	}
+	var header edgeHeader
+	if err := decodeJWTSegment(segments[0], &header); err != nil {
+		return nil, fmt.Errorf("unable to decode the header of the edge assertion, %s", err)
+	}
+	// step: the load balancer signs with es256, cloudflare with rs256
+	switch {
+	case r.mode == edgeAWSALB && header.Algorithm == "ES256":
+		if header.Signer != r.signer {
+			return nil, fmt.Errorf("the edge assertion was signed by: %s, not the load balancer", header.Signer)
+		}
+	case r.mode == edgeCloudflareAccess && header.Algorithm == "RS256":
+	default:
+		return nil, fmt.Errorf("the edge assertion algorithm: %s is not permitted", header.Algorithm)
+	}
+	key, err := r.getKey(header.KeyID, now)
+	if err != nil {
+		return nil, err
+	}
+	// step: the load balancer pads the base64 of the segments, so the signature is decoded without
+	signature, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(segments[2], "="))
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyEdgeSignature(key, []byte(segments[0]+"."+segments[1]), signature); err != nil {
+		return nil, err
+	}
+
+	var claims jose.Claims
+	if err := decodeJWTSegment(segments[1], &claims); err != nil {
+		return nil, fmt.Errorf("unable to decode the claims of the edge assertion, %s", err)
+	}
+	expires, found, err := claims.TimeClaim("exp")
+	if err != nil || !found {
+		return nil, errors.New("the edge assertion has no expiration")
+	}
+	if now.After(expires.Add(r.skew)) {
+		return nil, ErrAccessTokenExpired
+	}
+	if err := verifyClaimsNotBefore(claims, now, r.skew); err != nil {
+		return nil, err
+	}
+	if r.mode == edgeCloudflareAccess {
+		if issuer, _, _ := claims.StringClaim("iss"); issuer != r.issuer {
+			return nil, fmt.Errorf("the edge assertion issuer: %s is not the team domain", issuer)
+		}
+		audiences, _, _ := claims.StringsClaim("aud")
+		if audience, found, _ := claims.StringClaim("aud"); found {
+			audiences = []string{audience}
+		}
+		if !containedIn(r.audience, audiences) {
+			return nil, errors.New("the edge assertion audience is not the application")
+		}
+	}
+
+	return claims, nil
+}
+
+//
+// getKey returns the signing key, requesting the unknown keys no more than once a refresh interval
+//
+func (r *edgeVerifier) getKey(id string, now time.Time) (crypto.PublicKey, error) {
+	r.RLock()
+	key, found := r.keys[id]
+	r.RUnlock()
+	if found {
+		return key, nil
+	}
+
+	r.Lock()
+	defer r.Unlock()
+	if key, found := r.keys[id]; found {
+		return key, nil
+	}
+	if now.Sub(r.requested) < edgeKeysRefreshInterval {
+		return nil, fmt.Errorf("the edge signing key: %s is unknown", id)
+	}
+	r.requested = now
+
+	switch r.mode {
+	case edgeAWSALB:
+		content, err := r.request(r.keysURL + "/" + url.PathEscape(id))
+		if err != nil {
+			return nil, err
+		}
+		block, _ := pem.Decode(content)
+		if block == nil {
+			return nil, errors.New("the load balancer signing key is not pem encoded")
+		}
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		r.keys[id] = key
+	default:
+		content, err := r.request(r.keysURL)
+		if err != nil {
+			return nil, err
+		}
+		var set struct {
+			Keys []struct {
+				KeyID string `json:"kid"`
+				dpopJWK
+			} `json:"keys"`
+		}
+		if err := json.Unmarshal(content, &set); err != nil {
+			return nil, err
+		}
+		keys := make(map[string]crypto.PublicKey)
+		for _, x := range set.Keys {
+			if x.KeyType != "RSA" {
+				continue
+			}
+			n, err := decodeBigInt(x.Modulus)
+			if err != nil {
+				return nil, err
+			}
+			e, err := decodeBigInt(x.Exp)
+			if err != nil {
+				return nil, err
+			}
+			keys[x.KeyID] = &rsa.PublicKey{N: n, E: int(e.Int64())}
+		}
+		r.keys = keys
+	}
+	log.WithFields(log.Fields{
+		"edge": r.mode,
+		"kid":  id,
+	}).Infof("retrieved the signing keys of the edge")
+
+	if key, found := r.keys[id]; found {
+		return key, nil
+	}
+
+	return nil, fmt.Errorf("the edge signing key: %s is unknown", id)
+}
+
+//
+// request retrieves the signing keys
+//
+func (r *edgeVerifier) request(location string) ([]byte, error) {
+	resp, err := r.client.Get(location)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unable to retrieve the edge signing keys from: %s, status: %d", location, resp.StatusCode)
+	}
+
+	return content, nil
+}
+
+//
+// verifyEdgeSignature checks the sha256 signature of the content, ecdsa or rsa by the key
+//
+func verifyEdgeSignature(key crypto.PublicKey, content, signature []byte) error {
+	hash := sha256.Sum256(content)
+	switch k := key.(type) {
+	case *ecdsa.PublicKey:
+		if len(signature) != 64 || !ecdsa.Verify(k, hash[:], new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])) {
+			return errors.New("the edge assertion signature is invalid")
+		}
+	case *rsa.PublicKey:
+		if err := rsa.VerifyPKCS1v15(k, crypto.SHA256, hash[:], signature); err != nil {
+			return errors.New("the edge assertion signature is invalid")
+		}
+	default:
+		return errors.New("the edge signing key type is not supported")
+	}
+
+	return nil
+}
+
+//
+// newEdgeIdentity creates the user context from the claims asserted by the edge
+//
+func (r *oauthProxy) newEdgeIdentity(claims jose.Claims) (*userContext, error) {
+	identity, err := oidc.IdentityFromClaims(claims)
+	if err != nil {
+		return nil, err
+	}
+	name, found, err := claims.StringClaim(claimPreferredName)
+	if err != nil || !found {
+		name = identity.Email
+	}
+
+	return &userContext{
+		id:            identity.ID,
+		name:          name,
+		preferredName: name,
+		email:         identity.Email,
+		audience:      r.config.ClientID,
+		expiresAt:     identity.ExpiresAt,
+		roles:         getClaimsRoles(claims),
+		claims:        claims,
+		bearerToken:   true,
+		edge:          true,
+	}, nil
+}
+
+//
+// edgeAuthentication authenticates the request by the identity asserted by the edge, there's no login to redirect
+// to, so the requests without a valid assertion are unauthorized
+//
+func (r *oauthProxy) edgeAuthentication(cx *gin.Context) {
+	claims, err := r.edge.getIdentity(cx.Request, time.Now())
+	if err == nil {
+		var user *userContext
+		if user, err = r.newEdgeIdentity(claims); err == nil {
+			cx.Set(userContextName, user)
+			cx.Next()
+			return
+		}
+	}
+	log.WithFields(log.Fields{
+		"client_ip": cx.ClientIP(),
+		"error":     err.Error(),
+	}).Warnf("the identity asserted by the edge is invalid")
+
+	cx.AbortWithStatus(http.StatusUnauthorized)
+}
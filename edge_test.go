@@ -0,0 +1,269 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/coreos/go-oidc/jose"
+	"github.com/stretchr/testify/assert"
+)
+
+const fakeALBArn = "arn:aws:elasticloadbalancing:eu-west-2:123456789012:loadbalancer/app/orders/50dc6c495c0c9188"
+
+// newFakeEdgeAssertion signs the claims as the edge, ecdsa keys as the load balancer (padding the segments), else rsa
+func newFakeEdgeAssertion(t *testing.T, key crypto.Signer, header map[string]interface{}, claims jose.Claims) string {
+	encoding := base64.RawURLEncoding
+	if _, ok := key.(*ecdsa.PrivateKey); ok {
+		encoding = base64.URLEncoding
+	}
+	encodedHeader, _ := json.Marshal(header)
+	encodedClaims, _ := json.Marshal(claims)
+	content := encoding.EncodeToString(encodedHeader) + "." + encoding.EncodeToString(encodedClaims)
+	hash := sha256.Sum256([]byte(content))
+	var signature []byte
+	switch k := key.(type) {
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, hash[:])
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		signature = append(append(signature, padBigInt(r)...), padBigInt(s)...)
+	case *rsa.PrivateKey:
+		var err error
+		if signature, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, hash[:]); !assert.NoError(t, err) {
+			t.FailNow()
+		}
+	}
+
+	return content + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func padBigInt(v *big.Int) []byte {
+	content := v.Bytes()
+	return append(make([]byte, 32-len(content)), content...)
+}
+
+func newFakeALBKeys(t *testing.T) (*ecdsa.PrivateKey, *httptest.Server) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	der, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/alb-key" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		pem.Encode(w, &pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	}))
+
+	return key, server
+}
+
+func TestNewEdgeVerifier(t *testing.T) {
+	e, err := newEdgeVerifier(&Config{EdgeAuthentication: edgeAWSALB, EdgeALBArn: fakeALBArn}, nil)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "https://public-keys.auth.elb.eu-west-2.amazonaws.com", e.keysURL)
+		assert.Equal(t, headerALBIdentity, e.header)
+	}
+	e, err = newEdgeVerifier(&Config{
+		EdgeAuthentication:       edgeCloudflareAccess,
+		EdgeCloudflareTeamDomain: "https://example.cloudflareaccess.com/",
+		EdgeAudience:             "aud",
+	}, nil)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "https://example.cloudflareaccess.com", e.issuer)
+		assert.Equal(t, "https://example.cloudflareaccess.com/cdn-cgi/access/certs", e.keysURL)
+	}
+	_, err = newEdgeVerifier(&Config{EdgeAuthentication: edgeAWSALB, EdgeALBArn: "orders"}, nil)
+	assert.Error(t, err)
+	_, err = newEdgeVerifier(&Config{EdgeAuthentication: "akamai"}, nil)
+	assert.Error(t, err)
+}
+
+func TestEdgeVerifierALB(t *testing.T) {
+	key, server := newFakeALBKeys(t)
+	defer server.Close()
+	other, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	e, err := newEdgeVerifier(&Config{EdgeAuthentication: edgeAWSALB, EdgeALBArn: fakeALBArn, EdgeKeysURL: server.URL}, nil)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	now := time.Now()
+	header := map[string]interface{}{"alg": "ES256", "kid": "alb-key", "signer": fakeALBArn}
+	claims := jose.Claims{"sub": "1234", "email": "jane@example.com", "exp": now.Add(time.Minute).Unix()}
+
+	cs := []struct {
+		Assertion string
+		Ok        bool
+	}{
+		{Assertion: newFakeEdgeAssertion(t, key, header, claims), Ok: true},
+		{Assertion: newFakeEdgeAssertion(t, other, header, claims)},
+		{Assertion: newFakeEdgeAssertion(t, key, map[string]interface{}{"alg": "ES256", "kid": "alb-key", "signer": "arn:other"}, claims)},
+		{Assertion: newFakeEdgeAssertion(t, key, map[string]interface{}{"alg": "none", "kid": "alb-key", "signer": fakeALBArn}, claims)},
+		{Assertion: newFakeEdgeAssertion(t, key, header, jose.Claims{"sub": "1234", "exp": now.Add(-time.Minute).Unix()})},
+		{Assertion: newFakeEdgeAssertion(t, key, header, jose.Claims{"sub": "1234"})},
+		{Assertion: "not.a-jwt"},
+	}
+	for i, c := range cs {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.Header.Set(headerALBIdentity, c.Assertion)
+		identity, err := e.getIdentity(req, now)
+		if !c.Ok {
+			assert.Error(t, err, "case %d, expected an error", i)
+			continue
+		}
+		if assert.NoError(t, err, "case %d", i) {
+			assert.Equal(t, "jane@example.com", identity["email"], "case %d", i)
+		}
+	}
+
+	// step: the unknown keys are requested no more than once a refresh interval
+	header["kid"] = "rotated"
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.Header.Set(headerALBIdentity, newFakeEdgeAssertion(t, key, header, claims))
+	_, err = e.getIdentity(req, now)
+	assert.Error(t, err)
+	requested := e.requested
+	_, err = e.getIdentity(req, now.Add(time.Second))
+	assert.Error(t, err)
+	assert.Equal(t, requested, e.requested)
+}
+
+func TestEdgeVerifierCloudflare(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kid": "cf-key",
+				"kty": "RSA",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	}))
+	defer server.Close()
+
+	e, err := newEdgeVerifier(&Config{
+		EdgeAuthentication:       edgeCloudflareAccess,
+		EdgeCloudflareTeamDomain: "example.cloudflareaccess.com",
+		EdgeAudience:             "app-aud",
+		EdgeKeysURL:              server.URL,
+	}, nil)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	now := time.Now()
+	header := map[string]interface{}{"alg": "RS256", "kid": "cf-key"}
+	expires := now.Add(time.Minute).Unix()
+
+	cs := []struct {
+		Claims jose.Claims
+		Ok     bool
+	}{
+		{
+			Claims: jose.Claims{"sub": "1234", "iss": "https://example.cloudflareaccess.com", "aud": []string{"app-aud"}, "exp": expires},
+			Ok:     true,
+		},
+		{
+			Claims: jose.Claims{"sub": "1234", "iss": "https://example.cloudflareaccess.com", "aud": "app-aud", "exp": expires},
+			Ok:     true,
+		},
+		{Claims: jose.Claims{"sub": "1234", "iss": "https://example.cloudflareaccess.com", "aud": []string{"other"}, "exp": expires}},
+		{Claims: jose.Claims{"sub": "1234", "iss": "https://other.cloudflareaccess.com", "aud": []string{"app-aud"}, "exp": expires}},
+	}
+	for i, c := range cs {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.Header.Set(headerCloudflareAssertion, newFakeEdgeAssertion(t, key, header, c.Claims))
+		_, err := e.getIdentity(req, now)
+		if c.Ok {
+			assert.NoError(t, err, "case %d", i)
+		} else {
+			assert.Error(t, err, "case %d, expected an error", i)
+		}
+	}
+}
+
+func TestEdgeAuthentication(t *testing.T) {
+	key, server := newFakeALBKeys(t)
+	defer server.Close()
+
+	config := newFakeKeycloakConfig()
+	config.EdgeAuthentication = edgeAWSALB
+	config.EdgeALBArn = fakeALBArn
+	config.EdgeKeysURL = server.URL
+	config.Resources = []*Resource{{URL: "/admin", Methods: []string{"ANY"}, Roles: []string{"admin"}}}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	defer upstream.Close()
+	config.Upstream = upstream.URL
+	p, _, u := newTestProxyService(config)
+	if !assert.NoError(t, p.createUpstreamProxy(p.endpoint)) {
+		t.FailNow()
+	}
+
+	header := map[string]interface{}{"alg": "ES256", "kid": "alb-key", "signer": fakeALBArn}
+	expires := time.Now().Add(time.Minute).Unix()
+	cs := []struct {
+		Claims   jose.Claims
+		HTTPCode int
+	}{
+		{
+			Claims:   jose.Claims{"sub": "1234", "exp": expires, "realm_access": map[string]interface{}{"roles": []string{"admin"}}},
+			HTTPCode: http.StatusOK,
+		},
+		{
+			Claims:   jose.Claims{"sub": "1234", "exp": expires, "realm_access": map[string]interface{}{"roles": []string{"user"}}},
+			HTTPCode: http.StatusForbidden,
+		},
+		{HTTPCode: http.StatusUnauthorized},
+	}
+	for i, c := range cs {
+		req, _ := http.NewRequest("GET", u+"/admin", nil)
+		if c.Claims != nil {
+			req.Header.Set(headerALBIdentity, newFakeEdgeAssertion(t, key, header, c.Claims))
+		}
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if !assert.NoError(t, err, "case %d", i) {
+			continue
+		}
+		resp.Body.Close()
+		assert.Equal(t, c.HTTPCode, resp.StatusCode, "case %d", i)
+	}
+
+	// step: there's no login flow in edge mode, so the authorization isn't redirected to a provider
+	req, _ := http.NewRequest("GET", u+oauthURL+authorizationURL, nil)
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.NotEqual(t, http.StatusTemporaryRedirect, resp.StatusCode)
+	}
+}
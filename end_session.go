@@ -0,0 +1,97 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-oidc/oidc"
+	"github.com/gin-gonic/gin"
+)
+
+// skipProviderLogoutParam is the query parameter of the logout which skips the logout at the provider
+const skipProviderLogoutParam = "skip_idp_logout"
+
+//
+// getEndSessionURL returns the end session endpoint of the provider, defaulting to the logout endpoint of keycloak
+// alongside the authorization endpoint, as the discovery of the openid client doesn't carry it
+//
+func getEndSessionURL(config *Config, provider oidc.ProviderConfig) (string, error) {
+	if config.EndSessionURL != "" {
+		return config.EndSessionURL, nil
+	}
+	if provider.AuthEndpoint == nil || !strings.HasSuffix(provider.AuthEndpoint.Path, "/auth") {
+		return "", errors.New("unable to derive the end session endpoint from the authorization endpoint, set the end-session-url")
+	}
+	endpoint := *provider.AuthEndpoint
+	endpoint.Path = strings.TrimSuffix(endpoint.Path, "/auth") + "/logout"
+	endpoint.RawQuery = ""
+
+	return endpoint.String(), nil
+}
+
+//
+// dropIDTokenCookie keeps the identity token of the session, to be passed as the hint on the logout
+//
+func (r *oauthProxy) dropIDTokenCookie(cx *gin.Context, value string, duration time.Duration) {
+	r.dropCookie(cx, r.config.CookieIDTokenName, value, duration)
+}
+
+//
+// clearIDTokenCookie clears the identity token cookie
+//
+func (r *oauthProxy) clearIDTokenCookie(cx *gin.Context) {
+	r.dropCookie(cx, r.config.CookieIDTokenName, "", time.Duration(-10*time.Hour))
+}
+
+//
+// isSkippedProviderLogout checks the logout only ends the session of the proxy, leaving the user logged in to the provider
+//
+func (r *oauthProxy) isSkippedProviderLogout(cx *gin.Context) bool {
+	skip, err := strconv.ParseBool(cx.Query(skipProviderLogoutParam))
+
+	return err == nil && skip
+}
+
+//
+// getEndSessionRedirect returns the url of the end session endpoint the user is redirected to on the logout (openid
+// connect rp-initiated logout 1.0); the identity token of the session is the hint, else the client is named, and the
+// user is returned to the redirect, else the configured post logout redirect uri
+//
+func (r *oauthProxy) getEndSessionRedirect(cx *gin.Context, redirect string) string {
+	params := url.Values{}
+	if cookie, err := cx.Request.Cookie(r.config.CookieIDTokenName); err == nil && cookie.Value != "" {
+		params.Set("id_token_hint", cookie.Value)
+	} else {
+		params.Set("client_id", r.config.ClientID)
+	}
+	if redirect == "" {
+		redirect = r.config.PostLogoutRedirectURI
+	}
+	if redirect != "" {
+		params.Set("post_logout_redirect_uri", redirect)
+	}
+	separator := "?"
+	if strings.Contains(r.endSession, "?") {
+		separator = "&"
+	}
+
+	return r.endSession + separator + params.Encode()
+}
@@ -0,0 +1,139 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/coreos/go-oidc/oidc"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetEndSessionURL(t *testing.T) {
+	auth, _ := url.Parse("https://keycloak.example.com/auth/realms/hod/protocol/openid-connect/auth")
+	other, _ := url.Parse("https://accounts.example.com/o/oauth2/v2/authorize")
+	cs := []struct {
+		Config   *Config
+		Endpoint *url.URL
+		Expected string
+	}{
+		{
+			Config:   &Config{},
+			Endpoint: auth,
+			Expected: "https://keycloak.example.com/auth/realms/hod/protocol/openid-connect/logout",
+		},
+		{
+			Config:   &Config{EndSessionURL: "https://accounts.example.com/logout"},
+			Endpoint: other,
+			Expected: "https://accounts.example.com/logout",
+		},
+		{
+			Config:   &Config{},
+			Endpoint: other,
+		},
+		{
+			Config: &Config{},
+		},
+	}
+	for i, c := range cs {
+		endpoint, err := getEndSessionURL(c.Config, oidc.ProviderConfig{AuthEndpoint: c.Endpoint})
+		if c.Expected == "" {
+			assert.Error(t, err, "case %d, expected an error", i)
+			continue
+		}
+		assert.NoError(t, err, "case %d", i)
+		assert.Equal(t, c.Expected, endpoint, "case %d", i)
+	}
+}
+
+func TestLogoutRedirect(t *testing.T) {
+	config := newFakeKeycloakConfig()
+	config.EnableLogoutRedirect = true
+	config.CookieIDTokenName = "kc-id"
+	config.PostLogoutRedirectURI = "https://myapp.example.com/goodbye"
+	p, _, u := newTestProxyService(config)
+
+	// step: login to get the session cookies
+	req, _ := http.NewRequest("GET", u+oauthURL+authorizationURL, nil)
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	req, _ = http.NewRequest("GET", resp.Header.Get("Location"), nil)
+	resp, err = http.DefaultTransport.RoundTrip(req)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	req, _ = http.NewRequest("GET", resp.Header.Get("Location"), nil)
+	resp, err = http.DefaultTransport.RoundTrip(req)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	cookies := resp.Cookies()
+	var identity string
+	for _, x := range cookies {
+		if x.Name == config.CookieIDTokenName {
+			identity = x.Value
+		}
+	}
+	if !assert.NotEmpty(t, identity, "the identity token cookie was not set") {
+		t.FailNow()
+	}
+
+	cs := []struct {
+		Query    string
+		Identity bool
+		Expected url.Values
+	}{
+		{
+			Identity: true,
+			Expected: url.Values{"id_token_hint": {identity}, "post_logout_redirect_uri": {config.PostLogoutRedirectURI}},
+		},
+		{
+			Query:    "?redirect=https://myapp.example.com/other",
+			Expected: url.Values{"client_id": {config.ClientID}, "post_logout_redirect_uri": {"https://myapp.example.com/other"}},
+		},
+		{
+			Query: "?skip_idp_logout=true",
+		},
+	}
+	for i, c := range cs {
+		req, _ = http.NewRequest("GET", u+oauthURL+logoutURL+c.Query, nil)
+		for _, x := range cookies {
+			if x.Name != config.CookieIDTokenName || c.Identity {
+				req.AddCookie(x)
+			}
+		}
+		resp, err = http.DefaultTransport.RoundTrip(req)
+		if !assert.NoError(t, err, "case %d", i) {
+			continue
+		}
+		resp.Body.Close()
+		if c.Expected == nil {
+			assert.Equal(t, http.StatusOK, resp.StatusCode, "case %d", i)
+			continue
+		}
+		assert.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode, "case %d", i)
+		location, err := url.Parse(resp.Header.Get("Location"))
+		if !assert.NoError(t, err, "case %d", i) {
+			continue
+		}
+		assert.Equal(t, p.endSession, location.Scheme+"://"+location.Host+location.Path, "case %d", i)
+		assert.Equal(t, c.Expected, location.Query(), "case %d", i)
+	}
+}
@@ -0,0 +1,369 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/coreos/go-oidc/jose"
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+//
+// enrichmentEntry is the attributes of a user, held until they expire
+//
+type enrichmentEntry struct {
+	// the time the attributes expire
+	expires time.Time
+	// the attributes of the user, none when the user isn't in the directory
+	attributes map[string]interface{}
+}
+
+//
+// enricher adds the attributes of the user from a external directory to the claims, for the headers and the
+// admission, caching the attributes so the directory isn't called on every request
+//
+type enricher struct {
+	sync.Mutex
+	// the directory holding the attributes
+	directory directory
+	// the claim the user is looked up by
+	claim string
+	// the claims the attributes are added as, keyed by the attribute
+	claims map[string]string
+	// the maximum number of users held, zero disables the caching
+	size int
+	// the maximum time the attributes are held
+	ttl time.Duration
+	// the attributes keyed by the lookup value
+	entries map[string]*enrichmentEntry
+	// the lookups, partitioned by the result
+	results *prometheus.CounterVec
+}
+
+//
+// newEnricher creates the enrichment from the directory of the enrichment url, ldap or ldaps for a ldap directory
+// else http or https for a scim endpoint
+//
+func newEnricher(config *Config) (*enricher, error) {
+	location, err := url.Parse(config.EnrichmentURL)
+	if err != nil {
+		return nil, err
+	}
+	claims := make(map[string]string)
+	var attributes []string
+	for _, x := range config.EnrichmentAttributes {
+		attribute, claim := parseEnrichmentAttribute(x)
+		attributes = append(attributes, attribute)
+		claims[attribute] = claim
+	}
+
+	var dir directory
+	switch location.Scheme {
+	case "ldap", "ldaps":
+		address := location.Host
+		if location.Port() == "" {
+			port := "389"
+			if location.Scheme == "ldaps" {
+				port = "636"
+			}
+			address = net.JoinHostPort(location.Hostname(), port)
+		}
+		attribute := config.EnrichmentLookupAttribute
+		if attribute == "" {
+			attribute = "uid"
+		}
+		dir = &ldapDirectory{
+			address:    address,
+			tls:        location.Scheme == "ldaps",
+			bindDN:     config.EnrichmentBindDN,
+			password:   config.EnrichmentBindPassword,
+			baseDN:     config.EnrichmentBaseDN,
+			attribute:  attribute,
+			attributes: attributes,
+			timeout:    config.EnrichmentTimeout,
+		}
+	case "http", "https":
+		attribute := config.EnrichmentLookupAttribute
+		if attribute == "" {
+			attribute = "userName"
+		}
+		dir = &scimDirectory{
+			client:     &http.Client{Timeout: config.EnrichmentTimeout},
+			endpoint:   strings.TrimSuffix(config.EnrichmentURL, "/") + "/Users",
+			token:      config.EnrichmentToken,
+			attribute:  attribute,
+			attributes: attributes,
+		}
+	default:
+		return nil, fmt.Errorf("the enrichment url: %s must be a ldap, ldaps, http or https url", config.EnrichmentURL)
+	}
+
+	return &enricher{
+		directory: dir,
+		claim:     config.EnrichmentClaim,
+		claims:    claims,
+		size:      config.EnrichmentCacheSize,
+		ttl:       config.EnrichmentCacheTTL,
+		entries:   make(map[string]*enrichmentEntry),
+		results: prometheus.MustRegisterOrGet(prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "proxy_enrichment_lookups_total",
+				Help: "The lookups of the attributes of the users in the directory, partitioned by the result",
+			},
+			[]string{"result"},
+		)).(*prometheus.CounterVec),
+	}, nil
+}
+
+//
+// parseEnrichmentAttribute splits the attribute=claim, the claim defaulting to the name of the attribute
+//
+func parseEnrichmentAttribute(value string) (string, string) {
+	if i := strings.LastIndex(value, "="); i > 0 && i < len(value)-1 {
+		return value[:i], value[i+1:]
+	}
+
+	return value, value
+}
+
+//
+// enrich returns a copy of the user with the attributes from the directory added to the claims; the claims of the
+// token take precedence, so the directory can't override the identity of the user
+//
+func (r *enricher) enrich(user *userContext, now time.Time) (*userContext, error) {
+	value, found, err := user.claims.StringClaim(r.claim)
+	if err != nil || !found || value == "" {
+		return user, nil
+	}
+	attributes, err := r.getAttributes(value, now)
+	if err != nil {
+		return nil, err
+	}
+	if len(attributes) <= 0 {
+		return user, nil
+	}
+
+	claims := make(jose.Claims, len(user.claims)+len(attributes))
+	for k, v := range user.claims {
+		claims[k] = v
+	}
+	for attribute, v := range attributes {
+		claim := r.claims[attribute]
+		if _, found := claims[claim]; !found && claim != "" {
+			claims[claim] = v
+		}
+	}
+	enriched := *user
+	enriched.claims = claims
+
+	return &enriched, nil
+}
+
+//
+// getAttributes returns the attributes of the user, from the cache or the directory
+//
+func (r *enricher) getAttributes(value string, now time.Time) (map[string]interface{}, error) {
+	r.Lock()
+	if entry, found := r.entries[value]; found {
+		if now.Before(entry.expires) {
+			r.Unlock()
+			r.results.WithLabelValues("cached").Inc()
+			return entry.attributes, nil
+		}
+		delete(r.entries, value)
+	}
+	r.Unlock()
+
+	attributes, err := r.directory.lookup(value)
+	if err != nil {
+		r.results.WithLabelValues("error").Inc()
+		return nil, err
+	}
+	if len(attributes) > 0 {
+		r.results.WithLabelValues("found").Inc()
+	} else {
+		r.results.WithLabelValues("missing").Inc()
+	}
+	if r.size > 0 {
+		r.set(value, &enrichmentEntry{expires: now.Add(r.ttl), attributes: attributes}, now)
+	}
+
+	return attributes, nil
+}
+
+//
+// set adds the attributes to the cache, removing the expired attributes when full, else a arbitrary one
+//
+func (r *enricher) set(key string, entry *enrichmentEntry, now time.Time) {
+	r.Lock()
+	defer r.Unlock()
+
+	if len(r.entries) >= r.size {
+		for k, v := range r.entries {
+			if !now.Before(v.expires) {
+				delete(r.entries, k)
+			}
+		}
+	}
+	if len(r.entries) >= r.size {
+		for k := range r.entries {
+			delete(r.entries, k)
+			break
+		}
+	}
+	r.entries[key] = entry
+}
+
+//
+// enrichmentMiddleware adds the attributes of the authenticated user from the directory, ahead of the admission
+//
+func (r *oauthProxy) enrichmentMiddleware() gin.HandlerFunc {
+	return func(cx *gin.Context) {
+		if r.enricher == nil {
+			return
+		}
+		uc, found := cx.Get(userContextName)
+		if !found {
+			return
+		}
+		user := uc.(*userContext)
+		enriched, err := r.enricher.enrich(user, time.Now())
+		if err != nil {
+			log.WithFields(log.Fields{
+				"username": user.name,
+				"error":    err.Error(),
+			}).Errorf("unable to lookup the attributes of the user in the directory")
+
+			cx.AbortWithStatus(http.StatusBadGateway)
+			return
+		}
+		cx.Set(userContextName, enriched)
+	}
+}
+
+//
+// scimDirectory looks up the attributes of the users from a scim endpoint (rfc 7644), by a filter on the users
+//
+type scimDirectory struct {
+	// the client used to reach the endpoint
+	client *http.Client
+	// the users endpoint
+	endpoint string
+	// the bearer token of the endpoint, if any
+	token string
+	// the attribute the users are matched by
+	attribute string
+	// the attributes returned
+	attributes []string
+}
+
+//
+// scimListResponse is the users matching the filter
+//
+type scimListResponse struct {
+	TotalResults int                      `json:"totalResults"`
+	Resources    []map[string]interface{} `json:"Resources"`
+}
+
+//
+// lookup queries the endpoint for the user, returning the attributes or none when there's no user
+//
+func (r *scimDirectory) lookup(value string) (map[string]interface{}, error) {
+	escaped := strings.Replace(strings.Replace(value, `\`, `\\`, -1), `"`, `\"`, -1)
+	query := url.Values{
+		"filter":     {fmt.Sprintf(`%s eq "%s"`, r.attribute, escaped)},
+		"attributes": {strings.Join(r.attributes, ",")},
+	}
+	req, err := http.NewRequest(http.MethodGet, r.endpoint+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/scim+json, application/json")
+	if r.token != "" {
+		req.Header.Set(authorizationHeader, "Bearer "+r.token)
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("the scim endpoint failed to list the users, status: %d, response: %s", resp.StatusCode, content)
+	}
+	var list scimListResponse
+	if err := json.Unmarshal(content, &list); err != nil {
+		return nil, err
+	}
+	if len(list.Resources) > 1 {
+		return nil, fmt.Errorf("the %s: %s matches more than one user of the scim endpoint", r.attribute, value)
+	}
+	attributes := make(map[string]interface{})
+	if len(list.Resources) <= 0 {
+		return attributes, nil
+	}
+	for _, x := range r.attributes {
+		if v, found := getSCIMAttribute(list.Resources[0], x); found {
+			attributes[x] = v
+		}
+	}
+
+	return attributes, nil
+}
+
+//
+// getSCIMAttribute returns the attribute of the user by the dotted path, e.g. name.familyName, a schema extension
+// being prefixed by the urn of the schema, e.g. urn:ietf:params:scim:schemas:extension:enterprise:2.0:User:department
+//
+func getSCIMAttribute(resource map[string]interface{}, attribute string) (interface{}, bool) {
+	var current interface{} = resource
+	path := attribute
+	if strings.HasPrefix(attribute, "urn:") {
+		i := strings.LastIndex(attribute, ":")
+		extension, found := resource[attribute[:i]]
+		if !found {
+			return nil, false
+		}
+		current, path = extension, attribute[i+1:]
+	}
+	for _, name := range strings.Split(path, ".") {
+		object, ok := current.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if current, ok = object[name]; !ok {
+			return nil, false
+		}
+	}
+
+	return current, true
+}
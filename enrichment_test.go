@@ -0,0 +1,188 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/coreos/go-oidc/jose"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeDirectory struct {
+	lookups int
+	users   map[string]map[string]interface{}
+}
+
+func (r *fakeDirectory) lookup(value string) (map[string]interface{}, error) {
+	r.lookups++
+	if value == "broken" {
+		return nil, errors.New("the directory is unavailable")
+	}
+	if attributes, found := r.users[value]; found {
+		return attributes, nil
+	}
+
+	return map[string]interface{}{}, nil
+}
+
+func newFakeEnricher(t *testing.T, dir directory) *enricher {
+	config := newDefaultConfig()
+	config.EnrichmentURL = "https://scim.example.com/scim/v2"
+	config.EnrichmentAttributes = []string{"department", "manager=reports_to", "email"}
+	e, err := newEnricher(config)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	e.directory = dir
+
+	return e
+}
+
+func TestParseEnrichmentAttribute(t *testing.T) {
+	cs := []struct {
+		Value     string
+		Attribute string
+		Claim     string
+	}{
+		{Value: "department", Attribute: "department", Claim: "department"},
+		{Value: "departmentNumber=department", Attribute: "departmentNumber", Claim: "department"},
+		{Value: "department=", Attribute: "department=", Claim: "department="},
+	}
+	for i, c := range cs {
+		attribute, claim := parseEnrichmentAttribute(c.Value)
+		assert.Equal(t, c.Attribute, attribute, "case %d", i)
+		assert.Equal(t, c.Claim, claim, "case %d", i)
+	}
+}
+
+func TestEnricherEnrich(t *testing.T) {
+	dir := &fakeDirectory{users: map[string]map[string]interface{}{
+		"jane": {"department": "finance", "manager": "bob", "email": "evil@example.com"},
+	}}
+	e := newFakeEnricher(t, dir)
+	now := time.Now()
+
+	user := &userContext{claims: jose.Claims{"preferred_username": "jane", "email": "jane@example.com"}}
+	enriched, err := e.enrich(user, now)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	assert.Equal(t, "finance", enriched.claims["department"])
+	assert.Equal(t, "bob", enriched.claims["reports_to"])
+	assert.Equal(t, "jane@example.com", enriched.claims["email"], "the claims of the token should take precedence")
+	assert.NotContains(t, user.claims, "department", "the claims of the user should not change")
+
+	// step: the attributes should be cached, until they expire
+	_, err = e.enrich(user, now.Add(time.Minute))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, dir.lookups)
+	_, err = e.enrich(user, now.Add(e.ttl))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, dir.lookups)
+
+	missing := &userContext{claims: jose.Claims{"preferred_username": "john"}}
+	enriched, err = e.enrich(missing, now)
+	assert.NoError(t, err)
+	assert.Equal(t, missing, enriched)
+
+	_, err = e.enrich(&userContext{claims: jose.Claims{"preferred_username": "broken"}}, now)
+	assert.Error(t, err)
+}
+
+func TestEnrichmentMiddleware(t *testing.T) {
+	proxy := newFakeKeycloakProxyWithResources(t, []*Resource{
+		{
+			URL:     "/admin",
+			Methods: []string{"ANY"},
+		},
+	})
+	proxy.enricher = newFakeEnricher(t, &fakeDirectory{users: map[string]map[string]interface{}{
+		"jane": {"department": "finance"},
+	}})
+	handler := proxy.enrichmentMiddleware()
+
+	cs := []struct {
+		Username   string
+		Department interface{}
+		HTTPCode   int
+	}{
+		{Username: "jane", Department: "finance", HTTPCode: http.StatusOK},
+		{Username: "john", HTTPCode: http.StatusOK},
+		{Username: "broken", HTTPCode: http.StatusBadGateway},
+	}
+	for i, c := range cs {
+		cx := newFakeGinContext("GET", "/admin")
+		cx.Set(userContextName, &userContext{claims: jose.Claims{"preferred_username": c.Username}})
+		handler(cx)
+		assert.Equal(t, c.HTTPCode, cx.Writer.Status(), "case %d", i)
+		if c.HTTPCode != http.StatusOK {
+			continue
+		}
+		uc, _ := cx.Get(userContextName)
+		assert.Equal(t, c.Department, uc.(*userContext).claims["department"], "case %d", i)
+	}
+}
+
+func TestSCIMDirectoryLookup(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get(authorizationHeader) != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/scim+json")
+		switch req.URL.Query().Get("filter") {
+		case `userName eq "jane"`:
+			w.Write([]byte(`{"totalResults":1,"Resources":[{"userName":"jane","title":"cfo","name":{"familyName":"doe"},
+				"urn:ietf:params:scim:schemas:extension:enterprise:2.0:User":{"department":"finance"}}]}`))
+		case `userName eq "jo\"hn"`:
+			w.Write([]byte(`{"totalResults":0,"Resources":[]}`))
+		default:
+			w.Write([]byte(`{"totalResults":2,"Resources":[{"userName":"a"},{"userName":"b"}]}`))
+		}
+	}))
+	defer server.Close()
+
+	dir := &scimDirectory{
+		client:     http.DefaultClient,
+		endpoint:   server.URL + "/Users",
+		token:      "secret",
+		attribute:  "userName",
+		attributes: []string{"title", "name.familyName", "urn:ietf:params:scim:schemas:extension:enterprise:2.0:User:department", "phone"},
+	}
+	attributes, err := dir.lookup("jane")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"title":           "cfo",
+		"name.familyName": "doe",
+		"urn:ietf:params:scim:schemas:extension:enterprise:2.0:User:department": "finance",
+	}, attributes)
+
+	attributes, err = dir.lookup(`jo"hn`)
+	assert.NoError(t, err)
+	assert.Empty(t, attributes)
+
+	_, err = dir.lookup("j*")
+	assert.Error(t, err)
+
+	dir.token = ""
+	_, err = dir.lookup("jane")
+	assert.Error(t, err)
+}
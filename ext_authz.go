@@ -0,0 +1,436 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// extAuthzCheckPath is the grpc method of the envoy external authorization service
+	extAuthzCheckPath = "/envoy.service.auth.v3.Authorization/Check"
+	// extAuthzMaxBodySize is the largest body of a denied response passed back to envoy
+	extAuthzMaxBodySize = 64 << 10
+
+	// the grpc status codes of the check responses
+	grpcStatusOK               = 0
+	grpcStatusInvalidArgument  = 3
+	grpcStatusPermissionDenied = 7
+	grpcStatusUnimplemented    = 12
+	grpcStatusUnauthenticated  = 16
+
+	// the protobuf wire types
+	protoVarint = 0
+	protoBytes  = 2
+)
+
+// extAuthzCheckKey holds the check in the context of the request run through the router
+var extAuthzCheckKey = contextKey("ext-authz-check")
+
+// extAuthzIgnoredHeaders are the headers added by the proxy which envoy handles itself
+var extAuthzIgnoredHeaders = []string{"X-Forwarded-For", "X-Forwarded-Host"}
+
+//
+// extAuthzCheck is the outcome of a request run through the router, the request as it would have been proxied
+//
+type extAuthzCheck struct {
+	// the request reached the upstream, i.e. was permitted
+	permitted bool
+	// the request as it would be sent upstream
+	request *http.Request
+}
+
+//
+// extAuthzRecorder records the response of the router to a check
+//
+type extAuthzRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (r *extAuthzRecorder) Header() http.Header {
+	return r.header
+}
+
+func (r *extAuthzRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	if remaining := extAuthzMaxBodySize - r.body.Len(); remaining > 0 {
+		if len(b) > remaining {
+			r.body.Write(b[:remaining])
+		} else {
+			r.body.Write(b)
+		}
+	}
+
+	return len(b), nil
+}
+
+func (r *extAuthzRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+}
+
+//
+// getExtAuthzCheck returns the check of the request, if run on behalf of envoy
+//
+func getExtAuthzCheck(req *http.Request) *extAuthzCheck {
+	check, _ := req.Context().Value(extAuthzCheckKey).(*extAuthzCheck)
+
+	return check
+}
+
+//
+// runExtAuthz starts the envoy external authorization service, grpc over h2c, which requires go 1.24
+//
+func (r *oauthProxy) runExtAuthz() error {
+	listener, err := net.Listen("tcp", r.config.ExtAuthzListen)
+	if err != nil {
+		return err
+	}
+	server := &http.Server{
+		Handler:   http.HandlerFunc(r.extAuthzHandler),
+		Protocols: newH2CProtocols(),
+	}
+
+	go func() {
+		log.Infof("envoy external authorization service starting on %s", r.config.ExtAuthzListen)
+		if err := server.Serve(listener); err != nil {
+			log.WithFields(log.Fields{
+				"error": err.Error(),
+			}).Fatalf("failed to start the envoy external authorization service")
+		}
+	}()
+
+	return nil
+}
+
+//
+// extAuthzHandler serves the check calls of envoy, the request described by envoy is run through the router in
+// place of the client's, the decision and the headers for the upstream being returned rather than proxied
+//
+func (r *oauthProxy) extAuthzHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", grpcContentType)
+	if req.Method != http.MethodPost || req.URL.Path != extAuthzCheckPath {
+		writeGRPCStatus(w, grpcStatusUnimplemented, "unknown service or method")
+		return
+	}
+	message, err := readGRPCMessage(req.Body)
+	if err != nil {
+		writeGRPCStatus(w, grpcStatusInvalidArgument, err.Error())
+		return
+	}
+	check, err := parseCheckRequest(message)
+	if err != nil {
+		writeGRPCStatus(w, grpcStatusInvalidArgument, err.Error())
+		return
+	}
+
+	// step: run the request through the router, the reverse proxy stops at the check
+	outcome := &extAuthzCheck{}
+	original := check.Header.Clone()
+	check = check.WithContext(context.WithValue(req.Context(), extAuthzCheckKey, outcome))
+	recorder := &extAuthzRecorder{header: make(http.Header)}
+	r.getRouter().ServeHTTP(recorder, check)
+
+	var response []byte
+	if outcome.permitted {
+		response = encodeCheckOkResponse(original, outcome.request.Header, recorder.header)
+	} else {
+		if recorder.status == 0 {
+			recorder.status = http.StatusForbidden
+		}
+		log.WithFields(log.Fields{
+			"client_ip": check.RemoteAddr,
+			"path":      check.URL.Path,
+			"status":    recorder.status,
+		}).Debugf("the external authorization check was denied")
+
+		response = encodeCheckDeniedResponse(recorder.status, recorder.header, recorder.body.Bytes())
+	}
+
+	w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+	w.WriteHeader(http.StatusOK)
+	w.Write(encodeGRPCMessage(response))
+	w.Header().Set("Grpc-Status", "0")
+	w.Header().Set("Grpc-Message", "")
+}
+
+//
+// writeGRPCStatus responds with the status alone, a trailers only response
+//
+func writeGRPCStatus(w http.ResponseWriter, code int, message string) {
+	w.Header().Set("Grpc-Status", strconv.Itoa(code))
+	w.Header().Set("Grpc-Message", url.PathEscape(message))
+	w.WriteHeader(http.StatusOK)
+}
+
+//
+// encodeGRPCMessage length prefixes the message
+//
+func encodeGRPCMessage(message []byte) []byte {
+	frame := make([]byte, 5, 5+len(message))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(message)))
+
+	return append(frame, message...)
+}
+
+//
+// parseCheckRequest converts the envoy check request to the http request it describes
+//
+//	CheckRequest { AttributeContext attributes = 1 }
+//	AttributeContext { Peer source = 1; Request request = 4 }
+//	Peer { Address address = 1 }, Address { SocketAddress socket_address = 1 }, SocketAddress { string address = 2 }
+//	Request { HttpRequest http = 2 }
+//	HttpRequest { string method = 2; map<string, string> headers = 3; string path = 4; string host = 5;
+//	  string scheme = 6; string body = 11; bytes raw_body = 12; HeaderMap header_map = 13 }
+//	HeaderMap { repeated HeaderValue headers = 1 }, HeaderValue { string key = 1; string value = 2; bytes raw_value = 3 }
+//
+func parseCheckRequest(message []byte) (*http.Request, error) {
+	attributes, err := getProtobufField(message, 1)
+	if err != nil {
+		return nil, err
+	}
+	request, err := getProtobufField(attributes, 4)
+	if err != nil {
+		return nil, err
+	}
+	request, err = getProtobufField(request, 2)
+	if err != nil {
+		return nil, err
+	}
+	fields, err := decodeProtobufFields(request)
+	if err != nil {
+		return nil, err
+	}
+	value := func(number int) string {
+		if len(fields[number]) > 0 {
+			return string(fields[number][0])
+		}
+		return ""
+	}
+	method, path, scheme := value(2), value(4), value(6)
+	if method == "" || !strings.HasPrefix(path, "/") {
+		return nil, errors.New("the check request has no http request")
+	}
+	if scheme == "" {
+		scheme = "http"
+	}
+	location, err := url.ParseRequestURI(path)
+	if err != nil {
+		return nil, fmt.Errorf("the path of the check request is invalid, %s", err)
+	}
+	location.Scheme, location.Host = scheme, value(5)
+	body := value(11)
+	if raw := value(12); raw != "" {
+		body = raw
+	}
+
+	req, err := http.NewRequest(method, location.String(), strings.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	// step: the headers are either a map or, when raw, a header map; the pseudo headers are carried above
+	entries := fields[3]
+	if len(fields[13]) > 0 {
+		headers, err := decodeProtobufFields(fields[13][0])
+		if err != nil {
+			return nil, err
+		}
+		entries = headers[1]
+	}
+	for _, x := range entries {
+		header, err := decodeProtobufFields(x)
+		if err != nil {
+			return nil, err
+		}
+		var key, value []byte
+		if len(header[1]) > 0 {
+			key = header[1][0]
+		}
+		for _, number := range []int{2, 3} {
+			if len(header[number]) > 0 {
+				value = header[number][0]
+			}
+		}
+		if len(key) > 0 && key[0] != ':' {
+			req.Header.Add(string(key), string(value))
+		}
+	}
+	// step: the address of the client, when envoy knows it
+	req.RemoteAddr = "0.0.0.0:0"
+	if peer, err := getProtobufField(attributes, 1); err == nil {
+		if address, err := getProtobufField(peer, 1); err == nil {
+			if socket, err := getProtobufField(address, 1); err == nil {
+				if ip, err := getProtobufField(socket, 2); err == nil {
+					req.RemoteAddr = net.JoinHostPort(string(ip), "0")
+				}
+			}
+		}
+	}
+
+	return req, nil
+}
+
+//
+// getProtobufField returns the first length delimited field of the message by number
+//
+func getProtobufField(message []byte, number int) ([]byte, error) {
+	fields, err := decodeProtobufFields(message)
+	if err != nil {
+		return nil, err
+	}
+	if len(fields[number]) <= 0 {
+		return nil, fmt.Errorf("the protobuf field: %d is missing", number)
+	}
+
+	return fields[number][0], nil
+}
+
+//
+// encodeCheckOkResponse permits the request, with the headers the proxy would have added to, or removed from, the
+// upstream request and those it would have added to the response
+//
+//	CheckResponse { Status status = 1; OkHttpResponse ok_response = 3 }
+//	OkHttpResponse { repeated HeaderValueOption headers = 2; repeated string headers_to_remove = 5;
+//	  repeated HeaderValueOption response_headers_to_add = 6 }
+//
+func encodeCheckOkResponse(original, upstream, response http.Header) []byte {
+	var ok []byte
+	for _, name := range sortedHeaderNames(upstream) {
+		if containedIn(name, extAuthzIgnoredHeaders) {
+			continue
+		}
+		value := strings.Join(upstream[name], ",")
+		if value != strings.Join(original[name], ",") {
+			ok = appendProtoBytes(ok, 2, encodeHeaderValueOption(name, value))
+		}
+	}
+	for _, name := range sortedHeaderNames(original) {
+		if _, found := upstream[name]; !found {
+			ok = appendProtoBytes(ok, 5, []byte(name))
+		}
+	}
+	for _, name := range sortedHeaderNames(response) {
+		for _, value := range response[name] {
+			ok = appendProtoBytes(ok, 6, encodeHeaderValueOption(name, value))
+		}
+	}
+	message := appendProtoBytes(nil, 1, appendProtoVarint(nil, 1, grpcStatusOK))
+
+	return appendProtoBytes(message, 3, ok)
+}
+
+//
+// encodeCheckDeniedResponse denies the request, envoy responding to the client as the proxy would have
+//
+//	CheckResponse { Status status = 1; DeniedHttpResponse denied_response = 2 }
+//	DeniedHttpResponse { HttpStatus status = 1; repeated HeaderValueOption headers = 2; string body = 3 }
+//
+func encodeCheckDeniedResponse(status int, header http.Header, body []byte) []byte {
+	code := grpcStatusPermissionDenied
+	if status == http.StatusUnauthorized {
+		code = grpcStatusUnauthenticated
+	}
+	denied := appendProtoBytes(nil, 1, appendProtoVarint(nil, 1, uint64(status)))
+	for _, name := range sortedHeaderNames(header) {
+		if name == "Content-Length" {
+			continue
+		}
+		for _, value := range header[name] {
+			denied = appendProtoBytes(denied, 2, encodeHeaderValueOption(name, value))
+		}
+	}
+	if len(body) > 0 {
+		denied = appendProtoBytes(denied, 3, body)
+	}
+	message := appendProtoBytes(nil, 1, appendProtoVarint(nil, 1, uint64(code)))
+
+	return appendProtoBytes(message, 2, denied)
+}
+
+//
+// encodeHeaderValueOption encodes the header, HeaderValueOption { HeaderValue header = 1 }
+//
+func encodeHeaderValueOption(name, value string) []byte {
+	header := appendProtoBytes(appendProtoBytes(nil, 1, []byte(name)), 2, []byte(value))
+
+	return appendProtoBytes(nil, 1, header)
+}
+
+//
+// sortedHeaderNames returns the names of the headers in order, keeping the responses stable
+//
+func sortedHeaderNames(header http.Header) []string {
+	var names []string
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+//
+// appendProtoVarint appends the varint field to the message
+//
+func appendProtoVarint(message []byte, field int, value uint64) []byte {
+	message = binary.AppendUvarint(message, uint64(field<<3|protoVarint))
+
+	return binary.AppendUvarint(message, value)
+}
+
+//
+// appendProtoBytes appends the length delimited field, a string, bytes or a embedded message, to the message
+//
+func appendProtoBytes(message []byte, field int, content []byte) []byte {
+	message = binary.AppendUvarint(message, uint64(field<<3|protoBytes))
+	message = binary.AppendUvarint(message, uint64(len(content)))
+
+	return append(message, content...)
+}
+
+//
+// extAuthzCheckpoint stops the requests checked on behalf of envoy before the upstream, recording the request as
+// it would have been proxied
+//
+func extAuthzCheckpoint(cx *gin.Context) bool {
+	check := getExtAuthzCheck(cx.Request)
+	if check == nil {
+		return false
+	}
+	check.permitted = true
+	check.request = cx.Request
+	cx.Abort()
+
+	return true
+}
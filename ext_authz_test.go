@@ -0,0 +1,180 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"testing"
+
+	"github.com/coreos/go-oidc/jose"
+	"github.com/stretchr/testify/assert"
+)
+
+// newFakeCheckRequest encodes the envoy check request of the http request
+func newFakeCheckRequest(method, path string, headers map[string]string) []byte {
+	var names []string
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var request []byte
+	request = appendProtoBytes(request, 2, []byte(method))
+	for _, k := range names {
+		request = appendProtoBytes(request, 3, appendProtoBytes(appendProtoBytes(nil, 1, []byte(k)), 2, []byte(headers[k])))
+	}
+	request = appendProtoBytes(request, 3, appendProtoBytes(appendProtoBytes(nil, 1, []byte(":path")), 2, []byte(path)))
+	request = appendProtoBytes(request, 4, []byte(path))
+	request = appendProtoBytes(request, 5, []byte("orders.example.com"))
+	request = appendProtoBytes(request, 6, []byte("https"))
+
+	socket := appendProtoVarint(appendProtoBytes(nil, 2, []byte("10.0.0.1")), 3, 41234)
+	source := appendProtoBytes(nil, 1, appendProtoBytes(nil, 1, socket))
+	attributes := appendProtoBytes(appendProtoBytes(nil, 1, source), 4, appendProtoBytes(nil, 2, request))
+
+	return appendProtoBytes(nil, 1, attributes)
+}
+
+// decodeFakeCheckResponse returns the grpc status, the http status of a denial and the headers of the response
+func decodeFakeCheckResponse(t *testing.T, message []byte) (uint64, uint64, map[string]string) {
+	fields, err := decodeProtobufFields(message)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	var code, status uint64
+	if len(fields[1][0]) > 1 {
+		code, _ = binary.Uvarint(fields[1][0][1:])
+	}
+	headers := make(map[string]string)
+	decodeHeaders := func(list [][]byte) {
+		for _, x := range list {
+			option, _ := decodeProtobufFields(x)
+			header, _ := decodeProtobufFields(option[1][0])
+			headers[string(header[1][0])] = string(header[2][0])
+		}
+	}
+	if len(fields[2]) > 0 {
+		denied, _ := decodeProtobufFields(fields[2][0])
+		status, _ = binary.Uvarint(denied[1][0][1:])
+		decodeHeaders(denied[2])
+	}
+	if len(fields[3]) > 0 {
+		ok, _ := decodeProtobufFields(fields[3][0])
+		decodeHeaders(ok[2])
+		decodeHeaders(ok[6])
+	}
+
+	return code, status, headers
+}
+
+func TestParseCheckRequest(t *testing.T) {
+	req, err := parseCheckRequest(newFakeCheckRequest("POST", "/admin/users?page=2", map[string]string{
+		"authorization": "Bearer token",
+		"cookie":        "kc-access=abc",
+	}))
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	assert.Equal(t, "POST", req.Method)
+	assert.Equal(t, "https://orders.example.com/admin/users?page=2", req.URL.String())
+	assert.Equal(t, "orders.example.com", req.Host)
+	assert.Equal(t, "Bearer token", req.Header.Get("Authorization"))
+	assert.Equal(t, "abc", findCookie("kc-access", req.Cookies()).Value)
+	assert.Empty(t, req.Header.Get(":path"))
+	assert.Equal(t, "10.0.0.1:0", req.RemoteAddr)
+
+	_, err = parseCheckRequest(appendProtoBytes(nil, 1, nil))
+	assert.Error(t, err)
+	_, err = parseCheckRequest([]byte{0x0a, 0x05, 0x01})
+	assert.Error(t, err)
+}
+
+func TestExtAuthzHandler(t *testing.T) {
+	config := newFakeKeycloakConfig()
+	config.NoRedirects = true
+	p, auth, _ := newTestProxyService(config)
+	token, err := jose.NewSignedJWT(auth.claims, auth.signer)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(p.extAuthzHandler))
+	server.Config.Protocols = newH2CProtocols()
+	server.Start()
+	defer server.Close()
+	client := &http.Client{Transport: &http.Transport{Protocols: newH2CProtocols()}}
+
+	cs := []struct {
+		Path     string
+		Headers  map[string]string
+		Code     uint64
+		Status   uint64
+		Expected map[string]string
+	}{
+		{Path: fakeAuthAllURL, Code: grpcStatusUnauthenticated, Status: http.StatusUnauthorized},
+		{Path: fakeTestWhitelistedURL, Code: grpcStatusOK, Expected: map[string]string{headerAuthDecision: decisionWhiteListed}},
+		{
+			Path:    fakeAuthAllURL + "/orders",
+			Headers: map[string]string{"authorization": "Bearer " + token.Encode()},
+			Code:    grpcStatusOK,
+			Expected: map[string]string{
+				"X-Auth-Username": "rjayawardene",
+				"X-Auth-Email":    "gambol99@gmail.com",
+			},
+		},
+		{
+			Path:    fakeAdminRoleURL,
+			Headers: map[string]string{"authorization": "Bearer " + token.Encode()},
+			Code:    grpcStatusPermissionDenied,
+			Status:  http.StatusForbidden,
+		},
+	}
+	for i, c := range cs {
+		req, _ := http.NewRequest("POST", server.URL+extAuthzCheckPath,
+			bytes.NewReader(encodeGRPCMessage(newFakeCheckRequest("GET", c.Path, c.Headers))))
+		req.Header.Set("Content-Type", grpcContentType)
+		resp, err := client.Do(req)
+		if !assert.NoError(t, err, "case %d", i) {
+			continue
+		}
+		message, err := readGRPCMessage(resp.Body)
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if !assert.NoError(t, err, "case %d", i) {
+			continue
+		}
+		assert.Equal(t, 2, resp.ProtoMajor, "case %d", i)
+		assert.Equal(t, "0", resp.Trailer.Get("Grpc-Status"), "case %d", i)
+		code, status, headers := decodeFakeCheckResponse(t, message)
+		assert.Equal(t, c.Code, code, "case %d", i)
+		assert.Equal(t, c.Status, status, "case %d", i)
+		for k, v := range c.Expected {
+			assert.Equal(t, v, headers[k], "case %d, header: %s", i, k)
+		}
+	}
+
+	// step: a unknown method is unimplemented
+	req, _ := http.NewRequest("POST", server.URL+"/envoy.service.auth.v2.Authorization/Check", nil)
+	resp, err := client.Do(req)
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, "12", resp.Header.Get("Grpc-Status"))
+	}
+}
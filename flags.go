@@ -0,0 +1,225 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+// flagAliases are the additional names of the options, so a option can be renamed without breaking the deployments
+// using the old name; note the slice options can't be aliased as the cli doesn't carry their values across the names
+var flagAliases = map[string][]string{
+	"upstream-url": {"upstream"},
+}
+
+// deprecatedFlags are the options, or aliases, still accepted but due to be removed, with the advice given on use
+var deprecatedFlags = map[string]string{}
+
+//
+// flagSpec is the machine readable description of a option
+//
+type flagSpec struct {
+	// the name of the option
+	Name string `json:"name"`
+	// the aliases of the option
+	Aliases []string `json:"aliases,omitempty"`
+	// the type of the value
+	Type string `json:"type"`
+	// the description of the option
+	Usage string `json:"usage"`
+	// the default value
+	Default interface{} `json:"default,omitempty"`
+	// the environment variable the option is read from
+	EnvVar string `json:"env_var,omitempty"`
+	// the advice when the option is deprecated
+	Deprecated string `json:"deprecated,omitempty"`
+	// the advice for the aliases which are deprecated
+	DeprecatedAliases map[string]string `json:"deprecated_aliases,omitempty"`
+}
+
+//
+// newFlagsCommand creates the command to print the options in a machine readable form, i.e. for tooling
+// generating or validating the deployments
+//
+func newFlagsCommand() cli.Command {
+	return cli.Command{
+		Name:      "flags",
+		Usage:     "prints the options, their aliases, types, defaults and deprecations as json",
+		UsageText: "keycloak-proxy flags",
+		Action: func(cx *cli.Context) error {
+			encoder := json.NewEncoder(cx.App.Writer)
+			encoder.SetEscapeHTML(false)
+			encoder.SetIndent("", "  ")
+			if err := encoder.Encode(getFlagSpecs(getOptions())); err != nil {
+				return printError(err.Error())
+			}
+
+			return nil
+		},
+	}
+}
+
+//
+// withFlagAliases adds the aliases to the names of the options
+//
+func withFlagAliases(flags []cli.Flag) []cli.Flag {
+	for i, x := range flags {
+		aliases, found := flagAliases[x.GetName()]
+		if !found {
+			continue
+		}
+		name := strings.Join(append([]string{x.GetName()}, aliases...), ", ")
+		switch f := x.(type) {
+		case cli.StringFlag:
+			f.Name = name
+			flags[i] = f
+		case cli.BoolFlag:
+			f.Name = name
+			flags[i] = f
+		case cli.BoolTFlag:
+			f.Name = name
+			flags[i] = f
+		case cli.IntFlag:
+			f.Name = name
+			flags[i] = f
+		case cli.Int64Flag:
+			f.Name = name
+			flags[i] = f
+		case cli.DurationFlag:
+			f.Name = name
+			flags[i] = f
+		}
+	}
+
+	return flags
+}
+
+//
+// getFlagNames returns the name and aliases of the option
+//
+func getFlagNames(x cli.Flag) (string, []string) {
+	var names []string
+	for _, name := range strings.Split(x.GetName(), ",") {
+		names = append(names, strings.TrimSpace(name))
+	}
+
+	return names[0], names[1:]
+}
+
+//
+// getFlagSpecs returns the machine readable description of the options, sorted by name
+//
+func getFlagSpecs(flags []cli.Flag) []*flagSpec {
+	var list []*flagSpec
+	for _, x := range flags {
+		spec := &flagSpec{}
+		spec.Name, spec.Aliases = getFlagNames(x)
+		switch f := x.(type) {
+		case cli.StringFlag:
+			spec.Type, spec.Usage, spec.EnvVar = "string", f.Usage, f.EnvVar
+			if f.Value != "" {
+				spec.Default = f.Value
+			}
+		case cli.StringSliceFlag:
+			spec.Type, spec.Usage, spec.EnvVar = "string-slice", f.Usage, f.EnvVar
+			if f.Value != nil && len(f.Value.Value()) > 0 {
+				spec.Default = f.Value.Value()
+			}
+		case cli.BoolFlag:
+			spec.Type, spec.Usage, spec.EnvVar = "bool", f.Usage, f.EnvVar
+		case cli.BoolTFlag:
+			spec.Type, spec.Usage, spec.EnvVar, spec.Default = "bool", f.Usage, f.EnvVar, true
+		case cli.IntFlag:
+			spec.Type, spec.Usage, spec.EnvVar = "int", f.Usage, f.EnvVar
+			if f.Value != 0 {
+				spec.Default = f.Value
+			}
+		case cli.Int64Flag:
+			spec.Type, spec.Usage, spec.EnvVar = "int", f.Usage, f.EnvVar
+			if f.Value != 0 {
+				spec.Default = f.Value
+			}
+		case cli.DurationFlag:
+			spec.Type, spec.Usage, spec.EnvVar = "duration", f.Usage, f.EnvVar
+			if f.Value != 0 {
+				spec.Default = f.Value.String()
+			}
+		default:
+			spec.Type = "unknown"
+		}
+		spec.Deprecated = deprecatedFlags[spec.Name]
+		for _, alias := range spec.Aliases {
+			if advice, found := deprecatedFlags[alias]; found {
+				if spec.DeprecatedAliases == nil {
+					spec.DeprecatedAliases = make(map[string]string)
+				}
+				spec.DeprecatedAliases[alias] = advice
+			}
+		}
+		list = append(list, spec)
+	}
+	sort.Sort(flagSpecsByName(list))
+
+	return list
+}
+
+// flagSpecsByName sorts the options by the name
+type flagSpecsByName []*flagSpec
+
+func (s flagSpecsByName) Len() int           { return len(s) }
+func (s flagSpecsByName) Less(i, j int) bool { return s[i].Name < s[j].Name }
+func (s flagSpecsByName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+//
+// getDeprecatedFlagsUsed returns the deprecated options in the command line arguments; the arguments are checked
+// as the cli carries the values across the aliases, so the name used is lost once parsed
+//
+func getDeprecatedFlagsUsed(args []string) []string {
+	var list []string
+	for _, x := range args {
+		if x == "--" {
+			break
+		}
+		if !strings.HasPrefix(x, "-") {
+			continue
+		}
+		name := strings.TrimLeft(x, "-")
+		if i := strings.Index(name, "="); i >= 0 {
+			name = name[:i]
+		}
+		if _, found := deprecatedFlags[name]; found && !containedIn(name, list) {
+			list = append(list, name)
+		}
+	}
+
+	return list
+}
+
+//
+// warnDeprecatedFlags logs a warning for each of the deprecated options used
+//
+func warnDeprecatedFlags(args []string) {
+	for _, name := range getDeprecatedFlagsUsed(args) {
+		log.WithFields(log.Fields{
+			"option": name,
+		}).Warnf("the option --%s is deprecated and will be removed, %s", name, deprecatedFlags[name])
+	}
+}
@@ -0,0 +1,102 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/urfave/cli"
+)
+
+func TestFlagAliases(t *testing.T) {
+	specs := make(map[string]*flagSpec)
+	for _, x := range getFlagSpecs(getOptions()) {
+		specs[x.Name] = x
+	}
+	// step: ensure the aliases have been applied, i.e. not registered against a slice option
+	for name, aliases := range flagAliases {
+		if assert.Contains(t, specs, name) {
+			assert.Equal(t, aliases, specs[name].Aliases, "the aliases of %s have not been applied", name)
+		}
+	}
+
+	for _, args := range [][]string{
+		{"", "--upstream", "http://127.0.0.1:8080"},
+		{"", "--upstream-url=http://127.0.0.1:8080"},
+	} {
+		config := &Config{}
+		app := cli.NewApp()
+		app.Flags = getOptions()
+		app.Action = func(cx *cli.Context) error {
+			return readOptions(cx, config)
+		}
+		assert.NoError(t, app.Run(args))
+		assert.Equal(t, "http://127.0.0.1:8080", config.Upstream, "args: %v", args)
+	}
+}
+
+func TestGetDeprecatedFlagsUsed(t *testing.T) {
+	deprecatedFlags["old-option"] = "use --new-option"
+	defer delete(deprecatedFlags, "old-option")
+
+	cs := []struct {
+		Args     []string
+		Expected []string
+	}{
+		{Args: []string{"--upstream-url", "http://127.0.0.1"}},
+		{Args: []string{"--old-option", "value"}, Expected: []string{"old-option"}},
+		{Args: []string{"-old-option=value", "--old-option=value"}, Expected: []string{"old-option"}},
+		{Args: []string{"selftest", "--old-option"}, Expected: []string{"old-option"}},
+		{Args: []string{"--", "--old-option"}},
+	}
+	for i, c := range cs {
+		assert.Equal(t, c.Expected, getDeprecatedFlagsUsed(c.Args), "case %d", i)
+	}
+}
+
+func TestFlagsCommand(t *testing.T) {
+	deprecatedFlags["upstream"] = "use --upstream-url"
+	defer delete(deprecatedFlags, "upstream")
+
+	output := &bytes.Buffer{}
+	app := newOauthProxyApp()
+	app.Writer = output
+	if !assert.NoError(t, app.Run([]string{"", "flags"})) {
+		t.FailNow()
+	}
+	var specs []*flagSpec
+	if !assert.NoError(t, json.Unmarshal(output.Bytes(), &specs)) {
+		t.FailNow()
+	}
+	assert.Equal(t, len(getOptions()), len(specs))
+	for _, x := range specs {
+		switch x.Name {
+		case "upstream-url":
+			assert.Equal(t, []string{"upstream"}, x.Aliases)
+			assert.Equal(t, "string", x.Type)
+			assert.Equal(t, "PROXY_UPSTREAM_URL", x.EnvVar)
+			assert.Equal(t, map[string]string{"upstream": "use --upstream-url"}, x.DeprecatedAliases)
+		case "upstream-timeout":
+			assert.Equal(t, "duration", x.Type)
+			assert.Equal(t, "10s", x.Default)
+		case "resource":
+			assert.Equal(t, "string-slice", x.Type)
+		}
+	}
+}
@@ -16,12 +16,14 @@ limitations under the License.
 package main
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/coreos/go-oidc/jose"
+	"github.com/coreos/go-oidc/oauth2"
 	"github.com/coreos/go-oidc/oidc"
 	"github.com/gin-gonic/gin"
 )
@@ -34,11 +36,36 @@ func (r *oauthProxy) reverveProxyMiddleware() gin.HandlerFunc {
 		if cx.IsAborted() {
 			return
 		}
+		// step: is the request being checked on behalf of envoy, i.e. not proxied by us?
+		if extAuthzCheckpoint(cx) {
+			return
+		}
+		endpoint, err := r.getEndpoint(cx)
+		if err != nil {
+			log.WithFields(log.Fields{"error": err.Error()}).Warnf("unable to select the upstream endpoint")
+			cx.AbortWithStatus(http.StatusBadGateway)
+			return
+		}
+
+		// step: is this a long lived connection, i.e. a websocket or event stream?
+		if kind := getUpgradeType(cx.Request); kind != "" && r.upgrades != nil {
+			release, permitted := r.acquireUpgrade(cx, kind)
+			if !permitted {
+				return
+			}
+			defer release()
+		}
 
 		// step: is this connection upgrading?
 		if isUpgradedConnection(cx.Request) {
 			log.Debugf("upgrading the connnection to %s", cx.Request.Header.Get(headerUpgrade))
-			if err := tryUpdateConnection(cx, r.endpoint); err != nil {
+			tlsConfig, err := r.upstreamTLS.getConfig(endpoint.Hostname())
+			if err != nil {
+				log.WithFields(log.Fields{"error": err.Error()}).Errorf("unable to create the upstream tls configuration")
+				cx.AbortWithStatus(http.StatusInternalServerError)
+				return
+			}
+			if err := tryUpdateConnection(cx, endpoint, tlsConfig); err != nil {
 				log.WithFields(log.Fields{"error": err.Error()}).Errorf("failed to upgrade the connection")
 				cx.AbortWithStatus(http.StatusInternalServerError)
 				return
@@ -50,9 +77,55 @@ func (r *oauthProxy) reverveProxyMiddleware() gin.HandlerFunc {
 			By default goproxy only provides a forwarding proxy, thus all requests have to be absolute
 			and we must update the host headers
 		*/
-		cx.Request.URL.Host = r.endpoint.Host
-		cx.Request.URL.Scheme = r.endpoint.Scheme
-		cx.Request.Host = r.endpoint.Host
+		cx.Request.URL.Host = endpoint.Host
+		cx.Request.URL.Scheme = endpoint.Scheme
+		cx.Request.Host = endpoint.Host
+
+		// step: strip the hop-by-hop headers and check the header limits
+		if err := r.sanitizeUpstreamRequest(cx.Request); err != nil {
+			log.WithFields(log.Fields{"error": err.Error()}).Warnf("refusing to proxy the request upstream")
+			cx.AbortWithStatus(http.StatusRequestHeaderFieldsTooLarge)
+			return
+		}
+
+		// step: pass the time remaining before the proxy gives up to the upstream
+		if r.config.EnableDeadlinePropagation {
+			setDeadlineHeaders(cx.Request, time.Now())
+		}
+
+		// step: are we sending the client address to the upstream via the proxy protocol?
+		if r.config.UpstreamProxyProtocol {
+			header, err := getUpstreamProxyHeader(cx.Request.Context(), cx.Request.RemoteAddr)
+			if err != nil {
+				log.WithFields(log.Fields{"error": err.Error()}).Errorf("unable to create the upstream proxy protocol header")
+				cx.AbortWithStatus(http.StatusInternalServerError)
+				return
+			}
+			cx.Request = cx.Request.WithContext(context.WithValue(cx.Request.Context(), upstreamProxyHeaderKey, header))
+		}
+
+		// step: sign the upstream request if required
+		if err := signUpstreamRequest(r.config.UpstreamSigning, cx.Request); err != nil {
+			log.WithFields(log.Fields{"error": err.Error()}).Errorf("failed to sign the upstream request")
+			cx.AbortWithStatus(getSigningErrorStatus(err))
+			return
+		}
+
+		// step: the casing is applied last, as the headers can no longer be accessed by the canonical name
+		applyHeaderCasing(cx.Request.Header, r.config.UpstreamHeaderCasing)
+
+		r.connections.requestStarted()
+		defer r.connections.requestDone()
+
+		if r.config.EnableDebugHeaders {
+			cx.Set(cxUpstreamStarted, time.Now())
+		}
+
+		// step: is this a grpc-web request from a browser?
+		if r.grpcWeb != nil && isGRPCWebRequest(cx.Request) {
+			r.grpcWeb.ServeHTTP(cx.Writer, cx.Request)
+			return
+		}
 
 		r.upstream.ServeHTTP(cx.Writer, cx.Request)
 	}
@@ -86,18 +159,28 @@ func (r *oauthProxy) forwardProxyMiddleware() gin.HandlerFunc {
 			// step: do we have a access token
 			if requireLogin {
 				log.WithFields(log.Fields{
-					"username": r.config.ForwardingUsername,
+					"grant_type": r.config.ForwardingGrantType,
+					"username":   r.config.ForwardingUsername,
 				}).Debugf("requesting a access token for user")
 
-				// step: login into the service
-				resp, err := client.UserCredsToken(r.config.ForwardingUsername, r.config.ForwardingPassword)
+				// step: login into the service, as the user or the client itself
+				var resp oauth2.TokenResponse
+				var err error
+				switch r.config.ForwardingGrantType {
+				case oauth2.GrantTypeClientCreds:
+					resp, err = client.ClientCredsToken(append(r.config.Scopes, oidc.DefaultScope...))
+				default:
+					resp, err = client.UserCredsToken(r.config.ForwardingUsername, r.config.ForwardingPassword)
+				}
 				if err != nil {
 					log.WithFields(log.Fields{
 						"error": err.Error(),
 					}).Error("failed to login to authentication service")
 
 					// step: backoff and reschedule
-					<-time.After(time.Duration(5) * time.Second)
+					if !r.wait(time.Duration(5) * time.Second) {
+						return
+					}
 					continue
 				}
 
@@ -109,7 +192,9 @@ func (r *oauthProxy) forwardProxyMiddleware() gin.HandlerFunc {
 					}).Errorf("failed to parse the access token")
 
 					// step: we should probably hope and reschedule here
-					<-time.After(time.Duration(5) * time.Second)
+					if !r.wait(time.Duration(5) * time.Second) {
+						return
+					}
 					continue
 				}
 
@@ -119,7 +204,9 @@ func (r *oauthProxy) forwardProxyMiddleware() gin.HandlerFunc {
 						"error": err.Error(),
 					}).Errorf("failed to parse claims in access token")
 
-					<-time.After(time.Duration(5) * time.Second)
+					if !r.wait(time.Duration(5) * time.Second) {
+						return
+					}
 					continue
 				}
 
@@ -131,14 +218,16 @@ func (r *oauthProxy) forwardProxyMiddleware() gin.HandlerFunc {
 					}).Errorf("failed to decode the identity of access token")
 
 					// step: reschedule a reattempt in x seconds
-					<-time.After(time.Duration(5) * time.Second)
+					if !r.wait(time.Duration(5) * time.Second) {
+						return
+					}
 					continue
 				}
 
 				// step: print some logging for debug purposes
 				// step: set the expiration of the access token within a random 85% of
 				// actual expiration
-				seconds := int(float64(identity.ExpiresAt.Sub(time.Now()).Seconds()) * 0.85)
+				seconds := int(float64((identity.ExpiresAt.Sub(time.Now()) - r.config.SkewTolerance).Seconds()) * 0.85)
 				expires = time.Now().Add(time.Duration(seconds) * time.Second)
 
 				// step: update the loop state
@@ -191,7 +280,9 @@ func (r *oauthProxy) forwardProxyMiddleware() gin.HandlerFunc {
 							"error": err.Error(),
 						}).Errorf("failed to refresh the access token")
 					}
-					<-time.After(time.Duration(5) * time.Second)
+					if !r.wait(time.Duration(5) * time.Second) {
+						return
+					}
 					continue
 				}
 
@@ -207,7 +298,9 @@ func (r *oauthProxy) forwardProxyMiddleware() gin.HandlerFunc {
 					"expires": expires.String(),
 				}).Debugf("waiting for expiration of access token")
 
-				<-time.After(expires.Sub(time.Now()))
+				if !r.wait(expires.Sub(time.Now())) {
+					return
+				}
 			}
 		}
 	}()
@@ -229,6 +322,40 @@ func (r *oauthProxy) forwardProxyMiddleware() gin.HandlerFunc {
 		cx.Request.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token.Encode()))
 
 	PROXY:
+		if err := r.sanitizeUpstreamRequest(cx.Request); err != nil {
+			log.WithFields(log.Fields{"error": err.Error()}).Warnf("refusing to forward the outbound request")
+			cx.AbortWithStatus(http.StatusRequestHeaderFieldsTooLarge)
+			return
+		}
+
+		// step: sign the outbound request if required
+		if err := signUpstreamRequest(r.config.UpstreamSigning, cx.Request); err != nil {
+			log.WithFields(log.Fields{"error": err.Error()}).Errorf("failed to sign the outbound request")
+			cx.AbortWithStatus(getSigningErrorStatus(err))
+			return
+		}
+
+		r.connections.requestStarted()
+		defer r.connections.requestDone()
+
 		r.upstream.ServeHTTP(cx.Writer, cx.Request)
 	}
 }
+
+//
+// sanitizeUpstreamRequest strips the hop-by-hop headers and enforces the header limits on the upstream request
+//
+func (r *oauthProxy) sanitizeUpstreamRequest(req *http.Request) error {
+	stripHopByHopHeaders(req.Header)
+	if r.config.DedupeForwardedHeaders {
+		dedupeForwardedHeaders(req.Header)
+	}
+	if r.config.UpstreamMaxHeaderSize > 0 && headerSize(req.Header) > r.config.UpstreamMaxHeaderSize {
+		return ErrHeadersTooLarge
+	}
+	if r.config.UpstreamMaxHeaders > 0 && headerCount(req.Header) > r.config.UpstreamMaxHeaders {
+		return ErrTooManyHeaders
+	}
+
+	return nil
+}
@@ -0,0 +1,115 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gin-gonic/gin"
+)
+
+// frontchannelLogoutPage is the empty page rendered in the iframe of the provider
+const frontchannelLogoutPage = "<!DOCTYPE html><html><head><title>Logged out</title></head><body></body></html>"
+
+//
+// isFrontchannelLogoutSession checks the issuer and session of the logout request are those of the session of the
+// user; either may be absent, unless the session is required
+//
+func (r *oauthProxy) isFrontchannelLogoutSession(user *userContext, issuer, sid string) bool {
+	if r.config.FrontchannelLogoutSessionRequired && (issuer == "" || sid == "") {
+		return false
+	}
+	claims, err := user.token.Claims()
+	if err != nil {
+		return false
+	}
+	if issuer != "" {
+		iss, _, _ := claims.StringClaim("iss")
+		if !isSameIssuer(issuer, iss) {
+			return false
+		}
+	}
+	if sid != "" {
+		for _, x := range []string{claimSessionID, claimSessionState} {
+			if v, found, err := claims.StringClaim(x); err == nil && found && v == sid {
+				return true
+			}
+		}
+		return false
+	}
+
+	return true
+}
+
+//
+// frontchannelLogoutHandler is loaded by the provider in a iframe when the user logs out of the single sign-on
+// session, clearing the cookies of the session (openid connect front-channel logout 1.0)
+//
+func (r *oauthProxy) frontchannelLogoutHandler(cx *gin.Context) {
+	cx.Header("Cache-Control", "no-cache, no-store")
+	cx.Header("Pragma", "no-cache")
+	// step: the page is framed by the provider, so must not be refused by the security filter
+	if w, ok := cx.Writer.(*securityHeadersWriter); ok {
+		delete(w.headers, "X-Frame-Options")
+		delete(w.headers, "Content-Security-Policy")
+	}
+	cx.Writer.Header().Del("X-Frame-Options")
+	cx.Writer.Header().Del("Content-Security-Policy")
+
+	issuer := cx.Query("iss")
+	sid := cx.Query(claimSessionID)
+
+	user, err := r.getIdentity(cx)
+	switch {
+	case err != nil:
+		// step: there's no session to log out, though any stale cookies are removed
+		r.clearAllCookies(cx)
+	case user.isBearer():
+	case !r.isFrontchannelLogoutSession(user, issuer, sid):
+		log.WithFields(log.Fields{
+			"client_ip": cx.ClientIP(),
+			"subject":   user.id,
+			"session":   sid,
+		}).Warnf("ignoring the front-channel logout, the issuer or session does not match the session of the user")
+	default:
+		r.clearAllCookies(cx)
+		if r.useStore() {
+			if err := r.DeleteRefreshToken(user.token); err != nil {
+				log.WithFields(log.Fields{
+					"error": err.Error(),
+				}).Errorf("unable to remove the refresh token from store")
+			}
+			if r.config.MaxSessions > 0 {
+				if err := r.removeSession(user); err != nil {
+					log.WithFields(log.Fields{
+						"error": err.Error(),
+					}).Errorf("unable to remove the session from store")
+				}
+			}
+		}
+
+		log.WithFields(log.Fields{
+			"event":   "session_logout",
+			"subject": user.id,
+			"email":   user.email,
+			"session": sid,
+		}).Infof("the provider has logged out the session of user: %s", user.email)
+	}
+
+	cx.Data(http.StatusOK, "text/html; charset=utf-8", []byte(frontchannelLogoutPage))
+	cx.Abort()
+}
@@ -0,0 +1,73 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/coreos/go-oidc/jose"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFrontchannelLogoutHandler(t *testing.T) {
+	config := newFakeKeycloakConfig()
+	config.EnableFrontchannelLogout = true
+	config.EnableSecurityFilter = true
+	p, auth, u := newTestProxyService(config)
+	session, err := jose.NewSignedJWT(auth.claims, auth.signer)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	sid := auth.claims["session_state"].(string)
+
+	cs := []struct {
+		Query    url.Values
+		Required bool
+		Cookie   bool
+		Cleared  bool
+	}{
+		{Query: url.Values{}, Cookie: true, Cleared: true},
+		{Query: url.Values{"iss": {auth.claims["iss"].(string)}, "sid": {sid}}, Cookie: true, Cleared: true},
+		{Query: url.Values{"sid": {"another"}}, Cookie: true},
+		{Query: url.Values{"iss": {"https://another.example.com"}, "sid": {sid}}, Cookie: true},
+		{Query: url.Values{"sid": {sid}}, Cookie: true, Required: true},
+		{Query: url.Values{}, Cleared: true},
+	}
+	for i, c := range cs {
+		p.config.FrontchannelLogoutSessionRequired = c.Required
+		req, _ := http.NewRequest("GET", u+oauthURL+frontchannelURL+"?"+c.Query.Encode(), nil)
+		if c.Cookie {
+			req.AddCookie(&http.Cookie{Name: config.CookieAccessName, Value: session.Encode()})
+		}
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if !assert.NoError(t, err, "case %d", i) {
+			continue
+		}
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode, "case %d", i)
+		assert.Empty(t, resp.Header.Get("X-Frame-Options"), "case %d, the page must be permitted in a frame", i)
+		assert.Contains(t, resp.Header.Get("Cache-Control"), "no-store", "case %d", i)
+		cleared := false
+		for _, x := range resp.Cookies() {
+			if x.Name == config.CookieAccessName && x.Value == "" {
+				cleared = true
+			}
+		}
+		assert.Equal(t, c.Cleared, cleared, "case %d", i)
+	}
+}
@@ -0,0 +1,76 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"math/big"
+
+	"github.com/urfave/cli"
+)
+
+// encryptionKeyCharacters are the characters used in a generated key, keeping it safe for the shell and yaml
+const encryptionKeyCharacters = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+
+//
+// newGenerateKeyCommand creates the command to generate a encryption key
+//
+func newGenerateKeyCommand() cli.Command {
+	return cli.Command{
+		Name:      "generate-key",
+		Usage:     "generates a random encryption key of the correct length for the --encryption-key option",
+		UsageText: "keycloak-proxy generate-key [--bits 256]",
+		Flags: []cli.Flag{
+			cli.IntFlag{
+				Name:  "bits",
+				Usage: "the size of the aes key, either 128 or 256",
+				Value: 256,
+			},
+		},
+		Action: func(cx *cli.Context) error {
+			key, err := generateEncryptionKey(cx.Int("bits"))
+			if err != nil {
+				return printError(err.Error())
+			}
+			fmt.Fprintln(cx.App.Writer, key)
+
+			return nil
+		},
+	}
+}
+
+//
+// generateEncryptionKey generates a random key for aes-128 or aes-256, the key is used as is so each character
+// is a byte of the key
+//
+func generateEncryptionKey(bits int) (string, error) {
+	if bits != 128 && bits != 256 {
+		return "", fmt.Errorf("the key size must be either 128 or 256 bits, not %d", bits)
+	}
+
+	max := big.NewInt(int64(len(encryptionKeyCharacters)))
+	key := make([]byte, bits/8)
+	for i := range key {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		key[i] = encryptionKeyCharacters[n.Int64()]
+	}
+
+	return string(key), nil
+}
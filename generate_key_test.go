@@ -0,0 +1,59 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGenerateEncryptionKey(t *testing.T) {
+	cases := []struct {
+		Bits   int
+		Length int
+		Error  bool
+	}{
+		{Bits: 128, Length: 16},
+		{Bits: 256, Length: 32},
+		{Bits: 192, Error: true},
+		{Bits: 0, Error: true},
+	}
+	for i, c := range cases {
+		key, err := generateEncryptionKey(c.Bits)
+		if c.Error {
+			assert.Error(t, err, "case %d should have failed", i)
+			continue
+		}
+		if !assert.NoError(t, err, "case %d should not have failed", i) {
+			continue
+		}
+		assert.Len(t, key, c.Length, "case %d, expected length: %d", i, c.Length)
+		for _, x := range key {
+			assert.True(t, strings.ContainsRune(encryptionKeyCharacters, x), "case %d, invalid character: %c", i, x)
+		}
+		// step: the key must be accepted by the cipher
+		encrypted, err := encodeText("test", key)
+		assert.NoError(t, err, "case %d, the key was not accepted", i)
+		decrypted, _ := decodeText(encrypted, key)
+		assert.Equal(t, "test", decrypted, "case %d", i)
+	}
+
+	first, _ := generateEncryptionKey(256)
+	second, _ := generateEncryptionKey(256)
+	assert.NotEqual(t, first, second)
+}
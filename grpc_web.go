@@ -0,0 +1,212 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"sort"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	// grpcContentType is the content type of the grpc requests
+	grpcContentType = "application/grpc"
+	// grpcWebContentType is the content type of the binary grpc-web requests
+	grpcWebContentType = "application/grpc-web"
+	// grpcWebTextContentType is the content type of the base64 encoded grpc-web requests
+	grpcWebTextContentType = "application/grpc-web-text"
+	// grpcWebTrailerFlag marks a frame of the grpc-web response as the trailers
+	grpcWebTrailerFlag = 0x80
+)
+
+// errGRPCWebTextEncoding indicates the base64 of a grpc-web-text request is malformed
+var errGRPCWebTextEncoding = errors.New("the grpc-web-text request is not valid base64")
+
+//
+// grpcWebProxy translates the grpc-web requests of the browsers to grpc, which requires http/2 to the upstream
+//
+type grpcWebProxy struct {
+	// the transport to the upstream, speaking http/2 only
+	transport *http.Transport
+}
+
+//
+// newGRPCWebProxy creates the grpc-web translation, deriving the transport from that of the upstream; plain http
+// upstreams are spoken to via h2c (http/2 with prior knowledge), which requires go 1.24
+//
+func newGRPCWebProxy(upstream *http.Transport) *grpcWebProxy {
+	transport := upstream.Clone()
+	transport.Protocols = newH2CProtocols()
+	transport.Protocols.SetHTTP2(true)
+
+	return &grpcWebProxy{transport: transport}
+}
+
+//
+// isGRPCWebRequest checks if the request is grpc-web, either the binary or text form
+//
+func isGRPCWebRequest(req *http.Request) bool {
+	media, _, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+
+	return strings.HasPrefix(media, grpcWebContentType)
+}
+
+//
+// decodeGRPCWebText decodes the body of a grpc-web-text request; the messages are encoded individually, so the
+// padding can appear mid stream and the content is decoded a quantum at a time
+//
+func decodeGRPCWebText(content []byte) ([]byte, error) {
+	content = bytes.Join(bytes.Fields(content), nil)
+	if len(content)%4 != 0 {
+		return nil, errGRPCWebTextEncoding
+	}
+	decoded := make([]byte, 0, len(content)/4*3)
+	quantum := make([]byte, 3)
+	for i := 0; i < len(content); i += 4 {
+		n, err := base64.StdEncoding.Decode(quantum, content[i:i+4])
+		if err != nil {
+			return nil, errGRPCWebTextEncoding
+		}
+		decoded = append(decoded, quantum[:n]...)
+	}
+
+	return decoded, nil
+}
+
+//
+// encodeGRPCWebTrailers encodes the grpc trailers as the trailer frame of the grpc-web response
+//
+func encodeGRPCWebTrailers(trailers http.Header) []byte {
+	var keys []string
+	for k := range trailers {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	payload := &bytes.Buffer{}
+	for _, k := range keys {
+		for _, v := range trailers[k] {
+			payload.WriteString(strings.ToLower(k) + ": " + v + "\r\n")
+		}
+	}
+	frame := make([]byte, 5, 5+payload.Len())
+	frame[0] = grpcWebTrailerFlag
+	binary.BigEndian.PutUint32(frame[1:], uint32(payload.Len()))
+
+	return append(frame, payload.Bytes()...)
+}
+
+//
+// ServeHTTP translates the grpc-web request to grpc, the response is streamed back as grpc-web with the trailers
+// as the last frame
+//
+func (r *grpcWebProxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	media, params, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	text := strings.HasPrefix(media, grpcWebTextContentType)
+
+	// step: translate the request to grpc
+	if text {
+		content, err := ioutil.ReadAll(req.Body)
+		if err == nil {
+			content, err = decodeGRPCWebText(content)
+		}
+		if err != nil {
+			log.WithFields(log.Fields{"error": err.Error()}).Warnf("unable to decode the grpc-web-text request")
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(content))
+		req.ContentLength = int64(len(content))
+		media = grpcContentType + strings.TrimPrefix(media, grpcWebTextContentType)
+	} else {
+		media = grpcContentType + strings.TrimPrefix(media, grpcWebContentType)
+	}
+	req.Header.Set("Content-Type", mime.FormatMediaType(media, params))
+	req.Header.Set("TE", "trailers")
+	req.Header.Del("Content-Length")
+	req.RequestURI = ""
+
+	resp, err := r.transport.RoundTrip(req)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err.Error()}).Errorf("unable to proxy the grpc-web request upstream")
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	// step: translate the response to grpc-web, the content type mirroring the request
+	for k, v := range resp.Header {
+		if k != "Content-Length" && k != "Trailer" {
+			w.Header()[k] = v
+		}
+	}
+	contentType := grpcWebContentType
+	if text {
+		contentType = grpcWebTextContentType
+	}
+	if upstream := resp.Header.Get("Content-Type"); strings.HasPrefix(upstream, grpcContentType) {
+		contentType += strings.TrimPrefix(upstream, grpcContentType)
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(resp.StatusCode)
+
+	// step: stream the messages, each chunk encoded on it's own in text mode
+	write := func(b []byte) error {
+		if text {
+			b = []byte(base64.StdEncoding.EncodeToString(b))
+		}
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+		if flusher, ok := w.(http.Flusher); ok {
+			flusher.Flush()
+		}
+		return nil
+	}
+	buffer := make([]byte, 32*1024)
+	for {
+		n, err := resp.Body.Read(buffer)
+		if n > 0 {
+			if werr := write(buffer[:n]); werr != nil {
+				return
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.WithFields(log.Fields{"error": err.Error()}).Warnf("unable to read the grpc response from upstream")
+			return
+		}
+	}
+
+	// step: the trailers, absent on a trailers only response, where the status was in the headers
+	if len(resp.Trailer) > 0 {
+		write(encodeGRPCWebTrailers(resp.Trailer))
+	}
+}
@@ -0,0 +1,131 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newFakeGRPCMessage frames the payload as a grpc message
+func newFakeGRPCMessage(payload string) []byte {
+	return append([]byte{0, 0, 0, 0, byte(len(payload))}, payload...)
+}
+
+// newFakeGRPCUpstream creates a h2c upstream echoing the grpc message back, with a status trailer
+func newFakeGRPCUpstream(t *testing.T) *httptest.Server {
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		assert.Equal(t, 2, req.ProtoMajor)
+		assert.Equal(t, "application/grpc+proto", req.Header.Get("Content-Type"))
+		assert.Equal(t, "trailers", req.Header.Get("TE"))
+		content, _ := ioutil.ReadAll(req.Body)
+		w.Header().Set("Content-Type", "application/grpc+proto")
+		w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+		w.WriteHeader(http.StatusOK)
+		w.Write(content)
+		w.Header().Set("Grpc-Status", "0")
+		w.Header().Set("Grpc-Message", "ok")
+	}))
+	upstream.Config.Protocols = newH2CProtocols()
+	upstream.Start()
+
+	return upstream
+}
+
+func TestDecodeGRPCWebText(t *testing.T) {
+	first, second := newFakeGRPCMessage("a"), newFakeGRPCMessage("hello")
+	encoded := base64.StdEncoding.EncodeToString(first) + base64.StdEncoding.EncodeToString(second)
+	decoded, err := decodeGRPCWebText([]byte(encoded))
+	assert.NoError(t, err)
+	assert.Equal(t, append(first, second...), decoded)
+
+	_, err = decodeGRPCWebText([]byte("abc"))
+	assert.Equal(t, errGRPCWebTextEncoding, err)
+	_, err = decodeGRPCWebText([]byte("a*b="))
+	assert.Equal(t, errGRPCWebTextEncoding, err)
+}
+
+func TestEncodeGRPCWebTrailers(t *testing.T) {
+	frame := encodeGRPCWebTrailers(http.Header{"Grpc-Status": {"0"}, "Grpc-Message": {"ok"}})
+	payload := "grpc-message: ok\r\ngrpc-status: 0\r\n"
+	assert.Equal(t, append([]byte{grpcWebTrailerFlag, 0, 0, 0, byte(len(payload))}, payload...), frame)
+}
+
+func TestIsGRPCWebRequest(t *testing.T) {
+	for contentType, expected := range map[string]bool{
+		"application/grpc-web":       true,
+		"application/grpc-web+proto": true,
+		"application/grpc-web-text":  true,
+		"application/grpc":           false,
+		"application/json":           false,
+		"":                           false,
+	} {
+		req, _ := http.NewRequest(http.MethodPost, "/", nil)
+		req.Header.Set("Content-Type", contentType)
+		assert.Equal(t, expected, isGRPCWebRequest(req), "content type: %s", contentType)
+	}
+}
+
+func TestGRPCWebTranslation(t *testing.T) {
+	upstream := newFakeGRPCUpstream(t)
+	defer upstream.Close()
+
+	config := newFakeKeycloakConfig()
+	config.Upstream = upstream.URL
+	config.EnableGRPCWeb = true
+	p, _, u := newTestProxyService(config)
+	if !assert.NoError(t, p.createUpstreamProxy(p.endpoint)) {
+		t.FailNow()
+	}
+	message := newFakeGRPCMessage("hello")
+	trailers := encodeGRPCWebTrailers(http.Header{"Grpc-Status": {"0"}, "Grpc-Message": {"ok"}})
+
+	cases := []struct {
+		ContentType string
+		Body        []byte
+		Expected    []byte
+	}{
+		{
+			ContentType: "application/grpc-web+proto",
+			Body:        message,
+			Expected:    append(append([]byte{}, message...), trailers...),
+		},
+		{
+			ContentType: "application/grpc-web-text+proto",
+			Body:        []byte(base64.StdEncoding.EncodeToString(message)),
+			Expected:    []byte(base64.StdEncoding.EncodeToString(message) + base64.StdEncoding.EncodeToString(trailers)),
+		},
+	}
+	for i, c := range cases {
+		req, _ := http.NewRequest(http.MethodPost, u+fakeTestWhitelistedURL+"/test.Echo/Say", bytes.NewReader(c.Body))
+		req.Header.Set("Content-Type", c.ContentType)
+		resp, err := http.DefaultClient.Do(req)
+		if !assert.NoError(t, err, "case %d, unable to make the request", i) {
+			continue
+		}
+		content, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode, "case %d, unexpected status", i)
+		assert.Equal(t, c.ContentType, resp.Header.Get("Content-Type"), "case %d, unexpected content type", i)
+		assert.Equal(t, c.Expected, content, "case %d, unexpected body", i)
+	}
+}
@@ -26,6 +26,7 @@ import (
 	"time"
 
 	log "github.com/Sirupsen/logrus"
+	"github.com/coreos/go-oidc/oauth2"
 	"github.com/gin-gonic/gin"
 )
 
@@ -39,7 +40,7 @@ func (r *oauthProxy) oauthAuthorizationHandler(cx *gin.Context) {
 		return
 	}
 
-	client, err := r.client.OAuthClient()
+	client, err := r.getRedirectClient(cx).OAuthClient()
 	if err != nil {
 		log.WithFields(log.Fields{
 			"error": err.Error(),
@@ -55,8 +56,56 @@ func (r *oauthProxy) oauthAuthorizationHandler(cx *gin.Context) {
 		accessType = "offline"
 	}
 
+	// step: append the fragment handed over by the browser to the state
+	state := cx.Query("state")
+	fragment := cx.Query("fragment")
+	if fragment != "" && r.config.PreserveFragments && !r.config.EnableSignedState {
+		if decoded, err := base64.StdEncoding.DecodeString(state); err == nil {
+			state = base64.StdEncoding.EncodeToString([]byte(string(decoded) + "#" + fragment))
+		}
+	}
+
+	// step: the signed state is reissued, defaulting to the root when missing or invalid
+	if r.config.EnableSignedState {
+		redirect, err := decodeSignedState([]byte(r.config.EncryptionKey), state, time.Now())
+		if err != nil {
+			redirect = "/"
+		}
+		if fragment != "" && r.config.PreserveFragments {
+			redirect = redirect + "#" + fragment
+		}
+		if state, err = r.getAuthorizationState(redirect); err != nil {
+			log.WithFields(log.Fields{
+				"error": err.Error(),
+			}).Errorf("unable to encode the authorization state")
+
+			cx.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+	}
+
 	// step: generate the authorization url
-	redirectionURL := client.AuthCodeURL(cx.Query("state"), accessType, "")
+	redirectionURL := addAuthorizationParams(client.AuthCodeURL(state, accessType, ""), r.getAuthorizationParams(cx))
+	if r.pkce != nil {
+		if redirectionURL, err = r.setPKCEVerifier(cx, redirectionURL); err != nil {
+			log.WithFields(log.Fields{
+				"error": err.Error(),
+			}).Errorf("unable to create the pkce code verifier")
+
+			cx.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+	}
+	if r.config.EnableNonce {
+		if redirectionURL, err = r.setNonce(cx, redirectionURL, state); err != nil {
+			log.WithFields(log.Fields{
+				"error": err.Error(),
+			}).Errorf("unable to create the nonce of the login")
+
+			cx.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+	}
 
 	log.WithFields(log.Fields{
 		"client_ip":       cx.ClientIP(),
@@ -65,15 +114,9 @@ func (r *oauthProxy) oauthAuthorizationHandler(cx *gin.Context) {
 	}).Debugf("incoming authorization request from client address: %s", cx.ClientIP())
 
 	// step: if we have a custom sign in page, lets display that
-	if r.config.hasCustomSignInPage() {
+	if page := r.getSignInPage(cx); page != "" {
 		// step: inject any custom tags into the context for the template
-		model := make(map[string]string, 0)
-		for k, v := range r.config.TagData {
-			model[k] = v
-		}
-		model["redirect"] = redirectionURL
-
-		cx.HTML(http.StatusOK, path.Base(r.config.SignInPage), model)
+		cx.HTML(http.StatusOK, path.Base(page), r.config.getSignInPageModel(redirectionURL))
 		return
 	}
 
@@ -97,8 +140,77 @@ func (r *oauthProxy) oauthCallbackHandler(cx *gin.Context) {
 		return
 	}
 
-	// step: exchange the authorization for a access token
-	response, err := exchangeAuthenticationCode(r.client, code)
+	// step: the signed state is verified before the code is exchanged
+	state := "/"
+	if r.config.EnableSignedState {
+		redirect, err := decodeSignedState([]byte(r.config.EncryptionKey), cx.Request.URL.Query().Get("state"), time.Now())
+		if err != nil {
+			log.WithFields(log.Fields{
+				"client_ip": cx.ClientIP(),
+				"error":     err.Error(),
+			}).Warnf("unable to verify the state parameter of the callback")
+
+			cx.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+		state = redirect
+	}
+
+	// step: reject the codes and states which have already been used, i.e. intercepted and replayed
+	if r.replays != nil {
+		now := time.Now()
+		replayed := ""
+		found, err := r.replays.isReplay("code", code, r.config.CallbackReplayWindow, now)
+		if err == nil && found {
+			replayed = "code"
+		} else if err == nil && r.config.EnableSignedState {
+			if found, err = r.replays.isReplay("state", cx.Request.URL.Query().Get("state"), r.config.SignedStateDuration, now); found {
+				replayed = "state"
+			}
+		}
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error": err.Error(),
+			}).Errorf("unable to record the use of the callback in the store, refusing the callback")
+
+			cx.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+		if replayed != "" {
+			log.WithFields(log.Fields{
+				"event":      "callback_replayed",
+				"replayed":   replayed,
+				"client_ip":  cx.ClientIP(),
+				"user_agent": cx.Request.Header.Get("User-Agent"),
+			}).Warnf("the %s of the callback has already been used, rejecting the replay", replayed)
+
+			r.accessForbidden(cx)
+			return
+		}
+	}
+
+	// step: exchange the authorization for a access token, proving the code verifier when using pkce
+	var response oauth2.TokenResponse
+	var err error
+	if r.pkce != nil {
+		var verifier string
+		if verifier, err = r.getPKCEVerifier(cx); err != nil {
+			log.WithFields(log.Fields{
+				"client_ip": cx.ClientIP(),
+				"error":     err.Error(),
+			}).Warnf("unable to retrieve the code verifier of the callback")
+
+			cx.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+		endpoint, clientID, clientSecret := r.provider.TokenEndpoint.String(), r.config.ClientID, r.config.ClientSecret
+		if provider := r.getRequestProvider(cx); provider != nil {
+			endpoint, clientID, clientSecret = provider.provider.TokenEndpoint.String(), provider.ClientID, provider.ClientSecret
+		}
+		response, err = r.pkce.exchange(r.getRedirectClient(cx), endpoint, clientID, clientSecret, code, verifier)
+	} else {
+		response, err = exchangeAuthenticationCode(r.getRedirectClient(cx), code)
+	}
 	if err != nil {
 		log.WithFields(log.Fields{
 			"error": err.Error(),
@@ -120,7 +232,7 @@ func (r *oauthProxy) oauthCallbackHandler(cx *gin.Context) {
 	}
 
 	// step: verify the token is valid
-	if err := verifyToken(r.client, session); err != nil {
+	if err := r.verifySkewedToken(session); err != nil {
 		log.WithFields(log.Fields{
 			"error": err.Error(),
 		}).Errorf("unable to verify the id token")
@@ -129,6 +241,19 @@ func (r *oauthProxy) oauthCallbackHandler(cx *gin.Context) {
 		return
 	}
 
+	// step: ensure the id token was issued for the login of this browser, i.e. not injected
+	if r.config.EnableNonce {
+		if err := r.verifyNonce(cx, session); err != nil {
+			log.WithFields(log.Fields{
+				"client_ip": cx.ClientIP(),
+				"error":     err.Error(),
+			}).Warnf("unable to verify the nonce of the id token")
+
+			r.accessForbidden(cx)
+			return
+		}
+	}
+
 	// step: attempt to decode the access token else we default to the id token
 	accessToken, id, err := parseToken(response.AccessToken)
 	if err != nil {
@@ -147,9 +272,49 @@ func (r *oauthProxy) oauthCallbackHandler(cx *gin.Context) {
 		"idle":     r.config.IdleDuration.String(),
 	}).Infof("issuing a new access token for user, email: %s", identity.Email)
 
+	// step: are we enforcing the concurrent session limit?
+	if r.config.MaxSessions > 0 {
+		user, err := extractIdentity(session)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error": err.Error(),
+			}).Errorf("unable to extract the identity for the session limit")
+
+			r.accessForbidden(cx)
+			return
+		}
+		if err := r.registerSession(user, ""); err != nil {
+			if err != ErrSessionLimitReached {
+				log.WithFields(log.Fields{
+					"error": err.Error(),
+				}).Errorf("unable to register the session in the store")
+			}
+
+			r.accessForbidden(cx)
+			return
+		}
+	}
+
 	// step: drop's a session cookie with the access token
 	r.dropAccessTokenCookie(cx, session.Encode(), r.config.IdleDuration)
 
+	// step: keep the identity token as the hint of the logout redirect
+	if r.endSession != "" {
+		r.dropIDTokenCookie(cx, response.IDToken, r.config.IdleDuration*2)
+	}
+
+	// step: are we binding the session to the client?
+	if r.useSessionBinding() {
+		if err := r.dropSessionBindingCookie(cx, identity.ID, r.config.IdleDuration); err != nil {
+			log.WithFields(log.Fields{
+				"error": err.Error(),
+			}).Errorf("failed to encrypt the session binding")
+
+			cx.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+	}
+
 	// step: does the response has a refresh token and we are NOT ignore refresh tokens?
 	if r.config.EnableRefreshTokens && response.RefreshToken != "" {
 		// step: encrypt the refresh token
@@ -177,8 +342,7 @@ func (r *oauthProxy) oauthCallbackHandler(cx *gin.Context) {
 	}
 
 	// step: decode the state variable
-	state := "/"
-	if cx.Request.URL.Query().Get("state") != "" {
+	if !r.config.EnableSignedState && cx.Request.URL.Query().Get("state") != "" {
 		decoded, err := base64.StdEncoding.DecodeString(cx.Request.URL.Query().Get("state"))
 		if err != nil {
 			log.WithFields(log.Fields{
@@ -189,6 +353,19 @@ func (r *oauthProxy) oauthCallbackHandler(cx *gin.Context) {
 			state = string(decoded)
 		}
 	}
+	if !isRelativeRedirect(state) {
+		log.WithFields(log.Fields{
+			"state": state,
+		}).Warnf("the state parameter is not a relative url, redirecting to the root")
+
+		state = "/"
+	}
+
+	// step: break the loop when the client keeps returning without a session
+	if r.loops != nil && r.loops.record(getLoginLoopClient(cx), time.Now()) {
+		r.loginLoopPage(cx, state)
+		return
+	}
 
 	r.redirectToURL(state, cx)
 }
@@ -237,6 +414,23 @@ func (r *oauthProxy) loginHandler(cx *gin.Context) {
 	// step: drop the access token
 	r.dropAccessTokenCookie(cx, token.AccessToken, r.config.IdleDuration)
 
+	// step: are we binding the session to the client?
+	if r.useSessionBinding() {
+		_, identity, err := parseToken(token.AccessToken)
+		if err == nil {
+			err = r.dropSessionBindingCookie(cx, identity.ID, r.config.IdleDuration)
+		}
+		if err != nil {
+			log.WithFields(log.Fields{
+				"client_ip": cx.ClientIP(),
+				"error":     err.Error(),
+			}).Errorf("unable to bind the session to the client")
+
+			cx.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+	}
+
 	cx.JSON(http.StatusOK, tokenResponse{
 		IDToken:      token.IDToken,
 		AccessToken:  token.AccessToken,
@@ -251,6 +445,7 @@ func (r *oauthProxy) loginHandler(cx *gin.Context) {
 //  - if it's just a access token, the cookie is deleted
 //  - if the user has a refresh token, the token is invalidated by the provider
 //  - optionally, the user can be redirected by to a url
+//  - optionally, the user is redirected to the provider to end the single sign-on session
 //
 func (r *oauthProxy) logoutHandler(cx *gin.Context) {
 	// the user can specify a url to redirect the back to
@@ -268,6 +463,11 @@ func (r *oauthProxy) logoutHandler(cx *gin.Context) {
 	if refresh, err := r.retrieveRefreshToken(cx, user); err == nil {
 		identityToken = refresh
 	}
+	// step: the end session redirect is taken before the identity token cookie is cleared
+	var endSessionURL string
+	if r.endSession != "" && !r.isSkippedProviderLogout(cx) {
+		endSessionURL = r.getEndSessionRedirect(cx, redirectURL)
+	}
 	r.clearAllCookies(cx)
 
 	// step: check if the user has a state session and if so, revoke it
@@ -278,6 +478,13 @@ func (r *oauthProxy) logoutHandler(cx *gin.Context) {
 					"error": err.Error(),
 				}).Errorf("unable to remove the refresh token from store")
 			}
+			if r.config.MaxSessions > 0 {
+				if err := r.removeSession(user); err != nil {
+					log.WithFields(log.Fields{
+						"error": err.Error(),
+					}).Errorf("unable to remove the session from store")
+				}
+			}
 		}()
 	}
 
@@ -339,6 +546,12 @@ func (r *oauthProxy) logoutHandler(cx *gin.Context) {
 		}
 	}
 
+	// step: are we ending the session with the provider?
+	if endSessionURL != "" {
+		r.redirectToURL(endSessionURL, cx)
+		return
+	}
+
 	// step: should we redirect the user
 	if redirectURL != "" {
 		r.redirectToURL(redirectURL, cx)
@@ -391,6 +604,14 @@ func (r *oauthProxy) healthHandler(cx *gin.Context) {
 	cx.String(http.StatusOK, "OK\n")
 }
 
+//
+// versionHandler returns the version and build information of the proxy
+//
+func (r *oauthProxy) versionHandler(cx *gin.Context) {
+	cx.Writer.Header().Set(versionHeader, version)
+	cx.JSON(http.StatusOK, getBuildInfo())
+}
+
 //
 // metricsEndpointHandler forwards the request into the prometheus handler
 //
@@ -16,6 +16,7 @@ limitations under the License.
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/url"
@@ -180,17 +181,17 @@ func TestAuthorizationURL(t *testing.T) {
 		},
 		{
 			URL:          "/admin/test",
-			ExpectedURL:  "/oauth/authorize?state=L2FkbWluL3Rlc3Q=",
+			ExpectedURL:  "/oauth/authorize?state=L2FkbWluL3Rlc3Q%3D",
 			ExpectedCode: http.StatusTemporaryRedirect,
 		},
 		{
 			URL:          "/admin/../",
-			ExpectedURL:  "/oauth/authorize?state=L2FkbWluLy4uLw==",
+			ExpectedURL:  "/oauth/authorize?state=L2FkbWluLy4uLw%3D%3D",
 			ExpectedCode: http.StatusTemporaryRedirect,
 		},
 		{
 			URL:          "/admin?test=yes&test1=test",
-			ExpectedURL:  "/oauth/authorize?state=L2FkbWluP3Rlc3Q9eWVzJnRlc3QxPXRlc3Q=",
+			ExpectedURL:  "/oauth/authorize?state=L2FkbWluP3Rlc3Q9eWVzJnRlc3QxPXRlc3Q%3D",
 			ExpectedCode: http.StatusTemporaryRedirect,
 		},
 	}
@@ -202,7 +203,9 @@ func TestAuthorizationURL(t *testing.T) {
 }
 
 func TestCallbackURL(t *testing.T) {
-	_, _, u := newTestProxyService(nil)
+	config := newFakeKeycloakConfig()
+	config.PreserveFragments = true
+	_, _, u := newTestProxyService(config)
 
 	cs := []struct {
 		URL         string
@@ -220,6 +223,14 @@ func TestCallbackURL(t *testing.T) {
 			URL:         "/oauth/authorize?state=L2FkbWluL3Rlc3QxP3Rlc3QxJmhlbGxv",
 			ExpectedURL: "/admin/test1?test1&hello",
 		},
+		{
+			URL:         "/oauth/authorize?state=L2FkbWluP3E9Pj4%2B",
+			ExpectedURL: "/admin?q=>>>",
+		},
+		{
+			URL:         "/oauth/authorize?state=L2FkbWlu&fragment=section/1",
+			ExpectedURL: "/admin#section/1",
+		},
 	}
 	for i, x := range cs {
 		// step: call the authorization endpoint
@@ -263,3 +274,19 @@ func TestHealthHandler(t *testing.T) {
 	assert.NotEmpty(t, context.Writer.Header().Get(versionHeader))
 	assert.Equal(t, version, context.Writer.Header().Get(versionHeader))
 }
+
+func TestVersionHandler(t *testing.T) {
+	_, _, u := newTestProxyService(nil)
+	resp, err := http.Get(u + oauthURL + versionURL)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, version, resp.Header.Get(versionHeader))
+
+	info := buildInfo{}
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&info))
+	assert.Equal(t, getBuildInfo(), info)
+	assert.Equal(t, release, info.Version)
+	assert.NotEmpty(t, info.GoVersion)
+}
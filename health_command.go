@@ -0,0 +1,117 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+//
+// newHealthCommand creates the command to probe the health of a running proxy, i.e. for a container healthcheck
+//
+func newHealthCommand(config *Config) cli.Command {
+	return cli.Command{
+		Name:      "health",
+		Usage:     "probes the health endpoint of a running proxy, exiting non-zero on failure",
+		UsageText: "keycloak-proxy health [--url URL] [options]",
+		Flags: append(getOptions(),
+			cli.StringFlag{
+				Name:  "url",
+				Usage: "the url to probe, defaults to the health endpoint on the listen address",
+			},
+			cli.DurationFlag{
+				Name:  "timeout",
+				Usage: "the timeout for the probe",
+				Value: time.Duration(5) * time.Second,
+			},
+			cli.BoolFlag{
+				Name:  "insecure",
+				Usage: "skip the verification of the tls certificate of the proxy",
+			},
+		),
+		Action: func(cx *cli.Context) error {
+			location := cx.String("url")
+			if location == "" {
+				if err := parseConfig(cx, config); err != nil {
+					return printError(err.Error())
+				}
+				var err error
+				if location, err = getHealthURL(config); err != nil {
+					return printError(err.Error())
+				}
+			}
+			if err := checkHealth(location, cx.Duration("timeout"), cx.Bool("insecure")); err != nil {
+				return printError(err.Error())
+			}
+
+			return nil
+		},
+	}
+}
+
+//
+// getHealthURL returns the url of the health endpoint for the listen address of the proxy
+//
+func getHealthURL(config *Config) (string, error) {
+	if strings.HasPrefix(config.Listen, "unix://") {
+		return "", errors.New("the proxy is listening on a unix socket, use --url to probe the health endpoint")
+	}
+	host, port, err := net.SplitHostPort(config.Listen)
+	if err != nil {
+		return "", fmt.Errorf("unable to parse the listen address: %s, error: %s", config.Listen, err)
+	}
+	// step: a wildcard listener is probed via the loopback
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = "127.0.0.1"
+	}
+	scheme := "http"
+	if config.useTLS() {
+		scheme = "https"
+	}
+
+	return fmt.Sprintf("%s://%s%s%s", scheme, net.JoinHostPort(host, port), oauthURL, healthURL), nil
+}
+
+//
+// checkHealth probes the url, a failure to connect or any status other than a 200 is a failure
+//
+func checkHealth(location string, timeout time.Duration, insecure bool) error {
+	client := &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: insecure},
+		},
+	}
+	resp, err := client.Get(location)
+	if err != nil {
+		return fmt.Errorf("the health check failed, error: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("the health check failed, %s returned: %s", location, resp.Status)
+	}
+
+	return nil
+}
@@ -0,0 +1,67 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetHealthURL(t *testing.T) {
+	cases := []struct {
+		Listen   string
+		TLS      bool
+		Expected string
+		Error    bool
+	}{
+		{Listen: "127.0.0.1:3000", Expected: "http://127.0.0.1:3000/oauth/health"},
+		{Listen: ":3000", Expected: "http://127.0.0.1:3000/oauth/health"},
+		{Listen: "0.0.0.0:443", TLS: true, Expected: "https://127.0.0.1:443/oauth/health"},
+		{Listen: "[::1]:3000", Expected: "http://[::1]:3000/oauth/health"},
+		{Listen: "unix:///tmp/proxy.sock", Error: true},
+		{Listen: "no_port", Error: true},
+	}
+	for i, c := range cases {
+		config := newFakeKeycloakConfig()
+		config.Listen = c.Listen
+		if c.TLS {
+			config.TLSCertificate = "tls.pem"
+		}
+		location, err := getHealthURL(config)
+		if c.Error {
+			assert.Error(t, err, "case %d should have failed", i)
+			continue
+		}
+		assert.NoError(t, err, "case %d should not have failed", i)
+		assert.Equal(t, c.Expected, location, "case %d, expected: %s, got: %s", i, c.Expected, location)
+	}
+}
+
+func TestCheckHealth(t *testing.T) {
+	_, _, u := newTestProxyService(nil)
+	assert.NoError(t, checkHealth(u+oauthURL+healthURL, time.Second, false))
+	assert.Error(t, checkHealth(u+oauthURL+"/not_found", time.Second, false))
+	assert.Error(t, checkHealth("http://127.0.0.1:1/oauth/health", time.Second, false))
+
+	tlsService := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	defer tlsService.Close()
+	assert.Error(t, checkHealth(tlsService.URL, time.Second, false))
+	assert.NoError(t, checkHealth(tlsService.URL, time.Second, true))
+}
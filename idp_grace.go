@@ -0,0 +1,230 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/coreos/go-oidc/jose"
+	"github.com/coreos/go-oidc/key"
+	"github.com/coreos/go-oidc/oidc"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// idpGraceSyncInterval is the interval the signing keys are retrieved from the provider
+	idpGraceSyncInterval = time.Duration(1) * time.Minute
+	// idpGraceRetryInterval is the minimum interval between the checks of the provider on a verification failure
+	idpGraceRetryInterval = time.Duration(5) * time.Second
+	// idpGraceRetryAfter is the retry after given to the clients while the refresh is deferred
+	idpGraceRetryAfter = "30"
+)
+
+//
+// idpGrace keeps the last known signing keys of the provider, so the tokens can still be verified locally while
+// the provider is unreachable
+//
+type idpGrace struct {
+	sync.RWMutex
+	// the http client for the provider
+	client *http.Client
+	// the jwks endpoint of the provider
+	endpoint string
+	// the issuer and audience of the tokens
+	issuer   string
+	clientID string
+	// the maximum time since the keys were last retrieved the grace applies
+	period time.Duration
+	// the last known signing keys
+	keys []key.PublicKey
+	// the last time the keys were retrieved
+	synced time.Time
+	// the last time the keys were requested
+	attempted time.Time
+	// the provider is unreachable
+	unreachable bool
+}
+
+//
+// newIdPGrace creates the grace for the provider
+//
+func newIdPGrace(client *http.Client, provider oidc.ProviderConfig, clientID string, period time.Duration) *idpGrace {
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	return &idpGrace{
+		client:   client,
+		endpoint: provider.KeysEndpoint.String(),
+		issuer:   provider.Issuer.String(),
+		clientID: clientID,
+		period:   period,
+	}
+}
+
+//
+// start retrieves the keys and keeps them updated in the background until done is closed
+//
+func (r *idpGrace) start(done <-chan struct{}) {
+	r.sync()
+	go func() {
+		ticker := time.NewTicker(idpGraceSyncInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				r.sync()
+			}
+		}
+	}()
+}
+
+//
+// sync retrieves the signing keys from the provider, keeping the last known keys on failure
+//
+func (r *idpGrace) sync() error {
+	keys, err := oidc.NewRemotePublicKeyRepo(r.client, r.endpoint).Get()
+	if err == nil && len(keys.(*key.PublicKeySet).Keys()) <= 0 {
+		err = errors.New("the provider returned no signing keys")
+	}
+
+	r.Lock()
+	defer r.Unlock()
+	r.attempted = time.Now()
+	if err != nil {
+		if !r.unreachable {
+			log.WithFields(log.Fields{
+				"endpoint": r.endpoint,
+				"error":    err.Error(),
+			}).Warnf("unable to retrieve the signing keys, the identity provider is unreachable")
+		}
+		r.unreachable = true
+
+		return err
+	}
+	if r.unreachable {
+		log.Infof("the identity provider is reachable again, leaving the grace mode")
+	}
+	r.keys = keys.(*key.PublicKeySet).Keys()
+	r.synced = time.Now()
+	r.unreachable = false
+
+	return nil
+}
+
+//
+// isReachable checks if the provider is reachable, retrieving the keys unless recently attempted
+//
+func (r *idpGrace) isReachable() bool {
+	r.RLock()
+	attempted, unreachable := r.attempted, r.unreachable
+	r.RUnlock()
+	if time.Since(attempted) < idpGraceRetryInterval {
+		return !unreachable
+	}
+
+	return r.sync() == nil
+}
+
+//
+// isActive checks the provider is unreachable and the keys are recent enough to be trusted
+//
+func (r *idpGrace) isActive() bool {
+	r.RLock()
+	defer r.RUnlock()
+
+	return r.unreachable && len(r.keys) > 0 && time.Since(r.synced) <= r.period
+}
+
+//
+// verify checks the token against the last known keys, only while the grace is active
+//
+func (r *idpGrace) verify(token jose.JWT) error {
+	if !r.isActive() {
+		return errors.New("the identity provider grace is not active")
+	}
+	r.RLock()
+	keys := r.keys
+	r.RUnlock()
+
+	verifier := oidc.NewJWTVerifier(r.issuer, r.clientID,
+		func() error { return nil },
+		func() []key.PublicKey { return keys })
+	if err := verifier.Verify(token); err != nil {
+		if strings.Contains(err.Error(), "token is expired") {
+			return ErrAccessTokenExpired
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+//
+// verifyAccessToken verifies the access token against the provider, falling back to the last known keys while the
+// provider is unreachable
+//
+func (r *oauthProxy) verifyAccessToken(token jose.JWT) error {
+	// step: has the token been validated recently?
+	if r.tokens != nil && r.tokens.isValidated(token, time.Now()) {
+		return nil
+	}
+	err := r.config.acceptAudience(token, r.verifySkewedToken(token))
+	if err == nil && r.tokens != nil {
+		r.tokens.add(token, time.Now())
+	}
+	if err == nil || err == ErrAccessTokenExpired || r.grace == nil {
+		return err
+	}
+	// step: the failure may be the first sign of a outage
+	if r.grace.isReachable() {
+		return err
+	}
+	if e := r.config.acceptAudience(token, r.acceptSkew(token, r.grace.verify(token))); e != nil {
+		if e == ErrAccessTokenExpired {
+			return e
+		}
+
+		return err
+	}
+	log.WithFields(log.Fields{
+		"error": err.Error(),
+	}).Warnf("the identity provider is unreachable, the access token was verified with the last known keys")
+
+	return nil
+}
+
+//
+// deferRefresh asks the client to retry later rather than redirecting to the unreachable provider, the session is
+// kept so the token can be refreshed once the provider returns
+//
+func (r *oauthProxy) deferRefresh(cx *gin.Context, user *userContext) {
+	log.WithFields(log.Fields{
+		"email":     user.email,
+		"client_ip": cx.ClientIP(),
+	}).Warnf("the identity provider is unreachable, deferring the refresh of the access token")
+
+	cx.Header("Retry-After", idpGraceRetryAfter)
+	cx.AbortWithStatus(http.StatusServiceUnavailable)
+}
@@ -0,0 +1,85 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/coreos/go-oidc/jose"
+	"github.com/coreos/go-oidc/oidc"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIdPGrace(t *testing.T) {
+	auth := newFakeOAuthServer()
+	available := true
+	keys := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !available {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		json.NewEncoder(w).Encode(jose.JWKSet{Keys: []jose.JWK{auth.key}})
+	}))
+	defer keys.Close()
+
+	endpoint, _ := url.Parse(keys.URL)
+	issuer, _ := url.Parse(auth.getLocation())
+	grace := newIdPGrace(nil, oidc.ProviderConfig{KeysEndpoint: endpoint, Issuer: issuer}, fakeClientID, time.Hour)
+
+	token, err := jose.NewSignedJWT(auth.claims, auth.signer)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	claims := jose.Claims{}
+	for k, v := range auth.claims {
+		claims[k] = v
+	}
+	claims["exp"] = float64(time.Now().Add(-time.Minute).Unix())
+	expired, _ := jose.NewSignedJWT(claims, auth.signer)
+	claims["exp"] = float64(time.Now().Add(time.Hour).Unix())
+	claims["aud"] = "another-client"
+	audience, _ := jose.NewSignedJWT(claims, auth.signer)
+
+	// step: the provider is reachable, so the grace doesn't apply
+	assert.NoError(t, grace.sync())
+	assert.True(t, grace.isReachable())
+	assert.False(t, grace.isActive())
+	assert.Error(t, grace.verify(*token))
+
+	// step: the provider is unreachable
+	available = false
+	assert.Error(t, grace.sync())
+	assert.False(t, grace.isReachable())
+	assert.True(t, grace.isActive())
+	assert.NoError(t, grace.verify(*token))
+	assert.Equal(t, ErrAccessTokenExpired, grace.verify(*expired))
+	assert.Error(t, grace.verify(*audience))
+
+	// step: the keys are too old to be trusted
+	grace.synced = time.Now().Add(-2 * time.Hour)
+	assert.False(t, grace.isActive())
+	assert.Error(t, grace.verify(*token))
+
+	// step: the provider returns
+	available = true
+	assert.NoError(t, grace.sync())
+	assert.False(t, grace.isActive())
+}
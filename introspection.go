@@ -0,0 +1,252 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/coreos/go-oidc/jose"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// errTokenInactive indicates the provider reports the opaque token as expired, revoked or unknown
+var errTokenInactive = errors.New("the access token is not active")
+
+//
+// introspectionEntry is the result of a introspection, held until it expires
+//
+type introspectionEntry struct {
+	// the time the result expires
+	expires time.Time
+	// the identity of the token, nil when inactive
+	identity *userContext
+}
+
+//
+// tokenIntrospection validates the opaque access tokens with the introspection endpoint of the provider (rfc 7662),
+// caching the results so the provider isn't called on every request
+//
+type tokenIntrospection struct {
+	sync.Mutex
+	// the client used to reach the provider
+	client *http.Client
+	// the introspection endpoint
+	endpoint string
+	// the credentials of the client
+	clientID, clientSecret string
+	// the maximum number of results held, zero disables the caching
+	size int
+	// the maximum time a result is held
+	ttl time.Duration
+	// the results keyed by the hash of the token
+	entries map[string]*introspectionEntry
+	// the introspections, partitioned by the result
+	results *prometheus.CounterVec
+}
+
+//
+// newTokenIntrospection creates the introspection of the opaque tokens
+//
+func newTokenIntrospection(client *http.Client, endpoint, clientID, clientSecret string, size int, ttl time.Duration) *tokenIntrospection {
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	return &tokenIntrospection{
+		client:       client,
+		endpoint:     endpoint,
+		clientID:     clientID,
+		clientSecret: clientSecret,
+		size:         size,
+		ttl:          ttl,
+		entries:      make(map[string]*introspectionEntry),
+		results: prometheus.MustRegisterOrGet(prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "proxy_token_introspections_total",
+				Help: "The introspections of the opaque access tokens, partitioned by the result",
+			},
+			[]string{"result"},
+		)).(*prometheus.CounterVec),
+	}
+}
+
+//
+// isOpaqueToken checks if the token isn't a jwt, i.e. lacks the three segments
+//
+func isOpaqueToken(token string) bool {
+	return strings.Count(token, ".") != 2
+}
+
+//
+// introspect returns a copy of the identity of the opaque token, from the cache or the provider
+//
+func (r *tokenIntrospection) introspect(token string, now time.Time) (*userContext, error) {
+	hash := sha256.Sum256([]byte(token))
+	key := hex.EncodeToString(hash[:])
+
+	r.Lock()
+	if entry, found := r.entries[key]; found {
+		if now.Before(entry.expires) {
+			r.Unlock()
+			r.results.WithLabelValues("cached").Inc()
+			if entry.identity == nil {
+				return nil, errTokenInactive
+			}
+			identity := *entry.identity
+
+			return &identity, nil
+		}
+		delete(r.entries, key)
+	}
+	r.Unlock()
+
+	identity, err := r.request(token)
+	switch err {
+	case nil:
+		r.results.WithLabelValues("active").Inc()
+	case errTokenInactive:
+		r.results.WithLabelValues("inactive").Inc()
+	default:
+		r.results.WithLabelValues("error").Inc()
+		return nil, err
+	}
+
+	// step: the result is held no longer than the token is valid for, the inactive tokens never become active
+	expires := now.Add(r.ttl)
+	if identity != nil && identity.expiresAt.Before(expires) {
+		expires = identity.expiresAt
+	}
+	if r.size > 0 && now.Before(expires) {
+		r.set(key, &introspectionEntry{expires: expires, identity: identity}, now)
+	}
+	if identity == nil {
+		return nil, errTokenInactive
+	}
+	copied := *identity
+
+	return &copied, nil
+}
+
+//
+// set adds the result to the cache, removing the expired results when full, else a arbitrary one
+//
+func (r *tokenIntrospection) set(key string, entry *introspectionEntry, now time.Time) {
+	r.Lock()
+	defer r.Unlock()
+
+	if len(r.entries) >= r.size {
+		for k, v := range r.entries {
+			if !now.Before(v.expires) {
+				delete(r.entries, k)
+			}
+		}
+	}
+	if len(r.entries) >= r.size {
+		for k := range r.entries {
+			delete(r.entries, k)
+			break
+		}
+	}
+	r.entries[key] = entry
+}
+
+//
+// request calls the introspection endpoint of the provider, authenticating as the client
+//
+func (r *tokenIntrospection) request(token string) (*userContext, error) {
+	values := url.Values{
+		"token":           {token},
+		"token_type_hint": {"access_token"},
+	}
+	req, err := http.NewRequest(http.MethodPost, r.endpoint, strings.NewReader(values.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(r.clientID), url.QueryEscape(r.clientSecret))
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected response from the introspection endpoint, status: %d", resp.StatusCode)
+	}
+	claims := jose.Claims{}
+	if err := json.Unmarshal(content, &claims); err != nil {
+		return nil, err
+	}
+	if active, _ := claims["active"].(bool); !active {
+		return nil, errTokenInactive
+	}
+	delete(claims, "active")
+
+	identity, err := extractClaimsIdentity(claims)
+	if err != nil {
+		return nil, err
+	}
+	identity.opaque = token
+
+	return identity, nil
+}
+
+//
+// getIntrospectedIdentity retrieves the user identity of a opaque bearer token from the provider
+//
+func (r *oauthProxy) getIntrospectedIdentity(token string) (*userContext, error) {
+	if r.limits != nil {
+		if err := r.limits.check(token); err != nil {
+			return nil, err
+		}
+	}
+	started := time.Now()
+	user, err := r.introspection.introspect(token, started)
+	if err != nil {
+		return nil, err
+	}
+	user.bearerToken = true
+
+	if log.GetLevel() >= log.DebugLevel {
+		log.WithFields(log.Fields{
+			"id":       user.id,
+			"name":     user.name,
+			"email":    user.email,
+			"roles":    strings.Join(user.roles, ","),
+			"source":   "introspection",
+			"duration": time.Since(started).String(),
+		}).Debugf("found the user identity: %s in the request", user.email)
+	}
+
+	return user, nil
+}
@@ -0,0 +1,259 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/coreos/go-oidc/jose"
+	"github.com/coreos/go-oidc/key"
+	"github.com/coreos/go-oidc/oidc"
+)
+
+//
+// jwksCache holds the signing keys of the provider keyed by the key id, the keys are retrieved again when a token
+// is signed by a unknown key, i.e. the realm keys have been rotated, no more than once a minimum interval, and
+// periodically in the background
+//
+type jwksCache struct {
+	sync.RWMutex
+	// serializes the retrievals of the keys
+	refreshing sync.Mutex
+	// the http client for the provider
+	client *http.Client
+	// the jwks endpoint of the provider
+	endpoint string
+	// the issuer and audience of the tokens
+	issuer   string
+	clientID string
+	// the minimum interval between the retrievals of the keys
+	minInterval time.Duration
+	// the signing keys keyed by the key id
+	keys map[string]key.PublicKey
+	// the last time the keys were requested
+	attempted time.Time
+}
+
+//
+// newJWKSCache creates the cache of the signing keys of the provider
+//
+func newJWKSCache(client *http.Client, provider oidc.ProviderConfig, clientID string, minInterval time.Duration) *jwksCache {
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	return &jwksCache{
+		client:      client,
+		endpoint:    provider.KeysEndpoint.String(),
+		issuer:      provider.Issuer.String(),
+		clientID:    clientID,
+		minInterval: minInterval,
+		keys:        make(map[string]key.PublicKey),
+	}
+}
+
+//
+// start retrieves the keys and, unless the interval is zero, refreshes them periodically in the background until
+// done is closed
+//
+func (r *jwksCache) start(interval time.Duration, done <-chan struct{}) {
+	r.refresh()
+	if interval > 0 {
+		go func() {
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-done:
+					return
+				case <-ticker.C:
+					r.refresh()
+				}
+			}
+		}()
+	}
+}
+
+//
+// refresh retrieves the signing keys from the provider
+//
+func (r *jwksCache) refresh() error {
+	r.refreshing.Lock()
+	defer r.refreshing.Unlock()
+
+	return r.sync()
+}
+
+//
+// refreshUnknown retrieves the keys when the key id is unknown, unless retrieved within the minimum interval; another
+// request may have retrieved the keys while waiting
+//
+func (r *jwksCache) refreshUnknown(id string) error {
+	r.refreshing.Lock()
+	defer r.refreshing.Unlock()
+
+	r.RLock()
+	_, found := r.keys[id]
+	attempted := r.attempted
+	r.RUnlock()
+	if (id != "" && found) || time.Since(attempted) < r.minInterval {
+		return nil
+	}
+
+	return r.sync()
+}
+
+//
+// sync retrieves the signing keys, keeping the current keys on failure, the caller holding the refreshing lock
+//
+func (r *jwksCache) sync() error {
+	keys, err := r.request()
+	r.Lock()
+	defer r.Unlock()
+	r.attempted = time.Now()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"endpoint": r.endpoint,
+			"error":    err.Error(),
+		}).Warnf("unable to retrieve the signing keys of the provider, keeping the current keys")
+
+		return err
+	}
+	if added, removed := getKeyChanges(r.keys, keys); len(added) > 0 || len(removed) > 0 {
+		log.WithFields(log.Fields{
+			"added":   added,
+			"removed": removed,
+		}).Infof("the signing keys of the provider have changed")
+	}
+	r.keys = keys
+
+	return nil
+}
+
+//
+// getKeys returns the signing key of the key id, or all the keys when the token has no key id
+//
+func (r *jwksCache) getKeys(id string) []key.PublicKey {
+	r.RLock()
+	defer r.RUnlock()
+	if id != "" {
+		if k, found := r.keys[id]; found {
+			return []key.PublicKey{k}
+		}
+		return []key.PublicKey{}
+	}
+	list := make([]key.PublicKey, 0, len(r.keys))
+	for _, k := range r.keys {
+		list = append(list, k)
+	}
+
+	return list
+}
+
+//
+// verify checks the signature and claims of the token, retrieving the keys when signed by a unknown key
+//
+func (r *jwksCache) verify(token jose.JWT) error {
+	id, _ := token.KeyID()
+	verifier := oidc.NewJWTVerifier(r.issuer, r.clientID,
+		func() error { return r.refreshUnknown(id) },
+		func() []key.PublicKey { return r.getKeys(id) })
+
+	return getVerificationError(verifier.Verify(token))
+}
+
+//
+// request retrieves the signing keys, the rsa signature keys being used and any other keys, i.e. the encryption or
+// elliptic curve keys of the realm, skipped
+//
+func (r *jwksCache) request() (map[string]key.PublicKey, error) {
+	resp, err := r.client.Get(r.endpoint)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unable to retrieve the signing keys from: %s, status: %d", r.endpoint, resp.StatusCode)
+	}
+	var set struct {
+		Keys []json.RawMessage `json:"keys"`
+	}
+	if err := json.Unmarshal(content, &set); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]key.PublicKey)
+	for _, x := range set.Keys {
+		var jwk jose.JWK
+		if err := json.Unmarshal(x, &jwk); err != nil {
+			continue
+		}
+		if jwk.Type != "RSA" || (jwk.Use != "" && jwk.Use != "sig") || (jwk.Alg != "" && jwk.Alg != "RS256") {
+			continue
+		}
+		keys[jwk.ID] = *key.NewPublicKey(jwk)
+	}
+	if len(keys) <= 0 {
+		return nil, errors.New("the provider returned no rsa signing keys")
+	}
+
+	return keys, nil
+}
+
+//
+// getKeyChanges returns the sorted key ids added and removed
+//
+func getKeyChanges(previous, next map[string]key.PublicKey) ([]string, []string) {
+	var added, removed []string
+	for id := range next {
+		if _, found := previous[id]; !found {
+			added = append(added, id)
+		}
+	}
+	for id := range previous {
+		if _, found := next[id]; !found {
+			removed = append(removed, id)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+
+	return added, removed
+}
+
+//
+// verifyIssuedToken verifies the token against the provider which issued it, with the cached keys of the provider
+//
+func (r *oauthProxy) verifyIssuedToken(token jose.JWT) error {
+	client := r.getIssuerClient(token)
+	if r.jwks != nil && client == r.client {
+		return r.jwks.verify(token)
+	}
+
+	return verifyToken(client, token)
+}
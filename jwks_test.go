@@ -0,0 +1,186 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coreos/go-oidc/jose"
+	"github.com/coreos/go-oidc/oidc"
+	"github.com/stretchr/testify/assert"
+)
+
+const fakeJWKSIssuer = "https://keycloak.example.com/auth/realms/hod-test"
+
+// fakeJWKS serves the signing keys, counting the requests
+type fakeJWKS struct {
+	sync.Mutex
+	keys     []interface{}
+	requests int
+}
+
+func (r *fakeJWKS) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.Lock()
+	defer r.Unlock()
+	r.requests++
+	json.NewEncoder(w).Encode(map[string]interface{}{"keys": r.keys})
+}
+
+func (r *fakeJWKS) set(keys ...interface{}) {
+	r.Lock()
+	defer r.Unlock()
+	r.keys = keys
+}
+
+func (r *fakeJWKS) getRequests() int {
+	r.Lock()
+	defer r.Unlock()
+	return r.requests
+}
+
+func newFakeJWKSKey(t *testing.T, kid string) (*rsa.PrivateKey, jose.JWK) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	return key, jose.JWK{ID: kid, Type: "RSA", Alg: "RS256", Use: "sig", Exponent: key.PublicKey.E, Modulus: key.PublicKey.N}
+}
+
+func newFakeJWKSToken(t *testing.T, key *rsa.PrivateKey, kid string) jose.JWT {
+	token, err := jose.NewSignedJWT(jose.Claims{
+		"iss": fakeJWKSIssuer,
+		"aud": fakeClientID,
+		"sub": "1234",
+		"iat": time.Now().Unix(),
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}, jose.NewSignerRSA(kid, *key))
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	return *token
+}
+
+func newFakeJWKSCache(endpoint string, minInterval time.Duration) *jwksCache {
+	issuer, _ := url.Parse(fakeJWKSIssuer)
+	keys, _ := url.Parse(endpoint)
+
+	return newJWKSCache(nil, oidc.ProviderConfig{Issuer: issuer, KeysEndpoint: keys}, fakeClientID, minInterval)
+}
+
+func TestJWKSCacheRotation(t *testing.T) {
+	current, currentJWK := newFakeJWKSKey(t, "current")
+	rotated, rotatedJWK := newFakeJWKSKey(t, "rotated")
+	jwks := &fakeJWKS{}
+	// step: the encryption and elliptic curve keys of the realm are skipped
+	jwks.set(&currentJWK,
+		map[string]string{"kid": "enc", "kty": "RSA", "alg": "RSA-OAEP", "use": "enc", "n": "AQAB", "e": "AQAB"},
+		map[string]string{"kid": "ec", "kty": "EC", "alg": "ES256", "use": "sig", "crv": "P-256", "x": "AQAB", "y": "AQAB"})
+	server := httptest.NewServer(jwks)
+	defer server.Close()
+
+	cache := newFakeJWKSCache(server.URL, time.Duration(1)*time.Hour)
+	cache.start(0, nil)
+	assert.Equal(t, 1, jwks.getRequests())
+	assert.NoError(t, cache.verify(newFakeJWKSToken(t, current, "current")))
+	assert.Equal(t, 1, jwks.getRequests())
+
+	// step: the keys aren't retrieved again within the minimum interval
+	jwks.set(&currentJWK, &rotatedJWK)
+	assert.Error(t, cache.verify(newFakeJWKSToken(t, rotated, "rotated")))
+	assert.Equal(t, 1, jwks.getRequests())
+
+	// step: a unknown key id has the keys retrieved again
+	cache.minInterval = 0
+	assert.NoError(t, cache.verify(newFakeJWKSToken(t, rotated, "rotated")))
+	assert.Equal(t, 2, jwks.getRequests())
+	assert.NoError(t, cache.verify(newFakeJWKSToken(t, rotated, "rotated")))
+	assert.Equal(t, 2, jwks.getRequests())
+
+	// step: a forged signature by a known key doesn't retrieve the keys
+	assert.Error(t, cache.verify(newFakeJWKSToken(t, current, "rotated")))
+	assert.Equal(t, 2, jwks.getRequests())
+
+	// step: the retired keys are dropped on a refresh, while a failed retrieval keeps the keys
+	jwks.set(&rotatedJWK)
+	assert.NoError(t, cache.refresh())
+	cache.minInterval = time.Duration(1) * time.Hour
+	assert.Error(t, cache.verify(newFakeJWKSToken(t, current, "current")))
+	jwks.set()
+	assert.Error(t, cache.refresh())
+	assert.NoError(t, cache.verify(newFakeJWKSToken(t, rotated, "rotated")))
+}
+
+func TestJWKSCacheBackgroundRefresh(t *testing.T) {
+	_, currentJWK := newFakeJWKSKey(t, "current")
+	jwks := &fakeJWKS{}
+	jwks.set(&currentJWK)
+	server := httptest.NewServer(jwks)
+	defer server.Close()
+
+	cache := newFakeJWKSCache(server.URL, time.Duration(1)*time.Hour)
+	done := make(chan struct{})
+	cache.start(time.Duration(10)*time.Millisecond, done)
+	time.Sleep(time.Duration(100) * time.Millisecond)
+	assert.True(t, jwks.getRequests() > 2)
+
+	// step: the refresh ends once done is closed
+	close(done)
+	time.Sleep(time.Duration(20) * time.Millisecond)
+	requests := jwks.getRequests()
+	time.Sleep(time.Duration(50) * time.Millisecond)
+	assert.Equal(t, requests, jwks.getRequests())
+}
+
+func TestJWKSRotation(t *testing.T) {
+	config := newFakeKeycloakConfig()
+	config.EnableJWKSCache = true
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	defer upstream.Close()
+	config.Upstream = upstream.URL
+	p, auth, u := newTestProxyService(config)
+	if !assert.NoError(t, p.createUpstreamProxy(p.endpoint)) {
+		t.FailNow()
+	}
+	if !assert.NotNil(t, p.jwks) {
+		t.FailNow()
+	}
+
+	// step: the realm keys are rotated by the provider
+	key, jwk := newFakeJWKSKey(t, "rotated")
+	auth.key = jwk
+	auth.signer = jose.NewSignerRSA("rotated", *key)
+	token, err := jose.NewSignedJWT(auth.claims, auth.signer)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	req, _ := http.NewRequest("GET", u+fakeAuthAllURL, nil)
+	req.Header.Set(authorizationHeader, "Bearer "+token.Encode())
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+}
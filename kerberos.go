@@ -0,0 +1,543 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/asn1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// kerberosAES128 and kerberosAES256 are the aes-cts-hmac-sha1-96 encryption types (rfc 3962), the only ones
+	// supported; the des and rc4 types are long deprecated
+	kerberosAES128 = 17
+	kerberosAES256 = 18
+
+	// kerberosUsageTicket and kerberosUsageAuthenticator are the key usages of the ticket and authenticator
+	kerberosUsageTicket        = 2
+	kerberosUsageAuthenticator = 11
+
+	// kerberosMessageAPReq is the message type of the ap-req
+	kerberosMessageAPReq = 14
+	// kerberosChecksumSize is the size of the truncated hmac-sha1 of the encrypted data
+	kerberosChecksumSize = 12
+	// kerberosClockSkew is the difference permitted between the clocks of the client and proxy
+	kerberosClockSkew = 5 * time.Minute
+)
+
+//
+// keytabEntry is a key of the service from the keytab
+//
+type keytabEntry struct {
+	// the principal, i.e. HTTP/proxy.example.com@EXAMPLE.COM
+	principal string
+	// the version of the key
+	kvno uint32
+	// the encryption type of the key
+	etype int32
+	// the key itself
+	key []byte
+}
+
+//
+// kerberosPrincipalName is the name of a principal in the messages
+//
+type kerberosPrincipalName struct {
+	NameType   int32    `asn1:"explicit,tag:0"`
+	NameString []string `asn1:"explicit,tag:1"`
+}
+
+//
+// kerberosEncryptedData is a encrypted part of the messages
+//
+type kerberosEncryptedData struct {
+	EType  int32  `asn1:"explicit,tag:0"`
+	KVNO   int    `asn1:"optional,explicit,tag:1"`
+	Cipher []byte `asn1:"explicit,tag:2"`
+}
+
+//
+// kerberosEncryptionKey is the session key in the ticket
+//
+type kerberosEncryptionKey struct {
+	KeyType  int32  `asn1:"explicit,tag:0"`
+	KeyValue []byte `asn1:"explicit,tag:1"`
+}
+
+//
+// kerberosAPReq is the request of the client carrying the ticket; the ticket is decoded separately as it's both
+// context and application tagged
+//
+type kerberosAPReq struct {
+	PVNO          int                   `asn1:"explicit,tag:0"`
+	MsgType       int                   `asn1:"explicit,tag:1"`
+	APOptions     asn1.BitString        `asn1:"explicit,tag:2"`
+	Ticket        asn1.RawValue         `asn1:"explicit,tag:3"`
+	Authenticator kerberosEncryptedData `asn1:"explicit,tag:4"`
+}
+
+//
+// kerberosTicket is the ticket issued to the client for the service
+//
+type kerberosTicket struct {
+	TktVNO  int                   `asn1:"explicit,tag:0"`
+	Realm   string                `asn1:"explicit,tag:1"`
+	SName   kerberosPrincipalName `asn1:"explicit,tag:2"`
+	EncPart kerberosEncryptedData `asn1:"explicit,tag:3"`
+}
+
+//
+// kerberosEncTicketPart is the part of the ticket encrypted with the key of the service
+//
+type kerberosEncTicketPart struct {
+	Flags             asn1.BitString        `asn1:"explicit,tag:0"`
+	Key               kerberosEncryptionKey `asn1:"explicit,tag:1"`
+	CRealm            string                `asn1:"explicit,tag:2"`
+	CName             kerberosPrincipalName `asn1:"explicit,tag:3"`
+	Transited         asn1.RawValue         `asn1:"explicit,tag:4"`
+	AuthTime          time.Time             `asn1:"generalized,explicit,tag:5"`
+	StartTime         time.Time             `asn1:"generalized,optional,explicit,tag:6"`
+	EndTime           time.Time             `asn1:"generalized,explicit,tag:7"`
+	RenewTill         time.Time             `asn1:"generalized,optional,explicit,tag:8"`
+	CAddr             asn1.RawValue         `asn1:"optional,explicit,tag:9"`
+	AuthorizationData asn1.RawValue         `asn1:"optional,explicit,tag:10"`
+}
+
+//
+// kerberosAuthenticator proves the client holds the session key of the ticket
+//
+type kerberosAuthenticator struct {
+	AVNO              int                   `asn1:"explicit,tag:0"`
+	CRealm            string                `asn1:"explicit,tag:1"`
+	CName             kerberosPrincipalName `asn1:"explicit,tag:2"`
+	Checksum          asn1.RawValue         `asn1:"optional,explicit,tag:3"`
+	CUSec             int                   `asn1:"explicit,tag:4"`
+	CTime             time.Time             `asn1:"generalized,explicit,tag:5"`
+	SubKey            asn1.RawValue         `asn1:"optional,explicit,tag:6"`
+	SeqNumber         int64                 `asn1:"optional,explicit,tag:7"`
+	AuthorizationData asn1.RawValue         `asn1:"optional,explicit,tag:8"`
+}
+
+//
+// kerberosIdentity is the client authenticated by a ticket
+//
+type kerberosIdentity struct {
+	// the principal of the client, i.e. jsmith@EXAMPLE.COM
+	principal string
+	// the expiration of the ticket
+	expires time.Time
+}
+
+//
+// kerberosAcceptor verifies the tickets presented to the service
+//
+type kerberosAcceptor struct {
+	sync.Mutex
+	// the keys of the service
+	keys []*keytabEntry
+	// the authenticators already seen, with when they can be forgotten
+	replays map[string]time.Time
+}
+
+//
+// newKerberosAcceptor creates the acceptor from the keytab of the service
+//
+func newKerberosAcceptor(filename string) (*kerberosAcceptor, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := parseKeytab(content)
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) <= 0 {
+		return nil, fmt.Errorf("the keytab: %s has no aes keys", filename)
+	}
+
+	return &kerberosAcceptor{keys: keys, replays: make(map[string]time.Time)}, nil
+}
+
+//
+// accept verifies the ap-req of the client, returning the identity of the client
+//
+func (r *kerberosAcceptor) accept(message []byte, now time.Time) (*kerberosIdentity, error) {
+	request := kerberosAPReq{}
+	if _, err := asn1.UnmarshalWithParams(message, &request, "application,explicit,tag:14"); err != nil {
+		return nil, fmt.Errorf("invalid kerberos ap-req, %s", err)
+	}
+	if request.MsgType != kerberosMessageAPReq {
+		return nil, errors.New("the kerberos message is not a ap-req")
+	}
+	ticket := kerberosTicket{}
+	if _, err := asn1.UnmarshalWithParams(request.Ticket.Bytes, &ticket, "application,explicit,tag:1"); err != nil {
+		return nil, fmt.Errorf("invalid kerberos ticket, %s", err)
+	}
+
+	// step: decrypt the ticket with the key of the service
+	service := getKerberosPrincipal(ticket.SName, ticket.Realm)
+	key, err := r.getKey(service, ticket.EncPart.EType, uint32(ticket.EncPart.KVNO))
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := kerberosDecrypt(key.key, kerberosUsageTicket, ticket.EncPart.Cipher)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decrypt the ticket, %s", err)
+	}
+	part := kerberosEncTicketPart{}
+	if _, err := asn1.UnmarshalWithParams(plaintext, &part, "application,explicit,tag:3"); err != nil {
+		return nil, fmt.Errorf("invalid kerberos ticket, %s", err)
+	}
+
+	// step: decrypt the authenticator with the session key from the ticket
+	if request.Authenticator.EType != part.Key.KeyType {
+		return nil, errors.New("the authenticator is not encrypted with the session key")
+	}
+	plaintext, err = kerberosDecrypt(part.Key.KeyValue, kerberosUsageAuthenticator, request.Authenticator.Cipher)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decrypt the authenticator, %s", err)
+	}
+	authenticator := kerberosAuthenticator{}
+	if _, err := asn1.UnmarshalWithParams(plaintext, &authenticator, "application,explicit,tag:2"); err != nil {
+		return nil, fmt.Errorf("invalid kerberos authenticator, %s", err)
+	}
+
+	// step: check the authenticator and ticket are for the same client and current
+	client := getKerberosPrincipal(part.CName, part.CRealm)
+	if getKerberosPrincipal(authenticator.CName, authenticator.CRealm) != client {
+		return nil, errors.New("the authenticator is not for the client of the ticket")
+	}
+	starts := part.StartTime
+	if starts.IsZero() {
+		starts = part.AuthTime
+	}
+	if now.Add(kerberosClockSkew).Before(starts) {
+		return nil, errors.New("the ticket is not yet valid")
+	}
+	if now.Add(-kerberosClockSkew).After(part.EndTime) {
+		return nil, errors.New("the ticket has expired")
+	}
+	if skew := now.Sub(authenticator.CTime); skew > kerberosClockSkew || skew < -kerberosClockSkew {
+		return nil, errors.New("the authenticator is outside the permitted clock skew")
+	}
+	if r.isReplay(fmt.Sprintf("%s|%d|%d", client, authenticator.CTime.Unix(), authenticator.CUSec), now) {
+		return nil, errors.New("the authenticator has already been used")
+	}
+
+	return &kerberosIdentity{principal: client, expires: part.EndTime}, nil
+}
+
+//
+// getKey returns the key of the service for the ticket
+//
+func (r *kerberosAcceptor) getKey(principal string, etype int32, kvno uint32) (*keytabEntry, error) {
+	var found *keytabEntry
+	for _, x := range r.keys {
+		if !strings.EqualFold(x.principal, principal) || x.etype != etype {
+			continue
+		}
+		if kvno != 0 && x.kvno == kvno {
+			return x, nil
+		}
+		if found == nil || x.kvno > found.kvno {
+			found = x
+		}
+	}
+	if found == nil || kvno != 0 {
+		return nil, fmt.Errorf("no key in the keytab for the service: %s, etype: %d, kvno: %d", principal, etype, kvno)
+	}
+
+	return found, nil
+}
+
+//
+// isReplay records the authenticator, returning true if it has already been seen within the clock skew
+//
+func (r *kerberosAcceptor) isReplay(id string, now time.Time) bool {
+	r.Lock()
+	defer r.Unlock()
+
+	for k, expires := range r.replays {
+		if now.After(expires) {
+			delete(r.replays, k)
+		}
+	}
+	if _, found := r.replays[id]; found {
+		return true
+	}
+	r.replays[id] = now.Add(2 * kerberosClockSkew)
+
+	return false
+}
+
+//
+// getKerberosPrincipal returns the principal as a string, i.e. HTTP/proxy.example.com@EXAMPLE.COM
+//
+func getKerberosPrincipal(name kerberosPrincipalName, realm string) string {
+	return strings.Join(name.NameString, "/") + "@" + realm
+}
+
+//
+// parseKeytab decodes the keys from a keytab (version 0x502), the keys of unsupported types are skipped
+//
+func parseKeytab(content []byte) ([]*keytabEntry, error) {
+	if len(content) < 2 || content[0] != 0x05 || content[1] != 0x02 {
+		return nil, errors.New("unsupported keytab, expected version 0x502")
+	}
+	var list []*keytabEntry
+	reader := bytes.NewReader(content[2:])
+	for reader.Len() > 0 {
+		var size int32
+		if err := binary.Read(reader, binary.BigEndian, &size); err != nil {
+			return nil, errors.New("the keytab is truncated")
+		}
+		// step: a negative size is a deleted entry
+		if size < 0 {
+			if _, err := reader.Seek(int64(-size), io.SeekCurrent); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		record := make([]byte, size)
+		if _, err := io.ReadFull(reader, record); err != nil {
+			return nil, errors.New("the keytab is truncated")
+		}
+		entry, err := parseKeytabEntry(record)
+		if err != nil {
+			return nil, err
+		}
+		if entry.etype == kerberosAES128 || entry.etype == kerberosAES256 {
+			list = append(list, entry)
+		}
+	}
+
+	return list, nil
+}
+
+//
+// parseKeytabEntry decodes a entry of the keytab
+//
+func parseKeytabEntry(record []byte) (*keytabEntry, error) {
+	reader := &keytabReader{Reader: bytes.NewReader(record)}
+	var count uint16
+	reader.read(&count)
+	realm := reader.readString()
+	var components []string
+	for i := 0; i < int(count) && reader.err == nil; i++ {
+		components = append(components, reader.readString())
+	}
+	var nameType, timestamp uint32
+	var kvno8 uint8
+	var etype uint16
+	reader.read(&nameType)
+	reader.read(&timestamp)
+	reader.read(&kvno8)
+	reader.read(&etype)
+	key := reader.readString()
+	if reader.err != nil {
+		return nil, errors.New("invalid keytab entry")
+	}
+
+	// step: the 32 bit version of the key, when present, supersedes the 8 bit one
+	kvno := uint32(kvno8)
+	if reader.Len() >= 4 {
+		var kvno32 uint32
+		reader.read(&kvno32)
+		if kvno32 != 0 {
+			kvno = kvno32
+		}
+	}
+
+	return &keytabEntry{
+		principal: strings.Join(components, "/") + "@" + realm,
+		kvno:      kvno,
+		etype:     int32(etype),
+		key:       []byte(key),
+	}, nil
+}
+
+//
+// keytabReader reads the big endian fields of a keytab entry, retaining the first error
+//
+type keytabReader struct {
+	*bytes.Reader
+	err error
+}
+
+//
+// read decodes the next field into the value
+//
+func (r *keytabReader) read(v interface{}) {
+	if r.err == nil {
+		r.err = binary.Read(r.Reader, binary.BigEndian, v)
+	}
+}
+
+//
+// readString decodes the next length prefixed string
+//
+func (r *keytabReader) readString() string {
+	var length uint16
+	r.read(&length)
+	if r.err != nil {
+		return ""
+	}
+	content := make([]byte, length)
+	if _, err := io.ReadFull(r.Reader, content); err != nil {
+		r.err = err
+	}
+
+	return string(content)
+}
+
+//
+// kerberosDecrypt decrypts and verifies the aes-cts-hmac-sha1-96 encrypted data, removing the confounder
+//
+func kerberosDecrypt(key []byte, usage uint32, ciphertext []byte) ([]byte, error) {
+	if len(key) != 16 && len(key) != 32 {
+		return nil, errors.New("unsupported key size")
+	}
+	if len(ciphertext) < aes.BlockSize+kerberosChecksumSize {
+		return nil, errors.New("the ciphertext is too short")
+	}
+	data, checksum := ciphertext[:len(ciphertext)-kerberosChecksumSize], ciphertext[len(ciphertext)-kerberosChecksumSize:]
+	plaintext, err := decryptAESCTS(kerberosDeriveKey(key, usage, 0xAA), data)
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha1.New, kerberosDeriveKey(key, usage, 0x55))
+	mac.Write(plaintext)
+	if !hmac.Equal(mac.Sum(nil)[:kerberosChecksumSize], checksum) {
+		return nil, errors.New("the integrity check failed")
+	}
+
+	return plaintext[aes.BlockSize:], nil
+}
+
+//
+// kerberosDeriveKey derives the encryption (0xAA) or integrity (0x55) key for the usage (rfc 3961)
+//
+func kerberosDeriveKey(key []byte, usage uint32, kind byte) []byte {
+	constant := make([]byte, 5)
+	binary.BigEndian.PutUint32(constant, usage)
+	constant[4] = kind
+
+	return kerberosDeriveRandom(key, constant)
+}
+
+//
+// kerberosDeriveRandom is the dr function of rfc 3961, the random to key function of aes being the identity
+//
+func kerberosDeriveRandom(key, constant []byte) []byte {
+	block, _ := aes.NewCipher(key)
+	input := nfold(constant, aes.BlockSize)
+	var derived []byte
+	for len(derived) < len(key) {
+		output := make([]byte, aes.BlockSize)
+		block.Encrypt(output, input)
+		derived = append(derived, output...)
+		input = output
+	}
+
+	return derived[:len(key)]
+}
+
+//
+// nfold stretches or folds the input to n bytes (rfc 3961), adding the copies rotated by 13 bits in ones'
+// complement arithmetic
+//
+func nfold(input []byte, n int) []byte {
+	k := len(input)
+	gcd := n
+	for b := k; b != 0; gcd, b = b, gcd%b {
+	}
+	lcm := n * k / gcd
+	output := make([]byte, n)
+	sum := 0
+	for i := lcm - 1; i >= 0; i-- {
+		// step: the most significant bit in the input of this byte of the rotated copies
+		msbit := ((k << 3) - 1 + ((k<<3)+13)*(i/k) + ((k - i%k) << 3)) % (k << 3)
+		sum += int((uint(input[(k-1-(msbit>>3))%k])<<8|uint(input[(k-(msbit>>3))%k]))>>uint((msbit&7)+1)) & 0xff
+		sum += int(output[i%n])
+		output[i%n] = byte(sum)
+		sum >>= 8
+	}
+	// step: add any carry back in
+	for i := n - 1; i >= 0 && sum != 0; i-- {
+		sum += int(output[i])
+		output[i] = byte(sum)
+		sum >>= 8
+	}
+
+	return output
+}
+
+//
+// decryptAESCTS decrypts the aes cbc ciphertext stealing mode used by kerberos, a zero iv and the last two blocks
+// swapped
+//
+func decryptAESCTS(key, ciphertext []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < aes.BlockSize {
+		return nil, errors.New("the ciphertext is shorter than a block")
+	}
+	plaintext := make([]byte, len(ciphertext))
+	if len(ciphertext) == aes.BlockSize {
+		block.Decrypt(plaintext, ciphertext)
+		return plaintext, nil
+	}
+
+	// step: decrypt the blocks before the last two as plain cbc
+	tail := len(ciphertext) % aes.BlockSize
+	if tail == 0 {
+		tail = aes.BlockSize
+	}
+	n := len(ciphertext) - tail - aes.BlockSize
+	iv := make([]byte, aes.BlockSize)
+	if n > 0 {
+		cipher.NewCBCDecrypter(block, iv).CryptBlocks(plaintext[:n], ciphertext[:n])
+		iv = ciphertext[n-aes.BlockSize : n]
+	}
+
+	// step: the second to last block is the final block, padded with the stolen ciphertext
+	decrypted := make([]byte, aes.BlockSize)
+	block.Decrypt(decrypted, ciphertext[n:n+aes.BlockSize])
+	last := append(append([]byte{}, ciphertext[n+aes.BlockSize:]...), decrypted[tail:]...)
+	for i := 0; i < tail; i++ {
+		plaintext[n+aes.BlockSize+i] = decrypted[i] ^ last[i]
+	}
+	block.Decrypt(plaintext[n:n+aes.BlockSize], last)
+	for i := 0; i < aes.BlockSize; i++ {
+		plaintext[n+i] ^= iv[i]
+	}
+
+	return plaintext, nil
+}
@@ -0,0 +1,370 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/asn1"
+	"encoding/binary"
+	"encoding/hex"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	fakeKerberosRealm   = "CORP.EXAMPLE.COM"
+	fakeKerberosService = "HTTP/proxy.corp.example.com"
+)
+
+var fakeKerberosKey = []byte("0123456789abcdef0123456789abcdef")
+
+// encryptAESCTS is the inverse of decryptAESCTS
+func encryptAESCTS(key, plaintext []byte) []byte {
+	block, _ := aes.NewCipher(key)
+	if len(plaintext) == aes.BlockSize {
+		ciphertext := make([]byte, aes.BlockSize)
+		block.Encrypt(ciphertext, plaintext)
+		return ciphertext
+	}
+	padded := make([]byte, (len(plaintext)+aes.BlockSize-1)/aes.BlockSize*aes.BlockSize)
+	copy(padded, plaintext)
+	encrypted := make([]byte, len(padded))
+	cipher.NewCBCEncrypter(block, make([]byte, aes.BlockSize)).CryptBlocks(encrypted, padded)
+	n := len(encrypted)
+	ciphertext := append(append([]byte{}, encrypted[:n-2*aes.BlockSize]...), encrypted[n-aes.BlockSize:]...)
+
+	return append(ciphertext, encrypted[n-2*aes.BlockSize:n-2*aes.BlockSize+len(plaintext)-(n-aes.BlockSize)]...)
+}
+
+// kerberosEncrypt is the inverse of kerberosDecrypt
+func kerberosEncrypt(key []byte, usage uint32, plaintext []byte) []byte {
+	content := make([]byte, aes.BlockSize)
+	rand.Read(content)
+	content = append(content, plaintext...)
+	mac := hmac.New(sha1.New, kerberosDeriveKey(key, usage, 0x55))
+	mac.Write(content)
+
+	return append(encryptAESCTS(kerberosDeriveKey(key, usage, 0xAA), content), mac.Sum(nil)[:kerberosChecksumSize]...)
+}
+
+type fakeTicket struct {
+	client     string
+	serviceKey []byte
+	kvno       int
+	sessionKey []byte
+	authTime   time.Time
+	endTime    time.Time
+	ctime      time.Time
+	// the client in the authenticator, defaults to the client
+	authenticatorClient string
+}
+
+func newFakeTicket(client string, now time.Time) *fakeTicket {
+	return &fakeTicket{
+		client:     client,
+		serviceKey: fakeKerberosKey,
+		kvno:       2,
+		sessionKey: []byte("fedcba9876543210"),
+		authTime:   now.Add(-time.Hour),
+		endTime:    now.Add(9 * time.Hour),
+		ctime:      now,
+	}
+}
+
+func newFakePrincipalName(name string) kerberosPrincipalName {
+	return kerberosPrincipalName{NameType: 1, NameString: strings.Split(name, "/")}
+}
+
+// encode returns the ap-req carrying the ticket
+func (r *fakeTicket) encode() []byte {
+	etype := int32(kerberosAES256)
+	if len(r.serviceKey) == 16 {
+		etype = kerberosAES128
+	}
+	sessionType := int32(kerberosAES128)
+	part, _ := asn1.MarshalWithParams(kerberosEncTicketPart{
+		Flags:     asn1.BitString{Bytes: []byte{0, 0, 0, 0}, BitLength: 32},
+		Key:       kerberosEncryptionKey{KeyType: sessionType, KeyValue: r.sessionKey},
+		CRealm:    fakeKerberosRealm,
+		CName:     newFakePrincipalName(r.client),
+		Transited: asn1.RawValue{FullBytes: []byte{0xa4, 0x0b, 0x30, 0x09, 0xa0, 0x03, 0x02, 0x01, 0x00, 0xa1, 0x02, 0x04, 0x00}},
+		AuthTime:  r.authTime.UTC(),
+		EndTime:   r.endTime.UTC(),
+	}, "application,explicit,tag:3")
+	ticket, _ := asn1.MarshalWithParams(kerberosTicket{
+		TktVNO:  5,
+		Realm:   fakeKerberosRealm,
+		SName:   newFakePrincipalName(fakeKerberosService),
+		EncPart: kerberosEncryptedData{EType: etype, KVNO: r.kvno, Cipher: kerberosEncrypt(r.serviceKey, kerberosUsageTicket, part)},
+	}, "application,explicit,tag:1")
+	wrapped, _ := asn1.Marshal(asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 3, IsCompound: true, Bytes: ticket})
+
+	client := r.authenticatorClient
+	if client == "" {
+		client = r.client
+	}
+	authenticator, _ := asn1.MarshalWithParams(kerberosAuthenticator{
+		AVNO:   5,
+		CRealm: fakeKerberosRealm,
+		CName:  newFakePrincipalName(client),
+		CUSec:  r.ctime.Nanosecond() / 1000,
+		CTime:  r.ctime.UTC().Truncate(time.Second),
+	}, "application,explicit,tag:2")
+	request, _ := asn1.MarshalWithParams(kerberosAPReq{
+		PVNO:          5,
+		MsgType:       kerberosMessageAPReq,
+		APOptions:     asn1.BitString{Bytes: []byte{0, 0, 0, 0}, BitLength: 32},
+		Ticket:        asn1.RawValue{FullBytes: wrapped},
+		Authenticator: kerberosEncryptedData{EType: sessionType, Cipher: kerberosEncrypt(r.sessionKey, kerberosUsageAuthenticator, authenticator)},
+	}, "application,explicit,tag:14")
+
+	return request
+}
+
+func newFakeKeytab(entries ...*keytabEntry) []byte {
+	content := &bytes.Buffer{}
+	content.Write([]byte{0x05, 0x02})
+	for _, x := range entries {
+		record := &bytes.Buffer{}
+		items := strings.Split(x.principal, "@")
+		components := strings.Split(items[0], "/")
+		writeString := func(v string) {
+			binary.Write(record, binary.BigEndian, uint16(len(v)))
+			record.WriteString(v)
+		}
+		binary.Write(record, binary.BigEndian, uint16(len(components)))
+		writeString(items[1])
+		for _, c := range components {
+			writeString(c)
+		}
+		binary.Write(record, binary.BigEndian, uint32(1))
+		binary.Write(record, binary.BigEndian, uint32(time.Now().Unix()))
+		record.WriteByte(byte(x.kvno))
+		binary.Write(record, binary.BigEndian, uint16(x.etype))
+		writeString(string(x.key))
+		binary.Write(record, binary.BigEndian, x.kvno)
+		binary.Write(content, binary.BigEndian, int32(record.Len()))
+		content.Write(record.Bytes())
+	}
+
+	return content.Bytes()
+}
+
+func newFakeKerberosAcceptor() *kerberosAcceptor {
+	return &kerberosAcceptor{
+		keys: []*keytabEntry{
+			{principal: fakeKerberosService + "@" + fakeKerberosRealm, kvno: 2, etype: kerberosAES256, key: fakeKerberosKey},
+		},
+		replays: make(map[string]time.Time),
+	}
+}
+
+func TestNFold(t *testing.T) {
+	// the test vectors of rfc 3961
+	cases := []struct {
+		Input    string
+		Size     int
+		Expected string
+	}{
+		{Input: "012345", Size: 8, Expected: "be072631276b1955"},
+		{Input: "password", Size: 7, Expected: "78a07b6caf85fa"},
+		{Input: "Rough Consensus, and Running Code", Size: 8, Expected: "bb6ed30870b7f0e0"},
+		{Input: "password", Size: 21, Expected: "59e4a8ca7c0385c3c37b3f6d2000247cb6e6bd5b3e"},
+		{Input: "MASSACHVSETTS INSTITVTE OF TECHNOLOGY", Size: 24, Expected: "db3b0d8f0b061e603282b308a50841229ad798fab9540c1b"},
+		{Input: "kerberos", Size: 16, Expected: "6b65726265726f737b9b5b2b93132b93"},
+	}
+	for i, c := range cases {
+		assert.Equal(t, c.Expected, hex.EncodeToString(nfold([]byte(c.Input), c.Size)), "case %d, unexpected n-fold", i)
+	}
+}
+
+func TestKerberosDeriveRandom(t *testing.T) {
+	// the string to key test vectors of rfc 3962, from the pbkdf2 of the password
+	cases := []struct {
+		Key      string
+		Expected string
+	}{
+		{Key: "cdedb5281bb2f801565a1122b2563515", Expected: "42263c6e89f4fc28b8df68ee09799f15"},
+		{
+			Key:      "cdedb5281bb2f801565a1122b25635150ad1f7a04bb9f3a333ecc0e2e1f70837",
+			Expected: "fe697b52bc0d3ce14432ba036a92e65bbb52280990a2fa27883998d72af30161",
+		},
+	}
+	for i, c := range cases {
+		key, _ := hex.DecodeString(c.Key)
+		assert.Equal(t, c.Expected, hex.EncodeToString(kerberosDeriveRandom(key, []byte("kerberos"))), "case %d, unexpected key", i)
+	}
+}
+
+func TestDecryptAESCTS(t *testing.T) {
+	// the test vectors of rfc 3962
+	key := []byte("chicken teriyaki")
+	cases := []struct {
+		Plaintext  string
+		Ciphertext string
+	}{
+		{Plaintext: "4920776f756c64206c696b652074686520", Ciphertext: "c6353568f2bf8cb4d8a580362da7ff7f97"},
+		{
+			Plaintext:  "4920776f756c64206c696b65207468652047656e6572616c20476175277320",
+			Ciphertext: "fc00783e0efdb2c1d445d4c8eff7ed2297687268d6ecccc0c07b25e25ecfe5",
+		},
+		{
+			Plaintext:  "4920776f756c64206c696b65207468652047656e6572616c2047617527732043",
+			Ciphertext: "39312523a78662d5be7fcbcc98ebf5a897687268d6ecccc0c07b25e25ecfe584",
+		},
+	}
+	for i, c := range cases {
+		ciphertext, _ := hex.DecodeString(c.Ciphertext)
+		plaintext, err := decryptAESCTS(key, ciphertext)
+		if assert.NoError(t, err, "case %d should not have failed", i) {
+			assert.Equal(t, c.Plaintext, hex.EncodeToString(plaintext), "case %d, unexpected plaintext", i)
+		}
+		plaintext, _ = hex.DecodeString(c.Plaintext)
+		assert.Equal(t, c.Ciphertext, hex.EncodeToString(encryptAESCTS(key, plaintext)), "case %d, unexpected ciphertext", i)
+	}
+}
+
+func TestKerberosDecrypt(t *testing.T) {
+	for _, size := range []int{0, 1, 16, 17, 100} {
+		plaintext := bytes.Repeat([]byte("x"), size)
+		decrypted, err := kerberosDecrypt(fakeKerberosKey, kerberosUsageTicket, kerberosEncrypt(fakeKerberosKey, kerberosUsageTicket, plaintext))
+		if assert.NoError(t, err, "size %d should not have failed", size) {
+			assert.Equal(t, plaintext, decrypted)
+		}
+	}
+	ciphertext := kerberosEncrypt(fakeKerberosKey, kerberosUsageTicket, []byte("content"))
+	_, err := kerberosDecrypt(fakeKerberosKey, kerberosUsageAuthenticator, ciphertext)
+	assert.Error(t, err, "the usage should be checked")
+	ciphertext[20] ^= 0x01
+	_, err = kerberosDecrypt(fakeKerberosKey, kerberosUsageTicket, ciphertext)
+	assert.Error(t, err, "the integrity should be checked")
+	_, err = kerberosDecrypt(fakeKerberosKey, kerberosUsageTicket, ciphertext[:20])
+	assert.Error(t, err)
+}
+
+func TestParseKeytab(t *testing.T) {
+	content := newFakeKeytab(
+		&keytabEntry{principal: fakeKerberosService + "@" + fakeKerberosRealm, kvno: 300, etype: kerberosAES256, key: fakeKerberosKey},
+		&keytabEntry{principal: fakeKerberosService + "@" + fakeKerberosRealm, kvno: 3, etype: 23, key: []byte("0123456789abcdef")},
+		&keytabEntry{principal: "HTTP/other.corp.example.com@" + fakeKerberosRealm, kvno: 1, etype: kerberosAES128, key: []byte("0123456789abcdef")},
+	)
+	keys, err := parseKeytab(content)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	if assert.Len(t, keys, 2, "the rc4 key should be skipped") {
+		assert.Equal(t, fakeKerberosService+"@"+fakeKerberosRealm, keys[0].principal)
+		assert.Equal(t, uint32(300), keys[0].kvno)
+		assert.Equal(t, int32(kerberosAES256), keys[0].etype)
+		assert.Equal(t, fakeKerberosKey, keys[0].key)
+		assert.Equal(t, "HTTP/other.corp.example.com@"+fakeKerberosRealm, keys[1].principal)
+	}
+
+	_, err = parseKeytab([]byte{0x05, 0x01})
+	assert.Error(t, err)
+	_, err = parseKeytab(content[:len(content)-4])
+	assert.Error(t, err)
+}
+
+func TestKerberosPrincipalGeneralString(t *testing.T) {
+	// the strings of the messages are general strings
+	content, _ := hex.DecodeString("3013a003020101a10c300a1b086a736d6974682f78")
+	name := kerberosPrincipalName{}
+	_, err := asn1.Unmarshal(content, &name)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "jsmith/x@"+fakeKerberosRealm, getKerberosPrincipal(name, fakeKerberosRealm))
+	}
+}
+
+func TestKerberosAccept(t *testing.T) {
+	now := time.Now()
+	cases := []struct {
+		Ticket func() *fakeTicket
+		Now    time.Time
+		Ok     bool
+	}{
+		{Ticket: func() *fakeTicket { return newFakeTicket("jsmith", now) }, Now: now, Ok: true},
+		{Ticket: func() *fakeTicket { return newFakeTicket("jsmith", now) }, Now: now.Add(4 * time.Minute), Ok: true},
+		{
+			Ticket: func() *fakeTicket {
+				x := newFakeTicket("jsmith", now)
+				x.serviceKey = []byte("ffffffffffffffffffffffffffffffff")
+				return x
+			},
+			Now: now,
+		},
+		{
+			Ticket: func() *fakeTicket {
+				x := newFakeTicket("jsmith", now)
+				x.kvno = 3
+				return x
+			},
+			Now: now,
+		},
+		{
+			Ticket: func() *fakeTicket {
+				x := newFakeTicket("jsmith", now)
+				x.endTime = now.Add(-10 * time.Minute)
+				return x
+			},
+			Now: now,
+		},
+		{
+			Ticket: func() *fakeTicket {
+				x := newFakeTicket("jsmith", now)
+				x.authenticatorClient = "admin"
+				return x
+			},
+			Now: now,
+		},
+		{Ticket: func() *fakeTicket { return newFakeTicket("jsmith", now) }, Now: now.Add(10 * time.Minute)},
+		{Ticket: func() *fakeTicket { return newFakeTicket("jsmith", now.Add(time.Hour)) }, Now: now},
+	}
+	for i, c := range cases {
+		identity, err := newFakeKerberosAcceptor().accept(c.Ticket().encode(), c.Now)
+		if !c.Ok {
+			assert.Error(t, err, "case %d should have failed", i)
+			continue
+		}
+		if assert.NoError(t, err, "case %d should not have failed", i) {
+			assert.Equal(t, "jsmith@"+fakeKerberosRealm, identity.principal, "case %d, unexpected principal", i)
+			assert.Equal(t, now.Add(9*time.Hour).Unix(), identity.expires.Unix(), "case %d, unexpected expiration", i)
+		}
+	}
+}
+
+func TestKerberosAcceptReplay(t *testing.T) {
+	now := time.Now()
+	acceptor := newFakeKerberosAcceptor()
+	request := newFakeTicket("jsmith", now).encode()
+	_, err := acceptor.accept(request, now)
+	assert.NoError(t, err)
+	_, err = acceptor.accept(request, now.Add(time.Second))
+	assert.Error(t, err, "the authenticator should not be accepted twice")
+	_, err = acceptor.accept(newFakeTicket("jsmith", now.Add(time.Millisecond)).encode(), now.Add(time.Second))
+	assert.NoError(t, err)
+	// the replays are forgotten once outside the clock skew
+	acceptor.isReplay("other", now.Add(time.Hour))
+	assert.Len(t, acceptor.replays, 1)
+}
@@ -0,0 +1,375 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	// the ber tags of the ldap messages (rfc 4511), the protocol operations are application tagged
+	berInteger     = 0x02
+	berOctetString = 0x04
+	berBoolean     = 0x01
+	berEnumerated  = 0x0a
+	berSequence    = 0x30
+	berSet         = 0x31
+
+	ldapBindRequest       = 0x60
+	ldapBindResponse      = 0x61
+	ldapUnbindRequest     = 0x42
+	ldapSearchRequest     = 0x63
+	ldapSearchResultEntry = 0x64
+	ldapSearchResultDone  = 0x65
+	ldapSearchResultRef   = 0x73
+	ldapSimpleAuth        = 0x80
+	ldapEqualityMatch     = 0xa3
+
+	// ldapScopeSubtree searches the base object and all its subordinates
+	ldapScopeSubtree = 2
+	// ldapResultSuccess and ldapResultSizeLimitExceeded are the result codes of the operations
+	ldapResultSuccess           = 0
+	ldapResultSizeLimitExceeded = 4
+	// ldapMaxMessageSize is the largest message read from the directory
+	ldapMaxMessageSize = 1 << 20
+)
+
+//
+// ldapDirectory looks up the attributes of the users in a ldap directory, by a simple bind and a search of the
+// subtree of the base dn for the single entry with the lookup attribute equal to the value
+//
+type ldapDirectory struct {
+	// the host:port of the directory
+	address string
+	// whether the directory is reached over tls, i.e. ldaps
+	tls bool
+	// the dn and password the proxy binds as, anonymous when empty
+	bindDN   string
+	password string
+	// the base dn the users are searched under
+	baseDN string
+	// the attribute the users are matched by
+	attribute string
+	// the attributes returned
+	attributes []string
+	// the time permitted for the lookup
+	timeout time.Duration
+}
+
+//
+// lookup searches the directory for the user, returning the attributes of the entry or none when there's no entry
+//
+func (r *ldapDirectory) lookup(value string) (map[string]interface{}, error) {
+	dialer := &net.Dialer{Timeout: r.timeout}
+	var conn net.Conn
+	var err error
+	if r.tls {
+		host, _, _ := net.SplitHostPort(r.address)
+		conn, err = tls.DialWithDialer(dialer, "tcp", r.address, &tls.Config{ServerName: host})
+	} else {
+		conn, err = dialer.Dial("tcp", r.address)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(r.timeout))
+	reader := bufio.NewReader(conn)
+
+	// step: bind as the proxy, unless the directory permits anonymous searches
+	if r.bindDN != "" {
+		if _, err := conn.Write(ldapMessage(1, berEncode(ldapBindRequest,
+			berInt(berInteger, 3), berString(berOctetString, r.bindDN), berString(ldapSimpleAuth, r.password)))); err != nil {
+			return nil, err
+		}
+		tag, content, err := readLDAPMessage(reader)
+		if err != nil {
+			return nil, err
+		}
+		if tag != ldapBindResponse {
+			return nil, fmt.Errorf("unexpected ldap response: %x to the bind", tag)
+		}
+		if code, message, err := parseLDAPResult(content); err != nil {
+			return nil, err
+		} else if code != ldapResultSuccess {
+			return nil, fmt.Errorf("unable to bind to the directory, result: %d, %s", code, message)
+		}
+	}
+
+	// step: search for the entry of the user
+	var attributes [][]byte
+	for _, x := range r.attributes {
+		attributes = append(attributes, berString(berOctetString, x))
+	}
+	if _, err := conn.Write(ldapMessage(2, berEncode(ldapSearchRequest,
+		berString(berOctetString, r.baseDN),
+		berInt(berEnumerated, ldapScopeSubtree),
+		berInt(berEnumerated, 0),
+		berInt(berInteger, 2),
+		berInt(berInteger, int(r.timeout/time.Second)),
+		berEncode(berBoolean, []byte{0x00}),
+		berEncode(ldapEqualityMatch, berString(berOctetString, r.attribute), berString(berOctetString, value)),
+		berEncode(berSequence, attributes...)))); err != nil {
+		return nil, err
+	}
+
+	var entries []map[string]interface{}
+	for {
+		tag, content, err := readLDAPMessage(reader)
+		if err != nil {
+			return nil, err
+		}
+		switch tag {
+		case ldapSearchResultEntry:
+			entry, err := r.parseEntry(content)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, entry)
+		case ldapSearchResultRef:
+		case ldapSearchResultDone:
+			code, message, err := parseLDAPResult(content)
+			if err != nil {
+				return nil, err
+			}
+			if code != ldapResultSuccess && code != ldapResultSizeLimitExceeded {
+				return nil, fmt.Errorf("unable to search the directory, result: %d, %s", code, message)
+			}
+			conn.Write(ldapMessage(3, berEncode(ldapUnbindRequest)))
+			if len(entries) > 1 {
+				return nil, fmt.Errorf("the %s: %s matches more than one entry in the directory", r.attribute, value)
+			}
+			if len(entries) <= 0 {
+				return map[string]interface{}{}, nil
+			}
+
+			return entries[0], nil
+		default:
+			return nil, fmt.Errorf("unexpected ldap response: %x to the search", tag)
+		}
+	}
+}
+
+//
+// parseEntry returns the requested attributes of the search result entry, a attribute with a single value as a
+// string, else a list of the values
+//
+func (r *ldapDirectory) parseEntry(content []byte) (map[string]interface{}, error) {
+	// step: skip the dn of the entry
+	_, _, rest, err := berDecode(content)
+	if err != nil {
+		return nil, err
+	}
+	_, list, _, err := berDecode(rest)
+	if err != nil {
+		return nil, err
+	}
+	entry := make(map[string]interface{})
+	for len(list) > 0 {
+		var attribute []byte
+		if _, attribute, list, err = berDecode(list); err != nil {
+			return nil, err
+		}
+		_, name, set, err := berDecode(attribute)
+		if err != nil {
+			return nil, err
+		}
+		_, set, _, err = berDecode(set)
+		if err != nil {
+			return nil, err
+		}
+		var values []interface{}
+		for len(set) > 0 {
+			var value []byte
+			if _, value, set, err = berDecode(set); err != nil {
+				return nil, err
+			}
+			values = append(values, string(value))
+		}
+		// step: the attribute names are case insensitive, so use the name as requested
+		key := string(name)
+		for _, x := range r.attributes {
+			if strings.EqualFold(x, key) {
+				key = x
+			}
+		}
+		switch len(values) {
+		case 0:
+		case 1:
+			entry[key] = values[0]
+		default:
+			entry[key] = values
+		}
+	}
+
+	return entry, nil
+}
+
+//
+// ldapMessage wraps the protocol operation in a ldap message
+//
+func ldapMessage(id int, operation []byte) []byte {
+	return berEncode(berSequence, berInt(berInteger, id), operation)
+}
+
+//
+// readLDAPMessage reads a ldap message from the directory, returning the tag and content of the protocol operation
+//
+func readLDAPMessage(reader *bufio.Reader) (byte, []byte, error) {
+	tag, err := reader.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	if tag != berSequence {
+		return 0, nil, fmt.Errorf("unexpected ldap message tag: %x", tag)
+	}
+	size, err := reader.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	length := int(size)
+	if size&0x80 != 0 {
+		count := int(size & 0x7f)
+		if count <= 0 || count > 4 {
+			return 0, nil, errors.New("invalid ldap message length")
+		}
+		length = 0
+		for i := 0; i < count; i++ {
+			b, err := reader.ReadByte()
+			if err != nil {
+				return 0, nil, err
+			}
+			length = length<<8 | int(b)
+		}
+	}
+	if length > ldapMaxMessageSize {
+		return 0, nil, fmt.Errorf("the ldap message of %d bytes is too large", length)
+	}
+	message := make([]byte, length)
+	if _, err := io.ReadFull(reader, message); err != nil {
+		return 0, nil, err
+	}
+	// step: skip the message id, returning the operation
+	_, _, rest, err := berDecode(message)
+	if err != nil {
+		return 0, nil, err
+	}
+	tag, content, _, err := berDecode(rest)
+
+	return tag, content, err
+}
+
+//
+// parseLDAPResult returns the result code and diagnostic message of a ldap result
+//
+func parseLDAPResult(content []byte) (int, string, error) {
+	_, code, rest, err := berDecode(content)
+	if err != nil {
+		return 0, "", err
+	}
+	result := 0
+	for _, b := range code {
+		result = result<<8 | int(b)
+	}
+	// step: skip the matched dn
+	if _, _, rest, err = berDecode(rest); err != nil {
+		return 0, "", err
+	}
+	_, message, _, err := berDecode(rest)
+	if err != nil {
+		return 0, "", err
+	}
+
+	return result, string(message), nil
+}
+
+//
+// berEncode encodes the tag, length and content of a ber element
+//
+func berEncode(tag byte, content ...[]byte) []byte {
+	var body []byte
+	for _, x := range content {
+		body = append(body, x...)
+	}
+	encoded := []byte{tag}
+	switch length := len(body); {
+	case length < 0x80:
+		encoded = append(encoded, byte(length))
+	case length <= 0xff:
+		encoded = append(encoded, 0x81, byte(length))
+	case length <= 0xffff:
+		encoded = append(encoded, 0x82, byte(length>>8), byte(length))
+	default:
+		encoded = append(encoded, 0x84, byte(length>>24), byte(length>>16), byte(length>>8), byte(length))
+	}
+
+	return append(encoded, body...)
+}
+
+//
+// berString encodes the string as a ber element
+//
+func berString(tag byte, value string) []byte {
+	return berEncode(tag, []byte(value))
+}
+
+//
+// berInt encodes the non negative integer as a ber element
+//
+func berInt(tag byte, value int) []byte {
+	content := []byte{byte(value)}
+	for value >>= 8; value > 0; value >>= 8 {
+		content = append([]byte{byte(value)}, content...)
+	}
+	if content[0]&0x80 != 0 {
+		content = append([]byte{0x00}, content...)
+	}
+
+	return berEncode(tag, content)
+}
+
+//
+// berDecode decodes the first ber element, returning the tag, content and the remainder
+//
+func berDecode(b []byte) (byte, []byte, []byte, error) {
+	if len(b) < 2 {
+		return 0, nil, nil, errors.New("truncated ber element")
+	}
+	tag, length, offset := b[0], int(b[1]), 2
+	if length&0x80 != 0 {
+		count := length & 0x7f
+		if count <= 0 || count > 4 || len(b) < 2+count {
+			return 0, nil, nil, errors.New("invalid ber element length")
+		}
+		length = 0
+		for _, x := range b[2 : 2+count] {
+			length = length<<8 | int(x)
+		}
+		offset += count
+	}
+	if length < 0 || len(b)-offset < length {
+		return 0, nil, nil, errors.New("truncated ber element")
+	}
+
+	return tag, b[offset : offset+length], b[offset+length:], nil
+}
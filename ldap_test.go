@@ -0,0 +1,150 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newFakeLDAPServer serves the bind and search of a directory holding the entries, keyed by the uid
+func newFakeLDAPServer(t *testing.T, entries map[string][][]byte) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	result := func(tag byte, code int) []byte {
+		return berEncode(tag, berInt(berEnumerated, code), berString(berOctetString, ""), berString(berOctetString, ""))
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			reader := bufio.NewReader(conn)
+			for {
+				tag, content, err := readLDAPMessage(reader)
+				if err != nil {
+					break
+				}
+				switch tag {
+				case ldapBindRequest:
+					code := 49
+					if strings.Contains(string(content), "cn=proxy") && strings.HasSuffix(string(content), "secret") {
+						code = ldapResultSuccess
+					}
+					conn.Write(ldapMessage(1, result(ldapBindResponse, code)))
+				case ldapSearchRequest:
+					rest := content
+					for i := 0; i < 6; i++ {
+						_, _, rest, _ = berDecode(rest)
+					}
+					_, filter, _, _ := berDecode(rest)
+					_, _, value, _ := berDecode(filter)
+					_, uid, _, _ := berDecode(value)
+					for _, x := range entries[string(uid)] {
+						conn.Write(ldapMessage(2, x))
+					}
+					code := ldapResultSuccess
+					if len(entries[string(uid)]) > 1 {
+						code = ldapResultSizeLimitExceeded
+					}
+					conn.Write(ldapMessage(2, result(ldapSearchResultDone, code)))
+				}
+			}
+			conn.Close()
+		}
+	}()
+
+	return listener
+}
+
+func newFakeLDAPEntry(dn string, attributes map[string][]string) []byte {
+	var list [][]byte
+	for name, values := range attributes {
+		var set [][]byte
+		for _, x := range values {
+			set = append(set, berString(berOctetString, x))
+		}
+		list = append(list, berEncode(berSequence, berString(berOctetString, name), berEncode(berSet, set...)))
+	}
+
+	return berEncode(ldapSearchResultEntry, berString(berOctetString, dn), berEncode(berSequence, list...))
+}
+
+func TestBEREncoding(t *testing.T) {
+	for _, size := range []int{0, 127, 128, 255, 256, 70000} {
+		encoded := berEncode(berOctetString, make([]byte, size))
+		tag, content, rest, err := berDecode(encoded)
+		assert.NoError(t, err, "size %d", size)
+		assert.Equal(t, byte(berOctetString), tag, "size %d", size)
+		assert.Equal(t, size, len(content), "size %d", size)
+		assert.Empty(t, rest, "size %d", size)
+	}
+	assert.Equal(t, []byte{berInteger, 0x01, 0x00}, berInt(berInteger, 0))
+	assert.Equal(t, []byte{berInteger, 0x02, 0x00, 0x80}, berInt(berInteger, 128))
+	assert.Equal(t, []byte{berInteger, 0x02, 0x01, 0x00}, berInt(berInteger, 256))
+
+	_, _, _, err := berDecode([]byte{berOctetString, 0x05, 0x00})
+	assert.Error(t, err)
+}
+
+func TestLDAPDirectoryLookup(t *testing.T) {
+	listener := newFakeLDAPServer(t, map[string][][]byte{
+		"jane": {newFakeLDAPEntry("uid=jane,ou=people,dc=example,dc=com", map[string][]string{
+			"DepartmentNumber": {"finance"},
+			"memberOf":         {"cn=a", "cn=b"},
+		})},
+		"j*": {
+			newFakeLDAPEntry("uid=jane,ou=people,dc=example,dc=com", map[string][]string{}),
+			newFakeLDAPEntry("uid=john,ou=people,dc=example,dc=com", map[string][]string{}),
+		},
+	})
+	defer listener.Close()
+
+	dir := &ldapDirectory{
+		address:    listener.Addr().String(),
+		bindDN:     "cn=proxy,dc=example,dc=com",
+		password:   "secret",
+		baseDN:     "ou=people,dc=example,dc=com",
+		attribute:  "uid",
+		attributes: []string{"departmentNumber", "memberOf"},
+		timeout:    time.Duration(5) * time.Second,
+	}
+	attributes, err := dir.lookup("jane")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"departmentNumber": "finance",
+		"memberOf":         []interface{}{"cn=a", "cn=b"},
+	}, attributes)
+
+	attributes, err = dir.lookup("john")
+	assert.NoError(t, err)
+	assert.Empty(t, attributes)
+
+	_, err = dir.lookup("j*")
+	assert.Error(t, err)
+
+	dir.password = "wrong"
+	_, err = dir.lookup("jane")
+	assert.Error(t, err)
+}
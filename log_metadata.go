@@ -0,0 +1,208 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	// metadataServiceTimeout is the timeout for the requests to the metadata services
+	metadataServiceTimeout = time.Duration(2) * time.Second
+)
+
+var (
+	// ec2MetadataURL is the location of the ec2 instance metadata service
+	ec2MetadataURL = "http://169.254.169.254/latest"
+	// logMetadataEnvironment maps the log fields to the environment variables they are read from, the pod, namespace
+	// and node are the conventional names when exposed via the kubernetes downward api
+	logMetadataEnvironment = map[string]string{
+		"pod":               "POD_NAME",
+		"namespace":         "POD_NAMESPACE",
+		"node":              "NODE_NAME",
+		"availability_zone": "AVAILABILITY_ZONE",
+	}
+	// logMetadataOnce ensures the hook is added once to the process wide logger, whatever the reloads
+	logMetadataOnce sync.Once
+)
+
+//
+// metadataHook adds the host and container metadata to every log entry
+//
+type metadataHook struct {
+	// the fields added to the entries
+	fields log.Fields
+}
+
+//
+// Levels returns the levels the hook applies to, i.e. all of them
+//
+func (r *metadataHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+//
+// Fire adds the metadata to the entry, any field already on the entry takes precedence
+//
+func (r *metadataHook) Fire(entry *log.Entry) error {
+	for k, v := range r.fields {
+		if _, found := entry.Data[k]; !found {
+			entry.Data[k] = v
+		}
+	}
+
+	return nil
+}
+
+//
+// addLogMetadataHook adds the metadata hook to the logger, unless already added
+//
+func addLogMetadataHook(useMetadataService bool) {
+	logMetadataOnce.Do(func() {
+		log.AddHook(&metadataHook{fields: getLogMetadata(useMetadataService)})
+	})
+}
+
+//
+// getLogMetadata collects the hostname and the metadata from the environment, optionally querying the ecs and ec2
+// metadata services for anything the environment does not provide
+//
+func getLogMetadata(useMetadataService bool) log.Fields {
+	fields := log.Fields{}
+	if hostname, err := os.Hostname(); err == nil {
+		fields["hostname"] = hostname
+	}
+	for name, env := range logMetadataEnvironment {
+		if value := os.Getenv(env); value != "" {
+			fields[name] = value
+		}
+	}
+	if !useMetadataService {
+		return fields
+	}
+
+	client := &http.Client{Timeout: metadataServiceTimeout}
+
+	// step: are we running in a ecs task?
+	if location := getECSMetadataURL(); location != "" {
+		task := struct {
+			Cluster          string `json:"Cluster"`
+			TaskARN          string `json:"TaskARN"`
+			AvailabilityZone string `json:"AvailabilityZone"`
+		}{}
+		if err := getMetadataJSON(client, location+"/task", &task); err != nil {
+			log.WithFields(log.Fields{"error": err.Error()}).Warnf("unable to retrieve the ecs task metadata")
+		}
+		for name, value := range map[string]string{
+			"cluster":           task.Cluster,
+			"task":              task.TaskARN,
+			"availability_zone": task.AvailabilityZone,
+		} {
+			if _, found := fields[name]; !found && value != "" {
+				fields[name] = value
+			}
+		}
+	}
+
+	// step: fall back to the ec2 instance metadata
+	if _, found := fields["availability_zone"]; !found {
+		zone, err := getEC2Metadata(client, "placement/availability-zone")
+		if err != nil {
+			log.WithFields(log.Fields{"error": err.Error()}).Warnf("unable to retrieve the availability zone from the ec2 metadata")
+		} else {
+			fields["availability_zone"] = zone
+		}
+	}
+
+	return fields
+}
+
+//
+// getECSMetadataURL returns the ecs container metadata endpoint if running in a ecs task
+//
+func getECSMetadataURL() string {
+	if location := os.Getenv("ECS_CONTAINER_METADATA_URI_V4"); location != "" {
+		return location
+	}
+
+	return os.Getenv("ECS_CONTAINER_METADATA_URI")
+}
+
+//
+// getMetadataJSON retrieves and decodes the json document from the metadata service
+//
+func getMetadataJSON(client *http.Client, location string, v interface{}) error {
+	resp, err := client.Get(location)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("the metadata service returned: %s", resp.Status)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+//
+// getEC2Metadata retrieves a value from the ec2 instance metadata service, using a imdsv2 session token
+//
+func getEC2Metadata(client *http.Client, item string) (string, error) {
+	request, err := http.NewRequest("PUT", ec2MetadataURL+"/api/token", nil)
+	if err != nil {
+		return "", err
+	}
+	request.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "60")
+	resp, err := client.Do(request)
+	if err != nil {
+		return "", err
+	}
+	token, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unable to retrieve a metadata session token, status: %s", resp.Status)
+	}
+
+	request, err = http.NewRequest("GET", ec2MetadataURL+"/meta-data/"+item, nil)
+	if err != nil {
+		return "", err
+	}
+	request.Header.Set("X-aws-ec2-metadata-token", string(token))
+	if resp, err = client.Do(request); err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("the metadata service returned: %s", resp.Status)
+	}
+
+	return strings.TrimSpace(string(content)), nil
+}
@@ -0,0 +1,87 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetadataHook(t *testing.T) {
+	hook := &metadataHook{fields: log.Fields{"hostname": "proxy-1", "pod": "proxy-1-abcde"}}
+	entry := log.WithFields(log.Fields{"pod": "request"})
+	assert.NoError(t, hook.Fire(entry))
+	assert.Equal(t, "proxy-1", entry.Data["hostname"])
+	assert.Equal(t, "request", entry.Data["pod"])
+}
+
+func TestGetLogMetadata(t *testing.T) {
+	os.Setenv("POD_NAME", "proxy-1-abcde")
+	os.Setenv("NODE_NAME", "node-1")
+	defer os.Unsetenv("POD_NAME")
+	defer os.Unsetenv("NODE_NAME")
+
+	fields := getLogMetadata(false)
+	assert.NotEmpty(t, fields["hostname"])
+	assert.Equal(t, "proxy-1-abcde", fields["pod"])
+	assert.Equal(t, "node-1", fields["node"])
+	assert.Nil(t, fields["availability_zone"])
+}
+
+func TestGetLogMetadataService(t *testing.T) {
+	service := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/ecs/task":
+			w.Write([]byte(`{"Cluster": "default", "TaskARN": "arn:aws:ecs:eu-west-2:1:task/default/1"}`))
+		case "/latest/api/token":
+			if req.Method != "PUT" {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			w.Write([]byte("token"))
+		case "/latest/meta-data/placement/availability-zone":
+			if req.Header.Get("X-aws-ec2-metadata-token") != "token" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.Write([]byte("eu-west-2a"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer service.Close()
+
+	original := ec2MetadataURL
+	defer func() { ec2MetadataURL = original }()
+	ec2MetadataURL = service.URL + "/latest"
+	os.Setenv("ECS_CONTAINER_METADATA_URI", service.URL+"/ecs")
+	defer os.Unsetenv("ECS_CONTAINER_METADATA_URI")
+
+	fields := getLogMetadata(true)
+	assert.Equal(t, "default", fields["cluster"])
+	assert.Equal(t, "arn:aws:ecs:eu-west-2:1:task/default/1", fields["task"])
+	assert.Equal(t, "eu-west-2a", fields["availability_zone"])
+
+	// step: the environment takes precedence over the metadata services
+	os.Setenv("AVAILABILITY_ZONE", "eu-west-2c")
+	defer os.Unsetenv("AVAILABILITY_ZONE")
+	assert.Equal(t, "eu-west-2c", getLogMetadata(true)["availability_zone"])
+}
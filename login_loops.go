@@ -0,0 +1,172 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"html/template"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// loginLoopTemplate is the diagnostic page shown to the user when the login is looping
+var loginLoopTemplate = template.Must(template.New("loop").Parse(`<!DOCTYPE html>
+<html><head><meta charset="UTF-8"><title>Unable to sign in</title></head>
+<body>
+<h1>Unable to sign in</h1>
+<p>You have been sent back to sign in {{.Attempts}} times within {{.Window}}, but the session is never being kept.
+This is usually caused by one of the below.</p>
+<ul>
+  <li>The cookies are blocked by the browser, a privacy mode or an embedded view.</li>
+  <li>The clock of this device or of the server is wrong, the time on the server is {{.Now}}.</li>
+  <li>The site is being accessed by a different address than the one it was configured with.</li>
+</ul>
+<p><a href="{{.Retry}}">Try again</a></p>
+</body></html>
+`))
+
+//
+// loginAttempts are the callbacks of a client within the window
+//
+type loginAttempts struct {
+	// the number of callbacks
+	count int
+	// the time of the first callback
+	started time.Time
+}
+
+//
+// loginLoops counts the callbacks of the clients which never establish a session, breaking the loop between the
+// proxy and the provider
+//
+type loginLoops struct {
+	sync.Mutex
+	// the callbacks permitted within the window
+	threshold int
+	// the window the callbacks are counted in
+	window time.Duration
+	// the attempts keyed by the client
+	clients map[string]*loginAttempts
+	// the time the expired attempts were last removed
+	swept time.Time
+	// the loops detected
+	detections prometheus.Counter
+}
+
+//
+// newLoginLoops creates the login loop detection
+//
+func newLoginLoops(threshold int, window time.Duration) *loginLoops {
+	return &loginLoops{
+		threshold: threshold,
+		window:    window,
+		clients:   make(map[string]*loginAttempts),
+		swept:     time.Now(),
+		detections: prometheus.MustRegisterOrGet(prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "proxy_login_loops_total",
+				Help: "The login loops detected, where the clients repeatedly returned without a session",
+			},
+		)).(prometheus.Counter),
+	}
+}
+
+//
+// record counts a callback of the client, returning true when the client has exceeded the threshold within the
+// window, in which case the count is reset
+//
+func (r *loginLoops) record(client string, now time.Time) bool {
+	r.Lock()
+	defer r.Unlock()
+
+	// step: remove the expired attempts so the clients which never returned don't accumulate
+	if now.Sub(r.swept) >= r.window {
+		for k, v := range r.clients {
+			if now.Sub(v.started) >= r.window {
+				delete(r.clients, k)
+			}
+		}
+		r.swept = now
+	}
+
+	attempts, found := r.clients[client]
+	if !found || now.Sub(attempts.started) >= r.window {
+		attempts = &loginAttempts{started: now}
+		r.clients[client] = attempts
+	}
+	attempts.count++
+	if attempts.count <= r.threshold {
+		return false
+	}
+	delete(r.clients, client)
+	r.detections.Inc()
+
+	return true
+}
+
+//
+// reset clears the attempts of a client which has established a session
+//
+func (r *loginLoops) reset(client string) {
+	r.Lock()
+	defer r.Unlock()
+
+	delete(r.clients, client)
+}
+
+//
+// getLoginLoopClient returns the key the callbacks of the client are counted by, the peer address as the forwarded
+// headers are set by the client, so could be rotated to evade the detection or forged to throttle another
+//
+func getLoginLoopClient(cx *gin.Context) string {
+	return getRemoteAddress(cx.Request) + "|" + cx.Request.UserAgent()
+}
+
+//
+// loginLoopPage renders the diagnostic page for a client caught in a login loop
+//
+func (r *oauthProxy) loginLoopPage(cx *gin.Context, retry string) {
+	log.WithFields(log.Fields{
+		"client_ip":  getRemoteAddress(cx.Request),
+		"user_agent": cx.Request.UserAgent(),
+		"attempts":   r.loops.threshold + 1,
+		"window":     r.loops.window.String(),
+	}).Warnf("detected a login loop, the client is repeatedly returning without a session")
+
+	var content bytes.Buffer
+	err := loginLoopTemplate.Execute(&content, map[string]interface{}{
+		"Attempts": r.loops.threshold + 1,
+		"Window":   r.loops.window.String(),
+		"Now":      time.Now().UTC().Format(time.RFC1123),
+		"Retry":    retry,
+	})
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err.Error(),
+		}).Errorf("failed to render the login loop page")
+
+		cx.AbortWithStatus(http.StatusLoopDetected)
+		return
+	}
+
+	cx.Data(http.StatusLoopDetected, "text/html; charset=utf-8", content.Bytes())
+	cx.Abort()
+}
@@ -0,0 +1,82 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoginLoops(t *testing.T) {
+	loops := newLoginLoops(2, time.Minute)
+	now := time.Now()
+
+	assert.False(t, loops.record("a", now))
+	assert.False(t, loops.record("a", now.Add(time.Second)))
+	assert.False(t, loops.record("b", now.Add(time.Second)))
+	assert.True(t, loops.record("a", now.Add(2*time.Second)))
+	// step: the count is reset once the loop is broken
+	assert.False(t, loops.record("a", now.Add(3*time.Second)))
+
+	// step: the callbacks outside the window aren't counted
+	assert.False(t, loops.record("b", now.Add(2*time.Minute)))
+	assert.False(t, loops.record("b", now.Add(2*time.Minute)))
+	assert.NotContains(t, loops.clients, "a")
+
+	// step: a client with a session is reset
+	loops.reset("b")
+	assert.False(t, loops.record("b", now.Add(2*time.Minute)))
+	assert.False(t, loops.record("b", now.Add(2*time.Minute)))
+	assert.True(t, loops.record("b", now.Add(2*time.Minute)))
+}
+
+func TestLoginLoopCallback(t *testing.T) {
+	config := newFakeKeycloakConfig()
+	config.LoginLoopThreshold = 2
+	config.LoginLoopWindow = time.Minute
+	_, _, u := newTestProxyService(config)
+
+	for i, expected := range []int{http.StatusTemporaryRedirect, http.StatusTemporaryRedirect, http.StatusLoopDetected} {
+		req, _ := http.NewRequest("GET", u+"/oauth/authorize?state=L2FkbWlu", nil)
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if !assert.NoError(t, err, "case %d, unable to call the authorization handler", i) {
+			continue
+		}
+		req, _ = http.NewRequest("GET", resp.Header.Get("Location"), nil)
+		resp, err = http.DefaultTransport.RoundTrip(req)
+		if !assert.NoError(t, err, "case %d, unable to call the provider", i) {
+			continue
+		}
+		// step: a rotated forwarded address doesn't evade the detection
+		req, _ = http.NewRequest("GET", resp.Header.Get("Location"), nil)
+		req.Header.Set("X-Forwarded-For", fmt.Sprintf("10.0.0.%d", i))
+		resp, err = http.DefaultTransport.RoundTrip(req)
+		if !assert.NoError(t, err, "case %d, unable to call the callback", i) {
+			continue
+		}
+		content, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Equal(t, expected, resp.StatusCode, "case %d, unexpected status", i)
+		if expected == http.StatusLoopDetected {
+			assert.Contains(t, string(content), `href="/admin"`)
+		}
+	}
+}
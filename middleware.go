@@ -17,7 +17,10 @@ package main
 
 import (
 	"fmt"
+	"math/rand"
+	"net/http"
 	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
@@ -31,28 +34,111 @@ import (
 const (
 	// cxEnforce is the tag name for a request requiring
 	cxEnforce = "Enforcing"
+	// cxResource is the tag name for the resource matched by the request, whether enforced or not
+	cxResource = "Resource"
+	// cxSignedURL is the tag name for a request permitted by a signed url
+	cxSignedURL = "SignedURL"
+	// cxBreakGlass is the tag name for a request permitted by a break glass token
+	cxBreakGlass = "BreakGlass"
+	// cxKerberos is the tag name for a request authenticated by kerberos
+	cxKerberos = "Kerberos"
+	// cxSAML is the tag name for a request with a saml session
+	cxSAML = "SAML"
+	// cxVirtualHost is the tag name for the virtual host of the request
+	cxVirtualHost = "VirtualHost"
+	// cxBearerError is the tag name for the reason the access token was refused
+	cxBearerError = "BearerError"
+
+	// headerAuthResource is the header carrying the resource matched by the request
+	headerAuthResource = "X-Auth-Resource"
+	// headerAuthDecision is the header carrying how the request was permitted
+	headerAuthDecision = "X-Auth-Decision"
+	// headerSessionExpires is the response header carrying the remaining lifetime of the session in seconds
+	headerSessionExpires = "X-Auth-Session-Expires"
+
+	decisionAuthenticated = "authenticated"
+	decisionWhiteListed   = "white-listed"
+	decisionSignedURL     = "signed-url"
+	decisionBreakGlass    = "break-glass"
+	decisionKerberos      = "kerberos"
+	decisionUnprotected   = "unprotected"
+
+	methodOverrideReject    = "reject"
+	methodOverrideNormalize = "normalize"
+	// methodOverrideMaxFormSize is the largest form inspected for a method override, as net/http parses
+	methodOverrideMaxFormSize = 10 << 20
+
+	methodHandlingExact    = "exact"
+	methodHandlingEnforce  = "enforce"
+	methodHandlingMatchGet = "match-get"
+	methodHandlingAllow    = "allow"
+
+	// redactedValue replaces any sensitive values in the request log
+	redactedValue = "REDACTED"
+)
+
+var (
+	// methodOverrideHeaders are the headers commonly used by frameworks to tunnel a method through a POST
+	methodOverrideHeaders = []string{
+		"X-Http-Method-Override",
+		"X-Http-Method",
+		"X-Method-Override",
+	}
 )
 
 //
 // loggingMiddleware is a custom http logger
 //
 func (r *oauthProxy) loggingMiddleware() gin.HandlerFunc {
+	redacted := append(append([]string{}, defaultRedactedQueryParams...), r.config.LogRedactQueryParams...)
+
 	return func(cx *gin.Context) {
 		start := time.Now()
 		cx.Next()
 		latency := time.Now().Sub(start)
 
-		log.WithFields(log.Fields{
+		// step: server errors are always logged, everything else is subject to the sampling
+		if cx.Writer.Status() < http.StatusInternalServerError && !isLogSampled(r.config.LogSampleRates, cx.Request.URL.Path) {
+			return
+		}
+
+		fields := log.Fields{
 			"client_ip": cx.ClientIP(),
 			"method":    cx.Request.Method,
 			"status":    cx.Writer.Status(),
 			"bytes":     cx.Writer.Size(),
 			"path":      cx.Request.URL.Path,
 			"latency":   latency.String(),
-		}).Infof("[%d] |%s| |%10v| %-5s %s", cx.Writer.Status(), cx.ClientIP(), latency, cx.Request.Method, cx.Request.URL.Path)
+		}
+		if cx.Request.URL.RawQuery != "" {
+			fields["query"] = redactQueryParams(cx.Request.URL.Query(), redacted)
+		}
+		for _, x := range r.config.LogRequestHeaders {
+			if v := cx.Request.Header.Get(x); v != "" {
+				fields["header_"+strings.ToLower(strings.Replace(x, "-", "_", -1))] = redactHeader(x, v)
+			}
+		}
+
+		log.WithFields(fields).Infof("[%d] |%s| |%10v| %-5s %s", cx.Writer.Status(), cx.ClientIP(), latency, cx.Request.Method, cx.Request.URL.Path)
 	}
 }
 
+//
+// isLogSampled decides if the request should be logged, the rate of the longest matching path prefix is used
+//
+func isLogSampled(rates map[string]float64, path string) bool {
+	matched := ""
+	rate := float64(1)
+	for k, v := range rates {
+		if strings.HasPrefix(path, k) && len(k) > len(matched) {
+			matched = k
+			rate = v
+		}
+	}
+
+	return rate >= 1 || (rate > 0 && rand.Float64() < rate)
+}
+
 //
 // metricsMiddleware is responsible for collecting metrics
 //
@@ -67,38 +153,125 @@ func (r *oauthProxy) metricsMiddleware() gin.HandlerFunc {
 		[]string{"code", "method"},
 	)
 
-	// step: register the metric with prometheus
+	info := getBuildInfo()
+	buildMetrics := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "build_info",
+			Help: "The version and build information of the proxy, the value is always 1",
+		},
+		[]string{"version", "gitsha", "build_time", "goversion"},
+	)
+
+	// step: register the metrics with prometheus
 	prometheus.MustRegisterOrGet(statusMetrics)
+	buildMetrics = prometheus.MustRegisterOrGet(buildMetrics).(*prometheus.GaugeVec)
+	buildMetrics.WithLabelValues(info.Version, info.GitSHA, info.BuildTime, info.GoVersion).Set(1)
 
 	return func(cx *gin.Context) {
 		// step: permit to next stage
 		cx.Next()
 		// step: update the metrics
-		statusMetrics.WithLabelValues(fmt.Sprintf("%d", cx.Writer.Status()), cx.Request.Method).Inc()
+		statusMetrics.WithLabelValues(strconv.Itoa(cx.Writer.Status()), cx.Request.Method).Inc()
+	}
+}
+
+//
+// pathNormalizationMiddleware normalizes the request path, ensuring the resource matching and the upstream
+// both see the same canonical path
+//
+func (r *oauthProxy) pathNormalizationMiddleware() gin.HandlerFunc {
+	return func(cx *gin.Context) {
+		if normalized := normalizePath(cx.Request.URL.Path); normalized != cx.Request.URL.Path || cx.Request.URL.RawPath != "" {
+			log.WithFields(log.Fields{
+				"path":       cx.Request.URL.Path,
+				"normalized": normalized,
+			}).Debugf("normalized the request path")
+
+			cx.Request.URL.Path = normalized
+			cx.Request.URL.RawPath = ""
+		}
+
+		cx.Next()
+	}
+}
+
+//
+// methodOverrideMiddleware rejects or normalizes any method override in the request, ensuring the resource
+// matching is performed against the method the upstream will actually act upon
+//
+func (r *oauthProxy) methodOverrideMiddleware() gin.HandlerFunc {
+	return func(cx *gin.Context) {
+		method, err := getMethodOverride(cx.Request)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"client_ip": cx.ClientIP(),
+				"error":     err.Error(),
+			}).Warnf("unable to inspect the request for a method override")
+
+			if err == ErrRequestBodyTooLarge {
+				cx.AbortWithStatus(http.StatusRequestEntityTooLarge)
+				return
+			}
+			cx.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+		if method == "" {
+			cx.Next()
+			return
+		}
+
+		switch r.config.MethodOverride {
+		case methodOverrideReject:
+			log.WithFields(log.Fields{
+				"client_ip": cx.ClientIP(),
+				"method":    cx.Request.Method,
+				"override":  method,
+			}).Warnf("rejecting the request, method overrides are not permitted")
+
+			cx.AbortWithStatus(http.StatusBadRequest)
+			return
+		default:
+			if !isValidMethod(method) || method == "ANY" {
+				cx.AbortWithStatus(http.StatusBadRequest)
+				return
+			}
+			// step: remove the override and apply the method to the request
+			if err := removeMethodOverride(cx.Request); err != nil {
+				cx.AbortWithStatus(http.StatusBadRequest)
+				return
+			}
+			cx.Request.Method = method
+		}
+
+		cx.Next()
 	}
 }
 
 //
 // entrypointMiddleware checks to see if the request requires authentication
 //
-func (r oauthProxy) entrypointMiddleware() gin.HandlerFunc {
+func (r *oauthProxy) entrypointMiddleware() gin.HandlerFunc {
 	return func(cx *gin.Context) {
 		if strings.HasPrefix(cx.Request.URL.Path, oauthURL) {
 			cx.Next()
 			return
 		}
-
+		// step: is the request for a virtual host?
+		if vhost := r.getVirtualHost(cx.Request.Host); vhost != nil {
+			cx.Set(cxVirtualHost, vhost)
+		}
 		// step: check if authentication is required - gin doesn't support wildcard url, so we have have to use prefixes
-		for _, resource := range r.config.Resources {
-			if strings.HasPrefix(cx.Request.URL.Path, resource.URL) {
-				if resource.WhiteListed {
-					break
-				}
-				// step: inject the resource into the context, saves us from doing this again
-				if containedIn("ANY", resource.Methods) || containedIn(cx.Request.Method, resource.Methods) {
-					cx.Set(cxEnforce, resource)
-				}
-				break
+		resource := r.getRequestResource(cx)
+		if resource == nil && r.config.DefaultDeny {
+			resource = defaultDenyResource
+		}
+		if resource != nil {
+			cx.Set(cxResource, resource)
+		}
+		if resource != nil && !resource.WhiteListed {
+			// step: inject the resource into the context, saves us from doing this again
+			if r.isMethodEnforced(cx.Request.Method, resource) {
+				cx.Set(cxEnforce, resource)
 			}
 		}
 		// step: pass into the authentication, admission and proxy handlers
@@ -106,13 +279,45 @@ func (r oauthProxy) entrypointMiddleware() gin.HandlerFunc {
 	}
 }
 
+//
+// isMethodEnforced checks if the resource protects the method, the head and options requests are either matched as
+// they are, always protected, matched as a get or always permitted, as configured
+//
+func (r *oauthProxy) isMethodEnforced(method string, resource *Resource) bool {
+	handling := methodHandlingExact
+	switch method {
+	case http.MethodHead:
+		handling = r.config.HeadMethod
+	case http.MethodOptions:
+		handling = r.config.OptionsMethod
+	}
+	switch handling {
+	case methodHandlingEnforce:
+		return true
+	case methodHandlingAllow:
+		return false
+	case methodHandlingMatchGet:
+		method = http.MethodGet
+	}
+
+	return containedIn("ANY", resource.Methods) || containedIn(method, resource.Methods)
+}
+
+//
+// getResource returns the first resource matching the prefix of the path, if any
+//
+func (r *oauthProxy) getResource(path string) *Resource {
+	return r.matcher.match(path)
+}
+
 //
 // authenticationMiddleware is responsible for verifying the access token
 //
 func (r *oauthProxy) authenticationMiddleware() gin.HandlerFunc {
 	return func(cx *gin.Context) {
 		// step: is authentication required on this uri?
-		if _, found := cx.Get(cxEnforce); !found {
+		ur, found := cx.Get(cxEnforce)
+		if !found {
 			log.WithFields(log.Fields{
 				"uri": cx.Request.URL.Path,
 			}).Debugf("skipping the authentication handler, resource not protected")
@@ -121,6 +326,33 @@ func (r *oauthProxy) authenticationMiddleware() gin.HandlerFunc {
 			return
 		}
 
+		// step: has the client been authenticated by kerberos?
+		if _, found := cx.Get(cxKerberos); found {
+			cx.Next()
+			return
+		}
+
+		// step: in saml mode the session is the saml session cookie
+		if r.saml != nil {
+			if _, found := cx.Get(cxSAML); !found {
+				log.WithFields(log.Fields{
+					"uri": cx.Request.URL.Path,
+				}).Debugf("no saml session found in request, redirecting for authorization")
+
+				r.redirectToAuthorization(cx)
+				return
+			}
+
+			cx.Next()
+			return
+		}
+
+		// step: in edge mode the identity is asserted by the load balancer or access gateway
+		if r.edge != nil {
+			r.edgeAuthentication(cx)
+			return
+		}
+
 		// step: grab the user identity from the request
 		user, err := r.getIdentity(cx)
 		if err != nil {
@@ -128,6 +360,9 @@ func (r *oauthProxy) authenticationMiddleware() gin.HandlerFunc {
 				"error": err.Error(),
 			}).Errorf("no session found in request, redirecting for authorization")
 
+			if err != ErrSessionNotFound {
+				setBearerError(cx, getBearerErrorDescription(err))
+			}
 			r.redirectToAuthorization(cx)
 			return
 		}
@@ -135,6 +370,48 @@ func (r *oauthProxy) authenticationMiddleware() gin.HandlerFunc {
 		// step: inject the user into the context
 		cx.Set(userContextName, user)
 
+		// step: validate the proof of possession for dpop bound tokens
+		if r.config.EnableDPoP {
+			resource := ur.(*Resource)
+			err := ErrSessionNotFound
+			if user.isBearer() {
+				err = r.verifyDPoP(cx, user, resource.RequireDPoP)
+			} else if !resource.RequireDPoP {
+				err = nil
+			}
+			if err != nil {
+				log.WithFields(log.Fields{
+					"email":     user.email,
+					"client_ip": cx.ClientIP(),
+					"error":     err.Error(),
+				}).Warnf("the dpop proof of possession is invalid")
+
+				cx.Header("WWW-Authenticate", `DPoP error="invalid_dpop_proof"`)
+				cx.AbortWithStatus(http.StatusUnauthorized)
+				return
+			}
+		}
+
+		// step: ensure the session is being used by the client it was issued to
+		if r.useSessionBinding() && !user.isBearer() {
+			if err := r.verifySessionBinding(cx, user); err != nil {
+				log.WithFields(log.Fields{
+					"email":     user.email,
+					"client_ip": cx.ClientIP(),
+				}).Warnf("the session binding is invalid, invalidating the session")
+
+				r.clearAllCookies(cx)
+				r.redirectToAuthorization(cx)
+				return
+			}
+		}
+
+		// step: a opaque token has been verified by the provider on introspection
+		if user.opaque != "" {
+			cx.Next()
+			return
+		}
+
 		// step: verify the access token
 		if r.config.SkipTokenVerification {
 			log.Warnf("skip token verification enabled, skipping verification process - FOR TESTING ONLY")
@@ -145,6 +422,7 @@ func (r *oauthProxy) authenticationMiddleware() gin.HandlerFunc {
 					"expired_on": user.expiresAt.String(),
 				}).Errorf("the session has expired and verification switch off")
 
+				setBearerError(cx, bearerErrorExpired)
 				r.redirectToAuthorization(cx)
 			}
 
@@ -152,7 +430,7 @@ func (r *oauthProxy) authenticationMiddleware() gin.HandlerFunc {
 		}
 
 		// step: verify the access token
-		if err := verifyToken(r.client, user.token); err != nil {
+		if err := r.verifyAccessToken(user.token); err != nil {
 
 			// step: if the error post verification is anything other than a token expired error
 			// we immediately throw an access forbidden - as there is something messed up in the token
@@ -172,6 +450,7 @@ func (r *oauthProxy) authenticationMiddleware() gin.HandlerFunc {
 					"expired_on": user.expiresAt.String(),
 				}).Errorf("the session has expired and access token refreshing is disabled")
 
+				setBearerError(cx, bearerErrorExpired)
 				r.redirectToAuthorization(cx)
 				return
 			}
@@ -183,6 +462,7 @@ func (r *oauthProxy) authenticationMiddleware() gin.HandlerFunc {
 					"expired_on": user.expiresAt.String(),
 				}).Errorf("the session has expired and we are using bearer tokens")
 
+				setBearerError(cx, bearerErrorExpired)
 				r.redirectToAuthorization(cx)
 				return
 			}
@@ -192,6 +472,12 @@ func (r *oauthProxy) authenticationMiddleware() gin.HandlerFunc {
 				"client_ip": cx.ClientIP(),
 			}).Infof("the accces token for user: %s has expired, attemping to refresh the token", user.email)
 
+			// step: the refresh is deferred while the provider is unreachable
+			if r.grace != nil && r.grace.isActive() {
+				r.deferRefresh(cx, user)
+				return
+			}
+
 			// step: check if the user has refresh token
 			rToken, err := r.retrieveRefreshToken(cx, user)
 			if err != nil {
@@ -200,6 +486,7 @@ func (r *oauthProxy) authenticationMiddleware() gin.HandlerFunc {
 					"error": err.Error(),
 				}).Errorf("unable to find a refresh token for the client: %s", user.email)
 
+				setBearerError(cx, bearerErrorExpired)
 				r.redirectToAuthorization(cx)
 				return
 			}
@@ -209,7 +496,7 @@ func (r *oauthProxy) authenticationMiddleware() gin.HandlerFunc {
 			}).Infof("found a refresh token, attempting to refresh access token for user: %s", user.email)
 
 			// step: attempts to refresh the access token
-			token, expires, err := getRefreshedToken(r.client, rToken)
+			token, expires, err := getRefreshedToken(r.getIssuerClient(user.token), rToken)
 			if err != nil {
 				// step: has the refresh token expired
 				switch err {
@@ -218,8 +505,13 @@ func (r *oauthProxy) authenticationMiddleware() gin.HandlerFunc {
 					r.clearAllCookies(cx)
 				default:
 					log.WithFields(log.Fields{"error": err.Error()}).Errorf("failed to refresh the access token")
+					if r.grace != nil && !r.grace.isReachable() {
+						r.deferRefresh(cx, user)
+						return
+					}
 				}
 
+				setBearerError(cx, bearerErrorExpired)
 				r.redirectToAuthorization(cx)
 				return
 			}
@@ -232,6 +524,13 @@ func (r *oauthProxy) authenticationMiddleware() gin.HandlerFunc {
 
 			// step: clear the cookie up
 			r.dropAccessTokenCookie(cx, token.Encode(), r.config.IdleDuration)
+			if r.useSessionBinding() {
+				if err := r.dropSessionBindingCookie(cx, user.id, r.config.IdleDuration); err != nil {
+					log.WithFields(log.Fields{
+						"error": err.Error(),
+					}).Errorf("failed to encrypt the session binding")
+				}
+			}
 
 			if r.useStore() {
 				go func(t jose.JWT, rt string) {
@@ -257,12 +556,27 @@ func (r *oauthProxy) authenticationMiddleware() gin.HandlerFunc {
 			}
 
 			// step: update the with the new access token
+			previous := getSessionID(user.token)
 			user.token = token
 
+			// step: carry the session over to the refreshed token
+			if r.config.MaxSessions > 0 && !user.isBearer() {
+				if err := r.registerSession(user, previous); err != nil && err != ErrInvalidSession {
+					log.WithFields(log.Fields{
+						"error": err.Error(),
+					}).Errorf("unable to renew the session in the store")
+				}
+			}
+
 			// step: inject the user into the context
 			cx.Set(userContextName, user)
 		}
 
+		// step: the client has a session, so isn't caught in a login loop
+		if r.loops != nil && !user.isBearer() {
+			r.loops.reset(getLoginLoopClient(cx))
+		}
+
 		cx.Next()
 	}
 }
@@ -292,23 +606,94 @@ func (r *oauthProxy) admissionMiddleware() gin.HandlerFunc {
 
 		resource := ur.(*Resource)
 		user := uc.(*userContext)
+		started := time.Now()
+
+		// step: the token must be issued by the provider selected for the request
+		issuer, selected := r.getIssuingProvider(user), r.getRequestProvider(cx)
+		if issuer != selected {
+			fields := log.Fields{
+				"username": user.name,
+				"resource": resource.URL,
+				"host":     cx.Request.Host,
+			}
+			if issuer != nil {
+				fields["issuer"] = issuer.getName()
+			}
+			if selected != nil {
+				fields["provider"] = selected.getName()
+			}
+			log.WithFields(fields).Warnf("the access token was not issued by the provider of the request")
+
+			r.resourceForbidden(cx, resource)
+			return
+		}
 
-		// step: check the audience for the token is us
-		if r.config.ClientID != "" && !user.isAudience(r.config.ClientID) {
+		// step: check the audience for the token is us, or the client of the provider
+		clientID := r.config.ClientID
+		if issuer != nil {
+			clientID = issuer.ClientID
+		}
+		audience := r.config.isClientAudience(user, clientID)
+		r.metrics.observeEvaluation("audience", "", time.Since(started))
+		if !audience {
 			log.WithFields(log.Fields{
 				"username":   user.name,
 				"expired_on": user.expiresAt.String(),
 				"issued":     user.audience,
-				"clientid":   r.config.ClientID,
+				"allowed":    strings.Join(r.config.getClientAudiences(clientID), ","),
 			}).Warnf("the access token audience is not us, redirecting back for authentication")
 
-			r.accessForbidden(cx)
+			r.resourceForbidden(cx, resource)
 			return
 		}
 
-		// step: we need to check the roles
-		if roles := len(resource.Roles); roles > 0 {
-			if !hasRoles(resource.Roles, user.roles) {
+		// step: does the resource require a stronger authentication than the user has?
+		if resource.ACR != "" {
+			acr, _, _ := user.claims.StringClaim(claimACR)
+			if !isSufficientACR(acr, resource.ACR, r.config.ACRLevels) {
+				log.WithFields(log.Fields{
+					"username": user.name,
+					"resource": resource.URL,
+					"acr":      acr,
+					"required": resource.ACR,
+				}).Warnf("the authentication of the user is too weak for the resource, stepping up")
+
+				r.stepUpAuthentication(cx, user, resource.ACR)
+				return
+			}
+		}
+
+		// step: are the permissions decided by the authorization services, in place of the roles?
+		if r.uma != nil {
+			checked := time.Now()
+			permitted, err := r.uma.isPermitted(user, resource, cx.Request.Method, checked)
+			r.metrics.observeEvaluation("uma", "", time.Since(checked))
+			if err != nil {
+				log.WithFields(log.Fields{
+					"username": user.name,
+					"resource": resource.URL,
+					"error":    err.Error(),
+				}).Errorf("unable to evaluate the permissions of the user")
+
+				cx.AbortWithStatus(http.StatusBadGateway)
+				return
+			}
+			if !permitted {
+				log.WithFields(log.Fields{
+					"access":   "denied",
+					"username": user.name,
+					"resource": resource.URL,
+				}).Warnf("access denied, no permission on the resource")
+
+				r.resourceForbidden(cx, resource)
+				return
+			}
+		} else if roles := len(resource.Roles); roles > 0 {
+			// step: we need to check the roles
+			checked := time.Now()
+			permitted := hasRoles(resource.Roles, r.getUserRoles(user))
+			r.metrics.observeEvaluation("roles", "", time.Since(checked))
+			if !permitted {
 				log.WithFields(log.Fields{
 					"access":   "denied",
 					"username": user.name,
@@ -316,13 +701,14 @@ func (r *oauthProxy) admissionMiddleware() gin.HandlerFunc {
 					"required": resource.GetRoles(),
 				}).Warnf("access denied, invalid roles")
 
-				r.accessForbidden(cx)
+				r.resourceForbidden(cx, resource)
 				return
 			}
 		}
 
 		// step: if we have any claim matching, validate the tokens has the claims
 		for claimName, match := range claimMatches {
+			checked := time.Now()
 			// step: if the claim is NOT in the token, we access deny
 			value, found, err := user.claims.StringClaim(claimName)
 			if err != nil {
@@ -333,7 +719,7 @@ func (r *oauthProxy) admissionMiddleware() gin.HandlerFunc {
 					"error":    err.Error(),
 				}).Errorf("unable to extract the claim from token")
 
-				r.accessForbidden(cx)
+				r.resourceForbidden(cx, resource)
 				return
 			}
 
@@ -345,12 +731,14 @@ func (r *oauthProxy) admissionMiddleware() gin.HandlerFunc {
 					"claim":    claimName,
 				}).Warnf("the token does not have the claim")
 
-				r.accessForbidden(cx)
+				r.resourceForbidden(cx, resource)
 				return
 			}
 
 			// step: check the claim is the same
-			if !match.MatchString(value) {
+			matched := match.MatchString(value)
+			r.metrics.observeEvaluation("claim", claimName, time.Since(checked))
+			if !matched {
 				log.WithFields(log.Fields{
 					"access":   "denied",
 					"username": user.name,
@@ -360,46 +748,81 @@ func (r *oauthProxy) admissionMiddleware() gin.HandlerFunc {
 					"required": match,
 				}).Warnf("the token claims does not match claim requirement")
 
-				r.accessForbidden(cx)
+				r.resourceForbidden(cx, resource)
 				return
 			}
 		}
 
 		log.WithFields(log.Fields{
-			"access":   "permitted",
-			"username": user.name,
-			"resource": resource.URL,
-			"expires":  user.expiresAt.Sub(time.Now()).String(),
+			"access":     "permitted",
+			"username":   user.name,
+			"resource":   resource.URL,
+			"expires":    user.expiresAt.Sub(time.Now()).String(),
+			"evaluation": time.Since(started).String(),
 		}).Debugf("resource access permitted: %s", cx.Request.RequestURI)
 	}
 }
 
 //
-// corsMiddleware injects the CORS headers, if set, for request made to /oauth
+// uploadRestrictionMiddleware enforces the content type and body size restrictions of the resource; the resource is
+// that matched by the request rather than enforced, so the limits apply to the white-listed resources, and those
+// permitted by a signed url or break glass token, too
 //
-func (r *oauthProxy) corsMiddleware(c CORS) gin.HandlerFunc {
+func (r *oauthProxy) uploadRestrictionMiddleware() gin.HandlerFunc {
 	return func(cx *gin.Context) {
-		if len(c.Origins) > 0 {
-			cx.Writer.Header().Set("Access-Control-Allow-Origin", strings.Join(c.Origins, ","))
-		}
-		if len(c.Methods) > 0 {
-			cx.Writer.Header().Set("Access-Control-Allow-Methods", strings.Join(c.Methods, ","))
-		}
-		if len(c.Headers) > 0 {
-			cx.Writer.Header().Set("Access-Control-Allow-Headers", strings.Join(c.Headers, ","))
+		ur, found := cx.Get(cxResource)
+		if !found {
+			return
 		}
-		if len(c.ExposedHeaders) > 0 {
-			cx.Writer.Header().Set("Access-Control-Expose-Headers", strings.Join(c.ExposedHeaders, ","))
+		resource := ur.(*Resource)
+
+		// step: we only need to check requests carrying a body
+		if cx.Request.ContentLength == 0 || cx.Request.Body == nil {
+			return
 		}
-		if c.Credentials {
-			cx.Writer.Header().Set("Access-Control-Allow-Credentials", "true")
+
+		if !resource.isContentTypePermitted(cx.Request.Header.Get("Content-Type")) {
+			log.WithFields(log.Fields{
+				"resource":     resource.URL,
+				"content_type": cx.Request.Header.Get("Content-Type"),
+			}).Warnf("rejecting the request, content type not permitted")
+
+			cx.AbortWithStatus(http.StatusUnsupportedMediaType)
+			return
 		}
-		if c.MaxAge > 0 {
-			cx.Writer.Header().Set("Access-Control-Max-Age", fmt.Sprintf("%d", int(c.MaxAge.Seconds())))
+
+		if resource.MaxBodySize > 0 {
+			if cx.Request.ContentLength > resource.MaxBodySize {
+				log.WithFields(log.Fields{
+					"resource": resource.URL,
+					"size":     cx.Request.ContentLength,
+					"limit":    resource.MaxBodySize,
+				}).Warnf("rejecting the request, body exceeds the permitted size")
+
+				cx.AbortWithStatus(http.StatusRequestEntityTooLarge)
+				return
+			}
+			// step: the content length can be unknown i.e. chunked, so ensure we never read past the limit
+			cx.Request.Body = http.MaxBytesReader(cx.Writer, cx.Request.Body, resource.MaxBodySize)
 		}
 	}
 }
 
+//
+// corsMiddleware injects the CORS headers, if set, for request made to /oauth
+//
+func (r *oauthProxy) corsMiddleware(c CORS) gin.HandlerFunc {
+	policy, err := newCORSPolicy(c)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err.Error()}).Errorf("unable to compile the cors policy")
+		policy = &corsPolicy{}
+	}
+
+	return func(cx *gin.Context) {
+		policy.setHeaders(cx)
+	}
+}
+
 //
 // headersMiddleware is responsible for add the authentication headers for the upstream
 //
@@ -415,6 +838,11 @@ func (r *oauthProxy) headersMiddleware(custom []string) gin.HandlerFunc {
 		for k, v := range r.config.Headers {
 			cx.Request.Header.Add(k, v)
 		}
+		if vhost := r.getRequestVirtualHost(cx); vhost != nil {
+			for k, v := range vhost.Headers {
+				cx.Request.Header.Set(k, v)
+			}
+		}
 
 		// step: retrieve the user context if any
 		if user, found := cx.Get(userContextName); found {
@@ -424,9 +852,27 @@ func (r *oauthProxy) headersMiddleware(custom []string) gin.HandlerFunc {
 			cx.Request.Header.Add("X-Auth-Username", id.name)
 			cx.Request.Header.Add("X-Auth-Email", id.email)
 			cx.Request.Header.Add("X-Auth-ExpiresIn", id.expiresAt.String())
-			cx.Request.Header.Add("X-Auth-Token", id.token.Encode())
-			cx.Request.Header.Add("X-Auth-Roles", strings.Join(id.roles, ","))
-			cx.Request.Header.Set("Authorization", fmt.Sprintf("Bearer %s", id.token.Encode()))
+			cx.Request.Header.Add("X-Auth-Roles", strings.Join(r.getUserRoles(id), ","))
+			// step: a user authenticated by kerberos, saml or the edge has no access token
+			if !id.kerberos && !id.saml && !id.edge {
+				token := id.getAccessToken()
+				cx.Request.Header.Add("X-Auth-Token", token)
+				// step: are we exchanging the token for the audience of the upstream?
+				if r.exchange != nil {
+					exchanged, err := r.exchange.exchange(id, time.Now())
+					if err != nil {
+						log.WithFields(log.Fields{
+							"email": id.email,
+							"error": err.Error(),
+						}).Errorf("unable to exchange the access token for the upstream")
+
+						cx.AbortWithStatus(http.StatusBadGateway)
+						return
+					}
+					token = exchanged
+				}
+				cx.Request.Header.Set("Authorization", "Bearer "+token)
+			}
 
 			// step: inject any custom claims
 			for claim, header := range customClaims {
@@ -435,6 +881,26 @@ func (r *oauthProxy) headersMiddleware(custom []string) gin.HandlerFunc {
 				}
 			}
 		}
+		// step: add the routing decision, replacing anything the client sent
+		resource, decision := r.getDecision(cx)
+		if resource != nil {
+			cx.Request.Header.Set(headerAuthResource, resource.getName())
+		} else {
+			cx.Request.Header.Del(headerAuthResource)
+		}
+		cx.Request.Header.Set(headerAuthDecision, decision)
+
+		// step: expose the remaining lifetime of the session to the client
+		if resource != nil && resource.SessionExpiry && decision == decisionAuthenticated {
+			if user, found := cx.Get(userContextName); found {
+				remaining := r.getSessionExpiry(cx, user.(*userContext)).Sub(time.Now())
+				if remaining < 0 {
+					remaining = 0
+				}
+				cx.Writer.Header().Set(headerSessionExpires, fmt.Sprintf("%d", int64(remaining/time.Second)))
+			}
+		}
+
 		// step: add the default headers
 		cx.Request.Header.Add("X-Forwarded-For", cx.Request.RemoteAddr)
 		cx.Request.Header.Set("X-Forwarded-Agent", prog)
@@ -442,19 +908,68 @@ func (r *oauthProxy) headersMiddleware(custom []string) gin.HandlerFunc {
 	}
 }
 
+//
+// getDecision returns the resource matched by the request and how the request was permitted
+//
+func (r *oauthProxy) getDecision(cx *gin.Context) (*Resource, string) {
+	if resource, found := cx.Get(cxEnforce); found {
+		if _, found := cx.Get(cxKerberos); found {
+			return resource.(*Resource), decisionKerberos
+		}
+		return resource.(*Resource), decisionAuthenticated
+	}
+	resource := r.getRequestResource(cx)
+	if resource == nil {
+		return nil, decisionUnprotected
+	}
+	if _, found := cx.Get(cxSignedURL); found {
+		return resource, decisionSignedURL
+	}
+	if _, found := cx.Get(cxBreakGlass); found {
+		return resource, decisionBreakGlass
+	}
+	if resource.WhiteListed {
+		return resource, decisionWhiteListed
+	}
+
+	return resource, decisionUnprotected
+}
+
 //
 // securityMiddleware performs numerous security checks on the request
 //
 func (r *oauthProxy) securityMiddleware() gin.HandlerFunc {
 	// step: create the security options
+	options := r.config.SecurityFilter
 	secure := secure.New(secure.Options{
-		AllowedHosts:       r.config.Hostnames,
-		BrowserXssFilter:   true,
-		ContentTypeNosniff: true,
-		FrameDeny:          true,
+		AllowedHosts:            options.AllowedHosts,
+		SSLRedirect:             options.SSLRedirect,
+		SSLTemporaryRedirect:    options.SSLTemporaryRedirect,
+		SSLHost:                 options.SSLHost,
+		SSLProxyHeaders:         options.SSLProxyHeaders,
+		STSSeconds:              options.STSSeconds,
+		STSIncludeSubdomains:    options.STSIncludeSubdomains,
+		STSPreload:              options.STSPreload,
+		ForceSTSHeader:          options.ForceSTSHeader,
+		FrameDeny:               options.FrameDeny,
+		CustomFrameOptionsValue: options.FrameOptions,
+		ContentTypeNosniff:      options.ContentTypeNosniff,
+		BrowserXssFilter:        options.BrowserXSSFilter,
+		ContentSecurityPolicy:   options.ContentSecurityPolicy,
+		IsDevelopment:           options.Development,
 	})
 
 	return func(cx *gin.Context) {
+		// step: check the host, the hostnames may include a wildcard
+		if !r.isPermittedHost(cx.Request.Host) {
+			log.WithFields(log.Fields{
+				"host": cx.Request.Host,
+			}).Errorf("failed security middleware, the host is not permitted")
+
+			http.Error(cx.Writer, "Bad Host", http.StatusInternalServerError)
+			cx.Abort()
+			return
+		}
 		// step: pass through the security middleware
 		if err := secure.Process(cx.Writer, cx.Request); err != nil {
 			log.WithFields(log.Fields{
@@ -464,6 +979,8 @@ func (r *oauthProxy) securityMiddleware() gin.HandlerFunc {
 			cx.Abort()
 			return
 		}
+		// step: the headers are replaced by those of the upstream response, so are added again on the write
+		cx.Writer = newSecurityHeadersWriter(cx.Writer)
 
 		// step: permit the request to continue
 		cx.Next()
@@ -16,9 +16,12 @@ limitations under the License.
 package main
 
 import (
+	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/coreos/go-oidc/jose"
 	"github.com/gin-gonic/gin"
@@ -34,6 +37,34 @@ func BenchmarkEntrypointHandler(b *testing.B) {
 	}
 }
 
+func BenchmarkAuthenticatedRequest(b *testing.B) {
+	benchmarkAuthenticatedRequest(b, newFakeKeycloakConfig())
+}
+
+func BenchmarkAuthenticatedRequestTokenCache(b *testing.B) {
+	config := newFakeKeycloakConfig()
+	config.TokenCacheSize = 100
+	config.TokenCacheTTL = time.Minute
+	benchmarkAuthenticatedRequest(b, config)
+}
+
+func benchmarkAuthenticatedRequest(b *testing.B, config *Config) {
+	p, auth, _ := newTestProxyService(config)
+	token, err := jose.NewSignedJWT(auth.claims, auth.signer)
+	if err != nil {
+		b.Fatalf("unable to sign the token, error: %s", err)
+	}
+	cookie := &http.Cookie{Name: p.config.CookieAccessName, Value: token.Encode()}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		request := httptest.NewRequest("GET", fakeAuthAllURL+"/resource", nil)
+		request.AddCookie(cookie)
+		p.router.ServeHTTP(httptest.NewRecorder(), request)
+	}
+}
+
 func TestEntrypointHandlerSecure(t *testing.T) {
 	proxy := newFakeKeycloakProxyWithResources(t, []*Resource{
 		{
@@ -157,6 +188,103 @@ func TestEntrypointWhiteListing(t *testing.T) {
 
 }
 
+func TestEntrypointDefaultDeny(t *testing.T) {
+	proxy := newFakeKeycloakProxyWithResources(t, []*Resource{
+		{
+			URL:         "/public",
+			WhiteListed: true,
+		},
+		{
+			URL:     "/admin",
+			Methods: []string{"GET"},
+		},
+	})
+	proxy.config.DefaultDeny = true
+	proxy.config.OptionsMethod = methodHandlingAllow
+	handler := proxy.entrypointMiddleware()
+
+	tests := []struct {
+		Context  *gin.Context
+		Resource *Resource
+	}{
+		{Context: newFakeGinContext("GET", "/"), Resource: defaultDenyResource},
+		{Context: newFakeGinContext("POST", "/unknown"), Resource: defaultDenyResource},
+		{Context: newFakeGinContext("GET", "/admin"), Resource: proxy.config.Resources[1]},
+		{Context: newFakeGinContext("POST", "/admin")},
+		{Context: newFakeGinContext("GET", "/public")},
+		{Context: newFakeGinContext("OPTIONS", "/unknown")},
+	}
+
+	for i, c := range tests {
+		handler(c.Context)
+		resource, found := c.Context.Get(cxEnforce)
+		if c.Resource == nil {
+			assert.False(t, found, "test case %d should not have been set secure", i)
+			continue
+		}
+		assert.Equal(t, c.Resource, resource, "test case %d", i)
+	}
+}
+
+func TestEntrypointCaseInsensitive(t *testing.T) {
+	proxy := newFakeKeycloakProxyWithResources(t, []*Resource{
+		{
+			URL:     "/Admin",
+			Methods: []string{"ANY"},
+		},
+	})
+	handler := proxy.entrypointMiddleware()
+
+	context := newFakeGinContext("GET", "/aDmIn/test")
+	handler(context)
+	_, found := context.Get(cxEnforce)
+	assert.False(t, found)
+
+	proxy.config.CaseInsensitivePaths = true
+	proxy.compileResources()
+	context = newFakeGinContext("GET", "/aDmIn/test")
+	handler(context)
+	_, found = context.Get(cxEnforce)
+	assert.True(t, found)
+}
+
+func TestPathNormalizationHandler(t *testing.T) {
+	proxy := newFakeKeycloakProxyWithResources(t, []*Resource{
+		{
+			URL:     "/admin",
+			Methods: []string{"ANY"},
+		},
+	})
+	normalizer := proxy.pathNormalizationMiddleware()
+	handler := proxy.entrypointMiddleware()
+
+	tests := []struct {
+		Path     string
+		RawPath  string
+		Expected string
+		Secure   bool
+	}{
+		{Path: "/admin", Expected: "/admin", Secure: true},
+		{Path: "/public/../admin", Expected: "/admin", Secure: true},
+		{Path: "//admin", Expected: "/admin", Secure: true},
+		{Path: "/admin", RawPath: "/%61dmin", Expected: "/admin", Secure: true},
+		{Path: "/oauth/../admin/", Expected: "/admin/", Secure: true},
+		{Path: "/public/./test", Expected: "/public/test"},
+	}
+
+	for i, c := range tests {
+		context := newFakeGinContext("GET", c.Path)
+		context.Request.URL.RawPath = c.RawPath
+		normalizer(context)
+		handler(context)
+
+		assert.Equal(t, c.Expected, context.Request.URL.Path, "case %d, expected path: %s", i, c.Expected)
+		assert.Empty(t, context.Request.URL.RawPath, "case %d, the raw path should have been reset", i)
+		_, found := context.Get(cxEnforce)
+		assert.Equal(t, c.Secure, found, "case %d, expected secure: %t", i, c.Secure)
+	}
+}
+
 func TestEntrypointHandler(t *testing.T) {
 	proxy, _, _ := newTestProxyService(nil)
 
@@ -187,6 +315,108 @@ func TestEntrypointHandler(t *testing.T) {
 	}
 }
 
+func TestEntrypointHandlerMethods(t *testing.T) {
+	proxy := newFakeKeycloakProxyWithResources(t, []*Resource{
+		{
+			URL:     "/admin",
+			Methods: []string{"GET"},
+		},
+		{
+			URL:     "/",
+			Methods: []string{"ANY"},
+		},
+	})
+	handler := proxy.entrypointMiddleware()
+
+	tests := []struct {
+		Handling string
+		Method   string
+		URI      string
+		Secure   bool
+	}{
+		{Handling: methodHandlingExact, Method: "HEAD", URI: "/admin"},
+		{Handling: methodHandlingExact, Method: "HEAD", URI: "/", Secure: true},
+		{Handling: methodHandlingExact, Method: "OPTIONS", URI: "/", Secure: true},
+		{Handling: methodHandlingEnforce, Method: "HEAD", URI: "/admin", Secure: true},
+		{Handling: methodHandlingEnforce, Method: "OPTIONS", URI: "/admin", Secure: true},
+		{Handling: methodHandlingMatchGet, Method: "HEAD", URI: "/admin", Secure: true},
+		{Handling: methodHandlingMatchGet, Method: "OPTIONS", URI: "/", Secure: true},
+		{Handling: methodHandlingAllow, Method: "HEAD", URI: "/admin"},
+		{Handling: methodHandlingAllow, Method: "OPTIONS", URI: "/"},
+		{Handling: methodHandlingAllow, Method: "GET", URI: "/admin", Secure: true},
+	}
+
+	for i, c := range tests {
+		proxy.config.HeadMethod = c.Handling
+		proxy.config.OptionsMethod = c.Handling
+		context := newFakeGinContext(c.Method, c.URI)
+		handler(context)
+		_, found := context.Get(cxEnforce)
+		assert.Equal(t, c.Secure, found, "case %d, unexpected enforcement", i)
+	}
+}
+
+func TestMethodOverrideHandler(t *testing.T) {
+	tests := []struct {
+		Mode     string
+		Header   string
+		Query    string
+		Form     string
+		Method   string
+		Body     string
+		HTTPCode int
+	}{
+		{Mode: methodOverrideReject, Method: "POST", HTTPCode: http.StatusOK},
+		{Mode: methodOverrideReject, Header: "DELETE", HTTPCode: http.StatusBadRequest},
+		{Mode: methodOverrideReject, Query: "DELETE", HTTPCode: http.StatusBadRequest},
+		{Mode: methodOverrideReject, Form: "name=jane&_method=DELETE", HTTPCode: http.StatusBadRequest},
+		{Mode: methodOverrideNormalize, Header: "delete", Method: "DELETE", HTTPCode: http.StatusOK},
+		{Mode: methodOverrideNormalize, Query: "PUT", Method: "PUT", HTTPCode: http.StatusOK},
+		{Mode: methodOverrideNormalize, Form: "name=jane&_method=DELETE", Method: "DELETE", Body: "name=jane", HTTPCode: http.StatusOK},
+		{Mode: methodOverrideNormalize, Form: "name=jane", Method: "POST", Body: "name=jane", HTTPCode: http.StatusOK},
+		{Mode: methodOverrideNormalize, Header: "BAD", HTTPCode: http.StatusBadRequest},
+		// the form inspected for a override is limited in size
+		{Mode: methodOverrideNormalize, Form: "a=" + strings.Repeat("a", methodOverrideMaxFormSize), HTTPCode: http.StatusRequestEntityTooLarge},
+	}
+
+	for i, c := range tests {
+		config := newFakeKeycloakConfig()
+		config.MethodOverride = c.Mode
+		p, _, u := newTestProxyService(config)
+
+		// step: record the method the upstream receives
+		var method, override, query, body string
+		p.upstream = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			method = req.Method
+			override = req.Header.Get("X-HTTP-Method-Override")
+			query = req.URL.RawQuery
+			content, _ := ioutil.ReadAll(req.Body)
+			body = string(content)
+			w.WriteHeader(http.StatusOK)
+		})
+
+		request, _ := http.NewRequest("POST", u+"/not_secure", strings.NewReader(c.Form))
+		if c.Form != "" {
+			request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+		if c.Header != "" {
+			request.Header.Set("X-HTTP-Method-Override", c.Header)
+		}
+		if c.Query != "" {
+			request.URL.RawQuery = formMethodOverride + "=" + c.Query
+		}
+		resp, err := http.DefaultClient.Do(request)
+		if !assert.NoError(t, err, "case %d, unable to make request", i) {
+			continue
+		}
+		assert.Equal(t, c.HTTPCode, resp.StatusCode, "case %d, expected: %d, got: %d", i, c.HTTPCode, resp.StatusCode)
+		assert.Equal(t, c.Method, method, "case %d, expected method: %s", i, c.Method)
+		assert.Empty(t, override, "case %d, the override should have been removed", i)
+		assert.Empty(t, query, "case %d, the override should have been removed from the query", i)
+		assert.Equal(t, c.Body, body, "case %d, the override should have been removed from the form", i)
+	}
+}
+
 func TestSecurityHandler(t *testing.T) {
 	p, _, _ := newTestProxyService(nil)
 	handler := p.securityMiddleware()
@@ -212,6 +442,60 @@ func TestSecurityHandler(t *testing.T) {
 		"we should have received a 500 not %d", context.Writer.Status())
 }
 
+func TestSecurityHandlerOptions(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	defer upstream.Close()
+
+	config := newFakeKeycloakConfig()
+	config.Upstream = upstream.URL
+	config.EnableSecurityFilter = true
+	config.SecurityFilter = SecurityFilter{
+		SSLRedirect:     true,
+		SSLProxyHeaders: map[string]string{"X-Forwarded-Proto": "https"},
+		STSSeconds:      3600,
+		FrameOptions:    "SAMEORIGIN",
+	}
+	p, _, u := newTestProxyService(config)
+	if !assert.NoError(t, p.createUpstreamProxy(p.endpoint)) {
+		t.FailNow()
+	}
+
+	// step: the http request is redirected to https
+	req, _ := http.NewRequest(http.MethodGet, u+fakeTestWhitelistedURL, nil)
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusMovedPermanently, resp.StatusCode)
+		assert.True(t, strings.HasPrefix(resp.Header.Get("Location"), "https://"))
+	}
+
+	// step: the load balancer terminated the tls
+	req.Header.Set("X-Forwarded-Proto", "https")
+	resp, err = http.DefaultTransport.RoundTrip(req)
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "max-age=3600", resp.Header.Get("Strict-Transport-Security"))
+		assert.Equal(t, "SAMEORIGIN", resp.Header.Get("X-Frame-Options"))
+		assert.Empty(t, resp.Header.Get("X-Content-Type-Options"))
+	}
+
+	// step: the development mode skips the redirect
+	config = newFakeKeycloakConfig()
+	config.Upstream = upstream.URL
+	config.EnableSecurityFilter = true
+	config.SecurityFilter = SecurityFilter{SSLRedirect: true, Development: true}
+	p, _, u = newTestProxyService(config)
+	if !assert.NoError(t, p.createUpstreamProxy(p.endpoint)) {
+		t.FailNow()
+	}
+	resp, err = http.Get(u + fakeTestWhitelistedURL)
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+}
+
 func TestCrossSiteHandler(t *testing.T) {
 	p, _, _ := newTestProxyService(nil)
 
@@ -327,6 +611,158 @@ func TestCustomHeadersHandler(t *testing.T) {
 	}
 }
 
+func TestDecisionHeadersHandler(t *testing.T) {
+	p := newFakeKeycloakProxyWithResources(t, []*Resource{
+		{Name: "admin", URL: "/admin", Methods: []string{"ANY"}},
+		{URL: "/public", WhiteListed: true},
+		{Name: "media", URL: "/media", Methods: []string{"ANY"}, SignedURLs: true},
+		{URL: "/reports", Methods: []string{"POST"}},
+	})
+	handler := p.headersMiddleware(nil)
+
+	cases := []struct {
+		URI       string
+		Enforced  bool
+		SignedURL bool
+		Spoofed   bool
+		Resource  string
+		Decision  string
+	}{
+		{URI: "/admin/users", Enforced: true, Resource: "admin", Decision: decisionAuthenticated},
+		{URI: "/public/index.html", Resource: "/public", Decision: decisionWhiteListed},
+		{URI: "/media/video.mp4", SignedURL: true, Resource: "media", Decision: decisionSignedURL},
+		{URI: "/reports/daily", Resource: "/reports", Decision: decisionUnprotected},
+		{URI: "/other", Spoofed: true, Decision: decisionUnprotected},
+	}
+	for i, c := range cases {
+		cx := newFakeGinContext("GET", c.URI)
+		if c.Spoofed {
+			cx.Request.Header.Set(headerAuthResource, "admin")
+			cx.Request.Header.Set(headerAuthDecision, decisionAuthenticated)
+		}
+		if c.Enforced {
+			cx.Set(cxEnforce, p.getResource(c.URI))
+		}
+		if c.SignedURL {
+			cx.Set(cxSignedURL, true)
+		}
+		handler(cx)
+		assert.Equal(t, c.Resource, cx.Request.Header.Get(headerAuthResource), "case %d, expected resource: %s", i, c.Resource)
+		assert.Equal(t, c.Decision, cx.Request.Header.Get(headerAuthDecision), "case %d, expected decision: %s", i, c.Decision)
+	}
+}
+
+func TestSessionExpiryHeader(t *testing.T) {
+	p := newFakeKeycloakProxyWithResources(t, []*Resource{
+		{URL: "/admin", Methods: []string{"ANY"}, SessionExpiry: true},
+		{URL: "/api", Methods: []string{"ANY"}},
+	})
+	p.config.EnableRefreshTokens = true
+	handler := p.headersMiddleware(nil)
+	refresh := newFakeJWTToken(t, jose.Claims{"exp": float64(time.Now().Add(time.Hour).Unix())})
+	encrypted, err := encodeText(refresh.Encode(), p.config.EncryptionKey)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	cases := []struct {
+		URI      string
+		Bearer   bool
+		Refresh  bool
+		Expected []string
+	}{
+		{URI: "/admin", Bearer: true, Expected: []string{"599", "600"}},
+		{URI: "/admin", Expected: []string{"599", "600"}},
+		{URI: "/admin", Refresh: true, Expected: []string{"3599", "3600"}},
+		{URI: "/admin", Bearer: true, Refresh: true, Expected: []string{"599", "600"}},
+		{URI: "/api", Refresh: true, Expected: []string{""}},
+	}
+	for i, c := range cases {
+		cx := newFakeGinContext("GET", c.URI)
+		cx.Set(cxEnforce, p.getResource(c.URI))
+		cx.Set(userContextName, &userContext{
+			bearerToken: c.Bearer,
+			expiresAt:   time.Now().Add(10 * time.Minute),
+			token:       *refresh,
+		})
+		if c.Refresh {
+			cx.Request.AddCookie(&http.Cookie{Name: p.config.CookieRefreshName, Value: encrypted})
+		}
+		handler(cx)
+		assert.Contains(t, c.Expected, cx.Writer.Header().Get(headerSessionExpires), "case %d, unexpected expiry", i)
+	}
+}
+
+func TestUploadRestrictionHandler(t *testing.T) {
+	p, _, _ := newTestProxyService(nil)
+	handler := p.uploadRestrictionMiddleware()
+	resource := &Resource{
+		URL:          "/upload",
+		ContentTypes: []string{"image/*"},
+		MaxBodySize:  10,
+	}
+
+	cases := []struct {
+		ContentType string
+		Body        string
+		HTTPCode    int
+	}{
+		{HTTPCode: http.StatusOK},
+		{ContentType: "image/png", Body: "small", HTTPCode: http.StatusOK},
+		{ContentType: "text/html", Body: "small", HTTPCode: http.StatusUnsupportedMediaType},
+		{ContentType: "image/png", Body: "far too large a body", HTTPCode: http.StatusRequestEntityTooLarge},
+	}
+
+	for i, c := range cases {
+		context := newFakeGinContext("POST", "/upload")
+		context.Set(cxResource, resource)
+		if c.Body != "" {
+			context.Request.Header.Set("Content-Type", c.ContentType)
+			context.Request.Body = ioutil.NopCloser(strings.NewReader(c.Body))
+			context.Request.ContentLength = int64(len(c.Body))
+		}
+		handler(context)
+		assert.Equal(t, c.HTTPCode, context.Writer.Status(), "case %d, expected: %d, got: %d", i, c.HTTPCode, context.Writer.Status())
+	}
+}
+
+func TestUploadRestrictionWhiteListed(t *testing.T) {
+	config := newFakeKeycloakConfig()
+	config.Resources = append([]*Resource{
+		{
+			URL:          "/public/upload",
+			Methods:      []string{"ANY"},
+			WhiteListed:  true,
+			ContentTypes: []string{"image/*"},
+			MaxBodySize:  10,
+		},
+	}, config.Resources...)
+	p, _, u := newTestProxyService(config)
+	p.upstream = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	cases := []struct {
+		ContentType string
+		Body        string
+		HTTPCode    int
+	}{
+		{ContentType: "image/png", Body: "small", HTTPCode: http.StatusOK},
+		{ContentType: "text/html", Body: "small", HTTPCode: http.StatusUnsupportedMediaType},
+		{ContentType: "image/png", Body: "far too large a body", HTTPCode: http.StatusRequestEntityTooLarge},
+	}
+	for i, c := range cases {
+		request, _ := http.NewRequest("POST", u+"/public/upload", strings.NewReader(c.Body))
+		request.Header.Set("Content-Type", c.ContentType)
+		resp, err := http.DefaultTransport.RoundTrip(request)
+		if !assert.NoError(t, err, "case %d, unable to make the request", i) {
+			continue
+		}
+		resp.Body.Close()
+		assert.Equal(t, c.HTTPCode, resp.StatusCode, "case %d, expected: %d, got: %d", i, c.HTTPCode, resp.StatusCode)
+	}
+}
+
 func TestAdmissionHandlerRoles(t *testing.T) {
 	proxy := newFakeKeycloakProxyWithResources(t, []*Resource{
 		{
@@ -344,6 +780,12 @@ func TestAdmissionHandlerRoles(t *testing.T) {
 			Methods: []string{"ANY"},
 			Roles:   []string{"admin", "test"},
 		},
+		{
+			URL:     "/hidden",
+			Methods: []string{"ANY"},
+			Roles:   []string{"admin"},
+			Hidden:  true,
+		},
 		{
 			URL:     "/",
 			Methods: []string{"ANY"},
@@ -395,6 +837,22 @@ func TestAdmissionHandlerRoles(t *testing.T) {
 				roles:    []string{"no_roles"},
 			},
 		},
+		{
+			Context:  newFakeGinContext("GET", "/hidden"),
+			HTTPCode: http.StatusNotFound,
+			UserContext: &userContext{
+				audience: "test",
+				roles:    []string{"test"},
+			},
+		},
+		{
+			Context:  newFakeGinContext("GET", "/hidden"),
+			HTTPCode: http.StatusOK,
+			UserContext: &userContext{
+				audience: "test",
+				roles:    []string{"admin"},
+			},
+		},
 		{
 			Context:  newFakeGinContext("GET", "/"),
 			HTTPCode: http.StatusOK,
@@ -535,3 +993,23 @@ func TestAdmissionHandlerClaims(t *testing.T) {
 		assert.Equal(t, c.HTTPCode, status, "test case %d should have recieved code: %d, got %d", i, c.HTTPCode, status)
 	}
 }
+
+func TestIsLogSampled(t *testing.T) {
+	rates := map[string]float64{
+		"/oauth/health": 0,
+		"/oauth":        1,
+		"/api":          0.5,
+	}
+	assert.False(t, isLogSampled(rates, "/oauth/health"))
+	assert.True(t, isLogSampled(rates, "/oauth/callback"))
+	assert.True(t, isLogSampled(rates, "/admin"))
+	assert.True(t, isLogSampled(nil, "/oauth/health"))
+
+	sampled := 0
+	for i := 0; i < 1000; i++ {
+		if isLogSampled(rates, "/api/users") {
+			sampled++
+		}
+	}
+	assert.True(t, sampled > 350 && sampled < 650, "expected roughly half the requests sampled, got: %d", sampled)
+}
@@ -0,0 +1,129 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"net/url"
+	"time"
+
+	"github.com/coreos/go-oidc/jose"
+	"github.com/gin-gonic/gin"
+)
+
+// nonceCookieDuration is the time the user has to complete the login before the nonce cookie expires
+const nonceCookieDuration = time.Duration(30) * time.Minute
+
+var (
+	// errNonceMissing indicates the nonce of the login couldn't be found
+	errNonceMissing = errors.New("the nonce of the login is missing or invalid")
+	// errNonceMismatch indicates the identity token wasn't issued for the login of the browser
+	errNonceMismatch = errors.New("the nonce of the identity token does not match the login")
+)
+
+//
+// newNonceSecret generates the random secret of the nonce
+//
+func newNonceSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+//
+// getNonce returns the nonce sent to the provider, the hash of the secret held by the browser, so the secret
+// itself never leaves the cookie
+//
+func getNonce(secret string) string {
+	hash := sha256.Sum256([]byte(secret))
+
+	return base64.RawURLEncoding.EncodeToString(hash[:])
+}
+
+//
+// getNonceStateSecret derives the secret of the nonce from the signed state, so nothing is kept on the client
+//
+func getNonceStateSecret(key []byte, state string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("nonce." + state))
+
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+//
+// setNonce creates the nonce of the login, dropping its secret in a cookie, encrypted when there's a encryption
+// key, unless derived from the signed state; and returns the authorization url with the nonce
+//
+func (r *oauthProxy) setNonce(cx *gin.Context, authURL, state string) (string, error) {
+	var secret string
+	if r.config.EnableSignedState {
+		secret = getNonceStateSecret([]byte(r.config.EncryptionKey), state)
+	} else {
+		var err error
+		if secret, err = newNonceSecret(); err != nil {
+			return "", err
+		}
+		value := secret
+		if r.config.EncryptionKey != "" {
+			if value, err = encodeText(secret, r.config.EncryptionKey); err != nil {
+				return "", err
+			}
+		}
+		r.dropCookie(cx, r.config.CookieNonceName, value, nonceCookieDuration)
+	}
+
+	return authURL + "&" + url.Values{"nonce": {getNonce(secret)}}.Encode(), nil
+}
+
+//
+// verifyNonce checks the nonce of the identity token is that of the login of the browser, clearing the cookie
+//
+func (r *oauthProxy) verifyNonce(cx *gin.Context, token jose.JWT) error {
+	var secret string
+	if r.config.EnableSignedState {
+		secret = getNonceStateSecret([]byte(r.config.EncryptionKey), cx.Request.URL.Query().Get("state"))
+	} else {
+		cookie, err := cx.Request.Cookie(r.config.CookieNonceName)
+		if err != nil || cookie.Value == "" {
+			return errNonceMissing
+		}
+		r.dropCookie(cx, r.config.CookieNonceName, "", time.Duration(-10*time.Hour))
+		secret = cookie.Value
+		if r.config.EncryptionKey != "" {
+			if secret, err = decodeText(cookie.Value, r.config.EncryptionKey); err != nil {
+				return errNonceMissing
+			}
+		}
+	}
+	claims, err := token.Claims()
+	if err != nil {
+		return err
+	}
+	nonce, _, _ := claims.StringClaim("nonce")
+	if subtle.ConstantTimeCompare([]byte(nonce), []byte(getNonce(secret))) != 1 {
+		return errNonceMismatch
+	}
+
+	return nil
+}
@@ -0,0 +1,116 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetNonce(t *testing.T) {
+	secret, err := newNonceSecret()
+	assert.NoError(t, err)
+	another, _ := newNonceSecret()
+	assert.NotEqual(t, secret, another)
+	assert.NotEqual(t, secret, getNonce(secret))
+	assert.Equal(t, getNonce(secret), getNonce(secret))
+
+	key := []byte("AgXa7xRcoClDEU0ZDSH4X0XhL5Qy2Z2j")
+	assert.Equal(t, getNonceStateSecret(key, "state"), getNonceStateSecret(key, "state"))
+	assert.NotEqual(t, getNonceStateSecret(key, "state"), getNonceStateSecret(key, "another"))
+}
+
+func TestNonceLogin(t *testing.T) {
+	for i, signed := range []bool{false, true} {
+		config := newFakeKeycloakConfig()
+		config.EnableNonce = true
+		config.CookieNonceName = "kc-nonce"
+		config.EnableSignedState = signed
+		config.SignedStateDuration = time.Minute
+		_, _, u := newTestProxyService(config)
+
+		req, _ := http.NewRequest("GET", u+oauthURL+authorizationURL, nil)
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if !assert.NoError(t, err, "case %d, unable to call the authorization handler", i) {
+			continue
+		}
+		location, _ := url.Parse(resp.Header.Get("Location"))
+		assert.NotEmpty(t, location.Query().Get("nonce"), "case %d, no nonce", i)
+		cookies := resp.Cookies()
+		if !signed {
+			cookie := findCookie(config.CookieNonceName, cookies)
+			if assert.NotNil(t, cookie, "case %d, no nonce cookie", i) {
+				assert.NotEqual(t, location.Query().Get("nonce"), getNonce(cookie.Value), "case %d, the secret should be encrypted", i)
+			}
+		}
+
+		req, _ = http.NewRequest("GET", location.String(), nil)
+		resp, err = http.DefaultTransport.RoundTrip(req)
+		if !assert.NoError(t, err, "case %d, unable to call the provider", i) {
+			continue
+		}
+		req, _ = http.NewRequest("GET", resp.Header.Get("Location"), nil)
+		for _, x := range cookies {
+			req.AddCookie(x)
+		}
+		resp, err = http.DefaultTransport.RoundTrip(req)
+		if assert.NoError(t, err, "case %d, unable to call the callback", i) {
+			assert.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode, "case %d, unexpected status", i)
+			assert.NotNil(t, findCookie(config.CookieAccessName, resp.Cookies()), "case %d, no session", i)
+		}
+	}
+}
+
+func TestNonceCallbackRefused(t *testing.T) {
+	config := newFakeKeycloakConfig()
+	config.EnableNonce = true
+	config.CookieNonceName = "kc-nonce"
+	_, _, u := newTestProxyService(config)
+
+	var callbacks []string
+	var cookies []*http.Cookie
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequest("GET", u+oauthURL+authorizationURL, nil)
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		cookies = append(cookies, findCookie(config.CookieNonceName, resp.Cookies()))
+		req, _ = http.NewRequest("GET", resp.Header.Get("Location"), nil)
+		resp, err = http.DefaultTransport.RoundTrip(req)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		callbacks = append(callbacks, resp.Header.Get("Location"))
+	}
+
+	// step: the identity token of another login, or without the nonce cookie, is refused
+	for i, cookie := range []*http.Cookie{cookies[1], nil} {
+		req, _ := http.NewRequest("GET", callbacks[0], nil)
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if assert.NoError(t, err, "case %d", i) {
+			resp.Body.Close()
+			assert.Equal(t, http.StatusForbidden, resp.StatusCode, "case %d", i)
+		}
+	}
+}
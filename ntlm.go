@@ -0,0 +1,251 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"encoding/binary"
+	"errors"
+	"math/bits"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+const (
+	ntlmSignature = "NTLMSSP\x00"
+
+	ntlmNegotiateUnicode                 = 0x00000001
+	ntlmRequestTarget                    = 0x00000004
+	ntlmNegotiateNTLM                    = 0x00000200
+	ntlmNegotiateAlwaysSign              = 0x00008000
+	ntlmNegotiateExtendedSessionSecurity = 0x00080000
+	ntlmNegotiateTargetInfo              = 0x00800000
+	ntlmNegotiate128                     = 0x20000000
+	ntlmNegotiate56                      = 0x80000000
+
+	// ntlmNegotiateFlags are the flags the proxy negotiates, no signing or sealing as the messages are carried by http
+	ntlmNegotiateFlags = ntlmNegotiateUnicode | ntlmRequestTarget | ntlmNegotiateNTLM | ntlmNegotiateAlwaysSign |
+		ntlmNegotiateExtendedSessionSecurity | ntlmNegotiateTargetInfo | ntlmNegotiate128 | ntlmNegotiate56
+
+	// ntlmAvTimestamp is the id of the server time in the target info
+	ntlmAvTimestamp = 7
+	// ntlmFileTimeOffset is the number of 100ns intervals between 1601 and the unix epoch
+	ntlmFileTimeOffset = 116444736000000000
+)
+
+//
+// ntlmChallenge is the challenge message of the server
+//
+type ntlmChallenge struct {
+	// the flags negotiated by the server
+	flags uint32
+	// the challenge of the server
+	challenge []byte
+	// the target info of the server, echoed in the response
+	targetInfo []byte
+}
+
+//
+// newNTLMNegotiateMessage creates the negotiate message opening the handshake
+//
+func newNTLMNegotiateMessage() []byte {
+	message := make([]byte, 32)
+	copy(message, ntlmSignature)
+	binary.LittleEndian.PutUint32(message[8:], 1)
+	binary.LittleEndian.PutUint32(message[12:], ntlmNegotiateFlags)
+
+	return message
+}
+
+//
+// parseNTLMChallengeMessage decodes the challenge message of the server
+//
+func parseNTLMChallengeMessage(message []byte) (*ntlmChallenge, error) {
+	if len(message) < 48 || !bytes.HasPrefix(message, []byte(ntlmSignature)) {
+		return nil, errors.New("invalid ntlm challenge message")
+	}
+	if binary.LittleEndian.Uint32(message[8:]) != 2 {
+		return nil, errors.New("the ntlm message is not a challenge")
+	}
+	length := int(binary.LittleEndian.Uint16(message[40:]))
+	offset := int(binary.LittleEndian.Uint32(message[44:]))
+	if offset+length > len(message) {
+		return nil, errors.New("the target info of the ntlm challenge is truncated")
+	}
+
+	return &ntlmChallenge{
+		flags:      binary.LittleEndian.Uint32(message[20:]),
+		challenge:  message[24:32],
+		targetInfo: message[offset : offset+length],
+	}, nil
+}
+
+//
+// newNTLMAuthenticateMessage creates the ntlmv2 response to the challenge of the server; the username may be
+// prefixed by the windows domain, i.e. CORP\user
+//
+func newNTLMAuthenticateMessage(challenge *ntlmChallenge, username, password string, clientChallenge []byte, now time.Time) []byte {
+	var domain string
+	if i := strings.Index(username, `\`); i >= 0 {
+		domain, username = username[:i], username[i+1:]
+	}
+	key := getNTLMv2ResponseKey(username, domain, password)
+
+	// step: the time of the server is used when given, in which case the lm response is omitted
+	timestamp := getNTLMTargetTimestamp(challenge.targetInfo)
+	lmResponse := make([]byte, 24)
+	if timestamp == nil {
+		timestamp = make([]byte, 8)
+		binary.LittleEndian.PutUint64(timestamp, uint64(now.UnixNano()/100+ntlmFileTimeOffset))
+		lmResponse = append(hmacMD5(key, challenge.challenge, clientChallenge), clientChallenge...)
+	}
+
+	ntResponse := getNTLMv2Response(key, challenge.challenge, clientChallenge, timestamp, challenge.targetInfo)
+
+	// step: the fields of the message are placed after the header, in order
+	message := make([]byte, 64)
+	copy(message, ntlmSignature)
+	binary.LittleEndian.PutUint32(message[8:], 3)
+	for i, field := range [][]byte{lmResponse, ntResponse, encodeUTF16(domain), encodeUTF16(username), {}, {}} {
+		binary.LittleEndian.PutUint16(message[12+i*8:], uint16(len(field)))
+		binary.LittleEndian.PutUint16(message[14+i*8:], uint16(len(field)))
+		binary.LittleEndian.PutUint32(message[16+i*8:], uint32(len(message)))
+		message = append(message, field...)
+	}
+	binary.LittleEndian.PutUint32(message[60:], challenge.flags&ntlmNegotiateFlags|ntlmNegotiateUnicode)
+
+	return message
+}
+
+//
+// getNTLMv2ResponseKey returns the ntlmv2 key of the user, derived from the nt hash of the password
+//
+func getNTLMv2ResponseKey(username, domain, password string) []byte {
+	hash := md4Sum(encodeUTF16(password))
+
+	return hmacMD5(hash[:], encodeUTF16(strings.ToUpper(username)+domain))
+}
+
+//
+// getNTLMv2Response returns the nt response, the proof over the client blob followed by the blob
+//
+func getNTLMv2Response(key, serverChallenge, clientChallenge, timestamp, targetInfo []byte) []byte {
+	blob := &bytes.Buffer{}
+	blob.Write([]byte{0x01, 0x01, 0, 0, 0, 0, 0, 0})
+	blob.Write(timestamp)
+	blob.Write(clientChallenge)
+	blob.Write([]byte{0, 0, 0, 0})
+	blob.Write(targetInfo)
+	blob.Write([]byte{0, 0, 0, 0})
+
+	return append(hmacMD5(key, serverChallenge, blob.Bytes()), blob.Bytes()...)
+}
+
+//
+// getNTLMTargetTimestamp returns the time of the server from the target info, or nil if not given
+//
+func getNTLMTargetTimestamp(info []byte) []byte {
+	for len(info) >= 4 {
+		id := binary.LittleEndian.Uint16(info)
+		length := int(binary.LittleEndian.Uint16(info[2:]))
+		if id == 0 || len(info) < 4+length {
+			break
+		}
+		if id == ntlmAvTimestamp && length == 8 {
+			return info[4:12]
+		}
+		info = info[4+length:]
+	}
+
+	return nil
+}
+
+//
+// encodeUTF16 returns the little endian utf16 encoding of the string
+//
+func encodeUTF16(value string) []byte {
+	encoded := utf16.Encode([]rune(value))
+	content := make([]byte, 2*len(encoded))
+	for i, x := range encoded {
+		binary.LittleEndian.PutUint16(content[2*i:], x)
+	}
+
+	return content
+}
+
+//
+// hmacMD5 returns the hmac-md5 of the content
+//
+func hmacMD5(key []byte, content ...[]byte) []byte {
+	mac := hmac.New(md5.New, key)
+	for _, x := range content {
+		mac.Write(x)
+	}
+
+	return mac.Sum(nil)
+}
+
+//
+// md4Sum returns the md4 digest (rfc 1320) of the content, used only to derive the nt hash of the password
+//
+func md4Sum(content []byte) [16]byte {
+	// step: pad the content to a multiple of the block size, ending with the length in bits
+	message := append(append([]byte{}, content...), 0x80)
+	for len(message)%64 != 56 {
+		message = append(message, 0)
+	}
+	length := make([]byte, 8)
+	binary.LittleEndian.PutUint64(length, uint64(len(content))*8)
+	message = append(message, length...)
+
+	a, b, c, d := uint32(0x67452301), uint32(0xefcdab89), uint32(0x98badcfe), uint32(0x10325476)
+	var x [16]uint32
+	for i := 0; i < len(message); i += 64 {
+		for j := range x {
+			x[j] = binary.LittleEndian.Uint32(message[i+4*j:])
+		}
+		aa, bb, cc, dd := a, b, c, d
+		for _, k := range []int{0, 4, 8, 12} {
+			a = bits.RotateLeft32(a+(b&c|^b&d)+x[k], 3)
+			d = bits.RotateLeft32(d+(a&b|^a&c)+x[k+1], 7)
+			c = bits.RotateLeft32(c+(d&a|^d&b)+x[k+2], 11)
+			b = bits.RotateLeft32(b+(c&d|^c&a)+x[k+3], 19)
+		}
+		for _, k := range []int{0, 1, 2, 3} {
+			a = bits.RotateLeft32(a+(b&c|b&d|c&d)+x[k]+0x5a827999, 3)
+			d = bits.RotateLeft32(d+(a&b|a&c|b&c)+x[k+4]+0x5a827999, 5)
+			c = bits.RotateLeft32(c+(d&a|d&b|a&b)+x[k+8]+0x5a827999, 9)
+			b = bits.RotateLeft32(b+(c&d|c&a|d&a)+x[k+12]+0x5a827999, 13)
+		}
+		for _, k := range []int{0, 2, 1, 3} {
+			a = bits.RotateLeft32(a+(b^c^d)+x[k]+0x6ed9eba1, 3)
+			d = bits.RotateLeft32(d+(a^b^c)+x[k+8]+0x6ed9eba1, 9)
+			c = bits.RotateLeft32(c+(d^a^b)+x[k+4]+0x6ed9eba1, 11)
+			b = bits.RotateLeft32(b+(c^d^a)+x[k+12]+0x6ed9eba1, 15)
+		}
+		a, b, c, d = a+aa, b+bb, c+cc, d+dd
+	}
+
+	var digest [16]byte
+	for i, x := range []uint32{a, b, c, d} {
+		binary.LittleEndian.PutUint32(digest[4*i:], x)
+	}
+
+	return digest
+}
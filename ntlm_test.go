@@ -0,0 +1,112 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMD4Sum(t *testing.T) {
+	// the test suite of rfc 1320
+	cases := map[string]string{
+		"":    "31d6cfe0d16ae931b73c59d7e0c089c0",
+		"a":   "bde52cb31de33e46245e05fbdbd6fb24",
+		"abc": "a448017aaf21d8525fc10ae87aa6729d",
+		"12345678901234567890123456789012345678901234567890123456789012345678901234567890": "e33b4ddc9c38f2199c3e7b164fcc0536",
+	}
+	for value, expected := range cases {
+		digest := md4Sum([]byte(value))
+		assert.Equal(t, expected, hex.EncodeToString(digest[:]), "value: %q", value)
+	}
+}
+
+// newTestNTLMTargetInfo returns the target info of the ms-nlmp examples
+func newTestNTLMTargetInfo() []byte {
+	info := &bytes.Buffer{}
+	for _, x := range []struct {
+		id    uint16
+		value string
+	}{{2, "Domain"}, {1, "Server"}} {
+		binary.Write(info, binary.LittleEndian, x.id)
+		binary.Write(info, binary.LittleEndian, uint16(2*len(x.value)))
+		info.Write(encodeUTF16(x.value))
+	}
+	info.Write([]byte{0, 0, 0, 0})
+
+	return info.Bytes()
+}
+
+func TestNTLMv2Response(t *testing.T) {
+	// the ntlmv2 example of ms-nlmp 4.2.4
+	key := getNTLMv2ResponseKey("User", "Domain", "Password")
+	assert.Equal(t, "0c868a403bfd7a93a3001ef22ef02e3f", hex.EncodeToString(key))
+
+	serverChallenge, _ := hex.DecodeString("0123456789abcdef")
+	clientChallenge, _ := hex.DecodeString("aaaaaaaaaaaaaaaa")
+	challenge := &ntlmChallenge{
+		flags:      ntlmNegotiateFlags,
+		challenge:  serverChallenge,
+		targetInfo: newTestNTLMTargetInfo(),
+	}
+	response := getNTLMv2Response(key, serverChallenge, clientChallenge, make([]byte, 8), challenge.targetInfo)
+	assert.Equal(t, "68cd0ab851e51c96aabc927bebef6a1c", hex.EncodeToString(response[:16]))
+
+	message := newNTLMAuthenticateMessage(challenge, `Domain\User`, "Password", clientChallenge, time.Now())
+	assert.Equal(t, ntlmSignature, string(message[:8]))
+	assert.Equal(t, uint32(3), binary.LittleEndian.Uint32(message[8:]))
+
+	field := func(i int) []byte {
+		length := binary.LittleEndian.Uint16(message[12+i*8:])
+		offset := binary.LittleEndian.Uint32(message[16+i*8:])
+		return message[offset : offset+uint32(length)]
+	}
+	assert.Equal(t, "86c35097ac9cec102554764a57cccc19aaaaaaaaaaaaaaaa", hex.EncodeToString(field(0)))
+	assert.Equal(t, response[16:24], field(1)[16:24])
+	assert.Equal(t, clientChallenge, field(1)[32:40])
+	assert.Equal(t, encodeUTF16("Domain"), field(2))
+	assert.Equal(t, encodeUTF16("User"), field(3))
+}
+
+func TestParseNTLMChallengeMessage(t *testing.T) {
+	info := newTestNTLMTargetInfo()
+	message := make([]byte, 48)
+	copy(message, ntlmSignature)
+	binary.LittleEndian.PutUint32(message[8:], 2)
+	binary.LittleEndian.PutUint32(message[20:], ntlmNegotiateFlags)
+	copy(message[24:], []byte{1, 2, 3, 4, 5, 6, 7, 8})
+	binary.LittleEndian.PutUint16(message[40:], uint16(len(info)))
+	binary.LittleEndian.PutUint32(message[44:], 48)
+	message = append(message, info...)
+
+	challenge, err := parseNTLMChallengeMessage(message)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	assert.Equal(t, []byte{1, 2, 3, 4, 5, 6, 7, 8}, challenge.challenge)
+	assert.Equal(t, info, challenge.targetInfo)
+	assert.Nil(t, getNTLMTargetTimestamp(challenge.targetInfo))
+
+	_, err = parseNTLMChallengeMessage(message[:40])
+	assert.Error(t, err)
+	_, err = parseNTLMChallengeMessage(newNTLMNegotiateMessage())
+	assert.Error(t, err)
+}
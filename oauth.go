@@ -16,6 +16,7 @@ limitations under the License.
 package main
 
 import (
+	"fmt"
 	"strings"
 	"time"
 
@@ -29,15 +30,24 @@ import (
 //
 func verifyToken(client *oidc.Client, token jose.JWT) error {
 	// step: verify the token is whom they say they are
-	if err := client.VerifyJWT(token); err != nil {
-		if strings.Contains(err.Error(), "token is expired") {
-			return ErrAccessTokenExpired
-		}
+	return getVerificationError(client.VerifyJWT(token))
+}
 
-		return err
+//
+// getVerificationError maps the error of the verification of a token
+//
+func getVerificationError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if strings.Contains(err.Error(), "token is expired") {
+		return ErrAccessTokenExpired
+	}
+	if strings.Contains(err.Error(), "invalid claim value: 'iss'") {
+		return fmt.Errorf("%s, if the users reach keycloak by a different url set the issuer-url", err)
 	}
 
-	return nil
+	return err
 }
 
 //
@@ -17,13 +17,16 @@ package main
 
 import (
 	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/x509"
+	"encoding/base64"
 	"encoding/pem"
 	"fmt"
 	"math/rand"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strings"
 	"sync"
 	"time"
 
@@ -44,6 +47,22 @@ type fakeOAuthServer struct {
 	signer jose.Signer
 	// the claims
 	claims jose.Claims
+	// the pkce code challenges, keyed by the code
+	challenges map[string]string
+	// the nonces of the logins, keyed by the code
+	nonces map[string]string
+	// the active opaque tokens
+	opaque map[string]bool
+	// the number of introspections
+	introspections int
+	// the device codes, approved or not
+	devices map[string]bool
+	// the number of token exchanges
+	exchanges int
+	// the permissions granted by the authorization services
+	permissions []umaPermission
+	// the number of permission requests
+	evaluations int
 }
 
 const fakePrivateKey = `
@@ -125,6 +144,10 @@ func newFakeOAuthServer() *fakeOAuthServer {
 			"given_name":         "Rohith",
 		},
 		privateKey: privateKey,
+		challenges: make(map[string]string),
+		nonces:     make(map[string]string),
+		opaque:     make(map[string]bool),
+		devices:    make(map[string]bool),
 		key: jose.JWK{
 			ID:       "test-kid",
 			Type:     "RSA",
@@ -143,7 +166,9 @@ func newFakeOAuthServer() *fakeOAuthServer {
 	r.GET("auth/realms/hod-test/protocol/openid-connect/certs", service.keysHandler)
 	r.GET("auth/realms/hod-test/protocol/openid-connect/token", service.tokenHandler)
 	r.POST("auth/realms/hod-test/protocol/openid-connect/token", service.tokenHandler)
+	r.POST("auth/realms/hod-test/protocol/openid-connect/token/introspect", service.introspectHandler)
 	r.GET("auth/realms/hod-test/protocol/openid-connect/auth", service.authHandler)
+	r.POST("auth/realms/hod-test/protocol/openid-connect/auth/device", service.deviceHandler)
 
 	location, err := url.Parse(httptest.NewServer(r).URL)
 	if err != nil {
@@ -205,7 +230,18 @@ func (r *fakeOAuthServer) authHandler(cx *gin.Context) {
 		state = "/"
 	}
 	// step: generate a random authentication code
-	redirectionURL := fmt.Sprintf("%s?state=%s&code=%s", redirect, state, getRandomString(32))
+	code := getRandomString(32)
+	if challenge := cx.Query("code_challenge"); challenge != "" {
+		r.Lock()
+		r.challenges[code] = challenge
+		r.Unlock()
+	}
+	if nonce := cx.Query("nonce"); nonce != "" {
+		r.Lock()
+		r.nonces[code] = nonce
+		r.Unlock()
+	}
+	redirectionURL := fmt.Sprintf("%s?state=%s&code=%s", redirect, url.QueryEscape(state), code)
 
 	cx.Redirect(http.StatusTemporaryRedirect, redirectionURL)
 }
@@ -234,18 +270,184 @@ func (r *fakeOAuthServer) tokenHandler(cx *gin.Context) {
 			ExpiresIn:    expiration.Second(),
 		})
 	case oauth2.GrantTypeAuthCode:
+		// step: verify the code verifier if the authorization had a challenge
+		r.Lock()
+		challenge, found := r.challenges[cx.PostForm("code")]
+		nonce := r.nonces[cx.PostForm("code")]
+		claims := jose.Claims{}
+		for k, v := range r.claims {
+			claims[k] = v
+		}
+		r.Unlock()
+		if hash := sha256.Sum256([]byte(cx.PostForm("code_verifier"))); found && base64.RawURLEncoding.EncodeToString(hash[:]) != challenge {
+			cx.JSON(http.StatusBadRequest, gin.H{"error": "invalid_grant", "error_description": "PKCE verification failed"})
+			return
+		}
+		// step: echo the nonce of the authorization in the identity token
+		idToken := token
+		if nonce != "" {
+			claims["nonce"] = nonce
+			if idToken, err = jose.NewSignedJWT(claims, r.signer); err != nil {
+				cx.AbortWithError(http.StatusInternalServerError, err)
+				return
+			}
+		}
 		cx.JSON(http.StatusOK, tokenResponse{
-			IDToken:      token.Encode(),
+			IDToken:      idToken.Encode(),
 			AccessToken:  token.Encode(),
 			RefreshToken: token.Encode(),
 			ExpiresIn:    expiration.Second(),
 		})
+	case deviceCodeGrantType:
+		r.Lock()
+		approved, found := r.devices[cx.PostForm("device_code")]
+		r.Unlock()
+		if !found {
+			cx.JSON(http.StatusBadRequest, gin.H{"error": "invalid_grant"})
+			return
+		}
+		if !approved {
+			cx.JSON(http.StatusBadRequest, gin.H{"error": "authorization_pending"})
+			return
+		}
+		cx.JSON(http.StatusOK, tokenResponse{
+			IDToken:     token.Encode(),
+			AccessToken: token.Encode(),
+			ExpiresIn:   expiration.Second(),
+		})
+	case oauth2.GrantTypeClientCreds:
+		clientID, clientSecret, _ := cx.Request.BasicAuth()
+		if clientID != fakeClientID || clientSecret != fakeSecret {
+			cx.JSON(http.StatusUnauthorized, gin.H{"error": "invalid_client"})
+			return
+		}
+		cx.JSON(http.StatusOK, tokenResponse{
+			AccessToken: token.Encode(),
+			ExpiresIn:   expiration.Second(),
+		})
+	case tokenExchangeGrantType:
+		clientID, clientSecret, _ := cx.Request.BasicAuth()
+		if clientID != fakeClientID || clientSecret != fakeSecret {
+			cx.JSON(http.StatusUnauthorized, gin.H{"error": "invalid_client"})
+			return
+		}
+		if cx.PostForm("subject_token") == "" || cx.PostForm("audience") == "refused" {
+			cx.JSON(http.StatusForbidden, gin.H{"error": "access_denied"})
+			return
+		}
+		r.Lock()
+		r.exchanges++
+		claims := jose.Claims{}
+		for k, v := range r.claims {
+			claims[k] = v
+		}
+		r.Unlock()
+		claims["aud"] = cx.PostForm("audience")
+		exchanged, err := jose.NewSignedJWT(claims, r.signer)
+		if err != nil {
+			cx.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+		cx.JSON(http.StatusOK, tokenResponse{
+			AccessToken: exchanged.Encode(),
+			ExpiresIn:   300,
+		})
+	case umaTicketGrantType:
+		if !strings.HasPrefix(cx.Request.Header.Get(authorizationHeader), "Bearer ") {
+			cx.JSON(http.StatusUnauthorized, gin.H{"error": "invalid_request"})
+			return
+		}
+		if cx.PostForm("response_mode") != "permissions" {
+			cx.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+		r.Lock()
+		r.evaluations++
+		permissions := r.permissions
+		r.Unlock()
+		if cx.PostForm("audience") == "unavailable" {
+			cx.JSON(http.StatusInternalServerError, gin.H{"error": "unknown_error"})
+			return
+		}
+		if len(permissions) <= 0 {
+			cx.JSON(http.StatusForbidden, gin.H{"error": "access_denied", "error_description": "not_authorized"})
+			return
+		}
+		cx.JSON(http.StatusOK, permissions)
 	default:
 		fmt.Println("dsdsd")
 		cx.AbortWithStatus(http.StatusBadRequest)
 	}
 }
 
+func (r *fakeOAuthServer) introspectHandler(cx *gin.Context) {
+	clientID, clientSecret, _ := cx.Request.BasicAuth()
+	if clientID != fakeClientID || clientSecret != fakeSecret {
+		cx.JSON(http.StatusUnauthorized, gin.H{"error": "invalid_client"})
+		return
+	}
+	r.Lock()
+	defer r.Unlock()
+	r.introspections++
+	if !r.opaque[cx.PostForm("token")] {
+		cx.JSON(http.StatusOK, gin.H{"active": false})
+		return
+	}
+	response := gin.H{"active": true}
+	for k, v := range r.claims {
+		response[k] = v
+	}
+	cx.JSON(http.StatusOK, response)
+}
+
+func (r *fakeOAuthServer) deviceHandler(cx *gin.Context) {
+	if cx.PostForm("client_id") != fakeClientID {
+		cx.JSON(http.StatusUnauthorized, gin.H{"error": "invalid_client"})
+		return
+	}
+	code := getRandomString(32)
+	r.Lock()
+	r.devices[code] = false
+	r.Unlock()
+	cx.JSON(http.StatusOK, gin.H{
+		"device_code":      code,
+		"user_code":        "QWER-ASDF",
+		"verification_uri": r.getLocation() + "/device",
+		"expires_in":       600,
+		"interval":         5,
+	})
+}
+
+func (r *fakeOAuthServer) approveDevice(code string) {
+	r.Lock()
+	defer r.Unlock()
+	r.devices[code] = true
+}
+
+func (r *fakeOAuthServer) getIntrospections() int {
+	r.Lock()
+	defer r.Unlock()
+	return r.introspections
+}
+
+func (r *fakeOAuthServer) getExchanges() int {
+	r.Lock()
+	defer r.Unlock()
+	return r.exchanges
+}
+
+func (r *fakeOAuthServer) setPermissions(permissions []umaPermission) {
+	r.Lock()
+	defer r.Unlock()
+	r.permissions = permissions
+}
+
+func (r *fakeOAuthServer) getEvaluations() int {
+	r.Lock()
+	defer r.Unlock()
+	return r.evaluations
+}
+
 func getRandomString(n int) string {
 	b := make([]rune, n)
 	for i := range b {
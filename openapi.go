@@ -0,0 +1,226 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// openAPISecurity is a list of alternative security requirements, each a set of schemes and the scopes required
+type openAPISecurity []map[string][]string
+
+//
+// openAPIOperation is the part of an operation protection is generated from
+//
+type openAPIOperation struct {
+	// the identifier of the operation
+	OperationID string `yaml:"operationId"`
+	// the security requirements of the operation, overriding those of the spec
+	Security *openAPISecurity `yaml:"security"`
+	// the roles required, overriding those generated from the security requirements
+	Roles []string `yaml:"x-keycloak-roles"`
+}
+
+//
+// openAPIPathItem are the operations of a path
+//
+type openAPIPathItem struct {
+	Get     *openAPIOperation `yaml:"get"`
+	Put     *openAPIOperation `yaml:"put"`
+	Post    *openAPIOperation `yaml:"post"`
+	Delete  *openAPIOperation `yaml:"delete"`
+	Options *openAPIOperation `yaml:"options"`
+	Head    *openAPIOperation `yaml:"head"`
+	Patch   *openAPIOperation `yaml:"patch"`
+	Trace   *openAPIOperation `yaml:"trace"`
+}
+
+//
+// openAPISpec is the part of a openapi 3 or swagger 2 spec protection is generated from
+//
+type openAPISpec struct {
+	// the base path of a swagger 2 spec
+	BasePath string `yaml:"basePath"`
+	// the servers of a openapi 3 spec
+	Servers []struct {
+		URL string `yaml:"url"`
+	} `yaml:"servers"`
+	// the default security requirements of the operations
+	Security openAPISecurity `yaml:"security"`
+	// the operations by path
+	Paths map[string]openAPIPathItem `yaml:"paths"`
+}
+
+//
+// getOperations returns the operations of the path item
+//
+func (r openAPIPathItem) getOperations() []*openAPIOperation {
+	var list []*openAPIOperation
+	for _, x := range []*openAPIOperation{r.Get, r.Put, r.Post, r.Delete, r.Options, r.Head, r.Patch, r.Trace} {
+		if x != nil {
+			list = append(list, x)
+		}
+	}
+
+	return list
+}
+
+//
+// getBasePath returns the path the operations are served under
+//
+func (r *openAPISpec) getBasePath() string {
+	base := r.BasePath
+	if len(r.Servers) > 0 {
+		if u, err := url.Parse(r.Servers[0].URL); err == nil {
+			base = u.Path
+		}
+	}
+
+	return strings.TrimSuffix(base, "/")
+}
+
+//
+// getRoles returns the roles required by the operation and whether the operation permits anonymous access
+//
+func (r *openAPISpec) getRoles(path string, operation *openAPIOperation) ([]string, bool, error) {
+	if operation.Roles != nil {
+		return operation.Roles, false, nil
+	}
+	security := r.Security
+	if operation.Security != nil {
+		security = *operation.Security
+	}
+	// step: an empty requirement, or none at all, permits anonymous access
+	if len(security) <= 0 {
+		return nil, true, nil
+	}
+	for _, x := range security {
+		if len(x) <= 0 {
+			return nil, true, nil
+		}
+	}
+	// note: the resources can't express alternatives, so an override is required rather than guessing at one
+	if len(security) > 1 {
+		return nil, false, fmt.Errorf("the operations of %s have alternative security requirements, add a x-keycloak-roles override", path)
+	}
+	var roles []string
+	for _, scopes := range security[0] {
+		for _, x := range scopes {
+			if !containedIn(x, roles) {
+				roles = append(roles, x)
+			}
+		}
+	}
+
+	return roles, false, nil
+}
+
+//
+// loadOpenAPIResources reads the openapi spec and generates the resources protecting the operations
+//
+func loadOpenAPIResources(filename string) ([]*Resource, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	spec := &openAPISpec{}
+	if err := yaml.Unmarshal(content, spec); err != nil {
+		return nil, err
+	}
+
+	return spec.getResources()
+}
+
+//
+// getResources generates the resources protecting the operations of the spec; as the resources are matched by
+// prefix, a path is protected up to its first parameter and the operations sharing a prefix are merged, requiring
+// all of their roles, while the longer prefixes are placed first so they are matched first
+//
+func (r *openAPISpec) getResources() ([]*Resource, error) {
+	base := r.getBasePath()
+	resources := make(map[string]*Resource)
+	anonymous := make(map[string]bool)
+	operations := make(map[string]int)
+	for path, item := range r.Paths {
+		if len(item.getOperations()) <= 0 {
+			continue
+		}
+		prefix := base + path
+		if i := strings.Index(prefix, "{"); i >= 0 {
+			prefix = prefix[:i]
+		}
+		if prefix == "" {
+			prefix = "/"
+		}
+		resource, found := resources[prefix]
+		if !found {
+			resource = &Resource{URL: prefix, Methods: []string{"ANY"}, Roles: []string{}}
+			resources[prefix] = resource
+			anonymous[prefix] = true
+		}
+		for _, operation := range item.getOperations() {
+			roles, public, err := r.getRoles(path, operation)
+			if err != nil {
+				return nil, err
+			}
+			if !public {
+				anonymous[prefix] = false
+			}
+			for _, x := range roles {
+				if !containedIn(x, resource.Roles) {
+					resource.Roles = append(resource.Roles, x)
+				}
+			}
+			resource.Name = operation.OperationID
+			operations[prefix]++
+		}
+	}
+
+	var list []*Resource
+	for prefix, resource := range resources {
+		// step: the name of a merged resource would be misleading
+		if operations[prefix] != 1 {
+			resource.Name = ""
+		}
+		resource.WhiteListed = anonymous[prefix]
+		if resource.WhiteListed {
+			resource.Roles = []string{}
+		}
+		sort.Strings(resource.Roles)
+		list = append(list, resource)
+	}
+	sort.Sort(resourcesByURL(list))
+
+	return list, nil
+}
+
+// resourcesByURL sorts the resources by the length of the url, the most specific first, then the url
+type resourcesByURL []*Resource
+
+func (s resourcesByURL) Len() int      { return len(s) }
+func (s resourcesByURL) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s resourcesByURL) Less(i, j int) bool {
+	if len(s[i].URL) != len(s[j].URL) {
+		return len(s[i].URL) > len(s[j].URL)
+	}
+	return s[i].URL < s[j].URL
+}
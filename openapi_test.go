@@ -0,0 +1,100 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const fakeOpenAPISpec = `
+openapi: 3.0.0
+servers:
+- url: https://api.example.com/v1/
+security:
+- oauth2: ["api:read"]
+paths:
+  /health:
+    get:
+      operationId: health
+      security: []
+  /pets:
+    parameters: []
+    get:
+      operationId: listPets
+    post:
+      operationId: createPet
+      security:
+      - oauth2: ["pets:write"]
+  /pets/{id}:
+    delete:
+      operationId: deletePet
+      security:
+      - oauth2: ["pets:write", "pets:admin"]
+  /pets/{id}/photos:
+    get:
+      operationId: listPhotos
+      x-keycloak-roles: ["photos:read"]
+  /stores:
+    get:
+      operationId: listStores
+      security:
+      - {}
+      - oauth2: ["stores:read"]
+`
+
+func TestLoadOpenAPIResources(t *testing.T) {
+	file, err := ioutil.TempFile("", "openapi")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer os.Remove(file.Name())
+	file.WriteString(fakeOpenAPISpec)
+	file.Close()
+
+	resources, err := loadOpenAPIResources(file.Name())
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	expected := []*Resource{
+		{URL: "/v1/health", Name: "health", Methods: []string{"ANY"}, Roles: []string{}, WhiteListed: true},
+		{URL: "/v1/stores", Name: "listStores", Methods: []string{"ANY"}, Roles: []string{}, WhiteListed: true},
+		{URL: "/v1/pets/", Methods: []string{"ANY"}, Roles: []string{"pets:admin", "pets:write", "photos:read"}},
+		{URL: "/v1/pets", Methods: []string{"ANY"}, Roles: []string{"api:read", "pets:write"}},
+	}
+	assert.Equal(t, expected, resources)
+
+	_, err = loadOpenAPIResources("/does/not/exist")
+	assert.Error(t, err)
+}
+
+func TestOpenAPIAlternativeSecurity(t *testing.T) {
+	spec := &openAPISpec{
+		Paths: map[string]openAPIPathItem{
+			"/orders": {Get: &openAPIOperation{Security: &openAPISecurity{{"oauth2": {"a"}}, {"apiKey": {}}}}},
+		},
+	}
+	_, err := spec.getResources()
+	assert.Error(t, err)
+
+	spec.Paths["/orders"].Get.Roles = []string{"orders"}
+	resources, err := spec.getResources()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"orders"}, resources[0].Roles)
+}
@@ -0,0 +1,185 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-oidc/oauth2"
+	"github.com/coreos/go-oidc/oidc"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// pkceChallengeMethod is the code challenge method, the plain method isn't offered
+	pkceChallengeMethod = "S256"
+	// pkceCookieDuration is the time the user has to complete the login before the verifier cookie expires
+	pkceCookieDuration = time.Duration(30) * time.Minute
+)
+
+// errPKCEVerifierMissing indicates the code verifier of the login couldn't be found
+var errPKCEVerifierMissing = errors.New("the pkce code verifier of the login is missing or invalid")
+
+//
+// pkce performs the authorization code exchange with a proof key (rfc 7636), which the oauth2 client can't
+//
+type pkce struct {
+	// the client used to reach the provider
+	client *http.Client
+}
+
+//
+// newPKCE creates the proof key exchange
+//
+func newPKCE(client *http.Client) *pkce {
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	return &pkce{client: client}
+}
+
+//
+// newPKCEVerifier generates a random code verifier, 43 characters of base64url
+//
+func newPKCEVerifier() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+//
+// getPKCEChallenge returns the S256 code challenge of the verifier
+//
+func getPKCEChallenge(verifier string) string {
+	hash := sha256.Sum256([]byte(verifier))
+
+	return base64.RawURLEncoding.EncodeToString(hash[:])
+}
+
+//
+// setPKCEVerifier creates the code verifier for the login, dropping it in a encrypted cookie, and returns the
+// authorization url with the challenge; the verifier is always random and held by the browser, even with the signed
+// state, as one derived from the state could be rebuilt from the callback url, so wouldn't bind the code to the browser
+//
+func (r *oauthProxy) setPKCEVerifier(cx *gin.Context, authURL string) (string, error) {
+	verifier, err := newPKCEVerifier()
+	if err != nil {
+		return "", err
+	}
+	encrypted, err := encodeText(verifier, r.config.EncryptionKey)
+	if err != nil {
+		return "", err
+	}
+	r.dropCookie(cx, r.config.CookiePKCEName, encrypted, pkceCookieDuration)
+
+	return authURL + "&" + url.Values{
+		"code_challenge":        {getPKCEChallenge(verifier)},
+		"code_challenge_method": {pkceChallengeMethod},
+	}.Encode(), nil
+}
+
+//
+// getPKCEVerifier retrieves the code verifier of the login on the callback, clearing the cookie
+//
+func (r *oauthProxy) getPKCEVerifier(cx *gin.Context) (string, error) {
+	cookie, err := cx.Request.Cookie(r.config.CookiePKCEName)
+	if err != nil {
+		return "", errPKCEVerifierMissing
+	}
+	r.dropCookie(cx, r.config.CookiePKCEName, "", time.Duration(-10*time.Hour))
+	verifier, err := decodeText(cookie.Value, r.config.EncryptionKey)
+	if err != nil {
+		return "", errPKCEVerifierMissing
+	}
+
+	return verifier, nil
+}
+
+//
+// exchange exchanges the authorization code with the provider for the tokens, proving the code verifier; the redirect
+// uri must match that of the authorization, so is taken from the client
+//
+func (r *pkce) exchange(client *oidc.Client, tokenURL, clientID, clientSecret, code, verifier string) (oauth2.TokenResponse, error) {
+	oauth, err := client.OAuthClient()
+	if err != nil {
+		return oauth2.TokenResponse{}, err
+	}
+	authURL, err := url.Parse(oauth.AuthCodeURL("", "", ""))
+	if err != nil {
+		return oauth2.TokenResponse{}, err
+	}
+	values := url.Values{
+		"grant_type":    {oauth2.GrantTypeAuthCode},
+		"code":          {code},
+		"redirect_uri":  {authURL.Query().Get("redirect_uri")},
+		"client_id":     {clientID},
+		"code_verifier": {verifier},
+	}
+	req, err := http.NewRequest(http.MethodPost, tokenURL, strings.NewReader(values.Encode()))
+	if err != nil {
+		return oauth2.TokenResponse{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if clientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(clientID), url.QueryEscape(clientSecret))
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return oauth2.TokenResponse{}, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return oauth2.TokenResponse{}, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		failure := &oauth2.Error{}
+		if err := json.Unmarshal(body, failure); err != nil || failure.Type == "" {
+			return oauth2.TokenResponse{}, fmt.Errorf("unexpected response from the token endpoint, status: %d", resp.StatusCode)
+		}
+		return oauth2.TokenResponse{}, failure
+	}
+	var token tokenResponse
+	if err := json.Unmarshal(body, &token); err != nil {
+		return oauth2.TokenResponse{}, err
+	}
+
+	return oauth2.TokenResponse{
+		AccessToken:  token.AccessToken,
+		TokenType:    token.TokenType,
+		Expires:      token.ExpiresIn,
+		IDToken:      token.IDToken,
+		RefreshToken: token.RefreshToken,
+		Scope:        token.Scope,
+		RawBody:      body,
+	}, nil
+}
@@ -0,0 +1,144 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPKCEVerifier(t *testing.T) {
+	verifier, err := newPKCEVerifier()
+	assert.NoError(t, err)
+	assert.Len(t, verifier, 43)
+	another, _ := newPKCEVerifier()
+	assert.NotEqual(t, verifier, another)
+
+	assert.Len(t, getPKCEChallenge(verifier), 43)
+	assert.NotEqual(t, getPKCEChallenge(verifier), getPKCEChallenge(another))
+}
+
+func TestPKCELogin(t *testing.T) {
+	for i, signed := range []bool{false, true} {
+		config := newFakeKeycloakConfig()
+		config.EnablePKCE = true
+		config.CookiePKCEName = "kc-pkce"
+		config.EnableSignedState = signed
+		config.SignedStateDuration = time.Minute
+		_, _, u := newTestProxyService(config)
+
+		req, _ := http.NewRequest("GET", u+oauthURL+authorizationURL, nil)
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if !assert.NoError(t, err, "case %d, unable to call the authorization handler", i) {
+			continue
+		}
+		location, _ := url.Parse(resp.Header.Get("Location"))
+		assert.NotEmpty(t, location.Query().Get("code_challenge"), "case %d, no code challenge", i)
+		assert.Equal(t, pkceChallengeMethod, location.Query().Get("code_challenge_method"), "case %d", i)
+		// step: the verifier is held by the browser, with or without the signed state
+		cookies := resp.Cookies()
+		assert.NotNil(t, findCookie(config.CookiePKCEName, cookies), "case %d, no verifier cookie", i)
+
+		req, _ = http.NewRequest("GET", location.String(), nil)
+		resp, err = http.DefaultTransport.RoundTrip(req)
+		if !assert.NoError(t, err, "case %d, unable to call the provider", i) {
+			continue
+		}
+		callbackURL := resp.Header.Get("Location")
+
+		// step: the callback with the verifier is permitted
+		req, _ = http.NewRequest("GET", callbackURL, nil)
+		for _, x := range cookies {
+			req.AddCookie(x)
+		}
+		resp, err = http.DefaultTransport.RoundTrip(req)
+		if assert.NoError(t, err, "case %d, unable to call the callback", i) {
+			assert.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode, "case %d, unexpected status", i)
+			assert.NotNil(t, findCookie(config.CookieAccessName, resp.Cookies()), "case %d, no session", i)
+		}
+	}
+}
+
+func TestPKCESignedStateCallbackRefused(t *testing.T) {
+	config := newFakeKeycloakConfig()
+	config.EnablePKCE = true
+	config.CookiePKCEName = "kc-pkce"
+	config.EnableSignedState = true
+	config.SignedStateDuration = time.Minute
+	_, _, u := newTestProxyService(config)
+
+	req, _ := http.NewRequest("GET", u+oauthURL+authorizationURL, nil)
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	req, _ = http.NewRequest("GET", resp.Header.Get("Location"), nil)
+	resp, err = http.DefaultTransport.RoundTrip(req)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	// step: the code and signed state replayed from another browser, without the verifier, is refused
+	req, _ = http.NewRequest("GET", resp.Header.Get("Location"), nil)
+	resp, err = http.DefaultTransport.RoundTrip(req)
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	}
+}
+
+func TestPKCECallbackRefused(t *testing.T) {
+	config := newFakeKeycloakConfig()
+	config.EnablePKCE = true
+	config.CookiePKCEName = "kc-pkce"
+	_, _, u := newTestProxyService(config)
+
+	// step: a callback without the verifier cookie
+	resp, err := http.Get(u + config.getCallbackPath() + "?code=abc&state=L2FkbWlu")
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	}
+
+	// step: a callback with the verifier of another login is refused by the provider
+	var callbacks []string
+	var cookies []*http.Cookie
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequest("GET", u+oauthURL+authorizationURL, nil)
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		cookies = append(cookies, findCookie(config.CookiePKCEName, resp.Cookies()))
+		req, _ = http.NewRequest("GET", resp.Header.Get("Location"), nil)
+		resp, err = http.DefaultTransport.RoundTrip(req)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		callbacks = append(callbacks, resp.Header.Get("Location"))
+	}
+	req, _ := http.NewRequest("GET", callbacks[0], nil)
+	req.AddCookie(cookies[1])
+	resp, err = http.DefaultTransport.RoundTrip(req)
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	}
+}
@@ -0,0 +1,211 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/coreos/go-oidc/oidc"
+	"github.com/gin-gonic/gin"
+)
+
+//
+// isValid validates the provider
+//
+func (r *Provider) isValid() error {
+	if r.DiscoveryURL == "" {
+		return errors.New("the provider has no discovery url")
+	}
+	if r.ClientID == "" {
+		return fmt.Errorf("the provider: %s has no client id", r.getName())
+	}
+	if len(r.Hostnames) <= 0 && len(r.PathPrefixes) <= 0 {
+		return fmt.Errorf("the provider: %s has no hostnames or path prefixes to be selected by", r.getName())
+	}
+	for _, x := range r.Hostnames {
+		if x == "" || (strings.Contains(x, "*") && !strings.HasPrefix(x, "*.")) || strings.Count(x, "*") > 1 {
+			return fmt.Errorf("the provider: %s hostname: '%s' is invalid, a wildcard must be the first label", r.getName(), x)
+		}
+	}
+	for _, x := range r.PathPrefixes {
+		if !strings.HasPrefix(x, "/") || strings.HasPrefix(x, oauthURL) {
+			return fmt.Errorf("the provider: %s path prefix: '%s' must start with a / and not be under %s", r.getName(), x, oauthURL)
+		}
+	}
+
+	return nil
+}
+
+//
+// getName returns a name for the provider in the logs and errors
+//
+func (r *Provider) getName() string {
+	if r.Name != "" {
+		return r.Name
+	}
+
+	return r.DiscoveryURL
+}
+
+//
+// isSelected checks the provider is selected for the host and path, both the hostnames and path prefixes must match
+// when set
+//
+func (r *Provider) isSelected(host, path string) bool {
+	if len(r.Hostnames) > 0 {
+		matched := false
+		for _, x := range r.Hostnames {
+			if matchesHostname(x, host) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	if len(r.PathPrefixes) > 0 {
+		for _, x := range r.PathPrefixes {
+			if strings.HasPrefix(path, x) {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	return true
+}
+
+//
+// createProviders creates the clients of the additional providers, adding them to the trusted issuers so their
+// tokens are verified and refreshed against them
+//
+func createProviders(cfg *Config, httpClient *http.Client, issuers map[string]*oidc.Client) error {
+	for _, x := range cfg.Providers {
+		// step: the provider inherits everything but the realm and client
+		config := *cfg
+		config.DiscoveryURL = x.DiscoveryURL
+		config.ClientID = x.ClientID
+		config.ClientSecret = x.ClientSecret
+		config.IssuerURL = ""
+		config.ExternalDiscoveryURL = ""
+		if len(x.Scopes) > 0 {
+			config.Scopes = x.Scopes
+		}
+		if x.RedirectionURL != "" {
+			config.RedirectionURL = strings.TrimSuffix(x.RedirectionURL, "/")
+		}
+
+		client, provider, err := createOpenIDClient(&config, httpClient)
+		if err != nil {
+			return fmt.Errorf("unable to create the client for the provider: %s, error: %s", x.getName(), err)
+		}
+		if cfg.EnablePKCE && provider.TokenEndpoint == nil {
+			return fmt.Errorf("the provider: %s has no token endpoint for the pkce code exchange", x.getName())
+		}
+		issuer := strings.TrimSuffix(provider.Issuer.String(), "/")
+		if _, found := issuers[issuer]; found {
+			return fmt.Errorf("the provider: %s has a duplicate issuer: %s", x.getName(), issuer)
+		}
+		log.WithFields(log.Fields{
+			"provider":      x.getName(),
+			"issuer":        issuer,
+			"hostnames":     strings.Join(x.Hostnames, ","),
+			"path_prefixes": strings.Join(x.PathPrefixes, ","),
+		}).Infof("fronting the applications of the provider")
+
+		x.client = client
+		x.provider = provider
+		issuers[issuer] = client
+	}
+
+	return nil
+}
+
+//
+// getRequestProvider returns the first provider selected by the request, if any; the oauth handlers are selected
+// by the url the login started from, as carried in the state
+//
+func (r *oauthProxy) getRequestProvider(cx *gin.Context) *Provider {
+	if len(r.config.Providers) <= 0 {
+		return nil
+	}
+	path := cx.Request.URL.Path
+	if strings.HasPrefix(path, oauthURL) {
+		path = r.getStatePath(cx.Request.URL.Query().Get("state"))
+	}
+	for _, x := range r.config.Providers {
+		if x.isSelected(cx.Request.Host, path) {
+			return x
+		}
+	}
+
+	return nil
+}
+
+//
+// getIssuingProvider returns the additional provider which issued the token of the user, if any
+//
+func (r *oauthProxy) getIssuingProvider(user *userContext) *Provider {
+	if len(r.config.Providers) <= 0 {
+		return nil
+	}
+	issuer, found, err := user.claims.StringClaim("iss")
+	if err != nil || !found {
+		return nil
+	}
+	for _, x := range r.config.Providers {
+		if x.provider.Issuer != nil && strings.TrimSuffix(x.provider.Issuer.String(), "/") == strings.TrimSuffix(issuer, "/") {
+			return x
+		}
+	}
+
+	return nil
+}
+
+//
+// getStatePath returns the path of the url carried in the state, defaulting to the root
+//
+func (r *oauthProxy) getStatePath(state string) string {
+	var redirect string
+	if r.config.EnableSignedState {
+		decoded, err := decodeSignedState([]byte(r.config.EncryptionKey), state, time.Now())
+		if err != nil {
+			return "/"
+		}
+		redirect = decoded
+	} else {
+		decoded, err := base64.StdEncoding.DecodeString(state)
+		if err != nil {
+			return "/"
+		}
+		redirect = string(decoded)
+	}
+	location, err := url.Parse(redirect)
+	if err != nil || location.Path == "" {
+		return "/"
+	}
+
+	return location.Path
+}
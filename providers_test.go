@@ -0,0 +1,150 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/coreos/go-oidc/jose"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProviderIsSelected(t *testing.T) {
+	tests := []struct {
+		Provider Provider
+		Host     string
+		Path     string
+		Selected bool
+	}{
+		{Provider: Provider{Hostnames: []string{"*.example.com"}}, Host: "app.example.com:443", Path: "/", Selected: true},
+		{Provider: Provider{Hostnames: []string{"*.example.com"}}, Host: "example.org", Path: "/"},
+		{Provider: Provider{PathPrefixes: []string{"/realm"}}, Host: "example.org", Path: "/realm/page", Selected: true},
+		{Provider: Provider{PathPrefixes: []string{"/realm"}}, Host: "example.org", Path: "/other"},
+		{Provider: Provider{Hostnames: []string{"a.example.com"}, PathPrefixes: []string{"/realm"}}, Host: "a.example.com", Path: "/realm", Selected: true},
+		{Provider: Provider{Hostnames: []string{"a.example.com"}, PathPrefixes: []string{"/realm"}}, Host: "b.example.com", Path: "/realm"},
+	}
+	for i, c := range tests {
+		assert.Equal(t, c.Selected, c.Provider.isSelected(c.Host, c.Path), "case %d", i)
+	}
+}
+
+func TestProviders(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	defer upstream.Close()
+
+	hosted, prefixed := newFakeOAuthServer(), newFakeOAuthServer()
+	hosted.claims["aud"] = "hosted"
+	prefixed.claims["aud"] = "prefixed"
+	config := newFakeKeycloakConfig()
+	config.Upstream = upstream.URL
+	config.Resources = append(config.Resources, &Resource{URL: "/realm", Methods: []string{"ANY"}, Roles: []string{}})
+	config.Providers = []*Provider{
+		{
+			DiscoveryURL: hosted.getLocation(),
+			ClientID:     "hosted",
+			ClientSecret: fakeSecret,
+			Hostnames:    []string{"other.example.com"},
+		},
+		{
+			DiscoveryURL: prefixed.getLocation(),
+			ClientID:     "prefixed",
+			ClientSecret: fakeSecret,
+			PathPrefixes: []string{"/realm"},
+		},
+	}
+	p, auth, u := newTestProxyService(config)
+	if !assert.NoError(t, p.createUpstreamProxy(p.endpoint)) {
+		t.FailNow()
+	}
+
+	// step: the login is sent to the provider selected by the host, or the path in the state
+	tests := []struct {
+		Host     string
+		State    string
+		Provider string
+	}{
+		{Host: "example.com", Provider: auth.getLocation()},
+		{Host: "other.example.com", Provider: hosted.getLocation()},
+		{Host: "example.com", State: "/realm/page", Provider: prefixed.getLocation()},
+		{Host: "example.com", State: "/page", Provider: auth.getLocation()},
+	}
+	for i, c := range tests {
+		req := httptest.NewRequest(http.MethodGet, oauthURL+authorizationURL, nil)
+		req.Host = c.Host
+		if c.State != "" {
+			req.URL.RawQuery = "state=" + base64.StdEncoding.EncodeToString([]byte(c.State))
+		}
+		resp := httptest.NewRecorder()
+		p.router.ServeHTTP(resp, req)
+		assert.Equal(t, http.StatusTemporaryRedirect, resp.Code, "case %d", i)
+		assert.True(t, strings.HasPrefix(resp.Header().Get("Location"), c.Provider+"/"),
+			"case %d, expected provider: %s, location: %s", i, c.Provider, resp.Header().Get("Location"))
+	}
+
+	// step: the tokens of the providers are only accepted on the hosts and paths of the provider, for its client
+	cs := []struct {
+		Issuer   *fakeOAuthServer
+		Host     string
+		Path     string
+		Expected int
+	}{
+		{Issuer: auth, Path: fakeAuthAllURL, Expected: http.StatusOK},
+		{Issuer: hosted, Host: "other.example.com", Path: fakeAuthAllURL, Expected: http.StatusOK},
+		{Issuer: prefixed, Path: "/realm/page", Expected: http.StatusOK},
+		{Issuer: auth, Host: "other.example.com", Path: fakeAuthAllURL, Expected: http.StatusForbidden},
+		{Issuer: auth, Path: "/realm/page", Expected: http.StatusForbidden},
+		{Issuer: hosted, Path: fakeAuthAllURL, Expected: http.StatusForbidden},
+		{Issuer: hosted, Path: "/realm/page", Expected: http.StatusForbidden},
+		{Issuer: prefixed, Path: fakeAuthAllURL, Expected: http.StatusForbidden},
+		{Issuer: prefixed, Host: "other.example.com", Path: fakeAuthAllURL, Expected: http.StatusForbidden},
+	}
+	for i, c := range cs {
+		token, err := jose.NewSignedJWT(c.Issuer.claims, c.Issuer.signer)
+		if !assert.NoError(t, err) {
+			continue
+		}
+		req, _ := http.NewRequest(http.MethodGet, u+c.Path, nil)
+		if c.Host != "" {
+			req.Host = c.Host
+		}
+		req.Header.Set(authorizationHeader, "Bearer "+token.Encode())
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if !assert.NoError(t, err) {
+			continue
+		}
+		resp.Body.Close()
+		assert.Equal(t, c.Expected, resp.StatusCode, "case %d", i)
+	}
+
+	// step: the token of a provider must be issued to the client of the provider
+	hosted.claims["aud"] = fakeClientID
+	token, err := jose.NewSignedJWT(hosted.claims, hosted.signer)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	req, _ := http.NewRequest(http.MethodGet, u+fakeAuthAllURL, nil)
+	req.Host = "other.example.com"
+	req.Header.Set(authorizationHeader, "Bearer "+token.Encode())
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	}
+}
@@ -46,17 +46,8 @@ func newOauthProxyApp() *cli.App {
 
 	// step: set the default action
 	app.Action = func(cx *cli.Context) error {
-		configFile := cx.String("config")
-
-		// step: do we have a configuration file?
-		if configFile != "" {
-			if err := readConfigFile(configFile, config); err != nil {
-				return printError("unable to read the configuration file: %s, error: %s", configFile, err.Error())
-			}
-		}
-
-		// step: parse the command line options
-		if err := readOptions(cx, config); err != nil {
+		// step: read the configuration file and command line options
+		if err := parseConfig(cx, config); err != nil {
 			return printError(err.Error())
 		}
 
@@ -76,17 +67,98 @@ func newOauthProxyApp() *cli.App {
 			return printError(err.Error())
 		}
 
-		// step: setup the termination signals
-		signalChannel := make(chan os.Signal)
-		signal.Notify(signalChannel, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+		// step: are we dumping the diagnostics on a signal?
+		diagnostics, found := diagnosticsSignals[config.DiagnosticsSignal]
+		if found {
+			proxy.handleDiagnosticsSignal(diagnostics)
+		}
+
+		// step: are we reloading the configuration on a hangup?
+		var reload os.Signal
+		if config.EnableConfigReload {
+			reload = syscall.SIGHUP
+			newConfigReloader(proxy, func() (*Config, error) {
+				next := newDefaultConfig()
+				if err := parseConfig(cx, next); err != nil {
+					return nil, err
+				}
+
+				return next, nil
+			}).handleSignal(reload)
+		}
+
+		// step: setup the termination signals, less the signals the diagnostics are dumped and configuration reloaded on
+		var signals []os.Signal
+		for _, x := range []os.Signal{syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT} {
+			if x != diagnostics && x != reload {
+				signals = append(signals, x)
+			}
+		}
+		signalChannel := make(chan os.Signal, 1)
+		signal.Notify(signalChannel, signals...)
 		<-signalChannel
 
 		return nil
 	}
 
+	// step: add the operational commands
+	app.Commands = []cli.Command{
+		newSelfTestCommand(config),
+		newTokenCommand(config),
+		newCookieCommand(config),
+		newGenerateKeyCommand(),
+		newTemplateCommand(config),
+		newHealthCommand(config),
+		newBreakGlassCommand(config),
+		newFlagsCommand(),
+		newConfigCommand(),
+	}
+
 	return app
 }
 
+//
+// parseConfig reads the configuration file and the command line options into the config; for commands the
+// options given before the command are read first and can be overridden by those given after
+//
+func parseConfig(cx *cli.Context, config *Config) error {
+	contexts := []*cli.Context{cx}
+	if cx.Parent() != nil {
+		contexts = []*cli.Context{cx.Parent(), cx}
+	}
+
+	// step: warn on the use of the deprecated options
+	warnDeprecatedFlags(os.Args[1:])
+
+	// step: do we have a configuration file?
+	for _, x := range contexts {
+		if configFile := x.String("config"); configFile != "" {
+			if err := readConfigFile(configFile, config); err != nil {
+				return fmt.Errorf("unable to read the configuration file: %s, error: %s", configFile, err.Error())
+			}
+			break
+		}
+	}
+
+	// step: parse the command line options
+	for _, x := range contexts {
+		if err := readOptions(x, config); err != nil {
+			return err
+		}
+	}
+
+	// step: generate the resources from the openapi spec, after those configured so they can be overridden
+	if config.OpenAPISpec != "" {
+		resources, err := loadOpenAPIResources(config.OpenAPISpec)
+		if err != nil {
+			return fmt.Errorf("unable to read the openapi spec: %s, error: %s", config.OpenAPISpec, err.Error())
+		}
+		config.Resources = append(config.Resources, resources...)
+	}
+
+	return nil
+}
+
 // printError display the command line usage and error
 func printError(message string, args ...interface{}) *cli.ExitError {
 	return cli.NewExitError(fmt.Sprintf("[error] "+message, args...), 1)
@@ -0,0 +1,434 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	// proxyProtocolHeaderTimeout is how long we wait for the client to send the proxy protocol header
+	proxyProtocolHeaderTimeout = time.Duration(10) * time.Second
+
+	proxyProtocolV2CommandLocal = 0x20
+	proxyProtocolV2CommandProxy = 0x21
+	proxyProtocolV2TCP4         = 0x11
+	proxyProtocolV2TCP6         = 0x21
+)
+
+type contextKey string
+
+const (
+	// proxyProtocolConnKey holds the inbound proxy protocol connection in the request context
+	proxyProtocolConnKey = contextKey("proxy-protocol-conn")
+	// upstreamProxyHeaderKey holds the proxy protocol header to send to the upstream in the request context
+	upstreamProxyHeaderKey = contextKey("upstream-proxy-header")
+)
+
+var (
+	proxyProtocolV1Prefix    = []byte("PROXY ")
+	proxyProtocolV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+//
+// proxyProtocolTLV is a type-length-value extension of a proxy protocol v2 header
+//
+type proxyProtocolTLV struct {
+	Type  byte
+	Value []byte
+}
+
+//
+// proxyProtocolHeader is the connection information carried by the proxy protocol
+//
+type proxyProtocolHeader struct {
+	// the address of the client
+	Source *net.TCPAddr
+	// the address the client connected to
+	Destination *net.TCPAddr
+	// the v2 extensions, i.e. the authority, unique id or cloud provider specifics
+	TLVs []proxyProtocolTLV
+}
+
+//
+// proxyProtocolListener wraps a listener whose connections are prefixed with a proxy protocol v1 or v2 header
+//
+type proxyProtocolListener struct {
+	net.Listener
+}
+
+//
+// proxyProtocolConn reads the proxy protocol header on the first read, or on a call for the remote address
+//
+type proxyProtocolConn struct {
+	net.Conn
+	// the buffered reader holding the remainder of the stream
+	reader *bufio.Reader
+	// ensures we only read the header once
+	once sync.Once
+	// the error from reading the header
+	err error
+	// the header, nil if the client did not send one
+	header *proxyProtocolHeader
+}
+
+//
+// Accept waits for and wraps the next connection
+//
+func (r *proxyProtocolListener) Accept() (net.Conn, error) {
+	conn, err := r.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	return newProxyProtocolConn(conn), nil
+}
+
+//
+// newProxyProtocolConn wraps the connection
+//
+func newProxyProtocolConn(conn net.Conn) *proxyProtocolConn {
+	return &proxyProtocolConn{Conn: conn, reader: bufio.NewReader(conn)}
+}
+
+//
+// Read reads from the connection after the header
+//
+func (r *proxyProtocolConn) Read(b []byte) (int, error) {
+	if err := r.readHeader(); err != nil {
+		return 0, err
+	}
+
+	return r.reader.Read(b)
+}
+
+//
+// RemoteAddr returns the address of the client from the header, or the peer address if none was sent
+//
+func (r *proxyProtocolConn) RemoteAddr() net.Addr {
+	if err := r.readHeader(); err == nil && r.header != nil && r.header.Source != nil {
+		return r.header.Source
+	}
+
+	return r.Conn.RemoteAddr()
+}
+
+//
+// getHeader returns the proxy protocol header, nil if the client did not send one
+//
+func (r *proxyProtocolConn) getHeader() *proxyProtocolHeader {
+	if err := r.readHeader(); err != nil {
+		return nil
+	}
+
+	return r.header
+}
+
+//
+// readHeader reads and parses the header, closing the connection if it is malformed
+//
+func (r *proxyProtocolConn) readHeader() error {
+	r.once.Do(func() {
+		r.Conn.SetReadDeadline(time.Now().Add(proxyProtocolHeaderTimeout))
+		defer r.Conn.SetReadDeadline(time.Time{})
+
+		if r.header, r.err = readProxyProtocolHeader(r.reader); r.err != nil {
+			if r.err != io.EOF {
+				log.WithFields(log.Fields{
+					"client_ip": r.Conn.RemoteAddr().String(),
+					"error":     r.err.Error(),
+				}).Warnf("invalid proxy protocol header, closing the connection")
+			}
+			r.Conn.Close()
+		}
+	})
+
+	return r.err
+}
+
+//
+// readProxyProtocolHeader reads a v1 or v2 header from the reader; a connection without a header returns nil and
+// the stream is left untouched
+//
+func readProxyProtocolHeader(reader *bufio.Reader) (*proxyProtocolHeader, error) {
+	// step: peek incrementally so a client sending a short request is not blocked on
+	for i := 1; i <= len(proxyProtocolV2Signature); i++ {
+		prefix, err := reader.Peek(i)
+		if err != nil {
+			return nil, err
+		}
+		v1 := i <= len(proxyProtocolV1Prefix) && bytes.Equal(prefix, proxyProtocolV1Prefix[:i])
+		v2 := bytes.Equal(prefix, proxyProtocolV2Signature[:i])
+		switch {
+		case v1 && i == len(proxyProtocolV1Prefix):
+			return readProxyProtocolV1(reader)
+		case v2 && i == len(proxyProtocolV2Signature):
+			return readProxyProtocolV2(reader)
+		case !v1 && !v2:
+			return nil, nil
+		}
+	}
+
+	return nil, nil
+}
+
+//
+// readProxyProtocolV1 parses the text header i.e. PROXY TCP4 <src addr> <dst addr> <src port> <dst port>\r\n
+//
+func readProxyProtocolV1(reader *bufio.Reader) (*proxyProtocolHeader, error) {
+	// the v1 header has a maximum length of 107 bytes
+	var line []byte
+	for len(line) < 107 {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("the v1 header is not terminated")
+	}
+
+	parts := strings.Split(string(line[:len(line)-2]), " ")
+	if len(parts) >= 2 && parts[1] == "UNKNOWN" {
+		return &proxyProtocolHeader{}, nil
+	}
+	if len(parts) != 6 || (parts[1] != "TCP4" && parts[1] != "TCP6") {
+		return nil, fmt.Errorf("invalid v1 header: %q", line)
+	}
+	source, err := parseProxyProtocolAddress(parts[2], parts[4])
+	if err != nil {
+		return nil, err
+	}
+	destination, err := parseProxyProtocolAddress(parts[3], parts[5])
+	if err != nil {
+		return nil, err
+	}
+
+	return &proxyProtocolHeader{Source: source, Destination: destination}, nil
+}
+
+//
+// readProxyProtocolV2 parses the binary header and its tlvs
+//
+func readProxyProtocolV2(reader *bufio.Reader) (*proxyProtocolHeader, error) {
+	head := make([]byte, 16)
+	if _, err := io.ReadFull(reader, head); err != nil {
+		return nil, err
+	}
+	command, family := head[12], head[13]
+	content := make([]byte, binary.BigEndian.Uint16(head[14:16]))
+	if _, err := io.ReadFull(reader, content); err != nil {
+		return nil, err
+	}
+
+	header := &proxyProtocolHeader{}
+	switch command {
+	case proxyProtocolV2CommandLocal:
+		// a health check from the load balancer, the connection addresses are used
+		return header, nil
+	case proxyProtocolV2CommandProxy:
+	default:
+		return nil, fmt.Errorf("unsupported v2 version or command: %#x", command)
+	}
+
+	var size int
+	switch family {
+	case proxyProtocolV2TCP4:
+		size = 12
+		if len(content) >= size {
+			header.Source = &net.TCPAddr{IP: net.IP(content[0:4]), Port: int(binary.BigEndian.Uint16(content[8:10]))}
+			header.Destination = &net.TCPAddr{IP: net.IP(content[4:8]), Port: int(binary.BigEndian.Uint16(content[10:12]))}
+		}
+	case proxyProtocolV2TCP6:
+		size = 36
+		if len(content) >= size {
+			header.Source = &net.TCPAddr{IP: net.IP(content[0:16]), Port: int(binary.BigEndian.Uint16(content[32:34]))}
+			header.Destination = &net.TCPAddr{IP: net.IP(content[16:32]), Port: int(binary.BigEndian.Uint16(content[34:36]))}
+		}
+	default:
+		// unspecified, udp or unix; the addresses are skipped and the connection addresses used
+		return header, nil
+	}
+	if len(content) < size {
+		return nil, errors.New("the v2 header is too short for the address family")
+	}
+
+	// step: parse the tlvs following the addresses
+	for tlvs := content[size:]; len(tlvs) > 0; {
+		if len(tlvs) < 3 {
+			return nil, errors.New("the v2 header has a truncated tlv")
+		}
+		length := int(binary.BigEndian.Uint16(tlvs[1:3]))
+		if len(tlvs) < 3+length {
+			return nil, errors.New("the v2 header has a truncated tlv")
+		}
+		header.TLVs = append(header.TLVs, proxyProtocolTLV{Type: tlvs[0], Value: tlvs[3 : 3+length]})
+		tlvs = tlvs[3+length:]
+	}
+
+	return header, nil
+}
+
+//
+// encode returns the v2 binary encoding of the header
+//
+func (r *proxyProtocolHeader) encode() ([]byte, error) {
+	var family byte
+	var addresses []byte
+	source, destination := r.Source.IP.To4(), r.Destination.IP.To4()
+	switch {
+	case source != nil && destination != nil:
+		family = proxyProtocolV2TCP4
+	default:
+		family = proxyProtocolV2TCP6
+		source, destination = r.Source.IP.To16(), r.Destination.IP.To16()
+	}
+	if source == nil || destination == nil {
+		return nil, errors.New("the header requires a source and destination ip address")
+	}
+	addresses = append(addresses, source...)
+	addresses = append(addresses, destination...)
+	ports := make([]byte, 4)
+	binary.BigEndian.PutUint16(ports[0:2], uint16(r.Source.Port))
+	binary.BigEndian.PutUint16(ports[2:4], uint16(r.Destination.Port))
+	addresses = append(addresses, ports...)
+	for _, x := range r.TLVs {
+		length := make([]byte, 2)
+		binary.BigEndian.PutUint16(length, uint16(len(x.Value)))
+		addresses = append(addresses, x.Type)
+		addresses = append(addresses, length...)
+		addresses = append(addresses, x.Value...)
+	}
+
+	encoded := append([]byte{}, proxyProtocolV2Signature...)
+	encoded = append(encoded, proxyProtocolV2CommandProxy, family, 0, 0)
+	binary.BigEndian.PutUint16(encoded[14:16], uint16(len(addresses)))
+
+	return append(encoded, addresses...), nil
+}
+
+//
+// getProxyProtocolContext adds the inbound proxy protocol connection to the context, the connection is unwrapped
+// from the tls connection where tls is enabled
+//
+func getProxyProtocolContext(ctx context.Context, conn net.Conn) context.Context {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+	if ppConn, ok := conn.(*proxyProtocolConn); ok {
+		return context.WithValue(ctx, proxyProtocolConnKey, ppConn)
+	}
+
+	return ctx
+}
+
+//
+// getUpstreamProxyHeader creates the header sent to the upstream for the client address, passing through any tlvs
+// received on the inbound connection
+//
+func getUpstreamProxyHeader(ctx context.Context, remoteAddr string) (*proxyProtocolHeader, error) {
+	host, port, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return nil, err
+	}
+	source, err := parseProxyProtocolAddress(host, port)
+	if err != nil {
+		return nil, err
+	}
+	header := &proxyProtocolHeader{Source: source}
+
+	if local, ok := ctx.Value(http.LocalAddrContextKey).(net.Addr); ok {
+		if address, ok := local.(*net.TCPAddr); ok {
+			header.Destination = address
+		}
+	}
+	if conn, ok := ctx.Value(proxyProtocolConnKey).(*proxyProtocolConn); ok {
+		if inbound := conn.getHeader(); inbound != nil {
+			if inbound.Destination != nil {
+				header.Destination = inbound.Destination
+			}
+			header.TLVs = inbound.TLVs
+		}
+	}
+	if header.Destination == nil {
+		// e.g. listening on a unix socket
+		header.Destination = &net.TCPAddr{IP: net.IPv4zero}
+		if source.IP.To4() == nil {
+			header.Destination.IP = net.IPv6zero
+		}
+	}
+
+	return header, nil
+}
+
+//
+// newProxyProtocolDialer wraps the dialer to send the proxy protocol header placed in the request context
+//
+func newProxyProtocolDialer(dialer func(network, address string) (net.Conn, error)) func(context.Context, string, string) (net.Conn, error) {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		conn, err := dialer(network, address)
+		if err != nil {
+			return nil, err
+		}
+		if header, ok := ctx.Value(upstreamProxyHeaderKey).(*proxyProtocolHeader); ok {
+			encoded, err := header.encode()
+			if err == nil {
+				_, err = conn.Write(encoded)
+			}
+			if err != nil {
+				conn.Close()
+				return nil, fmt.Errorf("unable to send the proxy protocol header, error: %s", err)
+			}
+		}
+
+		return conn, nil
+	}
+}
+
+//
+// parseProxyProtocolAddress parses the ip address and port
+//
+func parseProxyProtocolAddress(host, port string) (*net.TCPAddr, error) {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid ip address: %s", host)
+	}
+	n, err := strconv.Atoi(port)
+	if err != nil || n < 0 || n > 65535 {
+		return nil, fmt.Errorf("invalid port: %s", port)
+	}
+
+	return &net.TCPAddr{IP: ip, Port: n}, nil
+}
@@ -0,0 +1,181 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newFakeProxyProtocolV2(command, family byte, content []byte) []byte {
+	encoded := append([]byte{}, proxyProtocolV2Signature...)
+	encoded = append(encoded, command, family, byte(len(content)>>8), byte(len(content)))
+	return append(encoded, content...)
+}
+
+func TestReadProxyProtocolHeader(t *testing.T) {
+	v4, _ := (&proxyProtocolHeader{
+		Source:      &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 45000},
+		Destination: &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 443},
+		TLVs:        []proxyProtocolTLV{{Type: 0xEA, Value: []byte("\x01vpce-0123456789")}},
+	}).encode()
+	v6, _ := (&proxyProtocolHeader{
+		Source:      &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 45000},
+		Destination: &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 443},
+	}).encode()
+
+	cases := []struct {
+		Stream string
+		Source string
+		TLVs   int
+		NoHead bool
+		Error  bool
+	}{
+		{Stream: "GET / HTTP/1.1\r\n\r\n", NoHead: true},
+		{Stream: "PROXY TCP4 10.0.0.1 10.0.0.2 45000 443\r\nGET / HTTP/1.1\r\n\r\n", Source: "10.0.0.1:45000"},
+		{Stream: "PROXY TCP6 2001:db8::1 2001:db8::2 45000 443\r\nGET / HTTP/1.1\r\n\r\n", Source: "[2001:db8::1]:45000"},
+		{Stream: "PROXY UNKNOWN\r\nGET / HTTP/1.1\r\n\r\n"},
+		{Stream: "PROXY TCP4 10.0.0.1\r\nGET / HTTP/1.1\r\n\r\n", Error: true},
+		{Stream: "PROXY TCP4 not_an_ip 10.0.0.2 45000 443\r\nGET / HTTP/1.1\r\n\r\n", Error: true},
+		{Stream: string(v4) + "GET / HTTP/1.1\r\n\r\n", Source: "10.0.0.1:45000", TLVs: 1},
+		{Stream: string(v6) + "GET / HTTP/1.1\r\n\r\n", Source: "[2001:db8::1]:45000"},
+		{Stream: string(newFakeProxyProtocolV2(proxyProtocolV2CommandLocal, 0, nil)) + "GET / HTTP/1.1\r\n\r\n"},
+		{Stream: string(newFakeProxyProtocolV2(0x31, proxyProtocolV2TCP4, make([]byte, 12))), Error: true},
+		{Stream: string(newFakeProxyProtocolV2(proxyProtocolV2CommandProxy, proxyProtocolV2TCP4, make([]byte, 8))), Error: true},
+		{Stream: string(newFakeProxyProtocolV2(proxyProtocolV2CommandProxy, proxyProtocolV2TCP4, append(make([]byte, 12), 0xEA, 0, 10))), Error: true},
+	}
+	for i, c := range cases {
+		reader := bufio.NewReader(bytes.NewBufferString(c.Stream))
+		header, err := readProxyProtocolHeader(reader)
+		if c.Error {
+			assert.Error(t, err, "case %d should have failed", i)
+			continue
+		}
+		if !assert.NoError(t, err, "case %d should not have failed", i) {
+			continue
+		}
+		if c.NoHead {
+			assert.Nil(t, header, "case %d should not have a header", i)
+		} else if assert.NotNil(t, header, "case %d should have a header", i) {
+			if c.Source != "" {
+				assert.Equal(t, c.Source, header.Source.String(), "case %d", i)
+			}
+			assert.Len(t, header.TLVs, c.TLVs, "case %d", i)
+		}
+		// step: the remainder of the stream must be untouched
+		remainder, _ := ioutil.ReadAll(reader)
+		assert.Equal(t, "GET / HTTP/1.1\r\n\r\n", string(remainder), "case %d", i)
+	}
+}
+
+func TestProxyProtocolListener(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	service := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.Write([]byte(req.RemoteAddr))
+		}),
+		ConnContext: getProxyProtocolContext,
+	}
+	go service.Serve(&proxyProtocolListener{listener})
+	defer service.Close()
+
+	for i, c := range []struct {
+		Header   string
+		Expected string
+	}{
+		{Header: "PROXY TCP4 10.0.0.1 10.0.0.2 45000 443\r\n", Expected: "10.0.0.1:45000"},
+		{Header: "", Expected: "127.0.0.1:"},
+	} {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if !assert.NoError(t, err, "case %d", i) {
+			continue
+		}
+		conn.Write([]byte(c.Header + "GET / HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n"))
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if assert.NoError(t, err, "case %d", i) {
+			content, _ := ioutil.ReadAll(resp.Body)
+			assert.Contains(t, string(content), c.Expected, "case %d", i)
+		}
+		conn.Close()
+	}
+}
+
+func TestUpstreamProxyProtocol(t *testing.T) {
+	// step: a upstream which reads the proxy protocol header and hands back the client address
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	upstream := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.Write([]byte(req.RemoteAddr))
+		}),
+	}
+	go upstream.Serve(&proxyProtocolListener{listener})
+	defer upstream.Close()
+
+	config := newFakeKeycloakConfig()
+	config.Upstream = "http://" + listener.Addr().String()
+	config.UpstreamProxyProtocol = true
+	p, _, u := newTestProxyService(config)
+	if !assert.NoError(t, p.createUpstreamProxy(p.endpoint)) {
+		t.FailNow()
+	}
+
+	request, _ := http.NewRequest("GET", u+fakeTestWhitelistedURL, nil)
+	resp, err := http.DefaultTransport.RoundTrip(request)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	content, _ := ioutil.ReadAll(resp.Body)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	// step: the upstream should see the address of the client, not the proxy
+	host, _, _ := net.SplitHostPort(string(content))
+	assert.Equal(t, "127.0.0.1", host)
+	assert.NotEqual(t, listener.Addr().String(), string(content))
+}
+
+func TestGetUpstreamProxyHeader(t *testing.T) {
+	ctx := context.WithValue(context.Background(), http.LocalAddrContextKey, &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 443})
+	header, err := getUpstreamProxyHeader(ctx, "10.0.0.1:45000")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "10.0.0.1:45000", header.Source.String())
+		assert.Equal(t, "10.0.0.2:443", header.Destination.String())
+	}
+
+	header, err = getUpstreamProxyHeader(context.Background(), "[2001:db8::1]:45000")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "[::]:0", header.Destination.String())
+		encoded, err := header.encode()
+		assert.NoError(t, err)
+		decoded, err := readProxyProtocolHeader(bufio.NewReader(bytes.NewReader(encoded)))
+		assert.NoError(t, err)
+		assert.Equal(t, "[2001:db8::1]:45000", decoded.Source.String())
+	}
+
+	_, err = getUpstreamProxyHeader(context.Background(), "not_an_address")
+	assert.Error(t, err)
+}
@@ -0,0 +1,64 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/coreos/go-oidc/oidc"
+	"github.com/gin-gonic/gin"
+)
+
+//
+// createRedirectClients creates a client for each of the additional redirection urls, keyed by the host, as the
+// redirect uri is fixed per client and must match between the authorization and the code exchange
+//
+func createRedirectClients(cfg *Config, provider oidc.ProviderConfig, httpClient *http.Client) (map[string]*oidc.Client, error) {
+	clients := make(map[string]*oidc.Client)
+	for _, x := range cfg.RedirectionURLs {
+		location, err := url.Parse(x)
+		if err != nil {
+			return nil, err
+		}
+		client, err := newOpenIDClient(cfg, provider, httpClient, x)
+		if err != nil {
+			return nil, err
+		}
+		log.Infof("accepting the redirection url: %s%s for host: %s", x, cfg.getCallbackPath(), location.Host)
+
+		clients[strings.ToLower(location.Host)] = client
+	}
+
+	return clients, nil
+}
+
+//
+// getRedirectClient returns the client of the provider selected by the request, else the client with the
+// redirection url for the host of the request, defaulting to the redirection url
+//
+func (r *oauthProxy) getRedirectClient(cx *gin.Context) *oidc.Client {
+	if provider := r.getRequestProvider(cx); provider != nil {
+		return provider.client
+	}
+	if client, found := r.redirects[strings.ToLower(cx.Request.Host)]; found {
+		return client
+	}
+
+	return r.client
+}
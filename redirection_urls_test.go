@@ -0,0 +1,63 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedirectionURLs(t *testing.T) {
+	config := newFakeKeycloakConfig()
+	config.CallbackPath = "/sso/callback"
+	config.RedirectionURLs = []string{"https://tenant.example.com"}
+	_, _, u := newTestProxyService(config)
+
+	cases := []struct {
+		Host     string
+		Redirect string
+	}{
+		{Redirect: u + "/sso/callback"},
+		{Host: "Tenant.example.com", Redirect: "https://tenant.example.com/sso/callback"},
+		{Host: "other.example.com", Redirect: u + "/sso/callback"},
+	}
+	for i, c := range cases {
+		request, _ := http.NewRequest("GET", u+oauthURL+authorizationURL, nil)
+		if c.Host != "" {
+			request.Host = c.Host
+		}
+		resp, err := http.DefaultTransport.RoundTrip(request)
+		if !assert.NoError(t, err, "case %d, unable to make the request", i) {
+			continue
+		}
+		resp.Body.Close()
+		location, err := url.Parse(resp.Header.Get("Location"))
+		if !assert.NoError(t, err, "case %d, invalid location", i) {
+			continue
+		}
+		assert.Equal(t, c.Redirect, location.Query().Get("redirect_uri"), "case %d, unexpected redirect uri", i)
+	}
+
+	// step: the callback handler is served on the path, without a code is a bad request
+	resp, err := http.Get(u + "/sso/callback")
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	}
+}
@@ -17,6 +17,7 @@ package main
 
 import (
 	"fmt"
+	"mime"
 	"strconv"
 	"strings"
 )
@@ -37,9 +38,11 @@ func (r *Resource) Parse(resource string) (*Resource, error) {
 		// step: split up the keypair
 		kp := strings.Split(x, "=")
 		if len(kp) != 2 {
-			return nil, fmt.Errorf("invalid resource keypair, should be (uri|roles|method|white-listed)=comma_values")
+			return nil, fmt.Errorf("invalid resource keypair, should be (name|uri|roles|method|white-listed|content-types|max-body-size|require-dpop|xhr-login|signed-urls|break-glass|session-expiry|spnego|hidden|body-claims|acr)=comma_values")
 		}
 		switch kp[0] {
+		case "name":
+			r.Name = kp[1]
 		case "uri":
 			r.URL = kp[1]
 		case "methods":
@@ -52,6 +55,73 @@ func (r *Resource) Parse(resource string) (*Resource, error) {
 				return nil, fmt.Errorf("the value of whitelisted must be true|TRUE|T or it's false equivilant")
 			}
 			r.WhiteListed = value
+		case "content-types":
+			r.ContentTypes = strings.Split(kp[1], ",")
+		case "max-body-size":
+			value, err := strconv.ParseInt(kp[1], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("the max-body-size must be a size in bytes")
+			}
+			r.MaxBodySize = value
+		case "require-dpop":
+			value, err := strconv.ParseBool(kp[1])
+			if err != nil {
+				return nil, fmt.Errorf("the value of require-dpop must be true|TRUE|T or it's false equivilant")
+			}
+			r.RequireDPoP = value
+		case "xhr-login":
+			value, err := strconv.ParseBool(kp[1])
+			if err != nil {
+				return nil, fmt.Errorf("the value of xhr-login must be true|TRUE|T or it's false equivilant")
+			}
+			r.XHRLogin = &value
+		case "signed-urls":
+			value, err := strconv.ParseBool(kp[1])
+			if err != nil {
+				return nil, fmt.Errorf("the value of signed-urls must be true|TRUE|T or it's false equivilant")
+			}
+			r.SignedURLs = value
+		case "break-glass":
+			value, err := strconv.ParseBool(kp[1])
+			if err != nil {
+				return nil, fmt.Errorf("the value of break-glass must be true|TRUE|T or it's false equivilant")
+			}
+			r.BreakGlass = value
+		case "session-expiry":
+			value, err := strconv.ParseBool(kp[1])
+			if err != nil {
+				return nil, fmt.Errorf("the value of session-expiry must be true|TRUE|T or it's false equivilant")
+			}
+			r.SessionExpiry = value
+		case "spnego":
+			value, err := strconv.ParseBool(kp[1])
+			if err != nil {
+				return nil, fmt.Errorf("the value of spnego must be true|TRUE|T or it's false equivilant")
+			}
+			r.SPNEGO = value
+		case "no-buffering":
+			value, err := strconv.ParseBool(kp[1])
+			if err != nil {
+				return nil, fmt.Errorf("the value of no-buffering must be true|TRUE|T or it's false equivilant")
+			}
+			r.NoBuffering = value
+		case "hidden":
+			value, err := strconv.ParseBool(kp[1])
+			if err != nil {
+				return nil, fmt.Errorf("the value of hidden must be true|TRUE|T or it's false equivilant")
+			}
+			r.Hidden = value
+		case "body-claims":
+			r.BodyClaims = make(map[string]string)
+			for _, x := range strings.Split(kp[1], ",") {
+				items := strings.Split(x, ":")
+				if len(items) != 2 {
+					return nil, fmt.Errorf("the body-claims must be a comma separated list of path:claim")
+				}
+				r.BodyClaims[items[0]] = items[1]
+			}
+		case "acr":
+			r.ACR = kp[1]
 		default:
 			return nil, fmt.Errorf("invalid identifier, should be roles, uri or methods")
 		}
@@ -91,9 +161,56 @@ func (r *Resource) IsValid() error {
 		}
 	}
 
+	// step: check the content types are valid
+	for _, x := range r.ContentTypes {
+		if _, _, err := mime.ParseMediaType(x); err != nil {
+			return fmt.Errorf("invalid content type %s, %s", x, err)
+		}
+	}
+	if r.MaxBodySize < 0 {
+		return fmt.Errorf("the max body size must be a positive value")
+	}
+	if r.CORS != nil {
+		if _, err := newCORSPolicy(*r.CORS); err != nil {
+			return err
+		}
+	}
+	if strings.ContainsAny(r.Name, "\r\n") {
+		return fmt.Errorf("the resource name can not contain line breaks")
+	}
+	if r.SignedURLs && r.WhiteListed {
+		return fmt.Errorf("a white-listed resource can not use signed urls")
+	}
+	for path, claim := range r.BodyClaims {
+		if path == "" || claim == "" || strings.HasPrefix(path, ".") || strings.HasSuffix(path, ".") {
+			return fmt.Errorf("invalid body claim %s: %s, requires a dotted path and claim", path, claim)
+		}
+	}
+	if len(r.BodyClaims) > 0 && r.WhiteListed {
+		return fmt.Errorf("a white-listed resource can not use body claims")
+	}
+
 	return nil
 }
 
+// defaultDenyResource is the resource enforced on the requests matching no resource in the default deny mode
+var defaultDenyResource = &Resource{
+	Name:    "default-deny",
+	URL:     "/",
+	Methods: []string{"ANY"},
+}
+
+//
+// getName returns the name of the resource, defaulting to the url
+//
+func (r Resource) getName() string {
+	if r.Name != "" {
+		return r.Name
+	}
+
+	return r.URL
+}
+
 // GetRoles gets a list of roles
 func (r Resource) GetRoles() string {
 	return strings.Join(r.Roles, ",")
@@ -118,3 +235,27 @@ func (r Resource) String() string {
 
 	return fmt.Sprintf("uri: %s, methods: %s, required: %s", r.URL, methods, roles)
 }
+
+//
+// isContentTypePermitted checks the media type is permitted by the resource, wildcards such as image/* are supported
+//
+func (r Resource) isContentTypePermitted(contentType string) bool {
+	if len(r.ContentTypes) <= 0 {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, x := range r.ContentTypes {
+		x = strings.ToLower(strings.TrimSpace(x))
+		if x == mediaType || x == "*/*" {
+			return true
+		}
+		if strings.HasSuffix(x, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(x, "*")) {
+			return true
+		}
+	}
+
+	return false
+}
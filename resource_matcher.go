@@ -0,0 +1,168 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"strings"
+)
+
+//
+// resourceNode is a node of the radix tree, labelled by the part of the prefix from the parent
+//
+type resourceNode struct {
+	// the part of the prefix from the parent
+	label string
+	// the position of the first resource with the prefix ending at the node, else -1
+	index int
+	// the children of the node, the labels start with distinct bytes
+	children []*resourceNode
+}
+
+//
+// resourceMatcher is a radix tree of the resource prefixes, compiled once so the resource of a request is found
+// by walking the path rather than comparing it with every resource; as before, the first of the resources in the
+// order configured whose prefix matches the path is returned
+//
+type resourceMatcher struct {
+	// the root of the tree, the empty prefix
+	root *resourceNode
+	// the resources in the order configured
+	resources []*Resource
+	// whether the prefixes and paths are compared regardless of case
+	insensitive bool
+}
+
+//
+// newResourceMatcher compiles the resources into a matcher
+//
+func newResourceMatcher(resources []*Resource, insensitive bool) *resourceMatcher {
+	matcher := &resourceMatcher{
+		root:        &resourceNode{index: -1},
+		resources:   resources,
+		insensitive: insensitive,
+	}
+	for i, resource := range resources {
+		prefix := resource.URL
+		if insensitive {
+			prefix = strings.ToLower(prefix)
+		}
+		matcher.insert(prefix, i)
+	}
+
+	return matcher
+}
+
+//
+// insert adds the prefix of a resource to the tree, splitting the nodes as required
+//
+func (r *resourceMatcher) insert(prefix string, index int) {
+	node := r.root
+	for {
+		if prefix == "" {
+			// step: the earlier resource takes precedence over a later one with the same prefix
+			if node.index < 0 {
+				node.index = index
+			}
+			return
+		}
+		child := node.getChild(prefix[0])
+		if child == nil {
+			node.children = append(node.children, &resourceNode{label: prefix, index: index})
+			return
+		}
+		common := getCommonPrefixLength(prefix, child.label)
+		if common < len(child.label) {
+			// step: split the child at the end of the common prefix
+			split := &resourceNode{label: child.label[:common], index: -1, children: []*resourceNode{child}}
+			child.label = child.label[common:]
+			for i, x := range node.children {
+				if x == child {
+					node.children[i] = split
+				}
+			}
+			child = split
+		}
+		node = child
+		prefix = prefix[common:]
+	}
+}
+
+//
+// match returns the first of the resources whose prefix matches the path, if any
+//
+func (r *resourceMatcher) match(path string) *Resource {
+	if r == nil {
+		return nil
+	}
+	if r.insensitive {
+		path = strings.ToLower(path)
+	}
+
+	// step: walk the path, keeping the earliest resource of the prefixes passed through
+	found := r.root.index
+	node := r.root
+	for path != "" {
+		node = node.getChild(path[0])
+		if node == nil || !strings.HasPrefix(path, node.label) {
+			break
+		}
+		if node.index >= 0 && (found < 0 || node.index < found) {
+			found = node.index
+		}
+		path = path[len(node.label):]
+	}
+	if found < 0 {
+		return nil
+	}
+
+	return r.resources[found]
+}
+
+//
+// getChild returns the child whose label starts with the byte, if any
+//
+func (r *resourceNode) getChild(b byte) *resourceNode {
+	for _, x := range r.children {
+		if x.label[0] == b {
+			return x
+		}
+	}
+
+	return nil
+}
+
+//
+// getCommonPrefixLength returns the length of the prefix shared by the strings
+//
+func getCommonPrefixLength(a, b string) int {
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+
+	return i
+}
+
+//
+// compileResources compiles the matchers of the resources, globally and for each of the virtual hosts; it must be
+// called again whenever the resources are changed
+//
+func (r *oauthProxy) compileResources() {
+	r.matcher = newResourceMatcher(r.config.Resources, r.config.CaseInsensitivePaths)
+	for _, x := range r.config.VirtualHosts {
+		x.matcher = newResourceMatcher(x.Resources, r.config.CaseInsensitivePaths)
+	}
+}
@@ -0,0 +1,81 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResourceMatcher(t *testing.T) {
+	resources := []*Resource{
+		{URL: "/admin/users"},
+		{URL: "/admin"},
+		{URL: "/api/v1"},
+		{URL: "/admin/users/special"},
+		{URL: "/ap"},
+		{URL: "/api"},
+		{URL: "/Static"},
+	}
+	cases := []struct {
+		Path        string
+		Insensitive bool
+		Expected    int
+	}{
+		{Path: "/admin/users/1", Expected: 0},
+		{Path: "/admin/users/special", Expected: 0},
+		{Path: "/admin/roles", Expected: 1},
+		{Path: "/admin", Expected: 1},
+		{Path: "/adm", Expected: -1},
+		{Path: "/api/v1/test", Expected: 2},
+		{Path: "/api/v2", Expected: 4},
+		{Path: "/apple", Expected: 4},
+		{Path: "/static/main.css", Expected: -1},
+		{Path: "/static/main.css", Insensitive: true, Expected: 6},
+		{Path: "/ADMIN/USERS", Insensitive: true, Expected: 0},
+		{Path: "/", Expected: -1},
+		{Path: "", Expected: -1},
+	}
+	for i, c := range cases {
+		resource := newResourceMatcher(resources, c.Insensitive).match(c.Path)
+		if c.Expected < 0 {
+			assert.Nil(t, resource, "case %d, expected no resource", i)
+			continue
+		}
+		assert.Equal(t, resources[c.Expected], resource, "case %d, unexpected resource", i)
+	}
+
+	// step: a resource for everything only applies after the earlier resources
+	matcher := newResourceMatcher([]*Resource{resources[2], {URL: "/"}, resources[1]}, false)
+	assert.Equal(t, resources[2], matcher.match("/api/v1"))
+	assert.Equal(t, "/", matcher.match("/admin").URL)
+	assert.Nil(t, (*resourceMatcher)(nil).match("/admin"))
+}
+
+func BenchmarkResourceMatcher(b *testing.B) {
+	var resources []*Resource
+	for i := 0; i < 500; i++ {
+		resources = append(resources, &Resource{URL: fmt.Sprintf("/api/v%d/service%d", i%5, i)})
+	}
+	matcher := newResourceMatcher(resources, false)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		matcher.match("/api/v4/service499/items")
+	}
+}
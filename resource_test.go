@@ -18,6 +18,8 @@ package main
 import (
 	"reflect"
 	"testing"
+
+	"github.com/stretchr/testify/assert"
 )
 
 func TestDecodeResource(t *testing.T) {
@@ -65,6 +67,54 @@ func TestDecodeResource(t *testing.T) {
 				WhiteListed: true,
 			},
 		},
+		{
+			Option: "uri=/upload|content-types=image/png,image/*|max-body-size=1024",
+			Ok:     true,
+			Resource: &Resource{
+				URL:          "/upload",
+				ContentTypes: []string{"image/png", "image/*"},
+				MaxBodySize:  1024,
+			},
+		},
+		{
+			Option: "name=uploads|uri=/upload",
+			Ok:     true,
+			Resource: &Resource{
+				Name: "uploads",
+				URL:  "/upload",
+			},
+		},
+		{
+			Option: "uri=/admin/console|roles=admin|hidden=true",
+			Ok:     true,
+			Resource: &Resource{
+				URL:    "/admin/console",
+				Roles:  []string{"admin"},
+				Hidden: true,
+			},
+		},
+		{
+			Option: "uri=/orders|body-claims=userId:sub,account.id:account",
+			Ok:     true,
+			Resource: &Resource{
+				URL:        "/orders",
+				BodyClaims: map[string]string{"userId": "sub", "account.id": "account"},
+			},
+		},
+		{
+			Option: "uri=/orders|body-claims=userId",
+		},
+		{
+			Option: "uri=/account|acr=2fa",
+			Ok:     true,
+			Resource: &Resource{
+				URL: "/account",
+				ACR: "2fa",
+			},
+		},
+		{
+			Option: "uri=/upload|max-body-size=big",
+		},
 		{
 			Option: "",
 		},
@@ -117,6 +167,15 @@ func TestIsValid(t *testing.T) {
 	}
 }
 
+func TestIsContentTypePermitted(t *testing.T) {
+	resource := &Resource{ContentTypes: []string{"application/json", "image/*"}}
+	assert.True(t, resource.isContentTypePermitted("application/json; charset=utf-8"))
+	assert.True(t, resource.isContentTypePermitted("image/png"))
+	assert.False(t, resource.isContentTypePermitted("text/html"))
+	assert.False(t, resource.isContentTypePermitted(""))
+	assert.True(t, (&Resource{}).isContentTypePermitted("text/html"))
+}
+
 func TestResourceString(t *testing.T) {
 	resource := &Resource{
 		Roles: []string{"1", "2", "3"},
@@ -0,0 +1,505 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	// revocationFailOpen permits the client certificate when the revocation status can't be determined
+	revocationFailOpen = "open"
+	// revocationFailClosed rejects the client certificate when the revocation status can't be determined
+	revocationFailClosed = "closed"
+	// ocspTimeout is the timeout for the requests to the ocsp responders
+	ocspTimeout = time.Duration(5) * time.Second
+	// ocspDefaultCacheTime is how long a ocsp response without a next update is cached
+	ocspDefaultCacheTime = time.Duration(5) * time.Minute
+	// ocspStapleRetry is the shortest interval between the refreshes of the stapled responses
+	ocspStapleRetry = time.Duration(1) * time.Minute
+	// ocspMaxResponseSize is the largest ocsp response read from a responder
+	ocspMaxResponseSize = 1 << 20
+)
+
+var (
+	// errCertificateRevoked indicates the client certificate has been revoked
+	errCertificateRevoked = errors.New("the client certificate has been revoked")
+	// oidOCSPBasicResponse is the type of the basic ocsp response
+	oidOCSPBasicResponse = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 48, 1, 1}
+	// oidSHA1 is the hash algorithm used for the certificate id in the ocsp requests
+	oidSHA1 = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+	// ocspSignatureAlgorithms maps the signature algorithms of the ocsp responses
+	ocspSignatureAlgorithms = map[string]x509.SignatureAlgorithm{
+		"1.2.840.113549.1.1.5":  x509.SHA1WithRSA,
+		"1.2.840.113549.1.1.11": x509.SHA256WithRSA,
+		"1.2.840.113549.1.1.12": x509.SHA384WithRSA,
+		"1.2.840.113549.1.1.13": x509.SHA512WithRSA,
+		"1.2.840.10045.4.1":     x509.ECDSAWithSHA1,
+		"1.2.840.10045.4.3.2":   x509.ECDSAWithSHA256,
+		"1.2.840.10045.4.3.3":   x509.ECDSAWithSHA384,
+		"1.2.840.10045.4.3.4":   x509.ECDSAWithSHA512,
+		"1.3.101.112":           x509.PureEd25519,
+	}
+)
+
+// the asn1 structures of the ocsp request and response (rfc 6960)
+type ocspCertID struct {
+	HashAlgorithm pkix.AlgorithmIdentifier
+	NameHash      []byte
+	IssuerKeyHash []byte
+	SerialNumber  *big.Int
+}
+
+type ocspRequest struct {
+	TBSRequest ocspTBSRequest
+}
+
+type ocspTBSRequest struct {
+	RequestList []ocspRequestEntry
+}
+
+type ocspRequestEntry struct {
+	Cert ocspCertID
+}
+
+type ocspResponse struct {
+	Status   asn1.Enumerated
+	Response ocspResponseBytes `asn1:"explicit,tag:0,optional"`
+}
+
+type ocspResponseBytes struct {
+	ResponseType asn1.ObjectIdentifier
+	Response     []byte
+}
+
+type ocspBasicResponse struct {
+	TBSResponseData    asn1.RawValue
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          asn1.BitString
+	Certificates       []asn1.RawValue `asn1:"explicit,tag:0,optional"`
+}
+
+type ocspResponseData struct {
+	Version            int `asn1:"optional,default:0,explicit,tag:0"`
+	RawResponderID     asn1.RawValue
+	ProducedAt         time.Time `asn1:"generalized"`
+	Responses          []ocspSingleResponse
+	ResponseExtensions []pkix.Extension `asn1:"explicit,tag:1,optional"`
+}
+
+type ocspSingleResponse struct {
+	CertID           ocspCertID
+	Good             asn1.Flag        `asn1:"tag:0,optional"`
+	Revoked          ocspRevokedInfo  `asn1:"tag:1,optional"`
+	Unknown          asn1.Flag        `asn1:"tag:2,optional"`
+	ThisUpdate       time.Time        `asn1:"generalized"`
+	NextUpdate       time.Time        `asn1:"generalized,explicit,tag:0,optional"`
+	SingleExtensions []pkix.Extension `asn1:"explicit,tag:1,optional"`
+}
+
+type ocspRevokedInfo struct {
+	RevocationTime time.Time       `asn1:"generalized"`
+	Reason         asn1.Enumerated `asn1:"explicit,tag:0,optional"`
+}
+
+//
+// ocspStatus is a cached ocsp status for a certificate
+//
+type ocspStatus struct {
+	// the certificate has been revoked
+	revoked bool
+	// the time the status should be refreshed
+	expires time.Time
+}
+
+//
+// revocationChecker checks the client certificates against the certificate revocation lists and ocsp responders
+//
+type revocationChecker struct {
+	sync.RWMutex
+	// the path to the pem encoded certificate revocation lists
+	crlFile string
+	// the modification time of the file when last loaded
+	crlModified time.Time
+	// the certificate revocation lists
+	crls []*x509.RevocationList
+	// query the ocsp responders of the certificates
+	ocsp bool
+	// permit the certificate when the status can't be determined
+	failOpen bool
+	// the client used for the ocsp requests
+	client *http.Client
+	// the ocsp statuses by the issuer and serial
+	statuses map[string]*ocspStatus
+}
+
+//
+// newRevocationChecker creates the revocation checker from the configuration, loading the revocation lists
+//
+func newRevocationChecker(config *Config) (*revocationChecker, error) {
+	checker := &revocationChecker{
+		crlFile:  config.TLSClientCRL,
+		ocsp:     config.EnableTLSClientOCSP,
+		failOpen: config.TLSRevocationFailureMode != revocationFailClosed,
+		client:   &http.Client{Timeout: ocspTimeout},
+		statuses: make(map[string]*ocspStatus, 0),
+	}
+	if checker.crlFile != "" {
+		if err := checker.loadCRL(); err != nil {
+			return nil, err
+		}
+	}
+
+	return checker, nil
+}
+
+//
+// verifyPeerCertificate is called after the chain has been verified, checking the revocation status of the client
+// certificate. A revoked certificate is always rejected, any other failure is subject to the failure mode
+//
+func (r *revocationChecker) verifyPeerCertificate(_ [][]byte, chains [][]*x509.Certificate) error {
+	for _, chain := range chains {
+		if len(chain) < 2 {
+			continue
+		}
+		certificate, issuer := chain[0], chain[1]
+		err := r.check(certificate, issuer)
+		switch {
+		case err == nil:
+			return nil
+		case err == errCertificateRevoked:
+			log.WithFields(log.Fields{
+				"subject": certificate.Subject.String(),
+				"serial":  certificate.SerialNumber.String(),
+			}).Warnf("rejecting a revoked client certificate")
+
+			return err
+		}
+		log.WithFields(log.Fields{
+			"subject": certificate.Subject.String(),
+			"serial":  certificate.SerialNumber.String(),
+			"error":   err.Error(),
+		}).Warnf("unable to determine the revocation status of the client certificate")
+
+		if r.failOpen {
+			return nil
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+//
+// check checks the certificate against the revocation lists and the ocsp responder
+//
+func (r *revocationChecker) check(certificate, issuer *x509.Certificate) error {
+	var failure error
+	if r.crlFile != "" {
+		if err := r.checkCRL(certificate, issuer); err == errCertificateRevoked {
+			return err
+		} else if err != nil {
+			failure = err
+		}
+	}
+	// note: the responder is still asked when the list failed, as it may know the certificate is revoked
+	if r.ocsp {
+		if err := r.checkOCSP(certificate, issuer); err == errCertificateRevoked {
+			return err
+		} else if err != nil && failure == nil {
+			failure = err
+		}
+	}
+
+	return failure
+}
+
+//
+// checkCRL checks the certificate against the revocation list of the issuer
+//
+func (r *revocationChecker) checkCRL(certificate, issuer *x509.Certificate) error {
+	// step: reload the revocation lists if the file has changed
+	if stat, err := os.Stat(r.crlFile); err == nil {
+		r.RLock()
+		modified := !stat.ModTime().Equal(r.crlModified)
+		r.RUnlock()
+		if modified {
+			if err := r.loadCRL(); err != nil {
+				log.WithFields(log.Fields{"error": err.Error()}).Warnf("unable to reload the certificate revocation list")
+			}
+		}
+	}
+
+	r.RLock()
+	defer r.RUnlock()
+
+	for _, crl := range r.crls {
+		if !bytes.Equal(crl.RawIssuer, issuer.RawSubject) || crl.CheckSignatureFrom(issuer) != nil {
+			continue
+		}
+		if !crl.NextUpdate.IsZero() && time.Now().After(crl.NextUpdate) {
+			return fmt.Errorf("the certificate revocation list for: %s expired on %s", issuer.Subject, crl.NextUpdate.Format(time.RFC3339))
+		}
+		for _, x := range crl.RevokedCertificateEntries {
+			if x.SerialNumber.Cmp(certificate.SerialNumber) == 0 {
+				return errCertificateRevoked
+			}
+		}
+
+		return nil
+	}
+
+	return fmt.Errorf("no certificate revocation list found for the issuer: %s", issuer.Subject)
+}
+
+//
+// loadCRL reads the pem (or der) encoded revocation lists from the file
+//
+func (r *revocationChecker) loadCRL() error {
+	stat, err := os.Stat(r.crlFile)
+	if err != nil {
+		return err
+	}
+	content, err := ioutil.ReadFile(r.crlFile)
+	if err != nil {
+		return err
+	}
+
+	var crls []*x509.RevocationList
+	for rest := content; ; {
+		var block *pem.Block
+		if block, rest = pem.Decode(rest); block == nil {
+			break
+		}
+		if block.Type != "X509 CRL" {
+			continue
+		}
+		crl, err := x509.ParseRevocationList(block.Bytes)
+		if err != nil {
+			return fmt.Errorf("unable to parse the certificate revocation list: %s, %s", r.crlFile, err)
+		}
+		crls = append(crls, crl)
+	}
+	// step: the file may be a single der encoded list
+	if len(crls) == 0 {
+		crl, err := x509.ParseRevocationList(content)
+		if err != nil {
+			return fmt.Errorf("unable to parse the certificate revocation list: %s, %s", r.crlFile, err)
+		}
+		crls = append(crls, crl)
+	}
+
+	r.Lock()
+	defer r.Unlock()
+	r.crls = crls
+	r.crlModified = stat.ModTime()
+	log.Infof("loaded %d certificate revocation list(s) from: %s", len(crls), r.crlFile)
+
+	return nil
+}
+
+//
+// checkOCSP checks the status of the certificate with its ocsp responder, caching the status until the next update
+//
+func (r *revocationChecker) checkOCSP(certificate, issuer *x509.Certificate) error {
+	if len(certificate.OCSPServer) == 0 {
+		return fmt.Errorf("the client certificate has no ocsp responder")
+	}
+	key := string(issuer.RawSubject) + certificate.SerialNumber.String()
+
+	r.RLock()
+	status, found := r.statuses[key]
+	r.RUnlock()
+	if !found || time.Now().After(status.expires) {
+		var err error
+		if _, status, err = queryOCSP(r.client, certificate.OCSPServer[0], certificate, issuer); err != nil {
+			return err
+		}
+		r.Lock()
+		r.statuses[key] = status
+		r.Unlock()
+	}
+	if status.revoked {
+		return errCertificateRevoked
+	}
+
+	return nil
+}
+
+//
+// queryOCSP requests the status of the certificate from the responder, verifying the signature of the response and
+// returning the encoded response along with the status
+//
+func queryOCSP(client *http.Client, responder string, certificate, issuer *x509.Certificate) ([]byte, *ocspStatus, error) {
+	id, err := getOCSPCertID(certificate, issuer)
+	if err != nil {
+		return nil, nil, err
+	}
+	request, err := asn1.Marshal(ocspRequest{TBSRequest: ocspTBSRequest{RequestList: []ocspRequestEntry{{Cert: id}}}})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	resp, err := client.Post(responder, "application/ocsp-request", bytes.NewReader(request))
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to reach the ocsp responder: %s, %s", responder, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("the ocsp responder: %s returned: %s", responder, resp.Status)
+	}
+	content, err := ioutil.ReadAll(io.LimitReader(resp.Body, ocspMaxResponseSize))
+	if err != nil {
+		return nil, nil, err
+	}
+	status, err := parseOCSPResponse(content, id, issuer)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return content, status, nil
+}
+
+//
+// parseOCSPResponse decodes and verifies the ocsp response for the certificate id
+//
+func parseOCSPResponse(content []byte, id ocspCertID, issuer *x509.Certificate) (*ocspStatus, error) {
+	response := ocspResponse{}
+	if _, err := asn1.Unmarshal(content, &response); err != nil {
+		return nil, fmt.Errorf("unable to decode the ocsp response, %s", err)
+	}
+	if response.Status != 0 {
+		return nil, fmt.Errorf("the ocsp responder returned the status: %d", response.Status)
+	}
+	if !response.Response.ResponseType.Equal(oidOCSPBasicResponse) {
+		return nil, fmt.Errorf("unsupported ocsp response type: %s", response.Response.ResponseType)
+	}
+	basic := ocspBasicResponse{}
+	if _, err := asn1.Unmarshal(response.Response.Response, &basic); err != nil {
+		return nil, fmt.Errorf("unable to decode the ocsp basic response, %s", err)
+	}
+	data := ocspResponseData{}
+	if _, err := asn1.Unmarshal(basic.TBSResponseData.FullBytes, &data); err != nil {
+		return nil, fmt.Errorf("unable to decode the ocsp response data, %s", err)
+	}
+
+	// step: the response is signed by the issuer or a responder the issuer has delegated to
+	signer := issuer
+	if len(basic.Certificates) > 0 {
+		delegate, err := x509.ParseCertificate(basic.Certificates[0].FullBytes)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse the ocsp responder certificate, %s", err)
+		}
+		if !bytes.Equal(delegate.Raw, issuer.Raw) {
+			if err := delegate.CheckSignatureFrom(issuer); err != nil {
+				return nil, fmt.Errorf("the ocsp responder certificate is not signed by the issuer, %s", err)
+			}
+			if !hasExtKeyUsage(delegate, x509.ExtKeyUsageOCSPSigning) {
+				return nil, errors.New("the ocsp responder certificate is not permitted to sign responses")
+			}
+			signer = delegate
+		}
+	}
+	algorithm, found := ocspSignatureAlgorithms[basic.SignatureAlgorithm.Algorithm.String()]
+	if !found {
+		return nil, fmt.Errorf("unsupported ocsp signature algorithm: %s", basic.SignatureAlgorithm.Algorithm)
+	}
+	if err := signer.CheckSignature(algorithm, basic.TBSResponseData.FullBytes, basic.Signature.RightAlign()); err != nil {
+		return nil, fmt.Errorf("invalid ocsp response signature, %s", err)
+	}
+
+	// step: find the status of the certificate
+	now := time.Now()
+	for _, x := range data.Responses {
+		if x.CertID.SerialNumber.Cmp(id.SerialNumber) != 0 || !bytes.Equal(x.CertID.IssuerKeyHash, id.IssuerKeyHash) {
+			continue
+		}
+		if x.ThisUpdate.After(now.Add(time.Minute)) {
+			return nil, errors.New("the ocsp response is not yet valid")
+		}
+		status := &ocspStatus{expires: now.Add(ocspDefaultCacheTime)}
+		if !x.NextUpdate.IsZero() {
+			if now.After(x.NextUpdate) {
+				return nil, errors.New("the ocsp response has expired")
+			}
+			status.expires = x.NextUpdate
+		}
+		switch {
+		case bool(x.Good):
+		case bool(x.Unknown):
+			return nil, errors.New("the ocsp responder does not know the certificate")
+		default:
+			status.revoked = true
+		}
+
+		return status, nil
+	}
+
+	return nil, errors.New("the ocsp response does not contain the certificate")
+}
+
+//
+// getOCSPCertID returns the ocsp identifier of the certificate
+//
+func getOCSPCertID(certificate, issuer *x509.Certificate) (ocspCertID, error) {
+	var publicKeyInfo struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}
+	if _, err := asn1.Unmarshal(issuer.RawSubjectPublicKeyInfo, &publicKeyInfo); err != nil {
+		return ocspCertID{}, err
+	}
+	nameHash := sha1.Sum(issuer.RawSubject)
+	keyHash := sha1.Sum(publicKeyInfo.PublicKey.RightAlign())
+
+	return ocspCertID{
+		HashAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidSHA1, Parameters: asn1.NullRawValue},
+		NameHash:      nameHash[:],
+		IssuerKeyHash: keyHash[:],
+		SerialNumber:  certificate.SerialNumber,
+	}, nil
+}
+
+//
+// hasExtKeyUsage checks if the certificate has the extended key usage
+//
+func hasExtKeyUsage(certificate *x509.Certificate, usage x509.ExtKeyUsage) bool {
+	for _, x := range certificate.ExtKeyUsage {
+		if x == usage {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,312 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeCA struct {
+	certificate *x509.Certificate
+	key         *ecdsa.PrivateKey
+}
+
+func newFakeCA(t *testing.T) *fakeCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "fake ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}
+	content, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	certificate, _ := x509.ParseCertificate(content)
+
+	return &fakeCA{certificate: certificate, key: key}
+}
+
+func (r *fakeCA) newClientCertificate(t *testing.T, serial int64, responder string) *x509.Certificate {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "client"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if responder != "" {
+		template.OCSPServer = []string{responder}
+	}
+	content, err := x509.CreateCertificate(rand.Reader, template, r.certificate, &key.PublicKey, r.key)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	certificate, _ := x509.ParseCertificate(content)
+
+	return certificate
+}
+
+func (r *fakeCA) newCRL(t *testing.T, nextUpdate time.Time, revoked ...int64) []byte {
+	template := &x509.RevocationList{
+		Number:     big.NewInt(time.Now().UnixNano()),
+		ThisUpdate: time.Now().Add(-time.Hour),
+		NextUpdate: nextUpdate,
+	}
+	for _, x := range revoked {
+		template.RevokedCertificateEntries = append(template.RevokedCertificateEntries,
+			x509.RevocationListEntry{SerialNumber: big.NewInt(x), RevocationTime: time.Now()})
+	}
+	content, err := x509.CreateRevocationList(rand.Reader, template, r.certificate, r.key)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: content})
+}
+
+// newOCSPResponse creates a ocsp response signed by the ca, the status being one of good, revoked or unknown
+func (r *fakeCA) newOCSPResponse(t *testing.T, certificate *x509.Certificate, status string) []byte {
+	id, err := getOCSPCertID(certificate, r.certificate)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	certStatus := asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0}
+	switch status {
+	case "revoked":
+		revokedAt, _ := asn1.MarshalWithParams(time.Now().UTC(), "generalized")
+		certStatus = asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 1, IsCompound: true, Bytes: revokedAt}
+	case "unknown":
+		certStatus.Tag = 2
+	}
+	keyHash, _ := asn1.Marshal(id.IssuerKeyHash)
+	data, err := asn1.Marshal(struct {
+		ResponderID asn1.RawValue
+		ProducedAt  time.Time `asn1:"generalized"`
+		Responses   []struct {
+			CertID     ocspCertID
+			Status     asn1.RawValue
+			ThisUpdate time.Time `asn1:"generalized"`
+			NextUpdate time.Time `asn1:"generalized,explicit,tag:0"`
+		}
+	}{
+		ResponderID: asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 2, IsCompound: true, Bytes: keyHash},
+		ProducedAt:  time.Now().UTC().Truncate(time.Second),
+		Responses: []struct {
+			CertID     ocspCertID
+			Status     asn1.RawValue
+			ThisUpdate time.Time `asn1:"generalized"`
+			NextUpdate time.Time `asn1:"generalized,explicit,tag:0"`
+		}{{
+			CertID:     id,
+			Status:     certStatus,
+			ThisUpdate: time.Now().UTC().Add(-time.Minute).Truncate(time.Second),
+			NextUpdate: time.Now().UTC().Add(time.Hour).Truncate(time.Second),
+		}},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	digest := sha256.Sum256(data)
+	signature, err := ecdsa.SignASN1(rand.Reader, r.key, digest[:])
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	basic, err := asn1.Marshal(ocspBasicResponse{
+		TBSResponseData:    asn1.RawValue{FullBytes: data},
+		SignatureAlgorithm: pkix.AlgorithmIdentifier{Algorithm: asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}},
+		Signature:          asn1.BitString{Bytes: signature, BitLength: len(signature) * 8},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	content, err := asn1.Marshal(ocspResponse{
+		Response: ocspResponseBytes{ResponseType: oidOCSPBasicResponse, Response: basic},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	return content
+}
+
+func TestRevocationCheckerCRL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "revocation")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca, other := newFakeCA(t), newFakeCA(t)
+	good, revoked := ca.newClientCertificate(t, 10, ""), ca.newClientCertificate(t, 11, "")
+	stranger := other.newClientCertificate(t, 10, "")
+
+	crl := filepath.Join(dir, "ca.crl")
+	if err := ioutil.WriteFile(crl, ca.newCRL(t, time.Now().Add(time.Hour), 11), 0600); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	cases := []struct {
+		Certificate *x509.Certificate
+		Issuer      *x509.Certificate
+		FailureMode string
+		Error       bool
+	}{
+		{Certificate: good, Issuer: ca.certificate},
+		{Certificate: revoked, Issuer: ca.certificate, Error: true},
+		{Certificate: revoked, Issuer: ca.certificate, FailureMode: revocationFailOpen, Error: true},
+		{Certificate: stranger, Issuer: other.certificate, FailureMode: revocationFailOpen},
+		{Certificate: stranger, Issuer: other.certificate, FailureMode: revocationFailClosed, Error: true},
+	}
+	for i, c := range cases {
+		config := newFakeKeycloakConfig()
+		config.TLSClientCRL = crl
+		config.TLSRevocationFailureMode = c.FailureMode
+		checker, err := newRevocationChecker(config)
+		if !assert.NoError(t, err, "case %d, unable to create the checker", i) {
+			continue
+		}
+		err = checker.verifyPeerCertificate(nil, [][]*x509.Certificate{{c.Certificate, c.Issuer}})
+		if c.Error {
+			assert.Error(t, err, "case %d should have failed", i)
+			continue
+		}
+		assert.NoError(t, err, "case %d should not have failed", i)
+	}
+}
+
+func TestRevocationCheckerCRLReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "revocation")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := newFakeCA(t)
+	certificate := ca.newClientCertificate(t, 10, "")
+	crl := filepath.Join(dir, "ca.crl")
+	if err := ioutil.WriteFile(crl, ca.newCRL(t, time.Now().Add(time.Hour)), 0600); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	config := newFakeKeycloakConfig()
+	config.TLSClientCRL = crl
+	config.TLSRevocationFailureMode = revocationFailClosed
+	checker, err := newRevocationChecker(config)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	assert.NoError(t, checker.check(certificate, ca.certificate))
+
+	// step: revoke the certificate and ensure the list is reloaded
+	if err := ioutil.WriteFile(crl, ca.newCRL(t, time.Now().Add(time.Hour), 10), 0600); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	os.Chtimes(crl, time.Now().Add(time.Minute), time.Now().Add(time.Minute))
+	assert.Equal(t, errCertificateRevoked, checker.check(certificate, ca.certificate))
+
+	// step: an expired list can't be trusted
+	if err := ioutil.WriteFile(crl, ca.newCRL(t, time.Now().Add(-time.Minute)), 0600); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	os.Chtimes(crl, time.Now().Add(2*time.Minute), time.Now().Add(2*time.Minute))
+	err = checker.check(certificate, ca.certificate)
+	assert.Error(t, err)
+	assert.NotEqual(t, errCertificateRevoked, err)
+}
+
+func TestRevocationCheckerOCSP(t *testing.T) {
+	ca := newFakeCA(t)
+	statuses := map[string]string{"10": "good", "11": "revoked", "12": "unknown"}
+	requests := 0
+	responder := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		content, _ := ioutil.ReadAll(r.Body)
+		request := ocspRequest{}
+		if _, err := asn1.Unmarshal(content, &request); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		serial := request.TBSRequest.RequestList[0].Cert.SerialNumber
+		certificate := &x509.Certificate{SerialNumber: serial}
+		w.Header().Set("Content-Type", "application/ocsp-response")
+		w.Write(ca.newOCSPResponse(t, certificate, statuses[serial.String()]))
+	}))
+	defer responder.Close()
+
+	cases := []struct {
+		Certificate *x509.Certificate
+		FailureMode string
+		Error       bool
+	}{
+		{Certificate: ca.newClientCertificate(t, 10, responder.URL)},
+		{Certificate: ca.newClientCertificate(t, 11, responder.URL), Error: true},
+		{Certificate: ca.newClientCertificate(t, 12, responder.URL), FailureMode: revocationFailOpen},
+		{Certificate: ca.newClientCertificate(t, 12, responder.URL), FailureMode: revocationFailClosed, Error: true},
+		{Certificate: ca.newClientCertificate(t, 13, ""), FailureMode: revocationFailOpen},
+		{Certificate: ca.newClientCertificate(t, 13, ""), FailureMode: revocationFailClosed, Error: true},
+		{Certificate: ca.newClientCertificate(t, 14, "http://127.0.0.1:1"), FailureMode: revocationFailClosed, Error: true},
+	}
+	for i, c := range cases {
+		config := newFakeKeycloakConfig()
+		config.EnableTLSClientOCSP = true
+		config.TLSRevocationFailureMode = c.FailureMode
+		checker, err := newRevocationChecker(config)
+		if !assert.NoError(t, err, "case %d, unable to create the checker", i) {
+			continue
+		}
+		err = checker.verifyPeerCertificate(nil, [][]*x509.Certificate{{c.Certificate, ca.certificate}})
+		if c.Error {
+			assert.Error(t, err, "case %d should have failed", i)
+			continue
+		}
+		assert.NoError(t, err, "case %d should not have failed", i)
+	}
+
+	// step: the status should be cached until the next update
+	config := newFakeKeycloakConfig()
+	config.EnableTLSClientOCSP = true
+	checker, _ := newRevocationChecker(config)
+	certificate := ca.newClientCertificate(t, 10, responder.URL)
+	requests = 0
+	assert.NoError(t, checker.check(certificate, ca.certificate))
+	assert.NoError(t, checker.check(certificate, ca.certificate))
+	assert.Equal(t, 1, requests)
+}
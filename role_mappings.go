@@ -0,0 +1,96 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+const (
+	// defaultRoleMappingClaim is the claim the groups of the user are taken from
+	defaultRoleMappingClaim = "groups"
+)
+
+//
+// isValid checks the role mapping
+//
+func (r *RoleMapping) isValid() error {
+	if r.Value == "" {
+		return errors.New("the role mapping has no value to match")
+	}
+	if len(r.Roles) <= 0 {
+		return fmt.Errorf("the role mapping for: %s has no roles", r.Value)
+	}
+	for _, x := range r.Roles {
+		if x == "" {
+			return fmt.Errorf("the role mapping for: %s has a empty role", r.Value)
+		}
+	}
+
+	return nil
+}
+
+//
+// getClaim returns the claim the mapping matches against
+//
+func (r *RoleMapping) getClaim() string {
+	if r.Claim != "" {
+		return r.Claim
+	}
+
+	return defaultRoleMappingClaim
+}
+
+//
+// matches checks the claim of the user holds the value, the claim being either a string or a list
+//
+func (r *RoleMapping) matches(user *userContext) bool {
+	switch v := user.claims[r.getClaim()].(type) {
+	case string:
+		return v == r.Value
+	case []interface{}:
+		for _, x := range v {
+			if s, ok := x.(string); ok && s == r.Value {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+//
+// getUserRoles returns the roles of the user, along with the roles mapped from the groups or claims of the user
+//
+func (r *oauthProxy) getUserRoles(user *userContext) []string {
+	if len(r.config.RoleMappings) <= 0 {
+		return user.roles
+	}
+	roles := append([]string{}, user.roles...)
+	for _, mapping := range r.config.RoleMappings {
+		if !mapping.matches(user) {
+			continue
+		}
+		for _, x := range mapping.Roles {
+			if !containedIn(x, roles) {
+				roles = append(roles, x)
+			}
+		}
+	}
+
+	return roles
+}
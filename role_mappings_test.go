@@ -0,0 +1,113 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRoleMappingIsValid(t *testing.T) {
+	cs := []struct {
+		Mapping *RoleMapping
+		Ok      bool
+	}{
+		{Mapping: &RoleMapping{Value: "/admins", Roles: []string{"admin"}}, Ok: true},
+		{Mapping: &RoleMapping{Claim: "department", Value: "finance", Roles: []string{"invoices"}}, Ok: true},
+		{Mapping: &RoleMapping{Roles: []string{"admin"}}},
+		{Mapping: &RoleMapping{Value: "/admins"}},
+		{Mapping: &RoleMapping{Value: "/admins", Roles: []string{""}}},
+	}
+	for i, c := range cs {
+		err := c.Mapping.isValid()
+		if c.Ok {
+			assert.NoError(t, err, "case %d, unexpected error", i)
+		} else {
+			assert.Error(t, err, "case %d, expected an error", i)
+		}
+	}
+}
+
+func TestGetMappedUserRoles(t *testing.T) {
+	p, _, _ := newTestProxyService(nil)
+	p.config.RoleMappings = []*RoleMapping{
+		{Value: "/admins", Roles: []string{"admin", "test"}},
+		{Claim: "department", Value: "finance", Roles: []string{"invoices"}},
+	}
+	cs := []struct {
+		User     *userContext
+		Expected []string
+	}{
+		{
+			User:     &userContext{roles: []string{"test"}},
+			Expected: []string{"test"},
+		},
+		{
+			User: &userContext{
+				roles:  []string{"test"},
+				claims: map[string]interface{}{"groups": []interface{}{"/users", "/admins"}},
+			},
+			Expected: []string{"test", "admin"},
+		},
+		{
+			User:     &userContext{claims: map[string]interface{}{"department": "finance", "groups": "/admins"}},
+			Expected: []string{"admin", "test", "invoices"},
+		},
+		{
+			User:     &userContext{claims: map[string]interface{}{"department": []interface{}{"sales"}}},
+			Expected: []string{},
+		},
+	}
+	for i, c := range cs {
+		roles := p.getUserRoles(c.User)
+		if len(c.Expected) <= 0 {
+			assert.Empty(t, roles, "case %d", i)
+			continue
+		}
+		assert.Equal(t, c.Expected, roles, "case %d", i)
+	}
+}
+
+func TestAdmissionHandlerRoleMappings(t *testing.T) {
+	proxy := newFakeKeycloakProxyWithResources(t, []*Resource{
+		{
+			URL:     "/admin",
+			Methods: []string{"ANY"},
+			Roles:   []string{"admin"},
+		},
+	})
+	proxy.config.RoleMappings = []*RoleMapping{{Value: "/admins", Roles: []string{"admin"}}}
+	handler := proxy.admissionMiddleware()
+
+	cs := []struct {
+		Groups   []interface{}
+		HTTPCode int
+	}{
+		{Groups: []interface{}{"/admins"}, HTTPCode: http.StatusOK},
+		{Groups: []interface{}{"/users"}, HTTPCode: http.StatusForbidden},
+	}
+	for i, c := range cs {
+		cx := newFakeGinContext("GET", "/admin")
+		cx.Set(cxEnforce, proxy.config.Resources[0])
+		user := &userContext{audience: "test", claims: map[string]interface{}{"groups": c.Groups}}
+		cx.Set(userContextName, user)
+		handler(cx)
+		assert.Equal(t, c.HTTPCode, cx.Writer.Status(), "case %d", i)
+		assert.Empty(t, user.roles, "case %d, the roles of the user should not change", i)
+	}
+}
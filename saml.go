@@ -0,0 +1,630 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/coreos/go-oidc/jose"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	xmlnsSAMLMetadata  = "urn:oasis:names:tc:SAML:2.0:metadata"
+	xmlnsSAMLAssertion = "urn:oasis:names:tc:SAML:2.0:assertion"
+	xmlnsSAMLProtocol  = "urn:oasis:names:tc:SAML:2.0:protocol"
+
+	samlBindingRedirect = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect"
+	samlBindingPost     = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST"
+	samlStatusSuccess   = "urn:oasis:names:tc:SAML:2.0:status:Success"
+	samlMethodBearer    = "urn:oasis:names:tc:SAML:2.0:cm:bearer"
+	samlNameIDFormat    = "urn:oasis:names:tc:SAML:1.1:nameid-format:unspecified"
+
+	// samlClockSkew is the skew permitted on the validity of the assertions
+	samlClockSkew = 2 * time.Minute
+	// samlMaxCookieSize is the size above which the attributes are dropped from the session cookie
+	samlMaxCookieSize = 4000
+)
+
+// samlEmailAttributes are the attributes holding the email of the user, as mapped by keycloak
+var samlEmailAttributes = []string{"email", "urn:oid:1.2.840.113549.1.9.1"}
+
+//
+// samlServiceProvider verifies the assertions of the identity provider
+//
+type samlServiceProvider struct {
+	sync.Mutex
+	// the entity id of the identity provider
+	entityID string
+	// the single sign on url of the identity provider, using the redirect binding
+	ssoURL string
+	// the signing certificates of the identity provider
+	certificates []*x509.Certificate
+	// the ids of the assertions consumed, and when they expire
+	assertions map[string]time.Time
+}
+
+//
+// samlSession is the identity of the user held in the encrypted session cookie
+//
+type samlSession struct {
+	// Subject is the name id of the user
+	Subject string `json:"sub"`
+	// Expires is the unix time the session expires
+	Expires int64 `json:"exp"`
+	// Attributes are the attributes of the assertion
+	Attributes map[string][]string `json:"attrs,omitempty"`
+}
+
+//
+// newSAMLServiceProvider retrieves the metadata of the identity provider from a url or file
+//
+func newSAMLServiceProvider(location string, client *http.Client) (*samlServiceProvider, error) {
+	var content []byte
+	var err error
+	if strings.HasPrefix(location, "http://") || strings.HasPrefix(location, "https://") {
+		if client == nil {
+			client = http.DefaultClient
+		}
+		resp, err := client.Get(location)
+		if err != nil {
+			return nil, fmt.Errorf("unable to retrieve the saml metadata, %s", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("unable to retrieve the saml metadata, status: %d", resp.StatusCode)
+		}
+		if content, err = ioutil.ReadAll(resp.Body); err != nil {
+			return nil, err
+		}
+	} else if content, err = ioutil.ReadFile(location); err != nil {
+		return nil, fmt.Errorf("unable to read the saml metadata, %s", err)
+	}
+
+	return parseSAMLMetadata(content)
+}
+
+//
+// parseSAMLMetadata extracts the entity id, single sign on url and signing certificates of the identity provider
+//
+func parseSAMLMetadata(content []byte) (*samlServiceProvider, error) {
+	root, err := parseXMLDocument(content)
+	if err != nil {
+		return nil, fmt.Errorf("invalid saml metadata, %s", err)
+	}
+	descriptor := root
+	if root.is(xmlnsSAMLMetadata, "EntitiesDescriptor") {
+		if descriptor = root.getChild(xmlnsSAMLMetadata, "EntityDescriptor"); descriptor == nil {
+			return nil, errors.New("the saml metadata has no entity descriptor")
+		}
+	}
+	if !descriptor.is(xmlnsSAMLMetadata, "EntityDescriptor") {
+		return nil, errors.New("the saml metadata is not a entity descriptor")
+	}
+	idp := descriptor.getChild(xmlnsSAMLMetadata, "IDPSSODescriptor")
+	if idp == nil {
+		return nil, errors.New("the saml metadata has no identity provider descriptor")
+	}
+
+	sp := &samlServiceProvider{entityID: descriptor.getAttr("entityID"), assertions: make(map[string]time.Time)}
+	if sp.entityID == "" {
+		return nil, errors.New("the saml metadata has no entity id")
+	}
+	for _, x := range idp.getChildren(xmlnsSAMLMetadata, "SingleSignOnService") {
+		if x.getAttr("Binding") == samlBindingRedirect {
+			sp.ssoURL = x.getAttr("Location")
+			break
+		}
+	}
+	if sp.ssoURL == "" {
+		return nil, errors.New("the saml metadata has no single sign on service with the redirect binding")
+	}
+	for _, x := range idp.getChildren(xmlnsSAMLMetadata, "KeyDescriptor") {
+		if use := x.getAttr("use"); use != "" && use != "signing" {
+			continue
+		}
+		info := x.getChild(xmlnsDSig, "KeyInfo")
+		if info == nil {
+			continue
+		}
+		for _, data := range info.getChildren(xmlnsDSig, "X509Data") {
+			for _, cert := range data.getChildren(xmlnsDSig, "X509Certificate") {
+				decoded, err := decodeXMLBase64(cert.getText())
+				if err != nil {
+					return nil, errors.New("the saml metadata certificate is not base64 encoded")
+				}
+				certificate, err := x509.ParseCertificate(decoded)
+				if err != nil {
+					return nil, fmt.Errorf("invalid saml metadata certificate, %s", err)
+				}
+				sp.certificates = append(sp.certificates, certificate)
+			}
+		}
+	}
+	if len(sp.certificates) <= 0 {
+		return nil, errors.New("the saml metadata has no signing certificates")
+	}
+
+	return sp, nil
+}
+
+//
+// verifyResponse verifies the response of the identity provider, returning the session of the user
+//
+func (r *samlServiceProvider) verifyResponse(content []byte, audience, recipient, requestID string, duration time.Duration, now time.Time) (*samlSession, error) {
+	root, err := parseXMLDocument(content)
+	if err != nil {
+		return nil, fmt.Errorf("invalid saml response, %s", err)
+	}
+	if !root.is(xmlnsSAMLProtocol, "Response") {
+		return nil, errors.New("the document is not a saml response")
+	}
+	if x := root.getAttr("Destination"); x != "" && x != recipient {
+		return nil, fmt.Errorf("the saml response is destined for: %s", x)
+	}
+	if x := root.getAttr("InResponseTo"); x != "" && x != requestID {
+		return nil, errors.New("the saml response is not in response to the request")
+	}
+	if x := root.getChild(xmlnsSAMLAssertion, "Issuer"); x != nil && strings.TrimSpace(x.getText()) != r.entityID {
+		return nil, fmt.Errorf("the saml response was issued by: %s", strings.TrimSpace(x.getText()))
+	}
+	status := root.getChild(xmlnsSAMLProtocol, "Status")
+	if status == nil {
+		return nil, errors.New("the saml response has no status")
+	}
+	if code := status.getChild(xmlnsSAMLProtocol, "StatusCode"); code == nil || code.getAttr("Value") != samlStatusSuccess {
+		return nil, errors.New("the saml response is not successful")
+	}
+	if len(root.getChildren(xmlnsSAMLAssertion, "EncryptedAssertion")) > 0 {
+		return nil, errors.New("encrypted saml assertions are not supported")
+	}
+	assertions := root.getChildren(xmlnsSAMLAssertion, "Assertion")
+	if len(assertions) != 1 {
+		return nil, errors.New("the saml response must have a single assertion")
+	}
+	assertion := assertions[0]
+
+	// step: either the response or the assertion must be signed, the values are only read from the elements verified
+	switch err := verifyXMLSignature(root, r.certificates); err {
+	case nil:
+	case errXMLNotSigned:
+		if err := verifyXMLSignature(assertion, r.certificates); err != nil {
+			return nil, fmt.Errorf("invalid saml assertion signature, %s", err)
+		}
+	default:
+		return nil, fmt.Errorf("invalid saml response signature, %s", err)
+	}
+
+	if x := assertion.getChild(xmlnsSAMLAssertion, "Issuer"); x == nil || strings.TrimSpace(x.getText()) != r.entityID {
+		return nil, errors.New("the saml assertion was not issued by the identity provider")
+	}
+
+	// step: check the conditions of the assertion
+	conditions := assertion.getChild(xmlnsSAMLAssertion, "Conditions")
+	if conditions == nil {
+		return nil, errors.New("the saml assertion has no conditions")
+	}
+	if err := checkSAMLValidity(conditions, now); err != nil {
+		return nil, err
+	}
+	restrictions := conditions.getChildren(xmlnsSAMLAssertion, "AudienceRestriction")
+	if len(restrictions) <= 0 {
+		return nil, errors.New("the saml assertion has no audience restriction")
+	}
+	for _, x := range restrictions {
+		permitted := false
+		for _, y := range x.getChildren(xmlnsSAMLAssertion, "Audience") {
+			if strings.TrimSpace(y.getText()) == audience {
+				permitted = true
+			}
+		}
+		if !permitted {
+			return nil, errors.New("the saml assertion is not intended for the service provider")
+		}
+	}
+
+	// step: check the subject was confirmed for the request
+	subject := assertion.getChild(xmlnsSAMLAssertion, "Subject")
+	if subject == nil {
+		return nil, errors.New("the saml assertion has no subject")
+	}
+	nameID := subject.getChild(xmlnsSAMLAssertion, "NameID")
+	if nameID == nil || strings.TrimSpace(nameID.getText()) == "" {
+		return nil, errors.New("the saml assertion has no name id")
+	}
+	var expires time.Time
+	for _, x := range subject.getChildren(xmlnsSAMLAssertion, "SubjectConfirmation") {
+		data := x.getChild(xmlnsSAMLAssertion, "SubjectConfirmationData")
+		if x.getAttr("Method") != samlMethodBearer || data == nil {
+			continue
+		}
+		if data.getAttr("Recipient") != recipient || data.getAttr("InResponseTo") != requestID {
+			continue
+		}
+		notOnOrAfter, err := time.Parse(time.RFC3339, data.getAttr("NotOnOrAfter"))
+		if err != nil || !now.Before(notOnOrAfter.Add(samlClockSkew)) {
+			continue
+		}
+		expires = notOnOrAfter.Add(samlClockSkew)
+		break
+	}
+	if expires.IsZero() {
+		return nil, errors.New("the saml assertion has no valid bearer subject confirmation")
+	}
+
+	// step: the assertion can only be consumed once
+	if r.isReplay(assertion.getAttr("ID"), expires, now) {
+		return nil, errors.New("the saml assertion has already been consumed")
+	}
+
+	session := &samlSession{
+		Subject:    strings.TrimSpace(nameID.getText()),
+		Expires:    now.Add(duration).Unix(),
+		Attributes: make(map[string][]string),
+	}
+	if statement := assertion.getChild(xmlnsSAMLAssertion, "AuthnStatement"); statement != nil {
+		if x := statement.getAttr("SessionNotOnOrAfter"); x != "" {
+			if notOnOrAfter, err := time.Parse(time.RFC3339, x); err == nil {
+				session.Expires = notOnOrAfter.Unix()
+			}
+		}
+	}
+	for _, statement := range assertion.getChildren(xmlnsSAMLAssertion, "AttributeStatement") {
+		for _, x := range statement.getChildren(xmlnsSAMLAssertion, "Attribute") {
+			name := x.getAttr("Name")
+			for _, value := range x.getChildren(xmlnsSAMLAssertion, "AttributeValue") {
+				session.Attributes[name] = append(session.Attributes[name], value.getText())
+			}
+		}
+	}
+
+	return session, nil
+}
+
+//
+// checkSAMLValidity checks the validity period of the conditions
+//
+func checkSAMLValidity(conditions *xmlElement, now time.Time) error {
+	if x := conditions.getAttr("NotBefore"); x != "" {
+		notBefore, err := time.Parse(time.RFC3339, x)
+		if err != nil {
+			return errors.New("invalid not before of the saml assertion")
+		}
+		if now.Add(samlClockSkew).Before(notBefore) {
+			return errors.New("the saml assertion is not yet valid")
+		}
+	}
+	if x := conditions.getAttr("NotOnOrAfter"); x != "" {
+		notOnOrAfter, err := time.Parse(time.RFC3339, x)
+		if err != nil {
+			return errors.New("invalid not on or after of the saml assertion")
+		}
+		if !now.Before(notOnOrAfter.Add(samlClockSkew)) {
+			return errors.New("the saml assertion has expired")
+		}
+	}
+
+	return nil
+}
+
+//
+// isReplay records the assertion, checking if it was already consumed
+//
+func (r *samlServiceProvider) isReplay(id string, expires, now time.Time) bool {
+	r.Lock()
+	defer r.Unlock()
+	for k, v := range r.assertions {
+		if now.After(v) {
+			delete(r.assertions, k)
+		}
+	}
+	if _, found := r.assertions[id]; found || id == "" {
+		return true
+	}
+	r.assertions[id] = expires
+
+	return false
+}
+
+//
+// getSAMLRequestID returns the id of the authentication request of the relay state, so the response can be matched
+// to the request without holding any state
+//
+func getSAMLRequestID(key, relayState string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte("saml|" + relayState))
+
+	return "_" + hex.EncodeToString(mac.Sum(nil))
+}
+
+//
+// getSAMLAuthnRequest returns the authentication request of the service provider
+//
+func getSAMLAuthnRequest(id, issuer, destination, acs string, now time.Time) string {
+	return fmt.Sprintf(`<samlp:AuthnRequest xmlns:samlp="%s" xmlns:saml="%s" ID="%s" Version="2.0" IssueInstant="%s" `+
+		`Destination="%s" AssertionConsumerServiceURL="%s" ProtocolBinding="%s"><saml:Issuer>%s</saml:Issuer>`+
+		`<samlp:NameIDPolicy Format="%s" AllowCreate="true"/></samlp:AuthnRequest>`,
+		xmlnsSAMLProtocol, xmlnsSAMLAssertion, id, now.UTC().Format(time.RFC3339), escapeXML(destination),
+		escapeXML(acs), samlBindingPost, escapeXML(issuer), samlNameIDFormat)
+}
+
+func escapeXML(value string) string {
+	var content bytes.Buffer
+	xml.EscapeText(&content, []byte(value))
+
+	return content.String()
+}
+
+//
+// samlLoginHandler redirects the user to the identity provider with a authentication request, the state being
+// handed back as the relay state
+//
+func (r *oauthProxy) samlLoginHandler(cx *gin.Context) {
+	state := cx.Query("state")
+	if state == "" {
+		var err error
+		if state, err = r.getAuthorizationState("/"); err != nil {
+			cx.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	request := getSAMLAuthnRequest(getSAMLRequestID(r.config.EncryptionKey, state), r.config.ClientID,
+		r.saml.ssoURL, r.getPublicURL(cx, oauthURL+samlACSURL), time.Now())
+	var content bytes.Buffer
+	writer, _ := flate.NewWriter(&content, flate.BestCompression)
+	writer.Write([]byte(request))
+	writer.Close()
+
+	query := url.Values{}
+	query.Set("SAMLRequest", base64.StdEncoding.EncodeToString(content.Bytes()))
+	query.Set("RelayState", state)
+	separator := "?"
+	if strings.Contains(r.saml.ssoURL, "?") {
+		separator = "&"
+	}
+
+	r.redirectToURL(r.saml.ssoURL+separator+query.Encode(), cx)
+}
+
+//
+// samlACSHandler consumes the response of the identity provider, dropping the session cookie of the user
+//
+func (r *oauthProxy) samlACSHandler(cx *gin.Context) {
+	relayState := cx.Request.PostFormValue("RelayState")
+	content, err := base64.StdEncoding.DecodeString(cx.Request.PostFormValue("SAMLResponse"))
+	if err != nil || len(content) <= 0 {
+		cx.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	session, err := r.saml.verifyResponse(content, r.config.ClientID, r.getPublicURL(cx, oauthURL+samlACSURL),
+		getSAMLRequestID(r.config.EncryptionKey, relayState), r.config.SAMLSessionDuration, time.Now())
+	if err != nil {
+		log.WithFields(log.Fields{
+			"client_ip": cx.ClientIP(),
+			"error":     err.Error(),
+		}).Errorf("unable to verify the saml response")
+
+		r.accessForbidden(cx)
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"subject":  session.Subject,
+		"expires":  time.Unix(session.Expires, 0).Format(time.RFC822Z),
+		"duration": time.Unix(session.Expires, 0).Sub(time.Now()).String(),
+	}).Infof("issuing a new saml session for user: %s", session.Subject)
+
+	if err := r.dropSAMLCookie(cx, session); err != nil {
+		log.WithFields(log.Fields{
+			"error": err.Error(),
+		}).Errorf("failed to encrypt the saml session")
+
+		cx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	// step: decode the relay state, as the state of the callback
+	state := "/"
+	if r.config.EnableSignedState {
+		if redirect, err := decodeSignedState([]byte(r.config.EncryptionKey), relayState, time.Now()); err == nil {
+			state = redirect
+		}
+	} else if decoded, err := base64.StdEncoding.DecodeString(relayState); err == nil && len(decoded) > 0 {
+		state = string(decoded)
+	}
+	if !isRelativeRedirect(state) {
+		log.WithFields(log.Fields{
+			"state": state,
+		}).Warnf("the relay state is not a relative url, redirecting to the root")
+
+		state = "/"
+	}
+
+	r.redirectToURL(state, cx)
+}
+
+//
+// samlLogoutHandler clears the session of the user, the session at the identity provider is left as is
+//
+func (r *oauthProxy) samlLogoutHandler(cx *gin.Context) {
+	r.clearAllCookies(cx)
+	if redirect := cx.Query("redirect"); redirect != "" {
+		r.redirectToURL(redirect, cx)
+		return
+	}
+
+	cx.AbortWithStatus(http.StatusOK)
+}
+
+//
+// samlMetadataHandler serves the metadata of the service provider, for importing the client into keycloak
+//
+func (r *oauthProxy) samlMetadataHandler(cx *gin.Context) {
+	metadata := fmt.Sprintf(`<md:EntityDescriptor xmlns:md="%s" entityID="%s"><md:SPSSODescriptor `+
+		`AuthnRequestsSigned="false" WantAssertionsSigned="true" protocolSupportEnumeration="%s">`+
+		`<md:NameIDFormat>%s</md:NameIDFormat><md:AssertionConsumerService Binding="%s" Location="%s" index="0"/>`+
+		`</md:SPSSODescriptor></md:EntityDescriptor>`,
+		xmlnsSAMLMetadata, escapeXML(r.config.ClientID), xmlnsSAMLProtocol, samlNameIDFormat, samlBindingPost,
+		escapeXML(r.getPublicURL(cx, oauthURL+samlACSURL)))
+
+	cx.Data(http.StatusOK, "application/samlmetadata+xml", []byte(metadata))
+}
+
+//
+// samlMiddleware retrieves the user from the saml session cookie
+//
+func (r *oauthProxy) samlMiddleware() gin.HandlerFunc {
+	if r.saml == nil {
+		return func(cx *gin.Context) {}
+	}
+
+	return func(cx *gin.Context) {
+		if _, found := cx.Get(cxEnforce); !found {
+			return
+		}
+		session, err := r.getSAMLSession(cx, time.Now())
+		if err != nil {
+			return
+		}
+		cx.Set(cxSAML, session)
+		cx.Set(userContextName, r.newSAMLIdentity(session))
+	}
+}
+
+//
+// newSAMLIdentity creates the user context from the saml session, the attributes becoming the claims
+//
+func (r *oauthProxy) newSAMLIdentity(session *samlSession) *userContext {
+	claims := jose.Claims{}
+	for k, v := range session.Attributes {
+		if len(v) == 1 {
+			claims.Add(k, v[0])
+		} else {
+			claims.Add(k, v)
+		}
+	}
+	claims.Add("sub", session.Subject)
+
+	user := &userContext{
+		id:            session.Subject,
+		name:          session.Subject,
+		preferredName: session.Subject,
+		audience:      r.config.ClientID,
+		expiresAt:     time.Unix(session.Expires, 0),
+		roles:         session.Attributes[r.config.SAMLRolesAttribute],
+		claims:        claims,
+		bearerToken:   true,
+		saml:          true,
+	}
+	for _, x := range samlEmailAttributes {
+		if v := session.Attributes[x]; len(v) > 0 {
+			user.email = v[0]
+			break
+		}
+	}
+	if v := session.Attributes["username"]; len(v) > 0 {
+		user.preferredName = v[0]
+	}
+
+	return user
+}
+
+//
+// dropSAMLCookie drops the encrypted session of the user, the attributes other than the roles and email are dropped
+// when the cookie would be too large
+//
+func (r *oauthProxy) dropSAMLCookie(cx *gin.Context, session *samlSession) error {
+	value, err := encodeSAMLSession(session, r.config.EncryptionKey)
+	if err != nil {
+		return err
+	}
+	if len(value) > samlMaxCookieSize {
+		log.WithFields(log.Fields{
+			"subject": session.Subject,
+		}).Warnf("the saml session is too large for a cookie, dropping the attributes")
+
+		attributes := make(map[string][]string)
+		for _, x := range append([]string{r.config.SAMLRolesAttribute}, samlEmailAttributes...) {
+			if v, found := session.Attributes[x]; found {
+				attributes[x] = v
+			}
+		}
+		if value, err = encodeSAMLSession(&samlSession{Subject: session.Subject, Expires: session.Expires, Attributes: attributes}, r.config.EncryptionKey); err != nil {
+			return err
+		}
+	}
+	r.dropCookie(cx, r.config.CookieSAMLName, value, time.Unix(session.Expires, 0).Sub(time.Now()))
+
+	return nil
+}
+
+func encodeSAMLSession(session *samlSession, key string) (string, error) {
+	encoded, err := json.Marshal(session)
+	if err != nil {
+		return "", err
+	}
+
+	return encodeText(string(encoded), key)
+}
+
+//
+// clearSAMLCookie clears the saml session cookie
+//
+func (r *oauthProxy) clearSAMLCookie(cx *gin.Context) {
+	r.dropCookie(cx, r.config.CookieSAMLName, "", time.Duration(-10*time.Hour))
+}
+
+//
+// getSAMLSession returns the user from the saml session cookie
+//
+func (r *oauthProxy) getSAMLSession(cx *gin.Context, now time.Time) (*samlSession, error) {
+	cookie, err := cx.Request.Cookie(r.config.CookieSAMLName)
+	if err != nil || cookie.Value == "" {
+		return nil, ErrSessionNotFound
+	}
+	decoded, err := decodeText(cookie.Value, r.config.EncryptionKey)
+	if err != nil {
+		return nil, err
+	}
+	session := &samlSession{}
+	if err := json.Unmarshal([]byte(decoded), session); err != nil || session.Subject == "" {
+		return nil, ErrInvalidSession
+	}
+	if now.Unix() >= session.Expires {
+		return nil, ErrSessionNotFound
+	}
+
+	return session, nil
+}
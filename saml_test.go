@@ -0,0 +1,342 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	fakeSAMLEntityID = "http://127.0.0.1/auth/realms/hod-test"
+	fakeSAMLSSOURL   = "http://127.0.0.1/auth/realms/hod-test/protocol/saml"
+)
+
+func newFakeSAMLMetadata(certificate *x509.Certificate) string {
+	return `<md:EntitiesDescriptor xmlns:md="` + xmlnsSAMLMetadata + `" Name="urn:keycloak">
+  <md:EntityDescriptor entityID="` + fakeSAMLEntityID + `">
+    <md:IDPSSODescriptor protocolSupportEnumeration="` + xmlnsSAMLProtocol + `">
+      <md:KeyDescriptor use="signing">
+        <dsig:KeyInfo xmlns:dsig="` + xmlnsDSig + `">
+          <dsig:X509Data><dsig:X509Certificate>` + base64.StdEncoding.EncodeToString(certificate.Raw) + `</dsig:X509Certificate></dsig:X509Data>
+        </dsig:KeyInfo>
+      </md:KeyDescriptor>
+      <md:SingleSignOnService Binding="` + samlBindingPost + `" Location="` + fakeSAMLSSOURL + `/post"/>
+      <md:SingleSignOnService Binding="` + samlBindingRedirect + `" Location="` + fakeSAMLSSOURL + `"/>
+    </md:IDPSSODescriptor>
+  </md:EntityDescriptor>
+</md:EntitiesDescriptor>`
+}
+
+type fakeSAMLResponse struct {
+	id           string
+	issuer       string
+	audience     string
+	recipient    string
+	inResponseTo string
+	subject      string
+	roles        []string
+	issued       time.Time
+	// signResponse signs the response rather than the assertion
+	signResponse bool
+}
+
+func newFakeSAMLResponse(recipient, inResponseTo string, now time.Time) *fakeSAMLResponse {
+	return &fakeSAMLResponse{
+		id:           fmt.Sprintf("ID_%d", now.UnixNano()),
+		issuer:       fakeSAMLEntityID,
+		audience:     fakeClientID,
+		recipient:    recipient,
+		inResponseTo: inResponseTo,
+		subject:      "jdoe",
+		roles:        []string{fakeAdminRole, fakeTestRole},
+		issued:       now,
+	}
+}
+
+// getAssertion returns the assertion, with the signature placeholder
+func (r *fakeSAMLResponse) getAssertion(signature string) string {
+	var roles string
+	for _, x := range r.roles {
+		roles += `<saml:AttributeValue xmlns:xs="http://www.w3.org/2001/XMLSchema" xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance" xsi:type="xs:string">` + x + `</saml:AttributeValue>`
+	}
+
+	return `<saml:Assertion xmlns="` + xmlnsSAMLAssertion + `" ID="` + r.id + `" IssueInstant="` + r.issued.UTC().Format(time.RFC3339) + `" Version="2.0">
+    <saml:Issuer>` + r.issuer + `</saml:Issuer>` + signature + `
+    <saml:Subject>
+      <saml:NameID Format="` + samlNameIDFormat + `">` + r.subject + `</saml:NameID>
+      <saml:SubjectConfirmation Method="` + samlMethodBearer + `">
+        <saml:SubjectConfirmationData InResponseTo="` + r.inResponseTo + `" NotOnOrAfter="` + r.issued.Add(5*time.Minute).UTC().Format(time.RFC3339) + `" Recipient="` + r.recipient + `"/>
+      </saml:SubjectConfirmation>
+    </saml:Subject>
+    <saml:Conditions NotBefore="` + r.issued.UTC().Format(time.RFC3339) + `" NotOnOrAfter="` + r.issued.Add(time.Minute).UTC().Format(time.RFC3339) + `">
+      <saml:AudienceRestriction><saml:Audience>` + r.audience + `</saml:Audience></saml:AudienceRestriction>
+    </saml:Conditions>
+    <saml:AuthnStatement AuthnInstant="` + r.issued.UTC().Format(time.RFC3339) + `" SessionIndex="1" SessionNotOnOrAfter="` + r.issued.Add(10*time.Hour).UTC().Format(time.RFC3339) + `"/>
+    <saml:AttributeStatement>
+      <saml:Attribute Name="email"><saml:AttributeValue>jdoe@example.com</saml:AttributeValue></saml:Attribute>
+      <saml:Attribute Name="Role">` + roles + `</saml:Attribute>
+    </saml:AttributeStatement>
+  </saml:Assertion>`
+}
+
+// getResponse returns the response, with the signature and assertions placeholders
+func (r *fakeSAMLResponse) getResponse(signature, assertions string) string {
+	return `<samlp:Response xmlns:samlp="` + xmlnsSAMLProtocol + `" xmlns:saml="` + xmlnsSAMLAssertion + `" Destination="` + r.recipient + `" ID="R` + r.id + `" InResponseTo="` + r.inResponseTo + `" IssueInstant="` + r.issued.UTC().Format(time.RFC3339) + `" Version="2.0">
+  <saml:Issuer>` + r.issuer + `</saml:Issuer>` + signature + `
+  <samlp:Status><samlp:StatusCode Value="` + samlStatusSuccess + `"/></samlp:Status>
+  ` + assertions + `
+</samlp:Response>`
+}
+
+// sign returns the signed response
+func (r *fakeSAMLResponse) sign(key *rsa.PrivateKey) string {
+	if r.signResponse {
+		root, _ := parseXMLDocument([]byte(r.getResponse("", r.getAssertion(""))))
+		return r.getResponse(newFakeXMLSignature(key, "R"+r.id, canonicalize(root, nil, nil)), r.getAssertion(""))
+	}
+	root, _ := parseXMLDocument([]byte(r.getResponse("", r.getAssertion(""))))
+	assertion := root.getChild(xmlnsSAMLAssertion, "Assertion")
+
+	return r.getResponse("", r.getAssertion(newFakeXMLSignature(key, r.id, canonicalize(assertion, nil, nil))))
+}
+
+func TestParseSAMLMetadata(t *testing.T) {
+	_, certificate := newFakeSigningKey(t)
+	sp, err := parseSAMLMetadata([]byte(newFakeSAMLMetadata(certificate)))
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	assert.Equal(t, fakeSAMLEntityID, sp.entityID)
+	assert.Equal(t, fakeSAMLSSOURL, sp.ssoURL)
+	if assert.Len(t, sp.certificates, 1) {
+		assert.Equal(t, certificate.Raw, sp.certificates[0].Raw)
+	}
+
+	for i, x := range []string{
+		strings.Replace(newFakeSAMLMetadata(certificate), samlBindingRedirect, samlBindingPost, 1),
+		strings.Replace(newFakeSAMLMetadata(certificate), `use="signing"`, `use="encryption"`, 1),
+		strings.Replace(newFakeSAMLMetadata(certificate), "IDPSSODescriptor", "SPSSODescriptor", 2),
+		`<html></html>`,
+	} {
+		_, err := parseSAMLMetadata([]byte(x))
+		assert.Error(t, err, "case %d should have failed", i)
+	}
+}
+
+func TestSAMLVerifyResponse(t *testing.T) {
+	key, certificate := newFakeSigningKey(t)
+	other, _ := newFakeSigningKey(t)
+	sp, _ := parseSAMLMetadata([]byte(newFakeSAMLMetadata(certificate)))
+	recipient := "https://example.com" + oauthURL + samlACSURL
+	now := time.Now()
+
+	cases := []struct {
+		Response func(*fakeSAMLResponse) string
+		Now      time.Time
+		Ok       bool
+	}{
+		{Response: func(r *fakeSAMLResponse) string { return r.sign(key) }, Ok: true},
+		{Response: func(r *fakeSAMLResponse) string { r.signResponse = true; return r.sign(key) }, Ok: true},
+		{Response: func(r *fakeSAMLResponse) string { return r.sign(key) }, Now: now.Add(-5 * time.Minute)},
+		{Response: func(r *fakeSAMLResponse) string { return r.sign(key) }, Now: now.Add(10 * time.Minute)},
+		{Response: func(r *fakeSAMLResponse) string { return r.sign(other) }},
+		{Response: func(r *fakeSAMLResponse) string { return r.getResponse("", r.getAssertion("")) }},
+		{Response: func(r *fakeSAMLResponse) string { r.audience = "other"; return r.sign(key) }},
+		{Response: func(r *fakeSAMLResponse) string { r.issuer = "http://evil"; return r.sign(key) }},
+		{Response: func(r *fakeSAMLResponse) string { r.recipient = "https://evil.com/acs"; return r.sign(key) }},
+		{Response: func(r *fakeSAMLResponse) string { r.inResponseTo = "_other"; return r.sign(key) }},
+		{
+			// the attributes are modified after signing
+			Response: func(r *fakeSAMLResponse) string {
+				return strings.Replace(r.sign(key), ">"+fakeTestRole+"<", ">superuser<", 1)
+			},
+		},
+		{
+			// the signed assertion is wrapped in the evil assertion
+			Response: func(r *fakeSAMLResponse) string {
+				signed := r.getAssertion(newFakeXMLSignature(key, r.id, canonicalize(getFakeAssertion(r), nil, nil)))
+				r.subject = "admin"
+				evil := strings.Replace(r.getAssertion(""), "<saml:Subject>", `<saml:Advice>`+signed+`</saml:Advice><saml:Subject>`, 1)
+				return r.getResponse("", evil)
+			},
+		},
+		{
+			// a second, unsigned, assertion is added to the response
+			Response: func(r *fakeSAMLResponse) string {
+				signed := r.getAssertion(newFakeXMLSignature(key, r.id, canonicalize(getFakeAssertion(r), nil, nil)))
+				r.subject = "admin"
+				return r.getResponse("", r.getAssertion("")+signed)
+			},
+		},
+		{
+			Response: func(r *fakeSAMLResponse) string {
+				return strings.Replace(r.sign(key), samlStatusSuccess, "urn:oasis:names:tc:SAML:2.0:status:Requester", 1)
+			},
+		},
+	}
+	for i, c := range cases {
+		requestID := fmt.Sprintf("_request%d", i)
+		issued := now
+		if !c.Now.IsZero() {
+			issued = c.Now
+		}
+		response := newFakeSAMLResponse(recipient, requestID, issued)
+		response.id = fmt.Sprintf("ID_%d", i)
+		session, err := sp.verifyResponse([]byte(c.Response(response)), fakeClientID, recipient, requestID, time.Hour, now)
+		if !c.Ok {
+			assert.Error(t, err, "case %d should have failed", i)
+			continue
+		}
+		if !assert.NoError(t, err, "case %d should not have failed", i) {
+			continue
+		}
+		assert.Equal(t, "jdoe", session.Subject, "case %d, unexpected subject", i)
+		assert.Equal(t, now.Add(10*time.Hour).Unix(), session.Expires, "case %d, unexpected expiry", i)
+		assert.Equal(t, []string{fakeAdminRole, fakeTestRole}, session.Attributes["Role"], "case %d, unexpected roles", i)
+		assert.Equal(t, []string{"jdoe@example.com"}, session.Attributes["email"], "case %d, unexpected email", i)
+	}
+
+	// step: the assertion can only be consumed once
+	response := newFakeSAMLResponse(recipient, "_replay", now)
+	content := []byte(response.sign(key))
+	_, err := sp.verifyResponse(content, fakeClientID, recipient, "_replay", time.Hour, now)
+	assert.NoError(t, err)
+	_, err = sp.verifyResponse(content, fakeClientID, recipient, "_replay", time.Hour, now)
+	assert.Error(t, err, "the assertion should not be accepted twice")
+}
+
+func getFakeAssertion(r *fakeSAMLResponse) *xmlElement {
+	root, _ := parseXMLDocument([]byte(r.getResponse("", r.getAssertion(""))))
+
+	return root.getChild(xmlnsSAMLAssertion, "Assertion")
+}
+
+func TestSAMLLogin(t *testing.T) {
+	key, certificate := newFakeSigningKey(t)
+	metadata := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(newFakeSAMLMetadata(certificate)))
+	}))
+	defer metadata.Close()
+
+	config := newFakeKeycloakConfig()
+	config.SAMLMetadataURL = metadata.URL
+	config.SAMLRolesAttribute = "Role"
+	config.SAMLSessionDuration = time.Hour
+	config.CookieSAMLName = "kc-saml"
+	p, _, u := newTestProxyService(config)
+	p.upstream = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, "%s|%s|%s|%s", req.Header.Get("X-Auth-Subject"), req.Header.Get("X-Auth-Email"),
+			req.Header.Get("X-Auth-Roles"), req.Header.Get("X-Auth-Token"))
+	})
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+
+	// step: the user is redirected to the identity provider
+	resp, err := client.Get(u + fakeAdminRoleURL)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	assert.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode)
+	resp, err = client.Get(u + resp.Header.Get("Location"))
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	location, err := url.Parse(resp.Header.Get("Location"))
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	assert.Equal(t, fakeSAMLSSOURL, location.Scheme+"://"+location.Host+location.Path)
+	relayState := location.Query().Get("RelayState")
+	deflated, _ := base64.StdEncoding.DecodeString(location.Query().Get("SAMLRequest"))
+	request, err := ioutil.ReadAll(flate.NewReader(bytes.NewReader(deflated)))
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	authn, err := parseXMLDocument(request)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	assert.True(t, authn.is(xmlnsSAMLProtocol, "AuthnRequest"))
+	assert.Equal(t, u+oauthURL+samlACSURL, authn.getAttr("AssertionConsumerServiceURL"))
+
+	// step: the identity provider posts the response to the service provider
+	post := func(response string, relayState string) *http.Response {
+		resp, err := client.PostForm(u+oauthURL+samlACSURL, url.Values{
+			"SAMLResponse": {base64.StdEncoding.EncodeToString([]byte(response))},
+			"RelayState":   {relayState},
+		})
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		return resp
+	}
+	response := newFakeSAMLResponse(u+oauthURL+samlACSURL, authn.getAttr("ID"), time.Now())
+	resp = post(response.sign(key), "")
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode, "the response is not in response to the relay state")
+	resp = post(response.sign(key), relayState)
+	assert.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode)
+	assert.Equal(t, fakeAdminRoleURL, resp.Header.Get("Location"))
+	var session *http.Cookie
+	for _, x := range resp.Cookies() {
+		if x.Name == config.CookieSAMLName {
+			session = x
+		}
+	}
+	if !assert.NotNil(t, session, "the saml session cookie should have been dropped") {
+		t.FailNow()
+	}
+	resp = post(response.sign(key), relayState)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode, "the assertion should not be accepted twice")
+
+	// step: the user is permitted with the session
+	req, _ := http.NewRequest("GET", u+fakeAdminRoleURL, nil)
+	req.AddCookie(session)
+	resp, err = client.Do(req)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "jdoe|jdoe@example.com|"+fakeAdminRole+","+fakeTestRole+"|", string(body))
+
+	req, _ = http.NewRequest("GET", u+fakeAdminRoleURL, nil)
+	req.AddCookie(&http.Cookie{Name: config.CookieSAMLName, Value: "invalid"})
+	resp, err = client.Do(req)
+	if assert.NoError(t, err) {
+		assert.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode)
+	}
+
+	resp, err = client.Get(u + oauthURL + samlMetadataURL)
+	if assert.NoError(t, err) {
+		body, _ := ioutil.ReadAll(resp.Body)
+		assert.Contains(t, string(body), `Location="`+u+oauthURL+samlACSURL+`"`)
+	}
+}
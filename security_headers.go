@@ -0,0 +1,107 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// securityHeaders are the response headers added by the security filter
+var securityHeaders = []string{
+	"Strict-Transport-Security",
+	"X-Frame-Options",
+	"X-Content-Type-Options",
+	"X-Xss-Protection",
+	"Content-Security-Policy",
+	"Public-Key-Pins",
+}
+
+//
+// securityHeadersWriter adds the headers of the security filter to the response before the headers are written,
+// unless the upstream has set its own
+//
+type securityHeadersWriter struct {
+	gin.ResponseWriter
+	// the headers of the security filter
+	headers http.Header
+	// the headers have been updated
+	done bool
+}
+
+//
+// newSecurityHeadersWriter wraps the writer, holding the security headers already set on the response
+//
+func newSecurityHeadersWriter(w gin.ResponseWriter) *securityHeadersWriter {
+	headers := make(http.Header)
+	for _, name := range securityHeaders {
+		if values, found := w.Header()[name]; found {
+			headers[name] = values
+		}
+	}
+
+	return &securityHeadersWriter{ResponseWriter: w, headers: headers}
+}
+
+//
+// setHeaders adds the security headers missing from the response, once
+//
+func (r *securityHeadersWriter) setHeaders() {
+	if r.done {
+		return
+	}
+	r.done = true
+
+	header := r.ResponseWriter.Header()
+	for name, values := range r.headers {
+		if _, found := header[name]; !found {
+			header[name] = values
+		}
+	}
+}
+
+//
+// WriteHeader updates the headers before writing the status
+//
+func (r *securityHeadersWriter) WriteHeader(code int) {
+	r.setHeaders()
+	r.ResponseWriter.WriteHeader(code)
+}
+
+//
+// WriteHeaderNow updates the headers before they are written
+//
+func (r *securityHeadersWriter) WriteHeaderNow() {
+	r.setHeaders()
+	r.ResponseWriter.WriteHeaderNow()
+}
+
+//
+// Write updates the headers before the body is written
+//
+func (r *securityHeadersWriter) Write(content []byte) (int, error) {
+	r.setHeaders()
+	return r.ResponseWriter.Write(content)
+}
+
+//
+// WriteString updates the headers before the body is written
+//
+func (r *securityHeadersWriter) WriteString(content string) (int, error) {
+	r.setHeaders()
+	return r.ResponseWriter.WriteString(content)
+}
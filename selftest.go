@@ -0,0 +1,374 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-oidc/oauth2"
+	"github.com/coreos/go-oidc/oidc"
+	"github.com/urfave/cli"
+)
+
+const (
+	// selfTestTimeout is the timeout for each of the network checks
+	selfTestTimeout = time.Duration(10) * time.Second
+	// selfTestMaxClockSkew is the largest difference to the provider clock before the check fails
+	selfTestMaxClockSkew = time.Duration(30) * time.Second
+	// selfTestCertificateExpiry is how close to expiry a certificate can be before a warning
+	selfTestCertificateExpiry = time.Duration(14*24) * time.Hour
+)
+
+// errSelfTestSkipped indicates the check does not apply to the configuration
+var errSelfTestSkipped = errors.New("skipped")
+
+//
+// selfTest runs a series of checks against the configuration and the services it depends on
+//
+type selfTest struct {
+	// the configuration being tested
+	config *Config
+	// the client used for the provider checks
+	client *http.Client
+	// the provider configuration retrieved from discovery
+	provider *oidc.ProviderConfig
+	// the time reported by the provider
+	providerTime time.Time
+}
+
+//
+// selfTestCheck is a named check
+//
+type selfTestCheck struct {
+	name  string
+	check func() (string, error)
+}
+
+//
+// newSelfTestCommand creates the command to check the configuration and dependencies of the proxy
+//
+func newSelfTestCommand(config *Config) cli.Command {
+	return cli.Command{
+		Name:      "selftest",
+		Aliases:   []string{"doctor"},
+		Usage:     "checks the configuration, provider, store, upstream and tls files, printing a report",
+		UsageText: "keycloak-proxy selftest [options]",
+		Flags:     getOptions(),
+		Action: func(cx *cli.Context) error {
+			if err := parseConfig(cx, config); err != nil {
+				return printError(err.Error())
+			}
+			if failed := newSelfTest(config).run(cx.App.Writer); failed > 0 {
+				return cli.NewExitError(fmt.Sprintf("%d check(s) failed", failed), 1)
+			}
+
+			return nil
+		},
+	}
+}
+
+//
+// newSelfTest creates a self test for the configuration
+//
+func newSelfTest(config *Config) *selfTest {
+	return &selfTest{
+		config: config,
+		client: &http.Client{Timeout: selfTestTimeout},
+	}
+}
+
+//
+// run performs the checks, writing the report to the writer and returning the number of failed checks
+//
+func (r *selfTest) run(w io.Writer) int {
+	checks := []selfTestCheck{
+		{name: "configuration", check: r.checkConfiguration},
+		{name: "discovery", check: r.checkDiscovery},
+		{name: "token endpoint", check: r.checkTokenEndpoint},
+		{name: "clock skew", check: r.checkClockSkew},
+		{name: "store", check: r.checkStore},
+		{name: "upstream", check: r.checkUpstream},
+		{name: "tls", check: r.checkTLS},
+	}
+
+	failed := 0
+	for _, x := range checks {
+		message, err := x.check()
+		status := "ok"
+		switch {
+		case err == errSelfTestSkipped:
+			status = "skip"
+		case err != nil:
+			status = "fail"
+			message = err.Error()
+			failed++
+		}
+		fmt.Fprintf(w, "[%-4s] %-15s %s\n", status, x.name, message)
+	}
+	fmt.Fprintf(w, "\n%d of %d checks failed\n", failed, len(checks))
+
+	return failed
+}
+
+//
+// checkConfiguration validates the configuration
+//
+func (r *selfTest) checkConfiguration() (string, error) {
+	if err := r.config.isValid(); err != nil {
+		return "", err
+	}
+
+	return "the configuration is valid", nil
+}
+
+//
+// checkDiscovery retrieves the provider configuration from the discovery url
+//
+func (r *selfTest) checkDiscovery() (string, error) {
+	if r.config.DiscoveryURL == "" {
+		return "no discovery url configured", errSelfTestSkipped
+	}
+	location := strings.TrimSuffix(r.config.DiscoveryURL, "/") + "/.well-known/openid-configuration"
+	if strings.HasSuffix(r.config.DiscoveryURL, "/.well-known/openid-configuration") {
+		location = r.config.DiscoveryURL
+	}
+
+	resp, err := r.client.Get(location)
+	if err != nil {
+		return "", fmt.Errorf("unable to reach the discovery url: %s, %s", location, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("the discovery url: %s returned: %s", location, resp.Status)
+	}
+	if date, err := http.ParseTime(resp.Header.Get("Date")); err == nil {
+		r.providerTime = date
+	}
+	provider := &oidc.ProviderConfig{}
+	if err := json.NewDecoder(resp.Body).Decode(provider); err != nil {
+		return "", fmt.Errorf("unable to decode the provider configuration, %s", err)
+	}
+	r.provider = provider
+
+	return fmt.Sprintf("retrieved the provider configuration for issuer: %s", provider.Issuer), nil
+}
+
+//
+// checkTokenEndpoint authenticates the client against the token endpoint; the client credentials grant is used
+// as a probe, a client without service accounts is refused the grant but its credentials are still verified
+//
+func (r *selfTest) checkTokenEndpoint() (string, error) {
+	if r.provider == nil || r.provider.TokenEndpoint == nil {
+		return "no provider configuration available", errSelfTestSkipped
+	}
+	if r.config.ClientID == "" {
+		return "no client id configured", errSelfTestSkipped
+	}
+
+	request, err := http.NewRequest("POST", r.provider.TokenEndpoint.String(),
+		strings.NewReader(url.Values{"grant_type": []string{oauth2.GrantTypeClientCreds}}.Encode()))
+	if err != nil {
+		return "", err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.SetBasicAuth(url.QueryEscape(r.config.ClientID), url.QueryEscape(r.config.ClientSecret))
+
+	resp, err := r.client.Do(request)
+	if err != nil {
+		return "", fmt.Errorf("unable to reach the token endpoint: %s, %s", r.provider.TokenEndpoint, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK {
+		return fmt.Sprintf("the client: %s authenticated with the token endpoint", r.config.ClientID), nil
+	}
+	var response struct {
+		Error       string `json:"error"`
+		Description string `json:"error_description"`
+	}
+	json.NewDecoder(resp.Body).Decode(&response)
+
+	switch response.Error {
+	case "unauthorized_client", "unsupported_grant_type", "invalid_scope":
+		return fmt.Sprintf("the client: %s authenticated with the token endpoint", r.config.ClientID), nil
+	case "":
+		return "", fmt.Errorf("the token endpoint returned: %s", resp.Status)
+	}
+
+	return "", fmt.Errorf("the client: %s failed to authenticate, %s: %s", r.config.ClientID, response.Error, response.Description)
+}
+
+//
+// checkClockSkew compares the local clock to the provider, as skew will cause tokens to be rejected
+//
+func (r *selfTest) checkClockSkew() (string, error) {
+	if r.providerTime.IsZero() {
+		return "the provider time is not available", errSelfTestSkipped
+	}
+	// the date header only has a resolution of a second
+	skew := time.Now().Sub(r.providerTime)
+	if skew < 0 {
+		skew = -skew
+	}
+	skew = skew - skew%time.Second
+	if skew > selfTestMaxClockSkew {
+		return "", fmt.Errorf("the local clock differs from the provider by %s", skew)
+	}
+
+	return fmt.Sprintf("the local clock is within %s of the provider", skew), nil
+}
+
+//
+// checkStore connects to the store and performs a round trip of a key
+//
+func (r *selfTest) checkStore() (string, error) {
+	if r.config.StoreURL == "" {
+		return "no store configured", errSelfTestSkipped
+	}
+	store, err := createStorage(r.config)
+	if err != nil {
+		return "", fmt.Errorf("unable to create the store, %s", err)
+	}
+	defer store.Close()
+
+	key := fmt.Sprintf("%s-selftest-%d", prog, time.Now().UnixNano())
+	if err := store.Set(key, "ok"); err != nil {
+		return "", fmt.Errorf("unable to write to the store, %s", err)
+	}
+	defer store.Delete(key)
+	if value, err := store.Get(key); err != nil || value != "ok" {
+		return "", fmt.Errorf("unable to read back from the store, %v", err)
+	}
+
+	return fmt.Sprintf("connected to the store: %s", r.config.StoreURL), nil
+}
+
+//
+// checkUpstream dials the upstream endpoint
+//
+func (r *selfTest) checkUpstream() (string, error) {
+	if r.config.Upstream == "" {
+		return "no upstream configured", errSelfTestSkipped
+	}
+	if isUpstreamTemplate(r.config.Upstream) {
+		return "the upstream url is templated from the claims of the users", errSelfTestSkipped
+	}
+	location, err := url.Parse(r.config.Upstream)
+	if err != nil {
+		return "", fmt.Errorf("the upstream url is invalid, %s", err)
+	}
+
+	network, address := "tcp", dialAddress(location)
+	if location.Scheme == "unix" {
+		network, address = "unix", location.Host+location.Path
+	}
+	conn, err := net.DialTimeout(network, address, selfTestTimeout)
+	if err != nil {
+		return "", fmt.Errorf("unable to connect to the upstream: %s, %s", r.config.Upstream, err)
+	}
+	conn.Close()
+
+	return fmt.Sprintf("connected to the upstream: %s", r.config.Upstream), nil
+}
+
+//
+// checkTLS loads the certificates and keys, checking their expiry
+//
+func (r *selfTest) checkTLS() (string, error) {
+	var messages []string
+
+	pairs := r.config.TLSCertificates
+	if r.config.TLSCertificate != "" || r.config.TLSPrivateKey != "" {
+		pairs = append([]TLSCertificatePair{{Certificate: r.config.TLSCertificate, PrivateKey: r.config.TLSPrivateKey}}, pairs...)
+	}
+	for _, x := range pairs {
+		pair, err := tls.LoadX509KeyPair(x.Certificate, x.PrivateKey)
+		if err != nil {
+			return "", fmt.Errorf("unable to load the tls certificate: %s and private key, %s", x.Certificate, err)
+		}
+		certificate, err := x509.ParseCertificate(pair.Certificate[0])
+		if err != nil {
+			return "", fmt.Errorf("unable to parse the tls certificate: %s, %s", x.Certificate, err)
+		}
+		message, err := checkCertificateExpiry("tls certificate: "+x.Certificate, certificate)
+		if err != nil {
+			return "", err
+		}
+		messages = append(messages, message)
+	}
+
+	for _, x := range [][]string{
+		{"tls ca certificate", r.config.TLSCaCertificate},
+		{"tls client certificate", r.config.TLSClientCertificate},
+	} {
+		name, filename := x[0], x[1]
+		if filename == "" {
+			continue
+		}
+		content, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return "", fmt.Errorf("unable to read the %s, %s", name, err)
+		}
+		block, _ := pem.Decode(content)
+		if block == nil {
+			return "", fmt.Errorf("the %s: %s is not pem encoded", name, filename)
+		}
+		certificate, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return "", fmt.Errorf("unable to parse the %s, %s", name, err)
+		}
+		message, err := checkCertificateExpiry(name, certificate)
+		if err != nil {
+			return "", err
+		}
+		messages = append(messages, message)
+	}
+	if len(messages) == 0 {
+		return "no tls files configured", errSelfTestSkipped
+	}
+
+	return strings.Join(messages, ", "), nil
+}
+
+//
+// checkCertificateExpiry checks the certificate is valid now and warns when it's close to expiring
+//
+func checkCertificateExpiry(name string, certificate *x509.Certificate) (string, error) {
+	now := time.Now()
+	switch {
+	case now.Before(certificate.NotBefore):
+		return "", fmt.Errorf("the %s is not valid until %s", name, certificate.NotBefore.Format(time.RFC3339))
+	case now.After(certificate.NotAfter):
+		return "", fmt.Errorf("the %s expired on %s", name, certificate.NotAfter.Format(time.RFC3339))
+	case certificate.NotAfter.Sub(now) < selfTestCertificateExpiry:
+		return fmt.Sprintf("the %s expires soon on %s", name, certificate.NotAfter.Format(time.RFC3339)), nil
+	}
+
+	return fmt.Sprintf("the %s is valid until %s", name, certificate.NotAfter.Format(time.RFC3339)), nil
+}
@@ -0,0 +1,88 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSelfTest(t *testing.T) {
+	auth := newFakeOAuthServer()
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	defer upstream.Close()
+
+	cases := []struct {
+		Secret   string
+		Upstream string
+		Failed   int
+		Report   []string
+	}{
+		{
+			Secret:   fakeSecret,
+			Upstream: upstream.URL,
+			Report: []string{
+				"[ok  ] configuration",
+				"[ok  ] discovery",
+				"[ok  ] token endpoint",
+				"[ok  ] clock skew",
+				"[skip] store",
+				"[ok  ] upstream",
+				"[skip] tls",
+			},
+		},
+		{
+			Secret:   "bad_secret",
+			Upstream: "http://127.0.0.1:1",
+			Failed:   2,
+			Report: []string{
+				"[fail] token endpoint  the client: test failed to authenticate, invalid_client",
+				"[fail] upstream",
+				"2 of 7 checks failed",
+			},
+		},
+	}
+	for i, c := range cases {
+		config := newFakeKeycloakConfig()
+		config.DiscoveryURL = auth.getLocation()
+		config.ClientSecret = c.Secret
+		config.Upstream = c.Upstream
+		config.Listen = "127.0.0.1:0"
+		config.RedirectionURL = "http://127.0.0.1"
+
+		report := &bytes.Buffer{}
+		failed := newSelfTest(config).run(report)
+		assert.Equal(t, c.Failed, failed, "case %d, expected: %d failures, got: %d, report: %s", i, c.Failed, failed, report)
+		for _, x := range c.Report {
+			assert.Contains(t, report.String(), x, "case %d, report: %s", i, report)
+		}
+	}
+}
+
+func TestSelfTestTLS(t *testing.T) {
+	config := newFakeKeycloakConfig()
+	config.TLSCaCertificate = "does_not_exist"
+	_, err := newSelfTest(config).checkTLS()
+	assert.Error(t, err)
+
+	config.TLSCaCertificate = ""
+	_, err = newSelfTest(config).checkTLS()
+	assert.Equal(t, errSelfTestSkipped, err)
+}
@@ -16,10 +16,12 @@ limitations under the License.
 package main
 
 import (
+	"bytes"
+	"context"
 	"crypto/tls"
 	"crypto/x509"
-	"encoding/base64"
 	"fmt"
+	"html/template"
 	"io/ioutil"
 	"net"
 	"net/http"
@@ -28,11 +30,13 @@ import (
 	"path"
 	"runtime"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
-	"github.com/armon/go-proxyproto"
 	"github.com/coreos/go-oidc/jose"
+	"github.com/coreos/go-oidc/oauth2"
 	"github.com/coreos/go-oidc/oidc"
 	"github.com/elazarl/goproxy"
 	"github.com/gin-gonic/gin"
@@ -49,16 +53,103 @@ type oauthProxy struct {
 	client *oidc.Client
 	// the openid provider configuration
 	provider oidc.ProviderConfig
+	// the clients for the trusted issuers
+	issuers map[string]*oidc.Client
+	// the clients for the additional redirection urls, by host
+	redirects map[string]*oidc.Client
 	// the proxy client
 	upstream reverseProxy
 	// the upstream endpoint url
 	endpoint *url.URL
 	// the store interface
 	store storage
+	// the dpop proof verifier
+	dpop *dpopVerifier
+	// the verifier of the kerberos tickets
+	kerberos *kerberosAcceptor
+	// the saml service provider, when the realm is only exposed by saml
+	saml *samlServiceProvider
+	// the spiffe workload api source of the client certificate
+	spiffe *spiffeSource
+	// the tls configuration of the upstreams
+	upstreamTLS *upstreamTLS
+	// the upstream connection tracker
+	connections *connectionTracker
+	// the grace for a unreachable identity provider
+	grace *idpGrace
+	// the login loop detection
+	loops *loginLoops
+	// the cache of the token validations
+	tokens *tokenCache
+	// the compiled matcher of the resources
+	matcher *resourceMatcher
+	// the cache of the states handed to the unauthenticated requests
+	unauthenticated *unauthenticatedCache
+	// the proxy of the discovery document and keys of the provider
+	wellKnown *wellKnownProxy
+	// the pass-through of the token requests to the provider
+	passthrough *tokenPassthrough
+	// the admin api router
+	adminRouter *gin.Engine
+	// the active request captures
+	capture *requestCapture
 	// the prometheus handler
 	prometheusHandler http.Handler
+	// the metrics of the auth layer, if enabled
+	metrics *authMetrics
+	// the sanity limits of the tokens presented by the clients
+	limits *tokenLimits
+	// the authorization codes and states used on the callback
+	replays *callbackReplays
+	// the translation of the grpc-web requests
+	grpcWeb *grpcWebProxy
+	// the proof key exchange of the authorization code
+	pkce *pkce
+	// the upgraded connections and event streams open
+	upgrades *upgradeTracker
+	// the introspection of the opaque access tokens
+	introspection *tokenIntrospection
+	// the device authorization grant of the headless clients
+	device *deviceAuthorization
+	// the exchange of the access tokens for the upstream audience
+	exchange *tokenExchange
+	// the enforcement of the permissions of the authorization services
+	uma *umaEnforcer
+	// the enrichment of the claims from a external directory
+	enricher *enricher
+	// the verification of the identities asserted by the edge, in place of the login
+	edge *edgeVerifier
+	// the sessions logged out by the provider
+	backchannel *backchannelLogouts
+	// the end session endpoint of the provider the logout is redirected to
+	endSession string
+	// the template of the upstream endpoints of the users, if templated
+	upstreamTemplate *upstreamTemplate
+	// the router of the reloaded configuration, served by the listeners in place of the router
+	reloaded atomic.Value
+	// the cache of the signing keys of the provider
+	jwks *jwksCache
+	// closed when the proxy is stopped, ending the routines in the background
+	done chan struct{}
+	// ensures the proxy is stopped once
+	stopped sync.Once
 }
 
+// fragmentRedirectTemplate carries the url fragment through to the authorization handler
+var fragmentRedirectTemplate = template.Must(template.New("fragment").Parse(`<!DOCTYPE html>
+<html><head><meta charset="UTF-8"><title>Redirecting</title></head>
+<body>
+<script>
+  var target = {{.}};
+  if (window.location.hash.length > 1) {
+    target += "&fragment=" + encodeURIComponent(window.location.hash.substring(1));
+  }
+  window.location.replace(target);
+</script>
+<noscript><a href="{{.}}">Continue to login</a></noscript>
+</body></html>
+`))
+
 type reverseProxy interface {
 	ServeHTTP(rw http.ResponseWriter, req *http.Request)
 }
@@ -74,7 +165,14 @@ func init() {
 // newProxy create's a new proxy from configuration
 //
 func newProxy(config *Config) (*oauthProxy, error) {
-	var err error
+	return createProxy(config, nil)
+}
+
+//
+// createProxy create's a new proxy from configuration; a reloaded configuration carries over the state of the
+// previous proxy which outlives the configuration, i.e. the store while unchanged and the active captures
+//
+func createProxy(config *Config, previous *oauthProxy) (_ *oauthProxy, err error) {
 	// step: set the logging level
 	if config.LogJSONFormat {
 		log.SetFormatter(&log.JSONFormatter{})
@@ -82,6 +180,9 @@ func newProxy(config *Config) (*oauthProxy, error) {
 	if config.Verbose {
 		log.SetLevel(log.DebugLevel)
 	}
+	if config.LogMetadata {
+		addLogMetadataHook(config.LogMetadataService)
+	}
 	// step: disable the logging for http server - stop us from getting all those
 	// annoying EOF from tcp health checks
 	httplog.SetOutput(ioutil.Discard)
@@ -91,34 +192,267 @@ func newProxy(config *Config) (*oauthProxy, error) {
 	service := &oauthProxy{
 		config:            config,
 		prometheusHandler: prometheus.Handler(),
+		done:              make(chan struct{}),
+	}
+	// step: end the routines already started and close any store opened, should the proxy fail to create
+	defer func() {
+		if err != nil {
+			service.Stop()
+			if previous == nil || service.store != previous.store {
+				service.CloseStore()
+			}
+		}
+	}()
+	// step: the store is shared while it's unchanged, the connections and any file lock held by the previous
+	if previous != nil && previous.config.StoreURL == config.StoreURL {
+		service.store = previous.store
 	}
 
-	// step: parse the upstream endpoint
-	if service.endpoint, err = url.Parse(config.Upstream); err != nil {
+	// step: parse the upstream endpoint, or the template of the endpoints of the users
+	if isUpstreamTemplate(config.Upstream) {
+		if service.upstreamTemplate, err = newUpstreamTemplate(config.Upstream, config.UpstreamURLPattern); err != nil {
+			return nil, err
+		}
+		service.endpoint = &url.URL{Scheme: strings.SplitN(config.Upstream, "://", 2)[0]}
+	} else if service.endpoint, err = url.Parse(config.Upstream); err != nil {
 		return nil, err
 	}
+	for _, x := range config.VirtualHosts {
+		if x.endpoint, err = url.Parse(x.Upstream); err != nil {
+			return nil, err
+		}
+	}
+	service.compileResources()
 
 	// step: initialize the store if any
-	if config.StoreURL != "" {
-		if service.store, err = createStorage(config.StoreURL); err != nil {
+	if config.StoreURL != "" && service.store == nil {
+		if service.store, err = createStorage(config); err != nil {
+			return nil, err
+		}
+	}
+
+	// step: are we accepting dpop bound tokens?
+	if config.EnableDPoP {
+		service.dpop = newDPoPVerifier()
+	}
+
+	// step: are we limiting the tokens presented by the clients?
+	if config.MaxTokenSize > 0 || config.MaxTokenClaims > 0 || config.MaxTokenDepth > 0 {
+		service.limits = newTokenLimits(config.MaxTokenSize, config.MaxTokenClaims, config.MaxTokenDepth)
+	}
+
+	// step: are we tracking or limiting the upgraded connections?
+	if config.EnableMetrics || config.MaxUpgradedConnections > 0 || config.MaxUpgradedConnectionsPerUser > 0 {
+		service.upgrades = newUpgradeTracker(config.MaxUpgradedConnections, config.MaxUpgradedConnectionsPerUser)
+	}
+
+	// step: are we recording where the time goes in the auth layer?
+	if config.EnableMetrics {
+		service.metrics = newAuthMetrics()
+	}
+
+	// step: are we negotiating kerberos on the resources?
+	if config.SPNEGOKeytab != "" {
+		if service.kerberos, err = newKerberosAcceptor(config.SPNEGOKeytab); err != nil {
+			return nil, err
+		}
+	}
+
+	// step: are we retrieving the client certificate from the spiffe workload api?
+	var httpClient *http.Client
+	if config.SpiffeEndpointSocket != "" {
+		log.Infof("retrieving the client certificate from the spiffe workload api: %s", config.SpiffeEndpointSocket)
+		service.spiffe = newSpiffeSource(config.SpiffeEndpointSocket)
+		service.spiffe.start(service.done)
+		if err := service.spiffe.waitReady(spiffeStartupTimeout); err != nil {
+			return nil, err
+		}
+		httpClient = &http.Client{
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: &tls.Config{GetClientCertificate: service.spiffe.getClientCertificate},
+			},
+		}
+	}
+
+	// step: the token requests are passed through with the credentials of the callers
+	passthroughClient := httpClient
+
+	// step: are we authenticating to the provider other than by the client secret?
+	if config.ClientAuthMethod != "" && config.ClientAuthMethod != oauth2.AuthMethodClientSecretBasic {
+		if httpClient, err = newClientAuthClient(config, httpClient); err != nil {
 			return nil, err
 		}
 	}
 
-	// step: initialize the openid client
-	if !config.SkipTokenVerification {
-		service.client, service.provider, err = createOpenIDClient(config)
+	// step: initialize the saml service provider or the openid client
+	if config.SAMLMetadataURL != "" {
+		log.Infof("running as a saml service provider, retrieving the metadata from: %s", config.SAMLMetadataURL)
+		if service.saml, err = newSAMLServiceProvider(config.SAMLMetadataURL, httpClient); err != nil {
+			return nil, err
+		}
+	} else if config.EdgeAuthentication != "" {
+		log.Infof("consuming the identities asserted by the edge: %s, rather than logging in", config.EdgeAuthentication)
+		if service.edge, err = newEdgeVerifier(config, httpClient); err != nil {
+			return nil, err
+		}
+	} else if !config.SkipTokenVerification {
+		service.client, service.provider, err = createOpenIDClient(config, httpClient)
+		if err != nil {
+			return nil, err
+		}
+		// step: are we caching the signing keys of the provider?
+		if config.EnableJWKSCache {
+			if service.provider.KeysEndpoint == nil {
+				return nil, fmt.Errorf("the provider has no jwks endpoint for the signing keys")
+			}
+			service.jwks = newJWKSCache(httpClient, service.provider, config.ClientID, config.JWKSMinRefreshInterval)
+			service.jwks.start(config.JWKSRefreshInterval, service.done)
+		}
+		// step: are we redirecting back to a number of hosts?
+		service.redirects, err = createRedirectClients(config, service.provider, httpClient)
+		if err != nil {
+			return nil, err
+		}
+		// step: are we accepting the tokens from other providers?
+		service.issuers, err = createTrustedIssuers(config, httpClient)
 		if err != nil {
 			return nil, err
 		}
+		// step: are we fronting the applications of other providers?
+		if err := createProviders(config, httpClient, service.issuers); err != nil {
+			return nil, err
+		}
+		// step: are we permitting the sessions through a provider outage?
+		if config.EnableIdPGrace {
+			service.grace = newIdPGrace(httpClient, service.provider, config.ClientID, config.IdPGracePeriod)
+			service.grace.start(service.done)
+		}
+		// step: are we using a proof key on the code exchange?
+		if config.EnablePKCE {
+			if service.provider.TokenEndpoint == nil {
+				return nil, fmt.Errorf("the provider has no token endpoint for the pkce code exchange")
+			}
+			service.pkce = newPKCE(httpClient)
+		}
+		// step: are we accepting the device authorization grant?
+		if config.EnableDeviceAuthorization {
+			if service.provider.TokenEndpoint == nil {
+				return nil, fmt.Errorf("the provider has no token endpoint for the device code exchange")
+			}
+			endpoint := config.DeviceAuthorizationURL
+			if endpoint == "" {
+				if service.provider.AuthEndpoint == nil {
+					return nil, fmt.Errorf("the provider has no authorization endpoint to derive the device authorization endpoint from")
+				}
+				endpoint = strings.TrimSuffix(service.provider.AuthEndpoint.String(), "/") + "/device"
+			}
+			service.device = newDeviceAuthorization(httpClient, endpoint, service.provider.TokenEndpoint.String(),
+				config.ClientID, config.ClientSecret, config.Scopes)
+		}
+		// step: are we redirecting the logout to the provider?
+		if config.EnableLogoutRedirect {
+			if service.endSession, err = getEndSessionURL(config, service.provider); err != nil {
+				return nil, err
+			}
+		}
+		// step: are we rejecting the replays of the callback?
+		if config.EnableCallbackReplayProtection {
+			store, _ := service.store.(claimingStorage)
+			service.replays = newCallbackReplays(store)
+		}
+		// step: are we accepting the logouts of the provider?
+		if config.EnableBackchannelLogout {
+			store, _ := service.store.(expiringStorage)
+			service.backchannel = newBackchannelLogouts(store, config.BackchannelLogoutTTL)
+		}
+		// step: are we breaking the login loops?
+		if config.LoginLoopThreshold > 0 {
+			service.loops = newLoginLoops(config.LoginLoopThreshold, config.LoginLoopWindow)
+		}
+		// step: are we caching the token validations?
+		if config.TokenCacheSize > 0 {
+			var store expiringStorage
+			if config.EnableTokenCacheStore {
+				shared, ok := service.store.(expiringStorage)
+				if !ok {
+					return nil, fmt.Errorf("the store doesn't support expiring keys, required by the token cache")
+				}
+				store = shared
+			}
+			service.tokens = newTokenCache(config.TokenCacheSize, config.TokenCacheTTL, store)
+		}
+		// step: are we introspecting the opaque tokens?
+		if config.EnableTokenIntrospection {
+			endpoint := config.IntrospectionURL
+			if endpoint == "" {
+				if service.provider.TokenEndpoint == nil {
+					return nil, fmt.Errorf("the provider has no token endpoint to derive the introspection endpoint from")
+				}
+				endpoint = strings.TrimSuffix(service.provider.TokenEndpoint.String(), "/") + "/introspect"
+			}
+			service.introspection = newTokenIntrospection(httpClient, endpoint, config.ClientID, config.ClientSecret,
+				config.IntrospectionCacheSize, config.IntrospectionCacheTTL)
+		}
+		// step: are we exchanging the access tokens for the upstream audience?
+		if config.EnableTokenExchange {
+			if service.provider.TokenEndpoint == nil {
+				return nil, fmt.Errorf("the provider has no token endpoint for the token exchange")
+			}
+			clientID, clientSecret := config.ClientID, config.ClientSecret
+			if config.TokenExchangeClientID != "" {
+				clientID, clientSecret = config.TokenExchangeClientID, config.TokenExchangeClientSecret
+			}
+			service.exchange = newTokenExchange(httpClient, service.provider.TokenEndpoint.String(), clientID, clientSecret,
+				config.TokenExchangeAudience, config.TokenExchangeCacheSize)
+		}
+		// step: are we enforcing the permissions of the authorization services?
+		if config.EnableUMA {
+			if service.provider.TokenEndpoint == nil {
+				return nil, fmt.Errorf("the provider has no token endpoint for the uma enforcement")
+			}
+			audience := config.UMAAudience
+			if audience == "" {
+				audience = config.ClientID
+			}
+			service.uma = newUMAEnforcer(httpClient, service.provider.TokenEndpoint.String(), audience,
+				config.UMACacheSize, config.UMACacheTTL)
+		}
+		// step: are we caching the states of the unauthenticated requests?
+		if config.UnauthenticatedCacheSize > 0 {
+			service.unauthenticated = newUnauthenticatedCache(config.UnauthenticatedCacheSize, config.UnauthenticatedCacheTTL)
+		}
 	} else {
 		log.Warnf("TESTING ONLY CONFIG - the verification of the token have been disabled")
 	}
+	// step: are we enriching the claims from a external directory?
+	if config.EnrichmentURL != "" {
+		if service.enricher, err = newEnricher(config); err != nil {
+			return nil, err
+		}
+	}
+	// step: are we serving the discovery document and keys of the provider?
+	if config.EnableDiscoveryProxy {
+		service.wellKnown = newWellKnownProxy(httpClient)
+	}
+	// step: are we passing the token requests through to the provider?
+	if len(config.TokenPassthroughClients) > 0 {
+		service.passthrough = newTokenPassthrough(passthroughClient, config.TokenPassthroughClients, config.TokenPassthroughRateLimit)
+	}
 
 	if config.ClientID == "" && config.ClientSecret == "" {
 		log.Warnf("Note: client credentials are not set, depending on provider (confidential|public) you might be able to auth")
 	}
 
+	// step: are we running the admin api?
+	if config.ListenAdmin != "" {
+		service.capture = newRequestCapture()
+		if previous != nil && previous.capture != nil {
+			service.capture = previous.capture
+		}
+		service.createAdminEndpoints()
+	}
+
 	// step: are we running in forwarding more?
 	switch config.EnableForwarding {
 	case true:
@@ -144,6 +478,12 @@ func createReverseProxy(config *Config, service *oauthProxy) error {
 	for _, resource := range config.Resources {
 		log.Infof("protecting resources under uri: %s", resource)
 	}
+	for _, vhost := range config.VirtualHosts {
+		log.Infof("virtual host: %s, upstream url: %s", vhost.getName(), vhost.Upstream)
+		for _, resource := range vhost.Resources {
+			log.Infof("protecting resources for virtual host: %s under uri: %s", vhost.getName(), resource)
+		}
+	}
 	for name, value := range config.MatchClaims {
 		log.Infof("the token must container the claim: %s, required: %s", name, value)
 	}
@@ -220,11 +560,22 @@ func (r *oauthProxy) Run() (err error) {
 		caCertPool.AppendCertsFromPEM(caCert)
 		tlsConfig.ClientCAs = caCertPool
 		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+
+		// step: are we checking the client certificates have been revoked?
+		if r.config.TLSClientCRL != "" || r.config.EnableTLSClientOCSP {
+			log.Infof("enabling client certificate revocation checks, crl: %s, ocsp: %t, failure mode: %s",
+				r.config.TLSClientCRL, r.config.EnableTLSClientOCSP, r.config.TLSRevocationFailureMode)
+			checker, err := newRevocationChecker(r.config)
+			if err != nil {
+				return err
+			}
+			tlsConfig.VerifyPeerCertificate = checker.verifyPeerCertificate
+		}
 	}
 
 	server := &http.Server{
 		Addr:    r.config.Listen,
-		Handler: r.router,
+		Handler: http.HandlerFunc(r.serveRouter),
 	}
 
 	// step: create the listener
@@ -251,28 +602,44 @@ func (r *oauthProxy) Run() (err error) {
 		}
 	}
 
+	// step: wrap the listen in a proxy protocol, the header precedes any tls handshake
+	if r.config.EnableProxyProtocol {
+		log.Infof("enabling the proxy protocol on listener: %s", r.config.Listen)
+		listener = &proxyProtocolListener{listener}
+		server.ConnContext = getProxyProtocolContext
+	}
+
 	// step: configure tls
-	if r.config.TLSCertificate != "" && r.config.TLSPrivateKey != "" {
+	if r.config.useTLS() {
 		server.TLSConfig = tlsConfig
 		if tlsConfig.NextProtos == nil {
 			tlsConfig.NextProtos = []string{"http/1.1"}
 		}
-		if len(tlsConfig.Certificates) == 0 || r.config.TLSCertificate != "" || r.config.TLSPrivateKey != "" {
-			var err error
-			tlsConfig.Certificates = make([]tls.Certificate, 1)
-			if tlsConfig.Certificates[0], err = tls.LoadX509KeyPair(r.config.TLSCertificate, r.config.TLSPrivateKey); err != nil {
-				return err
-			}
+		certificates, err := newCertificateStore(r.config)
+		if err != nil {
+			return err
+		}
+		tlsConfig.GetCertificate = certificates.getCertificate
+		if r.config.EnableOCSPStapling {
+			certificates.startStapling()
 		}
-		log.Infof("tls enabled, certificate: %s, key: %s", r.config.TLSCertificate, r.config.TLSPrivateKey)
+		log.Infof("tls enabled, certificate: %s, key: %s, additional pairs: %d", r.config.TLSCertificate, r.config.TLSPrivateKey, len(r.config.TLSCertificates))
 
 		listener = tls.NewListener(listener, tlsConfig)
 	}
 
-	// step: wrap the listen in a proxy protocol
-	if r.config.EnableProxyProtocol {
-		log.Infof("enabling the proxy protocol on listener: %s", r.config.Listen)
-		listener = &proxyproto.Listener{listener}
+	// step: start the admin api if required
+	if r.config.ListenAdmin != "" {
+		if err := r.runAdmin(); err != nil {
+			return err
+		}
+	}
+
+	// step: start the envoy external authorization service if required
+	if r.config.ExtAuthzListen != "" {
+		if err := r.runExtAuthz(); err != nil {
+			return err
+		}
 	}
 
 	go func() {
@@ -296,6 +663,12 @@ func (r *oauthProxy) createUpstreamProxy(upstream *url.URL) error {
 		KeepAlive: r.config.UpstreamKeepaliveTimeout,
 		Timeout:   r.config.UpstreamTimeout,
 	}).Dial
+	// step: are we racing the addresses of the upstream?
+	if r.config.UpstreamAttemptTimeout > 0 {
+		dialer = newUpstreamDialer(&net.Dialer{
+			KeepAlive: r.config.UpstreamKeepaliveTimeout,
+		}, r.config.UpstreamTimeout, r.config.UpstreamAttemptTimeout).Dial
+	}
 
 	// step: are we using a unix socket?
 	if upstream != nil && upstream.Scheme == "unix" {
@@ -309,10 +682,25 @@ func (r *oauthProxy) createUpstreamProxy(upstream *url.URL) error {
 		upstream.Scheme = "http"
 	}
 
+	// step: track the upstream connections
+	r.connections = &connectionTracker{}
+	dialer = r.connections.dialer(dialer)
+	if r.config.EnableMetrics {
+		r.connections.register()
+	}
+
 	// step: create the upstream tls configure
 	tlsConfig := &tls.Config{
 		InsecureSkipVerify: r.config.SkipUpstreamTLSVerify,
 	}
+	if r.config.SkipUpstreamTLSVerify {
+		log.Warnf("the verification of the upstream tls has been switched off, this is insecure")
+	}
+
+	// step: present the svid from the spiffe workload api, the current svid is taken on each handshake
+	if r.spiffe != nil {
+		tlsConfig.GetClientCertificate = r.spiffe.getClientCertificate
+	}
 
 	// step: are we using a client certificate
 	// @TODO provide a means of reload on the client certificate when it expires. I'm not sure if it's just a
@@ -335,9 +723,44 @@ func (r *oauthProxy) createUpstreamProxy(upstream *url.URL) error {
 
 	// step: update the tls configuration of the reverse proxy
 	proxy.Tr = &http.Transport{
-		Dial:              dialer,
-		TLSClientConfig:   tlsConfig,
-		DisableKeepAlives: !r.config.UpstreamKeepalives,
+		Dial:                dialer,
+		TLSClientConfig:     tlsConfig,
+		DisableKeepAlives:   !r.config.UpstreamKeepalives,
+		IdleConnTimeout:     r.config.UpstreamIdleTimeout,
+		MaxIdleConns:        r.config.UpstreamMaxIdleConnections,
+		MaxIdleConnsPerHost: r.config.UpstreamMaxIdleConnectionsPerHost,
+	}
+	// step: are we sending the proxy protocol to the upstream? the header is per connection, so they can not be
+	// shared between clients
+	if r.config.UpstreamProxyProtocol {
+		log.Infof("enabling the proxy protocol on the upstream connections, keepalives are disabled")
+		proxy.Tr.Dial = nil
+		proxy.Tr.DialContext = newProxyProtocolDialer(dialer)
+		proxy.Tr.DisableKeepAlives = true
+	}
+	// step: are we using per upstream tls settings? the handshake is made by the proxy to select the settings
+	r.upstreamTLS = newUpstreamTLS(tlsConfig, r.config.UpstreamTLS)
+	if len(r.config.UpstreamTLS) > 0 {
+		dialContext := proxy.Tr.DialContext
+		if dialContext == nil {
+			dialContext = func(_ context.Context, network, address string) (net.Conn, error) {
+				return dialer(network, address)
+			}
+		}
+		proxy.Tr.DialTLSContext = r.upstreamTLS.dialTLS(dialContext)
+	}
+	// step: are we translating the grpc-web requests?
+	if r.config.EnableGRPCWeb {
+		r.grpcWeb = newGRPCWebProxy(proxy.Tr)
+	}
+	// step: are we authenticating to the upstreams?
+	if len(r.config.UpstreamAuth) > 0 {
+		proxy.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+			if auth := getUpstreamAuth(r.config.UpstreamAuth, req.URL.Host); auth != nil {
+				ctx.RoundTripper = &upstreamAuthTransport{auth: auth, transport: proxy.Tr}
+			}
+			return req, nil
+		})
 	}
 	r.upstream = proxy
 
@@ -367,32 +790,100 @@ func (r *oauthProxy) createEndpoints() error {
 		engine.Use(r.metricsMiddleware())
 	}
 
+	// step: are we permitting request capture from the admin api?
+	if r.capture != nil {
+		engine.Use(r.captureMiddleware())
+	}
+
+	// step: are we adding the debug headers for the allowlisted clients?
+	if r.config.EnableDebugHeaders {
+		engine.Use(r.debugHeadersMiddleware())
+	}
+
+	// step: enabling the bot detection?
+	if r.config.EnableBotDetection {
+		engine.Use(r.botDetectionMiddleware())
+	}
+
 	// step: enabling the security filter?
 	if r.config.EnableSecurityFilter {
 		engine.Use(r.securityMiddleware())
 	}
 
+	// step: are we normalizing the request path?
+	if r.config.EnablePathNormalization {
+		engine.Use(r.pathNormalizationMiddleware())
+	}
+
+	// step: are we handling method overrides?
+	if r.config.MethodOverride != "" {
+		engine.Use(r.methodOverrideMiddleware())
+	}
+
 	// step: add the routing
 	oauth := engine.Group(oauthURL)
 	{
 		oauth.Use(r.corsMiddleware(r.config.CrossOrigin))
-		oauth.GET(authorizationURL, r.oauthAuthorizationHandler)
-		oauth.GET(callbackURL, r.oauthCallbackHandler)
 		oauth.GET(healthURL, r.healthHandler)
-		oauth.GET(tokenURL, r.tokenHandler)
-		oauth.GET(expiredURL, r.expirationHandler)
-		oauth.GET(logoutURL, r.logoutHandler)
-		oauth.POST(loginURL, r.loginHandler)
+		oauth.GET(versionURL, r.versionHandler)
+		if r.saml != nil {
+			oauth.GET(authorizationURL, r.samlLoginHandler)
+			oauth.GET(logoutURL, r.samlLogoutHandler)
+			oauth.POST(samlACSURL, r.samlACSHandler)
+			oauth.GET(samlMetadataURL, r.samlMetadataHandler)
+		} else if r.edge == nil {
+			oauth.GET(authorizationURL, r.oauthAuthorizationHandler)
+			oauth.GET(tokenURL, r.tokenHandler)
+			oauth.GET(expiredURL, r.expirationHandler)
+			oauth.GET(logoutURL, r.logoutHandler)
+			oauth.POST(loginURL, r.loginHandler)
+		}
 		if r.config.EnableMetrics {
 			oauth.GET(metricsURL, r.metricsEndpointHandler)
 		}
+		if r.wellKnown != nil {
+			oauth.GET(discoveryURL, r.discoveryHandler)
+			oauth.GET(jwksURL, r.jwksHandler)
+		}
+		if r.passthrough != nil {
+			oauth.POST(providerTokenURL, r.tokenPassthroughHandler)
+		}
+		if r.device != nil {
+			oauth.POST(deviceURL, r.deviceAuthorizationHandler)
+			oauth.POST(deviceTokenURL, r.deviceTokenHandler)
+		}
+		if r.backchannel != nil {
+			oauth.POST(backchannelURL, r.backchannelLogoutHandler)
+		}
+		if r.config.EnableFrontchannelLogout {
+			oauth.GET(frontchannelURL, r.frontchannelLogoutHandler)
+		}
+	}
+
+	// step: the callback path is configurable, so may be outside the oauth handlers
+	if r.saml == nil && r.edge == nil {
+		engine.GET(r.config.getCallbackPath(), r.oauthCallbackHandler)
 	}
 
 	engine.Use(
 		r.entrypointMiddleware(),
+		r.crossOriginMiddleware(),
+		r.signedURLMiddleware(),
+		r.breakGlassMiddleware(),
+		r.spnegoMiddleware(),
+		r.samlMiddleware(),
 		r.authenticationMiddleware(),
+		r.cacheHeadersMiddleware(),
+		r.sessionLimitMiddleware(),
+		r.backchannelLogoutMiddleware(),
+		r.enrichmentMiddleware(),
 		r.admissionMiddleware(),
+		r.signedURLRedirectMiddleware(),
+		r.uploadRestrictionMiddleware(),
+		r.bodyInspectionMiddleware(),
 		r.headersMiddleware(r.config.AddClaims),
+		r.transferLimitMiddleware(),
+		r.streamingMiddleware(),
 		r.reverveProxyMiddleware())
 
 	r.router = engine
@@ -416,6 +907,29 @@ func (r *oauthProxy) createTemplates() error {
 		list = append(list, r.config.ForbiddenPage)
 	}
 
+	if r.config.EnableBotDetection && r.config.BotDetection.ChallengePage != "" {
+		log.Debugf("loading the custom challenge page: %s", r.config.BotDetection.ChallengePage)
+		list = append(list, r.config.BotDetection.ChallengePage)
+	}
+
+	for _, x := range r.config.VirtualHosts {
+		for _, page := range []string{x.SignInPage, x.ForbiddenPage} {
+			if page != "" && !containedIn(page, list) {
+				log.Debugf("loading the custom page: %s for virtual host: %s", page, x.getName())
+				list = append(list, page)
+			}
+		}
+	}
+
+	// step: the templates are named by the filename, so they must be unique
+	names := make(map[string]string, 0)
+	for _, x := range list {
+		if other, found := names[path.Base(x)]; found && other != x {
+			return fmt.Errorf("the templates: %s and %s have the same filename", other, x)
+		}
+		names[path.Base(x)] = x
+	}
+
 	if len(list) > 0 {
 		log.Infof("loading the custom templates: %s", strings.Join(list, ","))
 		r.router.LoadHTMLFiles(list...)
@@ -469,6 +983,28 @@ func (r *oauthProxy) DeleteRefreshToken(token jose.JWT) error {
 	return nil
 }
 
+//
+// Stop ends the routines of the proxy in the background, i.e. the refresh of the signing keys of the provider, the
+// spiffe stream and the forwarding logins; the listeners and the store are left open
+//
+func (r *oauthProxy) Stop() {
+	r.stopped.Do(func() {
+		close(r.done)
+	})
+}
+
+//
+// wait waits for the duration, returning false if the proxy is stopped in the meantime
+//
+func (r *oauthProxy) wait(duration time.Duration) bool {
+	select {
+	case <-r.done:
+		return false
+	case <-time.After(duration):
+		return true
+	}
+}
+
 //
 // Close is used to close off any resources
 //
@@ -484,8 +1020,8 @@ func (r *oauthProxy) CloseStore() error {
 // accessForbidden redirects the user to the forbidden page
 //
 func (r *oauthProxy) accessForbidden(cx *gin.Context) {
-	if r.config.hasCustomForbiddenPage() {
-		cx.HTML(http.StatusForbidden, path.Base(r.config.ForbiddenPage), r.config.TagData)
+	if page := r.getForbiddenPage(cx); page != "" {
+		cx.HTML(http.StatusForbidden, path.Base(page), r.config.TagData)
 		cx.Abort()
 		return
 	}
@@ -493,6 +1029,26 @@ func (r *oauthProxy) accessForbidden(cx *gin.Context) {
 	cx.AbortWithStatus(http.StatusForbidden)
 }
 
+//
+// resourceForbidden denies access to the resource, responding with a not found when the resource is hidden; the
+// true decision is recorded in the audit log
+//
+func (r *oauthProxy) resourceForbidden(cx *gin.Context, resource *Resource) {
+	if !resource.Hidden {
+		r.accessForbidden(cx)
+		return
+	}
+	log.WithFields(log.Fields{
+		"event":    "hidden_resource_denied",
+		"decision": "forbidden",
+		"resource": resource.getName(),
+		"method":   cx.Request.Method,
+		"uri":      cx.Request.URL.Path,
+	}).Warnf("access to the hidden resource denied, responding as not found")
+
+	cx.AbortWithStatus(http.StatusNotFound)
+}
+
 //
 // redirectToURL redirects the user and aborts the context
 //
@@ -506,12 +1062,43 @@ func (r *oauthProxy) redirectToURL(url string, cx *gin.Context) {
 //
 func (r *oauthProxy) redirectToAuthorization(cx *gin.Context) {
 	if r.config.NoRedirects {
+		if r.isNegotiable(cx) {
+			cx.Header(headerWWWAuthenticate, authNegotiate)
+		}
+		r.setBearerChallenge(cx)
 		cx.AbortWithStatus(http.StatusUnauthorized)
 		return
 	}
 
-	// step: add a state referrer to the authorization page
-	authQuery := fmt.Sprintf("?state=%s", base64.StdEncoding.EncodeToString([]byte(cx.Request.URL.RequestURI())))
+	// step: add a state referrer to the authorization page, the request uri includes the query string
+	uri := cx.Request.URL.RequestURI()
+	state, found := "", false
+	if r.unauthenticated != nil {
+		state, found = r.unauthenticated.get(uri, time.Now())
+	}
+	if !found {
+		var err error
+		if state, err = r.getAuthorizationState(uri); err != nil {
+			log.WithFields(log.Fields{
+				"error": err.Error(),
+			}).Errorf("unable to encode the authorization state")
+
+			cx.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+		if r.unauthenticated != nil {
+			r.unauthenticated.add(uri, state, time.Now())
+		}
+	}
+	authQuery := fmt.Sprintf("?state=%s", url.QueryEscape(state))
+	params := r.getRequestAuthorizationParams(cx)
+	if hint := r.getRequestLoginHint(cx); hint != "" {
+		params.Set(loginHintParam, hint)
+	}
+	if acr := getRequiredACR(cx); acr != "" {
+		params.Set(acrValuesParam, acr)
+	}
+	authQuery = addAuthorizationParams(authQuery, params)
 
 	// step: if verification is switched off, we can't authorization
 	if r.config.SkipTokenVerification {
@@ -521,5 +1108,60 @@ func (r *oauthProxy) redirectToAuthorization(cx *gin.Context) {
 		return
 	}
 
+	// step: xhr requests can't follow a cross origin redirect, so we hand back the login url instead
+	if r.isXHRLogin(cx) {
+		r.setBearerChallenge(cx)
+		cx.JSON(http.StatusUnauthorized, loginRequiredResponse{
+			Error:    "authentication required",
+			LoginURL: oauthURL + authorizationURL + authQuery,
+		})
+		cx.Abort()
+		return
+	}
+
+	// step: offer kerberos to the domain joined clients, the others continue to the login
+	if r.isNegotiable(cx) {
+		r.negotiateRedirect(oauthURL+authorizationURL+authQuery, cx)
+		return
+	}
+
+	// step: the fragment is never sent to the server, so we need the browser to hand it over
+	if r.config.PreserveFragments {
+		r.fragmentRedirect(oauthURL+authorizationURL+authQuery, cx)
+		return
+	}
+
 	r.redirectToURL(oauthURL+authorizationURL+authQuery, cx)
 }
+
+//
+// fragmentRedirect serves a small script which appends the url fragment to the authorization url and redirects
+//
+func (r *oauthProxy) fragmentRedirect(location string, cx *gin.Context) {
+	var content bytes.Buffer
+	if err := fragmentRedirectTemplate.Execute(&content, location); err != nil {
+		log.WithFields(log.Fields{
+			"error": err.Error(),
+		}).Errorf("failed to render the fragment redirection page")
+
+		r.redirectToURL(location, cx)
+		return
+	}
+
+	cx.Data(http.StatusOK, "text/html; charset=utf-8", content.Bytes())
+	cx.Abort()
+}
+
+//
+// isXHRLogin checks if the request is a xhr request and the login should be handed back rather than redirected
+//
+func (r *oauthProxy) isXHRLogin(cx *gin.Context) bool {
+	enabled := r.config.EnableXHRLogin
+	if ur, found := cx.Get(cxEnforce); found {
+		if resource := ur.(*Resource); resource.XHRLogin != nil {
+			enabled = *resource.XHRLogin
+		}
+	}
+
+	return enabled && isXHRRequest(cx.Request)
+}
@@ -18,11 +18,14 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"encoding/json"
+	"errors"
 	"io/ioutil"
 	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strings"
 	"testing"
 
 	log "github.com/Sirupsen/logrus"
@@ -123,7 +126,7 @@ func newTestProxyService(config *Config) (*oauthProxy, *fakeOAuthServer, string)
 	config.RedirectionURL = service.URL
 
 	// step: we need to update the client config
-	proxy.client, proxy.provider, err = createOpenIDClient(config)
+	proxy.client, proxy.provider, err = createOpenIDClient(config, nil)
 	if err != nil {
 		panic("failed to recreate the openid client, error: " + err.Error())
 	}
@@ -131,9 +134,70 @@ func newTestProxyService(config *Config) (*oauthProxy, *fakeOAuthServer, string)
 	return proxy, auth, service.URL
 }
 
+func TestUpstreamHeaderCasing(t *testing.T) {
+	// step: a upstream which hands back the raw request headers
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			var raw bytes.Buffer
+			reader := bufio.NewReader(conn)
+			for {
+				line, err := reader.ReadString('\n')
+				raw.WriteString(line)
+				if err != nil || line == "\r\n" {
+					break
+				}
+			}
+			conn.Write([]byte("HTTP/1.1 200 OK\r\nConnection: close\r\n\r\n"))
+			conn.Write(raw.Bytes())
+			conn.Close()
+		}
+	}()
+
+	config := newFakeKeycloakConfig()
+	config.Upstream = "http://" + listener.Addr().String()
+	config.UpstreamHeaderCasing = []string{"SOAPAction"}
+	config.UpstreamMaxHeaders = 12
+	p, _, u := newTestProxyService(config)
+	if !assert.NoError(t, p.createUpstreamProxy(p.endpoint)) {
+		t.FailNow()
+	}
+
+	request, _ := http.NewRequest("POST", u+fakeTestWhitelistedURL, nil)
+	request.Header.Set("SOAPAction", "urn:getUser")
+	resp, err := http.DefaultTransport.RoundTrip(request)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	content, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, string(content), "\r\nSOAPAction: urn:getUser\r\n")
+
+	// step: the number of headers is limited
+	for i := 0; i < 12; i++ {
+		request.Header.Add("X-Padding", "value")
+	}
+	resp, err = http.DefaultTransport.RoundTrip(request)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	resp.Body.Close()
+	assert.Equal(t, http.StatusRequestHeaderFieldsTooLarge, resp.StatusCode)
+}
+
 func newFakeKeycloakProxyWithResources(t *testing.T, resources []*Resource) *oauthProxy {
 	p, _, _ := newTestProxyService(nil)
 	p.config.Resources = resources
+	p.compileResources()
 	p.endpoint = &url.URL{
 		Host: "127.0.0.1",
 	}
@@ -178,6 +242,62 @@ func TestRedirectToAuthorizationUnauthorized(t *testing.T) {
 	assert.Equal(t, http.StatusUnauthorized, context.Writer.Status())
 }
 
+func TestRedirectToAuthorizationXHR(t *testing.T) {
+	disabled := false
+	config := newFakeKeycloakConfig()
+	config.EnableXHRLogin = true
+	config.Resources = append(config.Resources, &Resource{URL: "/no_xhr", Methods: []string{"ANY"}, XHRLogin: &disabled})
+	_, _, u := newTestProxyService(config)
+
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return errors.New("no redirects")
+		},
+	}
+
+	cases := []struct {
+		URI      string
+		XHR      bool
+		HTTPCode int
+	}{
+		{URI: fakeAdminRoleURL, XHR: true, HTTPCode: http.StatusUnauthorized},
+		{URI: fakeAdminRoleURL, HTTPCode: http.StatusTemporaryRedirect},
+		{URI: "/no_xhr", XHR: true, HTTPCode: http.StatusTemporaryRedirect},
+	}
+	for i, c := range cases {
+		request, _ := http.NewRequest("GET", u+c.URI, nil)
+		if c.XHR {
+			request.Header.Set("X-Requested-With", "XMLHttpRequest")
+		}
+		resp, _ := client.Do(request)
+		if !assert.NotNil(t, resp, "case %d, no response", i) {
+			continue
+		}
+		assert.Equal(t, c.HTTPCode, resp.StatusCode, "case %d, expected: %d, got: %d", i, c.HTTPCode, resp.StatusCode)
+		if c.HTTPCode == http.StatusUnauthorized {
+			response := loginRequiredResponse{}
+			assert.NoError(t, json.NewDecoder(resp.Body).Decode(&response))
+			assert.True(t, strings.HasPrefix(response.LoginURL, oauthURL+authorizationURL), "case %d, invalid login url", i)
+		}
+	}
+}
+
+func TestRedirectToAuthorizationFragment(t *testing.T) {
+	config := newFakeKeycloakConfig()
+	config.PreserveFragments = true
+	_, _, u := newTestProxyService(config)
+
+	resp, err := http.Get(u + fakeAdminRoleURL)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, resp.Header.Get("Content-Type"), "text/html")
+	content, _ := ioutil.ReadAll(resp.Body)
+	assert.Contains(t, string(content), "window.location.hash")
+	assert.Contains(t, string(content), authorizationURL+"?state=")
+}
+
 func TestCreateReverseProxy(t *testing.T) {
 	proxy, _, _ := newTestProxyService(nil)
 	err := createReverseProxy(proxy.config, proxy)
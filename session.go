@@ -17,6 +17,7 @@ package main
 
 import (
 	"strings"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/coreos/go-oidc/jose"
@@ -26,7 +27,7 @@ import (
 //
 // getIdentity retrieves the user identity from a request, either from a session cookie or a bearer token
 //
-func (r oauthProxy) getIdentity(cx *gin.Context) (*userContext, error) {
+func (r *oauthProxy) getIdentity(cx *gin.Context) (*userContext, error) {
 	// step: check for a bearer token or cookie with jwt token
 	isBearer := false
 	token, err := r.getAccessTokenFromCookie(cx)
@@ -34,6 +35,12 @@ func (r oauthProxy) getIdentity(cx *gin.Context) (*userContext, error) {
 		if err != ErrSessionNotFound {
 			return nil, err
 		}
+		// step: a opaque bearer token is validated by the provider
+		if r.introspection != nil {
+			if raw, err := getBearerToken(cx); err == nil && isOpaqueToken(raw) {
+				return r.getIntrospectedIdentity(raw)
+			}
+		}
 		// step: else attempt to grab token from the bearer token]
 		token, err = r.getTokenFromBearer(cx)
 		if err != nil {
@@ -42,20 +49,36 @@ func (r oauthProxy) getIdentity(cx *gin.Context) (*userContext, error) {
 		isBearer = true
 	}
 
-	// step: parse the access token and extract the user identity
-	user, err := extractIdentity(token)
-	if err != nil {
-		return nil, err
+	// step: parse the access token and extract the user identity, unless already extracted from a validated token
+	started := time.Now()
+	source := "token"
+	var user *userContext
+	if r.tokens != nil {
+		user = r.tokens.getIdentity(token, started)
+		r.metrics.recordIdentityLookup(user != nil)
+	}
+	if user == nil {
+		if user, err = extractIdentity(token); err != nil {
+			return nil, err
+		}
+	} else {
+		source = "cache"
 	}
 	user.bearerToken = isBearer
-
-	// step: add some logging
-	log.WithFields(log.Fields{
-		"id":    user.id,
-		"name":  user.name,
-		"email": user.email,
-		"roles": strings.Join(user.roles, ","),
-	}).Debugf("found the user identity: %s in the request", user.email)
+	took := time.Since(started)
+	r.metrics.observeExtraction(source, took)
+
+	// step: add some logging, the fields are only built when debugging as this is on every request
+	if log.GetLevel() >= log.DebugLevel {
+		log.WithFields(log.Fields{
+			"id":       user.id,
+			"name":     user.name,
+			"email":    user.email,
+			"roles":    strings.Join(user.roles, ","),
+			"source":   source,
+			"duration": took.String(),
+		}).Debugf("found the user identity: %s in the request", user.email)
+	}
 
 	return user, nil
 }
@@ -63,40 +86,81 @@ func (r oauthProxy) getIdentity(cx *gin.Context) (*userContext, error) {
 //
 // getTokenFromBearer attempt to retrieve token from bearer token
 //
-func (r oauthProxy) getTokenFromBearer(cx *gin.Context) (jose.JWT, error) {
+func (r *oauthProxy) getTokenFromBearer(cx *gin.Context) (jose.JWT, error) {
+	raw, err := getBearerToken(cx)
+	if err != nil {
+		return jose.JWT{}, err
+	}
+
+	return r.parseAccessToken(raw)
+}
+
+//
+// getBearerToken retrieves the raw token from the authorization header
+//
+func getBearerToken(cx *gin.Context) (string, error) {
 	auth := cx.Request.Header.Get(authorizationHeader)
 	if auth == "" {
-		return jose.JWT{}, ErrSessionNotFound
+		return "", ErrSessionNotFound
 	}
 
 	items := strings.Split(auth, " ")
 	if len(items) != 2 {
-		return jose.JWT{}, ErrInvalidSession
+		return "", ErrInvalidSession
 	}
 
-	return jose.ParseJWT(items[1])
+	return items[1], nil
 }
 
 //
 // getAccessTokenFromCookie attempt to grab access token from cookie
 //
-func (r oauthProxy) getAccessTokenFromCookie(cx *gin.Context) (jose.JWT, error) {
-	cookie := findCookie(r.config.CookieAccessName, cx.Request.Cookies())
-	if cookie == nil {
+func (r *oauthProxy) getAccessTokenFromCookie(cx *gin.Context) (jose.JWT, error) {
+	cookie, err := cx.Request.Cookie(r.config.CookieAccessName)
+	if err != nil {
 		return jose.JWT{}, ErrSessionNotFound
 	}
 
-	return jose.ParseJWT(cookie.Value)
+	return r.parseAccessToken(cookie.Value)
 }
 
 //
 // getRefreshTokenFromCookie returns the refresh token from the cookie if any
 //
-func (r oauthProxy) getRefreshTokenFromCookie(cx *gin.Context) (string, error) {
-	cookie := findCookie(r.config.CookieRefreshName, cx.Request.Cookies())
-	if cookie == nil {
+func (r *oauthProxy) getRefreshTokenFromCookie(cx *gin.Context) (string, error) {
+	cookie, err := cx.Request.Cookie(r.config.CookieRefreshName)
+	if err != nil {
 		return "", ErrSessionNotFound
 	}
 
 	return cookie.Value, nil
 }
+
+//
+// getSessionExpiry returns when the session expires, i.e. the expiry of the refresh token when refreshing is enabled,
+// else the access token
+//
+func (r *oauthProxy) getSessionExpiry(cx *gin.Context, user *userContext) time.Time {
+	expires := user.expiresAt
+	if !r.config.EnableRefreshTokens || user.isBearer() {
+		return expires
+	}
+	token, err := r.retrieveRefreshToken(cx, user)
+	if err != nil {
+		return expires
+	}
+	// note: the refresh token is opaque for some providers, keycloak issues a jwt
+	refresh, err := jose.ParseJWT(token)
+	if err != nil {
+		return expires
+	}
+	claims, err := refresh.Claims()
+	if err != nil {
+		return expires
+	}
+	if exp, found, err := claims.TimeClaim("exp"); err == nil && found && exp.After(expires) {
+		return exp
+	}
+
+	return expires
+}
@@ -0,0 +1,310 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/coreos/go-oidc/jose"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	sessionLimitReject      = "reject"
+	sessionLimitEvictOldest = "evict-oldest"
+
+	sessionKeyPrefix  = "sessions:"
+	claimSessionState = "session_state"
+	claimSessionID    = "sid"
+)
+
+// sessionLock serializes the updates to the session lists within this instance
+var sessionLock sync.Mutex
+
+//
+// sessionEntry is a session held in the subject's session list
+//
+type sessionEntry struct {
+	// ID is the identifier of the session
+	ID string `json:"id"`
+	// Created is the time the session was created
+	Created time.Time `json:"created"`
+	// Expires is the time the session can no longer be refreshed
+	Expires time.Time `json:"expires"`
+}
+
+//
+// getSessionID returns the identifier of the session, the provider's session claim is used if present as it survives
+// the token being refreshed, otherwise we fall back to a hash of the token
+//
+func getSessionID(token jose.JWT) string {
+	if claims, err := token.Claims(); err == nil {
+		for _, x := range []string{claimSessionState, claimSessionID} {
+			if v, found, err := claims.StringClaim(x); err == nil && found && v != "" {
+				return v
+			}
+		}
+	}
+
+	return getHashKey(&token)
+}
+
+//
+// getSessions retrieves the active sessions for the subject from the store
+//
+func (r *oauthProxy) getSessions(subject string) ([]*sessionEntry, error) {
+	value, err := r.store.Get(sessionKeyPrefix + subject)
+	if err != nil {
+		return nil, err
+	}
+	if value == "" {
+		return []*sessionEntry{}, nil
+	}
+	var sessions []*sessionEntry
+	if err := json.Unmarshal([]byte(value), &sessions); err != nil {
+		return nil, err
+	}
+
+	// step: filter out any expired sessions
+	var list []*sessionEntry
+	now := time.Now()
+	for _, x := range sessions {
+		if x.Expires.After(now) {
+			list = append(list, x)
+		}
+	}
+
+	return list, nil
+}
+
+//
+// putSessions places the sessions for the subject back in the store
+//
+func (r *oauthProxy) putSessions(subject string, sessions []*sessionEntry) error {
+	if len(sessions) <= 0 {
+		return r.store.Delete(sessionKeyPrefix + subject)
+	}
+	content, err := json.Marshal(sessions)
+	if err != nil {
+		return err
+	}
+
+	return r.store.Set(sessionKeyPrefix+subject, string(content))
+}
+
+//
+// registerSession adds the session to the subject's list, enforcing the concurrent session limit. Registering a
+// session which is already held, or renewing the previous session after a refresh, simply extends the expiration
+//
+func (r *oauthProxy) registerSession(user *userContext, previous string) error {
+	sessionLock.Lock()
+	defer sessionLock.Unlock()
+
+	sessions, err := r.getSessions(user.id)
+	if err != nil {
+		return err
+	}
+
+	id := getSessionID(user.token)
+	expires := user.expiresAt
+	if r.config.EnableRefreshTokens {
+		if refresh := time.Now().Add(r.config.IdleDuration * 2); refresh.After(expires) {
+			expires = refresh
+		}
+	}
+
+	for _, x := range sessions {
+		if x.ID == id || (previous != "" && x.ID == previous) {
+			x.ID = id
+			x.Expires = expires
+			return r.putSessions(user.id, sessions)
+		}
+	}
+	// step: a session being renewed must still be held, otherwise it has been evicted
+	if previous != "" {
+		return ErrInvalidSession
+	}
+
+	// step: are we over the limit?
+	if len(sessions) >= r.config.MaxSessions {
+		if r.config.SessionLimitAction != sessionLimitEvictOldest {
+			log.WithFields(log.Fields{
+				"event":    "session_rejected",
+				"subject":  user.id,
+				"email":    user.email,
+				"sessions": len(sessions),
+				"limit":    r.config.MaxSessions,
+			}).Warnf("user: %s has reached the concurrent session limit, rejecting the new session", user.email)
+
+			return ErrSessionLimitReached
+		}
+
+		sort.Sort(sessionsByCreated(sessions))
+		evicted := sessions[:len(sessions)-r.config.MaxSessions+1]
+		sessions = sessions[len(evicted):]
+		for _, x := range evicted {
+			log.WithFields(log.Fields{
+				"event":   "session_evicted",
+				"subject": user.id,
+				"email":   user.email,
+				"session": x.ID,
+				"created": x.Created.Format(time.RFC3339),
+			}).Warnf("user: %s has reached the concurrent session limit, evicting the oldest session", user.email)
+		}
+	}
+
+	sessions = append(sessions, &sessionEntry{ID: id, Created: time.Now(), Expires: expires})
+
+	log.WithFields(log.Fields{
+		"event":    "session_created",
+		"subject":  user.id,
+		"email":    user.email,
+		"session":  id,
+		"sessions": len(sessions),
+	}).Infof("registered a new session for user: %s", user.email)
+
+	return r.putSessions(user.id, sessions)
+}
+
+//
+// hasSession checks the session is still held by the subject, i.e. it has not been evicted
+//
+func (r *oauthProxy) hasSession(user *userContext) (bool, error) {
+	sessions, err := r.getSessions(user.id)
+	if err != nil {
+		return false, err
+	}
+	id := getSessionID(user.token)
+	for _, x := range sessions {
+		if x.ID == id {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+//
+// removeSession removes the session from the subject's list
+//
+func (r *oauthProxy) removeSession(user *userContext) error {
+	sessionLock.Lock()
+	defer sessionLock.Unlock()
+
+	sessions, err := r.getSessions(user.id)
+	if err != nil {
+		return err
+	}
+	id := getSessionID(user.token)
+	var list []*sessionEntry
+	for _, x := range sessions {
+		if x.ID != id {
+			list = append(list, x)
+		}
+	}
+	if len(list) == len(sessions) {
+		return nil
+	}
+
+	log.WithFields(log.Fields{
+		"event":   "session_removed",
+		"subject": user.id,
+		"email":   user.email,
+		"session": id,
+	}).Infof("removed the session for user: %s", user.email)
+
+	return r.putSessions(user.id, list)
+}
+
+//
+// removeSessionID removes the session from the subject's list by its identifier, i.e. when logged out by the provider
+//
+func (r *oauthProxy) removeSessionID(subject, id string) error {
+	sessionLock.Lock()
+	defer sessionLock.Unlock()
+
+	sessions, err := r.getSessions(subject)
+	if err != nil {
+		return err
+	}
+	var list []*sessionEntry
+	for _, x := range sessions {
+		if x.ID != id {
+			list = append(list, x)
+		}
+	}
+	if len(list) == len(sessions) {
+		return nil
+	}
+
+	return r.putSessions(subject, list)
+}
+
+//
+// sessionLimitMiddleware rejects any session which has been evicted by the concurrent session limit
+//
+func (r *oauthProxy) sessionLimitMiddleware() gin.HandlerFunc {
+	return func(cx *gin.Context) {
+		if r.config.MaxSessions <= 0 {
+			return
+		}
+		if _, found := cx.Get(cxEnforce); !found {
+			return
+		}
+		uc, found := cx.Get(userContextName)
+		if !found {
+			return
+		}
+		user := uc.(*userContext)
+		// step: bearer tokens are not sessions
+		if user.isBearer() {
+			return
+		}
+
+		held, err := r.hasSession(user)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error": err.Error(),
+			}).Errorf("unable to retrieve the sessions from the store")
+
+			cx.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+		if !held {
+			log.WithFields(log.Fields{
+				"event":     "session_revoked",
+				"subject":   user.id,
+				"email":     user.email,
+				"client_ip": cx.ClientIP(),
+			}).Warnf("the session for user: %s is no longer active, redirecting for authorization", user.email)
+
+			r.clearAllCookies(cx)
+			r.redirectToAuthorization(cx)
+		}
+	}
+}
+
+// sessionsByCreated sorts the sessions by creation time
+type sessionsByCreated []*sessionEntry
+
+func (s sessionsByCreated) Len() int           { return len(s) }
+func (s sessionsByCreated) Less(i, j int) bool { return s[i].Created.Before(s[j].Created) }
+func (s sessionsByCreated) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
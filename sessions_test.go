@@ -0,0 +1,125 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/coreos/go-oidc/jose"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeStore struct {
+	items map[string]string
+}
+
+func newFakeStore() *fakeStore {
+	return &fakeStore{items: make(map[string]string, 0)}
+}
+
+func (r *fakeStore) Set(key, value string) error    { r.items[key] = value; return nil }
+func (r *fakeStore) Get(key string) (string, error) { return r.items[key], nil }
+func (r *fakeStore) Delete(key string) error        { delete(r.items, key); return nil }
+func (r *fakeStore) Close() error                   { return nil }
+
+func newFakeSessionUser(t *testing.T, session string) *userContext {
+	claims := jose.Claims{"sub": "1e11e539-8256-4b3b-bda8-cc0d56cddb48"}
+	if session != "" {
+		claims[claimSessionState] = session
+	}
+
+	return &userContext{
+		id:        "1e11e539-8256-4b3b-bda8-cc0d56cddb48",
+		email:     "gambol99@gmail.com",
+		expiresAt: time.Now().Add(time.Duration(1) * time.Hour),
+		token:     *newFakeJWTToken(t, claims),
+	}
+}
+
+func newFakeSessionProxy(limit int, action string) *oauthProxy {
+	config := newFakeKeycloakConfig()
+	config.MaxSessions = limit
+	config.SessionLimitAction = action
+
+	return &oauthProxy{config: config, store: newFakeStore()}
+}
+
+func TestGetSessionID(t *testing.T) {
+	assert.Equal(t, "session", getSessionID(newFakeSessionUser(t, "session").token))
+	token := newFakeSessionUser(t, "").token
+	assert.Equal(t, getHashKey(&token), getSessionID(token))
+}
+
+func TestRegisterSessionReject(t *testing.T) {
+	proxy := newFakeSessionProxy(2, sessionLimitReject)
+	first, second, third := newFakeSessionUser(t, "1"), newFakeSessionUser(t, "2"), newFakeSessionUser(t, "3")
+
+	assert.NoError(t, proxy.registerSession(first, ""))
+	assert.NoError(t, proxy.registerSession(second, ""))
+	// step: registering an existing session should not count toward the limit
+	assert.NoError(t, proxy.registerSession(first, ""))
+	assert.Equal(t, ErrSessionLimitReached, proxy.registerSession(third, ""))
+
+	held, err := proxy.hasSession(third)
+	assert.NoError(t, err)
+	assert.False(t, held)
+
+	// step: logging out should free up a slot
+	assert.NoError(t, proxy.removeSession(first))
+	assert.NoError(t, proxy.registerSession(third, ""))
+}
+
+func TestRegisterSessionEvictOldest(t *testing.T) {
+	proxy := newFakeSessionProxy(2, sessionLimitEvictOldest)
+	first, second, third := newFakeSessionUser(t, "1"), newFakeSessionUser(t, "2"), newFakeSessionUser(t, "3")
+
+	assert.NoError(t, proxy.registerSession(first, ""))
+	time.Sleep(time.Duration(5) * time.Millisecond)
+	assert.NoError(t, proxy.registerSession(second, ""))
+	assert.NoError(t, proxy.registerSession(third, ""))
+
+	for i, c := range []struct {
+		User *userContext
+		Held bool
+	}{
+		{User: first},
+		{User: second, Held: true},
+		{User: third, Held: true},
+	} {
+		held, err := proxy.hasSession(c.User)
+		assert.NoError(t, err)
+		assert.Equal(t, c.Held, held, "case %d, expected held: %t", i, c.Held)
+	}
+
+	// step: an evicted session can not be renewed by a refresh
+	assert.Equal(t, ErrInvalidSession, proxy.registerSession(newFakeSessionUser(t, "4"), "1"))
+}
+
+func TestRegisterSessionRenew(t *testing.T) {
+	proxy := newFakeSessionProxy(1, sessionLimitReject)
+	user := newFakeSessionUser(t, "")
+	assert.NoError(t, proxy.registerSession(user, ""))
+
+	refreshed := newFakeSessionUser(t, "")
+	refreshed.token = *newFakeJWTToken(t, jose.Claims{"sub": user.id, "jti": "refreshed"})
+	assert.NoError(t, proxy.registerSession(refreshed, getSessionID(user.token)))
+
+	held, _ := proxy.hasSession(refreshed)
+	assert.True(t, held)
+	held, _ = proxy.hasSession(user)
+	assert.False(t, held)
+}
@@ -0,0 +1,164 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// signedURLExpires is the query parameter holding the expiration of the signed url
+	signedURLExpires = "kc-expires"
+	// signedURLSignature is the query parameter holding the signature of the signed url
+	signedURLSignature = "kc-signature"
+	// signedURLWindows is the number of windows the duration is divided into, the users within a window sharing a url
+	signedURLWindows = 4
+)
+
+//
+// signURL appends the expiration and signature to the url, the expiration is rounded down to a window of the duration
+// so the users requesting the same asset within the window are given the same url, allowing a cdn to cache it; the
+// url is valid for no longer than the duration, and no less than the duration minus a window
+//
+func signURL(key []byte, location *url.URL, duration time.Duration, now time.Time) *url.URL {
+	expires := now.Truncate(duration / signedURLWindows).Add(duration).Unix()
+
+	query := location.Query()
+	query.Del(signedURLExpires)
+	query.Del(signedURLSignature)
+	signature := getURLSignature(key, location.EscapedPath(), query, expires)
+	query.Set(signedURLExpires, fmt.Sprintf("%d", expires))
+	query.Set(signedURLSignature, signature)
+
+	signed := *location
+	signed.RawQuery = query.Encode()
+
+	return &signed
+}
+
+//
+// verifySignedURL checks the url has a valid signature which hasn't expired, returning the query minus the signature
+//
+func verifySignedURL(key []byte, location *url.URL, now time.Time) (url.Values, error) {
+	query := location.Query()
+	expires, err := strconv.ParseInt(query.Get(signedURLExpires), 10, 64)
+	if err != nil {
+		return nil, ErrSignedURLInvalid
+	}
+	signature := query.Get(signedURLSignature)
+	query.Del(signedURLExpires)
+	query.Del(signedURLSignature)
+
+	if !hmac.Equal([]byte(signature), []byte(getURLSignature(key, location.EscapedPath(), query, expires))) {
+		return nil, ErrSignedURLInvalid
+	}
+	if now.Unix() >= expires {
+		return nil, ErrSignedURLExpired
+	}
+
+	return query, nil
+}
+
+//
+// getURLSignature returns the hmac of the path, the remaining query parameters and the expiration
+//
+func getURLSignature(key []byte, path string, query url.Values, expires int64) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(fmt.Sprintf("%s\n%s\n%d", path, query.Encode(), expires)))
+
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+//
+// hasURLSignature checks if the request carries a url signature
+//
+func hasURLSignature(req *http.Request) bool {
+	query := req.URL.Query()
+
+	return query.Get(signedURLExpires) != "" || query.Get(signedURLSignature) != ""
+}
+
+//
+// signedURLMiddleware permits the GET and HEAD requests to a signed url resource carrying a valid signature through
+// without a token, as only those are signed; any other request, or one with an invalid or expired signature, falls
+// back to the authentication
+//
+func (r *oauthProxy) signedURLMiddleware() gin.HandlerFunc {
+	return func(cx *gin.Context) {
+		resource, found := cx.Get(cxEnforce)
+		if !found || !resource.(*Resource).SignedURLs || !hasURLSignature(cx.Request) {
+			cx.Next()
+			return
+		}
+		if cx.Request.Method != http.MethodGet && cx.Request.Method != http.MethodHead {
+			log.WithFields(log.Fields{
+				"method": cx.Request.Method,
+				"uri":    cx.Request.URL.Path,
+			}).Warnf("the signed urls only permit the GET and HEAD requests, falling back to authentication")
+
+			cx.Next()
+			return
+		}
+
+		query, err := verifySignedURL([]byte(r.config.SignedURLKey), cx.Request.URL, time.Now())
+		if err != nil {
+			log.WithFields(log.Fields{
+				"uri":   cx.Request.URL.Path,
+				"error": err.Error(),
+			}).Warnf("unable to verify the signed url, falling back to authentication")
+
+			cx.Next()
+			return
+		}
+
+		// step: strip the signature from the upstream request and skip the authentication
+		cx.Request.URL.RawQuery = query.Encode()
+		delete(cx.Keys, cxEnforce)
+		cx.Set(cxSignedURL, true)
+
+		cx.Next()
+	}
+}
+
+//
+// signedURLRedirectMiddleware redirects an admitted request for a signed url resource to the signed url, so the
+// asset can be served from a cdn in front of the proxy
+//
+func (r *oauthProxy) signedURLRedirectMiddleware() gin.HandlerFunc {
+	return func(cx *gin.Context) {
+		resource, found := cx.Get(cxEnforce)
+		if !found || !resource.(*Resource).SignedURLs {
+			return
+		}
+		if cx.Request.Method != http.MethodGet && cx.Request.Method != http.MethodHead {
+			return
+		}
+
+		signed := signURL([]byte(r.config.SignedURLKey), cx.Request.URL, r.config.SignedURLDuration, time.Now())
+
+		r.redirectToURL((&url.URL{Path: signed.Path, RawPath: signed.RawPath, RawQuery: signed.RawQuery}).String(), cx)
+	}
+}
@@ -0,0 +1,137 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/coreos/go-oidc/jose"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSignedURLs(t *testing.T) {
+	key := []byte("signing-key")
+	now := time.Unix(1500000000, 0)
+	location, _ := url.Parse("/assets/video.mp4?quality=hd")
+	signed := signURL(key, location, time.Minute, now)
+
+	assert.Equal(t, "/assets/video.mp4", signed.Path)
+	assert.Equal(t, "hd", signed.Query().Get("quality"))
+	assert.NotEmpty(t, signed.Query().Get(signedURLSignature))
+	// the url is the same within the window
+	assert.Equal(t, signed.String(), signURL(key, location, time.Minute, now.Add(10*time.Second)).String())
+	assert.NotEqual(t, signed.String(), signURL(key, location, time.Minute, now.Add(15*time.Second)).String())
+	// resigning replaces the signature
+	assert.Equal(t, signed.String(), signURL(key, signed, time.Minute, now).String())
+
+	tamper := func(fn func(*url.URL)) *url.URL {
+		x := *signed
+		fn(&x)
+		return &x
+	}
+	cases := []struct {
+		Key      []byte
+		URL      *url.URL
+		Now      time.Time
+		Expected error
+	}{
+		{URL: signed, Now: now},
+		{URL: signed, Now: now.Add(59 * time.Second)},
+		// the url is valid for no longer than the duration
+		{URL: signed, Now: now.Add(time.Minute), Expected: ErrSignedURLExpired},
+		{Key: []byte("other"), URL: signed, Now: now, Expected: ErrSignedURLInvalid},
+		{URL: tamper(func(x *url.URL) { x.Path = "/assets/other.mp4" }), Now: now, Expected: ErrSignedURLInvalid},
+		{URL: tamper(func(x *url.URL) { x.RawQuery += "&quality=4k" }), Now: now, Expected: ErrSignedURLInvalid},
+		{URL: location, Now: now, Expected: ErrSignedURLInvalid},
+	}
+	for i, c := range cases {
+		if c.Key == nil {
+			c.Key = key
+		}
+		query, err := verifySignedURL(c.Key, c.URL, c.Now)
+		assert.Equal(t, c.Expected, err, "case %d, expected: %v, got: %v", i, c.Expected, err)
+		if err == nil {
+			assert.Equal(t, "quality=hd", query.Encode(), "case %d, the signature should be removed", i)
+		}
+	}
+}
+
+func TestSignedURLMiddleware(t *testing.T) {
+	config := newFakeKeycloakConfig()
+	config.SignedURLKey = "signing-key"
+	config.SignedURLDuration = time.Minute
+	config.Resources = append([]*Resource{
+		{
+			URL:        "/assets",
+			Methods:    []string{"ANY"},
+			SignedURLs: true,
+		},
+	}, config.Resources...)
+	_, auth, u := newTestProxyService(config)
+
+	token, err := jose.NewSignedJWT(auth.claims, auth.signer)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	location, _ := url.Parse("/assets/video.mp4")
+	signed := signURL([]byte(config.SignedURLKey), location, config.SignedURLDuration, time.Now())
+	expired := signURL([]byte(config.SignedURLKey), location, config.SignedURLDuration, time.Now().Add(-time.Hour))
+
+	cases := []struct {
+		Method   string
+		URI      string
+		Token    bool
+		HTTPCode int
+		Signed   bool
+	}{
+		{URI: location.String(), HTTPCode: http.StatusTemporaryRedirect},
+		// note: the fake upstream doesn't write a response
+		{URI: signed.String(), HTTPCode: http.StatusNotFound},
+		{URI: expired.String(), HTTPCode: http.StatusTemporaryRedirect},
+		{URI: location.String(), Token: true, HTTPCode: http.StatusTemporaryRedirect, Signed: true},
+		{URI: expired.String(), Token: true, HTTPCode: http.StatusTemporaryRedirect, Signed: true},
+		{Method: "POST", URI: location.String(), Token: true, HTTPCode: http.StatusNotFound},
+		// the signature of a GET doesn't permit the other methods
+		{Method: "POST", URI: signed.String(), HTTPCode: http.StatusTemporaryRedirect},
+		{Method: "DELETE", URI: signed.String(), HTTPCode: http.StatusTemporaryRedirect},
+		{Method: "HEAD", URI: signed.String(), HTTPCode: http.StatusNotFound},
+	}
+	for i, c := range cases {
+		if c.Method == "" {
+			c.Method = "GET"
+		}
+		request, _ := http.NewRequest(c.Method, u+c.URI, nil)
+		if c.Token {
+			request.Header.Set(authorizationHeader, "Bearer "+token.Encode())
+		}
+		resp, err := http.DefaultTransport.RoundTrip(request)
+		if !assert.NoError(t, err, "case %d, unable to make the request", i) {
+			continue
+		}
+		resp.Body.Close()
+		assert.Equal(t, c.HTTPCode, resp.StatusCode, "case %d, expected: %d, got: %d", i, c.HTTPCode, resp.StatusCode)
+		if c.Signed {
+			redirect, err := url.Parse(resp.Header.Get("Location"))
+			if assert.NoError(t, err, "case %d, invalid location", i) {
+				_, err := verifySignedURL([]byte(config.SignedURLKey), redirect, time.Now())
+				assert.NoError(t, err, "case %d, the redirect should be a signed url", i)
+			}
+		}
+	}
+}
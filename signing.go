@@ -0,0 +1,327 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	signingTypeAWSv4 = "aws-sigv4"
+	signingTypeHMAC  = "hmac"
+
+	awsSigningAlgorithm  = "AWS4-HMAC-SHA256"
+	awsDateFormat        = "20060102T150405Z"
+	awsUnsignedPayload   = "UNSIGNED-PAYLOAD"
+	headerAmzDate        = "X-Amz-Date"
+	headerAmzContentHash = "X-Amz-Content-Sha256"
+	headerAmzToken       = "X-Amz-Security-Token"
+
+	defaultSigningHeader          = "X-Auth-Signature"
+	defaultSigningTimestampHeader = "X-Auth-Signature-Timestamp"
+
+	// defaultSigningMaxBodySize is the maximum size of the request body read in to be signed
+	defaultSigningMaxBodySize = 10 << 20
+)
+
+//
+// isValid validates the upstream signing configuration
+//
+func (r *UpstreamSigning) isValid() error {
+	if r.MaxBodySize < 0 {
+		return fmt.Errorf("the signing max body size must be zero or greater")
+	}
+	switch r.Type {
+	case signingTypeAWSv4:
+		if r.Region == "" {
+			return fmt.Errorf("the aws signing region has not been set")
+		}
+		if r.Service == "" {
+			return fmt.Errorf("the aws signing service has not been set")
+		}
+		if r.AccessKey == "" || r.SecretKey == "" {
+			return fmt.Errorf("the aws signing requires both an access and secret key")
+		}
+	case signingTypeHMAC:
+		if r.SecretKey == "" {
+			return fmt.Errorf("the hmac signing requires a secret key")
+		}
+	default:
+		return fmt.Errorf("unsupported upstream signing type: %s, should be %s or %s", r.Type, signingTypeAWSv4, signingTypeHMAC)
+	}
+
+	return nil
+}
+
+//
+// isSigned checks if the hostname of the upstream should be signed by this configuration
+//
+func (r *UpstreamSigning) isSigned(hostname string) bool {
+	if len(r.Domains) <= 0 {
+		return true
+	}
+	hostname = strings.Split(hostname, ":")[0]
+	for _, x := range r.Domains {
+		if hostname == x || strings.HasSuffix(hostname, "."+strings.TrimPrefix(x, ".")) {
+			return true
+		}
+	}
+
+	return false
+}
+
+//
+// getMaxBodySize returns the maximum size of the request body read in to be signed
+//
+func (r *UpstreamSigning) getMaxBodySize() int64 {
+	if r.MaxBodySize <= 0 {
+		return defaultSigningMaxBodySize
+	}
+
+	return r.MaxBodySize
+}
+
+//
+// signUpstreamRequest signs the upstream request with the first signing configuration matching the host
+//
+func signUpstreamRequest(signers []*UpstreamSigning, req *http.Request) error {
+	for _, x := range signers {
+		if !x.isSigned(req.URL.Host) {
+			continue
+		}
+		switch x.Type {
+		case signingTypeAWSv4:
+			return signRequestAWSv4(x, req, time.Now().UTC())
+		case signingTypeHMAC:
+			return signRequestHMAC(x, req, time.Now().UTC())
+		}
+	}
+
+	return nil
+}
+
+//
+// signRequestAWSv4 signs the request using the aws signature version 4 process
+//
+func signRequestAWSv4(signer *UpstreamSigning, req *http.Request, now time.Time) error {
+	// step: calculate the payload hash
+	payloadHash := awsUnsignedPayload
+	if !signer.UnsignedPayload {
+		body, err := readRequestBody(req, signer.getMaxBodySize())
+		if err != nil {
+			return err
+		}
+		payloadHash = hashSHA256(body)
+	}
+
+	amzDate := now.Format(awsDateFormat)
+	scope := strings.Join([]string{now.Format("20060102"), signer.Region, signer.Service, "aws4_request"}, "/")
+
+	req.Header.Set(headerAmzDate, amzDate)
+	if signer.SessionToken != "" {
+		req.Header.Set(headerAmzToken, signer.SessionToken)
+	}
+	// the content hash header is mandatory for s3, other services ignore it
+	if signer.Service == "s3" || signer.UnsignedPayload {
+		req.Header.Set(headerAmzContentHash, payloadHash)
+	}
+
+	// step: build up the canonical headers, the host is always signed
+	headers := map[string]string{"host": req.URL.Host}
+	for _, x := range []string{headerAmzDate, headerAmzToken, headerAmzContentHash} {
+		if v := req.Header.Get(x); v != "" {
+			headers[strings.ToLower(x)] = v
+		}
+	}
+	var names []string
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders bytes.Buffer
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + strings.TrimSpace(headers[k]) + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		awsCanonicalURI(req.URL),
+		awsCanonicalQuery(req.URL),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	stringToSign := strings.Join([]string{
+		awsSigningAlgorithm,
+		amzDate,
+		scope,
+		hashSHA256([]byte(canonicalRequest)),
+	}, "\n")
+
+	// step: derive the signing key
+	key := hmacSHA256([]byte("AWS4"+signer.SecretKey), []byte(now.Format("20060102")))
+	key = hmacSHA256(key, []byte(signer.Region))
+	key = hmacSHA256(key, []byte(signer.Service))
+	key = hmacSHA256(key, []byte("aws4_request"))
+	signature := hex.EncodeToString(hmacSHA256(key, []byte(stringToSign)))
+
+	req.Header.Set(authorizationHeader, fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		awsSigningAlgorithm, signer.AccessKey, scope, signedHeaders, signature))
+
+	return nil
+}
+
+//
+// signRequestHMAC signs the request with a shared secret, the signature covers the method, uri, timestamp and body
+//
+func signRequestHMAC(signer *UpstreamSigning, req *http.Request, now time.Time) error {
+	body, err := readRequestBody(req, signer.getMaxBodySize())
+	if err != nil {
+		return err
+	}
+	header := signer.Header
+	if header == "" {
+		header = defaultSigningHeader
+	}
+	timestamp := fmt.Sprintf("%d", now.Unix())
+
+	signature := hmacSHA256([]byte(signer.SecretKey), []byte(strings.Join([]string{
+		req.Method,
+		req.URL.RequestURI(),
+		timestamp,
+		hashSHA256(body),
+	}, "\n")))
+
+	req.Header.Set(header, hex.EncodeToString(signature))
+	req.Header.Set(defaultSigningTimestampHeader, timestamp)
+	if signer.StripBearer {
+		req.Header.Del(authorizationHeader)
+	}
+
+	return nil
+}
+
+//
+// getSigningErrorStatus returns the status the request is refused with when it can't be signed
+//
+func getSigningErrorStatus(err error) int {
+	if err == ErrRequestBodyTooLarge {
+		return http.StatusRequestEntityTooLarge
+	}
+
+	return http.StatusInternalServerError
+}
+
+//
+// awsCanonicalURI returns the uri encoded path for the canonical request
+//
+func awsCanonicalURI(u *url.URL) string {
+	path := u.EscapedPath()
+	if path == "" {
+		return "/"
+	}
+
+	return path
+}
+
+//
+// awsCanonicalQuery returns the sorted and encoded query string for the canonical request
+//
+func awsCanonicalQuery(u *url.URL) string {
+	values := u.Query()
+	var keys []string
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var list []string
+	for _, k := range keys {
+		v := values[k]
+		sort.Strings(v)
+		for _, x := range v {
+			list = append(list, awsEscape(k)+"="+awsEscape(x))
+		}
+	}
+
+	return strings.Join(list, "&")
+}
+
+//
+// awsEscape performs the aws flavor of uri encoding, i.e. spaces are %20 not +
+//
+func awsEscape(v string) string {
+	return strings.Replace(url.QueryEscape(v), "+", "%20", -1)
+}
+
+//
+// readRequestBody reads in the body of the request and places a copy back for the upstream, refusing a body larger
+// than the limit, if any
+//
+func readRequestBody(req *http.Request, limit int64) ([]byte, error) {
+	if req.Body == nil {
+		return []byte{}, nil
+	}
+	if limit > 0 && req.ContentLength > limit {
+		return nil, ErrRequestBodyTooLarge
+	}
+	reader := io.Reader(req.Body)
+	if limit > 0 {
+		reader = io.LimitReader(req.Body, limit+1)
+	}
+	content, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	if limit > 0 && int64(len(content)) > limit {
+		return nil, ErrRequestBodyTooLarge
+	}
+	req.Body.Close()
+	req.Body = ioutil.NopCloser(bytes.NewReader(content))
+
+	return content, nil
+}
+
+//
+// hashSHA256 returns the hex encoded sha256 of the content
+//
+func hashSHA256(content []byte) string {
+	hash := sha256.Sum256(content)
+	return hex.EncodeToString(hash[:])
+}
+
+//
+// hmacSHA256 returns the hmac-sha256 of the content with the key
+//
+func hmacSHA256(key, content []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(content)
+	return h.Sum(nil)
+}
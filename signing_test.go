@@ -0,0 +1,153 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUpstreamSigningIsValid(t *testing.T) {
+	cases := []struct {
+		Signer *UpstreamSigning
+		Ok     bool
+	}{
+		{
+			Signer: &UpstreamSigning{},
+		},
+		{
+			Signer: &UpstreamSigning{Type: signingTypeAWSv4, Region: "us-east-1"},
+		},
+		{
+			Signer: &UpstreamSigning{
+				Type:      signingTypeAWSv4,
+				Region:    "us-east-1",
+				Service:   "execute-api",
+				AccessKey: "key",
+				SecretKey: "secret",
+			},
+			Ok: true,
+		},
+		{
+			Signer: &UpstreamSigning{Type: signingTypeHMAC},
+		},
+		{
+			Signer: &UpstreamSigning{Type: signingTypeHMAC, SecretKey: "secret"},
+			Ok:     true,
+		},
+	}
+	for i, c := range cases {
+		err := c.Signer.isValid()
+		if c.Ok && err != nil {
+			t.Errorf("case %d should not have failed, error: %s", i, err)
+		}
+		if !c.Ok && err == nil {
+			t.Errorf("case %d should have failed", i)
+		}
+	}
+}
+
+func TestUpstreamSigningIsSigned(t *testing.T) {
+	signer := &UpstreamSigning{Domains: []string{"example.com"}}
+	assert.True(t, signer.isSigned("example.com"))
+	assert.True(t, signer.isSigned("api.example.com:443"))
+	assert.False(t, signer.isSigned("badexample.com"))
+	assert.True(t, (&UpstreamSigning{}).isSigned("anything.local"))
+}
+
+func TestSignRequestAWSv4(t *testing.T) {
+	// the get-vanilla case from the aws signature v4 test suite
+	req, _ := http.NewRequest("GET", "https://example.amazonaws.com/", nil)
+	now, _ := time.Parse(awsDateFormat, "20150830T123600Z")
+
+	err := signRequestAWSv4(&UpstreamSigning{
+		Type:      signingTypeAWSv4,
+		Region:    "us-east-1",
+		Service:   "service",
+		AccessKey: "AKIDEXAMPLE",
+		SecretKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+	}, req, now)
+	assert.NoError(t, err)
+	assert.Equal(t, "20150830T123600Z", req.Header.Get(headerAmzDate))
+	assert.Equal(t, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, "+
+		"SignedHeaders=host;x-amz-date, Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31",
+		req.Header.Get(authorizationHeader))
+}
+
+func TestSignRequestHMAC(t *testing.T) {
+	req, _ := http.NewRequest("POST", "http://127.0.0.1/test?a=b", bytes.NewBufferString("hello"))
+	req.Header.Set(authorizationHeader, "Bearer token")
+	now := time.Unix(1450372669, 0)
+
+	err := signRequestHMAC(&UpstreamSigning{
+		Type:        signingTypeHMAC,
+		SecretKey:   "secret",
+		StripBearer: true,
+	}, req, now)
+	assert.NoError(t, err)
+	assert.Equal(t, "1450372669", req.Header.Get(defaultSigningTimestampHeader))
+	assert.Len(t, req.Header.Get(defaultSigningHeader), 64)
+	assert.Empty(t, req.Header.Get(authorizationHeader))
+
+	// step: ensure the body is still available for the upstream
+	body, err := ioutil.ReadAll(req.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(body))
+}
+
+func TestSignRequestMaxBodySize(t *testing.T) {
+	signer := &UpstreamSigning{Type: signingTypeHMAC, SecretKey: "secret", MaxBodySize: 5}
+	now := time.Unix(1450372669, 0)
+
+	req, _ := http.NewRequest("POST", "http://127.0.0.1/test", bytes.NewBufferString("hello"))
+	assert.NoError(t, signRequestHMAC(signer, req, now))
+
+	req, _ = http.NewRequest("POST", "http://127.0.0.1/test", bytes.NewBufferString("hello world"))
+	assert.Equal(t, ErrRequestBodyTooLarge, signRequestHMAC(signer, req, now))
+
+	// step: the length of a chunked body isn't known up front
+	req, _ = http.NewRequest("POST", "http://127.0.0.1/test", ioutil.NopCloser(bytes.NewBufferString("hello world")))
+	req.ContentLength = -1
+	err := signRequestAWSv4(&UpstreamSigning{
+		Type:        signingTypeAWSv4,
+		Region:      "us-east-1",
+		Service:     "service",
+		AccessKey:   "key",
+		SecretKey:   "secret",
+		MaxBodySize: 5,
+	}, req, now)
+	assert.Equal(t, ErrRequestBodyTooLarge, err)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, getSigningErrorStatus(err))
+	assert.Equal(t, http.StatusInternalServerError, getSigningErrorStatus(errors.New("failed")))
+
+	assert.Error(t, (&UpstreamSigning{Type: signingTypeHMAC, SecretKey: "secret", MaxBodySize: -1}).isValid())
+	assert.Equal(t, int64(defaultSigningMaxBodySize), (&UpstreamSigning{}).getMaxBodySize())
+}
+
+func TestSignUpstreamRequestNoMatch(t *testing.T) {
+	req, _ := http.NewRequest("GET", "http://127.0.0.1/", nil)
+	err := signUpstreamRequest([]*UpstreamSigning{
+		{Type: signingTypeHMAC, SecretKey: "secret", Domains: []string{"example.com"}},
+	}, req)
+	assert.NoError(t, err)
+	assert.Empty(t, req.Header.Get(defaultSigningHeader))
+}
@@ -0,0 +1,124 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"strings"
+	"time"
+
+	"github.com/coreos/go-oidc/jose"
+	"github.com/coreos/go-oidc/oidc"
+)
+
+//
+// verifySkewedToken verifies the token against the provider which issued it, tolerating the skew between the
+// clocks of the provider and the proxy on the expiration and not before of the token
+//
+func (r *oauthProxy) verifySkewedToken(token jose.JWT) error {
+	if err := r.acceptSkew(token, r.verifyIssuedToken(token)); err != nil {
+		return err
+	}
+
+	return verifyNotBefore(token, time.Now(), r.config.SkewTolerance)
+}
+
+//
+// acceptSkew clears the expiration error of a token which expired within the skew tolerance; the provider client
+// verifies the signature before the claims, and the expiration first of the claims, so the remaining claims are
+// verified here with the expiration extended by the tolerance
+//
+func (r *oauthProxy) acceptSkew(token jose.JWT, err error) error {
+	if err != ErrAccessTokenExpired || r.config.SkewTolerance <= 0 {
+		return err
+	}
+	claims, e := token.Claims()
+	if e != nil {
+		return err
+	}
+	expires, found, e := claims.TimeClaim("exp")
+	if e != nil || !found || !time.Now().Before(expires.Add(r.config.SkewTolerance)) {
+		return err
+	}
+	extended := make(jose.Claims, len(claims))
+	for k, v := range claims {
+		extended[k] = v
+	}
+	extended["exp"] = expires.Add(r.config.SkewTolerance).Unix()
+	shifted, e := jose.NewJWT(token.Header, extended)
+	if e != nil {
+		return err
+	}
+	issuer, clientID := r.getIssuerIdentity(token)
+
+	return oidc.VerifyClaims(shifted, issuer, clientID)
+}
+
+//
+// verifyNotBefore checks the token isn't used before it's valid, the nbf claim, allowing for the skew tolerance
+//
+func verifyNotBefore(token jose.JWT, now time.Time, skew time.Duration) error {
+	claims, err := token.Claims()
+	if err != nil {
+		return err
+	}
+
+	return verifyClaimsNotBefore(claims, now, skew)
+}
+
+//
+// verifyClaimsNotBefore checks the not before of the claims, allowing for the skew tolerance
+//
+func verifyClaimsNotBefore(claims jose.Claims, now time.Time, skew time.Duration) error {
+	notBefore, found, err := claims.TimeClaim("nbf")
+	if err != nil {
+		return err
+	}
+	if found && now.Add(skew).Before(notBefore) {
+		return ErrTokenNotYetValid
+	}
+
+	return nil
+}
+
+//
+// getIssuerIdentity returns the issuer and client id the token is verified against, following getIssuerClient
+//
+func (r *oauthProxy) getIssuerIdentity(token jose.JWT) (string, string) {
+	var issuer string
+	if r.provider.Issuer != nil {
+		issuer = r.provider.Issuer.String()
+	}
+	clientID := r.config.ClientID
+	if len(r.issuers) <= 0 {
+		return issuer, clientID
+	}
+	claims, err := token.Claims()
+	if err != nil {
+		return issuer, clientID
+	}
+	name, _, _ := claims.StringClaim("iss")
+	name = strings.TrimSuffix(name, "/")
+	if _, found := r.issuers[name]; !found {
+		return issuer, clientID
+	}
+	for _, x := range r.config.Providers {
+		if x.provider.Issuer != nil && strings.TrimSuffix(x.provider.Issuer.String(), "/") == name {
+			return name, x.ClientID
+		}
+	}
+
+	return name, clientID
+}
@@ -0,0 +1,90 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/coreos/go-oidc/jose"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerifyClaimsNotBefore(t *testing.T) {
+	now := time.Now()
+	cs := []struct {
+		Claims jose.Claims
+		Skew   time.Duration
+		Error  error
+	}{
+		{Claims: jose.Claims{}},
+		{Claims: jose.Claims{"nbf": now.Add(-time.Minute).Unix()}},
+		{Claims: jose.Claims{"nbf": now.Add(time.Minute).Unix()}, Error: ErrTokenNotYetValid},
+		{Claims: jose.Claims{"nbf": now.Add(time.Minute).Unix()}, Skew: time.Duration(2) * time.Minute},
+		{Claims: jose.Claims{"nbf": now.Add(time.Hour).Unix()}, Skew: time.Duration(2) * time.Minute, Error: ErrTokenNotYetValid},
+	}
+	for i, c := range cs {
+		assert.Equal(t, c.Error, verifyClaimsNotBefore(c.Claims, now, c.Skew), "case %d", i)
+	}
+}
+
+func TestSkewTolerance(t *testing.T) {
+	config := newFakeKeycloakConfig()
+	config.SkewTolerance = time.Duration(1) * time.Minute
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	defer upstream.Close()
+	config.Upstream = upstream.URL
+	p, auth, u := newTestProxyService(config)
+	if !assert.NoError(t, p.createUpstreamProxy(p.endpoint)) {
+		t.FailNow()
+	}
+
+	now := time.Now()
+	cs := []struct {
+		Claims jose.Claims
+		Ok     bool
+	}{
+		{Claims: jose.Claims{"exp": now.Add(time.Hour).Unix()}, Ok: true},
+		{Claims: jose.Claims{"exp": now.Add(-10 * time.Second).Unix()}, Ok: true},
+		{Claims: jose.Claims{"exp": now.Add(-2 * time.Minute).Unix()}},
+		{Claims: jose.Claims{"nbf": now.Add(30 * time.Second).Unix()}, Ok: true},
+		{Claims: jose.Claims{"nbf": now.Add(time.Hour).Unix()}},
+		{Claims: jose.Claims{"exp": now.Add(-10 * time.Second).Unix(), "aud": "billing"}},
+	}
+	for i, c := range cs {
+		claims := jose.Claims{}
+		for k, v := range auth.claims {
+			claims[k] = v
+		}
+		for k, v := range c.Claims {
+			claims[k] = v
+		}
+		token, err := jose.NewSignedJWT(claims, auth.signer)
+		if !assert.NoError(t, err, "case %d", i) {
+			continue
+		}
+		req, _ := http.NewRequest("GET", u+fakeAuthAllURL, nil)
+		req.Header.Set(authorizationHeader, "Bearer "+token.Encode())
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if !assert.NoError(t, err, "case %d", i) {
+			continue
+		}
+		resp.Body.Close()
+		assert.Equal(t, c.Ok, resp.StatusCode == http.StatusOK, "case %d, status: %d", i, resp.StatusCode)
+	}
+}
@@ -0,0 +1,299 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	// spiffeFetchX509SVIDURL is the grpc method of the workload api streaming the x509 svids
+	spiffeFetchX509SVIDURL = "http://localhost/SpiffeWorkloadAPI/FetchX509SVID"
+	// spiffeStartupTimeout is how long to wait for the first svid on startup
+	spiffeStartupTimeout = time.Duration(30) * time.Second
+	// spiffeRetryInterval is the interval between the attempts to reconnect to the workload api
+	spiffeRetryInterval = time.Duration(5) * time.Second
+	// spiffeMaxMessageSize is the largest message read from the workload api
+	spiffeMaxMessageSize = 4 << 20
+)
+
+//
+// spiffeSource streams the x509 svid from the spiffe workload api, the agent pushes a new svid on rotation
+//
+type spiffeSource struct {
+	sync.RWMutex
+	// the path to the workload api socket
+	socket string
+	// the client for the workload api
+	client *http.Client
+	// the current svid
+	certificate *tls.Certificate
+	// the spiffe id of the svid
+	id string
+	// closed when the first svid has been received
+	ready chan struct{}
+	// ensures the ready channel is closed once
+	once sync.Once
+}
+
+//
+// newSpiffeSource creates a source for the workload api socket, e.g. unix:///run/spire/sockets/agent.sock
+//
+func newSpiffeSource(socket string) *spiffeSource {
+	socket = strings.TrimPrefix(socket, "unix://")
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", socket)
+		},
+		Protocols: newH2CProtocols(),
+	}
+
+	return &spiffeSource{
+		socket: socket,
+		client: &http.Client{Transport: transport},
+		ready:  make(chan struct{}),
+	}
+}
+
+//
+// start streams the svids in the background, reconnecting if the stream fails, until done is closed
+//
+func (r *spiffeSource) start(done <-chan struct{}) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-done
+		cancel()
+	}()
+	go func() {
+		for {
+			if err := r.stream(ctx); err != nil && ctx.Err() == nil {
+				log.WithFields(log.Fields{
+					"socket": r.socket,
+					"error":  err.Error(),
+				}).Warnf("the spiffe workload api stream failed, reconnecting")
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(spiffeRetryInterval):
+			}
+		}
+	}()
+}
+
+//
+// waitReady waits for the first svid to be received
+//
+func (r *spiffeSource) waitReady(timeout time.Duration) error {
+	select {
+	case <-r.ready:
+		return nil
+	case <-time.After(timeout):
+		return fmt.Errorf("no svid received from the spiffe workload api: %s within %s", r.socket, timeout)
+	}
+}
+
+//
+// getClientCertificate returns the current svid for the tls handshake
+//
+func (r *spiffeSource) getClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	r.RLock()
+	defer r.RUnlock()
+	if r.certificate == nil {
+		return nil, errors.New("no svid has been received from the spiffe workload api")
+	}
+
+	return r.certificate, nil
+}
+
+//
+// stream calls FetchX509SVID, updating the certificate with each response until the stream ends
+//
+func (r *spiffeSource) stream(ctx context.Context) error {
+	// step: the request is a empty X509SVIDRequest in a grpc frame
+	request, err := http.NewRequestWithContext(ctx, "POST", spiffeFetchX509SVIDURL, bytes.NewReader(make([]byte, 5)))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/grpc")
+	request.Header.Set("TE", "trailers")
+	request.Header.Set("workload.spiffe.io", "true")
+
+	resp, err := r.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("the workload api returned: %s", resp.Status)
+	}
+	if status := resp.Header.Get("Grpc-Status"); status != "" && status != "0" {
+		return fmt.Errorf("the workload api returned the grpc status: %s, %s", status, resp.Header.Get("Grpc-Message"))
+	}
+
+	for {
+		message, err := readGRPCMessage(resp.Body)
+		if err == io.EOF {
+			if status := resp.Trailer.Get("Grpc-Status"); status != "" && status != "0" {
+				return fmt.Errorf("the workload api returned the grpc status: %s, %s", status, resp.Trailer.Get("Grpc-Message"))
+			}
+			return errors.New("the workload api closed the stream")
+		}
+		if err != nil {
+			return err
+		}
+		id, certificate, err := parseX509SVIDResponse(message)
+		if err != nil {
+			log.WithFields(log.Fields{"error": err.Error()}).Warnf("unable to decode the svid from the spiffe workload api")
+			continue
+		}
+
+		r.Lock()
+		r.id, r.certificate = id, certificate
+		r.Unlock()
+		r.once.Do(func() { close(r.ready) })
+
+		log.WithFields(log.Fields{
+			"spiffe_id": id,
+			"expires":   certificate.Leaf.NotAfter.Format(time.RFC3339),
+		}).Infof("received a svid from the spiffe workload api")
+	}
+}
+
+//
+// readGRPCMessage reads a length prefixed grpc message
+//
+func readGRPCMessage(reader io.Reader) ([]byte, error) {
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	}
+	if header[0] != 0 {
+		return nil, errors.New("compressed grpc messages are not supported")
+	}
+	size := binary.BigEndian.Uint32(header[1:])
+	if size > spiffeMaxMessageSize {
+		return nil, fmt.Errorf("the grpc message size: %d exceeds the maximum", size)
+	}
+	message := make([]byte, size)
+	if _, err := io.ReadFull(reader, message); err != nil {
+		return nil, err
+	}
+
+	return message, nil
+}
+
+//
+// parseX509SVIDResponse decodes the first svid from the X509SVIDResponse message, i.e. field 1 holds the svids,
+// each with the spiffe id (1), the der certificate chain (2) and the pkcs8 private key (3)
+//
+func parseX509SVIDResponse(message []byte) (string, *tls.Certificate, error) {
+	fields, err := decodeProtobufFields(message)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(fields[1]) == 0 {
+		return "", nil, errors.New("the response contains no svids")
+	}
+	svid, err := decodeProtobufFields(fields[1][0])
+	if err != nil {
+		return "", nil, err
+	}
+	if len(svid[2]) == 0 || len(svid[3]) == 0 {
+		return "", nil, errors.New("the svid has no certificate or private key")
+	}
+
+	chain, err := x509.ParseCertificates(svid[2][0])
+	if err != nil {
+		return "", nil, fmt.Errorf("unable to parse the svid certificates, %s", err)
+	}
+	if len(chain) == 0 {
+		return "", nil, errors.New("the svid contains no certificates")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(svid[3][0])
+	if err != nil {
+		return "", nil, fmt.Errorf("unable to parse the svid private key, %s", err)
+	}
+	certificate := &tls.Certificate{PrivateKey: key, Leaf: chain[0]}
+	for _, x := range chain {
+		certificate.Certificate = append(certificate.Certificate, x.Raw)
+	}
+	var id string
+	if len(svid[1]) > 0 {
+		id = string(svid[1][0])
+	}
+
+	return id, certificate, nil
+}
+
+//
+// decodeProtobufFields decodes the length delimited fields of a protobuf message by field number, other wire types
+// are skipped
+//
+func decodeProtobufFields(message []byte) (map[int][][]byte, error) {
+	fields := make(map[int][][]byte, 0)
+	for len(message) > 0 {
+		key, n := binary.Uvarint(message)
+		if n <= 0 {
+			return nil, errors.New("invalid protobuf field key")
+		}
+		message = message[n:]
+
+		switch number, wireType := int(key>>3), key&7; wireType {
+		case 0:
+			if _, n = binary.Uvarint(message); n <= 0 {
+				return nil, errors.New("invalid protobuf varint")
+			}
+			message = message[n:]
+		case 1, 5:
+			size := 8
+			if wireType == 5 {
+				size = 4
+			}
+			if len(message) < size {
+				return nil, errors.New("truncated protobuf field")
+			}
+			message = message[size:]
+		case 2:
+			length, n := binary.Uvarint(message)
+			if n <= 0 || uint64(len(message)-n) < length {
+				return nil, errors.New("truncated protobuf field")
+			}
+			fields[number] = append(fields[number], message[n:n+int(length)])
+			message = message[n+int(length):]
+		default:
+			return nil, fmt.Errorf("unsupported protobuf wire type: %d", wireType)
+		}
+	}
+
+	return fields, nil
+}
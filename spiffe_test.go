@@ -0,0 +1,148 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newFakeProtobufField(number int, content []byte) []byte {
+	field := binary.AppendUvarint(nil, uint64(number<<3|2))
+	field = binary.AppendUvarint(field, uint64(len(content)))
+
+	return append(field, content...)
+}
+
+// newFakeX509SVIDResponse creates a X509SVIDResponse message framed for grpc
+func newFakeX509SVIDResponse(t *testing.T, ca *fakeCA, id string, serial int64) []byte {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	spiffeID, _ := url.Parse(id)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "workload"},
+		URIs:         []*url.URL{spiffeID},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	certificate, err := x509.CreateCertificate(rand.Reader, template, ca.certificate, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	encoded, _ := x509.MarshalPKCS8PrivateKey(key)
+
+	svid := newFakeProtobufField(1, []byte(id))
+	svid = append(svid, newFakeProtobufField(2, append(certificate, ca.certificate.Raw...))...)
+	svid = append(svid, newFakeProtobufField(3, encoded)...)
+	svid = append(svid, newFakeProtobufField(4, ca.certificate.Raw)...)
+	message := newFakeProtobufField(1, svid)
+
+	frame := make([]byte, 5)
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(message)))
+
+	return append(frame, message...)
+}
+
+func TestDecodeProtobufFields(t *testing.T) {
+	message := binary.AppendUvarint(nil, 2<<3)
+	message = binary.AppendUvarint(message, 300)
+	message = append(message, newFakeProtobufField(1, []byte("a"))...)
+	message = append(message, newFakeProtobufField(1, []byte("b"))...)
+	message = append(message, 3<<3|5, 0, 0, 0, 0)
+
+	fields, err := decodeProtobufFields(message)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("a"), []byte("b")}, fields[1])
+
+	_, err = decodeProtobufFields(newFakeProtobufField(1, []byte("abc"))[:3])
+	assert.Error(t, err)
+}
+
+func TestSpiffeSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spiffe")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := newFakeCA(t)
+	rotate := make(chan struct{})
+	socket := filepath.Join(dir, "agent.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	server := &http.Server{
+		Protocols: newH2CProtocols(),
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/SpiffeWorkloadAPI/FetchX509SVID" || r.Header.Get("workload.spiffe.io") != "true" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			w.Header().Set("Content-Type", "application/grpc")
+			w.Write(newFakeX509SVIDResponse(t, ca, "spiffe://example.org/proxy", 10))
+			w.(http.Flusher).Flush()
+			// step: push a rotated svid
+			<-rotate
+			w.Write(newFakeX509SVIDResponse(t, ca, "spiffe://example.org/proxy", 11))
+			w.(http.Flusher).Flush()
+			<-r.Context().Done()
+		}),
+	}
+	go server.Serve(listener)
+	defer server.Close()
+
+	source := newSpiffeSource("unix://" + socket)
+	_, err = source.getClientCertificate(nil)
+	assert.Error(t, err)
+
+	done := make(chan struct{})
+	defer close(done)
+	source.start(done)
+	if !assert.NoError(t, source.waitReady(time.Duration(5)*time.Second)) {
+		return
+	}
+	certificate, err := source.getClientCertificate(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(10), certificate.Leaf.SerialNumber.Int64())
+	assert.Len(t, certificate.Certificate, 2)
+	assert.Equal(t, "spiffe://example.org/proxy", source.id)
+
+	close(rotate)
+	for i := 0; i < 50; i++ {
+		if certificate, _ = source.getClientCertificate(nil); certificate.Leaf.SerialNumber.Int64() == 11 {
+			break
+		}
+		time.Sleep(time.Duration(20) * time.Millisecond)
+	}
+	assert.Equal(t, int64(11), certificate.Leaf.SerialNumber.Int64())
+}
@@ -0,0 +1,344 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/asn1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/coreos/go-oidc/jose"
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// authNegotiate is the authorization scheme of spnego
+	authNegotiate = "Negotiate"
+)
+
+var (
+	// oidSPNEGO is the mechanism of the spnego tokens
+	oidSPNEGO = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 2}
+	// oidKerberos and oidMSKerberos are the kerberos mechanisms, the latter sent by older windows clients
+	oidKerberos   = asn1.ObjectIdentifier{1, 2, 840, 113554, 1, 2, 2}
+	oidMSKerberos = asn1.ObjectIdentifier{1, 2, 840, 48018, 1, 2, 2}
+)
+
+// negotiateTemplate is the body of the negotiate challenge, rendered by the browsers unable to answer it, so the
+// clients which aren't domain joined continue to the login
+var negotiateTemplate = template.Must(template.New("negotiate").Parse(`<!DOCTYPE html>
+<html><head><meta charset="UTF-8"><title>Redirecting</title></head>
+<body>
+<script>
+  window.location.replace({{.}});
+</script>
+<noscript><a href="{{.}}">Continue to login</a></noscript>
+</body></html>
+`))
+
+//
+// spnegoNegTokenInit is the initial spnego token of the client
+//
+type spnegoNegTokenInit struct {
+	MechTypes   []asn1.ObjectIdentifier `asn1:"optional,explicit,tag:0"`
+	ReqFlags    asn1.BitString          `asn1:"optional,explicit,tag:1"`
+	MechToken   []byte                  `asn1:"optional,explicit,tag:2"`
+	MechListMIC []byte                  `asn1:"optional,explicit,tag:3"`
+}
+
+//
+// getKerberosAPReq unwraps the kerberos ap-req from the spnego, or plain kerberos, token of the client
+//
+func getKerberosAPReq(token []byte) ([]byte, error) {
+	mech, inner, err := parseGSSToken(token)
+	if err != nil {
+		return nil, err
+	}
+	if mech.Equal(oidSPNEGO) {
+		init := spnegoNegTokenInit{}
+		if _, err := asn1.UnmarshalWithParams(inner, &init, "explicit,tag:0"); err != nil {
+			return nil, fmt.Errorf("invalid spnego token, %s", err)
+		}
+		if len(init.MechToken) <= 0 {
+			return nil, errors.New("the spnego token has no kerberos token")
+		}
+		if mech, inner, err = parseGSSToken(init.MechToken); err != nil {
+			return nil, err
+		}
+	}
+	if !mech.Equal(oidKerberos) && !mech.Equal(oidMSKerberos) {
+		return nil, fmt.Errorf("unsupported negotiate mechanism: %s", mech)
+	}
+	// step: the kerberos token is prefixed by the token id of a ap-req
+	if len(inner) < 2 || inner[0] != 0x01 || inner[1] != 0x00 {
+		return nil, errors.New("the kerberos token is not a ap-req")
+	}
+
+	return inner[2:], nil
+}
+
+//
+// parseGSSToken decodes the initial context token of the gss api (rfc 2743), returning the mechanism and the inner
+// token
+//
+func parseGSSToken(token []byte) (asn1.ObjectIdentifier, []byte, error) {
+	wrapper := asn1.RawValue{}
+	if _, err := asn1.Unmarshal(token, &wrapper); err != nil {
+		return nil, nil, fmt.Errorf("invalid gss token, %s", err)
+	}
+	if wrapper.Class != asn1.ClassApplication || wrapper.Tag != 0 {
+		return nil, nil, errors.New("the token is not a initial gss token")
+	}
+	var mech asn1.ObjectIdentifier
+	inner, err := asn1.Unmarshal(wrapper.Bytes, &mech)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid gss token mechanism, %s", err)
+	}
+
+	return mech, inner, nil
+}
+
+//
+// getKerberosRoles returns the roles mapped to the principal, either by the principal or the realm, i.e. @EXAMPLE.COM
+//
+func getKerberosRoles(mapping map[string]string, principal string) []string {
+	var list []string
+	keys := []string{principal}
+	if i := strings.LastIndex(principal, "@"); i >= 0 {
+		keys = append(keys, principal[i:])
+	}
+	for _, key := range keys {
+		for _, x := range strings.Split(mapping[key], ",") {
+			if x = strings.TrimSpace(x); x != "" && !containedIn(x, list) {
+				list = append(list, x)
+			}
+		}
+	}
+
+	return list
+}
+
+//
+// newKerberosIdentity creates the user context for the client authenticated by kerberos
+//
+func (r *oauthProxy) newKerberosIdentity(identity *kerberosIdentity) *userContext {
+	username := identity.principal
+	if i := strings.LastIndex(username, "@"); i >= 0 {
+		username = username[:i]
+	}
+	claims := jose.Claims{}
+	claims.Add("sub", identity.principal)
+	claims.Add(claimPreferredName, username)
+
+	return &userContext{
+		id:            identity.principal,
+		name:          identity.principal,
+		preferredName: username,
+		audience:      r.config.ClientID,
+		expiresAt:     identity.expires,
+		roles:         getKerberosRoles(r.config.SPNEGORoles, identity.principal),
+		claims:        claims,
+		bearerToken:   true,
+		kerberos:      true,
+	}
+}
+
+//
+// spnegoMiddleware authenticates the domain joined clients by kerberos on the resources which opt in, the
+// client is given a session cookie so the negotiation isn't repeated on every request
+//
+func (r *oauthProxy) spnegoMiddleware() gin.HandlerFunc {
+	if r.kerberos == nil {
+		return func(cx *gin.Context) {}
+	}
+
+	attempts := prometheus.MustRegisterOrGet(prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "proxy_kerberos_requests_total",
+			Help: "The kerberos negotiations, partitioned by the result",
+		},
+		[]string{"result"},
+	)).(*prometheus.CounterVec)
+
+	return func(cx *gin.Context) {
+		ur, found := cx.Get(cxEnforce)
+		if !found || !ur.(*Resource).SPNEGO {
+			return
+		}
+
+		// step: has the client already negotiated?
+		if identity, err := r.getKerberosSession(cx, time.Now()); err == nil {
+			cx.Set(cxKerberos, identity)
+			cx.Set(userContextName, r.newKerberosIdentity(identity))
+			return
+		}
+
+		scheme, token := getAuthorization(cx.Request)
+		if !strings.EqualFold(scheme, authNegotiate) {
+			return
+		}
+		identity, err := r.acceptNegotiation(token)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"client_ip": cx.ClientIP(),
+				"error":     err.Error(),
+			}).Warnf("the kerberos negotiation failed, falling back to the login")
+			attempts.WithLabelValues("rejected").Inc()
+
+			return
+		}
+		attempts.WithLabelValues("permitted").Inc()
+		log.WithFields(log.Fields{
+			"principal": identity.principal,
+			"client_ip": cx.ClientIP(),
+			"expires":   identity.expires.Format(time.RFC3339),
+		}).Infof("authenticated the client: %s by kerberos", identity.principal)
+
+		if err := r.dropKerberosCookie(cx, identity); err != nil {
+			log.WithFields(log.Fields{
+				"error": err.Error(),
+			}).Errorf("failed to encrypt the kerberos session")
+		}
+		cx.Request.Header.Del(authorizationHeader)
+		cx.Set(cxKerberos, identity)
+		cx.Set(userContextName, r.newKerberosIdentity(identity))
+	}
+}
+
+//
+// acceptNegotiation verifies the negotiate token of the client
+//
+func (r *oauthProxy) acceptNegotiation(token string) (*kerberosIdentity, error) {
+	decoded, err := base64.StdEncoding.DecodeString(token)
+	if err != nil {
+		return nil, errors.New("the negotiate token is not base64 encoded")
+	}
+	request, err := getKerberosAPReq(decoded)
+	if err != nil {
+		return nil, err
+	}
+
+	return r.kerberos.accept(request, time.Now())
+}
+
+//
+// getAuthorization returns the scheme and credentials of the authorization header
+//
+func getAuthorization(req *http.Request) (string, string) {
+	items := strings.SplitN(strings.TrimSpace(req.Header.Get(authorizationHeader)), " ", 2)
+	if len(items) != 2 {
+		return items[0], ""
+	}
+
+	return items[0], strings.TrimSpace(items[1])
+}
+
+//
+// dropKerberosCookie drops the encrypted session of the client, expiring with the ticket
+//
+func (r *oauthProxy) dropKerberosCookie(cx *gin.Context, identity *kerberosIdentity) error {
+	value, err := encodeText(fmt.Sprintf("%d|%s", identity.expires.Unix(), identity.principal), r.config.EncryptionKey)
+	if err != nil {
+		return err
+	}
+	r.dropCookie(cx, r.config.CookieKerberosName, value, identity.expires.Sub(time.Now()))
+
+	return nil
+}
+
+//
+// clearKerberosCookie clears the kerberos session cookie
+//
+func (r *oauthProxy) clearKerberosCookie(cx *gin.Context) {
+	r.dropCookie(cx, r.config.CookieKerberosName, "", time.Duration(-10*time.Hour))
+}
+
+//
+// getKerberosSession returns the client from the kerberos session cookie
+//
+func (r *oauthProxy) getKerberosSession(cx *gin.Context, now time.Time) (*kerberosIdentity, error) {
+	cookie, err := cx.Request.Cookie(r.config.CookieKerberosName)
+	if err != nil || cookie.Value == "" {
+		return nil, ErrSessionNotFound
+	}
+	decoded, err := decodeText(cookie.Value, r.config.EncryptionKey)
+	if err != nil {
+		return nil, err
+	}
+	items := strings.SplitN(decoded, "|", 2)
+	if len(items) != 2 {
+		return nil, ErrInvalidSession
+	}
+	expires, err := strconv.ParseInt(items[0], 10, 64)
+	if err != nil || items[1] == "" {
+		return nil, ErrInvalidSession
+	}
+	if now.Unix() >= expires {
+		return nil, ErrSessionNotFound
+	}
+
+	return &kerberosIdentity{principal: items[1], expires: time.Unix(expires, 0)}, nil
+}
+
+//
+// isNegotiable checks if kerberos should be offered to the client, i.e. the resource opts in and the client hasn't
+// already tried
+//
+func (r *oauthProxy) isNegotiable(cx *gin.Context) bool {
+	if r.kerberos == nil {
+		return false
+	}
+	ur, found := cx.Get(cxEnforce)
+	if !found || !ur.(*Resource).SPNEGO {
+		return false
+	}
+	scheme, _ := getAuthorization(cx.Request)
+
+	return !strings.EqualFold(scheme, authNegotiate)
+}
+
+//
+// negotiateRedirect challenges the client to negotiate kerberos; the body of the challenge continues to the
+// login, as it's only rendered by the browsers unable to negotiate
+//
+func (r *oauthProxy) negotiateRedirect(location string, cx *gin.Context) {
+	page := negotiateTemplate
+	if r.config.PreserveFragments {
+		page = fragmentRedirectTemplate
+	}
+	var content bytes.Buffer
+	if err := page.Execute(&content, location); err != nil {
+		log.WithFields(log.Fields{
+			"error": err.Error(),
+		}).Errorf("failed to render the negotiate page")
+
+		r.redirectToURL(location, cx)
+		return
+	}
+
+	cx.Header(headerWWWAuthenticate, authNegotiate)
+	cx.Data(http.StatusUnauthorized, "text/html; charset=utf-8", content.Bytes())
+	cx.Abort()
+}
@@ -0,0 +1,219 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/asn1"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newFakeGSSToken(mech asn1.ObjectIdentifier, inner []byte) []byte {
+	oid, _ := asn1.Marshal(mech)
+	token, _ := asn1.Marshal(asn1.RawValue{Class: asn1.ClassApplication, Tag: 0, IsCompound: true, Bytes: append(oid, inner...)})
+
+	return token
+}
+
+func newFakeKerberosToken(request []byte) []byte {
+	return newFakeGSSToken(oidKerberos, append([]byte{0x01, 0x00}, request...))
+}
+
+func newFakeSPNEGOToken(mechToken []byte) []byte {
+	init, _ := asn1.MarshalWithParams(spnegoNegTokenInit{
+		MechTypes: []asn1.ObjectIdentifier{oidMSKerberos, oidKerberos},
+		MechToken: mechToken,
+	}, "explicit,tag:0")
+
+	return newFakeGSSToken(oidSPNEGO, init)
+}
+
+func TestGetKerberosAPReq(t *testing.T) {
+	request := []byte{0x6e, 0x00}
+	cases := []struct {
+		Token []byte
+		Ok    bool
+	}{
+		{Token: newFakeSPNEGOToken(newFakeKerberosToken(request)), Ok: true},
+		{Token: newFakeKerberosToken(request), Ok: true},
+		{Token: newFakeGSSToken(oidMSKerberos, append([]byte{0x01, 0x00}, request...)), Ok: true},
+		{Token: newFakeSPNEGOToken(nil)},
+		{Token: newFakeSPNEGOToken([]byte("NTLMSSP\x00"))},
+		{Token: newFakeGSSToken(asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 2, 2, 10}, request)},
+		{Token: newFakeGSSToken(oidKerberos, append([]byte{0x02, 0x00}, request...))},
+		{Token: []byte("NTLMSSP\x00\x01\x00\x00\x00")},
+		{Token: []byte{}},
+	}
+	for i, c := range cases {
+		decoded, err := getKerberosAPReq(c.Token)
+		if !c.Ok {
+			assert.Error(t, err, "case %d should have failed", i)
+			continue
+		}
+		if assert.NoError(t, err, "case %d should not have failed", i) {
+			assert.Equal(t, request, decoded, "case %d, unexpected ap-req", i)
+		}
+	}
+}
+
+func TestGetKerberosRoles(t *testing.T) {
+	mapping := map[string]string{
+		"@CORP.EXAMPLE.COM":         "staff",
+		"jsmith@CORP.EXAMPLE.COM":   "admin, staff",
+		"contractor@PARTNER.COM":    "",
+		"admin@PARTNER.EXAMPLE.COM": "admin",
+	}
+	assert.Equal(t, []string{"admin", "staff"}, getKerberosRoles(mapping, "jsmith@CORP.EXAMPLE.COM"))
+	assert.Equal(t, []string{"staff"}, getKerberosRoles(mapping, "jdoe@CORP.EXAMPLE.COM"))
+	assert.Empty(t, getKerberosRoles(mapping, "contractor@PARTNER.COM"))
+	assert.Empty(t, getKerberosRoles(mapping, "jdoe@PARTNER.EXAMPLE.COM"))
+	assert.Empty(t, getKerberosRoles(nil, "jdoe@CORP.EXAMPLE.COM"))
+}
+
+func TestSPNEGOMiddleware(t *testing.T) {
+	keytab, err := ioutil.TempFile("", "keytab")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer os.Remove(keytab.Name())
+	keytab.Write(newFakeKeytab(&keytabEntry{
+		principal: fakeKerberosService + "@" + fakeKerberosRealm,
+		kvno:      2,
+		etype:     kerberosAES256,
+		key:       fakeKerberosKey,
+	}))
+	keytab.Close()
+
+	config := newFakeKeycloakConfig()
+	config.SPNEGOKeytab = keytab.Name()
+	config.CookieKerberosName = "kc-kerberos"
+	config.SPNEGORoles = map[string]string{
+		"@" + fakeKerberosRealm:       "staff",
+		"jsmith@" + fakeKerberosRealm: "admin",
+	}
+	config.Resources = append([]*Resource{
+		{URL: "/intranet", Methods: []string{"ANY"}, SPNEGO: true, Roles: []string{"staff"}},
+		{URL: "/portal", Methods: []string{"ANY"}, SPNEGO: true, Roles: []string{"admin"}},
+	}, config.Resources...)
+	p, _, u := newTestProxyService(config)
+	p.upstream = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, "%s|%s|%s|%s", req.Header.Get("X-Auth-Username"), req.Header.Get("X-Auth-Roles"),
+			req.Header.Get(headerAuthDecision), req.Header.Get(authorizationHeader))
+	})
+	negotiate := func(client string) string {
+		token := newFakeSPNEGOToken(newFakeKerberosToken(newFakeTicket(client, time.Now()).encode()))
+		return authNegotiate + " " + base64.StdEncoding.EncodeToString(token)
+	}
+
+	// step: retrieve a session with the first negotiation
+	request, _ := http.NewRequest("GET", u+"/intranet", nil)
+	request.Header.Set(authorizationHeader, negotiate("jdoe"))
+	resp, err := http.DefaultTransport.RoundTrip(request)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	resp.Body.Close()
+	var session *http.Cookie
+	for _, x := range resp.Cookies() {
+		if x.Name == config.CookieKerberosName {
+			session = x
+		}
+	}
+	if !assert.NotNil(t, session, "the kerberos session cookie should have been dropped") {
+		t.FailNow()
+	}
+
+	cases := []struct {
+		URI           string
+		Authorization string
+		Cookie        *http.Cookie
+		HTTPCode      int
+		Negotiate     bool
+		Body          string
+	}{
+		{URI: "/intranet", HTTPCode: http.StatusUnauthorized, Negotiate: true, Body: oauthURL + authorizationURL},
+		{URI: "/intranet", Authorization: negotiate("jdoe"), HTTPCode: http.StatusOK, Body: "jdoe@" + fakeKerberosRealm + "|staff|kerberos|"},
+		{URI: "/portal", Authorization: negotiate("jsmith"), HTTPCode: http.StatusOK, Body: "jsmith@" + fakeKerberosRealm + "|admin,staff|kerberos|"},
+		{URI: "/portal", Authorization: negotiate("jdoe"), HTTPCode: http.StatusForbidden},
+		{URI: "/intranet", Cookie: session, HTTPCode: http.StatusOK, Body: "jdoe@" + fakeKerberosRealm + "|staff|kerberos|"},
+		{URI: "/intranet", Cookie: &http.Cookie{Name: config.CookieKerberosName, Value: "invalid"}, HTTPCode: http.StatusUnauthorized, Negotiate: true},
+		// the clients unable to negotiate kerberos continue to the login
+		{URI: "/intranet", Authorization: "Negotiate " + base64.StdEncoding.EncodeToString([]byte("NTLMSSP\x00\x01")), HTTPCode: http.StatusTemporaryRedirect},
+		{URI: "/intranet", Authorization: "Negotiate not-base64", HTTPCode: http.StatusTemporaryRedirect},
+		{URI: fakeAdminRoleURL, HTTPCode: http.StatusTemporaryRedirect},
+		{URI: fakeAdminRoleURL, Authorization: negotiate("jsmith"), HTTPCode: http.StatusTemporaryRedirect},
+	}
+	for i, c := range cases {
+		request, _ := http.NewRequest("GET", u+c.URI, nil)
+		if c.Authorization != "" {
+			request.Header.Set(authorizationHeader, c.Authorization)
+		}
+		if c.Cookie != nil {
+			request.AddCookie(c.Cookie)
+		}
+		resp, err := http.DefaultTransport.RoundTrip(request)
+		if !assert.NoError(t, err, "case %d, unable to make the request", i) {
+			continue
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Equal(t, c.HTTPCode, resp.StatusCode, "case %d, expected: %d, got: %d", i, c.HTTPCode, resp.StatusCode)
+		if c.Negotiate {
+			assert.Equal(t, authNegotiate, resp.Header.Get(headerWWWAuthenticate), "case %d, expected a negotiate challenge", i)
+		} else {
+			assert.Empty(t, resp.Header.Get(headerWWWAuthenticate), "case %d, unexpected challenge", i)
+		}
+		if c.Body != "" {
+			assert.True(t, strings.Contains(string(body), c.Body), "case %d, expected: %s in the body: %s", i, c.Body, body)
+		}
+	}
+}
+
+func TestKerberosSession(t *testing.T) {
+	p, _, _ := newTestProxyService(nil)
+	p.config.CookieKerberosName = "kc-kerberos"
+	now := time.Now()
+	identity := &kerberosIdentity{principal: "jdoe@" + fakeKerberosRealm, expires: now.Add(time.Hour)}
+
+	cx := newFakeGinContext("GET", "/intranet")
+	if !assert.NoError(t, p.dropKerberosCookie(cx, identity)) {
+		t.FailNow()
+	}
+	cookie := (&http.Response{Header: cx.Writer.Header()}).Cookies()[0]
+
+	cx = newFakeGinContext("GET", "/intranet")
+	cx.Request.AddCookie(cookie)
+	session, err := p.getKerberosSession(cx, now)
+	if assert.NoError(t, err) {
+		assert.Equal(t, identity.principal, session.principal)
+		assert.Equal(t, identity.expires.Unix(), session.expires.Unix())
+	}
+	_, err = p.getKerberosSession(cx, now.Add(time.Hour))
+	assert.Error(t, err, "the session should have expired with the ticket")
+
+	cx = newFakeGinContext("GET", "/intranet")
+	_, err = p.getKerberosSession(cx, now)
+	assert.Equal(t, ErrSessionNotFound, err)
+}
@@ -0,0 +1,105 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// signedState is the login state carried through the provider in the state parameter
+type signedState struct {
+	// Redirect is the relative url the user is returned to after the login
+	Redirect string `json:"r"`
+	// Expires is the unix time the state expires
+	Expires int64 `json:"e"`
+	// Nonce makes every state unique
+	Nonce string `json:"n"`
+}
+
+//
+// encodeSignedState encodes the redirect and expiration of the login into a signed state parameter, so no temporary
+// cookie is required to carry it through the provider
+//
+func encodeSignedState(key []byte, redirect string, expires time.Time) (string, error) {
+	nonce := make([]byte, 12)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(&signedState{
+		Redirect: redirect,
+		Expires:  expires.Unix(),
+		Nonce:    base64.RawURLEncoding.EncodeToString(nonce),
+	})
+	if err != nil {
+		return "", err
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+
+	return encoded + "." + getStateSignature(key, encoded), nil
+}
+
+//
+// decodeSignedState verifies the signature and expiration of the state parameter, returning the redirect
+//
+func decodeSignedState(key []byte, state string, now time.Time) (string, error) {
+	items := strings.Split(state, ".")
+	if len(items) != 2 {
+		return "", ErrStateInvalid
+	}
+	if !hmac.Equal([]byte(items[1]), []byte(getStateSignature(key, items[0]))) {
+		return "", ErrStateInvalid
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(items[0])
+	if err != nil {
+		return "", ErrStateInvalid
+	}
+	decoded := new(signedState)
+	if err := json.Unmarshal(payload, decoded); err != nil {
+		return "", ErrStateInvalid
+	}
+	if now.Unix() >= decoded.Expires {
+		return "", ErrStateExpired
+	}
+
+	return decoded.Redirect, nil
+}
+
+//
+// getStateSignature returns the hmac of the encoded state
+//
+func getStateSignature(key []byte, encoded string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(encoded))
+
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+//
+// getAuthorizationState returns the state parameter handed to the authorization handler for the redirect
+//
+func (r *oauthProxy) getAuthorizationState(redirect string) (string, error) {
+	if !r.config.EnableSignedState {
+		return base64.StdEncoding.EncodeToString([]byte(redirect)), nil
+	}
+
+	return encodeSignedState([]byte(r.config.EncryptionKey), redirect, time.Now().Add(r.config.SignedStateDuration))
+}
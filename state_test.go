@@ -0,0 +1,104 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSignedState(t *testing.T) {
+	key := []byte("AgXa7xRcoClDEU0ZDSH4X0XhL5Qy2Z2j")
+	now := time.Now()
+
+	state, err := encodeSignedState(key, "/admin?q=1", now.Add(time.Minute))
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	another, _ := encodeSignedState(key, "/admin?q=1", now.Add(time.Minute))
+	assert.NotEqual(t, state, another)
+
+	redirect, err := decodeSignedState(key, state, now)
+	assert.NoError(t, err)
+	assert.Equal(t, "/admin?q=1", redirect)
+
+	_, err = decodeSignedState(key, state, now.Add(time.Minute))
+	assert.Equal(t, ErrStateExpired, err)
+	_, err = decodeSignedState([]byte("another-key"), state, now)
+	assert.Equal(t, ErrStateInvalid, err)
+	_, err = decodeSignedState(key, "L2FkbWlu", now)
+	assert.Equal(t, ErrStateInvalid, err)
+	items := strings.Split(state, ".")
+	forged, _ := encodeSignedState([]byte("another-key"), "https://evil.com", now.Add(time.Minute))
+	_, err = decodeSignedState(key, strings.Split(forged, ".")[0]+"."+items[1], now)
+	assert.Equal(t, ErrStateInvalid, err)
+}
+
+func TestSignedStateCallback(t *testing.T) {
+	config := newFakeKeycloakConfig()
+	config.EnableSignedState = true
+	config.PreserveFragments = true
+	config.EncryptionKey = "AgXa7xRcoClDEU0ZDSH4X0XhL5Qy2Z2j"
+	config.SignedStateDuration = time.Minute
+	_, _, u := newTestProxyService(config)
+	key := []byte(config.EncryptionKey)
+
+	signed, _ := encodeSignedState(key, "/admin/test", time.Now().Add(time.Minute))
+	expired, _ := encodeSignedState(key, "/admin", time.Now().Add(-time.Minute))
+	cases := []struct {
+		URL         string
+		ExpectedURL string
+	}{
+		{URL: "/oauth/authorize?state=" + url.QueryEscape(signed), ExpectedURL: "/admin/test"},
+		{URL: "/oauth/authorize?state=" + url.QueryEscape(signed) + "&fragment=section/1", ExpectedURL: "/admin/test#section/1"},
+		{URL: "/oauth/authorize?state=L2FkbWlu", ExpectedURL: "/"},
+		{URL: "/oauth/authorize?state=" + url.QueryEscape(expired), ExpectedURL: "/"},
+		{URL: "/oauth/authorize", ExpectedURL: "/"},
+	}
+	for i, c := range cases {
+		req, _ := http.NewRequest("GET", u+c.URL, nil)
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if !assert.NoError(t, err, "case %d, unable to call the authorization handler", i) {
+			continue
+		}
+		req, _ = http.NewRequest("GET", resp.Header.Get("Location"), nil)
+		resp, err = http.DefaultTransport.RoundTrip(req)
+		if !assert.NoError(t, err, "case %d, unable to call the provider", i) {
+			continue
+		}
+		req, _ = http.NewRequest("GET", resp.Header.Get("Location"), nil)
+		resp, err = http.DefaultTransport.RoundTrip(req)
+		if !assert.NoError(t, err, "case %d, unable to call the callback", i) {
+			continue
+		}
+		assert.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode, "case %d, unexpected status", i)
+		assert.Equal(t, c.ExpectedURL, resp.Header.Get("Location"), "case %d, unexpected redirect", i)
+	}
+
+	// step: a callback with a forged or expired state is refused before the code exchange
+	for i, state := range []string{"L2FkbWlu", expired} {
+		resp, err := http.Get(u + config.getCallbackPath() + "?code=abc&state=" + url.QueryEscape(state))
+		if assert.NoError(t, err, "case %d, unable to call the callback", i) {
+			resp.Body.Close()
+			assert.Equal(t, http.StatusBadRequest, resp.StatusCode, "case %d, unexpected status", i)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// acrValuesParam is the parameter of the authentication context classes requested of the provider
+	acrValuesParam = "acr_values"
+	// claimACR is the claim of the authentication context class the user was authenticated with
+	claimACR = "acr"
+	// bearerErrorInsufficientAuthentication is the error of a token with a too weak authentication (rfc 9470)
+	bearerErrorInsufficientAuthentication = "insufficient_user_authentication"
+)
+
+//
+// indexOfACR returns the position of the acr in the levels, or -1 when it's not a level
+//
+func indexOfACR(acr string, levels []string) int {
+	for i, x := range levels {
+		if x == acr {
+			return i
+		}
+	}
+
+	return -1
+}
+
+//
+// isSufficientACR checks the acr of the token satisfies the required acr, i.e. is the same class or a stronger level
+//
+func isSufficientACR(acr, required string, levels []string) bool {
+	if acr == required {
+		return true
+	}
+	have, want := indexOfACR(acr, levels), indexOfACR(required, levels)
+
+	return have >= 0 && want >= 0 && have >= want
+}
+
+//
+// getStepUpACRValues returns the acr values requested of the provider, the required acr and the stronger levels
+//
+func getStepUpACRValues(required string, levels []string) []string {
+	if i := indexOfACR(required, levels); i >= 0 {
+		return levels[i:]
+	}
+
+	return []string{required}
+}
+
+//
+// isKnownACR checks the acr is one of the levels or required by a resource, so only those can be requested
+//
+func (r *oauthProxy) isKnownACR(acr string) bool {
+	if acr == "" {
+		return false
+	}
+	if containedIn(acr, r.config.ACRLevels) {
+		return true
+	}
+	for _, x := range r.config.getResources() {
+		if x.ACR == acr {
+			return true
+		}
+	}
+
+	return false
+}
+
+//
+// getRequiredACR returns the acr required by the resource of the request, if any
+//
+func getRequiredACR(cx *gin.Context) string {
+	if v, found := cx.Get(cxEnforce); found {
+		if resource, ok := v.(*Resource); ok {
+			return resource.ACR
+		}
+	}
+
+	return ""
+}
+
+//
+// getStepUpClaims returns the claims request parameter (openid connect core 5.5.1) requiring the acr of the identity
+//
+func getStepUpClaims(required string, levels []string) string {
+	encoded, _ := json.Marshal(map[string]interface{}{
+		"id_token": map[string]interface{}{
+			claimACR: map[string]interface{}{
+				"essential": true,
+				"values":    getStepUpACRValues(required, levels),
+			},
+		},
+	})
+
+	return string(encoded)
+}
+
+//
+// stepUpAuthentication handles a user whose acr is weaker than the resource requires; the browsers are redirected
+// to the provider requesting the acr, while the bearer tokens are refused with the insufficient_user_authentication
+// challenge (rfc 9470), as the client has to fetch a stronger token itself
+//
+func (r *oauthProxy) stepUpAuthentication(cx *gin.Context, user *userContext, required string) {
+	if user.isBearer() || r.config.NoRedirects {
+		params := []string{`error="` + bearerErrorInsufficientAuthentication + `"`}
+		if r.config.BearerRealm != "" {
+			params = append([]string{`realm="` + r.config.BearerRealm + `"`}, params...)
+		}
+		params = append(params, acrValuesParam+`="`+strings.Join(getStepUpACRValues(required, r.config.ACRLevels), " ")+`"`)
+		cx.Writer.Header().Add(headerWWWAuthenticate, authBearer+" "+strings.Join(params, ", "))
+		cx.AbortWithStatus(http.StatusUnauthorized)
+		return
+	}
+
+	r.redirectToAuthorization(cx)
+}
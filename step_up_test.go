@@ -0,0 +1,123 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsSufficientACR(t *testing.T) {
+	levels := []string{"0", "1", "2fa"}
+	cs := []struct {
+		ACR      string
+		Required string
+		Levels   []string
+		Ok       bool
+	}{
+		{ACR: "2fa", Required: "2fa", Ok: true},
+		{ACR: "1", Required: "2fa"},
+		{ACR: "", Required: "2fa"},
+		{ACR: "2fa", Required: "1", Levels: levels, Ok: true},
+		{ACR: "1", Required: "2fa", Levels: levels},
+		{ACR: "gold", Required: "1", Levels: levels},
+		{ACR: "2fa", Required: "gold", Levels: levels},
+	}
+	for i, c := range cs {
+		assert.Equal(t, c.Ok, isSufficientACR(c.ACR, c.Required, c.Levels), "case %d", i)
+	}
+}
+
+func TestGetStepUpACRValues(t *testing.T) {
+	levels := []string{"0", "1", "2fa"}
+	assert.Equal(t, []string{"1", "2fa"}, getStepUpACRValues("1", levels))
+	assert.Equal(t, []string{"gold"}, getStepUpACRValues("gold", levels))
+	assert.Equal(t, `{"id_token":{"acr":{"essential":true,"values":["2fa"]}}}`, getStepUpClaims("2fa", levels))
+}
+
+func TestAdmissionHandlerStepUp(t *testing.T) {
+	proxy := newFakeKeycloakProxyWithResources(t, []*Resource{
+		{
+			URL:     "/account",
+			Methods: []string{"ANY"},
+			ACR:     "2fa",
+		},
+	})
+	proxy.config.SkipTokenVerification = false
+	proxy.config.ACRLevels = []string{"0", "1", "2fa"}
+	handler := proxy.admissionMiddleware()
+
+	cs := []struct {
+		ACR       string
+		Bearer    bool
+		HTTPCode  int
+		Challenge string
+	}{
+		{ACR: "2fa", HTTPCode: http.StatusOK},
+		{ACR: "2fa", Bearer: true, HTTPCode: http.StatusOK},
+		{ACR: "1", HTTPCode: http.StatusTemporaryRedirect},
+		{
+			ACR:       "1",
+			Bearer:    true,
+			HTTPCode:  http.StatusUnauthorized,
+			Challenge: `Bearer error="insufficient_user_authentication", acr_values="2fa"`,
+		},
+	}
+	for i, c := range cs {
+		cx := newFakeGinContext("GET", "/account")
+		cx.Set(cxEnforce, proxy.config.Resources[0])
+		cx.Set(userContextName, &userContext{audience: "test", bearerToken: c.Bearer, claims: map[string]interface{}{"acr": c.ACR}})
+		handler(cx)
+		assert.Equal(t, c.HTTPCode, cx.Writer.Status(), "case %d", i)
+		assert.Equal(t, c.Challenge, cx.Writer.Header().Get(headerWWWAuthenticate), "case %d", i)
+		if c.HTTPCode != http.StatusTemporaryRedirect {
+			continue
+		}
+		location, err := url.Parse(cx.Writer.Header().Get("Location"))
+		if assert.NoError(t, err, "case %d", i) {
+			assert.Equal(t, "2fa", location.Query().Get(acrValuesParam), "case %d", i)
+		}
+	}
+}
+
+func TestAuthorizationParamsStepUp(t *testing.T) {
+	proxy := newFakeKeycloakProxyWithResources(t, []*Resource{
+		{
+			URL:     "/account",
+			Methods: []string{"ANY"},
+			ACR:     "2fa",
+		},
+	})
+	proxy.config.ACRLevels = []string{"0", "1", "2fa"}
+
+	cs := []struct {
+		Query    string
+		Expected url.Values
+	}{
+		{Query: "?acr_values=1", Expected: url.Values{"acr_values": {"1 2fa"}, "claims": {getStepUpClaims("1", proxy.config.ACRLevels)}}},
+		{Query: "?acr_values=2fa", Expected: url.Values{"acr_values": {"2fa"}, "claims": {getStepUpClaims("2fa", proxy.config.ACRLevels)}}},
+		{Query: "?acr_values=gold", Expected: url.Values{}},
+	}
+	for i, c := range cs {
+		cx := newFakeGinContext("GET", oauthURL+authorizationURL)
+		cx.Request.URL.RawQuery = strings.TrimPrefix(c.Query, "?")
+		assert.Equal(t, c.Expected, proxy.getAuthorizationParams(cx), "case %d", i)
+	}
+}
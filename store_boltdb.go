@@ -114,6 +114,18 @@ func (r boltdbStore) Delete(key string) error {
 	})
 }
 
+// Stats returns the statistics of the database
+func (r boltdbStore) Stats() map[string]interface{} {
+	stats := r.client.Stats()
+
+	return map[string]interface{}{
+		"free_pages":    stats.FreePageN,
+		"pending_pages": stats.PendingPageN,
+		"open_txs":      stats.OpenTxN,
+		"total_txs":     stats.TxN,
+	}
+}
+
 // Close closes of any open resources
 func (r boltdbStore) Close() error {
 	log.Infof("closing the resourcese for boltdb store")
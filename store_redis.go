@@ -16,37 +16,165 @@ limitations under the License.
 package main
 
 import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
 	"net/url"
+	"strconv"
+	"strings"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
 	redis "gopkg.in/redis.v4"
 )
 
+const (
+	// redisDialTimeout is the timeout on establishing a connection to redis, including the tls handshake and login
+	redisDialTimeout = time.Duration(5) * time.Second
+	// redisDefaultUser is the user of the password only authentication of redis
+	redisDefaultUser = "default"
+)
+
 type redisStore struct {
 	client *redis.Client
 }
 
 // newRedisStore creates a new redis store
-func newRedisStore(location *url.URL) (storage, error) {
+func newRedisStore(location *url.URL, config *Config) (storage, error) {
 	log.Infof("creating a redis client for store: %s", location.Host)
 
-	// step: get any password
-	password := ""
+	options, err := getRedisOptions(location, config)
+	if err != nil {
+		return nil, err
+	}
+
+	return redisStore{
+		client: redis.NewClient(options),
+	}, nil
+}
+
+// getRedisOptions parses the url notation, i.e. redis[s]://[USER:PASSWORD@]HOST:PORT[/DB], into the client options,
+// dialing over tls for rediss and logging in as the user of the acl when one is given
+func getRedisOptions(location *url.URL, config *Config) (*redis.Options, error) {
+	options := &redis.Options{
+		Addr:     location.Host,
+		PoolSize: config.StorePoolSize,
+	}
+	if location.Port() == "" {
+		options.Addr = net.JoinHostPort(location.Hostname(), "6379")
+	}
+
+	// step: select the database from the path
+	if db := strings.Trim(location.Path, "/"); db != "" {
+		n, err := strconv.ParseInt(db, 10, 64)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("the redis database: %s must be a positive number", db)
+		}
+		options.DB = n
+	}
+
+	// step: get any credentials, the password alone being the login of the default user
+	var username, password string
 	if location.User != nil {
+		username = location.User.Username()
 		password, _ = location.User.Password()
 	}
+	if username == redisDefaultUser {
+		username = ""
+	}
 
-	// step: parse the url notation
-	client := redis.NewClient(&redis.Options{
-		Addr:     location.Host,
-		DB:       0,
-		Password: password,
-	})
+	var tlsConfig *tls.Config
+	if location.Scheme == "rediss" {
+		var err error
+		if tlsConfig, err = getRedisTLSConfig(location.Hostname(), config); err != nil {
+			return nil, err
+		}
+	}
+	if tlsConfig == nil && username == "" {
+		options.Password = password
+		return options, nil
+	}
 
-	return redisStore{
-		client: client,
-	}, nil
+	// step: the client only logs in with a password, so the connection is authenticated as the user on dialing
+	address := options.Addr
+	options.Dialer = func() (net.Conn, error) {
+		conn, err := net.DialTimeout("tcp", address, redisDialTimeout)
+		if err != nil {
+			return nil, err
+		}
+		conn.SetDeadline(time.Now().Add(redisDialTimeout))
+		if tlsConfig != nil {
+			tlsConn := tls.Client(conn, tlsConfig)
+			if err := tlsConn.Handshake(); err != nil {
+				conn.Close()
+				return nil, err
+			}
+			conn = tlsConn
+		}
+		if username != "" {
+			if err := redisLogin(conn, username, password); err != nil {
+				conn.Close()
+				return nil, err
+			}
+		}
+		conn.SetDeadline(time.Time{})
+
+		return conn, nil
+	}
+	if username == "" {
+		options.Password = password
+	}
+
+	return options, nil
+}
+
+// getRedisTLSConfig creates the tls configuration of the connection, verifying redis against the ca certificate and
+// presenting the client certificate when given
+func getRedisTLSConfig(hostname string, config *Config) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName: hostname,
+		MinVersion: tls.VersionTLS12,
+	}
+	if config.StoreCACertificate != "" {
+		content, err := ioutil.ReadFile(config.StoreCACertificate)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(content) {
+			return nil, fmt.Errorf("no certificates found in the store ca certificate: %s", config.StoreCACertificate)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if config.StoreClientCertificate != "" {
+		certificate, err := tls.LoadX509KeyPair(config.StoreClientCertificate, config.StoreClientPrivateKey)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+
+	return tlsConfig, nil
+}
+
+// redisLogin authenticates the connection as the user of the redis acl
+func redisLogin(conn net.Conn, username, password string) error {
+	command := fmt.Sprintf("*3\r\n$4\r\nAUTH\r\n$%d\r\n%s\r\n$%d\r\n%s\r\n", len(username), username, len(password), password)
+	if _, err := conn.Write([]byte(command)); err != nil {
+		return err
+	}
+	reply, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(reply, "+") {
+		return fmt.Errorf("unable to login to redis as: %s, %s", username, strings.TrimSpace(strings.TrimPrefix(reply, "-")))
+	}
+
+	return nil
 }
 
 // Set adds a token to the store
@@ -63,6 +191,26 @@ func (r redisStore) Set(key, value string) error {
 	return nil
 }
 
+// SetWithExpiration adds a key to the store, expired by redis after the duration
+func (r redisStore) SetWithExpiration(key, value string, expiration time.Duration) error {
+	log.WithFields(log.Fields{
+		"key":        key,
+		"expiration": expiration.String(),
+	}).Debugf("adding the key: %s to the store", key)
+
+	return r.client.Set(key, value, expiration).Err()
+}
+
+// SetIfNotExists adds a key to the store, expired by redis after the duration, only if it's not already present
+func (r redisStore) SetIfNotExists(key, value string, expiration time.Duration) (bool, error) {
+	log.WithFields(log.Fields{
+		"key":        key,
+		"expiration": expiration.String(),
+	}).Debugf("claiming the key: %s in the store", key)
+
+	return r.client.SetNX(key, value, expiration).Result()
+}
+
 // Get retrieves a token from the store
 func (r redisStore) Get(key string) (string, error) {
 	log.WithFields(log.Fields{
@@ -70,11 +218,14 @@ func (r redisStore) Get(key string) (string, error) {
 	}).Debugf("retrieving the key: %s from store", key)
 
 	result := r.client.Get(key)
+	if result.Err() == redis.Nil {
+		return "", nil
+	}
 	if result.Err() != nil {
 		return "", result.Err()
 	}
 
-	return result.String(), nil
+	return result.Val(), nil
 }
 
 // Delete remove the key
@@ -86,6 +237,19 @@ func (r redisStore) Delete(key string) error {
 	return r.client.Del(key).Err()
 }
 
+// Stats returns the statistics of the connection pool
+func (r redisStore) Stats() map[string]interface{} {
+	stats := r.client.PoolStats()
+
+	return map[string]interface{}{
+		"requests":    stats.Requests,
+		"hits":        stats.Hits,
+		"timeouts":    stats.Timeouts,
+		"total_conns": stats.TotalConns,
+		"free_conns":  stats.FreeConns,
+	}
+}
+
 // Close closes of any open resources
 func (r redisStore) Close() error {
 	log.Infof("closing the resourcese for redis store")
@@ -18,20 +18,26 @@ package main
 import (
 	"fmt"
 	"net/url"
+	"strings"
 )
 
+// isRedisStoreURL checks the store is redis, with or without tls
+func isRedisStoreURL(location string) bool {
+	return strings.HasPrefix(location, "redis://") || strings.HasPrefix(location, "rediss://")
+}
+
 // createStorage creates the store client for use
-func createStorage(location string) (storage, error) {
+func createStorage(config *Config) (storage, error) {
 	var store storage
 	var err error
 
-	u, err := url.Parse(location)
+	u, err := url.Parse(config.StoreURL)
 	if err != nil {
 		return nil, err
 	}
 	switch u.Scheme {
-	case "redis":
-		store, err = newRedisStore(u)
+	case "redis", "rediss":
+		store, err = newRedisStore(u, config)
 	case "boltdb":
 		store, err = newBoltDBStore(u)
 	default:
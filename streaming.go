@@ -0,0 +1,93 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+//
+// streamingWriter flushes the response to the client as it's written by the upstream, rather than as the write
+// buffer of the connection fills
+//
+type streamingWriter struct {
+	gin.ResponseWriter
+	// flush every response, not only the partial content
+	always bool
+}
+
+//
+// shouldFlush checks if the response is flushed as it's written, the partial content always is
+//
+func (r *streamingWriter) shouldFlush() bool {
+	return r.always || r.ResponseWriter.Status() == http.StatusPartialContent
+}
+
+//
+// Write writes the content, flushing it to the client
+//
+func (r *streamingWriter) Write(content []byte) (int, error) {
+	n, err := r.ResponseWriter.Write(content)
+	if err == nil && r.shouldFlush() {
+		r.ResponseWriter.Flush()
+	}
+
+	return n, err
+}
+
+//
+// WriteString writes the content, flushing it to the client
+//
+func (r *streamingWriter) WriteString(content string) (int, error) {
+	n, err := r.ResponseWriter.WriteString(content)
+	if err == nil && r.shouldFlush() {
+		r.ResponseWriter.Flush()
+	}
+
+	return n, err
+}
+
+//
+// streamingMiddleware passes the range requests and the responses of the resources with buffering disabled to the
+// client as they are received, counting the bytes of the responses streamed to the clients
+//
+func (r *oauthProxy) streamingMiddleware() gin.HandlerFunc {
+	streamed := prometheus.MustRegisterOrGet(prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "proxy_streamed_bytes_total",
+			Help: "The bytes of the upstream responses streamed to the clients, partitioned by the status code",
+		},
+		[]string{"code"},
+	)).(*prometheus.CounterVec)
+
+	return func(cx *gin.Context) {
+		resource, _ := r.getDecision(cx)
+		noBuffering := resource != nil && resource.NoBuffering
+		if noBuffering || cx.Request.Header.Get("Range") != "" {
+			cx.Writer = &streamingWriter{ResponseWriter: cx.Writer, always: noBuffering}
+		}
+
+		cx.Next()
+
+		if size := cx.Writer.Size(); size > 0 {
+			streamed.WithLabelValues(strconv.Itoa(cx.Writer.Status())).Add(float64(size))
+		}
+	}
+}
@@ -0,0 +1,112 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStreamingRangeRequest(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 100000)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		http.ServeContent(w, req, "download.bin", time.Now(), bytes.NewReader(content))
+	}))
+	defer upstream.Close()
+
+	config := newFakeKeycloakConfig()
+	config.Upstream = upstream.URL
+	p, _, u := newTestProxyService(config)
+	if !assert.NoError(t, p.createUpstreamProxy(p.endpoint)) {
+		t.FailNow()
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, u+"/downloads/file", nil)
+	req.Header.Set("Range", "bytes=500000-500099")
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusPartialContent, resp.StatusCode)
+	assert.Equal(t, "bytes 500000-500099/1000000", resp.Header.Get("Content-Range"))
+	assert.Equal(t, content[500000:500100], body)
+}
+
+func TestStreamingNoBuffering(t *testing.T) {
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("first"))
+		w.(http.Flusher).Flush()
+		select {
+		case <-release:
+		case <-time.After(5 * time.Second):
+		}
+		w.Write([]byte("second"))
+	}))
+	defer upstream.Close()
+
+	config := newFakeKeycloakConfig()
+	config.Upstream = upstream.URL
+	config.Resources = []*Resource{{URL: "/exports", WhiteListed: true, NoBuffering: true}}
+	p, _, u := newTestProxyService(config)
+	if !assert.NoError(t, p.createUpstreamProxy(p.endpoint)) {
+		t.FailNow()
+	}
+
+	// step: the first chunk must arrive while the upstream is still writing
+	type result struct {
+		resp *http.Response
+		head []byte
+		err  error
+	}
+	received := make(chan result, 1)
+	go func() {
+		resp, err := http.Get(u + "/exports/report")
+		if err != nil {
+			received <- result{err: err}
+			return
+		}
+		head := make([]byte, 5)
+		_, err = io.ReadFull(resp.Body, head)
+		received <- result{resp: resp, head: head, err: err}
+	}()
+	var first result
+	select {
+	case first = <-received:
+	case <-time.After(2 * time.Second):
+		close(release)
+		t.Fatalf("the first chunk of the response was not flushed to the client")
+	}
+	close(release)
+	if !assert.NoError(t, first.err) {
+		t.FailNow()
+	}
+	defer first.resp.Body.Close()
+	assert.Equal(t, "first", string(first.head))
+	rest, err := ioutil.ReadAll(first.resp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "second", string(rest))
+}
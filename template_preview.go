@@ -0,0 +1,175 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/urfave/cli"
+)
+
+// previewRedirectURL is the sample redirection url handed to the sign in page
+const previewRedirectURL = "https://sso.example.com/auth/realms/example/protocol/openid-connect/auth?client_id=proxy&response_type=code&state=Lw%3D%3D"
+
+//
+// templatePreview is a page which can be previewed
+//
+type templatePreview struct {
+	// the name of the page
+	name string
+	// the template file
+	filename string
+	// the data passed to the template
+	model interface{}
+}
+
+//
+// newTemplateCommand creates the command to preview the custom templates
+//
+func newTemplateCommand(config *Config) cli.Command {
+	return cli.Command{
+		Name:  "template",
+		Usage: "helpers for authoring the custom templates",
+		Subcommands: []cli.Command{
+			{
+				Name:      "preview",
+				Usage:     "renders the sign in, forbidden and challenge pages with sample data and the configured tags",
+				UsageText: "keycloak-proxy template preview [options] [--page NAME] [--preview-listen ADDRESS]",
+				Flags: append(getOptions(),
+					cli.StringFlag{
+						Name:  "page",
+						Usage: "the page to render to stdout, either sign-in, forbidden or challenge, defaults to all",
+					},
+					cli.StringFlag{
+						Name:  "preview-listen",
+						Usage: "serve the pages on the address instead, the templates are reloaded on every request",
+					},
+				),
+				Action: func(cx *cli.Context) error {
+					if err := parseConfig(cx, config); err != nil {
+						return printError(err.Error())
+					}
+					pages := getTemplatePreviews(config)
+					if len(pages) == 0 {
+						return printError("no custom templates have been configured")
+					}
+					if listen := cx.String("preview-listen"); listen != "" {
+						fmt.Fprintf(cx.App.Writer, "serving the template previews on http://%s/\n", listen)
+						if err := http.ListenAndServe(listen, newTemplatePreviewHandler(pages)); err != nil {
+							return printError(err.Error())
+						}
+						return nil
+					}
+					for _, x := range pages {
+						if page := cx.String("page"); page != "" && page != x.name {
+							continue
+						}
+						if err := x.render(cx.App.Writer); err != nil {
+							return printError(err.Error())
+						}
+					}
+
+					return nil
+				},
+			},
+		},
+	}
+}
+
+//
+// getTemplatePreviews returns the configured templates with the data they are rendered with by the proxy
+//
+func getTemplatePreviews(config *Config) []*templatePreview {
+	var list []*templatePreview
+	if config.hasCustomSignInPage() {
+		list = append(list, &templatePreview{
+			name:     "sign-in",
+			filename: config.SignInPage,
+			model:    config.getSignInPageModel(previewRedirectURL),
+		})
+	}
+	if config.hasCustomForbiddenPage() {
+		list = append(list, &templatePreview{
+			name:     "forbidden",
+			filename: config.ForbiddenPage,
+			model:    config.TagData,
+		})
+	}
+	if config.BotDetection.ChallengePage != "" {
+		list = append(list, &templatePreview{
+			name:     "challenge",
+			filename: config.BotDetection.ChallengePage,
+			model:    config.TagData,
+		})
+	}
+
+	return list
+}
+
+//
+// render parses the template and executes it with the sample data
+//
+func (r *templatePreview) render(w io.Writer) error {
+	tmpl, err := template.ParseFiles(r.filename)
+	if err != nil {
+		return fmt.Errorf("unable to parse the %s page: %s, error: %s", r.name, r.filename, err)
+	}
+	if err := tmpl.ExecuteTemplate(w, path.Base(r.filename), r.model); err != nil {
+		return fmt.Errorf("unable to render the %s page: %s, error: %s", r.name, r.filename, err)
+	}
+
+	return nil
+}
+
+//
+// newTemplatePreviewHandler serves a index of the pages and each page under its name
+//
+func newTemplatePreviewHandler(pages []*templatePreview) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/" {
+			http.NotFound(w, req)
+			return
+		}
+		var links []string
+		for _, x := range pages {
+			links = append(links, fmt.Sprintf(`<li><a href="/%s">%s</a> (%s)</li>`,
+				x.name, x.name, template.HTMLEscapeString(x.filename)))
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprintf(w, "<html><body><ul>%s</ul></body></html>", strings.Join(links, ""))
+	})
+	for _, x := range pages {
+		page := x
+		mux.HandleFunc("/"+page.name, func(w http.ResponseWriter, req *http.Request) {
+			content := &bytes.Buffer{}
+			if err := page.render(content); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			content.WriteTo(w)
+		})
+	}
+
+	return mux
+}
@@ -0,0 +1,79 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTemplatePreview(t *testing.T) {
+	config := newFakeKeycloakConfig()
+	assert.Empty(t, getTemplatePreviews(config))
+
+	config.SignInPage = "templates/sign_in.html.tmpl"
+	config.ForbiddenPage = "templates/forbidden.html.tmpl"
+	config.TagData = map[string]string{"title": "preview_title"}
+	pages := getTemplatePreviews(config)
+	if !assert.Len(t, pages, 2) {
+		t.FailNow()
+	}
+
+	content := &bytes.Buffer{}
+	assert.NoError(t, pages[0].render(content))
+	assert.Contains(t, content.String(), "<title>preview_title</title>")
+	assert.Contains(t, content.String(), "client_id=proxy")
+
+	content.Reset()
+	assert.NoError(t, pages[1].render(content))
+	assert.Contains(t, content.String(), "403 - Access Forbidden")
+
+	missing := &templatePreview{name: "sign-in", filename: "templates/does_not_exist.html.tmpl"}
+	assert.Error(t, missing.render(content))
+}
+
+func TestTemplatePreviewHandler(t *testing.T) {
+	config := newFakeKeycloakConfig()
+	config.SignInPage = "templates/sign_in.html.tmpl"
+	pages := append(getTemplatePreviews(config), &templatePreview{name: "broken", filename: "templates/does_not_exist.html.tmpl"})
+	service := httptest.NewServer(newTemplatePreviewHandler(pages))
+	defer service.Close()
+
+	cases := []struct {
+		URI      string
+		HTTPCode int
+		Content  string
+	}{
+		{URI: "/", HTTPCode: http.StatusOK, Content: `<a href="/sign-in">sign-in</a>`},
+		{URI: "/sign-in", HTTPCode: http.StatusOK, Content: "Sign In"},
+		{URI: "/broken", HTTPCode: http.StatusInternalServerError, Content: "unable to parse the broken page"},
+		{URI: "/forbidden", HTTPCode: http.StatusNotFound},
+	}
+	for i, c := range cases {
+		resp, err := http.Get(service.URL + c.URI)
+		if !assert.NoError(t, err, "case %d, unable to make the request", i) {
+			continue
+		}
+		content, _ := ioutil.ReadAll(resp.Body)
+		assert.Equal(t, c.HTTPCode, resp.StatusCode, "case %d, expected: %d, got: %d", i, c.HTTPCode, resp.StatusCode)
+		assert.Contains(t, string(content), c.Content, "case %d", i)
+	}
+}
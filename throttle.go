@@ -0,0 +1,160 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"io"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gin-gonic/gin"
+)
+
+//
+// bandwidthLimiter paces a transfer to the rate in bytes per second, permitting a burst of a second's worth
+//
+type bandwidthLimiter struct {
+	// the context of the transfer, the wait is cancelled with it
+	ctx context.Context
+	// the rate in bytes per second
+	rate int64
+	// the time the transfer started
+	started time.Time
+	// the bytes transferred so far
+	transferred int64
+}
+
+//
+// newBandwidthLimiter creates a limiter for the transfer
+//
+func newBandwidthLimiter(ctx context.Context, rate int64) *bandwidthLimiter {
+	return &bandwidthLimiter{ctx: ctx, rate: rate, started: time.Now()}
+}
+
+//
+// wait blocks until the size can be transferred within the rate, or the transfer is cancelled
+//
+func (r *bandwidthLimiter) wait(size int) error {
+	r.transferred += int64(size)
+	permitted := r.rate + int64(time.Since(r.started).Seconds()*float64(r.rate))
+	if r.transferred <= permitted {
+		return nil
+	}
+	delay := time.Duration(float64(r.transferred-permitted) / float64(r.rate) * float64(time.Second))
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-r.ctx.Done():
+		return r.ctx.Err()
+	}
+}
+
+//
+// throttledReader limits the rate the request body is read
+//
+type throttledReader struct {
+	io.ReadCloser
+	limiter *bandwidthLimiter
+}
+
+//
+// Read reads from the body and waits for the rate to permit it
+//
+func (r *throttledReader) Read(content []byte) (int, error) {
+	n, err := r.ReadCloser.Read(content)
+	if n > 0 {
+		if e := r.limiter.wait(n); e != nil {
+			return n, e
+		}
+	}
+
+	return n, err
+}
+
+//
+// throttledWriter limits the rate the response is written
+//
+type throttledWriter struct {
+	gin.ResponseWriter
+	limiter *bandwidthLimiter
+}
+
+//
+// Write waits for the rate to permit the content before writing it
+//
+func (r *throttledWriter) Write(content []byte) (int, error) {
+	if err := r.limiter.wait(len(content)); err != nil {
+		return 0, err
+	}
+
+	return r.ResponseWriter.Write(content)
+}
+
+//
+// WriteString waits for the rate to permit the content before writing it
+//
+func (r *throttledWriter) WriteString(content string) (int, error) {
+	if err := r.limiter.wait(len(content)); err != nil {
+		return 0, err
+	}
+
+	return r.ResponseWriter.WriteString(content)
+}
+
+//
+// transferLimitMiddleware limits the bandwidth of the uploads and downloads and the duration of the transfer, so a
+// few bulk transfers can't starve the interactive traffic
+//
+func (r *oauthProxy) transferLimitMiddleware() gin.HandlerFunc {
+	return func(cx *gin.Context) {
+		if r.config.MaxUploadRate <= 0 && r.config.MaxDownloadRate <= 0 && r.config.MaxTransferDuration <= 0 {
+			return
+		}
+		// step: the upgraded connections are long lived by design
+		if isUpgradedConnection(cx.Request) {
+			return
+		}
+
+		ctx := cx.Request.Context()
+		if r.config.MaxTransferDuration > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, r.config.MaxTransferDuration)
+			defer cancel()
+			cx.Request = cx.Request.WithContext(ctx)
+		}
+		if r.config.MaxUploadRate > 0 && cx.Request.Body != nil {
+			cx.Request.Body = &throttledReader{ReadCloser: cx.Request.Body, limiter: newBandwidthLimiter(ctx, r.config.MaxUploadRate)}
+		}
+		if r.config.MaxDownloadRate > 0 {
+			cx.Writer = &throttledWriter{ResponseWriter: cx.Writer, limiter: newBandwidthLimiter(ctx, r.config.MaxDownloadRate)}
+		}
+
+		cx.Next()
+
+		if ctx.Err() == context.DeadlineExceeded {
+			log.WithFields(log.Fields{
+				"client_ip": cx.ClientIP(),
+				"method":    cx.Request.Method,
+				"uri":       cx.Request.URL.Path,
+				"duration":  r.config.MaxTransferDuration.String(),
+			}).Warnf("the transfer exceeded the maximum duration and was aborted")
+		}
+	}
+}
@@ -0,0 +1,64 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBandwidthLimiter(t *testing.T) {
+	cases := []struct {
+		Rate    int64
+		Size    int
+		Minimum time.Duration
+		Maximum time.Duration
+	}{
+		// within the burst
+		{Rate: 10000, Size: 10000, Maximum: 100 * time.Millisecond},
+		{Rate: 10000, Size: 15000, Minimum: 400 * time.Millisecond, Maximum: time.Second},
+	}
+	for i, c := range cases {
+		reader := &throttledReader{
+			ReadCloser: ioutil.NopCloser(bytes.NewReader(make([]byte, c.Size))),
+			limiter:    newBandwidthLimiter(context.Background(), c.Rate),
+		}
+		started := time.Now()
+		content, err := ioutil.ReadAll(reader)
+		elapsed := time.Since(started)
+		assert.NoError(t, err, "case %d, unexpected error", i)
+		assert.Equal(t, c.Size, len(content), "case %d, expected: %d bytes, got: %d", i, c.Size, len(content))
+		assert.True(t, elapsed >= c.Minimum && elapsed <= c.Maximum, "case %d, the transfer took: %s", i, elapsed)
+	}
+}
+
+func TestThrottledWriterCancelled(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	writer := &throttledWriter{ResponseWriter: newFakeResponse(), limiter: newBandwidthLimiter(ctx, 1000)}
+
+	_, err := writer.Write(make([]byte, 1000))
+	assert.NoError(t, err)
+	started := time.Now()
+	_, err = writer.Write(make([]byte, 10000))
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.True(t, time.Since(started) < time.Second)
+}
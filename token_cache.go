@@ -0,0 +1,255 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/coreos/go-oidc/jose"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// tokenCacheKeyPrefix is the prefix of the validations held in the store
+	tokenCacheKeyPrefix = "validated."
+)
+
+//
+// expiringStorage is a store which can expire the keys itself
+//
+type expiringStorage interface {
+	storage
+	// SetWithExpiration adds the key to the store, removed after the duration
+	SetWithExpiration(string, string, time.Duration) error
+}
+
+//
+// tokenCacheEntry is a successful validation of a token
+//
+type tokenCacheEntry struct {
+	// the hash of the token
+	key string
+	// the time the validation expires
+	expires time.Time
+	// the identity extracted from the token, if any
+	identity *userContext
+}
+
+//
+// tokenCache holds the recent successful validations of the access tokens, keyed by the hash of the token, so the
+// signature and claims aren't verified on every request; the least recently used are evicted beyond the size
+//
+type tokenCache struct {
+	sync.Mutex
+	// the maximum number of validations held
+	size int
+	// the maximum time a validation is held
+	ttl time.Duration
+	// the validations, most recently used first
+	entries *list.List
+	// the elements of the validations keyed by the hash of the token
+	elements map[string]*list.Element
+	// the shared store, if any
+	store expiringStorage
+	// the lookups, partitioned by the result
+	lookups *prometheus.CounterVec
+}
+
+//
+// newTokenCache creates the token validation cache
+//
+func newTokenCache(size int, ttl time.Duration, store expiringStorage) *tokenCache {
+	return &tokenCache{
+		size:     size,
+		ttl:      ttl,
+		entries:  list.New(),
+		elements: make(map[string]*list.Element),
+		store:    store,
+		lookups: prometheus.MustRegisterOrGet(prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "proxy_token_cache_lookups_total",
+				Help: "The lookups of the token validation cache, partitioned by the result",
+			},
+			[]string{"result"},
+		)).(*prometheus.CounterVec),
+	}
+}
+
+//
+// getTokenCacheKey returns the key of the token in the cache
+//
+func getTokenCacheKey(token jose.JWT) string {
+	// step: hash the segments as they are rather than encoding the token again
+	hash := sha256.New()
+	hash.Write([]byte(token.RawHeader))
+	hash.Write([]byte{'.'})
+	hash.Write([]byte(token.RawPayload))
+	hash.Write([]byte{'.'})
+	hash.Write(token.Signature)
+
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+//
+// getIdentity returns a copy of the identity extracted from a token with an unexpired validation, saving the claims
+// being decoded again on every request
+//
+func (r *tokenCache) getIdentity(token jose.JWT, now time.Time) *userContext {
+	key := getTokenCacheKey(token)
+
+	r.Lock()
+	defer r.Unlock()
+
+	element, found := r.elements[key]
+	if !found {
+		return nil
+	}
+	entry := element.Value.(*tokenCacheEntry)
+	if entry.identity == nil || !now.Before(entry.expires) {
+		return nil
+	}
+	identity := *entry.identity
+
+	return &identity
+}
+
+//
+// isValidated checks if the token has a unexpired validation, in memory or the store
+//
+func (r *tokenCache) isValidated(token jose.JWT, now time.Time) bool {
+	key := getTokenCacheKey(token)
+
+	r.Lock()
+	if element, found := r.elements[key]; found {
+		if now.Before(element.Value.(*tokenCacheEntry).expires) {
+			r.entries.MoveToFront(element)
+			r.Unlock()
+			r.lookups.WithLabelValues("hit").Inc()
+
+			return true
+		}
+		r.remove(element)
+	}
+	r.Unlock()
+
+	// step: fall back to the store shared by the other instances
+	if r.store != nil {
+		if expires, found := r.getStoredValidation(key); found && now.Before(expires) {
+			r.set(key, expires)
+			r.lookups.WithLabelValues("store").Inc()
+
+			return true
+		}
+	}
+	r.lookups.WithLabelValues("miss").Inc()
+
+	return false
+}
+
+//
+// add records a successful validation of the token, held no longer than the token is valid for
+//
+func (r *tokenCache) add(token jose.JWT, now time.Time) {
+	claims, err := token.Claims()
+	if err != nil {
+		return
+	}
+	exp, found, err := claims.TimeClaim("exp")
+	if err != nil || !found {
+		return
+	}
+	expires := now.Add(r.ttl)
+	if exp.Before(expires) {
+		expires = exp
+	}
+	if !now.Before(expires) {
+		return
+	}
+	key := getTokenCacheKey(token)
+	r.set(key, expires)
+
+	// step: keep the identity alongside the validation
+	if identity, err := extractIdentity(token); err == nil {
+		r.Lock()
+		if element, found := r.elements[key]; found {
+			element.Value.(*tokenCacheEntry).identity = identity
+		}
+		r.Unlock()
+	}
+
+	if r.store != nil {
+		if err := r.store.SetWithExpiration(tokenCacheKeyPrefix+key, strconv.FormatInt(expires.Unix(), 10), expires.Sub(now)); err != nil {
+			log.WithFields(log.Fields{
+				"error": err.Error(),
+			}).Warnf("unable to add the token validation to the store")
+		}
+	}
+}
+
+//
+// set adds the validation to memory, evicting the least recently used beyond the size
+//
+func (r *tokenCache) set(key string, expires time.Time) {
+	r.Lock()
+	defer r.Unlock()
+
+	if element, found := r.elements[key]; found {
+		element.Value.(*tokenCacheEntry).expires = expires
+		r.entries.MoveToFront(element)
+		return
+	}
+	r.elements[key] = r.entries.PushFront(&tokenCacheEntry{key: key, expires: expires})
+	for r.entries.Len() > r.size {
+		r.remove(r.entries.Back())
+	}
+}
+
+//
+// remove deletes the validation from memory, the lock must be held
+//
+func (r *tokenCache) remove(element *list.Element) {
+	r.entries.Remove(element)
+	delete(r.elements, element.Value.(*tokenCacheEntry).key)
+}
+
+//
+// getStoredValidation retrieves the expiration of the validation from the store
+//
+func (r *tokenCache) getStoredValidation(key string) (time.Time, bool) {
+	value, err := r.store.Get(tokenCacheKeyPrefix + key)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err.Error(),
+		}).Warnf("unable to retrieve the token validation from the store")
+
+		return time.Time{}, false
+	}
+	if value == "" {
+		return time.Time{}, false
+	}
+	expires, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	return time.Unix(expires, 0), true
+}
@@ -0,0 +1,120 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/coreos/go-oidc/jose"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeExpiringStore struct {
+	values map[string]string
+	// the error claiming the keys, if any
+	err error
+}
+
+func (r *fakeExpiringStore) Set(key, value string) error {
+	r.values[key] = value
+	return nil
+}
+
+func (r *fakeExpiringStore) SetWithExpiration(key, value string, expiration time.Duration) error {
+	r.values[key] = value
+	return nil
+}
+
+func (r *fakeExpiringStore) SetIfNotExists(key, value string, expiration time.Duration) (bool, error) {
+	if r.err != nil {
+		return false, r.err
+	}
+	if _, found := r.values[key]; found {
+		return false, nil
+	}
+	r.values[key] = value
+	return true, nil
+}
+
+func (r *fakeExpiringStore) Get(key string) (string, error) {
+	return r.values[key], nil
+}
+
+func (r *fakeExpiringStore) Delete(key string) error {
+	delete(r.values, key)
+	return nil
+}
+
+func (r *fakeExpiringStore) Close() error {
+	return nil
+}
+
+func TestTokenCache(t *testing.T) {
+	now := time.Now()
+	cache := newTokenCache(2, time.Minute, nil)
+	first := newFakeJWTToken(t, jose.Claims{"sub": "first", "aud": "test", "exp": float64(now.Add(time.Hour).Unix())})
+	second := newFakeJWTToken(t, jose.Claims{"sub": "second", "exp": float64(now.Add(30 * time.Second).Unix())})
+	third := newFakeJWTToken(t, jose.Claims{"sub": "third", "exp": float64(now.Add(time.Hour).Unix())})
+	expired := newFakeJWTToken(t, jose.Claims{"sub": "expired", "exp": float64(now.Add(-time.Second).Unix())})
+
+	assert.False(t, cache.isValidated(*first, now))
+	cache.add(*first, now)
+	cache.add(*second, now)
+	cache.add(*expired, now)
+	assert.True(t, cache.isValidated(*first, now))
+	assert.True(t, cache.isValidated(*second, now))
+	assert.False(t, cache.isValidated(*expired, now))
+
+	// step: the identity is extracted once and copied out
+	identity := cache.getIdentity(*first, now)
+	if assert.NotNil(t, identity) {
+		assert.Equal(t, "first", identity.id)
+		identity.bearerToken = true
+		assert.False(t, cache.getIdentity(*first, now).bearerToken)
+	}
+	assert.Nil(t, cache.getIdentity(*expired, now))
+
+	// step: the validation is held no longer than the ttl, nor the expiration of the token
+	assert.False(t, cache.isValidated(*second, now.Add(45*time.Second)))
+	assert.True(t, cache.isValidated(*first, now.Add(45*time.Second)))
+	assert.False(t, cache.isValidated(*first, now.Add(2*time.Minute)))
+
+	// step: the least recently used is evicted beyond the size
+	cache.add(*first, now)
+	cache.add(*second, now)
+	assert.True(t, cache.isValidated(*first, now))
+	cache.add(*third, now)
+	assert.Equal(t, 2, cache.entries.Len())
+	assert.True(t, cache.isValidated(*first, now))
+	assert.True(t, cache.isValidated(*third, now))
+	assert.False(t, cache.isValidated(*second, now))
+}
+
+func TestTokenCacheStore(t *testing.T) {
+	now := time.Now()
+	store := &fakeExpiringStore{values: make(map[string]string)}
+	token := newFakeJWTToken(t, jose.Claims{"sub": "test", "exp": float64(now.Add(time.Hour).Unix())})
+
+	newTokenCache(10, time.Minute, store).add(*token, now)
+	assert.Len(t, store.values, 1)
+
+	// step: another instance picks up the validation from the store
+	other := newTokenCache(10, time.Minute, store)
+	assert.True(t, other.isValidated(*token, now))
+	assert.Equal(t, 1, other.entries.Len())
+	assert.False(t, newTokenCache(10, time.Minute, store).isValidated(*token, now.Add(2*time.Minute)))
+}
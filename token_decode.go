@@ -0,0 +1,201 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-oidc/jose"
+	"github.com/urfave/cli"
+)
+
+//
+// newTokenCommand creates the command to decode and explain access tokens
+//
+func newTokenCommand(config *Config) cli.Command {
+	return cli.Command{
+		Name:  "token",
+		Usage: "helpers for inspecting access tokens",
+		Subcommands: []cli.Command{
+			{
+				Name:      "decode",
+				Usage:     "verifies the token against the provider, prints the claims and the resources it would satisfy",
+				UsageText: "keycloak-proxy token decode [options] --token TOKEN, or the token on stdin",
+				Flags: append(getOptions(),
+					cli.StringFlag{
+						Name:  "token",
+						Usage: "the access token to decode, if not given the token is read from stdin",
+					},
+				),
+				Action: func(cx *cli.Context) error {
+					if err := parseConfig(cx, config); err != nil {
+						return printError(err.Error())
+					}
+					token := cx.String("token")
+					if token == "" {
+						content, err := ioutil.ReadAll(os.Stdin)
+						if err != nil {
+							return printError("unable to read the token from stdin, error: %s", err)
+						}
+						token = string(content)
+					}
+					if strings.TrimSpace(token) == "" {
+						return printError("no token given, use --token or pass the token on stdin")
+					}
+
+					return decodeToken(cx.App.Writer, config, strings.TrimSpace(token))
+				},
+			},
+		},
+	}
+}
+
+//
+// decodeToken parses and verifies the token, writing the identity, claims and the resources the token would be
+// permitted access to
+//
+func decodeToken(w io.Writer, config *Config, t string) error {
+	token, err := jose.ParseJWT(strings.TrimPrefix(t, "Bearer "))
+	if err != nil {
+		return printError("unable to parse the token, error: %s", err)
+	}
+	user, err := extractIdentity(token)
+	if err != nil {
+		return printError("unable to extract the identity from the token, error: %s", err)
+	}
+
+	// step: verify the token against the provider
+	verified := "verified against the provider"
+	var verifyErr error
+	switch {
+	case config.SkipTokenVerification:
+		verified = "not verified, token verification is disabled"
+	case config.DiscoveryURL == "":
+		verified = "not verified, no discovery url configured"
+	default:
+		client, _, err := createOpenIDClient(config, nil)
+		if err != nil {
+			verifyErr = err
+		} else {
+			verifyErr = config.acceptAudience(token, verifyToken(client, token))
+		}
+		if verifyErr != nil {
+			verified = "invalid, " + verifyErr.Error()
+		}
+	}
+	expires := user.expiresAt.Format(time.RFC3339)
+	if user.isExpired() {
+		expires += " (expired)"
+	}
+
+	fmt.Fprintf(w, "subject:   %s\n", user.id)
+	fmt.Fprintf(w, "username:  %s\n", user.name)
+	fmt.Fprintf(w, "email:     %s\n", user.email)
+	fmt.Fprintf(w, "audience:  %s\n", user.audience)
+	fmt.Fprintf(w, "roles:     %s\n", user.getRoles())
+	fmt.Fprintf(w, "expires:   %s\n", expires)
+	fmt.Fprintf(w, "signature: %s\n", verified)
+
+	claims, err := json.MarshalIndent(user.claims, "", "  ")
+	if err != nil {
+		return printError("unable to encode the claims, error: %s", err)
+	}
+	fmt.Fprintf(w, "\nclaims:\n%s\n", claims)
+
+	// step: explain the resources the token would satisfy
+	claimMatches := make(map[string]*regexp.Regexp, 0)
+	for k, v := range config.MatchClaims {
+		if claimMatches[k], err = regexp.Compile(v); err != nil {
+			return printError("the claim match: %s is invalid, error: %s", k, err)
+		}
+	}
+	fmt.Fprintf(w, "\nresources:\n")
+	for _, x := range config.Resources {
+		status, reasons := "permit", explainResourceAccess(config, claimMatches, x, user)
+		if len(reasons) > 0 {
+			status = "deny"
+		}
+		fmt.Fprintf(w, "  [%-6s] %s %s", status, x.URL, strings.Join(x.Methods, ","))
+		if len(reasons) > 0 {
+			fmt.Fprintf(w, ", %s", strings.Join(reasons, ", "))
+		}
+		fmt.Fprintf(w, "\n")
+	}
+
+	if verifyErr != nil {
+		return cli.NewExitError("", 1)
+	}
+
+	return nil
+}
+
+//
+// explainResourceAccess returns the reasons the user would be denied access to the resource, mirroring the checks
+// of the authentication and admission middleware
+//
+func explainResourceAccess(config *Config, claimMatches map[string]*regexp.Regexp, resource *Resource, user *userContext) []string {
+	var reasons []string
+	if resource.WhiteListed {
+		return nil
+	}
+	if user.isExpired() {
+		reasons = append(reasons, "the token has expired")
+	}
+	if !config.isAllowedAudience(user) {
+		reasons = append(reasons, fmt.Sprintf("the audience: %s is not one of: %s", user.audience, strings.Join(config.getAllowedAudiences(), ",")))
+	}
+	var missing []string
+	for _, role := range resource.Roles {
+		if !containedIn(role, user.roles) {
+			missing = append(missing, role)
+		}
+	}
+	if len(missing) > 0 {
+		reasons = append(reasons, "missing roles: "+strings.Join(missing, ","))
+	}
+	var names []string
+	for name := range claimMatches {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		match := claimMatches[name]
+		value, found, err := user.claims.StringClaim(name)
+		switch {
+		case err != nil:
+			reasons = append(reasons, fmt.Sprintf("unable to extract the claim: %s", name))
+		case !found:
+			reasons = append(reasons, fmt.Sprintf("missing the claim: %s", name))
+		case !match.MatchString(value):
+			reasons = append(reasons, fmt.Sprintf("the claim: %s value: %s does not match: %s", name, value, match))
+		}
+	}
+	if resource.RequireDPoP {
+		if _, found := user.claims[claimConfirmation]; !found {
+			reasons = append(reasons, "the resource requires a dpop bound token")
+		}
+	}
+
+	return reasons
+}
@@ -0,0 +1,102 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"testing"
+
+	"github.com/coreos/go-oidc/jose"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecodeToken(t *testing.T) {
+	auth := newFakeOAuthServer()
+	auth.setUserRealmRoles([]string{fakeTestRole})
+	token, err := jose.NewSignedJWT(auth.claims, auth.signer)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	key, _ := rsa.GenerateKey(rand.Reader, 1024)
+	forged, err := jose.NewSignedJWT(auth.claims, jose.NewSignerRSA("test-kid", *key))
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	cases := []struct {
+		Token      string
+		SkipVerify bool
+		Error      bool
+		Report     []string
+	}{
+		{
+			Token: token.Encode(),
+			Report: []string{
+				"username:  rjayawardene",
+				"signature: verified against the provider",
+				"\"email\": \"gambol99@gmail.com\"",
+				"[permit] " + fakeAuthAllURL,
+				"[permit] " + fakeTestRoleURL,
+				"[deny  ] " + fakeAdminRoleURL + " GET, missing roles: " + fakeAdminRole,
+			},
+		},
+		{
+			Token:      "Bearer " + token.Encode(),
+			SkipVerify: true,
+			Report:     []string{"signature: not verified, token verification is disabled"},
+		},
+		{
+			Token:  forged.Encode(),
+			Error:  true,
+			Report: []string{"signature: invalid"},
+		},
+	}
+	for i, c := range cases {
+		config := newFakeKeycloakConfig()
+		config.DiscoveryURL = auth.getLocation()
+		config.SkipTokenVerification = c.SkipVerify
+
+		report := &bytes.Buffer{}
+		err := decodeToken(report, config, c.Token)
+		if c.Error && err == nil {
+			t.Errorf("case %d should have failed", i)
+		}
+		if !c.Error && err != nil {
+			t.Errorf("case %d should not have failed, error: %s", i, err)
+		}
+		for _, x := range c.Report {
+			assert.Contains(t, report.String(), x, "case %d, report: %s", i, report)
+		}
+	}
+
+	assert.Error(t, decodeToken(&bytes.Buffer{}, newFakeKeycloakConfig(), "not_a_token"))
+}
+
+func TestExplainResourceAccess(t *testing.T) {
+	user := &userContext{
+		audience: "test",
+		roles:    []string{"a"},
+		claims:   jose.Claims{"item": "tester"},
+	}
+	config := newFakeKeycloakConfig()
+	resource := &Resource{URL: "/", Roles: []string{"a", "b"}}
+	assert.Equal(t, []string{"the token has expired", "missing roles: b"}, explainResourceAccess(config, nil, resource, user))
+
+	resource.WhiteListed = true
+	assert.Empty(t, explainResourceAccess(config, nil, resource, user))
+}
@@ -0,0 +1,197 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// tokenExchangeGrantType is the grant type of the token exchange (rfc 8693)
+	tokenExchangeGrantType = "urn:ietf:params:oauth:grant-type:token-exchange"
+	// accessTokenType is the token type identifier of a access token
+	accessTokenType = "urn:ietf:params:oauth:token-type:access_token"
+	// tokenExchangeExpirySkew is the time before the expiration a exchanged token is no longer handed out
+	tokenExchangeExpirySkew = time.Duration(10) * time.Second
+)
+
+//
+// exchangedToken is a token issued for the upstream audience, held until it expires
+//
+type exchangedToken struct {
+	// the access token for the upstream
+	token string
+	// the time the token is no longer handed out
+	expires time.Time
+}
+
+//
+// tokenExchange exchanges the access tokens of the users for tokens of the upstream audience (rfc 8693), caching
+// the exchanged tokens by the subject so the provider isn't called on every request
+//
+type tokenExchange struct {
+	sync.Mutex
+	// the client used to reach the provider
+	client *http.Client
+	// the token endpoint of the provider
+	endpoint string
+	// the credentials of the client performing the exchange
+	clientID, clientSecret string
+	// the audience the tokens are exchanged for
+	audience string
+	// the maximum number of tokens held, zero disables the caching
+	size int
+	// the exchanged tokens keyed by the subject
+	entries map[string]*exchangedToken
+	// the exchanges, partitioned by the result
+	results *prometheus.CounterVec
+}
+
+//
+// newTokenExchange creates the exchange of the access tokens
+//
+func newTokenExchange(client *http.Client, endpoint, clientID, clientSecret, audience string, size int) *tokenExchange {
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	return &tokenExchange{
+		client:       client,
+		endpoint:     endpoint,
+		clientID:     clientID,
+		clientSecret: clientSecret,
+		audience:     audience,
+		size:         size,
+		entries:      make(map[string]*exchangedToken),
+		results: prometheus.MustRegisterOrGet(prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "proxy_token_exchanges_total",
+				Help: "The exchanges of the access tokens for the upstream audience, partitioned by the result",
+			},
+			[]string{"result"},
+		)).(*prometheus.CounterVec),
+	}
+}
+
+//
+// exchange returns the token of the upstream audience for the user, from the cache or the provider; the token is
+// held no longer than the access token of the user is valid for
+//
+func (r *tokenExchange) exchange(user *userContext, now time.Time) (string, error) {
+	r.Lock()
+	if entry, found := r.entries[user.id]; found {
+		if now.Before(entry.expires) {
+			r.Unlock()
+			r.results.WithLabelValues("cached").Inc()
+			return entry.token, nil
+		}
+		delete(r.entries, user.id)
+	}
+	r.Unlock()
+
+	token, expiresIn, err := r.request(user.getAccessToken())
+	if err != nil {
+		r.results.WithLabelValues("error").Inc()
+		return "", err
+	}
+	r.results.WithLabelValues("exchanged").Inc()
+
+	expires := now.Add(time.Duration(expiresIn)*time.Second - tokenExchangeExpirySkew)
+	if user.expiresAt.Before(expires) {
+		expires = user.expiresAt
+	}
+	if r.size > 0 && now.Before(expires) {
+		r.set(user.id, &exchangedToken{token: token, expires: expires}, now)
+	}
+
+	return token, nil
+}
+
+//
+// set adds the token to the cache, removing the expired tokens when full, else a arbitrary one
+//
+func (r *tokenExchange) set(subject string, entry *exchangedToken, now time.Time) {
+	r.Lock()
+	defer r.Unlock()
+
+	if len(r.entries) >= r.size {
+		for k, v := range r.entries {
+			if !now.Before(v.expires) {
+				delete(r.entries, k)
+			}
+		}
+	}
+	if len(r.entries) >= r.size {
+		for k := range r.entries {
+			delete(r.entries, k)
+			break
+		}
+	}
+	r.entries[subject] = entry
+}
+
+//
+// request calls the token endpoint of the provider, authenticating as the client, returning the exchanged token and
+// the seconds it expires in
+//
+func (r *tokenExchange) request(token string) (string, int, error) {
+	values := url.Values{
+		"grant_type":           {tokenExchangeGrantType},
+		"subject_token":        {token},
+		"subject_token_type":   {accessTokenType},
+		"requested_token_type": {accessTokenType},
+		"audience":             {r.audience},
+	}
+	req, err := http.NewRequest(http.MethodPost, r.endpoint, strings.NewReader(values.Encode()))
+	if err != nil {
+		return "", 0, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(r.clientID), url.QueryEscape(r.clientSecret))
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return "", 0, err
+	}
+	defer resp.Body.Close()
+
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", 0, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", 0, fmt.Errorf("the provider refused the token exchange, status: %d, response: %s", resp.StatusCode, content)
+	}
+	var response tokenResponse
+	if err := json.Unmarshal(content, &response); err != nil {
+		return "", 0, err
+	}
+	if response.AccessToken == "" {
+		return "", 0, fmt.Errorf("the response of the token exchange has no access token")
+	}
+
+	return response.AccessToken, response.ExpiresIn, nil
+}
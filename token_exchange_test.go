@@ -0,0 +1,87 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/coreos/go-oidc/jose"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenExchange(t *testing.T) {
+	var authorization, token string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		authorization = req.Header.Get(authorizationHeader)
+		token = req.Header.Get("X-Auth-Token")
+	}))
+	defer upstream.Close()
+
+	config := newFakeKeycloakConfig()
+	config.Upstream = upstream.URL
+	config.EnableTokenExchange = true
+	config.TokenExchangeAudience = "orders-api"
+	config.TokenExchangeCacheSize = 10
+	p, auth, u := newTestProxyService(config)
+	if !assert.NoError(t, p.createUpstreamProxy(p.endpoint)) {
+		t.FailNow()
+	}
+	signed, err := jose.NewSignedJWT(auth.claims, auth.signer)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	// step: the token is exchanged for the audience of the upstream, then taken from the cache
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequest(http.MethodGet, u+fakeAuthAllURL, nil)
+		req.Header.Set(authorizationHeader, "Bearer "+signed.Encode())
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode, "request %d", i)
+		assert.Equal(t, signed.Encode(), token, "request %d, the original token should be passed", i)
+		if !assert.True(t, strings.HasPrefix(authorization, "Bearer "), "request %d", i) {
+			continue
+		}
+		exchanged, err := jose.ParseJWT(strings.TrimPrefix(authorization, "Bearer "))
+		if !assert.NoError(t, err, "request %d", i) {
+			continue
+		}
+		claims, err := exchanged.Claims()
+		assert.NoError(t, err, "request %d", i)
+		assert.Equal(t, "orders-api", claims["aud"], "request %d", i)
+	}
+	assert.Equal(t, 1, auth.getExchanges())
+
+	// step: a refused exchange fails the request rather than passing the token upstream
+	p.exchange.audience = "refused"
+	p.exchange.entries = make(map[string]*exchangedToken)
+	authorization = ""
+	req, _ := http.NewRequest(http.MethodGet, u+fakeAuthAllURL, nil)
+	req.Header.Set(authorizationHeader, "Bearer "+signed.Encode())
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+	assert.Empty(t, authorization)
+}
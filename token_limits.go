@@ -0,0 +1,129 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/base64"
+	"strings"
+
+	"github.com/coreos/go-oidc/jose"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+//
+// tokenLimits are the sanity limits of the tokens presented by the clients, checked on the raw token before it's
+// decoded, so a maliciously large or deeply nested token is refused cheaply
+//
+type tokenLimits struct {
+	// the maximum size of the token in bytes, zero disables
+	size int
+	// the maximum number of claims of the token, zero disables
+	claims int
+	// the maximum nesting depth of the claims, zero disables
+	depth int
+	// the tokens refused, partitioned by the reason
+	rejected *prometheus.CounterVec
+}
+
+//
+// newTokenLimits creates the token limits
+//
+func newTokenLimits(size, claims, depth int) *tokenLimits {
+	return &tokenLimits{
+		size:   size,
+		claims: claims,
+		depth:  depth,
+		rejected: prometheus.MustRegisterOrGet(prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "proxy_token_rejected_total",
+				Help: "The tokens refused by the token sanity limits, partitioned by the reason",
+			},
+			[]string{"reason"},
+		)).(*prometheus.CounterVec),
+	}
+}
+
+//
+// check verifies the raw token is within the limits; a payload which can't be decoded is left to the parsing
+//
+func (r *tokenLimits) check(raw string) error {
+	if r.size > 0 && len(raw) > r.size {
+		r.rejected.WithLabelValues("size").Inc()
+		return ErrTokenTooLarge
+	}
+	if r.claims <= 0 && r.depth <= 0 {
+		return nil
+	}
+	segments := strings.Split(raw, ".")
+	if len(segments) != 3 {
+		return nil
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(segments[1], "="))
+	if err != nil {
+		return nil
+	}
+
+	// step: a single pass over the payload counting the members of the claims and the nesting depth
+	depth, members := 0, 0
+	quoted, escaped := false, false
+	for _, c := range payload {
+		if quoted {
+			switch {
+			case escaped:
+				escaped = false
+			case c == '\\':
+				escaped = true
+			case c == '"':
+				quoted = false
+			}
+			continue
+		}
+		switch c {
+		case '"':
+			quoted = true
+		case '{', '[':
+			if depth++; r.depth > 0 && depth > r.depth {
+				r.rejected.WithLabelValues("depth").Inc()
+				return ErrTokenTooDeep
+			}
+		case '}', ']':
+			depth--
+		case ':':
+			if depth != 1 {
+				continue
+			}
+			if members++; r.claims > 0 && members > r.claims {
+				r.rejected.WithLabelValues("claims").Inc()
+				return ErrTokenTooManyClaims
+			}
+		}
+	}
+
+	return nil
+}
+
+//
+// parseAccessToken parses the token presented by the client, checking the sanity limits first
+//
+func (r *oauthProxy) parseAccessToken(raw string) (jose.JWT, error) {
+	if r.limits != nil {
+		if err := r.limits.check(raw); err != nil {
+			return jose.JWT{}, err
+		}
+	}
+
+	return jose.ParseJWT(raw)
+}
@@ -0,0 +1,76 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"github.com/coreos/go-oidc/jose"
+	"github.com/stretchr/testify/assert"
+)
+
+func newFakeRawToken(payload string) string {
+	return "eyJhbGciOiJSUzI1NiJ9." + base64.RawURLEncoding.EncodeToString([]byte(payload)) + ".c2lnbmF0dXJl"
+}
+
+func TestTokenLimits(t *testing.T) {
+	limits := newTokenLimits(256, 3, 3)
+	cases := []struct {
+		Token string
+		Error error
+	}{
+		{Token: newFakeRawToken(`{"sub":"jdoe","realm_access":{"roles":["a","b"]},"aud":"test"}`)},
+		{Token: newFakeRawToken(`{"sub":"a:b","name":"{[{[\"quoted\"]}]}","iss":"http://x:80"}`)},
+		{Token: newFakeRawToken(`{"sub":"jdoe","exp":1,"iat":1,"aud":"test"}`), Error: ErrTokenTooManyClaims},
+		{Token: newFakeRawToken(`{"sub":"jdoe","a":{"b":{"c":{"d":1}}}}`), Error: ErrTokenTooDeep},
+		{Token: newFakeRawToken(`{"sub":"` + strings.Repeat("x", 256) + `"}`), Error: ErrTokenTooLarge},
+		{Token: newFakeRawToken(`[[[[[[[[[[`), Error: ErrTokenTooDeep},
+		// the tokens which aren't decodable are left to the parsing
+		{Token: "not.a-token"},
+		{Token: "eyJhbGciOiJSUzI1NiJ9.!!!.c2ln"},
+	}
+	for i, c := range cases {
+		assert.Equal(t, c.Error, limits.check(c.Token), "case %d, unexpected result", i)
+	}
+
+	// step: the limits are disabled by zero
+	assert.NoError(t, newTokenLimits(0, 0, 0).check(newFakeRawToken(`{"a":{"b":{"c":{"d":{"e":1}}}}}`)))
+	assert.NoError(t, newTokenLimits(0, 1, 0).check(newFakeRawToken(`{"a":{"b":{"c":{"d":{"e":1}}}}}`)))
+}
+
+func TestTokenLimitsRequest(t *testing.T) {
+	config := newFakeKeycloakConfig()
+	config.MaxTokenSize = 65536
+	config.MaxTokenDepth = 4
+	p, auth, _ := newTestProxyService(config)
+	token, err := jose.NewSignedJWT(auth.claims, auth.signer)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	_, err = p.parseAccessToken(token.Encode())
+	assert.NoError(t, err)
+
+	deep := newFakeRawToken(`{"sub":` + strings.Repeat("[", 100) + strings.Repeat("]", 100) + `}`)
+	large := newFakeRawToken(`{"sub":"` + strings.Repeat("x", 70000) + `"}`)
+	for i, x := range []string{deep, large} {
+		cx := newFakeGinContext("GET", fakeAuthAllURL)
+		cx.Request.Header.Set(authorizationHeader, "Bearer "+x)
+		_, err := p.getIdentity(cx)
+		assert.Error(t, err, "case %d should have failed", i)
+	}
+}
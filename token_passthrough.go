@@ -0,0 +1,192 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// tokenPassthroughMaxBodySize is the maximum size of a token request
+	tokenPassthroughMaxBodySize = 64 * 1024
+)
+
+// tokenPassthroughGrants are the grants permitted through to the token endpoint
+var tokenPassthroughGrants = []string{"authorization_code", "refresh_token"}
+
+//
+// tokenPassthrough forwards the token requests of the permitted clients to the token endpoint of the provider, so
+// the mobile clients can complete the code exchange via the hostname of the proxy
+//
+type tokenPassthrough struct {
+	sync.Mutex
+	// the client used to reach the provider
+	client *http.Client
+	// the client ids permitted
+	clients []string
+	// the requests permitted per client per minute
+	rate int
+	// the start of the current minute
+	window time.Time
+	// the requests of the clients in the current minute
+	requests map[string]int
+}
+
+//
+// newTokenPassthrough creates the token endpoint pass-through
+//
+func newTokenPassthrough(client *http.Client, clients []string, rate int) *tokenPassthrough {
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	return &tokenPassthrough{
+		client:   client,
+		clients:  clients,
+		rate:     rate,
+		requests: make(map[string]int),
+	}
+}
+
+//
+// allow checks the client is within its rate limit
+//
+func (r *tokenPassthrough) allow(client string, now time.Time) bool {
+	r.Lock()
+	defer r.Unlock()
+
+	if now.Sub(r.window) >= time.Minute {
+		r.window = now
+		r.requests = make(map[string]int)
+	}
+	if r.requests[client] >= r.rate {
+		return false
+	}
+	r.requests[client]++
+
+	return true
+}
+
+//
+// getTokenRequestClient returns the client id of the token request, from the basic authentication or the form
+//
+func getTokenRequestClient(req *http.Request, form url.Values) string {
+	if username, _, found := req.BasicAuth(); found {
+		if client, err := url.QueryUnescape(username); err == nil {
+			return client
+		}
+	}
+
+	return form.Get("client_id")
+}
+
+//
+// tokenPassthroughError writes a oauth error response
+//
+func tokenPassthroughError(cx *gin.Context, code int, reason, description string) {
+	cx.Header("Cache-Control", "no-store")
+	cx.JSON(code, gin.H{
+		"error":             reason,
+		"error_description": description,
+	})
+	cx.Abort()
+}
+
+//
+// tokenPassthroughHandler forwards the token request of a permitted client to the token endpoint of the provider
+//
+func (r *oauthProxy) tokenPassthroughHandler(cx *gin.Context) {
+	if r.provider.TokenEndpoint == nil {
+		cx.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	content, err := ioutil.ReadAll(io.LimitReader(cx.Request.Body, tokenPassthroughMaxBodySize+1))
+	if err != nil || len(content) > tokenPassthroughMaxBodySize {
+		tokenPassthroughError(cx, http.StatusBadRequest, "invalid_request", "the token request is invalid")
+		return
+	}
+	form, err := url.ParseQuery(string(content))
+	if err != nil {
+		tokenPassthroughError(cx, http.StatusBadRequest, "invalid_request", "the token request is invalid")
+		return
+	}
+
+	// step: only the permitted clients and grants are passed through
+	client := getTokenRequestClient(cx.Request, form)
+	if !containedIn(client, r.passthrough.clients) {
+		log.WithFields(log.Fields{
+			"client_id": client,
+			"client_ip": cx.ClientIP(),
+		}).Warnf("refusing the token request of a client not permitted through")
+
+		tokenPassthroughError(cx, http.StatusUnauthorized, "invalid_client", "the client is not permitted")
+		return
+	}
+	if !containedIn(form.Get("grant_type"), tokenPassthroughGrants) {
+		tokenPassthroughError(cx, http.StatusBadRequest, "unsupported_grant_type", "the grant type is not permitted")
+		return
+	}
+	if !r.passthrough.allow(client, time.Now()) {
+		log.WithFields(log.Fields{
+			"client_id": client,
+			"client_ip": cx.ClientIP(),
+		}).Warnf("the token request rate limit of the client has been reached")
+
+		cx.Header("Retry-After", "60")
+		tokenPassthroughError(cx, http.StatusTooManyRequests, "slow_down", "the rate limit of the client has been reached")
+		return
+	}
+
+	// step: forward the request to the provider
+	req, err := http.NewRequest(http.MethodPost, r.provider.TokenEndpoint.String(), bytes.NewReader(content))
+	if err != nil {
+		cx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if auth := cx.Request.Header.Get(authorizationHeader); auth != "" {
+		req.Header.Set(authorizationHeader, auth)
+	}
+	resp, err := r.passthrough.client.Do(req)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err.Error(),
+		}).Errorf("unable to forward the token request to the provider")
+
+		tokenPassthroughError(cx, http.StatusBadGateway, "temporarily_unavailable", "the provider is unavailable")
+		return
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		tokenPassthroughError(cx, http.StatusBadGateway, "temporarily_unavailable", "the provider is unavailable")
+		return
+	}
+	cx.Header("Cache-Control", "no-store")
+	cx.Header("Pragma", "no-cache")
+	cx.Data(resp.StatusCode, resp.Header.Get("Content-Type"), body)
+	cx.Abort()
+}
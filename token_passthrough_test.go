@@ -0,0 +1,71 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenPassthrough(t *testing.T) {
+	config := newFakeKeycloakConfig()
+	config.TokenPassthroughClients = []string{"mobile"}
+	config.TokenPassthroughRateLimit = 2
+	_, _, u := newTestProxyService(config)
+
+	cs := []struct {
+		Client       string
+		GrantType    string
+		ExpectedCode int
+	}{
+		{Client: "unknown", GrantType: "authorization_code", ExpectedCode: http.StatusUnauthorized},
+		{Client: "mobile", GrantType: "password", ExpectedCode: http.StatusBadRequest},
+		{Client: "mobile", GrantType: "authorization_code", ExpectedCode: http.StatusOK},
+		{Client: "mobile", GrantType: "authorization_code", ExpectedCode: http.StatusOK},
+		{Client: "mobile", GrantType: "authorization_code", ExpectedCode: http.StatusTooManyRequests},
+	}
+	for i, c := range cs {
+		form := url.Values{"client_id": {c.Client}, "grant_type": {c.GrantType}, "code": {"code"}}
+		resp, err := http.Post(u+oauthURL+providerTokenURL, "application/x-www-form-urlencoded", strings.NewReader(form.Encode()))
+		if !assert.NoError(t, err, "case %d, unable to make request", i) {
+			continue
+		}
+		resp.Body.Close()
+		assert.Equal(t, c.ExpectedCode, resp.StatusCode, "case %d, expected: %d, got: %d", i, c.ExpectedCode, resp.StatusCode)
+		assert.Equal(t, "no-store", resp.Header.Get("Cache-Control"), "case %d", i)
+	}
+}
+
+func TestTokenPassthroughAllow(t *testing.T) {
+	passthrough := newTokenPassthrough(nil, []string{"mobile"}, 1)
+	now := time.Now()
+	assert.True(t, passthrough.allow("mobile", now))
+	assert.False(t, passthrough.allow("mobile", now.Add(time.Second)))
+	assert.True(t, passthrough.allow("other", now.Add(time.Second)))
+	assert.True(t, passthrough.allow("mobile", now.Add(time.Minute)))
+}
+
+func TestGetTokenRequestClient(t *testing.T) {
+	req, _ := http.NewRequest(http.MethodPost, "http://127.0.0.1/", nil)
+	assert.Equal(t, "form", getTokenRequestClient(req, url.Values{"client_id": {"form"}}))
+	req.SetBasicAuth("basic", "secret")
+	assert.Equal(t, "basic", getTokenRequestClient(req, url.Values{"client_id": {"form"}}))
+}
@@ -0,0 +1,79 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/coreos/go-oidc/jose"
+	"github.com/coreos/go-oidc/oidc"
+)
+
+//
+// createTrustedIssuers creates the clients for the additional providers whose tokens are accepted, keyed by the issuer
+//
+func createTrustedIssuers(cfg *Config, httpClient *http.Client) (map[string]*oidc.Client, error) {
+	issuers := make(map[string]*oidc.Client)
+	for _, discoveryURL := range cfg.TrustedDiscoveryURLs {
+		// step: the client id, secret and scopes are shared with the primary provider
+		trusted := *cfg
+		trusted.DiscoveryURL = discoveryURL
+		trusted.IssuerURL = ""
+		trusted.ExternalDiscoveryURL = ""
+
+		client, provider, err := createOpenIDClient(&trusted, httpClient)
+		if err != nil {
+			return nil, fmt.Errorf("unable to create the client for the trusted discovery url: %s, error: %s", discoveryURL, err)
+		}
+		issuer := strings.TrimSuffix(provider.Issuer.String(), "/")
+		if _, found := issuers[issuer]; found {
+			return nil, fmt.Errorf("the trusted discovery url: %s has a duplicate issuer: %s", discoveryURL, issuer)
+		}
+		log.WithFields(log.Fields{
+			"discovery_url": discoveryURL,
+			"issuer":        issuer,
+		}).Infof("accepting the tokens from the trusted issuer")
+
+		issuers[issuer] = client
+	}
+
+	return issuers, nil
+}
+
+//
+// getIssuerClient returns the client for the provider which issued the token, defaulting to the primary provider
+//
+func (r *oauthProxy) getIssuerClient(token jose.JWT) *oidc.Client {
+	if len(r.issuers) <= 0 {
+		return r.client
+	}
+	claims, err := token.Claims()
+	if err != nil {
+		return r.client
+	}
+	issuer, found, err := claims.StringClaim("iss")
+	if err != nil || !found {
+		return r.client
+	}
+	if client, found := r.issuers[strings.TrimSuffix(issuer, "/")]; found {
+		return client
+	}
+
+	return r.client
+}
@@ -0,0 +1,61 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/coreos/go-oidc/jose"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTrustedIssuers(t *testing.T) {
+	trusted := newFakeOAuthServer()
+	untrusted := newFakeOAuthServer()
+	config := newFakeKeycloakConfig()
+	config.TrustedDiscoveryURLs = []string{trusted.getLocation()}
+	proxy, auth, u := newTestProxyService(config)
+	if !assert.Len(t, proxy.issuers, 1) {
+		t.FailNow()
+	}
+
+	cases := []struct {
+		Server   *fakeOAuthServer
+		HTTPCode int
+	}{
+		// note: the fake upstream doesn't write a response
+		{Server: auth, HTTPCode: http.StatusNotFound},
+		{Server: trusted, HTTPCode: http.StatusNotFound},
+		{Server: untrusted, HTTPCode: http.StatusForbidden},
+	}
+	for i, c := range cases {
+		token, err := jose.NewSignedJWT(c.Server.claims, c.Server.signer)
+		if !assert.NoError(t, err, "case %d, unable to sign the token", i) {
+			continue
+		}
+		assert.Equal(t, c.Server.getLocation() == trusted.getLocation(), proxy.getIssuerClient(*token) != proxy.client, "case %d, unexpected client", i)
+
+		request, _ := http.NewRequest("GET", u+fakeAuthAllURL, nil)
+		request.Header.Set("Authorization", "Bearer "+token.Encode())
+		resp, err := http.DefaultTransport.RoundTrip(request)
+		if !assert.NoError(t, err, "case %d, unable to make the request", i) {
+			continue
+		}
+		resp.Body.Close()
+		assert.Equal(t, c.HTTPCode, resp.StatusCode, "case %d, expected: %d, got: %d", i, c.HTTPCode, resp.StatusCode)
+	}
+}
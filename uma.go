@@ -0,0 +1,236 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// umaTicketGrantType is the grant type the permissions of the user are requested by (keycloak authorization services)
+const umaTicketGrantType = "urn:ietf:params:oauth:grant-type:uma-ticket"
+
+//
+// umaPermission is a permission granted to the user by the policies of the provider
+//
+type umaPermission struct {
+	// the id of the resource on the provider
+	ResourceID string `json:"rsid"`
+	// the name of the resource on the provider
+	ResourceName string `json:"rsname"`
+	// the scopes granted on the resource, none grants all
+	Scopes []string `json:"scopes"`
+}
+
+//
+// umaEntry is the permissions of a access token, held until it expires
+//
+type umaEntry struct {
+	// the time the permissions expire
+	expires time.Time
+	// the permissions granted, none when refused
+	permissions []umaPermission
+}
+
+//
+// umaEnforcer authorizes the requests by the permissions the authorization services of the provider grant the
+// access token of the user, caching the permissions so the provider isn't called on every request
+//
+type umaEnforcer struct {
+	sync.Mutex
+	// the client used to reach the provider
+	client *http.Client
+	// the token endpoint of the provider
+	endpoint string
+	// the client holding the resources and policies
+	audience string
+	// the maximum number of permissions held, zero disables the caching
+	size int
+	// the maximum time the permissions are held
+	ttl time.Duration
+	// the permissions keyed by the hash of the access token
+	entries map[string]*umaEntry
+	// the evaluations, partitioned by the result
+	results *prometheus.CounterVec
+}
+
+//
+// newUMAEnforcer creates the enforcement of the permissions of the provider
+//
+func newUMAEnforcer(client *http.Client, endpoint, audience string, size int, ttl time.Duration) *umaEnforcer {
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	return &umaEnforcer{
+		client:   client,
+		endpoint: endpoint,
+		audience: audience,
+		size:     size,
+		ttl:      ttl,
+		entries:  make(map[string]*umaEntry),
+		results: prometheus.MustRegisterOrGet(prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "proxy_uma_evaluations_total",
+				Help: "The requests for the permissions of the users, partitioned by the result",
+			},
+			[]string{"result"},
+		)).(*prometheus.CounterVec),
+	}
+}
+
+//
+// isPermitted checks the user is granted the resource, the scopes of the permission when any must hold the method
+//
+func (r *umaEnforcer) isPermitted(user *userContext, resource *Resource, method string, now time.Time) (bool, error) {
+	permissions, err := r.getPermissions(user, now)
+	if err != nil {
+		return false, err
+	}
+	name := resource.getName()
+	for _, x := range permissions {
+		if x.ResourceName != name && x.ResourceID != name {
+			continue
+		}
+		if len(x.Scopes) <= 0 {
+			return true, nil
+		}
+		for _, scope := range x.Scopes {
+			if strings.EqualFold(scope, method) {
+				return true, nil
+			}
+		}
+	}
+
+	return false, nil
+}
+
+//
+// getPermissions returns the permissions of the access token, from the cache or the provider; the permissions are
+// held no longer than the access token is valid for
+//
+func (r *umaEnforcer) getPermissions(user *userContext, now time.Time) ([]umaPermission, error) {
+	hash := sha256.Sum256([]byte(user.getAccessToken()))
+	key := hex.EncodeToString(hash[:])
+
+	r.Lock()
+	if entry, found := r.entries[key]; found {
+		if now.Before(entry.expires) {
+			r.Unlock()
+			r.results.WithLabelValues("cached").Inc()
+			return entry.permissions, nil
+		}
+		delete(r.entries, key)
+	}
+	r.Unlock()
+
+	permissions, err := r.request(user.getAccessToken())
+	if err != nil {
+		r.results.WithLabelValues("error").Inc()
+		return nil, err
+	}
+	if len(permissions) > 0 {
+		r.results.WithLabelValues("granted").Inc()
+	} else {
+		r.results.WithLabelValues("refused").Inc()
+	}
+
+	expires := now.Add(r.ttl)
+	if user.expiresAt.Before(expires) {
+		expires = user.expiresAt
+	}
+	if r.size > 0 && now.Before(expires) {
+		r.set(key, &umaEntry{expires: expires, permissions: permissions}, now)
+	}
+
+	return permissions, nil
+}
+
+//
+// set adds the permissions to the cache, removing the expired permissions when full, else a arbitrary one
+//
+func (r *umaEnforcer) set(key string, entry *umaEntry, now time.Time) {
+	r.Lock()
+	defer r.Unlock()
+
+	if len(r.entries) >= r.size {
+		for k, v := range r.entries {
+			if !now.Before(v.expires) {
+				delete(r.entries, k)
+			}
+		}
+	}
+	if len(r.entries) >= r.size {
+		for k := range r.entries {
+			delete(r.entries, k)
+			break
+		}
+	}
+	r.entries[key] = entry
+}
+
+//
+// request calls the token endpoint of the provider with the access token of the user, returning the permissions the
+// policies grant; a refusal by the provider is no permissions rather than a error
+//
+func (r *umaEnforcer) request(token string) ([]umaPermission, error) {
+	values := url.Values{
+		"grant_type":    {umaTicketGrantType},
+		"audience":      {r.audience},
+		"response_mode": {"permissions"},
+	}
+	req, err := http.NewRequest(http.MethodPost, r.endpoint, strings.NewReader(values.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set(authorizationHeader, "Bearer "+token)
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusForbidden:
+		return []umaPermission{}, nil
+	default:
+		return nil, fmt.Errorf("the provider failed to evaluate the permissions, status: %d, response: %s", resp.StatusCode, content)
+	}
+	var permissions []umaPermission
+	if err := json.Unmarshal(content, &permissions); err != nil {
+		return nil, err
+	}
+
+	return permissions, nil
+}
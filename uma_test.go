@@ -0,0 +1,170 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/coreos/go-oidc/jose"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUMAEnforcement(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	defer upstream.Close()
+
+	config := newFakeKeycloakConfig()
+	config.Upstream = upstream.URL
+	config.EnableUMA = true
+	config.UMACacheSize = 0
+	config.Resources = []*Resource{{URL: "/orders", Name: "orders", Methods: []string{"ANY"}, Roles: []string{"unknown"}}}
+	p, auth, u := newTestProxyService(config)
+	if !assert.NoError(t, p.createUpstreamProxy(p.endpoint)) {
+		t.FailNow()
+	}
+	signed, err := jose.NewSignedJWT(auth.claims, auth.signer)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	cs := []struct {
+		Permissions []umaPermission
+		Audience    string
+		Method      string
+		Expected    int
+	}{
+		{Method: http.MethodGet, Expected: http.StatusForbidden},
+		{
+			Permissions: []umaPermission{{ResourceName: "invoices"}},
+			Method:      http.MethodGet,
+			Expected:    http.StatusForbidden,
+		},
+		{
+			Permissions: []umaPermission{{ResourceName: "orders"}},
+			Method:      http.MethodGet,
+			Expected:    http.StatusOK,
+		},
+		{
+			Permissions: []umaPermission{{ResourceName: "orders", Scopes: []string{"POST"}}},
+			Method:      http.MethodGet,
+			Expected:    http.StatusForbidden,
+		},
+		{
+			Permissions: []umaPermission{{ResourceName: "orders", Scopes: []string{"get", "POST"}}},
+			Method:      http.MethodGet,
+			Expected:    http.StatusOK,
+		},
+		{
+			Permissions: []umaPermission{{ResourceName: "orders"}},
+			Audience:    "unavailable",
+			Method:      http.MethodGet,
+			Expected:    http.StatusBadGateway,
+		},
+	}
+	for i, c := range cs {
+		auth.setPermissions(c.Permissions)
+		p.uma.audience = fakeClientID
+		if c.Audience != "" {
+			p.uma.audience = c.Audience
+		}
+		req, _ := http.NewRequest(c.Method, u+"/orders/1", nil)
+		req.Header.Set(authorizationHeader, "Bearer "+signed.Encode())
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if !assert.NoError(t, err, "case %d, unable to make the request", i) {
+			continue
+		}
+		resp.Body.Close()
+		assert.Equal(t, c.Expected, resp.StatusCode, "case %d", i)
+	}
+}
+
+func TestUMAEnforcementCached(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	defer upstream.Close()
+
+	config := newFakeKeycloakConfig()
+	config.Upstream = upstream.URL
+	config.EnableUMA = true
+	config.UMACacheSize = 10
+	config.UMACacheTTL = time.Duration(1) * time.Minute
+	config.Resources = []*Resource{{URL: "/orders", Name: "orders", Methods: []string{"ANY"}}}
+	p, auth, u := newTestProxyService(config)
+	if !assert.NoError(t, p.createUpstreamProxy(p.endpoint)) {
+		t.FailNow()
+	}
+	auth.setPermissions([]umaPermission{{ResourceName: "orders"}})
+	signed, err := jose.NewSignedJWT(auth.claims, auth.signer)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	// step: the permissions are requested once, then taken from the cache
+	for i := 0; i < 3; i++ {
+		req, _ := http.NewRequest(http.MethodGet, u+"/orders/1", nil)
+		req.Header.Set(authorizationHeader, "Bearer "+signed.Encode())
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode, "request %d", i)
+	}
+	assert.Equal(t, 1, auth.getEvaluations())
+}
+
+func TestUMAEnforcementMatchClaims(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	defer upstream.Close()
+
+	for i, c := range []struct {
+		Match    string
+		Expected int
+	}{
+		{Match: "^gambol99@", Expected: http.StatusOK},
+		{Match: "^someone@", Expected: http.StatusForbidden},
+	} {
+		config := newFakeKeycloakConfig()
+		config.Upstream = upstream.URL
+		config.EnableUMA = true
+		config.UMACacheSize = 0
+		config.MatchClaims = map[string]string{"email": c.Match}
+		config.Resources = []*Resource{{URL: "/orders", Name: "orders", Methods: []string{"ANY"}}}
+		p, auth, u := newTestProxyService(config)
+		if !assert.NoError(t, p.createUpstreamProxy(p.endpoint)) {
+			t.FailNow()
+		}
+		p.uma.audience = fakeClientID
+		auth.setPermissions([]umaPermission{{ResourceName: "orders"}})
+		signed, err := jose.NewSignedJWT(auth.claims, auth.signer)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+
+		// step: the permission is granted, though the claims must still match
+		req, _ := http.NewRequest(http.MethodGet, u+"/orders/1", nil)
+		req.Header.Set(authorizationHeader, "Bearer "+signed.Encode())
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if !assert.NoError(t, err, "case %d, unable to make the request", i) {
+			continue
+		}
+		resp.Body.Close()
+		assert.Equal(t, c.Expected, resp.StatusCode, "case %d", i)
+		assert.Equal(t, 1, auth.getEvaluations(), "case %d", i)
+	}
+}
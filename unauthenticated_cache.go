@@ -0,0 +1,109 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+//
+// unauthenticatedEntry is the authorization state handed to the unauthenticated requests for a uri
+//
+type unauthenticatedEntry struct {
+	// the authorization state
+	state string
+	// the time the entry expires
+	expires time.Time
+}
+
+//
+// unauthenticatedCache holds the recent authorization states by the request uri, so a page without a session pulling
+// in dozens of assets doesn't have a state encoded and signed for every one of them
+//
+type unauthenticatedCache struct {
+	sync.Mutex
+	// the maximum number of entries held
+	size int
+	// the time an entry is held
+	ttl time.Duration
+	// the entries keyed by the request uri
+	entries map[string]*unauthenticatedEntry
+	// the lookups, partitioned by the result
+	lookups *prometheus.CounterVec
+}
+
+//
+// newUnauthenticatedCache creates the cache of the unauthenticated decisions
+//
+func newUnauthenticatedCache(size int, ttl time.Duration) *unauthenticatedCache {
+	return &unauthenticatedCache{
+		size:    size,
+		ttl:     ttl,
+		entries: make(map[string]*unauthenticatedEntry),
+		lookups: prometheus.MustRegisterOrGet(prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "proxy_unauthenticated_cache_lookups_total",
+				Help: "The lookups of the unauthenticated request cache, partitioned by the result",
+			},
+			[]string{"result"},
+		)).(*prometheus.CounterVec),
+	}
+}
+
+//
+// get returns the unexpired authorization state of the uri, if any
+//
+func (r *unauthenticatedCache) get(uri string, now time.Time) (string, bool) {
+	r.Lock()
+	entry, found := r.entries[uri]
+	if found && !now.Before(entry.expires) {
+		delete(r.entries, uri)
+		found = false
+	}
+	r.Unlock()
+
+	if !found {
+		r.lookups.WithLabelValues("miss").Inc()
+		return "", false
+	}
+	r.lookups.WithLabelValues("hit").Inc()
+
+	return entry.state, true
+}
+
+//
+// add holds the authorization state of the uri for the ttl; when full the expired entries are removed and, failing
+// that, the state isn't held, so a flood of distinct uris can't push out the pages being browsed
+//
+func (r *unauthenticatedCache) add(uri, state string, now time.Time) {
+	r.Lock()
+	defer r.Unlock()
+
+	if len(r.entries) >= r.size {
+		for k, v := range r.entries {
+			if !now.Before(v.expires) {
+				delete(r.entries, k)
+			}
+		}
+		if len(r.entries) >= r.size {
+			return
+		}
+	}
+	r.entries[uri] = &unauthenticatedEntry{state: state, expires: now.Add(r.ttl)}
+}
@@ -0,0 +1,70 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUnauthenticatedCache(t *testing.T) {
+	now := time.Now()
+	cache := newUnauthenticatedCache(2, time.Second)
+
+	_, found := cache.get("/a", now)
+	assert.False(t, found)
+	cache.add("/a", "state-a", now)
+	cache.add("/b", "state-b", now)
+	state, found := cache.get("/a", now)
+	assert.True(t, found)
+	assert.Equal(t, "state-a", state)
+
+	// step: no room is made for a new uri until the entries expire
+	cache.add("/c", "state-c", now)
+	_, found = cache.get("/c", now)
+	assert.False(t, found)
+	_, found = cache.get("/a", now.Add(time.Second))
+	assert.False(t, found)
+	cache.add("/c", "state-c", now.Add(time.Second))
+	_, found = cache.get("/c", now.Add(time.Second))
+	assert.True(t, found)
+}
+
+func TestUnauthenticatedCacheRedirect(t *testing.T) {
+	config := newFakeKeycloakConfig()
+	config.EnableSignedState = true
+	config.EncryptionKey = "AgXa7xRcoClDEU0ZDSH4X0XhL5Qy2Z2j"
+	config.SignedStateDuration = time.Minute
+	config.UnauthenticatedCacheSize = 10
+	config.UnauthenticatedCacheTTL = time.Minute
+	_, _, u := newTestProxyService(config)
+
+	var locations []string
+	for _, uri := range []string{"/admin/main.css", "/admin/main.css", "/admin/main.js"} {
+		req, _ := http.NewRequest("GET", u+uri, nil)
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		assert.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode)
+		locations = append(locations, resp.Header.Get("Location"))
+	}
+	assert.Equal(t, locations[0], locations[1])
+	assert.NotEqual(t, locations[0], locations[2])
+}
@@ -0,0 +1,179 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// upgradeWebSocket is the type of the upgraded connections, i.e. websockets
+	upgradeWebSocket = "websocket"
+	// upgradeEventStream is the type of the server sent event streams
+	upgradeEventStream = "sse"
+	// upgradeAnonymous is the subject of the connections without a identity
+	upgradeAnonymous = "anonymous"
+)
+
+//
+// upgradeTracker counts the long lived connections, i.e. the upgraded connections and event streams, which hold a
+// socket through the proxy, enforcing the global and per user limits
+//
+type upgradeTracker struct {
+	sync.Mutex
+	// the maximum connections in total, zero disables
+	maxTotal int
+	// the maximum connections per user, zero disables
+	maxPerUser int
+	// the connections open in total
+	total int
+	// the connections open per user, keyed by the subject or client address
+	users map[string]int
+	// the connections open per subject, the anonymous users sharing one
+	held map[string]int
+	// the connections open, partitioned by the type and resource
+	open *prometheus.GaugeVec
+	// the connections open, partitioned by the subject; the subjects are removed once they've none
+	subjects *prometheus.GaugeVec
+	// the connections refused, partitioned by the reason
+	rejected *prometheus.CounterVec
+}
+
+//
+// newUpgradeTracker creates the tracker of the long lived connections
+//
+func newUpgradeTracker(maxTotal, maxPerUser int) *upgradeTracker {
+	return &upgradeTracker{
+		maxTotal:   maxTotal,
+		maxPerUser: maxPerUser,
+		users:      make(map[string]int),
+		held:       make(map[string]int),
+		open: prometheus.MustRegisterOrGet(prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "proxy_upgraded_connections",
+				Help: "The upgraded connections and event streams open, partitioned by the type and resource",
+			},
+			[]string{"type", "resource"},
+		)).(*prometheus.GaugeVec),
+		subjects: prometheus.MustRegisterOrGet(prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "proxy_upgraded_connections_subject",
+				Help: "The upgraded connections and event streams open, partitioned by the subject",
+			},
+			[]string{"subject"},
+		)).(*prometheus.GaugeVec),
+		rejected: prometheus.MustRegisterOrGet(prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "proxy_upgraded_connections_rejected_total",
+				Help: "The upgraded connections and event streams refused by the limits, partitioned by the reason",
+			},
+			[]string{"reason"},
+		)).(*prometheus.CounterVec),
+	}
+}
+
+//
+// acquire records a connection opened by the user, returning the release or the reason it was refused
+//
+func (r *upgradeTracker) acquire(kind, resource, subject, user string) (func(), string) {
+	r.Lock()
+	defer r.Unlock()
+
+	if r.maxTotal > 0 && r.total >= r.maxTotal {
+		r.rejected.WithLabelValues("global").Inc()
+		return nil, "global"
+	}
+	if r.maxPerUser > 0 && r.users[user] >= r.maxPerUser {
+		r.rejected.WithLabelValues("user").Inc()
+		return nil, "user"
+	}
+	r.total++
+	r.users[user]++
+	r.held[subject]++
+	r.open.WithLabelValues(kind, resource).Inc()
+	r.subjects.WithLabelValues(subject).Inc()
+
+	return func() {
+		r.Lock()
+		defer r.Unlock()
+		r.total--
+		r.open.WithLabelValues(kind, resource).Dec()
+		if r.users[user]--; r.users[user] <= 0 {
+			delete(r.users, user)
+		}
+		// step: the subject is removed once it has no connections, so the series don't grow without bound
+		if r.held[subject]--; r.held[subject] <= 0 {
+			delete(r.held, subject)
+			r.subjects.DeleteLabelValues(subject)
+			return
+		}
+		r.subjects.WithLabelValues(subject).Dec()
+	}, ""
+}
+
+//
+// getUpgradeType returns the type of the long lived connection, if the request is one
+//
+func getUpgradeType(req *http.Request) string {
+	if isUpgradedConnection(req) {
+		return upgradeWebSocket
+	}
+	if strings.Contains(req.Header.Get("Accept"), "text/event-stream") {
+		return upgradeEventStream
+	}
+
+	return ""
+}
+
+//
+// acquireUpgrade records the long lived connection of the request against the limits, responding with a 429 when
+// refused; the release must be called once the connection is done
+//
+func (r *oauthProxy) acquireUpgrade(cx *gin.Context, kind string) (func(), bool) {
+	resource := "none"
+	if ur, found := cx.Get(cxEnforce); found {
+		resource = ur.(*Resource).getName()
+	}
+	// step: the anonymous clients are counted by the peer address, the forwarded headers being set by the client
+	address := getRemoteAddress(cx.Request)
+	subject, user := upgradeAnonymous, "ip:"+address
+	if uc, found := cx.Get(userContextName); found && uc.(*userContext).id != "" {
+		subject = uc.(*userContext).id
+		user = "sub:" + subject
+	}
+
+	release, reason := r.upgrades.acquire(kind, resource, subject, user)
+	if release == nil {
+		log.WithFields(log.Fields{
+			"type":      kind,
+			"resource":  resource,
+			"subject":   subject,
+			"client_ip": address,
+			"limit":     reason,
+		}).Warnf("refusing the connection, the %s limit of the upgraded connections has been reached", reason)
+
+		cx.AbortWithStatus(http.StatusTooManyRequests)
+		return nil, false
+	}
+
+	return release, true
+}
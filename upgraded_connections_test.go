@@ -0,0 +1,106 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetUpgradeType(t *testing.T) {
+	cases := []struct {
+		Headers  map[string]string
+		Expected string
+	}{
+		{Headers: map[string]string{"Upgrade": "websocket"}, Expected: upgradeWebSocket},
+		{Headers: map[string]string{"Accept": "text/event-stream"}, Expected: upgradeEventStream},
+		{Headers: map[string]string{"Accept": "text/html"}},
+		{},
+	}
+	for i, c := range cases {
+		req, _ := http.NewRequest(http.MethodGet, "/", nil)
+		for k, v := range c.Headers {
+			req.Header.Set(k, v)
+		}
+		assert.Equal(t, c.Expected, getUpgradeType(req), "case %d, unexpected type", i)
+	}
+}
+
+func TestUpgradeTrackerLimits(t *testing.T) {
+	tracker := newUpgradeTracker(3, 2)
+	first, reason := tracker.acquire(upgradeWebSocket, "chat", "alice", "sub:alice")
+	assert.NotNil(t, first)
+	assert.Empty(t, reason)
+	second, _ := tracker.acquire(upgradeEventStream, "feed", "alice", "sub:alice")
+	assert.NotNil(t, second)
+
+	// step: the user limit is reached, other users are permitted up to the global limit
+	release, reason := tracker.acquire(upgradeWebSocket, "chat", "alice", "sub:alice")
+	assert.Nil(t, release)
+	assert.Equal(t, "user", reason)
+	third, _ := tracker.acquire(upgradeWebSocket, "chat", upgradeAnonymous, "ip:10.0.0.1")
+	assert.NotNil(t, third)
+	release, reason = tracker.acquire(upgradeWebSocket, "chat", upgradeAnonymous, "ip:10.0.0.2")
+	assert.Nil(t, release)
+	assert.Equal(t, "global", reason)
+
+	// step: the released connections free up the limits and the subjects
+	first()
+	second()
+	third()
+	assert.Equal(t, 0, tracker.total)
+	assert.Empty(t, tracker.users)
+	assert.Empty(t, tracker.held)
+	release, _ = tracker.acquire(upgradeWebSocket, "chat", "alice", "sub:alice")
+	assert.NotNil(t, release)
+}
+
+func TestUpgradedConnectionRefused(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer upstream.Close()
+
+	config := newFakeKeycloakConfig()
+	config.Upstream = upstream.URL
+	config.MaxUpgradedConnectionsPerUser = 1
+	p, _, u := newTestProxyService(config)
+	if !assert.NoError(t, p.createUpstreamProxy(p.endpoint)) {
+		t.FailNow()
+	}
+
+	// step: hold the only connection permitted for the client, which a forged forwarded address doesn't evade
+	release, _ := p.upgrades.acquire(upgradeEventStream, "none", upgradeAnonymous, "ip:127.0.0.1")
+	req, _ := http.NewRequest(http.MethodGet, u+fakeTestWhitelistedURL, nil)
+	req.Header.Set("Accept", "text/event-stream")
+	req.Header.Set("X-Forwarded-For", "10.0.0.1")
+	resp, err := http.DefaultClient.Do(req)
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	}
+
+	release()
+	resp, err = http.DefaultClient.Do(req)
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+}
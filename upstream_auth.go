@@ -0,0 +1,209 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+const (
+	upstreamAuthBasic = "basic"
+	upstreamAuthNTLM  = "ntlm"
+
+	headerWWWAuthenticate = "WWW-Authenticate"
+)
+
+//
+// isValid validates the upstream authentication configuration
+//
+func (r *UpstreamAuth) isValid() error {
+	switch r.Type {
+	case upstreamAuthBasic, upstreamAuthNTLM:
+	default:
+		return fmt.Errorf("unsupported upstream authentication type: %s, should be %s or %s", r.Type, upstreamAuthBasic, upstreamAuthNTLM)
+	}
+	if r.Username == "" || r.Password == "" {
+		return fmt.Errorf("the upstream authentication requires both a username and password")
+	}
+
+	return nil
+}
+
+//
+// isAuthenticated checks if the proxy should authenticate to the hostname of the upstream with this configuration
+//
+func (r *UpstreamAuth) isAuthenticated(hostname string) bool {
+	if len(r.Domains) <= 0 {
+		return true
+	}
+	hostname = strings.Split(hostname, ":")[0]
+	for _, x := range r.Domains {
+		if hostname == x || strings.HasSuffix(hostname, "."+strings.TrimPrefix(x, ".")) {
+			return true
+		}
+	}
+
+	return false
+}
+
+//
+// getUpstreamAuth returns the first authentication configuration matching the host, or nil
+//
+func getUpstreamAuth(list []*UpstreamAuth, hostname string) *UpstreamAuth {
+	for _, x := range list {
+		if x.isAuthenticated(hostname) {
+			return x
+		}
+	}
+
+	return nil
+}
+
+//
+// upstreamAuthTransport authenticates the proxy to the upstream; the ntlm handshake authenticates the connection
+// rather than the request, so the transport relies on the connection being kept alive between the messages
+//
+type upstreamAuthTransport struct {
+	// the credentials
+	auth *UpstreamAuth
+	// the transport to the upstream
+	transport http.RoundTripper
+}
+
+//
+// RoundTrip makes the request to the upstream, authenticating as required
+//
+func (r *upstreamAuthTransport) RoundTrip(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Response, error) {
+	if r.auth.Type == upstreamAuthBasic {
+		req.SetBasicAuth(r.auth.Username, r.auth.Password)
+		return r.transport.RoundTrip(req)
+	}
+
+	// step: the request may be sent a number of times, so the body is read in
+	body, err := readRequestBody(req, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	// step: the connection may already be authenticated, so the request is tried as is first
+	resp, err := r.send(req, body, "")
+	if err != nil {
+		return nil, err
+	}
+	scheme := getNTLMScheme(resp)
+	if resp.StatusCode != http.StatusUnauthorized || scheme == "" {
+		return resp, nil
+	}
+	discardResponse(resp)
+
+	// step: open the handshake and retrieve the challenge of the upstream
+	resp, err = r.send(req, body, scheme+" "+base64.StdEncoding.EncodeToString(newNTLMNegotiateMessage()))
+	if err != nil {
+		return nil, err
+	}
+	challenge, err := getNTLMChallenge(resp, scheme)
+	if err != nil {
+		return resp, nil
+	}
+	discardResponse(resp)
+
+	// step: answer the challenge with the request
+	clientChallenge := make([]byte, 8)
+	if _, err := rand.Read(clientChallenge); err != nil {
+		return nil, err
+	}
+	message := newNTLMAuthenticateMessage(challenge, r.auth.Username, r.auth.Password, clientChallenge, time.Now())
+
+	return r.send(req, body, scheme+" "+base64.StdEncoding.EncodeToString(message))
+}
+
+//
+// send makes a copy of the request to the upstream with the authorization
+//
+func (r *upstreamAuthTransport) send(req *http.Request, body []byte, authorization string) (*http.Response, error) {
+	outbound := req.WithContext(req.Context())
+	outbound.Header = make(http.Header, len(req.Header))
+	for k, v := range req.Header {
+		outbound.Header[k] = v
+	}
+	outbound.Header.Del(authorizationHeader)
+	if authorization != "" {
+		outbound.Header.Set(authorizationHeader, authorization)
+	}
+	outbound.Body = ioutil.NopCloser(bytes.NewReader(body))
+	outbound.ContentLength = int64(len(body))
+
+	return r.transport.RoundTrip(outbound)
+}
+
+//
+// getNTLMScheme returns the scheme the upstream accepts ntlm by, preferring ntlm over negotiate, or empty if neither
+//
+func getNTLMScheme(resp *http.Response) string {
+	var scheme string
+	for _, x := range resp.Header[http.CanonicalHeaderKey(headerWWWAuthenticate)] {
+		switch fields := strings.Fields(x); {
+		case len(fields) <= 0:
+		case strings.EqualFold(fields[0], "NTLM"):
+			return "NTLM"
+		case strings.EqualFold(fields[0], "Negotiate"):
+			scheme = "Negotiate"
+		}
+	}
+
+	return scheme
+}
+
+//
+// getNTLMChallenge returns the challenge of the upstream from the response
+//
+func getNTLMChallenge(resp *http.Response, scheme string) (*ntlmChallenge, error) {
+	if resp.StatusCode != http.StatusUnauthorized {
+		return nil, fmt.Errorf("unexpected response to the ntlm negotiation, status: %d", resp.StatusCode)
+	}
+	for _, x := range resp.Header[http.CanonicalHeaderKey(headerWWWAuthenticate)] {
+		fields := strings.Fields(x)
+		if len(fields) != 2 || !strings.EqualFold(fields[0], scheme) {
+			continue
+		}
+		message, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil {
+			return nil, err
+		}
+
+		return parseNTLMChallengeMessage(message)
+	}
+
+	return nil, fmt.Errorf("no ntlm challenge in the response")
+}
+
+//
+// discardResponse reads and closes the body of the response, so the connection can be reused
+//
+func discardResponse(resp *http.Response) {
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64*1024))
+	resp.Body.Close()
+}
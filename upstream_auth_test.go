@@ -0,0 +1,171 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUpstreamAuthIsValid(t *testing.T) {
+	cases := []struct {
+		Auth *UpstreamAuth
+		Ok   bool
+	}{
+		{Auth: &UpstreamAuth{}},
+		{Auth: &UpstreamAuth{Type: "kerberos", Username: "user", Password: "secret"}},
+		{Auth: &UpstreamAuth{Type: upstreamAuthBasic, Username: "user"}},
+		{Auth: &UpstreamAuth{Type: upstreamAuthBasic, Username: "user", Password: "secret"}, Ok: true},
+		{Auth: &UpstreamAuth{Type: upstreamAuthNTLM, Username: `CORP\user`, Password: "secret"}, Ok: true},
+	}
+	for i, c := range cases {
+		err := c.Auth.isValid()
+		if c.Ok && err != nil {
+			t.Errorf("case %d should not have failed, error: %s", i, err)
+		}
+		if !c.Ok && err == nil {
+			t.Errorf("case %d should have failed", i)
+		}
+	}
+}
+
+func TestGetUpstreamAuth(t *testing.T) {
+	list := []*UpstreamAuth{
+		{Type: upstreamAuthNTLM, Domains: []string{"corp.local"}},
+		{Type: upstreamAuthBasic},
+	}
+	assert.Equal(t, list[0], getUpstreamAuth(list, "sharepoint.corp.local:443"))
+	assert.Equal(t, list[1], getUpstreamAuth(list, "legacy.example.com"))
+	assert.Nil(t, getUpstreamAuth(list[:1], "legacy.example.com"))
+}
+
+// newFakeNTLMUpstream creates a upstream requiring the ntlm handshake, handing back the body of the request
+func newFakeNTLMUpstream(username, domain, password string) (*httptest.Server, *[]string) {
+	var connections []string
+	serverChallenge := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	authenticated := make(map[string]bool)
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		connections = append(connections, req.RemoteAddr)
+		if authenticated[req.RemoteAddr] {
+			content, _ := ioutil.ReadAll(req.Body)
+			w.Write(content)
+			return
+		}
+		authorization := strings.Fields(req.Header.Get(authorizationHeader))
+		if len(authorization) != 2 || authorization[0] != "NTLM" {
+			w.Header().Add(headerWWWAuthenticate, "Negotiate")
+			w.Header().Add(headerWWWAuthenticate, "NTLM")
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		message, _ := base64.StdEncoding.DecodeString(authorization[1])
+		switch binary.LittleEndian.Uint32(message[8:]) {
+		case 1:
+			challenge := make([]byte, 48)
+			copy(challenge, ntlmSignature)
+			binary.LittleEndian.PutUint32(challenge[8:], 2)
+			binary.LittleEndian.PutUint32(challenge[20:], ntlmNegotiateFlags)
+			copy(challenge[24:], serverChallenge)
+			binary.LittleEndian.PutUint32(challenge[44:], 48)
+			w.Header().Set(headerWWWAuthenticate, "NTLM "+base64.StdEncoding.EncodeToString(challenge))
+			w.WriteHeader(http.StatusUnauthorized)
+		case 3:
+			length := binary.LittleEndian.Uint16(message[20:])
+			offset := binary.LittleEndian.Uint32(message[24:])
+			response := message[offset : offset+uint32(length)]
+			key := getNTLMv2ResponseKey(username, domain, password)
+			if !bytes.Equal(hmacMD5(key, serverChallenge, response[16:]), response[:16]) {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			authenticated[req.RemoteAddr] = true
+			content, _ := ioutil.ReadAll(req.Body)
+			w.Write(content)
+		}
+	})), &connections
+}
+
+func TestUpstreamAuthTransportNTLM(t *testing.T) {
+	upstream, connections := newFakeNTLMUpstream("user", "CORP", "secret")
+	defer upstream.Close()
+
+	transport := &upstreamAuthTransport{
+		auth:      &UpstreamAuth{Type: upstreamAuthNTLM, Username: `CORP\user`, Password: "secret"},
+		transport: &http.Transport{},
+	}
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequest(http.MethodPost, upstream.URL, strings.NewReader("payload"))
+		resp, err := transport.RoundTrip(req, nil)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		content, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "payload", string(content))
+	}
+	// step: the handshake is made once on the one connection, which is then authenticated
+	if assert.Len(t, *connections, 4) {
+		for _, x := range *connections {
+			assert.Equal(t, (*connections)[0], x)
+		}
+	}
+
+	// step: the wrong credentials are handed back the refusal of the upstream
+	transport.auth.Password = "wrong"
+	transport.transport = &http.Transport{}
+	req, _ := http.NewRequest(http.MethodGet, upstream.URL, nil)
+	resp, err := transport.RoundTrip(req, nil)
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	}
+}
+
+func TestUpstreamAuthBasic(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if username, password, _ := req.BasicAuth(); username != "user" || password != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer upstream.Close()
+
+	config := newFakeKeycloakConfig()
+	config.Upstream = upstream.URL
+	config.UpstreamAuth = []*UpstreamAuth{{Type: upstreamAuthBasic, Username: "user", Password: "secret"}}
+	p, _, u := newTestProxyService(config)
+	if !assert.NoError(t, p.createUpstreamProxy(p.endpoint)) {
+		t.FailNow()
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, u+fakeTestWhitelistedURL, nil)
+	req.Header.Set(authorizationHeader, "Bearer token")
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
@@ -0,0 +1,144 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+//
+// connectionTracker counts the upstream connections and the requests in flight over them
+//
+type connectionTracker struct {
+	// the number of connections opened
+	opened int64
+	// the number of connections closed
+	closed int64
+	// the number of requests in flight
+	active int64
+}
+
+//
+// trackedConn is a upstream connection which is counted as closed once
+//
+type trackedConn struct {
+	net.Conn
+	tracker *connectionTracker
+	once    sync.Once
+}
+
+//
+// Close closes the connection and updates the tracker
+//
+func (r *trackedConn) Close() error {
+	r.once.Do(func() {
+		atomic.AddInt64(&r.tracker.closed, 1)
+	})
+
+	return r.Conn.Close()
+}
+
+//
+// dialer wraps the dialer to track the connections it opens
+//
+func (r *connectionTracker) dialer(dial func(string, string) (net.Conn, error)) func(string, string) (net.Conn, error) {
+	return func(network, address string) (net.Conn, error) {
+		conn, err := dial(network, address)
+		if err != nil {
+			return nil, err
+		}
+		atomic.AddInt64(&r.opened, 1)
+
+		return &trackedConn{Conn: conn, tracker: r}, nil
+	}
+}
+
+//
+// requestStarted marks a request in flight to the upstream
+//
+func (r *connectionTracker) requestStarted() {
+	atomic.AddInt64(&r.active, 1)
+}
+
+//
+// requestDone marks a request to the upstream as completed
+//
+func (r *connectionTracker) requestDone() {
+	atomic.AddInt64(&r.active, -1)
+}
+
+//
+// getOpen returns the number of connections currently open
+//
+func (r *connectionTracker) getOpen() int64 {
+	return atomic.LoadInt64(&r.opened) - atomic.LoadInt64(&r.closed)
+}
+
+//
+// getActive returns the number of connections in use, i.e. with a request in flight
+//
+func (r *connectionTracker) getActive() int64 {
+	if active, open := atomic.LoadInt64(&r.active), r.getOpen(); active < open {
+		return active
+	}
+
+	return r.getOpen()
+}
+
+//
+// getIdle returns the number of connections open but not in use
+//
+func (r *connectionTracker) getIdle() int64 {
+	return r.getOpen() - r.getActive()
+}
+
+//
+// register adds the connection metrics to prometheus
+//
+func (r *connectionTracker) register() {
+	prometheus.MustRegisterOrGet(prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "proxy_upstream_connections_active",
+			Help: "The upstream connections with a request in flight",
+		},
+		func() float64 { return float64(r.getActive()) },
+	))
+	prometheus.MustRegisterOrGet(prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "proxy_upstream_connections_idle",
+			Help: "The upstream connections open but idle, waiting to be reused or reaped",
+		},
+		func() float64 { return float64(r.getIdle()) },
+	))
+	prometheus.MustRegisterOrGet(prometheus.NewCounterFunc(
+		prometheus.CounterOpts{
+			Name: "proxy_upstream_connections_opened_total",
+			Help: "The upstream connections opened",
+		},
+		func() float64 { return float64(atomic.LoadInt64(&r.opened)) },
+	))
+	prometheus.MustRegisterOrGet(prometheus.NewCounterFunc(
+		prometheus.CounterOpts{
+			Name: "proxy_upstream_connections_closed_total",
+			Help: "The upstream connections closed, including those reaped when idle",
+		},
+		func() float64 { return float64(atomic.LoadInt64(&r.closed)) },
+	))
+}
@@ -0,0 +1,62 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConnectionTracker(t *testing.T) {
+	tracker := &connectionTracker{}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, int64(1), tracker.getActive())
+		assert.Equal(t, int64(0), tracker.getIdle())
+	}))
+	defer upstream.Close()
+
+	transport := &http.Transport{
+		Dial:            tracker.dialer(net.Dial),
+		IdleConnTimeout: 100 * time.Millisecond,
+	}
+	for i := 0; i < 2; i++ {
+		request, _ := http.NewRequest("GET", upstream.URL, nil)
+		tracker.requestStarted()
+		resp, err := transport.RoundTrip(request)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		tracker.requestDone()
+	}
+	// step: the connection should have been reused
+	assert.Equal(t, int64(1), tracker.opened)
+	assert.Equal(t, int64(1), tracker.getIdle())
+	assert.Equal(t, int64(0), tracker.getActive())
+
+	// step: the idle connection should be reaped
+	time.Sleep(300 * time.Millisecond)
+	assert.Equal(t, int64(1), tracker.closed)
+	assert.Equal(t, int64(0), tracker.getOpen())
+	assert.Equal(t, int64(0), tracker.getIdle())
+}
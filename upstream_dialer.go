@@ -0,0 +1,167 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+const (
+	// upstreamAttemptDelay is the time given to a connection attempt before the next address is tried alongside it
+	upstreamAttemptDelay = time.Duration(250) * time.Millisecond
+)
+
+//
+// dialResult is the outcome of a connection attempt
+//
+type dialResult struct {
+	conn net.Conn
+	err  error
+}
+
+//
+// upstreamDialer races the connections to the addresses of the upstream, in the manner of happy eyeballs (rfc 8305);
+// the next address is tried when an attempt fails or hasn't connected within the delay, and each attempt is given no
+// longer than the attempt timeout, so a dead address in the answer doesn't hold up the request for the whole timeout
+//
+type upstreamDialer struct {
+	// the maximum time for the lookup and connection
+	timeout time.Duration
+	// the maximum time for a connection attempt to an address
+	attemptTimeout time.Duration
+	// the time before the next address is tried
+	delay time.Duration
+	// the lookup of the addresses of a host
+	lookup func(context.Context, string) ([]net.IPAddr, error)
+	// the connection to an address
+	dial func(context.Context, string, string) (net.Conn, error)
+}
+
+//
+// newUpstreamDialer creates the upstream dialer
+//
+func newUpstreamDialer(dialer *net.Dialer, timeout, attemptTimeout time.Duration) *upstreamDialer {
+	return &upstreamDialer{
+		timeout:        timeout,
+		attemptTimeout: attemptTimeout,
+		delay:          upstreamAttemptDelay,
+		lookup:         net.DefaultResolver.LookupIPAddr,
+		dial:           dialer.DialContext,
+	}
+}
+
+//
+// Dial connects to the first of the addresses of the upstream to answer
+//
+func (r *upstreamDialer) Dial(network, address string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+	defer cancel()
+
+	host, port, err := net.SplitHostPort(address)
+	if err != nil || net.ParseIP(host) != nil {
+		return r.dial(ctx, network, address)
+	}
+	addresses, err := r.lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	ips := getDialOrder(network, addresses)
+	if len(ips) == 0 {
+		return nil, &net.AddrError{Err: "no suitable address found", Addr: host}
+	}
+	if len(ips) == 1 {
+		return r.dial(ctx, network, net.JoinHostPort(ips[0].String(), port))
+	}
+
+	results := make(chan dialResult, len(ips))
+	attempt := func(ip net.IP) {
+		actx, acancel := context.WithTimeout(ctx, r.attemptTimeout)
+		defer acancel()
+		conn, err := r.dial(actx, network, net.JoinHostPort(ip.String(), port))
+		results <- dialResult{conn: conn, err: err}
+	}
+
+	// step: start with the first address, trying the next on a failure or once the delay has passed
+	go attempt(ips[0])
+	next, pending := 1, 1
+	timer := time.NewTimer(r.delay)
+	defer timer.Stop()
+	for {
+		select {
+		case result := <-results:
+			pending--
+			if result.err == nil {
+				// step: close the connections of the attempts which lose the race
+				go func(pending int) {
+					for i := 0; i < pending; i++ {
+						if x := <-results; x.conn != nil {
+							x.conn.Close()
+						}
+					}
+				}(pending)
+
+				return result.conn, nil
+			}
+			err = result.err
+			if next >= len(ips) {
+				if pending <= 0 {
+					return nil, err
+				}
+				continue
+			}
+		case <-timer.C:
+			if next >= len(ips) {
+				continue
+			}
+		}
+		go attempt(ips[next])
+		next++
+		pending++
+		timer.Reset(r.delay)
+	}
+}
+
+//
+// getDialOrder returns the addresses suitable for the network, alternating between the address families with the
+// first family of the answer leading
+//
+func getDialOrder(network string, addresses []net.IPAddr) []net.IP {
+	var primary, fallback []net.IP
+	for _, x := range addresses {
+		isV4 := x.IP.To4() != nil
+		if (network == "tcp4" && !isV4) || (network == "tcp6" && isV4) {
+			continue
+		}
+		if len(primary) == 0 || (primary[0].To4() != nil) == isV4 {
+			primary = append(primary, x.IP)
+			continue
+		}
+		fallback = append(fallback, x.IP)
+	}
+	var ordered []net.IP
+	for i := 0; i < len(primary) || i < len(fallback); i++ {
+		if i < len(primary) {
+			ordered = append(ordered, primary[i])
+		}
+		if i < len(fallback) {
+			ordered = append(ordered, fallback[i])
+		}
+	}
+
+	return ordered
+}
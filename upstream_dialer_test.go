@@ -0,0 +1,86 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetDialOrder(t *testing.T) {
+	addresses := []net.IPAddr{
+		{IP: net.ParseIP("2001:db8::1")},
+		{IP: net.ParseIP("10.0.0.1")},
+		{IP: net.ParseIP("10.0.0.2")},
+		{IP: net.ParseIP("2001:db8::2")},
+		{IP: net.ParseIP("10.0.0.3")},
+	}
+	var ordered []string
+	for _, x := range getDialOrder("tcp", addresses) {
+		ordered = append(ordered, x.String())
+	}
+	assert.Equal(t, []string{"2001:db8::1", "10.0.0.1", "2001:db8::2", "10.0.0.2", "10.0.0.3"}, ordered)
+	assert.Len(t, getDialOrder("tcp4", addresses), 3)
+	assert.Len(t, getDialOrder("tcp6", addresses), 2)
+}
+
+func TestUpstreamDialer(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer listener.Close()
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+
+	dialer := newUpstreamDialer(&net.Dialer{}, 5*time.Second, time.Second)
+	dialer.delay = 50 * time.Millisecond
+	dialer.lookup = func(context.Context, string) ([]net.IPAddr, error) {
+		return []net.IPAddr{{IP: net.ParseIP("10.0.0.1")}, {IP: net.ParseIP("10.0.0.2")}, {IP: net.ParseIP("127.0.0.1")}}, nil
+	}
+	dialer.dial = func(ctx context.Context, network, address string) (net.Conn, error) {
+		switch address {
+		case net.JoinHostPort("10.0.0.1", port):
+			// the dead address never answers
+			<-ctx.Done()
+			return nil, ctx.Err()
+		case net.JoinHostPort("10.0.0.2", port):
+			return nil, errors.New("connection refused")
+		}
+		return (&net.Dialer{}).DialContext(ctx, network, address)
+	}
+
+	// step: the dead and refused addresses don't hold up the connection
+	started := time.Now()
+	conn, err := dialer.Dial("tcp", net.JoinHostPort("upstream.local", port))
+	if assert.NoError(t, err) {
+		conn.Close()
+		assert.Equal(t, net.JoinHostPort("127.0.0.1", port), conn.RemoteAddr().String())
+	}
+	assert.True(t, time.Since(started) < time.Second)
+
+	// step: the error is returned once all of the attempts have failed
+	dialer.attemptTimeout = 100 * time.Millisecond
+	dialer.lookup = func(context.Context, string) ([]net.IPAddr, error) {
+		return []net.IPAddr{{IP: net.ParseIP("10.0.0.1")}, {IP: net.ParseIP("10.0.0.2")}}, nil
+	}
+	_, err = dialer.Dial("tcp", net.JoinHostPort("upstream.local", port))
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
@@ -0,0 +1,89 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"text/template"
+)
+
+//
+// upstreamTemplate renders the upstream url of a request from the claims of the user, i.e. a backend per user; the
+// rendered url must match the pattern, so a claim can't route the request to any other host
+//
+type upstreamTemplate struct {
+	// the template of the upstream url
+	tmpl *template.Template
+	// the pattern the rendered url must match
+	pattern *regexp.Regexp
+}
+
+//
+// isUpstreamTemplate checks the upstream url holds claim placeholders
+//
+func isUpstreamTemplate(upstream string) bool {
+	return strings.Contains(upstream, "{{")
+}
+
+//
+// newUpstreamTemplate parses the template of the upstream url and the pattern the rendered urls must match
+//
+func newUpstreamTemplate(upstream, pattern string) (*upstreamTemplate, error) {
+	if pattern == "" {
+		return nil, errors.New("the templated upstream url requires the upstream url pattern")
+	}
+	if !strings.HasPrefix(upstream, "http://") && !strings.HasPrefix(upstream, "https://") {
+		return nil, errors.New("the templated upstream url must be a http or https url")
+	}
+	tmpl, err := template.New("upstream").Option("missingkey=error").Parse(upstream)
+	if err != nil {
+		return nil, fmt.Errorf("the upstream url template is invalid, %s", err)
+	}
+	compiled, err := regexp.Compile("^(?:" + pattern + ")$")
+	if err != nil {
+		return nil, fmt.Errorf("the upstream url pattern is invalid, %s", err)
+	}
+
+	return &upstreamTemplate{tmpl: tmpl, pattern: compiled}, nil
+}
+
+//
+// render returns the upstream url of the user
+//
+func (r *upstreamTemplate) render(user *userContext) (*url.URL, error) {
+	content := new(bytes.Buffer)
+	if err := r.tmpl.Execute(content, map[string]interface{}(user.claims)); err != nil {
+		return nil, fmt.Errorf("unable to render the upstream url, %s", err)
+	}
+	rendered := content.String()
+	if !r.pattern.MatchString(rendered) {
+		return nil, fmt.Errorf("the upstream url: %s does not match the upstream url pattern", rendered)
+	}
+	endpoint, err := url.Parse(rendered)
+	if err != nil {
+		return nil, fmt.Errorf("the upstream url: %s is invalid, %s", rendered, err)
+	}
+	if endpoint.Host == "" || (endpoint.Scheme != "http" && endpoint.Scheme != "https") {
+		return nil, fmt.Errorf("the upstream url: %s must be a absolute http or https url", rendered)
+	}
+
+	return endpoint, nil
+}
@@ -0,0 +1,111 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/coreos/go-oidc/jose"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewUpstreamTemplate(t *testing.T) {
+	cs := []struct {
+		Upstream string
+		Pattern  string
+		Ok       bool
+	}{
+		{Upstream: "http://notebook-{{ .preferred_username }}.svc:8888", Pattern: `http://notebook-[a-z]+\.svc:8888`, Ok: true},
+		{Upstream: "http://notebook-{{ .preferred_username }}.svc:8888"},
+		{Upstream: "unix://{{ .preferred_username }}.sock", Pattern: ".*"},
+		{Upstream: "http://notebook-{{ .preferred_username .svc:8888", Pattern: ".*"},
+		{Upstream: "http://notebook-{{ .preferred_username }}.svc:8888", Pattern: "[a-z"},
+	}
+	for i, c := range cs {
+		_, err := newUpstreamTemplate(c.Upstream, c.Pattern)
+		if c.Ok {
+			assert.NoError(t, err, "case %d, unexpected error", i)
+		} else {
+			assert.Error(t, err, "case %d, expected an error", i)
+		}
+	}
+}
+
+func TestUpstreamTemplateRender(t *testing.T) {
+	tmpl, err := newUpstreamTemplate("http://notebook-{{ .preferred_username }}.svc:8888", `http://notebook-[a-z0-9-]+\.svc:8888`)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	cs := []struct {
+		Claims   jose.Claims
+		Expected string
+	}{
+		{Claims: jose.Claims{"preferred_username": "jane"}, Expected: "http://notebook-jane.svc:8888"},
+		{Claims: jose.Claims{"preferred_username": "evil.example.com/"}},
+		{Claims: jose.Claims{"preferred_username": "x.svc:8888@evil.example.com#"}},
+		{Claims: jose.Claims{"email": "jane@example.com"}},
+	}
+	for i, c := range cs {
+		endpoint, err := tmpl.render(&userContext{claims: c.Claims})
+		if c.Expected == "" {
+			assert.Error(t, err, "case %d, expected an error", i)
+			continue
+		}
+		if assert.NoError(t, err, "case %d", i) {
+			assert.Equal(t, c.Expected, endpoint.String(), "case %d", i)
+		}
+	}
+}
+
+func TestUpstreamTemplateProxied(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	defer upstream.Close()
+	location, _ := url.Parse(upstream.URL)
+
+	config := newFakeKeycloakConfig()
+	config.Upstream = "http://127.0.0.1:{{ .backend }}"
+	config.UpstreamURLPattern = `http://127\.0\.0\.1:[0-9]+`
+	p, auth, u := newTestProxyService(config)
+	if !assert.NoError(t, p.createUpstreamProxy(p.endpoint)) {
+		t.FailNow()
+	}
+
+	cs := []struct {
+		Backend  string
+		HTTPCode int
+	}{
+		{Backend: location.Port(), HTTPCode: http.StatusOK},
+		{Backend: location.Port() + "@evil.example.com", HTTPCode: http.StatusBadGateway},
+	}
+	for i, c := range cs {
+		auth.claims["backend"] = c.Backend
+		token, err := jose.NewSignedJWT(auth.claims, auth.signer)
+		if !assert.NoError(t, err, "case %d", i) {
+			continue
+		}
+		req, _ := http.NewRequest("GET", u+fakeAuthAllURL, nil)
+		req.Header.Set(authorizationHeader, "Bearer "+token.Encode())
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if !assert.NoError(t, err, "case %d", i) {
+			continue
+		}
+		resp.Body.Close()
+		assert.Equal(t, c.HTTPCode, resp.StatusCode, "case %d", i)
+	}
+}
@@ -0,0 +1,217 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+)
+
+const (
+	// spkiPinPrefix is the optional prefix of the pins, i.e. sha256/BASE64
+	spkiPinPrefix = "sha256/"
+)
+
+//
+// isValid validates the upstream tls configuration
+//
+func (r *UpstreamTLS) isValid() error {
+	if r.CACertificate != "" && !fileExists(r.CACertificate) {
+		return fmt.Errorf("the upstream tls ca certificate %s does not exist", r.CACertificate)
+	}
+	for _, x := range r.Pins {
+		decoded, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(x, spkiPinPrefix))
+		if err != nil || len(decoded) != sha256.Size {
+			return fmt.Errorf("the upstream tls pin: %s should be the base64 sha256 of the subject public key info", x)
+		}
+	}
+
+	return nil
+}
+
+//
+// matches checks if the hostname of the upstream is covered by this configuration
+//
+func (r *UpstreamTLS) matches(hostname string) bool {
+	if len(r.Domains) <= 0 {
+		return true
+	}
+	for _, x := range r.Domains {
+		if hostname == x || strings.HasSuffix(hostname, "."+strings.TrimPrefix(x, ".")) {
+			return true
+		}
+	}
+
+	return false
+}
+
+//
+// upstreamTLS provides the tls configuration for each of the upstream hosts
+//
+type upstreamTLS struct {
+	sync.RWMutex
+	// the configuration used when no settings match the host
+	base *tls.Config
+	// the per upstream settings, the first match is used
+	settings []*UpstreamTLS
+	// the tls configurations of the settings, keyed by the index so bounded by the configured upstreams
+	configs map[int]*tls.Config
+}
+
+//
+// newUpstreamTLS creates the upstream tls from the base configuration and the per upstream settings
+//
+func newUpstreamTLS(base *tls.Config, settings []*UpstreamTLS) *upstreamTLS {
+	return &upstreamTLS{
+		base:     base,
+		settings: settings,
+		configs:  make(map[int]*tls.Config, 0),
+	}
+}
+
+//
+// getConfig returns the tls configuration for the upstream host
+//
+func (r *upstreamTLS) getConfig(hostname string) (*tls.Config, error) {
+	config := r.base.Clone()
+	config.ServerName = hostname
+	for i, x := range r.settings {
+		if !x.matches(hostname) {
+			continue
+		}
+		settings, err := r.getSettingsConfig(i)
+		if err != nil {
+			return nil, err
+		}
+		config = settings.Clone()
+		config.ServerName = hostname
+		if x.ServerName != "" {
+			config.ServerName = x.ServerName
+		}
+		break
+	}
+
+	return config, nil
+}
+
+//
+// getSettingsConfig returns the tls configuration of the upstream settings, loading the ca certificate once
+//
+func (r *upstreamTLS) getSettingsConfig(index int) (*tls.Config, error) {
+	r.RLock()
+	config, found := r.configs[index]
+	r.RUnlock()
+	if found {
+		return config, nil
+	}
+
+	x := r.settings[index]
+	config = r.base.Clone()
+	config.InsecureSkipVerify = x.SkipVerify
+	if x.CACertificate != "" {
+		content, err := ioutil.ReadFile(x.CACertificate)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(content) {
+			return nil, fmt.Errorf("no certificates found in the upstream tls ca certificate: %s", x.CACertificate)
+		}
+		config.RootCAs = pool
+	}
+	if len(x.Pins) > 0 {
+		config.VerifyConnection = newSPKIPinVerifier(x.Pins)
+	}
+
+	r.Lock()
+	r.configs[index] = config
+	r.Unlock()
+
+	return config, nil
+}
+
+//
+// dialTLS returns a tls dialer for the transport, the connection is made by the dialer and the handshake uses the
+// configuration of the upstream host
+//
+func (r *upstreamTLS) dialTLS(dialer func(context.Context, string, string) (net.Conn, error)) func(context.Context, string, string) (net.Conn, error) {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		hostname, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+		config, err := r.getConfig(hostname)
+		if err != nil {
+			return nil, err
+		}
+		conn, err := dialer(ctx, network, address)
+		if err != nil {
+			return nil, err
+		}
+		tlsConn := tls.Client(conn, config)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+
+		return tlsConn, nil
+	}
+}
+
+//
+// newSPKIPinVerifier checks one of the certificates of the verified chains has a pinned public key; the chain presented
+// by the upstream is unverified, anyone could append the pinned certificate, so when the verification is skipped only
+// the leaf, whose key the upstream proved it holds in the handshake, is checked
+//
+func newSPKIPinVerifier(pins []string) func(tls.ConnectionState) error {
+	return func(state tls.ConnectionState) error {
+		var certificates []*x509.Certificate
+		for _, chain := range state.VerifiedChains {
+			certificates = append(certificates, chain...)
+		}
+		if len(state.VerifiedChains) <= 0 && len(state.PeerCertificates) > 0 {
+			certificates = state.PeerCertificates[:1]
+		}
+		for _, certificate := range certificates {
+			pin := getSPKIPin(certificate)
+			for _, x := range pins {
+				if strings.TrimPrefix(x, spkiPinPrefix) == pin {
+					return nil
+				}
+			}
+		}
+
+		return errors.New("none of the upstream certificates match the pinned public keys")
+	}
+}
+
+//
+// getSPKIPin returns the base64 sha256 of the subject public key info of the certificate
+//
+func getSPKIPin(certificate *x509.Certificate) string {
+	digest := sha256.Sum256(certificate.RawSubjectPublicKeyInfo)
+
+	return base64.StdEncoding.EncodeToString(digest[:])
+}
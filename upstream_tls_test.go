@@ -0,0 +1,155 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUpstreamTLSMatches(t *testing.T) {
+	cases := []struct {
+		Domains  []string
+		Hostname string
+		Expected bool
+	}{
+		{Hostname: "example.com", Expected: true},
+		{Domains: []string{"example.com"}, Hostname: "example.com", Expected: true},
+		{Domains: []string{"example.com"}, Hostname: "api.example.com", Expected: true},
+		{Domains: []string{".example.com"}, Hostname: "api.example.com", Expected: true},
+		{Domains: []string{"example.com"}, Hostname: "badexample.com"},
+		{Domains: []string{"example.com"}, Hostname: "example.org"},
+	}
+	for i, c := range cases {
+		settings := &UpstreamTLS{Domains: c.Domains}
+		assert.Equal(t, c.Expected, settings.matches(c.Hostname), "case %d, expected: %t", i, c.Expected)
+	}
+}
+
+func TestUpstreamTLSIsValid(t *testing.T) {
+	assert.NoError(t, (&UpstreamTLS{Pins: []string{"sha256/47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU="}}).isValid())
+	assert.NoError(t, (&UpstreamTLS{Pins: []string{"47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU="}}).isValid())
+	assert.Error(t, (&UpstreamTLS{Pins: []string{"sha256/not_a_pin"}}).isValid())
+	assert.Error(t, (&UpstreamTLS{Pins: []string{"c2hvcnQ="}}).isValid())
+	assert.Error(t, (&UpstreamTLS{CACertificate: "/does/not/exist"}).isValid())
+}
+
+func TestSPKIPinVerifier(t *testing.T) {
+	leaf := &x509.Certificate{RawSubjectPublicKeyInfo: []byte("leaf")}
+	intermediate := &x509.Certificate{RawSubjectPublicKeyInfo: []byte("intermediate")}
+	pinned := &x509.Certificate{RawSubjectPublicKeyInfo: []byte("pinned")}
+	verify := newSPKIPinVerifier([]string{spkiPinPrefix + getSPKIPin(pinned)})
+
+	cases := []struct {
+		State tls.ConnectionState
+		Error bool
+	}{
+		{State: tls.ConnectionState{PeerCertificates: []*x509.Certificate{pinned}}},
+		{State: tls.ConnectionState{
+			PeerCertificates: []*x509.Certificate{leaf, intermediate},
+			VerifiedChains:   [][]*x509.Certificate{{leaf, intermediate, pinned}},
+		}},
+		// the pinned certificate appended to a unverified chain is ignored
+		{State: tls.ConnectionState{PeerCertificates: []*x509.Certificate{leaf, pinned}}, Error: true},
+		{State: tls.ConnectionState{
+			PeerCertificates: []*x509.Certificate{leaf, pinned},
+			VerifiedChains:   [][]*x509.Certificate{{leaf, intermediate}},
+		}, Error: true},
+		{Error: true},
+	}
+	for i, c := range cases {
+		err := verify(c.State)
+		if c.Error {
+			assert.Error(t, err, "case %d should have failed", i)
+		} else {
+			assert.NoError(t, err, "case %d should not have failed", i)
+		}
+	}
+}
+
+func TestUpstreamTLSConfigs(t *testing.T) {
+	r := newUpstreamTLS(&tls.Config{}, []*UpstreamTLS{{Domains: []string{"example.com"}, SkipVerify: true}})
+	for _, hostname := range []string{"a.example.com", "b.example.com", "example.org", "example.net"} {
+		config, err := r.getConfig(hostname)
+		if assert.NoError(t, err) {
+			assert.Equal(t, hostname, config.ServerName)
+		}
+	}
+	assert.Len(t, r.configs, 1)
+}
+
+func TestUpstreamTLSDial(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+
+	dir, err := ioutil.TempDir("", "upstream")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	ca := filepath.Join(dir, "ca.pem")
+	certificate := upstream.Certificate()
+	ioutil.WriteFile(ca, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificate.Raw}), 0600)
+	pin := getSPKIPin(certificate)
+
+	cases := []struct {
+		Settings *UpstreamTLS
+		Skip     bool
+		Error    bool
+	}{
+		{Error: true},
+		{Skip: true},
+		{Settings: &UpstreamTLS{CACertificate: ca}},
+		{Settings: &UpstreamTLS{CACertificate: ca, ServerName: "example.com"}},
+		{Settings: &UpstreamTLS{CACertificate: ca, ServerName: "other.example.org"}, Error: true},
+		{Settings: &UpstreamTLS{Domains: []string{"example.org"}, CACertificate: ca}, Error: true},
+		{Settings: &UpstreamTLS{Domains: []string{"example.org"}, SkipVerify: true}, Skip: true},
+		{Settings: &UpstreamTLS{CACertificate: ca, Pins: []string{spkiPinPrefix + pin}}},
+		{Settings: &UpstreamTLS{SkipVerify: true, Pins: []string{pin}}},
+		{Settings: &UpstreamTLS{SkipVerify: true, Pins: []string{"47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU="}}, Error: true},
+		// the global skip is overridden by the matching settings
+		{Settings: &UpstreamTLS{}, Skip: true, Error: true},
+	}
+	dialer := func(ctx context.Context, network, address string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, network, address)
+	}
+	for i, c := range cases {
+		var settings []*UpstreamTLS
+		if c.Settings != nil {
+			settings = append(settings, c.Settings)
+		}
+		conn, err := newUpstreamTLS(&tls.Config{InsecureSkipVerify: c.Skip}, settings).dialTLS(dialer)(
+			context.Background(), "tcp", upstream.Listener.Addr().String())
+		if c.Error {
+			assert.Error(t, err, "case %d should have failed", i)
+			continue
+		}
+		if assert.NoError(t, err, "case %d should not have failed", i) {
+			conn.Close()
+		}
+	}
+}
@@ -42,12 +42,22 @@ type userContext struct {
 	roles []string
 	// the audience for the token
 	audience string
+	// the audiences of the token, when issued for several
+	audiences []string
 	// the access token itself
 	token jose.JWT
+	// the opaque access token, when validated by introspection rather than a jwt
+	opaque string
 	// the claims associated to the token
 	claims jose.Claims
 	// whether the context is from a session cookie or authorization header
 	bearerToken bool
+	// whether the user was authenticated by kerberos, in which case there's no access token
+	kerberos bool
+	// whether the user was authenticated by a saml assertion, in which case there's no access token
+	saml bool
+	// whether the user was authenticated by the identity asserted by the edge, in which case there's no access token
+	edge bool
 }
 
 //
@@ -59,7 +69,19 @@ func extractIdentity(token jose.JWT) (*userContext, error) {
 	if err != nil {
 		return nil, err
 	}
+	user, err := extractClaimsIdentity(claims)
+	if err != nil {
+		return nil, err
+	}
+	user.token = token
+
+	return user, nil
+}
 
+//
+// extractClaimsIdentity constructs the user from the claims, of a jwt or the introspection of a opaque token
+//
+func extractClaimsIdentity(claims jose.Claims) (*userContext, error) {
 	// step: extract the identity
 	identity, err := oidc.IdentityFromClaims(claims)
 	if err != nil {
@@ -73,11 +95,29 @@ func extractIdentity(token jose.JWT) (*userContext, error) {
 		preferredName = identity.Email
 	}
 
-	// step: retrieve the audience from access token
-	audience, found, err := claims.StringClaim(claimAudience)
-	if err != nil || !found {
-		return nil, ErrNoTokenAudience
+	// step: retrieve the audiences from access token
+	audiences, err := getClaimsAudiences(claims)
+	if err != nil {
+		return nil, err
 	}
+
+	return &userContext{
+		id:            identity.ID,
+		name:          preferredName,
+		audience:      strings.Join(audiences, ","),
+		audiences:     audiences,
+		preferredName: preferredName,
+		email:         identity.Email,
+		expiresAt:     identity.ExpiresAt,
+		roles:         getClaimsRoles(claims),
+		claims:        claims,
+	}, nil
+}
+
+//
+// getClaimsRoles returns the realm roles and the client roles, prefixed by the client, of the claims
+//
+func getClaimsRoles(claims jose.Claims) []string {
 	var list []string
 
 	// step: extract the realm roles
@@ -101,17 +141,18 @@ func extractIdentity(token jose.JWT) (*userContext, error) {
 		}
 	}
 
-	return &userContext{
-		id:            identity.ID,
-		name:          preferredName,
-		audience:      audience,
-		preferredName: preferredName,
-		email:         identity.Email,
-		expiresAt:     identity.ExpiresAt,
-		roles:         list,
-		token:         token,
-		claims:        claims,
-	}, nil
+	return list
+}
+
+//
+// getAccessToken returns the encoded access token, opaque or jwt
+//
+func (r userContext) getAccessToken() string {
+	if r.opaque != "" {
+		return r.opaque
+	}
+
+	return r.token.Encode()
 }
 
 //
@@ -122,7 +163,7 @@ func (r userContext) isAudience(aud string) bool {
 		return true
 	}
 
-	return false
+	return containedIn(aud, r.audiences)
 }
 
 //
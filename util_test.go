@@ -26,6 +26,7 @@ import (
 	"reflect"
 	"testing"
 
+	"github.com/coreos/go-oidc/oidc"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -33,11 +34,65 @@ func TestCreateOpenIDClient(t *testing.T) {
 	_, auth, _ := newTestProxyService(nil)
 	client, _, err := createOpenIDClient(&Config{
 		DiscoveryURL: auth.location.String() + "/auth/realms/hod-test",
-	})
+	}, nil)
 	assert.NoError(t, err)
 	assert.NotNil(t, client)
 }
 
+func TestCheckProviderIssuer(t *testing.T) {
+	internal := "http://keycloak.svc.cluster.local:8080/auth/realms/hod-test"
+	external := "https://sso.example.com/auth/realms/hod-test"
+	cases := []struct {
+		Issuer    string
+		IssuerURL string
+		Expected  string
+		Ok        bool
+	}{
+		{Issuer: internal, Expected: internal, Ok: true},
+		{Issuer: internal + "/", Expected: internal + "/", Ok: true},
+		{Issuer: external},
+		{Issuer: internal, IssuerURL: external, Expected: external, Ok: true},
+		{Issuer: external, IssuerURL: external, Expected: external, Ok: true},
+		{Issuer: "https://other.example.com/auth/realms/hod-test", IssuerURL: external},
+	}
+	for i, c := range cases {
+		issuer, _ := url.Parse(c.Issuer)
+		provider := oidc.ProviderConfig{Issuer: issuer}
+		err := checkProviderIssuer(&Config{DiscoveryURL: internal, IssuerURL: c.IssuerURL}, &provider)
+		if !c.Ok {
+			assert.Error(t, err, "case %d, expected an error", i)
+			continue
+		}
+		if assert.NoError(t, err, "case %d, unexpected error", i) {
+			assert.Equal(t, c.Expected, provider.Issuer.String(), "case %d, unexpected issuer", i)
+		}
+	}
+}
+
+func TestRebaseProviderEndpoints(t *testing.T) {
+	internal := "http://keycloak.svc.cluster.local:8080/auth/realms/hod-test"
+	external := "https://sso.example.com/realms/hod-test"
+	parse := func(location string) *url.URL {
+		u, _ := url.Parse(location)
+		return u
+	}
+	provider := oidc.ProviderConfig{
+		AuthEndpoint:     parse(internal + "/protocol/openid-connect/auth"),
+		TokenEndpoint:    parse("https://sso.example.com/realms/hod-test/protocol/openid-connect/token"),
+		UserInfoEndpoint: parse("https://other.example.com/userinfo"),
+		KeysEndpoint:     parse(internal + "/protocol/openid-connect/certs"),
+	}
+	rebaseProviderEndpoints(&Config{DiscoveryURL: internal, ExternalDiscoveryURL: external}, &provider)
+
+	assert.Equal(t, external+"/protocol/openid-connect/auth", provider.AuthEndpoint.String())
+	assert.Equal(t, internal+"/protocol/openid-connect/token", provider.TokenEndpoint.String())
+	assert.Equal(t, "https://other.example.com/userinfo", provider.UserInfoEndpoint.String())
+	assert.Equal(t, internal+"/protocol/openid-connect/certs", provider.KeysEndpoint.String())
+	assert.Nil(t, provider.RegistrationEndpoint)
+
+	assert.Equal(t, internal+"-other/auth", rebaseURL(parse(internal+"-other/auth"), internal, external).String())
+}
+
 func TestDecodeKeyPairs(t *testing.T) {
 	testCases := []struct {
 		List     []string
@@ -327,6 +382,158 @@ func TestMergeMaps(t *testing.T) {
 	}
 }
 
+func TestStripHopByHopHeaders(t *testing.T) {
+	header := http.Header{}
+	header.Set("Connection", "keep-alive, X-Custom, X-Auth-Roles")
+	header.Set("Keep-Alive", "timeout=5")
+	header.Set("Transfer-Encoding", "chunked")
+	header.Set("X-Custom", "value")
+	header.Set("X-Auth-Roles", "admin")
+	header.Set("Accept", "*/*")
+
+	stripHopByHopHeaders(header)
+	assert.Empty(t, header.Get("Connection"))
+	assert.Empty(t, header.Get("Keep-Alive"))
+	assert.Empty(t, header.Get("Transfer-Encoding"))
+	assert.Empty(t, header.Get("X-Custom"))
+	assert.Equal(t, "admin", header.Get("X-Auth-Roles"))
+	assert.Equal(t, "*/*", header.Get("Accept"))
+}
+
+func TestDedupeForwardedHeaders(t *testing.T) {
+	header := http.Header{}
+	header.Add("X-Forwarded-For", "10.0.0.1")
+	header.Add("X-Forwarded-For", "127.0.0.1")
+	header.Add("X-Auth-Email", "spoofed@example.com")
+	header.Add("X-Auth-Email", "gambol99@gmail.com")
+	header.Add("Accept", "text/html")
+	header.Add("Accept", "application/json")
+
+	dedupeForwardedHeaders(header)
+	assert.Equal(t, []string{"10.0.0.1, 127.0.0.1"}, header["X-Forwarded-For"])
+	assert.Equal(t, []string{"gambol99@gmail.com"}, header["X-Auth-Email"])
+	assert.Len(t, header["Accept"], 2)
+}
+
+func TestHeaderSize(t *testing.T) {
+	header := http.Header{}
+	assert.Equal(t, 0, headerSize(header))
+	header.Set("Host", "127.0.0.1")
+	assert.Equal(t, 17, headerSize(header))
+}
+
+func TestHeaderCount(t *testing.T) {
+	header := http.Header{}
+	assert.Equal(t, 0, headerCount(header))
+	header.Set("Host", "127.0.0.1")
+	header.Add("X-Forwarded-For", "10.0.0.1")
+	header.Add("X-Forwarded-For", "10.0.0.2")
+	assert.Equal(t, 3, headerCount(header))
+}
+
+func TestApplyHeaderCasing(t *testing.T) {
+	header := http.Header{}
+	header.Set("Soapaction", "urn:getUser")
+	header.Set("X-Request-Id", "1")
+	applyHeaderCasing(header, []string{"SOAPAction", "X-Request-Id", "x-missing"})
+	assert.Equal(t, http.Header{
+		"SOAPAction":   []string{"urn:getUser"},
+		"X-Request-Id": []string{"1"},
+	}, header)
+}
+
+func TestNormalizePath(t *testing.T) {
+	cases := []struct {
+		Path     string
+		Expected string
+	}{
+		{Path: "", Expected: "/"},
+		{Path: "/", Expected: "/"},
+		{Path: "/admin", Expected: "/admin"},
+		{Path: "/admin/", Expected: "/admin/"},
+		{Path: "//admin//test", Expected: "/admin/test"},
+		{Path: "/admin/../admin", Expected: "/admin"},
+		{Path: "/public/../admin/./test", Expected: "/admin/test"},
+		{Path: "/../../admin", Expected: "/admin"},
+		{Path: "admin", Expected: "/admin"},
+	}
+	for i, x := range cases {
+		assert.Equal(t, x.Expected, normalizePath(x.Path), "case %d, expected: %s but got: %s", i, x.Expected, normalizePath(x.Path))
+	}
+}
+
+func TestIsXHRRequest(t *testing.T) {
+	cases := []struct {
+		Headers map[string]string
+		XHR     bool
+	}{
+		{Headers: map[string]string{}},
+		{Headers: map[string]string{"X-Requested-With": "XMLHttpRequest"}, XHR: true},
+		{Headers: map[string]string{"Sec-Fetch-Mode": "cors"}, XHR: true},
+		{Headers: map[string]string{"Sec-Fetch-Mode": "navigate"}},
+		{Headers: map[string]string{"Accept": "application/json"}, XHR: true},
+		{Headers: map[string]string{"Accept": "text/html,application/json"}},
+	}
+	for i, x := range cases {
+		req := &http.Request{Header: http.Header{}}
+		for k, v := range x.Headers {
+			req.Header.Set(k, v)
+		}
+		assert.Equal(t, x.XHR, isXHRRequest(req), "case %d, expected: %t", i, x.XHR)
+	}
+}
+
+func TestIsRelativeRedirect(t *testing.T) {
+	cases := []struct {
+		Location string
+		Ok       bool
+	}{
+		{Location: "/", Ok: true},
+		{Location: "/admin?test=yes#section", Ok: true},
+		{Location: ""},
+		{Location: "admin"},
+		{Location: "//evil.com/admin"},
+		{Location: "/\\evil.com"},
+		{Location: "https://evil.com"},
+	}
+	for i, x := range cases {
+		assert.Equal(t, x.Ok, isRelativeRedirect(x.Location), "case %d, location: %s", i, x.Location)
+	}
+}
+
+func TestRedactQueryParams(t *testing.T) {
+	cases := []struct {
+		Query    string
+		Params   []string
+		Expected string
+	}{
+		{Query: "page=1", Expected: "page=1"},
+		{Query: "code=abc&state=L2FkbWlu", Params: defaultRedactedQueryParams, Expected: "code=REDACTED&state=L2FkbWlu"},
+		{Query: "API_KEY=secret&page=2", Params: []string{"api_key"}, Expected: "API_KEY=REDACTED&page=2"},
+		{Query: "token=a&token=b", Params: defaultRedactedQueryParams, Expected: "token=REDACTED&token=REDACTED"},
+	}
+	for i, x := range cases {
+		values, _ := url.ParseQuery(x.Query)
+		assert.Equal(t, x.Expected, redactQueryParams(values, x.Params), "case %d", i)
+	}
+}
+
+func TestRedactHeader(t *testing.T) {
+	cases := []struct {
+		Name     string
+		Value    string
+		Expected string
+	}{
+		{Name: "User-Agent", Value: "curl/7.47.0", Expected: "curl/7.47.0"},
+		{Name: "authorization", Value: "Bearer eyJhbGciOiJSUzI1NiJ9", Expected: "Bearer REDACTED"},
+		{Name: "Cookie", Value: "kc-access=eyJhbGci; kc-state=abc", Expected: "kc-access=REDACTED; kc-state=REDACTED"},
+		{Name: "X-Auth-Token", Value: "secret", Expected: "REDACTED"},
+	}
+	for i, x := range cases {
+		assert.Equal(t, x.Expected, redactHeader(x.Name, x.Value), "case %d", i)
+	}
+}
+
 func getFakeURL(location string) *url.URL {
 	u, _ := url.Parse(location)
 	return u
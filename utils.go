@@ -23,13 +23,17 @@ import (
 	"crypto/tls"
 	"encoding/base64"
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"path"
 	"regexp"
+	"runtime"
 	"strings"
 	"sync"
 	"time"
@@ -43,8 +47,31 @@ import (
 )
 
 var (
-	httpMethodRegex = regexp.MustCompile("^(ANY|GET|POST|DELETE|PATCH|HEAD|PUT|TRACE|CONNECT)$")
+	httpMethodRegex = regexp.MustCompile("^(ANY|GET|POST|DELETE|PATCH|HEAD|OPTIONS|PUT|TRACE|CONNECT)$")
 	symbolsFilter   = regexp.MustCompilePOSIX("[_$><\\[\\].,\\+-/'%^&*()!\\\\]+")
+	// hopByHopHeaders are the headers which are meaningful only for a single transport-level connection
+	hopByHopHeaders = []string{
+		"Connection",
+		"Keep-Alive",
+		"Proxy-Authenticate",
+		"Proxy-Authorization",
+		"Proxy-Connection",
+		"Te",
+		"Trailer",
+		"Transfer-Encoding",
+		"Upgrade",
+	}
+	// forwardedHeaders are the headers added by the proxy which a client must not be able to influence
+	forwardedHeaders = []string{
+		"X-Forwarded-Host",
+		"X-Forwarded-Proto",
+		"X-Forwarded-Agent",
+		"X-Real-Ip",
+	}
+	// defaultRedactedQueryParams are the query parameters which always have their values redacted in the logs
+	defaultRedactedQueryParams = []string{"access_token", "id_token", "refresh_token", "code", "client_secret", "password", "token"}
+	// redactedHeaders are the headers whose values are redacted when logged
+	redactedHeaders = []string{"DPoP", "X-Auth-Token", "X-Api-Key", "Set-Cookie"}
 )
 
 //
@@ -126,10 +153,13 @@ func decodeText(state, key string) (string, error) {
 }
 
 // createOpenIDClient initializes the openID configuration, note: the redirection url is deliberately left blank
-// in order to retrieve it from the host header on request
-func createOpenIDClient(cfg *Config) (*oidc.Client, oidc.ProviderConfig, error) {
+// in order to retrieve it from the host header on request; the http client defaults to http.DefaultClient
+func createOpenIDClient(cfg *Config, httpClient *http.Client) (*oidc.Client, oidc.ProviderConfig, error) {
 	var err error
 	var providerConfig oidc.ProviderConfig
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
 
 	// step: fix up the url if required, the underlining lib will add the .well-known/openid-configuration to the discovery url for us.
 	if strings.HasSuffix(cfg.DiscoveryURL, "/.well-known/openid-configuration") {
@@ -138,7 +168,7 @@ func createOpenIDClient(cfg *Config) (*oidc.Client, oidc.ProviderConfig, error)
 	// step: attempt to retrieve the provider configuration
 	for i := 0; i < 3; i++ {
 		log.Infof("attempting to retrieve the openid configuration from the discovery url: %s", cfg.DiscoveryURL)
-		providerConfig, err = oidc.FetchProviderConfig(http.DefaultClient, cfg.DiscoveryURL)
+		providerConfig, err = fetchProviderConfig(httpClient, cfg.DiscoveryURL)
 		if err == nil {
 			goto GOT_CONFIG
 		}
@@ -149,23 +179,178 @@ func createOpenIDClient(cfg *Config) (*oidc.Client, oidc.ProviderConfig, error)
 	return nil, oidc.ProviderConfig{}, fmt.Errorf("failed to retrieve the provider configuration from discovery url")
 
 GOT_CONFIG:
+	// step: a mismatched issuer would fail the verification of every token, so we refuse to start
+	if err := checkProviderIssuer(cfg, &providerConfig); err != nil {
+		return nil, oidc.ProviderConfig{}, err
+	}
+	rebaseProviderEndpoints(cfg, &providerConfig)
+	client, err := newOpenIDClient(cfg, providerConfig, httpClient, cfg.RedirectionURL)
+	if err != nil {
+		return nil, oidc.ProviderConfig{}, err
+	}
+
+	return client, providerConfig, nil
+}
+
+// newOpenIDClient creates a client for the provider, with the callback handler under the redirection url
+func newOpenIDClient(cfg *Config, providerConfig oidc.ProviderConfig, httpClient *http.Client, redirectionURL string) (*oidc.Client, error) {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	// step: the openid client requires a secret, though the client may authenticate otherwise
+	secret := cfg.ClientSecret
+	if secret == "" && !cfg.isClientSecretAuth() {
+		secret = clientAuthUnusedSecret
+	}
 	client, err := oidc.NewClient(oidc.ClientConfig{
+		HTTPClient:     httpClient,
 		ProviderConfig: providerConfig,
 		Credentials: oidc.ClientCredentials{
 			ID:     cfg.ClientID,
-			Secret: cfg.ClientSecret,
+			Secret: secret,
 		},
-		RedirectURL: fmt.Sprintf("%s/oauth/callback", cfg.RedirectionURL),
+		RedirectURL: fmt.Sprintf("%s%s", redirectionURL, cfg.getCallbackPath()),
 		Scope:       append(cfg.Scopes, oidc.DefaultScope...),
 	})
 	if err != nil {
-		return nil, oidc.ProviderConfig{}, err
+		return nil, err
 	}
 
-	// step: start the provider sync
-	client.SyncProviderConfig(cfg.DiscoveryURL)
+	// step: start the provider sync, unless the issuer is mapped, as the sync would revert it
+	if cfg.getIssuerURL() == "" {
+		client.SyncProviderConfig(cfg.DiscoveryURL)
+	}
 
-	return client, providerConfig, nil
+	return client, nil
+}
+
+//
+// fetchProviderConfig retrieves the openid configuration from the discovery url, the issuer is checked by the caller
+//
+func fetchProviderConfig(httpClient *http.Client, discoveryURL string) (oidc.ProviderConfig, error) {
+	var providerConfig oidc.ProviderConfig
+
+	resp, err := httpClient.Get(strings.TrimSuffix(discoveryURL, "/") + "/.well-known/openid-configuration")
+	if err != nil {
+		return providerConfig, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return providerConfig, fmt.Errorf("unexpected response from the discovery url, status: %d", resp.StatusCode)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&providerConfig); err != nil {
+		return providerConfig, err
+	}
+
+	return providerConfig, nil
+}
+
+//
+// checkProviderIssuer checks the issuer of the provider matches the discovery url, or the issuer url if mapped, in
+// which case the issuer of the provider is replaced by the issuer url
+//
+func checkProviderIssuer(cfg *Config, providerConfig *oidc.ProviderConfig) error {
+	if providerConfig.Issuer == nil {
+		return fmt.Errorf("the openid configuration from the discovery url: %s has no issuer", cfg.DiscoveryURL)
+	}
+	issuer := providerConfig.Issuer.String()
+	issuerURL := cfg.getIssuerURL()
+
+	if issuerURL == "" {
+		if !isSameIssuer(issuer, cfg.DiscoveryURL) {
+			return fmt.Errorf("the issuer: %s of the openid configuration doesn't match the discovery url: %s, "+
+				"the tokens would fail verification; if keycloak is reached by a different url to the users, "+
+				"set the external-discovery-url or issuer-url", issuer, cfg.DiscoveryURL)
+		}
+
+		return nil
+	}
+	if !isSameIssuer(issuer, cfg.DiscoveryURL) && !isSameIssuer(issuer, issuerURL) {
+		return fmt.Errorf("the issuer: %s of the openid configuration matches neither the discovery url: %s "+
+			"nor the issuer url: %s", issuer, cfg.DiscoveryURL, issuerURL)
+	}
+	location, err := url.Parse(issuerURL)
+	if err != nil {
+		return err
+	}
+	log.WithFields(log.Fields{
+		"discovery_url": cfg.DiscoveryURL,
+		"issuer":        issuer,
+		"issuer_url":    issuerURL,
+	}).Infof("expecting the tokens to be issued by the issuer url")
+
+	providerConfig.Issuer = location
+
+	return nil
+}
+
+//
+// rebaseProviderEndpoints points the authorization endpoint, which the browser is redirected to, at the external
+// discovery url and the endpoints the proxy calls itself at the discovery url
+//
+func rebaseProviderEndpoints(cfg *Config, providerConfig *oidc.ProviderConfig) {
+	if cfg.ExternalDiscoveryURL == "" {
+		return
+	}
+	providerConfig.AuthEndpoint = rebaseURL(providerConfig.AuthEndpoint, cfg.DiscoveryURL, cfg.ExternalDiscoveryURL)
+	for _, x := range []**url.URL{&providerConfig.TokenEndpoint, &providerConfig.UserInfoEndpoint, &providerConfig.KeysEndpoint, &providerConfig.RegistrationEndpoint} {
+		*x = rebaseURL(*x, cfg.ExternalDiscoveryURL, cfg.DiscoveryURL)
+	}
+
+	log.WithFields(log.Fields{
+		"authorization_endpoint": providerConfig.AuthEndpoint.String(),
+		"token_endpoint":         providerConfig.TokenEndpoint.String(),
+	}).Infof("redirecting the users to the external discovery url: %s", cfg.ExternalDiscoveryURL)
+}
+
+//
+// rebaseURL moves the location from under the one base url to the other, a location outside the base is unchanged
+//
+func rebaseURL(location *url.URL, from, to string) *url.URL {
+	if location == nil {
+		return nil
+	}
+	base, err := url.Parse(strings.TrimSuffix(from, "/"))
+	if err != nil {
+		return location
+	}
+	target, err := url.Parse(strings.TrimSuffix(to, "/"))
+	if err != nil {
+		return location
+	}
+	if !strings.EqualFold(location.Host, base.Host) || !strings.HasPrefix(location.Path, base.Path) {
+		return location
+	}
+	remainder := strings.TrimPrefix(location.Path, base.Path)
+	if remainder != "" && !strings.HasPrefix(remainder, "/") {
+		return location
+	}
+
+	rebased := *location
+	rebased.Scheme = target.Scheme
+	rebased.Host = target.Host
+	rebased.Path = target.Path + remainder
+	rebased.RawPath = ""
+
+	return &rebased
+}
+
+//
+// isSameIssuer checks the issuers are the same, ignoring the scheme, case and a trailing slash as the token
+// verification does
+//
+func isSameIssuer(a, b string) bool {
+	first, err := url.Parse(a)
+	if err != nil {
+		return false
+	}
+	second, err := url.Parse(b)
+	if err != nil {
+		return false
+	}
+
+	return strings.EqualFold(first.Host+strings.TrimSuffix(first.Path, "/"), second.Host+strings.TrimSuffix(second.Path, "/"))
 }
 
 //
@@ -185,6 +370,18 @@ func decodeKeyPairs(list []string) (map[string]string, error) {
 	return kp, nil
 }
 
+//
+// getBuildInfo returns the version and build information of the proxy
+//
+func getBuildInfo() buildInfo {
+	return buildInfo{
+		Version:   release,
+		GitSHA:    gitsha,
+		BuildTime: buildTime,
+		GoVersion: runtime.Version(),
+	}
+}
+
 //
 // isValidMethod ensure this is a valid http method type
 //
@@ -277,18 +474,28 @@ func containsSubString(value string, list []string) bool {
 //
 // tryDialEndpoint dials the upstream endpoint via plain
 //
-func tryDialEndpoint(location *url.URL) (net.Conn, error) {
+func tryDialEndpoint(location *url.URL, config *tls.Config) (net.Conn, error) {
 	switch dialAddress := dialAddress(location); location.Scheme {
 	case "http":
 		return net.Dial("tcp", dialAddress)
 	default:
-		return tls.Dial("tcp", dialAddress, &tls.Config{
-			Rand:               rand.Reader,
-			InsecureSkipVerify: true,
-		})
+		return tls.Dial("tcp", dialAddress, config)
 	}
 }
 
+//
+// getRemoteAddress returns the address of the peer the request came from, the address from the proxy protocol header
+// when enabled; unlike the forwarded headers, which the client can set, it can't be forged
+//
+func getRemoteAddress(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+
+	return host
+}
+
 //
 // isUpgradedConnection checks to see if the request is requesting
 //
@@ -316,9 +523,9 @@ func transferBytes(src io.Reader, dest io.Writer, wg *sync.WaitGroup) (int64, er
 //
 // tryUpdateConnection attempt to upgrade the connection to a http pdy stream
 //
-func tryUpdateConnection(cx *gin.Context, endpoint *url.URL) error {
+func tryUpdateConnection(cx *gin.Context, endpoint *url.URL, config *tls.Config) error {
 	// step: dial the endpoint
-	tlsConn, err := tryDialEndpoint(endpoint)
+	tlsConn, err := tryDialEndpoint(endpoint, config)
 	if err != nil {
 		return err
 	}
@@ -420,3 +627,255 @@ func getHashKey(token *jose.JWT) string {
 	hash := md5.Sum([]byte(token.Encode()))
 	return hex.EncodeToString(hash[:])
 }
+
+//
+// stripHopByHopHeaders removes the hop-by-hop headers, including any named in the connection header; the
+// headers injected by the proxy itself are never removed, otherwise a client could strip the identity headers
+//
+func stripHopByHopHeaders(header http.Header) {
+	for _, x := range header[http.CanonicalHeaderKey("Connection")] {
+		for _, name := range strings.Split(x, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			if name == "" || isProtectedHeader(name) {
+				continue
+			}
+			header.Del(name)
+		}
+	}
+	for _, name := range hopByHopHeaders {
+		header.Del(name)
+	}
+}
+
+//
+// dedupeForwardedHeaders collapses multiple values of the forwarding headers, the X-Forwarded-For is joined into a
+// single list, while any other proxy header keeps the last value i.e. the one added by us
+//
+func dedupeForwardedHeaders(header http.Header) {
+	for name, values := range header {
+		if len(values) <= 1 {
+			continue
+		}
+		switch {
+		case name == "X-Forwarded-For":
+			header.Set(name, strings.Join(values, ", "))
+		case isProtectedHeader(name):
+			header.Set(name, values[len(values)-1])
+		}
+	}
+}
+
+//
+// isProtectedHeader checks if the header is one which is injected by the proxy
+//
+func isProtectedHeader(name string) bool {
+	if name == authorizationHeader || strings.HasPrefix(name, "X-Auth-") {
+		return true
+	}
+
+	return containedIn(name, forwardedHeaders)
+}
+
+//
+// headerSize calculates the size of the headers as they would appear on the wire
+//
+func headerSize(header http.Header) int {
+	size := 0
+	for name, values := range header {
+		for _, x := range values {
+			size += len(name) + len(x) + 4
+		}
+	}
+
+	return size
+}
+
+//
+// headerCount calculates the number of header lines as they would appear on the wire
+//
+func headerCount(header http.Header) int {
+	count := 0
+	for _, values := range header {
+		count += len(values)
+	}
+
+	return count
+}
+
+//
+// applyHeaderCasing renames the canonical headers to the casing expected by the upstream, the header must be
+// accessed by the new name afterwards
+//
+func applyHeaderCasing(header http.Header, casing []string) {
+	for _, x := range casing {
+		canonical := http.CanonicalHeaderKey(x)
+		if values, found := header[canonical]; found && canonical != x {
+			delete(header, canonical)
+			header[x] = values
+		}
+	}
+}
+
+//
+// getMethodOverride returns the method override from the request headers, query or form, if any
+//
+func getMethodOverride(req *http.Request) (string, error) {
+	for _, x := range methodOverrideHeaders {
+		if v := req.Header.Get(x); v != "" {
+			return strings.ToUpper(strings.TrimSpace(v)), nil
+		}
+	}
+	if req.URL != nil {
+		if v := req.URL.Query().Get(formMethodOverride); v != "" {
+			return strings.ToUpper(strings.TrimSpace(v)), nil
+		}
+	}
+	// step: check the form values, ensuring the body is placed back for the upstream
+	values, err := getMethodOverrideForm(req)
+	if err != nil {
+		return "", err
+	}
+	if v := values.Get(formMethodOverride); v != "" {
+		return strings.ToUpper(strings.TrimSpace(v)), nil
+	}
+
+	return "", nil
+}
+
+//
+// getMethodOverrideForm returns the values of a posted form, reading in no more than the form size limit
+//
+func getMethodOverrideForm(req *http.Request) (url.Values, error) {
+	if req.Method != "POST" || !strings.HasPrefix(req.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+		return url.Values{}, nil
+	}
+	content, err := readRequestBody(req, methodOverrideMaxFormSize)
+	if err != nil {
+		return nil, err
+	}
+
+	return url.ParseQuery(string(content))
+}
+
+//
+// removeMethodOverride strips the method override from the headers, query and form, so the upstream acts on the
+// method the resources were matched against
+//
+func removeMethodOverride(req *http.Request) error {
+	for _, x := range methodOverrideHeaders {
+		req.Header.Del(x)
+	}
+	if query := req.URL.Query(); query.Get(formMethodOverride) != "" {
+		query.Del(formMethodOverride)
+		req.URL.RawQuery = query.Encode()
+	}
+	values, err := getMethodOverrideForm(req)
+	if err != nil {
+		return err
+	}
+	if values.Get(formMethodOverride) != "" {
+		values.Del(formMethodOverride)
+		content := values.Encode()
+		req.Body = ioutil.NopCloser(strings.NewReader(content))
+		req.ContentLength = int64(len(content))
+		req.Header.Set("Content-Length", fmt.Sprintf("%d", len(content)))
+	}
+
+	return nil
+}
+
+//
+// normalizePath resolves the dot segments and duplicate slashes in the path, preserving any trailing slash
+//
+func normalizePath(p string) string {
+	if p == "" {
+		return "/"
+	}
+	cleaned := path.Clean("/" + p)
+	if strings.HasSuffix(p, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+
+	return cleaned
+}
+
+//
+// isXHRRequest checks if the request was made by a script i.e. xhr or fetch, rather than a browser navigation
+//
+func isXHRRequest(req *http.Request) bool {
+	if strings.EqualFold(req.Header.Get("X-Requested-With"), "XMLHttpRequest") {
+		return true
+	}
+	if mode := req.Header.Get("Sec-Fetch-Mode"); mode != "" && mode != "navigate" {
+		return true
+	}
+	accept := req.Header.Get("Accept")
+
+	return strings.Contains(accept, "application/json") && !strings.Contains(accept, "text/html")
+}
+
+//
+// isRelativeRedirect checks the location is a path on this host, i.e. not a protocol relative or absolute url
+//
+func isRelativeRedirect(location string) bool {
+	if !strings.HasPrefix(location, "/") || strings.HasPrefix(location, "//") || strings.HasPrefix(location, "/\\") {
+		return false
+	}
+	u, err := url.Parse(location)
+	if err != nil {
+		return false
+	}
+
+	return u.Scheme == "" && u.Host == ""
+}
+
+//
+// redactQueryParams encodes the query string with the values of any sensitive parameters redacted
+//
+func redactQueryParams(values url.Values, params []string) string {
+	for k := range values {
+		for _, x := range params {
+			if strings.EqualFold(k, x) {
+				for i := range values[k] {
+					values[k][i] = redactedValue
+				}
+			}
+		}
+	}
+
+	return values.Encode()
+}
+
+//
+// redactHeader redacts the credentials from a header value, the authorization scheme and cookie names are kept
+//
+func redactHeader(name, value string) string {
+	switch http.CanonicalHeaderKey(name) {
+	case "Authorization", "Proxy-Authorization":
+		return strings.SplitN(value, " ", 2)[0] + " " + redactedValue
+	case "Cookie":
+		var list []string
+		for _, x := range strings.Split(value, ";") {
+			list = append(list, strings.SplitN(strings.TrimSpace(x), "=", 2)[0]+"="+redactedValue)
+		}
+		return strings.Join(list, "; ")
+	}
+	for _, x := range redactedHeaders {
+		if strings.EqualFold(name, x) {
+			return redactedValue
+		}
+	}
+
+	return value
+}
+
+//
+// newH2CProtocols returns the protocols of http/2 without tls (h2c), as grpc is spoken over the plain connections;
+// note, the protocols of the transports and servers require go 1.24
+//
+func newH2CProtocols() *http.Protocols {
+	protocols := new(http.Protocols)
+	protocols.SetUnencryptedHTTP2(true)
+
+	return protocols
+}
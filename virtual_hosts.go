@@ -0,0 +1,196 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+//
+// isValid validates the virtual host
+//
+func (r *VirtualHost) isValid() error {
+	if len(r.Hostnames) <= 0 && !r.Default {
+		return errors.New("the virtual host has no hostnames and is not the default")
+	}
+	for _, x := range r.Hostnames {
+		if x == "" || (strings.Contains(x, "*") && !strings.HasPrefix(x, "*.")) || strings.Count(x, "*") > 1 {
+			return fmt.Errorf("the virtual host hostname: '%s' is invalid, a wildcard must be the first label", x)
+		}
+	}
+	if r.Upstream == "" {
+		return fmt.Errorf("the virtual host: %s has no upstream url", r.getName())
+	}
+	location, err := url.Parse(r.Upstream)
+	if err != nil {
+		return fmt.Errorf("the virtual host: %s upstream url is invalid, %s", r.getName(), err)
+	}
+	if location.Scheme != "http" && location.Scheme != "https" {
+		return fmt.Errorf("the virtual host: %s upstream url must be http or https", r.getName())
+	}
+	for _, x := range []string{r.SignInPage, r.ForbiddenPage} {
+		if x != "" && !fileExists(x) {
+			return fmt.Errorf("the virtual host: %s page: %s does not exist", r.getName(), x)
+		}
+	}
+
+	return nil
+}
+
+//
+// getName returns a name for the virtual host in the logs and errors
+//
+func (r *VirtualHost) getName() string {
+	if len(r.Hostnames) <= 0 {
+		return "default"
+	}
+
+	return strings.Join(r.Hostnames, ",")
+}
+
+//
+// matchesHostname checks the host matches the hostname, ignoring the port of the host unless the hostname has one;
+// a hostname of *.example.com matches any subdomain of example.com
+//
+func matchesHostname(hostname, host string) bool {
+	hostname, host = strings.ToLower(hostname), strings.ToLower(host)
+	if name, _, err := net.SplitHostPort(host); err == nil && !strings.Contains(hostname, ":") {
+		host = name
+	}
+	if strings.HasPrefix(hostname, "*.") {
+		return len(host) > len(hostname)-1 && strings.HasSuffix(host, hostname[1:])
+	}
+
+	return hostname == host
+}
+
+//
+// getVirtualHost returns the virtual host for the host; an exact hostname takes precedence over a wildcard, falling
+// back to the default virtual host, if any
+//
+func (r *oauthProxy) getVirtualHost(host string) *VirtualHost {
+	var wildcard, fallback *VirtualHost
+	for _, x := range r.config.VirtualHosts {
+		if x.Default && fallback == nil {
+			fallback = x
+		}
+		for _, hostname := range x.Hostnames {
+			if !matchesHostname(hostname, host) {
+				continue
+			}
+			if !strings.HasPrefix(hostname, "*.") {
+				return x
+			}
+			if wildcard == nil {
+				wildcard = x
+			}
+		}
+	}
+	if wildcard != nil {
+		return wildcard
+	}
+
+	return fallback
+}
+
+//
+// isPermittedHost checks the proxy responds to the host, i.e. it matches the hostnames or a virtual host
+//
+func (r *oauthProxy) isPermittedHost(host string) bool {
+	if len(r.config.Hostnames) <= 0 {
+		return true
+	}
+	for _, x := range r.config.Hostnames {
+		if matchesHostname(x, host) {
+			return true
+		}
+	}
+
+	return r.getVirtualHost(host) != nil
+}
+
+//
+// getRequestVirtualHost returns the virtual host of the request, if any
+//
+func (r *oauthProxy) getRequestVirtualHost(cx *gin.Context) *VirtualHost {
+	if vhost, found := cx.Get(cxVirtualHost); found {
+		return vhost.(*VirtualHost)
+	}
+	// note: the oauth handlers don't pass through the entrypoint
+	if len(r.config.VirtualHosts) <= 0 {
+		return nil
+	}
+
+	return r.getVirtualHost(cx.Request.Host)
+}
+
+//
+// getRequestResource returns the resource matching the request, from the virtual host of the request if any
+//
+func (r *oauthProxy) getRequestResource(cx *gin.Context) *Resource {
+	if vhost := r.getRequestVirtualHost(cx); vhost != nil {
+		return vhost.matcher.match(cx.Request.URL.Path)
+	}
+
+	return r.getResource(cx.Request.URL.Path)
+}
+
+//
+// getEndpoint returns the upstream endpoint for the request, from the virtual host of the request if any, else
+// rendered from the claims of the user when the upstream is templated
+//
+func (r *oauthProxy) getEndpoint(cx *gin.Context) (*url.URL, error) {
+	if vhost := r.getRequestVirtualHost(cx); vhost != nil {
+		return vhost.endpoint, nil
+	}
+	if r.upstreamTemplate != nil {
+		uc, found := cx.Get(userContextName)
+		if !found {
+			return nil, errors.New("the upstream url is templated, though the request has no identity")
+		}
+		return r.upstreamTemplate.render(uc.(*userContext))
+	}
+
+	return r.endpoint, nil
+}
+
+//
+// getSignInPage returns the sign in page for the request, the page of the virtual host taking precedence
+//
+func (r *oauthProxy) getSignInPage(cx *gin.Context) string {
+	if vhost := r.getRequestVirtualHost(cx); vhost != nil && vhost.SignInPage != "" {
+		return vhost.SignInPage
+	}
+
+	return r.config.SignInPage
+}
+
+//
+// getForbiddenPage returns the forbidden page for the request, the page of the virtual host taking precedence
+//
+func (r *oauthProxy) getForbiddenPage(cx *gin.Context) string {
+	if vhost := r.getRequestVirtualHost(cx); vhost != nil && vhost.ForbiddenPage != "" {
+		return vhost.ForbiddenPage
+	}
+
+	return r.config.ForbiddenPage
+}
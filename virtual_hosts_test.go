@@ -0,0 +1,131 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatchesHostname(t *testing.T) {
+	cases := []struct {
+		Hostname string
+		Host     string
+		Ok       bool
+	}{
+		{Hostname: "example.com", Host: "example.com", Ok: true},
+		{Hostname: "example.com", Host: "Example.com:443", Ok: true},
+		{Hostname: "example.com:8443", Host: "example.com:443"},
+		{Hostname: "example.com", Host: "www.example.com"},
+		{Hostname: "*.apps.example.com", Host: "tenant.apps.example.com", Ok: true},
+		{Hostname: "*.apps.example.com", Host: "a.tenant.apps.example.com:80", Ok: true},
+		{Hostname: "*.apps.example.com", Host: "apps.example.com"},
+		{Hostname: "*.apps.example.com", Host: ".apps.example.com"},
+		{Hostname: "*.apps.example.com", Host: "tenantapps.example.com"},
+	}
+	for i, c := range cases {
+		assert.Equal(t, c.Ok, matchesHostname(c.Hostname, c.Host), "case %d, %s and %s", i, c.Hostname, c.Host)
+	}
+}
+
+func TestGetVirtualHost(t *testing.T) {
+	wildcard := &VirtualHost{Hostnames: []string{"*.apps.example.com"}}
+	exact := &VirtualHost{Hostnames: []string{"admin.apps.example.com", "admin.example.com"}}
+	fallback := &VirtualHost{Default: true}
+	p := &oauthProxy{config: &Config{VirtualHosts: []*VirtualHost{wildcard, exact}}}
+
+	assert.Equal(t, exact, p.getVirtualHost("admin.apps.example.com"))
+	assert.Equal(t, exact, p.getVirtualHost("admin.example.com"))
+	assert.Equal(t, wildcard, p.getVirtualHost("tenant.apps.example.com"))
+	assert.Nil(t, p.getVirtualHost("example.com"))
+
+	p.config.Hostnames = []string{"example.com"}
+	assert.True(t, p.isPermittedHost("example.com"))
+	assert.True(t, p.isPermittedHost("tenant.apps.example.com"))
+	assert.False(t, p.isPermittedHost("www.example.com"))
+
+	p.config.VirtualHosts = append(p.config.VirtualHosts, fallback)
+	assert.Equal(t, fallback, p.getVirtualHost("example.com"))
+	assert.True(t, p.isPermittedHost("www.example.com"))
+}
+
+func TestVirtualHostResources(t *testing.T) {
+	config := newFakeKeycloakConfig()
+	config.VirtualHosts = []*VirtualHost{
+		{
+			Hostnames: []string{"*.apps.example.com"},
+			Upstream:  "http://127.0.0.1:8081",
+			Resources: []*Resource{
+				{URL: fakeAdminRoleURL, Methods: []string{"ANY"}},
+			},
+		},
+	}
+	_, _, u := newTestProxyService(config)
+
+	cases := []struct {
+		Host     string
+		URI      string
+		HTTPCode int
+	}{
+		{URI: fakeAuthAllURL, HTTPCode: http.StatusTemporaryRedirect},
+		// note: the fake upstream doesn't write a response
+		{Host: "tenant.apps.example.com", URI: fakeAuthAllURL, HTTPCode: http.StatusNotFound},
+		{Host: "tenant.apps.example.com", URI: fakeAdminRoleURL, HTTPCode: http.StatusTemporaryRedirect},
+	}
+	for i, c := range cases {
+		request, _ := http.NewRequest("GET", u+c.URI, nil)
+		if c.Host != "" {
+			request.Host = c.Host
+		}
+		resp, err := http.DefaultTransport.RoundTrip(request)
+		if !assert.NoError(t, err, "case %d, unable to make the request", i) {
+			continue
+		}
+		resp.Body.Close()
+		assert.Equal(t, c.HTTPCode, resp.StatusCode, "case %d, expected: %d, got: %d", i, c.HTTPCode, resp.StatusCode)
+	}
+}
+
+func TestVirtualHostSettings(t *testing.T) {
+	tenant := &VirtualHost{
+		Hostnames:  []string{"*.apps.example.com"},
+		SignInPage: "templates/tenant_sign_in.html",
+		Headers:    map[string]string{"X-Site": "tenant"},
+	}
+	p := &oauthProxy{config: &Config{
+		SignInPage:    "templates/sign_in.html",
+		ForbiddenPage: "templates/forbidden.html",
+		Headers:       map[string]string{"X-Site": "default", "X-Proxy": "yes"},
+		VirtualHosts:  []*VirtualHost{tenant},
+	}}
+	handler := p.headersMiddleware(nil)
+
+	cx := newFakeGinContext("GET", "/")
+	assert.Equal(t, "templates/sign_in.html", p.getSignInPage(cx))
+	assert.Equal(t, "templates/forbidden.html", p.getForbiddenPage(cx))
+	handler(cx)
+	assert.Equal(t, "default", cx.Request.Header.Get("X-Site"))
+
+	cx = newFakeGinContext("GET", "/")
+	cx.Request.Host = "tenant.apps.example.com"
+	assert.Equal(t, "templates/tenant_sign_in.html", p.getSignInPage(cx))
+	assert.Equal(t, "templates/forbidden.html", p.getForbiddenPage(cx))
+	handler(cx)
+	assert.Equal(t, []string{"tenant"}, cx.Request.Header["X-Site"])
+	assert.Equal(t, "yes", cx.Request.Header.Get("X-Proxy"))
+}
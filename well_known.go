@@ -0,0 +1,201 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// wellKnownCacheDuration is the time the documents of the provider are cached for
+	wellKnownCacheDuration = time.Duration(5) * time.Minute
+)
+
+//
+// wellKnownDocument is a document retrieved from the provider
+//
+type wellKnownDocument struct {
+	// the content of the document
+	content []byte
+	// the time the document was retrieved
+	fetched time.Time
+}
+
+//
+// wellKnownProxy retrieves and caches the discovery document and keys of the provider, so the browser and mobile
+// clients only need to reach the proxy
+//
+type wellKnownProxy struct {
+	sync.Mutex
+	// the client used to reach the provider
+	client *http.Client
+	// the documents keyed by the location
+	documents map[string]*wellKnownDocument
+}
+
+//
+// newWellKnownProxy creates the proxy of the provider documents
+//
+func newWellKnownProxy(client *http.Client) *wellKnownProxy {
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	return &wellKnownProxy{
+		client:    client,
+		documents: make(map[string]*wellKnownDocument),
+	}
+}
+
+//
+// get returns the document at the location, from the cache unless it has expired; when the provider can't be reached
+// the expired document is served rather than failing the clients
+//
+func (r *wellKnownProxy) get(location string, now time.Time) ([]byte, error) {
+	r.Lock()
+	document, found := r.documents[location]
+	r.Unlock()
+	if found && now.Sub(document.fetched) < wellKnownCacheDuration {
+		return document.content, nil
+	}
+
+	content, err := r.fetch(location)
+	if err != nil {
+		if found {
+			log.WithFields(log.Fields{
+				"location": location,
+				"error":    err.Error(),
+			}).Warnf("unable to refresh the provider document, serving the cached copy")
+
+			return document.content, nil
+		}
+		return nil, err
+	}
+	r.Lock()
+	r.documents[location] = &wellKnownDocument{content: content, fetched: now}
+	r.Unlock()
+
+	return content, nil
+}
+
+//
+// fetch retrieves the document from the provider
+//
+func (r *wellKnownProxy) fetch(location string) ([]byte, error) {
+	resp, err := r.client.Get(location)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected response from the provider, status: %d", resp.StatusCode)
+	}
+
+	return ioutil.ReadAll(resp.Body)
+}
+
+//
+// getPublicURL returns the url of the path as seen by the client, under the redirection url if set
+//
+func (r *oauthProxy) getPublicURL(cx *gin.Context, path string) string {
+	if r.config.RedirectionURL != "" {
+		return strings.TrimSuffix(r.config.RedirectionURL, "/") + path
+	}
+	location := getRequestURL(cx)
+	location.Path = path
+
+	return location.String()
+}
+
+//
+// discoveryHandler serves the discovery document of the provider, with the keys (and token endpoint when passed
+// through) served by the proxy and the endpoints rebased onto the external discovery url if set
+//
+func (r *oauthProxy) discoveryHandler(cx *gin.Context) {
+	content, err := r.wellKnown.get(strings.TrimSuffix(r.config.DiscoveryURL, "/")+"/.well-known/openid-configuration", time.Now())
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err.Error(),
+		}).Errorf("unable to retrieve the discovery document from the provider")
+
+		cx.AbortWithStatus(http.StatusBadGateway)
+		return
+	}
+	document := make(map[string]interface{})
+	if err := json.Unmarshal(content, &document); err != nil {
+		log.WithFields(log.Fields{
+			"error": err.Error(),
+		}).Errorf("unable to decode the discovery document from the provider")
+
+		cx.AbortWithStatus(http.StatusBadGateway)
+		return
+	}
+
+	// step: rebase the endpoints the clients are sent to
+	if r.config.ExternalDiscoveryURL != "" {
+		for k, v := range document {
+			if value, ok := v.(string); ok {
+				if location, err := url.Parse(value); err == nil && location.IsAbs() {
+					document[k] = rebaseURL(location, r.config.DiscoveryURL, r.config.ExternalDiscoveryURL).String()
+				}
+			}
+		}
+	}
+	// note: the issuer must remain the one in the tokens
+	if r.provider.Issuer != nil {
+		document["issuer"] = r.provider.Issuer.String()
+	}
+	document["jwks_uri"] = r.getPublicURL(cx, oauthURL+jwksURL)
+	if r.passthrough != nil {
+		document["token_endpoint"] = r.getPublicURL(cx, oauthURL+providerTokenURL)
+	}
+
+	cx.Header("Cache-Control", fmt.Sprintf("public, max-age=%d", int(wellKnownCacheDuration.Seconds())))
+	cx.JSON(http.StatusOK, document)
+}
+
+//
+// jwksHandler serves the signing keys of the provider
+//
+func (r *oauthProxy) jwksHandler(cx *gin.Context) {
+	if r.provider.KeysEndpoint == nil {
+		cx.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	content, err := r.wellKnown.get(r.provider.KeysEndpoint.String(), time.Now())
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err.Error(),
+		}).Errorf("unable to retrieve the signing keys from the provider")
+
+		cx.AbortWithStatus(http.StatusBadGateway)
+		return
+	}
+
+	cx.Header("Cache-Control", fmt.Sprintf("public, max-age=%d", int(wellKnownCacheDuration.Seconds())))
+	cx.Data(http.StatusOK, "application/json", content)
+}
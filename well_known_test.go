@@ -0,0 +1,80 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiscoveryProxy(t *testing.T) {
+	config := newFakeKeycloakConfig()
+	config.EnableDiscoveryProxy = true
+	p, _, u := newTestProxyService(config)
+
+	resp, err := http.Get(u + oauthURL + discoveryURL)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	document := make(map[string]interface{})
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&document))
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, u+oauthURL+jwksURL, document["jwks_uri"])
+	assert.Equal(t, p.provider.Issuer.String(), document["issuer"])
+	assert.Equal(t, p.provider.AuthEndpoint.String(), document["authorization_endpoint"])
+
+	resp, err = http.Get(u + oauthURL + jwksURL)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	content, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, string(content), `"keys"`)
+}
+
+func TestWellKnownProxyCache(t *testing.T) {
+	requests := 0
+	provider := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requests++
+		if requests > 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"keys":[]}`))
+	}))
+	defer provider.Close()
+
+	proxy := newWellKnownProxy(nil)
+	now := time.Now()
+	for _, x := range []time.Time{now, now.Add(time.Minute), now.Add(wellKnownCacheDuration)} {
+		content, err := proxy.get(provider.URL, x)
+		assert.NoError(t, err)
+		assert.Equal(t, `{"keys":[]}`, string(content))
+	}
+	// step: the expired copy is served while the provider is failing
+	assert.Equal(t, 2, requests)
+
+	_, err := newWellKnownProxy(nil).get(provider.URL, now)
+	assert.Error(t, err)
+}
@@ -0,0 +1,458 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	// the hashes of the signature methods
+	_ "crypto/sha1"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+)
+
+const (
+	xmlnsDSig = "http://www.w3.org/2000/09/xmldsig#"
+	xmlnsXML  = "http://www.w3.org/XML/1998/namespace"
+
+	// xmlExcC14N is exclusive canonicalization (without comments), the only canonicalization supported
+	xmlExcC14N = "http://www.w3.org/2001/10/xml-exc-c14n#"
+	// xmlEnvelopedSignature is the transform removing the signature from the signed element
+	xmlEnvelopedSignature = "http://www.w3.org/2000/09/xmldsig#enveloped-signature"
+)
+
+// xmlSignatureMethods are the signature algorithms supported
+var xmlSignatureMethods = map[string]crypto.Hash{
+	"http://www.w3.org/2000/09/xmldsig#rsa-sha1":        crypto.SHA1,
+	"http://www.w3.org/2001/04/xmldsig-more#rsa-sha256": crypto.SHA256,
+	"http://www.w3.org/2001/04/xmldsig-more#rsa-sha512": crypto.SHA512,
+}
+
+// xmlDigestMethods are the digest algorithms supported
+var xmlDigestMethods = map[string]crypto.Hash{
+	"http://www.w3.org/2000/09/xmldsig#sha1":  crypto.SHA1,
+	"http://www.w3.org/2001/04/xmlenc#sha256": crypto.SHA256,
+	"http://www.w3.org/2001/04/xmlenc#sha512": crypto.SHA512,
+}
+
+// errXMLNotSigned indicates the element has no signature
+var errXMLNotSigned = errors.New("the element is not signed")
+
+//
+// xmlElement is a element of a parsed document, retaining the prefixes and namespace declarations as written so
+// the element can be canonicalized
+//
+type xmlElement struct {
+	// the prefix of the name
+	prefix string
+	// the local name
+	name string
+	// the attributes, excluding the namespace declarations
+	attrs []xml.Attr
+	// the namespaces declared on the element, by prefix, the default being empty
+	namespaces map[string]string
+	// the parent element
+	parent *xmlElement
+	// the child elements (*xmlElement) and text (string)
+	children []interface{}
+}
+
+//
+// parseXMLDocument parses the document into the element tree; document types are refused, so no entities
+//
+func parseXMLDocument(content []byte) (*xmlElement, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(content))
+	var root, current *xmlElement
+	for {
+		token, err := decoder.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			element := &xmlElement{prefix: t.Name.Space, name: t.Name.Local, namespaces: make(map[string]string), parent: current}
+			for _, x := range t.Attr {
+				switch {
+				case x.Name.Space == "xmlns":
+					element.namespaces[x.Name.Local] = x.Value
+				case x.Name.Space == "" && x.Name.Local == "xmlns":
+					element.namespaces[""] = x.Value
+				default:
+					element.attrs = append(element.attrs, x)
+				}
+			}
+			if current == nil {
+				if root != nil {
+					return nil, errors.New("the document has more than one root element")
+				}
+				root = element
+			} else {
+				current.children = append(current.children, element)
+			}
+			current = element
+		case xml.EndElement:
+			if current == nil || t.Name.Space != current.prefix || t.Name.Local != current.name {
+				return nil, fmt.Errorf("unexpected end element: %s", t.Name.Local)
+			}
+			current = current.parent
+		case xml.CharData:
+			if current != nil {
+				current.children = append(current.children, string(t))
+			}
+		case xml.Directive:
+			return nil, errors.New("document types are not permitted")
+		}
+	}
+	if root == nil || current != nil {
+		return nil, errors.New("the document is incomplete")
+	}
+
+	return root, nil
+}
+
+//
+// lookupNamespace returns the namespace of the prefix in scope of the element
+//
+func (r *xmlElement) lookupNamespace(prefix string) string {
+	if prefix == "xml" {
+		return xmlnsXML
+	}
+	for x := r; x != nil; x = x.parent {
+		if uri, found := x.namespaces[prefix]; found {
+			return uri
+		}
+	}
+
+	return ""
+}
+
+//
+// is checks the namespace and local name of the element
+//
+func (r *xmlElement) is(space, name string) bool {
+	return r.name == name && r.lookupNamespace(r.prefix) == space
+}
+
+//
+// getChildren returns the child elements of the namespace and name
+//
+func (r *xmlElement) getChildren(space, name string) []*xmlElement {
+	var list []*xmlElement
+	for _, x := range r.children {
+		if child, ok := x.(*xmlElement); ok && child.is(space, name) {
+			list = append(list, child)
+		}
+	}
+
+	return list
+}
+
+//
+// getChild returns the first child element of the namespace and name, or nil
+//
+func (r *xmlElement) getChild(space, name string) *xmlElement {
+	if list := r.getChildren(space, name); len(list) > 0 {
+		return list[0]
+	}
+
+	return nil
+}
+
+//
+// getAttr returns the value of the unqualified attribute
+//
+func (r *xmlElement) getAttr(name string) string {
+	for _, x := range r.attrs {
+		if x.Name.Space == "" && x.Name.Local == name {
+			return x.Value
+		}
+	}
+
+	return ""
+}
+
+//
+// getText returns the text content of the element
+//
+func (r *xmlElement) getText() string {
+	var text bytes.Buffer
+	for _, x := range r.children {
+		switch v := x.(type) {
+		case string:
+			text.WriteString(v)
+		case *xmlElement:
+			text.WriteString(v.getText())
+		}
+	}
+
+	return text.String()
+}
+
+//
+// canonicalize returns the exclusive canonicalization of the element, without the excluded element (i.e. the
+// enveloped signature) and with the namespaces of the inclusive prefixes
+//
+func canonicalize(element, excluded *xmlElement, inclusive []string) []byte {
+	content := &bytes.Buffer{}
+	writeCanonical(content, element, excluded, inclusive, map[string]string{})
+
+	return content.Bytes()
+}
+
+//
+// writeCanonical writes the element in canonical form, the rendered being the namespaces declared by the output
+// ancestors
+//
+func writeCanonical(w *bytes.Buffer, element, excluded *xmlElement, inclusive []string, rendered map[string]string) {
+	// step: the namespaces visibly utilized by the element and its attributes are declared, unless already declared
+	// by a output ancestor
+	used := []string{element.prefix}
+	for _, x := range element.attrs {
+		if x.Name.Space != "" {
+			used = append(used, x.Name.Space)
+		}
+	}
+	for _, x := range inclusive {
+		if x == "#default" {
+			x = ""
+		}
+		if element.lookupNamespace(x) != "" {
+			used = append(used, x)
+		}
+	}
+	scope := make(map[string]string, len(rendered))
+	for k, v := range rendered {
+		scope[k] = v
+	}
+	var declared []string
+	for _, prefix := range used {
+		if prefix == "xml" || containedIn(prefix, declared) {
+			continue
+		}
+		uri := element.lookupNamespace(prefix)
+		current, found := rendered[prefix]
+		if (found && current == uri) || (!found && uri == "") {
+			continue
+		}
+		declared = append(declared, prefix)
+		scope[prefix] = uri
+	}
+	sort.Strings(declared)
+
+	w.WriteString("<" + getQualifiedName(element.prefix, element.name))
+	for _, prefix := range declared {
+		name := "xmlns"
+		if prefix != "" {
+			name += ":" + prefix
+		}
+		w.WriteString(" " + name + `="` + escapeCanonicalAttr(scope[prefix]) + `"`)
+	}
+
+	// step: the attributes are sorted by the namespace then the local name, the unqualified ones first
+	attrs := append([]xml.Attr{}, element.attrs...)
+	sort.Stable(canonicalAttrs{element: element, attrs: attrs})
+	for _, x := range attrs {
+		w.WriteString(" " + getQualifiedName(x.Name.Space, x.Name.Local) + `="` + escapeCanonicalAttr(x.Value) + `"`)
+	}
+	w.WriteString(">")
+
+	for _, x := range element.children {
+		switch v := x.(type) {
+		case string:
+			w.WriteString(escapeCanonicalText(v))
+		case *xmlElement:
+			if v != excluded {
+				writeCanonical(w, v, excluded, inclusive, scope)
+			}
+		}
+	}
+	w.WriteString("</" + getQualifiedName(element.prefix, element.name) + ">")
+}
+
+func getQualifiedName(prefix, name string) string {
+	if prefix == "" {
+		return name
+	}
+
+	return prefix + ":" + name
+}
+
+var canonicalTextReplacer = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", "\r", "&#xD;")
+
+var canonicalAttrReplacer = strings.NewReplacer("&", "&amp;", "<", "&lt;", `"`, "&quot;", "\t", "&#x9;", "\n", "&#xA;", "\r", "&#xD;")
+
+func escapeCanonicalText(value string) string {
+	return canonicalTextReplacer.Replace(value)
+}
+
+func escapeCanonicalAttr(value string) string {
+	return canonicalAttrReplacer.Replace(value)
+}
+
+//
+// verifyXMLSignature verifies the enveloped signature of the element with one of the certificates; the signature
+// must reference the element itself, so a signature can't be moved onto another element
+//
+func verifyXMLSignature(element *xmlElement, certificates []*x509.Certificate) error {
+	signature := element.getChild(xmlnsDSig, "Signature")
+	if signature == nil {
+		return errXMLNotSigned
+	}
+	signedInfo := signature.getChild(xmlnsDSig, "SignedInfo")
+	if signedInfo == nil {
+		return errors.New("the signature has no signed info")
+	}
+
+	// step: check the algorithms of the signed info
+	method := signedInfo.getChild(xmlnsDSig, "CanonicalizationMethod")
+	if method == nil || method.getAttr("Algorithm") != xmlExcC14N {
+		return errors.New("unsupported canonicalization method, only exclusive canonicalization is supported")
+	}
+	signatureMethod := signedInfo.getChild(xmlnsDSig, "SignatureMethod")
+	if signatureMethod == nil {
+		return errors.New("the signature has no signature method")
+	}
+	signatureHash, found := xmlSignatureMethods[signatureMethod.getAttr("Algorithm")]
+	if !found {
+		return fmt.Errorf("unsupported signature method: %s", signatureMethod.getAttr("Algorithm"))
+	}
+
+	// step: check the reference is to the element
+	references := signedInfo.getChildren(xmlnsDSig, "Reference")
+	if len(references) != 1 {
+		return errors.New("the signature must have a single reference")
+	}
+	reference := references[0]
+	if id := element.getAttr("ID"); id == "" || reference.getAttr("URI") != "#"+id {
+		return errors.New("the signature does not reference the signed element")
+	}
+	var inclusive []string
+	if transforms := reference.getChild(xmlnsDSig, "Transforms"); transforms != nil {
+		for _, x := range transforms.getChildren(xmlnsDSig, "Transform") {
+			switch x.getAttr("Algorithm") {
+			case xmlEnvelopedSignature:
+			case xmlExcC14N:
+				inclusive = getInclusivePrefixes(x)
+			default:
+				return fmt.Errorf("unsupported signature transform: %s", x.getAttr("Algorithm"))
+			}
+		}
+	}
+
+	// step: verify the digest of the element
+	digestMethod := reference.getChild(xmlnsDSig, "DigestMethod")
+	if digestMethod == nil {
+		return errors.New("the reference has no digest method")
+	}
+	digestHash, found := xmlDigestMethods[digestMethod.getAttr("Algorithm")]
+	if !found {
+		return fmt.Errorf("unsupported digest method: %s", digestMethod.getAttr("Algorithm"))
+	}
+	digestValue := reference.getChild(xmlnsDSig, "DigestValue")
+	if digestValue == nil {
+		return errors.New("the reference has no digest value")
+	}
+	expected, err := decodeXMLBase64(digestValue.getText())
+	if err != nil {
+		return errors.New("the digest value is not base64 encoded")
+	}
+	digest := digestHash.New()
+	digest.Write(canonicalize(element, signature, inclusive))
+	if !bytes.Equal(digest.Sum(nil), expected) {
+		return errors.New("the digest of the signed element is invalid")
+	}
+
+	// step: verify the signature of the signed info
+	signatureValue := signature.getChild(xmlnsDSig, "SignatureValue")
+	if signatureValue == nil {
+		return errors.New("the signature has no signature value")
+	}
+	value, err := decodeXMLBase64(signatureValue.getText())
+	if err != nil {
+		return errors.New("the signature value is not base64 encoded")
+	}
+	hashed := signatureHash.New()
+	hashed.Write(canonicalize(signedInfo, nil, getInclusivePrefixes(method)))
+	for _, x := range certificates {
+		if key, ok := x.PublicKey.(*rsa.PublicKey); ok && rsa.VerifyPKCS1v15(key, signatureHash, hashed.Sum(nil), value) == nil {
+			return nil
+		}
+	}
+
+	return errors.New("the signature is not valid for any of the certificates")
+}
+
+//
+// getInclusivePrefixes returns the prefix list of the exclusive canonicalization
+//
+func getInclusivePrefixes(method *xmlElement) []string {
+	if x := method.getChild(xmlExcC14N, "InclusiveNamespaces"); x != nil {
+		return strings.Fields(x.getAttr("PrefixList"))
+	}
+
+	return nil
+}
+
+//
+// decodeXMLBase64 decodes the base64 content of a element, which may be wrapped
+//
+func decodeXMLBase64(content string) ([]byte, error) {
+	return base64.StdEncoding.DecodeString(strings.Join(strings.Fields(content), ""))
+}
+
+//
+// canonicalAttrs sorts the attributes of the element by the namespace then the local name, the unqualified ones first
+//
+type canonicalAttrs struct {
+	// the element the prefixes are resolved against
+	element *xmlElement
+	// the attributes being sorted
+	attrs []xml.Attr
+}
+
+func (s canonicalAttrs) Len() int      { return len(s.attrs) }
+func (s canonicalAttrs) Swap(i, j int) { s.attrs[i], s.attrs[j] = s.attrs[j], s.attrs[i] }
+func (s canonicalAttrs) Less(i, j int) bool {
+	a, b := s.namespace(i), s.namespace(j)
+	if a != b {
+		return a < b
+	}
+	return s.attrs[i].Name.Local < s.attrs[j].Name.Local
+}
+
+//
+// namespace returns the namespace of the attribute, empty when unqualified
+//
+func (s canonicalAttrs) namespace(i int) string {
+	if s.attrs[i].Name.Space == "" {
+		return ""
+	}
+
+	return s.element.lookupNamespace(s.attrs[i].Name.Space)
+}
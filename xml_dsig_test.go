@@ -0,0 +1,192 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newFakeSigningKey(t *testing.T) (*rsa.PrivateKey, *x509.Certificate) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "fake idp"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	content, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	certificate, _ := x509.ParseCertificate(content)
+
+	return key, certificate
+}
+
+// newFakeXMLSignature returns the enveloped signature of the element, from the canonical form of the element
+func newFakeXMLSignature(key *rsa.PrivateKey, id string, canonical []byte) string {
+	digest := sha256.Sum256(canonical)
+	signedInfo := `<ds:CanonicalizationMethod Algorithm="` + xmlExcC14N + `"></ds:CanonicalizationMethod>` +
+		`<ds:SignatureMethod Algorithm="http://www.w3.org/2001/04/xmldsig-more#rsa-sha256"></ds:SignatureMethod>` +
+		`<ds:Reference URI="#` + id + `"><ds:Transforms>` +
+		`<ds:Transform Algorithm="` + xmlEnvelopedSignature + `"></ds:Transform>` +
+		`<ds:Transform Algorithm="` + xmlExcC14N + `"></ds:Transform></ds:Transforms>` +
+		`<ds:DigestMethod Algorithm="http://www.w3.org/2001/04/xmlenc#sha256"></ds:DigestMethod>` +
+		`<ds:DigestValue>` + base64.StdEncoding.EncodeToString(digest[:]) + `</ds:DigestValue></ds:Reference>`
+	hashed := sha256.Sum256([]byte(`<ds:SignedInfo xmlns:ds="` + xmlnsDSig + `">` + signedInfo + `</ds:SignedInfo>`))
+	signature, _ := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hashed[:])
+
+	return `<ds:Signature xmlns:ds="` + xmlnsDSig + `"><ds:SignedInfo>` + signedInfo + `</ds:SignedInfo>` +
+		`<ds:SignatureValue>` + base64.StdEncoding.EncodeToString(signature) + `</ds:SignatureValue></ds:Signature>`
+}
+
+func TestParseXMLDocument(t *testing.T) {
+	root, err := parseXMLDocument([]byte(`<?xml version="1.0"?><a:doc xmlns:a="urn:a"><a:item ID="1">x<b>y</b></a:item></a:doc>`))
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	assert.True(t, root.is("urn:a", "doc"))
+	item := root.getChild("urn:a", "item")
+	if assert.NotNil(t, item) {
+		assert.Equal(t, "1", item.getAttr("ID"))
+		assert.Equal(t, "xy", item.getText())
+		assert.NotNil(t, item.getChild("", "b"))
+	}
+	assert.Nil(t, root.getChild("urn:b", "item"))
+
+	for i, x := range []string{
+		`<!DOCTYPE doc [<!ENTITY x "y">]><doc>&x;</doc>`,
+		`<doc></other>`,
+		`<doc>`,
+		`<doc></doc><doc></doc>`,
+		``,
+	} {
+		_, err := parseXMLDocument([]byte(x))
+		assert.Error(t, err, "case %d should have failed", i)
+	}
+}
+
+func TestCanonicalize(t *testing.T) {
+	cases := []struct {
+		Document  string
+		Path      []string
+		Inclusive []string
+		Expected  string
+	}{
+		// the examples of the exclusive canonicalization specification
+		{
+			Document: `<n0:local xmlns:n0="foo:bar" xmlns:n3="ftp://example.org"><n1:elem2 xmlns:n1="http://example.net" xml:lang="en"><n3:stuff xmlns:n3="ftp://example.org"/></n1:elem2></n0:local>`,
+			Path:     []string{"elem2"},
+			Expected: `<n1:elem2 xmlns:n1="http://example.net" xml:lang="en"><n3:stuff xmlns:n3="ftp://example.org"></n3:stuff></n1:elem2>`,
+		},
+		{
+			Document: `<n2:pdu xmlns:n1="http://example.com" xmlns:n2="http://foo.example" xml:lang="fr" xml:space="retain"><n1:elem2 xmlns:n1="http://example.net" xml:lang="en"><n3:stuff xmlns:n3="ftp://example.org"/></n1:elem2></n2:pdu>`,
+			Path:     []string{"elem2"},
+			Expected: `<n1:elem2 xmlns:n1="http://example.net" xml:lang="en"><n3:stuff xmlns:n3="ftp://example.org"></n3:stuff></n1:elem2>`,
+		},
+		{
+			Document: `<doc xmlns:b="http://b" xmlns:a="http://z" b:attr="1" a:attr='2' z="3" attr="&quot;&lt;&amp;&gt;&#9;x">text &amp; &lt; &gt; "quote"<![CDATA[<cdata>]]><!-- comment --><e/></doc>`,
+			Expected: `<doc xmlns:a="http://z" xmlns:b="http://b" attr="&quot;&lt;&amp;>&#x9;x" z="3" b:attr="1" a:attr="2">text &amp; &lt; &gt; "quote"&lt;cdata&gt;<e></e></doc>`,
+		},
+		{
+			Document: `<a xmlns="http://a" xmlns:unused="http://u"><b xmlns=""><c xmlns="http://a"/></b><d xmlns="http://a"/></a>`,
+			Expected: `<a xmlns="http://a"><b xmlns=""><c xmlns="http://a"></c></b><d></d></a>`,
+		},
+		{
+			Document: `<a xmlns="http://a"><b xmlns=""><c xmlns="http://a"/></b></a>`,
+			Path:     []string{"b"},
+			Expected: `<b><c xmlns="http://a"></c></b>`,
+		},
+		{
+			Document:  `<p:a xmlns:p="http://p" xmlns:q="http://q" xmlns:r="http://r"><p:b/></p:a>`,
+			Inclusive: []string{"q"},
+			Expected:  `<p:a xmlns:p="http://p" xmlns:q="http://q"><p:b></p:b></p:a>`,
+		},
+	}
+	for i, c := range cases {
+		element, err := parseXMLDocument([]byte(c.Document))
+		if !assert.NoError(t, err, "case %d, unable to parse the document", i) {
+			continue
+		}
+		for _, x := range c.Path {
+			for _, child := range element.children {
+				if v, ok := child.(*xmlElement); ok && v.name == x {
+					element = v
+				}
+			}
+		}
+		assert.Equal(t, c.Expected, string(canonicalize(element, nil, c.Inclusive)), "case %d, unexpected canonical form", i)
+	}
+}
+
+func TestVerifyXMLSignature(t *testing.T) {
+	key, certificate := newFakeSigningKey(t)
+	other, otherCertificate := newFakeSigningKey(t)
+	// the canonical form of the item in the document below, without the signature
+	canonical := "<x:Item xmlns:x=\"urn:x\" ID=\"_item\" a=\"1\" b=\"2\" x:flag=\"1\">\n  <x:Name>jdoe</x:Name>\n  <x:Empty></x:Empty>\n</x:Item>"
+	document := "<r:Root xmlns:r=\"urn:root\" xmlns:x=\"urn:x\"><x:Item ID='_item' x:flag=\"1\" b=\"2\" a=\"1\">\n  <x:Name>%s</x:Name>\n  %s<x:Empty/>\n</x:Item></r:Root>"
+	signature := newFakeXMLSignature(key, "_item", []byte(canonical))
+
+	cases := []struct {
+		Document     string
+		Certificates []*x509.Certificate
+		Ok           bool
+		Error        error
+	}{
+		{Document: fmt.Sprintf(document, "jdoe", signature), Certificates: []*x509.Certificate{certificate}, Ok: true},
+		{Document: fmt.Sprintf(document, "jdoe", signature), Certificates: []*x509.Certificate{otherCertificate, certificate}, Ok: true},
+		{Document: fmt.Sprintf(document, "jdoe", ""), Certificates: []*x509.Certificate{certificate}, Error: errXMLNotSigned},
+		{Document: fmt.Sprintf(document, "jdoe", signature), Certificates: []*x509.Certificate{otherCertificate}},
+		{Document: fmt.Sprintf(document, "admin", signature), Certificates: []*x509.Certificate{certificate}},
+		{Document: fmt.Sprintf(document, "jdoe", newFakeXMLSignature(other, "_item", []byte(canonical))), Certificates: []*x509.Certificate{certificate}},
+		{Document: fmt.Sprintf(document, "jdoe", newFakeXMLSignature(key, "_other", []byte(canonical))), Certificates: []*x509.Certificate{certificate}},
+		{
+			Document:     fmt.Sprintf(document, "jdoe", strings.Replace(signature, xmlEnvelopedSignature, "http://www.w3.org/TR/1999/REC-xslt-19991116", 1)),
+			Certificates: []*x509.Certificate{certificate},
+		},
+	}
+	for i, c := range cases {
+		root, err := parseXMLDocument([]byte(c.Document))
+		if !assert.NoError(t, err, "case %d, unable to parse the document", i) {
+			continue
+		}
+		err = verifyXMLSignature(root.getChild("urn:x", "Item"), c.Certificates)
+		switch {
+		case c.Ok:
+			assert.NoError(t, err, "case %d should not have failed", i)
+		case c.Error != nil:
+			assert.Equal(t, c.Error, err, "case %d, unexpected error", i)
+		default:
+			assert.Error(t, err, "case %d should have failed", i)
+		}
+	}
+}